@@ -0,0 +1,361 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/errorpb"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/tikvpb"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/store/mockstore/unistore/pd"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+const (
+	maxBackoffAttempts = 20
+	minBackoff         = 2 * time.Millisecond
+	maxBackoff         = 500 * time.Millisecond
+	defaultLockTTL     = 3000
+)
+
+// KVClient is the part of the tikv service used by the transactions, *tikv.Server implements it, so the
+// client can talk to a server in the same process without gRPC.
+type KVClient interface {
+	KvGet(ctx context.Context, req *kvrpcpb.GetRequest) (*kvrpcpb.GetResponse, error)
+	KvPrewrite(ctx context.Context, req *kvrpcpb.PrewriteRequest) (*kvrpcpb.PrewriteResponse, error)
+	KvCommit(ctx context.Context, req *kvrpcpb.CommitRequest) (*kvrpcpb.CommitResponse, error)
+	KvBatchRollback(ctx context.Context, req *kvrpcpb.BatchRollbackRequest) (*kvrpcpb.BatchRollbackResponse, error)
+}
+
+// Connector returns the KVClient of a store.
+type Connector func(ctx context.Context, store *metapb.Store) (KVClient, error)
+
+// InProcessConnector returns a Connector which sends all the requests to the server of the process.
+func InProcessConnector(server KVClient) Connector {
+	return func(context.Context, *metapb.Store) (KVClient, error) {
+		return server, nil
+	}
+}
+
+// GRPCConnector dials the address of the store.
+func GRPCConnector(ctx context.Context, store *metapb.Store) (KVClient, error) {
+	conn, err := grpc.DialContext(ctx, store.Address, grpc.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+	return &grpcKVClient{conn: conn, client: tikvpb.NewTikvClient(conn)}, nil
+}
+
+type grpcKVClient struct {
+	conn   *grpc.ClientConn
+	client tikvpb.TikvClient
+}
+
+func (c *grpcKVClient) KvGet(ctx context.Context, req *kvrpcpb.GetRequest) (*kvrpcpb.GetResponse, error) {
+	return c.client.KvGet(ctx, req)
+}
+
+func (c *grpcKVClient) KvPrewrite(ctx context.Context, req *kvrpcpb.PrewriteRequest) (*kvrpcpb.PrewriteResponse, error) {
+	return c.client.KvPrewrite(ctx, req)
+}
+
+func (c *grpcKVClient) KvCommit(ctx context.Context, req *kvrpcpb.CommitRequest) (*kvrpcpb.CommitResponse, error) {
+	return c.client.KvCommit(ctx, req)
+}
+
+func (c *grpcKVClient) KvBatchRollback(ctx context.Context, req *kvrpcpb.BatchRollbackRequest) (*kvrpcpb.BatchRollbackResponse, error) {
+	return c.client.KvBatchRollback(ctx, req)
+}
+
+// Client is a minimal transactional client for tests, it locates the regions with PD and retries the requests
+// on the region errors. Locks of the other transactions are waited for instead of being resolved.
+type Client struct {
+	pd      pd.Client
+	connect Connector
+	lockTTL uint64
+
+	mu      sync.Mutex
+	regions map[uint64]*cachedRegion
+	stores  map[uint64]KVClient
+}
+
+type cachedRegion struct {
+	meta   *metapb.Region
+	leader *metapb.Peer
+}
+
+func (r *cachedRegion) contains(key []byte) bool {
+	return bytes.Compare(key, r.meta.StartKey) >= 0 &&
+		(len(r.meta.EndKey) == 0 || bytes.Compare(key, r.meta.EndKey) < 0)
+}
+
+// NewClient returns a client which gets the timestamps and the regions from PD.
+func NewClient(pdClient pd.Client, connect Connector) *Client {
+	return &Client{
+		pd:      pdClient,
+		connect: connect,
+		lockTTL: defaultLockTTL,
+		regions: make(map[uint64]*cachedRegion),
+		stores:  make(map[uint64]KVClient),
+	}
+}
+
+// Close closes the gRPC connections of the client.
+func (c *Client) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, store := range c.stores {
+		if g, ok := store.(*grpcKVClient); ok {
+			if err := g.conn.Close(); err != nil {
+				log.Warn("failed to close connection", zap.Uint64("store", id), zap.Error(err))
+			}
+		}
+	}
+	c.stores = make(map[uint64]KVClient)
+}
+
+// Begin starts a transaction.
+func (c *Client) Begin(ctx context.Context) (*Txn, error) {
+	startTS, err := c.getTS(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Txn{c: c, startTS: startTS, mutations: make(map[string]*kvrpcpb.Mutation)}, nil
+}
+
+func (c *Client) getTS(ctx context.Context) (uint64, error) {
+	physical, logical, err := c.pd.GetTS(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(physical)<<18 + uint64(logical), nil
+}
+
+func (c *Client) locate(ctx context.Context, key []byte) (*cachedRegion, error) {
+	c.mu.Lock()
+	for _, r := range c.regions {
+		if r.contains(key) {
+			c.mu.Unlock()
+			return r, nil
+		}
+	}
+	c.mu.Unlock()
+	region, err := c.pd.GetRegion(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if region == nil || region.Meta == nil {
+		return nil, errors.Errorf("region of key %q not found", key)
+	}
+	leader := region.Leader
+	if leader == nil || leader.Id == 0 {
+		if len(region.Meta.Peers) == 0 {
+			return nil, errors.Errorf("region %d has no peer", region.Meta.Id)
+		}
+		leader = region.Meta.Peers[0]
+	}
+	r := &cachedRegion{meta: region.Meta, leader: leader}
+	c.insertRegion(r)
+	return r, nil
+}
+
+// insertRegion replaces the cached regions overlapping with the region.
+func (c *Client) insertRegion(r *cachedRegion) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, old := range c.regions {
+		if (len(old.meta.EndKey) == 0 || bytes.Compare(r.meta.StartKey, old.meta.EndKey) < 0) &&
+			(len(r.meta.EndKey) == 0 || bytes.Compare(old.meta.StartKey, r.meta.EndKey) < 0) {
+			delete(c.regions, id)
+		}
+	}
+	c.regions[r.meta.Id] = r
+}
+
+func (c *Client) invalidateRegion(regionID uint64) {
+	c.mu.Lock()
+	delete(c.regions, regionID)
+	c.mu.Unlock()
+}
+
+func (c *Client) getStore(ctx context.Context, storeID uint64) (KVClient, error) {
+	c.mu.Lock()
+	store := c.stores[storeID]
+	c.mu.Unlock()
+	if store != nil {
+		return store, nil
+	}
+	meta, err := c.pd.GetStore(ctx, storeID)
+	if err != nil {
+		return nil, err
+	}
+	store, err = c.connect(ctx, meta)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old := c.stores[storeID]; old != nil {
+		return old, nil
+	}
+	c.stores[storeID] = store
+	return store, nil
+}
+
+// onRegionError updates the region cache by the error, it returns false if the error can't be retried.
+func (c *Client) onRegionError(r *cachedRegion, regionErr *errorpb.Error) bool {
+	switch {
+	case regionErr.NotLeader != nil:
+		if leader := regionErr.NotLeader.Leader; leader != nil {
+			c.insertRegion(&cachedRegion{meta: r.meta, leader: leader})
+		} else {
+			c.invalidateRegion(r.meta.Id)
+		}
+	case regionErr.EpochNotMatch != nil:
+		c.invalidateRegion(r.meta.Id)
+		for _, meta := range regionErr.EpochNotMatch.CurrentRegions {
+			// The regions are on the store the request is sent to.
+			for _, p := range meta.Peers {
+				if p.StoreId == r.leader.StoreId {
+					c.insertRegion(&cachedRegion{meta: meta, leader: p})
+				}
+			}
+		}
+	case regionErr.RaftEntryTooLarge != nil:
+		return false
+	default:
+		// RegionNotFound, KeyNotInRegion, StoreNotMatch, ServerIsBusy, StaleCommand and the others are retried
+		// after reloading the region.
+		c.invalidateRegion(r.meta.Id)
+	}
+	return true
+}
+
+func (c *Client) requestContext(r *cachedRegion) *kvrpcpb.Context {
+	return &kvrpcpb.Context{
+		RegionId:    r.meta.Id,
+		RegionEpoch: r.meta.RegionEpoch,
+		Peer:        r.leader,
+	}
+}
+
+// batch is a group of the keys in the same region.
+type batch struct {
+	region *cachedRegion
+	keys   [][]byte
+}
+
+func (c *Client) groupKeys(ctx context.Context, keys [][]byte) ([]batch, error) {
+	var batches []batch
+	index := make(map[uint64]int)
+	for _, key := range keys {
+		r, err := c.locate(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		i, ok := index[r.meta.Id]
+		if !ok {
+			i = len(batches)
+			index[r.meta.Id] = i
+			batches = append(batches, batch{region: r})
+		}
+		batches[i].keys = append(batches[i].keys, key)
+	}
+	return batches, nil
+}
+
+// batchFunc sends the request of the keys in a region, it returns the region error to retry the keys.
+type batchFunc func(ctx context.Context, store KVClient, reqCtx *kvrpcpb.Context, keys [][]byte) (*errorpb.Error, error)
+
+// doBatches sends the keys grouped by region, the keys of a batch failed by a region error are grouped again
+// after the region cache is updated.
+func (c *Client) doBatches(ctx context.Context, bo *backoffer, keys [][]byte, f batchFunc) error {
+	batches, err := c.groupKeys(ctx, keys)
+	if err != nil {
+		return err
+	}
+	for _, b := range batches {
+		store, err := c.getStore(ctx, b.region.leader.StoreId)
+		if err != nil {
+			return err
+		}
+		regionErr, err := f(ctx, store, c.requestContext(b.region), b.keys)
+		if _, ok := err.(*KeyError); ok {
+			return err
+		}
+		if err != nil {
+			// The store may be down, locate the region again.
+			c.invalidateRegion(b.region.meta.Id)
+			if err = bo.backoff(ctx, err); err != nil {
+				return err
+			}
+			regionErr = nil
+		} else if regionErr != nil {
+			if !c.onRegionError(b.region, regionErr) {
+				return errors.New(regionErr.String())
+			}
+			if err = bo.backoff(ctx, errors.New(regionErr.String())); err != nil {
+				return err
+			}
+		} else {
+			continue
+		}
+		if err = c.doBatches(ctx, bo, b.keys, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type backoffer struct {
+	attempts int
+	sleep    time.Duration
+}
+
+func (bo *backoffer) backoff(ctx context.Context, cause error) error {
+	bo.attempts++
+	if bo.attempts > maxBackoffAttempts {
+		return errors.Annotatef(cause, "backoff exceeds %d attempts", maxBackoffAttempts)
+	}
+	if bo.sleep == 0 {
+		bo.sleep = minBackoff
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(bo.sleep):
+	}
+	if bo.sleep *= 2; bo.sleep > maxBackoff {
+		bo.sleep = maxBackoff
+	}
+	return nil
+}
+
+// KeyError is a key error returned by the server.
+type KeyError struct {
+	Err *kvrpcpb.KeyError
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("key error: %s", e.Err.String())
+}
+
+// IsConflict returns true if the error is a write conflict, the transaction can be retried.
+func IsConflict(err error) bool {
+	e, ok := errors.Cause(err).(*KeyError)
+	return ok && (e.Err.Conflict != nil || e.Err.Retryable != "")
+}
+
+func sortKeys(keys [][]byte) {
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+}
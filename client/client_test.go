@@ -0,0 +1,270 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/pingcap/kvproto/pkg/errorpb"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/tidb/store/mockstore/unistore/pd"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	pdclient "github.com/tikv/pd/client"
+)
+
+var _ KVClient = (*tikv.Server)(nil)
+
+// mockCluster is a PD and the stores of a cluster, the leaders and the regions known by PD can be stale.
+type mockCluster struct {
+	pd.Client
+
+	mu      sync.Mutex
+	ts      int64
+	regions []*metapb.Region
+	// leaders are the stores of the leaders, pdLeaders are the ones reported to PD.
+	leaders   map[uint64]uint64
+	pdLeaders map[uint64]uint64
+	pdRegions []*metapb.Region
+
+	values map[string][]byte
+	locks  map[string]uint64
+	writes map[string]uint64
+	errs   int
+}
+
+func newMockCluster() *mockCluster {
+	region := &metapb.Region{
+		Id:          1,
+		RegionEpoch: &metapb.RegionEpoch{ConfVer: 1, Version: 1},
+		Peers:       []*metapb.Peer{{Id: 11, StoreId: 1}, {Id: 12, StoreId: 2}},
+	}
+	return &mockCluster{
+		regions:   []*metapb.Region{region},
+		pdRegions: []*metapb.Region{region},
+		leaders:   map[uint64]uint64{1: 1},
+		pdLeaders: map[uint64]uint64{1: 1},
+		values:    make(map[string][]byte),
+		locks:     make(map[string]uint64),
+		writes:    make(map[string]uint64),
+	}
+}
+
+func peerOnStore(region *metapb.Region, storeID uint64) *metapb.Peer {
+	for _, p := range region.Peers {
+		if p.StoreId == storeID {
+			return p
+		}
+	}
+	return nil
+}
+
+func (c *mockCluster) GetTS(ctx context.Context) (int64, int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ts++
+	return c.ts, 0, nil
+}
+
+func (c *mockCluster) GetRegion(ctx context.Context, key []byte) (*pdclient.Region, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, r := range c.pdRegions {
+		if (&cachedRegion{meta: r}).contains(key) {
+			return &pdclient.Region{Meta: r, Leader: peerOnStore(r, c.pdLeaders[r.Id])}, nil
+		}
+	}
+	return nil, nil
+}
+
+func (c *mockCluster) GetStore(ctx context.Context, storeID uint64) (*metapb.Store, error) {
+	return &metapb.Store{Id: storeID}, nil
+}
+
+// split splits the region at the key, PD doesn't know it yet.
+func (c *mockCluster) split(key []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	left := c.regions[0]
+	right := &metapb.Region{
+		Id:          2,
+		StartKey:    key,
+		EndKey:      left.EndKey,
+		RegionEpoch: &metapb.RegionEpoch{ConfVer: 1, Version: 2},
+		Peers:       []*metapb.Peer{{Id: 21, StoreId: 1}, {Id: 22, StoreId: 2}},
+	}
+	c.regions = []*metapb.Region{
+		{Id: 1, EndKey: key, RegionEpoch: &metapb.RegionEpoch{ConfVer: 1, Version: 2}, Peers: left.Peers},
+		right,
+	}
+	c.leaders[2] = c.leaders[1]
+}
+
+func (c *mockCluster) checkRegion(storeID uint64, reqCtx *kvrpcpb.Context, keys [][]byte) *errorpb.Error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, r := range c.regions {
+		if r.Id != reqCtx.RegionId {
+			continue
+		}
+		if leader := c.leaders[r.Id]; leader != storeID {
+			c.errs++
+			return &errorpb.Error{NotLeader: &errorpb.NotLeader{RegionId: r.Id, Leader: peerOnStore(r, leader)}}
+		}
+		if r.RegionEpoch.Version != reqCtx.RegionEpoch.Version {
+			c.errs++
+			return &errorpb.Error{EpochNotMatch: &errorpb.EpochNotMatch{CurrentRegions: c.regions}}
+		}
+		for _, key := range keys {
+			if !(&cachedRegion{meta: r}).contains(key) {
+				c.errs++
+				return &errorpb.Error{KeyNotInRegion: &errorpb.KeyNotInRegion{Key: key}}
+			}
+		}
+		return nil
+	}
+	c.errs++
+	return &errorpb.Error{RegionNotFound: &errorpb.RegionNotFound{RegionId: reqCtx.RegionId}}
+}
+
+type mockStore struct {
+	id uint64
+	c  *mockCluster
+}
+
+func (c *mockCluster) connect(ctx context.Context, store *metapb.Store) (KVClient, error) {
+	return &mockStore{id: store.Id, c: c}, nil
+}
+
+func (s *mockStore) KvGet(ctx context.Context, req *kvrpcpb.GetRequest) (*kvrpcpb.GetResponse, error) {
+	if regionErr := s.c.checkRegion(s.id, req.Context, [][]byte{req.Key}); regionErr != nil {
+		return &kvrpcpb.GetResponse{RegionError: regionErr}, nil
+	}
+	s.c.mu.Lock()
+	defer s.c.mu.Unlock()
+	if lockTS, ok := s.c.locks[string(req.Key)]; ok && lockTS < req.Version {
+		return &kvrpcpb.GetResponse{Error: &kvrpcpb.KeyError{Locked: &kvrpcpb.LockInfo{Key: req.Key, LockVersion: lockTS}}}, nil
+	}
+	val, ok := s.c.values[string(req.Key)]
+	return &kvrpcpb.GetResponse{Value: val, NotFound: !ok}, nil
+}
+
+func (s *mockStore) KvPrewrite(ctx context.Context, req *kvrpcpb.PrewriteRequest) (*kvrpcpb.PrewriteResponse, error) {
+	var keys [][]byte
+	for _, m := range req.Mutations {
+		keys = append(keys, m.Key)
+	}
+	if regionErr := s.c.checkRegion(s.id, req.Context, keys); regionErr != nil {
+		return &kvrpcpb.PrewriteResponse{RegionError: regionErr}, nil
+	}
+	s.c.mu.Lock()
+	defer s.c.mu.Unlock()
+	for _, m := range req.Mutations {
+		if commitTS := s.c.writes[string(m.Key)]; commitTS > req.StartVersion {
+			conflict := &kvrpcpb.WriteConflict{StartTs: req.StartVersion, ConflictCommitTs: commitTS, Key: m.Key}
+			return &kvrpcpb.PrewriteResponse{Errors: []*kvrpcpb.KeyError{{Conflict: conflict}}}, nil
+		}
+	}
+	for _, m := range req.Mutations {
+		s.c.locks[string(m.Key)] = req.StartVersion
+	}
+	return &kvrpcpb.PrewriteResponse{}, nil
+}
+
+func (s *mockStore) KvCommit(ctx context.Context, req *kvrpcpb.CommitRequest) (*kvrpcpb.CommitResponse, error) {
+	if regionErr := s.c.checkRegion(s.id, req.Context, req.Keys); regionErr != nil {
+		return &kvrpcpb.CommitResponse{RegionError: regionErr}, nil
+	}
+	s.c.mu.Lock()
+	defer s.c.mu.Unlock()
+	for _, key := range req.Keys {
+		delete(s.c.locks, string(key))
+		s.c.writes[string(key)] = req.CommitVersion
+	}
+	return &kvrpcpb.CommitResponse{}, nil
+}
+
+func (s *mockStore) KvBatchRollback(ctx context.Context, req *kvrpcpb.BatchRollbackRequest) (*kvrpcpb.BatchRollbackResponse, error) {
+	if regionErr := s.c.checkRegion(s.id, req.Context, req.Keys); regionErr != nil {
+		return &kvrpcpb.BatchRollbackResponse{RegionError: regionErr}, nil
+	}
+	s.c.mu.Lock()
+	defer s.c.mu.Unlock()
+	for _, key := range req.Keys {
+		if s.c.locks[string(key)] == req.StartVersion {
+			delete(s.c.locks, string(key))
+		}
+	}
+	return &kvrpcpb.BatchRollbackResponse{}, nil
+}
+
+func TestTxn(t *testing.T) {
+	ctx := context.Background()
+	cluster := newMockCluster()
+	c := NewClient(cluster, cluster.connect)
+	defer c.Close()
+
+	txn, err := c.Begin(ctx)
+	require.Nil(t, err)
+	_, err = txn.Get(ctx, []byte("a"))
+	assert.Equal(t, ErrNotFound, err)
+	require.Nil(t, txn.Set([]byte("a"), []byte("1")))
+	require.Nil(t, txn.Set([]byte("z"), []byte("2")))
+	val, err := txn.Get(ctx, []byte("a"))
+	require.Nil(t, err)
+	assert.Equal(t, []byte("1"), val)
+	require.Nil(t, txn.Commit(ctx))
+	assert.Equal(t, ErrTxnDone, txn.Commit(ctx))
+	assert.Empty(t, cluster.locks)
+
+	// The leader is transferred and the region is split, PD knows neither of them.
+	cluster.leaders[1] = 2
+	cluster.split([]byte("m"))
+	txn, err = c.Begin(ctx)
+	require.Nil(t, err)
+	require.Nil(t, txn.Set([]byte("b"), []byte("3")))
+	require.Nil(t, txn.Set([]byte("y"), []byte("4")))
+	require.Nil(t, txn.Delete([]byte("a")))
+	require.Nil(t, txn.Commit(ctx))
+	assert.Empty(t, cluster.locks)
+	assert.True(t, cluster.errs >= 2)
+	c.mu.Lock()
+	assert.Len(t, c.regions, 2)
+	for _, r := range c.regions {
+		assert.Equal(t, uint64(2), r.leader.StoreId)
+		assert.Equal(t, uint64(2), r.meta.RegionEpoch.Version)
+	}
+	c.mu.Unlock()
+
+	// A transaction started before a commit conflicts and its locks are rolled back.
+	txn1, err := c.Begin(ctx)
+	require.Nil(t, err)
+	txn2, err := c.Begin(ctx)
+	require.Nil(t, err)
+	require.Nil(t, txn1.Set([]byte("c"), []byte("5")))
+	require.Nil(t, txn2.Set([]byte("c"), []byte("6")))
+	require.Nil(t, txn2.Set([]byte("d"), []byte("6")))
+	require.Nil(t, txn2.Commit(ctx))
+	err = txn1.Commit(ctx)
+	assert.True(t, IsConflict(err))
+	assert.Empty(t, cluster.locks)
+
+	// A read waits for the lock of the other transaction.
+	cluster.mu.Lock()
+	cluster.locks["c"] = 1
+	cluster.values["c"] = []byte("6")
+	cluster.mu.Unlock()
+	txn, err = c.Begin(ctx)
+	require.Nil(t, err)
+	go func() {
+		cluster.mu.Lock()
+		delete(cluster.locks, "c")
+		cluster.mu.Unlock()
+	}()
+	val, err = txn.Get(ctx, []byte("c"))
+	require.Nil(t, err)
+	assert.True(t, bytes.Equal([]byte("6"), val))
+}
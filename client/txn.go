@@ -0,0 +1,205 @@
+package client
+
+import (
+	"context"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/errorpb"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrNotFound is returned by Txn.Get if the key doesn't exist.
+	ErrNotFound = errors.New("key not found")
+	// ErrTxnDone is returned if the transaction is already committed or rolled back.
+	ErrTxnDone = errors.New("transaction is done")
+)
+
+// Txn is an optimistic transaction, the mutations are buffered until Commit.
+type Txn struct {
+	c         *Client
+	startTS   uint64
+	mutations map[string]*kvrpcpb.Mutation
+	done      bool
+}
+
+// StartTS returns the start timestamp of the transaction.
+func (txn *Txn) StartTS() uint64 {
+	return txn.startTS
+}
+
+// Get returns the value of the key, the locks of the other transactions are waited for until they are
+// committed or rolled back.
+func (txn *Txn) Get(ctx context.Context, key []byte) ([]byte, error) {
+	if txn.done {
+		return nil, ErrTxnDone
+	}
+	if m, ok := txn.mutations[string(key)]; ok {
+		if m.Op == kvrpcpb.Op_Del {
+			return nil, ErrNotFound
+		}
+		return m.Value, nil
+	}
+	bo := new(backoffer)
+	for {
+		var resp *kvrpcpb.GetResponse
+		err := txn.c.doBatches(ctx, bo, [][]byte{key}, func(ctx context.Context, store KVClient, reqCtx *kvrpcpb.Context, _ [][]byte) (*errorpb.Error, error) {
+			var err error
+			resp, err = store.KvGet(ctx, &kvrpcpb.GetRequest{Context: reqCtx, Key: key, Version: txn.startTS})
+			if err != nil {
+				return nil, err
+			}
+			return resp.RegionError, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if keyErr := resp.Error; keyErr != nil {
+			if keyErr.Locked == nil {
+				return nil, &KeyError{Err: keyErr}
+			}
+			if err = bo.backoff(ctx, &KeyError{Err: keyErr}); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if resp.NotFound {
+			return nil, ErrNotFound
+		}
+		return resp.Value, nil
+	}
+}
+
+// Set sets the value of the key.
+func (txn *Txn) Set(key, value []byte) error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	txn.mutations[string(key)] = &kvrpcpb.Mutation{Op: kvrpcpb.Op_Put, Key: key, Value: value}
+	return nil
+}
+
+// Delete deletes the key.
+func (txn *Txn) Delete(key []byte) error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	txn.mutations[string(key)] = &kvrpcpb.Mutation{Op: kvrpcpb.Op_Del, Key: key}
+	return nil
+}
+
+// Rollback discards the mutations of the transaction.
+func (txn *Txn) Rollback() {
+	txn.done = true
+	txn.mutations = nil
+}
+
+// Commit commits the mutations with two phase commit. The smallest key is the primary key, the transaction is
+// committed once the primary key is committed, the failures of committing the secondary keys are only logged.
+func (txn *Txn) Commit(ctx context.Context) error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	txn.done = true
+	if len(txn.mutations) == 0 {
+		return nil
+	}
+	keys := make([][]byte, 0, len(txn.mutations))
+	for _, m := range txn.mutations {
+		keys = append(keys, m.Key)
+	}
+	sortKeys(keys)
+	primary := keys[0]
+	if err := txn.prewrite(ctx, keys, primary); err != nil {
+		txn.rollback(ctx, keys)
+		return err
+	}
+	commitTS, err := txn.c.getTS(ctx)
+	if err != nil {
+		txn.rollback(ctx, keys)
+		return err
+	}
+	if err = txn.commit(ctx, [][]byte{primary}, commitTS); err != nil {
+		txn.rollback(ctx, keys)
+		return err
+	}
+	if len(keys) > 1 {
+		if err = txn.commit(ctx, keys[1:], commitTS); err != nil {
+			log.Warn("failed to commit secondary keys", zap.Uint64("start ts", txn.startTS), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+func (txn *Txn) prewrite(ctx context.Context, keys [][]byte, primary []byte) error {
+	return txn.c.doBatches(ctx, new(backoffer), keys, func(ctx context.Context, store KVClient, reqCtx *kvrpcpb.Context, keys [][]byte) (*errorpb.Error, error) {
+		req := &kvrpcpb.PrewriteRequest{
+			Context:      reqCtx,
+			PrimaryLock:  primary,
+			StartVersion: txn.startTS,
+			LockTtl:      txn.c.lockTTL,
+			TxnSize:      uint64(len(txn.mutations)),
+		}
+		for _, key := range keys {
+			req.Mutations = append(req.Mutations, txn.mutations[string(key)])
+		}
+		resp, err := store.KvPrewrite(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.RegionError != nil {
+			return resp.RegionError, nil
+		}
+		if len(resp.Errors) > 0 {
+			return nil, &KeyError{Err: resp.Errors[0]}
+		}
+		return nil, nil
+	})
+}
+
+func (txn *Txn) commit(ctx context.Context, keys [][]byte, commitTS uint64) error {
+	return txn.c.doBatches(ctx, new(backoffer), keys, func(ctx context.Context, store KVClient, reqCtx *kvrpcpb.Context, keys [][]byte) (*errorpb.Error, error) {
+		resp, err := store.KvCommit(ctx, &kvrpcpb.CommitRequest{
+			Context:       reqCtx,
+			StartVersion:  txn.startTS,
+			Keys:          keys,
+			CommitVersion: commitTS,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if resp.RegionError != nil {
+			return resp.RegionError, nil
+		}
+		if resp.Error != nil {
+			return nil, &KeyError{Err: resp.Error}
+		}
+		return nil, nil
+	})
+}
+
+// rollback removes the locks of the transaction, the locks left by a failure expire after the lock TTL.
+func (txn *Txn) rollback(ctx context.Context, keys [][]byte) {
+	err := txn.c.doBatches(ctx, new(backoffer), keys, func(ctx context.Context, store KVClient, reqCtx *kvrpcpb.Context, keys [][]byte) (*errorpb.Error, error) {
+		resp, err := store.KvBatchRollback(ctx, &kvrpcpb.BatchRollbackRequest{
+			Context:      reqCtx,
+			StartVersion: txn.startTS,
+			Keys:         keys,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if resp.RegionError != nil {
+			return resp.RegionError, nil
+		}
+		if resp.Error != nil {
+			return nil, &KeyError{Err: resp.Error}
+		}
+		return nil, nil
+	})
+	if err != nil {
+		log.Warn("failed to rollback", zap.Uint64("start ts", txn.startTS), zap.Error(err))
+	}
+}
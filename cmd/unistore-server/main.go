@@ -14,6 +14,7 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"net"
@@ -28,6 +29,7 @@ import (
 
 	"github.com/BurntSushi/toml"
 	"github.com/ngaut/unistore/config"
+	"github.com/ngaut/unistore/raftstore"
 	"github.com/ngaut/unistore/server"
 	"github.com/pingcap/badger"
 	"github.com/pingcap/badger/y"
@@ -127,22 +129,24 @@ func main() {
 		log.S().Fatal(err)
 	}
 
-	tikvServer, err := server.New(conf, pdClient)
+	store, err := server.NewStore(conf, pdClient)
 	if err != nil {
 		log.S().Fatal(err)
 	}
+	tikvServer := store.Server
 
 	var alivePolicy = keepalive.EnforcementPolicy{
 		MinTime:             2 * time.Second, // If a client pings more than once every 2 seconds, terminate the connection
 		PermitWithoutStream: true,            // Allow pings even when there are no active streams
 	}
 
-	grpcServer := grpc.NewServer(
+	opts := []grpc.ServerOption{
 		grpc.KeepaliveEnforcementPolicy(alivePolicy),
 		grpc.InitialWindowSize(grpcInitialWindowSize),
 		grpc.InitialConnWindowSize(grpcInitialConnWindowSize),
-		grpc.MaxRecvMsgSize(10*1024*1024),
-	)
+		grpc.MaxRecvMsgSize(10 * 1024 * 1024),
+	}
+	grpcServer := grpc.NewServer(append(opts, server.RegisteredInterceptors().ServerOptions(conf, store.Services)...)...)
 	tikvpb.RegisterTikvServer(grpcServer, tikvServer)
 	listenAddr := conf.Server.StoreAddr[strings.IndexByte(conf.Server.StoreAddr, ':'):]
 	l, err := net.Listen("tcp", listenAddr)
@@ -156,6 +160,8 @@ func main() {
 		http.HandleFunc("/status", func(writer http.ResponseWriter, request *http.Request) {
 			writer.WriteHeader(http.StatusOK)
 		})
+		http.HandleFunc("/log-level", handleLogLevel)
+		http.Handle("/", store.Status)
 		err := http.ListenAndServe(conf.Server.StatusAddr, nil)
 		if err != nil {
 			log.S().Fatal(err)
@@ -169,6 +175,23 @@ func main() {
 	log.Info("Server stopped.")
 }
 
+// handleLogLevel returns the log levels of the raftstore modules, or sets the level of a module by
+// "POST /log-level?module=peer&level=debug", the level "global" makes the module follow the global level.
+func handleLogLevel(writer http.ResponseWriter, request *http.Request) {
+	if request.Method == http.MethodPost {
+		module, level := request.FormValue("module"), request.FormValue("level")
+		if err := raftstore.SetModuleLogLevel(module, level); err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Info("set log level", zap.String("module", module), zap.String("level", level))
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(writer).Encode(raftstore.ModuleLogLevels()); err != nil {
+		log.Warn("failed to write log levels", zap.Error(err))
+	}
+}
+
 func loadConfig() *config.Config {
 	conf := config.DefaultConf
 	if *configPath != "" {
@@ -25,6 +25,13 @@ import (
 type Config struct {
 	config.Config
 	RaftStore RaftStore `toml:"raftstore"` // RaftStore configs
+	Memory    Memory    `toml:"memory"`    // Memory quota configs
+}
+
+// Memory is the config for the memory quota of coprocessor and scan requests.
+type Memory struct {
+	RequestQuota int64 `toml:"request-quota"` // Max bytes of the request and the response of a request, 0 means no limit.
+	StoreQuota   int64 `toml:"store-quota"`   // Max bytes of the running requests and the responses not sent yet, 0 means no limit.
 }
 
 // RaftStore is the config for raft store.
@@ -35,6 +42,65 @@ type RaftStore struct {
 	RaftHeartbeatTicks       int    `toml:"raft-heartbeat-ticks"`        // raft-heartbeat-ticks times
 	RaftElectionTimeoutTicks int    `toml:"raft-election-timeout-ticks"` // raft-election-timeout-ticks times
 	CustomRaftLog            bool   `toml:"custom-raft-log"`
+
+	RaftMinElectionTimeoutTicks int `toml:"raft-min-election-timeout-ticks"` // 0 means raft-election-timeout-ticks
+	RaftMaxElectionTimeoutTicks int `toml:"raft-max-election-timeout-ticks"` // 0 means 2 * raft-election-timeout-ticks
+	ElectionPriority            int `toml:"election-priority"`               // peers with higher priority campaign earlier
+	RaftElectionGraceTicks      int `toml:"raft-election-grace-ticks"`       // ticks a follower defers its election after a snapshot or a split
+
+	Labels         map[string]string `toml:"labels"`          // labels of the store, like zone and host
+	LocationLabels []string          `toml:"location-labels"` // label keys describing the location of stores from the top level
+	IsolationLevel string            `toml:"isolation-level"` // replicas must be in different locations down to this label
+
+	HibernateRegions   bool `toml:"hibernate-regions"`    // stop ticking the raft groups of the idle regions
+	HibernateIdleTicks int  `toml:"hibernate-idle-ticks"` // 0 means the default of raftstore
+
+	PeerDebugLogRate  float64 `toml:"peer-debug-log-rate"`  // debug logs of a region per second, 0 means the default of raftstore, negative means no limit
+	PeerDebugLogBurst int     `toml:"peer-debug-log-burst"` // 0 means the default of raftstore
+
+	VerifyIngestChecksum bool `toml:"verify-ingest-checksum"` // verify the tables built by applying snapshots before ingesting them
+
+	SnapWaitersCapacity int    `toml:"snap-waiters-capacity"` // commands of a region waiting for a snapshot to be applied, 0 means the default of raftstore
+	SnapWaitTimeout     string `toml:"snap-wait-timeout"`     // empty means the default of raftstore
+
+	SnapGenLimit       int    `toml:"snap-gen-limit"`        // max snapshots generated for a region in snap-gen-limit-window, 0 means no limit
+	SnapGenLimitWindow string `toml:"snap-gen-limit-window"` // empty means the default of raftstore
+	SnapRateLimit      uint64 `toml:"snap-rate-limit"`       // bytes per second of the snapshots generated, sent and received, 0 means no limit
+
+	RaftEntryCacheCapacity int64 `toml:"raft-entry-cache-capacity"` // bytes of the raft entries cached by a region, 0 means the default of raftstore, negative means no limit
+
+	AsyncRaftLogWriters int `toml:"async-raft-log-writers"` // goroutines persisting the raft logs, 0 means the raft worker persists them
+
+	FailFastDroppedProposals bool `toml:"fail-fast-dropped-proposals"` // respond the proposals dropped by raft with the reason instead of NotLeader
+
+	RegionMaxSize   int64 `toml:"region-max-size"`   // bytes of a region to split, 0 means region-split-size / 2 * 3
+	RegionSplitSize int64 `toml:"region-split-size"` // bytes of the regions split from a region, 0 means the default of raftstore
+
+	LoadSplitQPSThreshold int64  `toml:"load-split-qps-threshold"` // QPS of a region to split it by the load, 0 means the default of raftstore, negative disables it
+	LoadSplitWindow       string `toml:"load-split-window"`        // window to count the QPS of a region, empty means the default of raftstore
+
+	RaftLogGCTickInterval string `toml:"raft-log-gc-tick-interval"` // interval to compact the raft log, empty means the default of raftstore
+	RaftLogGCThreshold    int64  `toml:"raft-log-gc-threshold"`     // entries replicated to all the peers to compact the raft log, 0 means the default of raftstore
+	RaftLogGCCountLimit   int64  `toml:"raft-log-gc-count-limit"`   // applied entries to compact the raft log regardless of the lagging peers, 0 means the default of raftstore
+	RaftLogGCSizeLimit    int64  `toml:"raft-log-gc-size-limit"`    // bytes of the raft log to compact it regardless of the lagging peers, 0 means the default of raftstore
+
+	PdStoreHeartbeatTickInterval string `toml:"pd-store-heartbeat-tick-interval"` // interval to report the store stats to PD, empty means the default of raftstore
+
+	ApplyProfileSampleRate int `toml:"apply-profile-sample-rate"` // time one in every apply-profile-sample-rate applies of a region, 0 means the default of raftstore, negative disables it
+
+	ReadPoolSize                int `toml:"read-pool-size"`                  // workers running the reads, 0 means the default of raftstore, negative runs the reads on the gRPC goroutines
+	ReadPoolPointGetConcurrency int `toml:"read-pool-point-get-concurrency"` // point gets running at the same time, 0 means the pool size
+	ReadPoolScanConcurrency     int `toml:"read-pool-scan-concurrency"`      // scans and coprocessor requests running at the same time, 0 means the default of raftstore
+
+	SafeTSUpdateInterval string `toml:"safe-ts-update-interval"` // interval the leaders advance the safe ts of the bounded staleness reads, empty disables them
+
+	RaftAdaptiveFlowControl bool   `toml:"raft-adaptive-flow-control"` // tune the replication window of every follower by its ack latency and drop rate
+	RaftFlowTargetLatency   string `toml:"raft-flow-target-latency"`   // ack latency over which the window of a follower shrinks, empty means the default of raftstore
+
+	PeerInitWorkers int `toml:"peer-init-workers"` // goroutines creating the peers when the store starts, 0 means GOMAXPROCS
+
+	InvariantCheckInterval string `toml:"invariant-check-interval"` // interval to check the raftstore invariants, empty disables the checks
+	InvariantViolationMode string `toml:"invariant-violation-mode"` // "panic", "event" or "metric", empty means "metric"
 }
 
 // ParseCompression parses the string s and returns a compression type.
@@ -19,6 +19,7 @@ require (
 	github.com/shirou/gopsutil v3.21.2+incompatible
 	github.com/spaolacci/murmur3 v1.1.0 // indirect
 	github.com/stretchr/testify v1.6.1
+	github.com/tikv/pd v1.1.0-beta.0.20210323121136-78679e5e209d
 	github.com/uber-go/atomic v1.4.0
 	github.com/zhangjinpeng1987/raft v0.0.0-20200819064223-df31bb68a018
 	go.etcd.io/bbolt v1.3.4 // indirect
@@ -0,0 +1,257 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// AdminFaultAction is the fault injected into a matched admin proposal.
+type AdminFaultAction string
+
+// AdminFaultAction
+const (
+	// AdminFaultFail responds to the proposal with the error of the rule.
+	AdminFaultFail AdminFaultAction = "fail"
+	// AdminFaultDrop doesn't propose the proposal and responds with ErrAdminFaultDropped, like a proposal lost
+	// before it reaches the raft log.
+	AdminFaultDrop AdminFaultAction = "drop"
+)
+
+// The error kinds of a failed proposal, any other error of a rule is returned as a plain error message.
+const (
+	AdminFaultNotLeader     = "not_leader"
+	AdminFaultEpochNotMatch = "epoch_not_match"
+	AdminFaultServerIsBusy  = "server_is_busy"
+	AdminFaultStaleCommand  = "stale_command"
+)
+
+// AdminFaultRule injects a fault into the admin proposals of a command type, it is used to reproduce the
+// retry bugs of the PD driven operators.
+type AdminFaultRule struct {
+	// RegionID is the region of the proposals, 0 matches all the regions.
+	RegionID uint64
+	CmdType  raft_cmdpb.AdminCmdType
+	// Nth is the 1-based sequence number of the matched proposal to inject, 0 injects all the matched proposals.
+	Nth    int
+	Action AdminFaultAction
+	// Error is the error kind or the error message of a failed proposal.
+	Error string
+}
+
+// AdminFault is an injected rule and its counters.
+type AdminFault struct {
+	ID   uint64
+	Rule AdminFaultRule
+	// Matched is the number of the proposals matched by the rule.
+	Matched int
+	// Injected is the number of the proposals failed or dropped by the rule.
+	Injected int
+}
+
+func (rule *AdminFaultRule) err(regionID uint64) error {
+	switch rule.Error {
+	case AdminFaultNotLeader:
+		return &ErrNotLeader{RegionID: regionID}
+	case AdminFaultEpochNotMatch:
+		return &ErrEpochNotMatch{Message: "injected"}
+	case AdminFaultServerIsBusy:
+		return &ErrServerIsBusy{Reason: "injected"}
+	case AdminFaultStaleCommand:
+		return &ErrStaleCommand{}
+	}
+	return errors.New(rule.Error)
+}
+
+// adminFaultInjector is shared by the raft workers of a store.
+type adminFaultInjector struct {
+	mu     sync.Mutex
+	nextID uint64
+	faults []*AdminFault
+}
+
+func (i *adminFaultInjector) add(rule AdminFaultRule) (uint64, error) {
+	if rule.Action != AdminFaultFail && rule.Action != AdminFaultDrop {
+		return 0, errors.Errorf("unknown admin fault action %q", rule.Action)
+	}
+	if rule.Action == AdminFaultFail && rule.Error == "" {
+		return 0, errors.New("the error of a failed admin proposal is empty")
+	}
+	if rule.Nth < 0 {
+		return 0, errors.Errorf("invalid nth %d", rule.Nth)
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.nextID++
+	i.faults = append(i.faults, &AdminFault{ID: i.nextID, Rule: rule})
+	return i.nextID, nil
+}
+
+// remove removes the rule with the id, 0 removes all the rules.
+func (i *adminFaultInjector) remove(id uint64) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if id == 0 {
+		removed := len(i.faults) > 0
+		i.faults = nil
+		return removed
+	}
+	for j, fault := range i.faults {
+		if fault.ID == id {
+			i.faults = append(i.faults[:j:j], i.faults[j+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (i *adminFaultInjector) list() []AdminFault {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	faults := make([]AdminFault, 0, len(i.faults))
+	for _, fault := range i.faults {
+		faults = append(faults, *fault)
+	}
+	return faults
+}
+
+// inject counts the admin proposal for every matching rule, it returns the error to fail the proposal
+// with, ErrAdminFaultDropped if the proposal is dropped. The first injecting rule wins.
+func (i *adminFaultInjector) inject(regionID uint64, cmdType raft_cmdpb.AdminCmdType) error {
+	if i == nil {
+		return nil
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	var injected *AdminFault
+	for _, fault := range i.faults {
+		rule := &fault.Rule
+		if rule.CmdType != cmdType || (rule.RegionID != 0 && rule.RegionID != regionID) {
+			continue
+		}
+		fault.Matched++
+		if injected == nil && (rule.Nth == 0 || rule.Nth == fault.Matched) {
+			injected = fault
+		}
+	}
+	if injected == nil {
+		return nil
+	}
+	injected.Injected++
+	rule := &injected.Rule
+	log.Warn("inject admin fault", zap.Uint64("region id", regionID), zap.Stringer("cmd type", cmdType),
+		zap.Uint64("rule", injected.ID), zap.String("action", string(rule.Action)), zap.String("error", rule.Error))
+	if rule.Action == AdminFaultDrop {
+		return &ErrAdminFaultDropped{RegionID: regionID, CmdType: cmdType}
+	}
+	return rule.err(regionID)
+}
+
+// AddAdminFault adds a rule to inject faults into the admin proposals of the store, it returns the id of the rule.
+func (r *Router) AddAdminFault(rule AdminFaultRule) (uint64, error) {
+	return r.router.adminFaults.add(rule)
+}
+
+// RemoveAdminFault removes the rule with the id, 0 removes all the rules.
+func (r *Router) RemoveAdminFault(id uint64) bool {
+	return r.router.adminFaults.remove(id)
+}
+
+// AdminFaults returns the rules and their counters.
+func (r *Router) AdminFaults() []AdminFault {
+	return r.router.adminFaults.list()
+}
+
+// AdminFaultHandler serves the admin fault rules for the status server. GET lists the rules as JSON, POST adds
+// a rule from the region_id, cmd_type, nth, action and error query parameters, where cmd_type is the name of
+// the admin command type like BatchSplit, and DELETE removes the rule of the id query parameter or all the
+// rules without it.
+func (r *Router) AdminFaultHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		var resp interface{}
+		switch req.Method {
+		case http.MethodGet:
+			resp = r.AdminFaults()
+		case http.MethodPost:
+			rule, err := parseAdminFaultRule(query)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			id, err := r.AddAdminFault(rule)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			resp = AdminFault{ID: id, Rule: rule}
+		case http.MethodDelete:
+			var id uint64
+			if idStr := query.Get("id"); idStr != "" {
+				var err error
+				if id, err = strconv.ParseUint(idStr, 10, 64); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			if !r.RemoveAdminFault(id) && id != 0 {
+				http.Error(w, errors.Errorf("admin fault %d not found", id).Error(), http.StatusNotFound)
+				return
+			}
+			resp = r.AdminFaults()
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Warn("failed to encode admin faults", zap.Error(err))
+		}
+	})
+}
+
+func parseAdminFaultRule(query map[string][]string) (AdminFaultRule, error) {
+	get := func(key string) string {
+		if values := query[key]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	rule := AdminFaultRule{Action: AdminFaultAction(get("action")), Error: get("error")}
+	cmdType, ok := raft_cmdpb.AdminCmdType_value[get("cmd_type")]
+	if !ok {
+		return rule, errors.Errorf("unknown admin command type %q", get("cmd_type"))
+	}
+	rule.CmdType = raft_cmdpb.AdminCmdType(cmdType)
+	var err error
+	if regionID := get("region_id"); regionID != "" {
+		if rule.RegionID, err = strconv.ParseUint(regionID, 10, 64); err != nil {
+			return rule, err
+		}
+	}
+	if nth := get("nth"); nth != "" {
+		if rule.Nth, err = strconv.Atoi(nth); err != nil {
+			return rule, err
+		}
+	}
+	return rule, nil
+}
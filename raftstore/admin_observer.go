@@ -0,0 +1,64 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"sync"
+
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
+)
+
+// AdminObserver is called before an admin command is applied to the region, it may rewrite the request
+// in place or veto the command by returning an error, the error is returned to the proposer as an
+// ErrAdminVetoed. The admin command is applied on every replica, so the observer must be registered on
+// every store and make the same decision on them, it must not block.
+type AdminObserver func(region *metapb.Region, req *raft_cmdpb.AdminRequest) error
+
+// adminObservers is shared by the apply workers of a store.
+type adminObservers struct {
+	mu        sync.Mutex
+	observers []AdminObserver
+}
+
+func (o *adminObservers) add(ob AdminObserver) {
+	o.mu.Lock()
+	observers := make([]AdminObserver, 0, len(o.observers)+1)
+	observers = append(observers, o.observers...)
+	o.observers = append(observers, ob)
+	o.mu.Unlock()
+}
+
+// observe calls the observers in the order of registration, it stops at the first veto.
+func (o *adminObservers) observe(region *metapb.Region, req *raft_cmdpb.AdminRequest) error {
+	if o == nil {
+		return nil
+	}
+	o.mu.Lock()
+	observers := o.observers
+	o.mu.Unlock()
+	for _, ob := range observers {
+		cmdType := req.CmdType
+		if err := ob(region, req); err != nil {
+			return &ErrAdminVetoed{RegionID: region.Id, CmdType: cmdType, Reason: err.Error()}
+		}
+	}
+	return nil
+}
+
+// AddAdminObserver registers an observer for the admin commands applied on this store, it must be
+// called after Setup.
+func (ris *RaftInnerServer) AddAdminObserver(ob AdminObserver) {
+	ris.router.adminObservers.add(ob)
+}
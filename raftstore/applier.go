@@ -32,6 +32,7 @@ import (
 	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/mvcc"
 	"github.com/pingcap/tidb/util/codec"
 	"github.com/uber-go/atomic"
+	"go.uber.org/zap"
 )
 
 type pendingCmd struct {
@@ -116,6 +117,7 @@ type execResultCompactLog struct {
 type execResultSplitRegion struct {
 	regions []*metapb.Region
 	derived *metapb.Region
+	index   uint64
 }
 
 type execResultPrepareMerge struct {
@@ -170,12 +172,22 @@ type applyExecContext struct {
 type applyCallback struct {
 	region *metapb.Region
 	cbs    []*Callback
+
+	// appliedIndex is the index of the last applied command, it is published to visibleIndex before the
+	// callbacks are invoked.
+	appliedIndex uint64
+	visibleIndex *atomic.Uint64
 }
 
 func (c *applyCallback) invokeAll(doneApplyTime time.Time) {
+	c.publishAppliedIndex()
 	for _, cb := range c.cbs {
 		if cb != nil {
 			cb.applyDoneTime = doneApplyTime
+			if cb.onDone != nil {
+				cb.onDone(cb)
+			}
+			cb.demux()
 			cb.wg.Done()
 		}
 	}
@@ -215,6 +227,9 @@ type registration struct {
 	applyState       applyState
 	appliedIndexTerm uint64
 	region           *metapb.Region
+	visibleIndex     *atomic.Uint64
+	logBudget        *logBudget
+	applyProfiler    *applyProfiler
 }
 
 func newRegistration(peer *Peer) *registration {
@@ -224,6 +239,9 @@ func newRegistration(peer *Peer) *registration {
 		applyState:       peer.Store().applyState,
 		appliedIndexTerm: peer.Store().appliedIndexTerm,
 		region:           peer.Region(),
+		visibleIndex:     &peer.leaderChecker.appliedIndex,
+		logBudget:        peer.logBudget,
+		applyProfiler:    peer.applyProfiler,
 	}
 }
 
@@ -231,12 +249,18 @@ func newRegistration(peer *Peer) *registration {
 type GenSnapTask struct {
 	regionID     uint64
 	snapNotifier chan *eraftpb.Snapshot
+	status       *JobStatus
+
+	// epoch is the region epoch when the snapshot is requested, the task is cancelled if it's stale.
+	epoch *metapb.RegionEpoch
 }
 
-func newGenSnapTask(regionID uint64, notifier chan *eraftpb.Snapshot) *GenSnapTask {
+func newGenSnapTask(regionID uint64, epoch *metapb.RegionEpoch, notifier chan *eraftpb.Snapshot, status *JobStatus) *GenSnapTask {
 	return &GenSnapTask{
 		regionID:     regionID,
 		snapNotifier: notifier,
+		status:       status,
+		epoch:        epoch,
 	}
 }
 
@@ -246,7 +270,9 @@ func (t *GenSnapTask) generateAndScheduleSnapshot(regionSched chan<- task, redoI
 		data: &regionTask{
 			regionID: t.regionID,
 			notifier: t.snapNotifier,
+			status:   t.status,
 			redoIdx:  redoIdx,
+			epoch:    t.epoch,
 		},
 	}
 }
@@ -280,18 +306,30 @@ type applyContext struct {
 	enableSyncLog bool
 	// Whether to use the delete range API instead of deleting one by one.
 	useDeleteRange bool
+	// The factor to multiply the size diff hint, see Config.RegionSizeAmplification.
+	sizeAmplification uint64
+	// The observers called before the admin commands are applied, it may be nil.
+	adminObservers *adminObservers
+	// The number of the idempotency tokens remembered by every region, see Config.IdempotencyWindow.
+	idempotencyWindow int
+	// customLogWarned is set once the custom raft logs bypassing the idempotency tokens are reported.
+	customLogWarned bool
+	// The audit log of the applied commands, it may be nil.
+	auditLog *auditLog
 }
 
 func newApplyContext(tag string, regionScheduler chan<- task, engines *Engines,
 	applyResCh chan<- Msg, cfg *Config) *applyContext {
 	return &applyContext{
-		tag:             tag,
-		regionScheduler: regionScheduler,
-		engines:         engines,
-		applyResCh:      applyResCh,
-		enableSyncLog:   cfg.SyncLog,
-		useDeleteRange:  cfg.UseDeleteRange,
-		wb:              new(WriteBatch),
+		tag:               tag,
+		regionScheduler:   regionScheduler,
+		engines:           engines,
+		applyResCh:        applyResCh,
+		enableSyncLog:     cfg.SyncLog,
+		useDeleteRange:    cfg.UseDeleteRange,
+		sizeAmplification: cfg.amplifySize(1),
+		idempotencyWindow: cfg.IdempotencyWindow,
+		wb:                new(WriteBatch),
 	}
 }
 
@@ -306,7 +344,7 @@ func (ac *applyContext) prepareFor(d *applier) {
 		ac.wbLastBytes = 0
 		ac.wbLastKeys = 0
 	}
-	ac.cbs = append(ac.cbs, applyCallback{region: d.region})
+	ac.cbs = append(ac.cbs, applyCallback{region: d.region, visibleIndex: d.visibleIndex})
 	ac.lastAppliedIndex = d.applyState.appliedIndex
 }
 
@@ -336,9 +374,13 @@ func (ac *applyContext) commitOpt(d *applier, persistent bool) {
 // Writes all the changes into badger.
 func (ac *applyContext) writeToDB() {
 	if ac.wb.size != 0 {
+		released := ac.wb.releasesLocks()
 		if err := ac.wb.WriteToKV(ac.engines.kv); err != nil {
 			panic(err)
 		}
+		if released {
+			ac.engines.lockReleased.notify()
+		}
 		ac.wb.Reset()
 		ac.wbLastBytes = 0
 		ac.wbLastKeys = 0
@@ -540,6 +582,19 @@ type applier struct {
 	// redoIdx is the raft log index starts redo for lockStore.
 	redoIndex uint64
 
+	// visibleIndex is the applied index visible to the reads of the leader checker.
+	visibleIndex *atomic.Uint64
+
+	// idempotencyTokens are the tokens of the recently applied writes, it is nil before a write with a token
+	// is applied.
+	idempotencyTokens *idempotencyTokens
+
+	// logBudget is the log budget of the peer.
+	logBudget *logBudget
+
+	// applyProfiler is the apply profiler of the peer.
+	applyProfiler *applyProfiler
+
 	// The local metrics, and it will be flushed periodically.
 	metrics applyMetrics
 }
@@ -552,6 +607,9 @@ func newApplier(reg *registration) *applier {
 		applyState:       reg.applyState,
 		appliedIndexTerm: reg.appliedIndexTerm,
 		term:             reg.term,
+		visibleIndex:     reg.visibleIndex,
+		logBudget:        reg.logBudget,
+		applyProfiler:    reg.applyProfiler,
 	}
 }
 
@@ -626,16 +684,9 @@ func (a *applier) handleRaftEntryNormal(aCtx *applyContext, entry *eraftpb.Entry
 	index := entry.Index
 	term := entry.Term
 	if len(entry.Data) > 0 {
-		var rlog raftlog.RaftLog
-		if entry.Data[0] == raftlog.CustomRaftLogFlag {
-			rlog = raftlog.NewCustom(entry.Data)
-		} else {
-			cmd := new(raft_cmdpb.RaftCmdRequest)
-			err := cmd.Unmarshal(entry.Data)
-			if err != nil {
-				panic(err)
-			}
-			rlog = raftlog.NewRequest(cmd)
+		rlog, err := DecodeEntry(entry)
+		if err != nil {
+			panic(err)
 		}
 		if shouldWriteToEngine(rlog, len(aCtx.wb.entries)) {
 			aCtx.commit(a)
@@ -723,12 +774,17 @@ func (a *applier) processRaftCmd(aCtx *applyContext, index, term uint64, rlog ra
 	if result.tp == applyResultTypeWaitMergeResource {
 		return result
 	}
-	log.S().Debugf("applied command. region_id %d, peer_id %d, index %d", a.region.Id, a.id, index)
+	a.debug("applied command", zap.Uint64("index", index))
 
 	// TODO: if we have exec_result, maybe we should return this callback too. Outer
 	// store will call it after handing exec result.
 	BindRespTerm(resp, term)
+	aCtx.auditLog.record(a.region.Id, index, term, rlog, resp)
 	cmdCB := a.findCallback(index, term, isConfChange)
+	if cmdCB != nil {
+		cmdCB.appliedIndex = index
+	}
+	aCtx.cbs[len(aCtx.cbs)-1].appliedIndex = index
 	aCtx.cbs[len(aCtx.cbs)-1].push(cmdCB, resp)
 	return result
 }
@@ -747,17 +803,21 @@ func (a *applier) applyRaftCmd(aCtx *applyContext, index, term uint64,
 	y.Assert(!a.pendingRemove)
 
 	aCtx.execCtx = a.newCtx(index, term)
-	aCtx.wb.SetSafePoint()
+	aCtx.wb.SetSavePoint()
 	resp, applyResult, err := a.execRaftCmd(aCtx, rlog)
 	if err != nil {
 		// clear dirty values.
-		aCtx.wb.RollbackToSafePoint()
+		y.Assert(aCtx.wb.RollbackToSavePoint() == nil)
 		if _, ok := err.(*ErrEpochNotMatch); ok {
-			log.S().Debugf("epoch not match region_id %d, peer_id %d, err %v", a.region.Id, a.id, err)
+			a.debug("epoch not match", zap.Error(err))
+		} else if _, ok := err.(*ErrAdminVetoed); ok {
+			log.S().Infof("region_id %d, peer_id %d, %v", a.region.Id, a.id, err)
 		} else {
 			log.S().Errorf("execute raft command region_id %d, peer_id %d, err %v", a.region.Id, a.id, err)
 		}
 		resp = ErrResp(err)
+	} else {
+		y.Assert(aCtx.wb.PopSavePoint() == nil)
 	}
 	if applyResult.tp == applyResultTypeWaitMergeResource {
 		return resp, applyResult
@@ -822,8 +882,7 @@ func (a *applier) execRaftCmd(aCtx *applyContext, rlog raftlog.RaftLog) (
 	if req.GetAdminRequest() != nil {
 		return a.execAdminCmd(aCtx, req)
 	}
-	resp, result = a.execWriteCmd(aCtx, rlog)
-	return
+	return a.execWriteCmd(aCtx, rlog)
 }
 
 func (a *applier) execAdminCmd(aCtx *applyContext, req *raft_cmdpb.RaftCmdRequest) (
@@ -834,6 +893,11 @@ func (a *applier) execAdminCmd(aCtx *applyContext, req *raft_cmdpb.RaftCmdReques
 		log.S().Infof("%s execute admin command. term %d, index %d, command %s",
 			a.tag, aCtx.execCtx.term, aCtx.execCtx.index, adminReq)
 	}
+	if err = aCtx.adminObservers.observe(a.region, adminReq); err != nil {
+		return
+	}
+	// The observers may rewrite the command.
+	cmdType = adminReq.CmdType
 	var adminResp *raft_cmdpb.AdminResponse
 	switch cmdType {
 	case raft_cmdpb.AdminCmdType_ChangePeer:
@@ -869,12 +933,24 @@ func (a *applier) execAdminCmd(aCtx *applyContext, req *raft_cmdpb.RaftCmdReques
 }
 
 func (a *applier) execWriteCmd(aCtx *applyContext, rlog raftlog.RaftLog) (
-	resp *raft_cmdpb.RaftCmdResponse, result applyResult) {
+	resp *raft_cmdpb.RaftCmdResponse, result applyResult, err error) {
+	// The size diff hint takes the encoded entries written by the command, so the deletions and the
+	// rollbacks are counted as well.
+	start := len(aCtx.wb.entries)
+	defer func() {
+		if err == nil {
+			a.metrics.sizeDiffHint += aCtx.wb.entriesSize(start) * aCtx.sizeAmplification
+		}
+	}()
 	if cl, ok := rlog.(*raftlog.CustomRaftLog); ok {
+		aCtx.warnCustomLogTokens()
 		resp = a.execCustomLog(aCtx, cl)
 		return
 	}
 	req := rlog.GetRaftCmdRequest()
+	if resp = a.checkDuplicate(aCtx, req); resp != nil {
+		return
+	}
 	requests := req.GetRequests()
 	writeCmdOps := createWriteCmdOps(requests)
 	rangeDeleted := false
@@ -887,7 +963,13 @@ func (a *applier) execWriteCmd(aCtx *applyContext, rlog raftlog.RaftLog) (
 		case *rollbackOp:
 			a.execRollback(aCtx, *x)
 		case *raft_cmdpb.DeleteRangeRequest:
-			a.execDeleteRange(aCtx, x)
+			// A failed delete range only reverts its own staged deletions.
+			aCtx.wb.SetSavePoint()
+			if err = a.execDeleteRange(aCtx, x); err != nil {
+				y.Assert(aCtx.wb.RollbackToSavePoint() == nil)
+				return
+			}
+			y.Assert(aCtx.wb.PopSavePoint() == nil)
 			rangeDeleted = true
 		default:
 			log.S().Fatalf("invalid input op=%v", x)
@@ -902,6 +984,7 @@ func (a *applier) execWriteCmd(aCtx *applyContext, rlog raftlog.RaftLog) (
 	}
 	resp = newCmdRespForReq(req)
 	resp.Responses = respPtrs
+	a.rememberToken(aCtx, req)
 	if rangeDeleted {
 		result = applyResult{
 			tp:   applyResultTypeExecResult,
@@ -1050,7 +1133,7 @@ func createWriteCmdOps(requests []*raft_cmdpb.Request) (ops []interface{}) {
 				}
 			}
 		case raft_cmdpb.CmdType_DeleteRange:
-			ops = append(ops, &req.DeleteRange)
+			ops = append(ops, req.DeleteRange)
 		case raft_cmdpb.CmdType_IngestSST:
 			panic("ingestSST not unsupported")
 		case raft_cmdpb.CmdType_Snap, raft_cmdpb.CmdType_Get:
@@ -1102,17 +1185,12 @@ func (a *applier) execCommit(aCtx *applyContext, op commitOp) {
 
 func (a *applier) commitLock(aCtx *applyContext, rawKey []byte, val []byte, commitTS uint64) {
 	lock := mvcc.DecodeLock(val)
-	var sizeDiff int64
 	userMeta := mvcc.NewDBUserMeta(lock.StartTS, commitTS)
 	if lock.Op != uint8(kvrpcpb.Op_Lock) {
 		aCtx.wb.SetWithUserMeta(y.KeyWithTs(rawKey, commitTS), lock.Value, userMeta)
-		sizeDiff = int64(len(rawKey) + len(lock.Value))
 	} else if bytes.Equal(lock.Primary, rawKey) {
 		aCtx.wb.SetOpLock(y.KeyWithTs(rawKey, commitTS), userMeta)
 	}
-	if sizeDiff > 0 {
-		a.metrics.sizeDiffHint += uint64(sizeDiff)
-	}
 	aCtx.wb.DeleteLock(rawKey)
 }
 
@@ -1150,14 +1228,14 @@ func (a *applier) execRollback(aCtx *applyContext, op rollbackOp) {
 	}
 }
 
-func (a *applier) execDeleteRange(aCtx *applyContext, req *raft_cmdpb.DeleteRangeRequest) {
+func (a *applier) execDeleteRange(aCtx *applyContext, req *raft_cmdpb.DeleteRangeRequest) error {
 	_, startKey, err := codec.DecodeBytes(req.StartKey, nil)
 	if err != nil {
-		panic(req.StartKey)
+		return errors.Errorf("invalid delete range start key %x: %v", req.StartKey, err)
 	}
 	_, endKey, err := codec.DecodeBytes(req.EndKey, nil)
 	if err != nil {
-		panic(req.EndKey)
+		return errors.Errorf("invalid delete range end key %x: %v", req.EndKey, err)
 	}
 	txn := aCtx.getTxn()
 	it := dbreader.NewIterator(txn, false, startKey, endKey)
@@ -1176,6 +1254,7 @@ func (a *applier) execDeleteRange(aCtx *applyContext, req *raft_cmdpb.DeleteRang
 		}
 		aCtx.wb.DeleteLock(safeCopy(lockIt.Key()))
 	}
+	return nil
 }
 
 func (a *applier) execChangePeer(aCtx *applyContext, req *raft_cmdpb.AdminRequest) (
@@ -1366,13 +1445,34 @@ func (a *applier) execBatchSplit(aCtx *applyContext, req *raft_cmdpb.AdminReques
 	result = applyResult{tp: applyResultTypeExecResult, data: &execResultSplitRegion{
 		regions: regions,
 		derived: derived,
+		index:   aCtx.execCtx.index,
 	}}
 	return
 }
 
 func (a *applier) execPrepareMerge(aCtx *applyContext, req *raft_cmdpb.AdminRequest) (
 	resp *raft_cmdpb.AdminResponse, result applyResult, err error) {
-	return // TODO: merge
+	prepareMerge := req.PrepareMerge
+	log.S().Infof("%s execute PrepareMerge, min index %d, target %s", a.tag, prepareMerge.MinIndex, prepareMerge.Target)
+	region := new(metapb.Region)
+	if err = CloneMsg(a.region, region); err != nil {
+		return
+	}
+	// The conf version is increased too, so no conf change is done after PrepareMerge is committed.
+	region.RegionEpoch.Version++
+	region.RegionEpoch.ConfVer++
+	mergeState := &rspb.MergeState{
+		MinIndex: prepareMerge.MinIndex,
+		Target:   prepareMerge.Target,
+		Commit:   aCtx.execCtx.index,
+	}
+	WritePeerState(aCtx.wb, region, rspb.PeerState_Merging, mergeState)
+	resp = new(raft_cmdpb.AdminResponse)
+	result = applyResult{tp: applyResultTypeExecResult, data: &execResultPrepareMerge{
+		region: region,
+		state:  mergeState,
+	}}
+	return
 }
 
 func (a *applier) execCommitMerge(aCtx *applyContext, req *raft_cmdpb.AdminRequest) (
@@ -1382,7 +1482,28 @@ func (a *applier) execCommitMerge(aCtx *applyContext, req *raft_cmdpb.AdminReque
 
 func (a *applier) execRollbackMerge(aCtx *applyContext, req *raft_cmdpb.AdminRequest) (
 	resp *raft_cmdpb.AdminResponse, result applyResult, err error) {
-	return // TODO: merge
+	rollback := req.RollbackMerge
+	log.S().Infof("%s execute RollbackMerge, commit %d", a.tag, rollback.Commit)
+	regionState, err := getRegionLocalState(aCtx.engines.kv.DB, a.region.Id)
+	if err != nil {
+		return
+	}
+	if regionState.State != rspb.PeerState_Merging {
+		panic(fmt.Sprintf("%s unexpected state of merging region %s", a.tag, regionState))
+	}
+	if regionState.MergeState.GetCommit() != rollback.Commit {
+		panic(fmt.Sprintf("%s unexpected rollback commit %d, merge state %s", a.tag, rollback.Commit, regionState.MergeState))
+	}
+	region := regionState.Region
+	// The version is increased to reject the duplicated rollback requests.
+	region.RegionEpoch.Version++
+	WritePeerState(aCtx.wb, region, rspb.PeerState_Normal, nil)
+	resp = new(raft_cmdpb.AdminResponse)
+	result = applyResult{tp: applyResultTypeExecResult, data: &execResultRollbackMerge{
+		region: region,
+		commit: rollback.Commit,
+	}}
+	return
 }
 
 func (a *applier) execCompactLog(aCtx *applyContext, req *raft_cmdpb.AdminRequest) (
@@ -1422,7 +1543,13 @@ func (a *applier) execCompactLog(aCtx *applyContext, req *raft_cmdpb.AdminReques
 func (a *applier) execComputeHash(aCtx *applyContext, req *raft_cmdpb.AdminRequest) (
 	resp *raft_cmdpb.AdminResponse, result applyResult, err error) {
 	resp = new(raft_cmdpb.AdminResponse)
-	// TODO: run in goroutine.
+	// The pending writes are flushed before the command, so the snapshot is taken at the same index on
+	// all the peers. The hash is computed in the compute hash worker.
+	result = applyResult{tp: applyResultTypeExecResult, data: &execResultComputeHash{
+		region: a.region,
+		index:  aCtx.execCtx.index,
+		snap:   newRegionDataSnapshot(aCtx.engines.kv, a.region),
+	}}
 	return
 }
 
@@ -1465,7 +1592,13 @@ func (a *applier) handleApply(aCtx *applyContext, apply *apply) {
 	}
 	a.metrics = applyMetrics{}
 	a.term = apply.term
-	a.handleRaftCommittedEntries(aCtx, apply.entries)
+	if a.applyProfiler.begin(len(apply.entries)) {
+		start := time.Now()
+		a.handleRaftCommittedEntries(aCtx, apply.entries)
+		a.applyProfiler.end(start)
+	} else {
+		a.handleRaftCommittedEntries(aCtx, apply.entries)
+	}
 	for i := range apply.entries {
 		apply.entries[i] = eraftpb.Entry{}
 	}
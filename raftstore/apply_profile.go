@@ -0,0 +1,88 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ApplyStats is the sampled time the apply worker spends on a region.
+type ApplyStats struct {
+	// Applies is the number of the apply tasks handled, Sampled of them are timed.
+	Applies uint64
+	Sampled uint64
+	// Entries is the number of the raft entries applied.
+	Entries uint64
+	// SampledTime is the time of the sampled applies, EstimatedTime scales it to all the applies.
+	SampledTime   time.Duration
+	EstimatedTime time.Duration
+}
+
+// applyProfiler times one in every sampleRate apply tasks of a region. It is updated by the apply worker and
+// can be read concurrently, the applier shares it with the peer through the registration.
+type applyProfiler struct {
+	sampleRate uint64
+	applies    uint64
+	sampled    uint64
+	entries    uint64
+	nanos      uint64
+}
+
+func newApplyProfiler(sampleRate int) *applyProfiler {
+	if sampleRate <= 0 {
+		return nil
+	}
+	return &applyProfiler{sampleRate: uint64(sampleRate)}
+}
+
+// begin counts an apply task of the entries and returns true if the task is sampled.
+func (p *applyProfiler) begin(entries int) bool {
+	if p == nil {
+		return false
+	}
+	atomic.AddUint64(&p.entries, uint64(entries))
+	return atomic.AddUint64(&p.applies, 1)%p.sampleRate == 1%p.sampleRate
+}
+
+// end records a sampled apply task started at start.
+func (p *applyProfiler) end(start time.Time) {
+	atomic.AddUint64(&p.nanos, uint64(time.Since(start)))
+	atomic.AddUint64(&p.sampled, 1)
+}
+
+func (p *applyProfiler) stats() ApplyStats {
+	if p == nil {
+		return ApplyStats{}
+	}
+	stats := ApplyStats{
+		Applies:     atomic.LoadUint64(&p.applies),
+		Sampled:     atomic.LoadUint64(&p.sampled),
+		Entries:     atomic.LoadUint64(&p.entries),
+		SampledTime: time.Duration(atomic.LoadUint64(&p.nanos)),
+	}
+	if stats.Sampled > 0 {
+		stats.EstimatedTime = time.Duration(float64(stats.SampledTime) * float64(stats.Applies) / float64(stats.Sampled))
+	}
+	return stats
+}
+
+// ApplyStats returns the sampled apply time of the region.
+func (r *Router) ApplyStats(regionID uint64) (ApplyStats, error) {
+	p := r.router.get(regionID)
+	if p == nil {
+		return ApplyStats{}, errPeerNotFound
+	}
+	return p.peer.peer.applyProfiler.stats(), nil
+}
@@ -0,0 +1,263 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"hash/fnv"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/ngaut/unistore/raftstore/raftlog"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// auditSampleScale is the resolution of the sample rate of the data commands.
+const auditSampleScale = 1000000
+
+// AuditRecord is a line of the audit log, an applied raft command.
+type AuditRecord struct {
+	RegionID uint64 `json:"region_id"`
+	Index    uint64 `json:"index"`
+	Term     uint64 `json:"term"`
+	// Type is the admin command type of an admin command, the custom log type or "Write" of a data command.
+	Type string `json:"type"`
+	Keys int    `json:"keys"`
+	// KeyDigest is the digest of the keys of a data command, or the digest of the request of an admin command.
+	KeyDigest string `json:"key_digest"`
+	Error     string `json:"error,omitempty"`
+}
+
+// auditLog writes the applied admin commands and a sample of the data commands to a file as JSON lines. The
+// sample is decided by the region and the index, so the stores of a region log the same commands and their
+// logs can be compared with an AuditReplayer.
+type auditLog struct {
+	file       *os.File
+	w          *bufio.Writer
+	enc        *json.Encoder
+	sampleRate float64
+	replayer   *AuditReplayer
+}
+
+func openAuditLog(path string, sampleRate float64, replayer *AuditReplayer) (*auditLog, error) {
+	if path == "" && replayer == nil {
+		return nil, nil
+	}
+	l := &auditLog{sampleRate: sampleRate, replayer: replayer}
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		l.file, l.w = f, bufio.NewWriter(f)
+		l.enc = json.NewEncoder(l.w)
+	}
+	return l, nil
+}
+
+func (l *auditLog) sampled(regionID, index uint64) bool {
+	if l.sampleRate <= 0 {
+		return false
+	}
+	var buf [16]byte
+	binary.LittleEndian.PutUint64(buf[:], regionID)
+	binary.LittleEndian.PutUint64(buf[8:], index)
+	h := fnv.New64a()
+	h.Write(buf[:])
+	return float64(h.Sum64()%auditSampleScale) < l.sampleRate*auditSampleScale
+}
+
+// record logs the applied command if it is an admin command or a sampled data command.
+func (l *auditLog) record(regionID, index, term uint64, rlog raftlog.RaftLog, resp *raft_cmdpb.RaftCmdResponse) {
+	if l == nil {
+		return
+	}
+	req := rlog.GetRaftCmdRequest()
+	isAdmin := req != nil && req.AdminRequest != nil
+	if !isAdmin && !l.sampled(regionID, index) {
+		return
+	}
+	rec := AuditRecord{RegionID: regionID, Index: index, Term: term}
+	h := fnv.New64a()
+	switch {
+	case isAdmin:
+		rec.Type = req.AdminRequest.CmdType.String()
+		data, err := req.AdminRequest.Marshal()
+		if err != nil {
+			panic(err)
+		}
+		h.Write(data)
+	case req != nil:
+		rec.Type = "Write"
+		rec.Keys = digestRequestKeys(h, req.Requests)
+	default:
+		cl := rlog.(*raftlog.CustomRaftLog)
+		rec.Type = cl.Type().String()
+		rec.Keys = digestCustomLogKeys(h, cl)
+	}
+	rec.KeyDigest = hex.EncodeToString(h.Sum(nil))
+	if err := resp.GetHeader().GetError(); err != nil {
+		rec.Error = err.String()
+	}
+	l.replayer.check(&rec)
+	if l.enc == nil {
+		return
+	}
+	if err := l.enc.Encode(&rec); err != nil {
+		log.Warn("failed to write audit log", zap.Error(err))
+	}
+}
+
+func digestKey(h hash.Hash, key []byte) {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], uint32(len(key)))
+	h.Write(buf[:])
+	h.Write(key)
+}
+
+func digestRequestKeys(h hash.Hash, reqs []*raft_cmdpb.Request) int {
+	var cnt int
+	for _, req := range reqs {
+		switch req.CmdType {
+		case raft_cmdpb.CmdType_Put:
+			digestKey(h, req.Put.Key)
+		case raft_cmdpb.CmdType_Delete:
+			digestKey(h, req.Delete.Key)
+		case raft_cmdpb.CmdType_DeleteRange:
+			digestKey(h, req.DeleteRange.StartKey)
+			digestKey(h, req.DeleteRange.EndKey)
+		default:
+			continue
+		}
+		cnt++
+	}
+	return cnt
+}
+
+func digestCustomLogKeys(h hash.Hash, cl *raftlog.CustomRaftLog) int {
+	var cnt int
+	add := func(key []byte) {
+		digestKey(h, key)
+		cnt++
+	}
+	switch cl.Type() {
+	case raftlog.TypePrewrite, raftlog.TypePessimisticLock:
+		cl.IterateLock(func(key, _ []byte) { add(key) })
+	case raftlog.TypeCommit:
+		cl.IterateCommit(func(key, _ []byte, _ uint64) { add(key) })
+	case raftlog.TypeRolback:
+		cl.IterateRollback(func(key []byte, _ uint64, _ bool) { add(key) })
+	case raftlog.TypePessimisticRollback:
+		cl.IteratePessimisticRollback(add)
+	}
+	return cnt
+}
+
+func (l *auditLog) close() {
+	if l == nil || l.file == nil {
+		return
+	}
+	if err := l.w.Flush(); err != nil {
+		log.Warn("failed to flush audit log", zap.Error(err))
+	}
+	if err := l.file.Close(); err != nil {
+		log.Warn("failed to close audit log", zap.Error(err))
+	}
+}
+
+// ReadAuditLog reads the records of an audit log.
+func ReadAuditLog(r io.Reader) ([]AuditRecord, error) {
+	var records []AuditRecord
+	dec := json.NewDecoder(r)
+	for {
+		var rec AuditRecord
+		if err := dec.Decode(&rec); err != nil {
+			if err == io.EOF {
+				return records, nil
+			}
+			return nil, errors.WithStack(err)
+		}
+		records = append(records, rec)
+	}
+}
+
+// AuditMismatch is an applied command different from the one in the replayed audit log.
+type AuditMismatch struct {
+	Expected AuditRecord
+	Actual   AuditRecord
+}
+
+type auditKey struct {
+	regionID uint64
+	index    uint64
+}
+
+// AuditReplayer replays the audit log of a store against another store, the commands applied by the other
+// store are compared with the records of the same region and index. The stores should use the same sample
+// rate.
+type AuditReplayer struct {
+	mu         sync.Mutex
+	expected   map[auditKey]AuditRecord
+	mismatches []AuditMismatch
+}
+
+// NewAuditReplayer creates an AuditReplayer of the records.
+func NewAuditReplayer(records []AuditRecord) *AuditReplayer {
+	r := &AuditReplayer{expected: make(map[auditKey]AuditRecord, len(records))}
+	for _, rec := range records {
+		r.expected[auditKey{regionID: rec.RegionID, index: rec.Index}] = rec
+	}
+	return r
+}
+
+func (r *AuditReplayer) check(rec *AuditRecord) {
+	if r == nil {
+		return
+	}
+	key := auditKey{regionID: rec.RegionID, index: rec.Index}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	expected, ok := r.expected[key]
+	if !ok {
+		return
+	}
+	delete(r.expected, key)
+	if expected != *rec {
+		log.Error("applied command doesn't match the audit log", zap.Uint64("region id", rec.RegionID),
+			zap.Uint64("index", rec.Index), zap.Any("expected", expected), zap.Any("actual", *rec))
+		r.mismatches = append(r.mismatches, AuditMismatch{Expected: expected, Actual: *rec})
+	}
+}
+
+// Mismatches returns the mismatched commands.
+func (r *AuditReplayer) Mismatches() []AuditMismatch {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]AuditMismatch{}, r.mismatches...)
+}
+
+// Pending returns the number of the records not applied yet.
+func (r *AuditReplayer) Pending() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.expected)
+}
@@ -0,0 +1,194 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// maxBacklogHeadTypes is the number of the head messages whose types are dumped.
+const maxBacklogHeadTypes = 8
+
+// QueueBacklog is the backlog of a queue.
+type QueueBacklog struct {
+	Count int
+	// OldestAge is the time the oldest message has waited in the queue.
+	OldestAge time.Duration
+	// HeadTypes are the types of the first messages of the queue.
+	HeadTypes []string
+}
+
+// RegionBacklog is the backlog of the mailbox and the apply queue of a peer.
+type RegionBacklog struct {
+	RegionID uint64
+	// Mailbox is the messages sent to the peer but not received by the raft worker.
+	Mailbox QueueBacklog
+	// Apply is the messages sent to the applier of the peer but not handled by the apply worker.
+	Apply QueueBacklog
+	// PendingCmds is the number of the raft commands sent to the peer but not handled yet.
+	PendingCmds int64
+}
+
+// StoreBacklog is the backlog of the message dispatch of a store.
+type StoreBacklog struct {
+	Time time.Time
+	// PeerChannel and StoreChannel are the numbers of the messages in the channels of the raft worker
+	// and the store worker.
+	PeerChannel  int
+	StoreChannel int
+	// Regions are the regions with a backlog, the region with the oldest message first.
+	Regions []RegionBacklog
+	// RegionTasks is the backlog of the region worker, which generates, applies and destroys snapshots.
+	RegionTasks QueueBacklog
+}
+
+type backlogEntry struct {
+	tp   MsgType
+	seq  uint64
+	time time.Time
+}
+
+// msgBacklog tracks the messages of a queue, so it can be dumped while the worker of the queue is stuck.
+type msgBacklog struct {
+	mu      sync.Mutex
+	entries []backlogEntry
+	nextSeq uint64
+}
+
+// push tracks a message sent to the queue, it returns the sequence number to remove a message that fails
+// to be sent.
+func (b *msgBacklog) push(tp MsgType) uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nextSeq++
+	b.entries = append(b.entries, backlogEntry{tp: tp, seq: b.nextSeq, time: time.Now()})
+	return b.nextSeq
+}
+
+// pop untracks the oldest message when a message is received from the queue, the concurrent senders may
+// have sent the messages out of the order they are pushed, so it doesn't need to be the received one.
+func (b *msgBacklog) pop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.entries) == 0 {
+		return
+	}
+	b.entries[0] = backlogEntry{}
+	b.entries = b.entries[1:]
+	if len(b.entries) == 0 {
+		b.entries = nil
+	}
+}
+
+func (b *msgBacklog) remove(seq uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := len(b.entries) - 1; i >= 0; i-- {
+		if b.entries[i].seq == seq {
+			b.entries = append(b.entries[:i], b.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+func (b *msgBacklog) load(now time.Time) QueueBacklog {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	backlog := QueueBacklog{Count: len(b.entries)}
+	for i, entry := range b.entries {
+		if i == 0 {
+			backlog.OldestAge = now.Sub(entry.time)
+		}
+		if i == maxBacklogHeadTypes {
+			break
+		}
+		backlog.HeadTypes = append(backlog.HeadTypes, entry.tp.String())
+	}
+	return backlog
+}
+
+// backlog returns the backlog of the region worker, unreceived is the number of the tasks in the channel.
+func (q *regionTaskQueue) backlog(now time.Time, unreceived int) QueueBacklog {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	backlog := QueueBacklog{Count: len(q.tasks) + unreceived}
+	for i, t := range q.tasks {
+		// The tasks are kept in the order they are received.
+		if i == 0 {
+			backlog.OldestAge = now.Sub(t.enqueued)
+		}
+		if i == maxBacklogHeadTypes {
+			break
+		}
+		backlog.HeadTypes = append(backlog.HeadTypes, regionTaskName(t.task.tp))
+	}
+	return backlog
+}
+
+// DumpBacklog snapshots the backlogs of the peer mailboxes, the apply queues and the region worker, it
+// doesn't wait for any worker, so it works when the store is stuck.
+func (r *Router) DumpBacklog() *StoreBacklog {
+	now := time.Now()
+	pr := r.router
+	dump := &StoreBacklog{Time: now, PeerChannel: len(pr.peerSender), StoreChannel: len(pr.storeSender)}
+	pr.peers.Range(func(key, value interface{}) bool {
+		ps := value.(*peerState)
+		region := RegionBacklog{
+			RegionID:    key.(uint64),
+			Mailbox:     ps.mailbox.load(now),
+			Apply:       ps.applyBacklog.load(now),
+			PendingCmds: atomic.LoadInt64(&ps.pendingCmds),
+		}
+		if region.Mailbox.Count > 0 || region.Apply.Count > 0 || region.PendingCmds > 0 {
+			dump.Regions = append(dump.Regions, region)
+		}
+		return true
+	})
+	sort.Slice(dump.Regions, func(i, j int) bool {
+		a, b := &dump.Regions[i], &dump.Regions[j]
+		ageA, ageB := a.Mailbox.OldestAge, b.Mailbox.OldestAge
+		if a.Apply.OldestAge > ageA {
+			ageA = a.Apply.OldestAge
+		}
+		if b.Apply.OldestAge > ageB {
+			ageB = b.Apply.OldestAge
+		}
+		if ageA != ageB {
+			return ageA > ageB
+		}
+		return a.RegionID < b.RegionID
+	})
+	if pr.regionTasks != nil {
+		dump.RegionTasks = pr.regionTasks.backlog(now, len(pr.regionTaskSender))
+	}
+	return dump
+}
+
+// BacklogHandler serves the backlog dump as JSON for the status server.
+func (r *Router) BacklogHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(r.DumpBacklog()); err != nil {
+			log.Warn("failed to encode backlog", zap.Error(err))
+		}
+	})
+}
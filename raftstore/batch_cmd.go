@@ -0,0 +1,101 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ngaut/unistore/raftstore/raftlog"
+	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
+)
+
+// SubCommand is a logically independent part of a batched raft command.
+type SubCommand struct {
+	Requests []*raft_cmdpb.Request
+	Callback *Callback
+}
+
+type subCallback struct {
+	cb *Callback
+	// n is the number of the requests of the sub command.
+	n int
+}
+
+// NewBatchCommand merges the sub commands of a region into one RaftCmdRequest with the header. The returned
+// callback of the merged command demultiplexes the response to the callbacks of the sub commands when it is
+// done, so a sub command is responded without waiting for the other callbacks to be handled.
+func NewBatchCommand(header *raft_cmdpb.RaftRequestHeader, subs []SubCommand) (*raft_cmdpb.RaftCmdRequest, *Callback) {
+	req := &raft_cmdpb.RaftCmdRequest{Header: header}
+	cb := NewCallback()
+	for _, sub := range subs {
+		req.Requests = append(req.Requests, sub.Requests...)
+		cb.subs = append(cb.subs, subCallback{cb: sub.Callback, n: len(sub.Requests)})
+	}
+	return req, cb
+}
+
+// demux responds the sub commands with their parts of the response, the error of the merged command is
+// responded to all of them.
+func (cb *Callback) demux() {
+	if len(cb.subs) == 0 {
+		return
+	}
+	resp := cb.resp
+	var total int
+	for _, sub := range cb.subs {
+		total += sub.n
+	}
+	if resp.GetHeader().GetError() == nil && len(resp.GetResponses()) != total {
+		err := fmt.Errorf("batch command expects %d responses, got %d", total, len(resp.GetResponses()))
+		resp = ErrRespWithTerm(err, resp.GetHeader().GetCurrentTerm())
+	}
+	var offset int
+	for _, sub := range cb.subs {
+		if sub.cb == nil {
+			offset += sub.n
+			continue
+		}
+		subResp := &raft_cmdpb.RaftCmdResponse{Header: resp.Header}
+		if resp.GetHeader().GetError() == nil {
+			subResp.Responses = resp.Responses[offset : offset+sub.n]
+		}
+		offset += sub.n
+		sub.cb.raftBeginTime = cb.raftBeginTime
+		sub.cb.raftDoneTime = cb.raftDoneTime
+		sub.cb.applyBeginTime = cb.applyBeginTime
+		sub.cb.applyDoneTime = cb.applyDoneTime
+		sub.cb.appliedIndex = cb.appliedIndex
+		sub.cb.Done(subResp)
+	}
+}
+
+// SendBatchCommand sends the sub commands of a region as one raft command, the response of each sub command
+// is delivered to its own callback. The sub commands must be all reads or all writes.
+func (r *Router) SendBatchCommand(header *raft_cmdpb.RaftRequestHeader, subs []SubCommand) error {
+	req, cb := NewBatchCommand(header, subs)
+	if h := r.router.historyRecorder(); h != nil {
+		h.invoke(req, cb)
+	}
+	msg := &MsgRaftCmd{
+		SendTime: time.Now(),
+		Request:  raftlog.NewRequest(req),
+		Callback: cb,
+	}
+	err := r.router.sendRaftCommand(msg)
+	if err != nil {
+		cb.onDone = nil
+	}
+	return err
+}
@@ -0,0 +1,470 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bench
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ngaut/unistore/raftstore"
+	"github.com/pingcap/errors"
+	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/pingcap/tidb/util/codec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+// newTestCluster starts a cluster of the regions over 1000 keys, raftConfig adjusts the raftstore config of
+// every store if it's not nil.
+func newTestCluster(t testing.TB, regions int, raftConfig func(*raftstore.Config)) *Cluster {
+	cfg := DefaultClusterConfig()
+	cfg.Regions = regions
+	cfg.KeySpace = 1000
+	cfg.RaftConfig = raftConfig
+	c, err := NewCluster(cfg)
+	require.Nil(t, err)
+	return c
+}
+
+func TestWorkloads(t *testing.T) {
+	c := newTestCluster(t, 4, nil)
+	defer c.Stop()
+
+	for _, kind := range []WorkloadKind{PointWrite, BatchWrite, Scan} {
+		w := DefaultWorkload(kind)
+		w.Concurrency = 4
+		w.Ops = 40
+		res, err := c.Run(w)
+		require.Nil(t, err)
+		assert.Equal(t, 40, res.Ops, "%s", res)
+		assert.Equal(t, 0, res.Errors, "%s", res)
+		assert.True(t, res.P50 <= res.P99 && res.P99 <= res.Max, "%s", res)
+		assert.True(t, res.Throughput() > 0, "%s", res)
+		t.Log(res)
+	}
+
+	w := DefaultWorkload(PointWrite)
+	w.Concurrency = 2
+	w.Duration = 200 * time.Millisecond
+	res, err := c.Run(w)
+	require.Nil(t, err)
+	assert.True(t, res.Ops > 0)
+	assert.True(t, res.Elapsed >= w.Duration)
+
+	w.Concurrency = 0
+	_, err = c.Run(w)
+	assert.NotNil(t, err)
+}
+
+// TestRaftConfigs runs the workloads in a cluster with the raftstore config adjusted, then checks the cluster.
+func TestRaftConfigs(t *testing.T) {
+	allWorkloads := []WorkloadKind{PointWrite, BatchWrite, Scan}
+	tests := []struct {
+		name       string
+		regions    int
+		raftConfig func(*raftstore.Config)
+		workloads  []WorkloadKind
+		ops        int
+		check      func(t *testing.T, c *Cluster)
+	}{
+		{
+			name:       "async raft log writers",
+			regions:    4,
+			raftConfig: func(cfg *raftstore.Config) { cfg.AsyncRaftLogWriters = 2 },
+			workloads:  allWorkloads,
+			ops:        40,
+		},
+		{
+			// The violations panic.
+			name:       "invariant checks",
+			regions:    4,
+			raftConfig: func(cfg *raftstore.Config) { cfg.InvariantCheckInterval = cfg.RaftBaseTickInterval },
+			workloads:  allWorkloads,
+			ops:        40,
+			check: func(t *testing.T, c *Cluster) {
+				for _, storeID := range c.Stores() {
+					stats := c.Router(storeID).InvariantStats()
+					assert.Greater(t, stats.Checks, uint64(0))
+					for name, cnt := range stats.Violations {
+						assert.Equal(t, uint64(0), cnt, "%s", name)
+					}
+				}
+			},
+		},
+		{
+			// The hashes are verified by every peer, a mismatch panics.
+			name:       "consistency check",
+			regions:    4,
+			raftConfig: func(cfg *raftstore.Config) { cfg.ConsistencyCheckInterval = cfg.RaftBaseTickInterval },
+			workloads:  []WorkloadKind{BatchWrite},
+			ops:        40,
+			check: func(t *testing.T, c *Cluster) {
+				for _, storeID := range c.Stores() {
+					router := c.Router(storeID)
+					require.Eventually(t, func() bool {
+						return router.InvariantStats().Checks >= uint64(c.cfg.Regions)
+					}, 10*time.Second, 10*time.Millisecond)
+					assert.Equal(t, uint64(0), router.InvariantStats().Violations["consistent-hash"])
+				}
+			},
+		},
+		{
+			// The followers catch up with the leader after the workload.
+			name:      "check region consistency",
+			regions:   4,
+			workloads: []WorkloadKind{BatchWrite},
+			ops:       40,
+			check: func(t *testing.T, c *Cluster) {
+				regionIDs := c.pd.regionIDs()
+				require.Len(t, regionIDs, c.cfg.Regions)
+				for _, regionID := range regionIDs {
+					var report *raftstore.RegionConsistencyReport
+					require.Eventually(t, func() bool {
+						var err error
+						report, err = c.CheckRegionConsistency(context.Background(), regionID)
+						return err == nil && report.Converged
+					}, 10*time.Second, 10*time.Millisecond)
+					require.Len(t, report.Replicas, c.cfg.Replicas)
+					assert.NotEmpty(t, report.Replicas[0].Hash)
+				}
+			},
+		},
+		{
+			// Every replica applies the writes of the workload.
+			name:       "store heartbeat",
+			regions:    4,
+			raftConfig: func(cfg *raftstore.Config) { cfg.PdStoreHeartbeatTickInterval = 100 * time.Millisecond },
+			workloads:  []WorkloadKind{BatchWrite},
+			ops:        40,
+			check: func(t *testing.T, c *Cluster) {
+				var leaders int
+				for _, storeID := range c.Stores() {
+					require.Eventually(t, func() bool {
+						stats := c.StoreStats(storeID)
+						return stats != nil && stats.RegionCount == uint32(c.cfg.Regions) && stats.BytesWritten > 0
+					}, 10*time.Second, 10*time.Millisecond)
+					stats := c.StoreStats(storeID)
+					assert.True(t, stats.KeysWritten > 0)
+					assert.True(t, stats.Capacity > 0)
+					assert.True(t, stats.Available <= stats.Capacity)
+					assert.True(t, stats.StartTime > 0)
+					leaders += c.LeaderCount(storeID)
+				}
+				assert.Equal(t, c.cfg.Regions, leaders)
+			},
+		},
+		{
+			// Every replica compacts its raft log and purges the compacted entries.
+			name:    "raft log gc",
+			regions: 2,
+			raftConfig: func(cfg *raftstore.Config) {
+				cfg.RaftLogGCTickInterval = 200 * time.Millisecond
+				cfg.RaftLogGcThreshold = 5
+			},
+			workloads: []WorkloadKind{BatchWrite},
+			ops:       100,
+			check: func(t *testing.T, c *Cluster) {
+				for _, regionID := range c.pd.regionIDs() {
+					require.Eventually(t, func() bool {
+						report, err := c.CheckRegionConsistency(context.Background(), regionID)
+						if err != nil || !report.Converged {
+							return false
+						}
+						for _, replica := range report.Replicas {
+							if replica.TruncatedIndex <= raftstore.RaftInitLogIndex || replica.CompactedIndex != replica.TruncatedIndex+1 {
+								return false
+							}
+						}
+						return true
+					}, 10*time.Second, 10*time.Millisecond)
+				}
+			},
+		},
+		{
+			// The heartbeats are sent and received by the store.
+			name:    "message filter",
+			regions: 2,
+			check: func(t *testing.T, c *Cluster) {
+				router := c.Router(c.Stores()[0])
+				// countFilter counts the messages of every direction.
+				countFilter := func(counts *[2]int64) raftstore.MessageFilter {
+					return raftstore.MessageFilterFunc(func(dir raftstore.MessageDirection, msg *rspb.RaftMessage) bool {
+						atomic.AddInt64(&counts[dir], 1)
+						return true
+					})
+				}
+				// waitCounts waits for n messages of every direction.
+				waitCounts := func(counts *[2]int64, n int64) {
+					require.Eventually(t, func() bool {
+						return atomic.LoadInt64(&counts[raftstore.MessageInbound]) >= n && atomic.LoadInt64(&counts[raftstore.MessageOutbound]) >= n
+					}, 10*time.Second, 10*time.Millisecond)
+				}
+				var counts, after [2]int64
+				id := router.AddMessageFilter(countFilter(&counts))
+				waitCounts(&counts, 1)
+				require.True(t, router.RemoveMessageFilter(id))
+				// The messages seen by a filter added after the removal are not seen by the removed one.
+				router.AddMessageFilter(countFilter(&after))
+				waitCounts(&after, 1)
+				inbound, outbound := atomic.LoadInt64(&counts[raftstore.MessageInbound]), atomic.LoadInt64(&counts[raftstore.MessageOutbound])
+				waitCounts(&after, 5)
+				assert.Equal(t, inbound, atomic.LoadInt64(&counts[raftstore.MessageInbound]))
+				assert.Equal(t, outbound, atomic.LoadInt64(&counts[raftstore.MessageOutbound]))
+			},
+		},
+		{
+			name:       "bounded stale read",
+			regions:    2,
+			raftConfig: func(cfg *raftstore.Config) { cfg.SafeTSUpdateInterval = 200 * time.Millisecond },
+			workloads:  []WorkloadKind{BatchWrite},
+			ops:        50,
+			check: func(t *testing.T, c *Cluster) {
+				written, err := c.ts()
+				require.Nil(t, err)
+				// The leader and the followers serve the writes once the safe ts passes them. The last region is
+				// read, the raw start key of the first one is above the keys of the workloads.
+				key := Key(c.cfg.KeySpace - 1)
+				counts := make(map[uint64]int)
+				for _, storeID := range c.Stores() {
+					require.Eventually(t, func() bool {
+						snap, err := c.BoundedStaleSnapshot(storeID, key, 10*time.Second)
+						if err != nil {
+							return false
+						}
+						defer snap.Close()
+						if snap.TS() <= written {
+							return false
+						}
+						it := snap.NewIterator()
+						defer it.Close()
+						counts[storeID] = 0
+						for ; it.Valid(); it.Next() {
+							counts[storeID]++
+						}
+						return it.Err() == nil
+					}, 10*time.Second, 10*time.Millisecond)
+				}
+				var expected int
+				for storeID, count := range counts {
+					assert.Greater(t, count, 0, "store %d", storeID)
+					if expected == 0 {
+						expected = count
+					}
+					assert.Equal(t, expected, count, "store %d", storeID)
+				}
+
+				// A read not tolerating any staleness gets the safe ts to retry with.
+				for _, storeID := range c.Stores() {
+					_, err := c.BoundedStaleSnapshot(storeID, key, 0)
+					notReady, ok := errors.Cause(err).(*raftstore.ErrDataIsNotReady)
+					require.True(t, ok, "%v", err)
+					assert.Greater(t, notReady.SafeTS, written)
+				}
+			},
+		},
+		{
+			// The peers of the parent leader win the elections of the new regions, the other peers wait in the
+			// grace.
+			name:       "split election grace",
+			regions:    1,
+			raftConfig: func(cfg *raftstore.Config) { cfg.RaftElectionGraceTicks = 10 },
+			check: func(t *testing.T, c *Cluster) {
+				var leader uint64
+				for _, storeID := range c.Stores() {
+					if c.LeaderCount(storeID) == 1 {
+						leader = storeID
+					}
+				}
+				require.NotZero(t, leader)
+				for i := 1; i < 5; i++ {
+					c.MustSplit(Key(i * 100))
+				}
+				c.MustWaitRegionConvergence(10 * time.Second)
+				require.Eventually(t, func() bool {
+					var deferred uint64
+					for _, regionID := range c.pd.regionIDs() {
+						for _, storeID := range c.Stores() {
+							metrics, err := c.Router(storeID).ElectionMetrics(regionID)
+							require.Nil(t, err)
+							deferred += metrics.DeferredTicks
+						}
+					}
+					return deferred > 0
+				}, 10*time.Second, 10*time.Millisecond)
+				assert.Equal(t, 5, c.LeaderCount(leader))
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCluster(t, tt.regions, tt.raftConfig)
+			defer c.Stop()
+
+			for _, kind := range tt.workloads {
+				w := DefaultWorkload(kind)
+				w.Concurrency = 4
+				w.Ops = tt.ops
+				res, err := c.Run(w)
+				require.Nil(t, err)
+				assert.Equal(t, tt.ops, res.Ops, "%s", res)
+				assert.Equal(t, 0, res.Errors, "%s", res)
+			}
+			if tt.check != nil {
+				tt.check(t, c)
+			}
+		})
+	}
+}
+
+func TestClusterHarness(t *testing.T) {
+	c := newTestCluster(t, 4, nil)
+	defer c.Stop()
+
+	newStore := c.MustAddStore()
+	require.Len(t, c.Stores(), 4)
+	assert.Equal(t, 0, c.LeaderCount(newStore))
+
+	regions := c.MustSplit(Key(100))
+	require.Len(t, regions, 2)
+	_, err := c.Split(Key(100))
+	assert.NotNil(t, err)
+	c.MustWaitRegionConvergence(10 * time.Second)
+	require.Len(t, c.pd.regionIDs(), 5)
+
+	region, err := c.pd.GetRegion(context.Background(), codec.EncodeBytes(nil, Key(100)))
+	require.Nil(t, err)
+	var follower uint64
+	for _, peer := range region.Meta.Peers {
+		if peer.StoreId != region.Leader.StoreId {
+			follower = peer.StoreId
+		}
+	}
+	c.MustTransferLeader(region.Meta.Id, follower)
+	region, err = c.pd.GetRegionByID(context.Background(), region.Meta.Id)
+	require.Nil(t, err)
+	assert.Equal(t, follower, region.Leader.StoreId)
+	assert.NotNil(t, c.TransferLeader(region.Meta.Id, newStore))
+
+	// The regions elect new leaders on the other stores.
+	c.MustStopStore(follower)
+	require.Len(t, c.Stores(), 3)
+	assert.Nil(t, c.Router(follower))
+	assert.NotNil(t, c.StopStore(follower))
+	c.MustWaitRegionConvergence(10 * time.Second)
+	assert.Equal(t, 0, c.LeaderCount(follower))
+
+	w := DefaultWorkload(PointWrite)
+	w.Concurrency = 2
+	w.Ops = 20
+	res, err := c.Run(w)
+	require.Nil(t, err)
+	assert.Equal(t, 0, res.Errors, "%s", res)
+}
+
+func TestInterceptors(t *testing.T) {
+	cfg := DefaultClusterConfig()
+	var streams int64
+	cfg.Interceptors.Stream = []grpc.StreamServerInterceptor{
+		func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if info.FullMethod == "/tikvpb.Tikv/BatchRaft" || info.FullMethod == "/tikvpb.Tikv/Raft" {
+				atomic.AddInt64(&streams, 1)
+			}
+			return handler(srv, ss)
+		},
+	}
+	c, err := NewCluster(cfg)
+	require.Nil(t, err)
+	defer c.Stop()
+
+	w := DefaultWorkload(PointWrite)
+	w.Ops = 20
+	res, err := c.Run(w)
+	require.Nil(t, err)
+	assert.Equal(t, 0, res.Errors, "%s", res)
+	assert.Greater(t, atomic.LoadInt64(&streams), int64(0))
+}
+
+func benchmarkWorkload(b *testing.B, kind WorkloadKind) {
+	c := newTestCluster(b, 4, nil)
+	defer c.Stop()
+	w := DefaultWorkload(kind)
+	w.Ops = b.N
+	b.ResetTimer()
+	res, err := c.Run(w)
+	require.Nil(b, err)
+	b.ReportMetric(float64(res.P99.Microseconds()), "p99-us")
+	b.ReportMetric(float64(res.Errors), "errors")
+}
+
+func BenchmarkPointWrite(b *testing.B) {
+	benchmarkWorkload(b, PointWrite)
+}
+
+func BenchmarkBatchWrite(b *testing.B) {
+	benchmarkWorkload(b, BatchWrite)
+}
+
+func BenchmarkScan(b *testing.B) {
+	benchmarkWorkload(b, Scan)
+}
+
+func TestTSO(t *testing.T) {
+	cfg := DefaultTSOConfig()
+	cfg.ElectionDelay = 20 * time.Millisecond
+	tso := newTSO(cfg)
+	var prev uint64
+	// last checks the timestamp is greater than the last checked one.
+	last := func(physical, logical int64) {
+		ts := uint64(physical)<<18 + uint64(logical)
+		assert.True(t, ts > prev, "%d <= %d", ts, prev)
+		prev = ts
+	}
+
+	physical, logical, err := tso.GetTS()
+	require.Nil(t, err)
+	last(physical, logical)
+	physical, logical, err = tso.GetTSBatch(100)
+	require.Nil(t, err)
+	last(physical, logical-99)
+	last(physical, logical)
+	_, _, err = tso.GetTSBatch(maxLogical)
+	assert.NotNil(t, err)
+
+	// The timestamps don't regress if the clock jumps backward.
+	tso.Jump(-time.Hour)
+	physical, logical, err = tso.GetTS()
+	require.Nil(t, err)
+	last(physical, logical)
+	tso.Jump(time.Hour)
+
+	tso.Pause()
+	_, _, err = tso.GetTS()
+	assert.Equal(t, ErrTSOUnavailable, err)
+	tso.Resume()
+
+	// The new leader with a slow clock starts after the window reserved by the former leader.
+	require.Nil(t, tso.SetSkew(1, -time.Minute))
+	require.Nil(t, tso.TransferLeader(1))
+	assert.Equal(t, 1, tso.Leader())
+	_, _, err = tso.GetTS()
+	assert.Equal(t, ErrTSOUnavailable, err)
+	time.Sleep(cfg.ElectionDelay)
+	physical, logical, err = tso.GetTS()
+	require.Nil(t, err)
+	last(physical, logical)
+	assert.NotNil(t, tso.TransferLeader(3))
+}
@@ -0,0 +1,438 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bench drives transactional workloads through the raftstore of an in-process cluster and
+// reports the throughput and the latency percentiles.
+package bench
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ngaut/unistore/config"
+	"github.com/ngaut/unistore/raftstore"
+	"github.com/ngaut/unistore/server"
+	"github.com/pingcap/badger"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/pdpb"
+	"github.com/pingcap/kvproto/pkg/tikvpb"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/store/mockstore/unistore/lockstore"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/mvcc"
+	"github.com/pingcap/tidb/util/codec"
+	"github.com/zhangjinpeng1987/raft"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+// ClusterConfig is the configuration of an in-process cluster.
+type ClusterConfig struct {
+	Stores   int
+	Replicas int
+	// Regions is the number of regions the key space is split into before the stores are started.
+	Regions int
+	// KeySpace is the number of distinct keys used by the workloads, see Key.
+	KeySpace int
+	// Dir is the directory of the store data, a temporary directory is created and removed if it is empty.
+	Dir string
+	// RaftBaseTickInterval is short by default, so the regions elect their leaders quickly.
+	RaftBaseTickInterval time.Duration
+	// StartTimeout is the time to wait for every region to have a leader.
+	StartTimeout time.Duration
+	// RaftConfig adjusts the raftstore config of every store after the cluster sets its defaults, it may be
+	// nil.
+	RaftConfig func(*raftstore.Config)
+	// Interceptors are installed on the gRPC servers of the stores, which serve the raft messages.
+	Interceptors server.Interceptors
+	TSO          TSOConfig
+}
+
+// DefaultClusterConfig returns a three stores cluster with three replicas.
+func DefaultClusterConfig() ClusterConfig {
+	return ClusterConfig{
+		Stores:               3,
+		Replicas:             3,
+		Regions:              8,
+		KeySpace:             100000,
+		RaftBaseTickInterval: 100 * time.Millisecond,
+		StartTimeout:         30 * time.Second,
+		TSO:                  DefaultTSOConfig(),
+	}
+}
+
+// Key returns the i-th key of the key space.
+func Key(i int) []byte {
+	return []byte(fmt.Sprintf("bench_%010d", i))
+}
+
+// Cluster is an in-process cluster, the stores talk to each other by gRPC on the loopback interface.
+type Cluster struct {
+	cfg     ClusterConfig
+	dir     string
+	tempDir bool
+	pd      *mockPD
+
+	resolver *raftstore.StaticStoreResolver
+	// mu guards stores against AddStore and StopStore.
+	mu     sync.RWMutex
+	stores map[uint64]*store
+}
+
+type store struct {
+	meta     *metapb.Store
+	dir      string
+	kvDB     *badger.DB
+	raftDB   *badger.DB
+	engines  *raftstore.Engines
+	server   *raftstore.RaftInnerServer
+	router   *raftstore.Router
+	writer   mvcc.DBWriter
+	listener net.Listener
+	grpc     *grpc.Server
+	started  bool
+	stopped  bool
+}
+
+// raftService serves the raft messages and snapshots of a store, the other methods of tikvpb.TikvServer
+// are not implemented.
+type raftService struct {
+	tikvpb.TikvServer
+	server *raftstore.RaftInnerServer
+}
+
+func (s *raftService) Raft(stream tikvpb.Tikv_RaftServer) error {
+	return s.server.Raft(stream)
+}
+
+func (s *raftService) BatchRaft(stream tikvpb.Tikv_BatchRaftServer) error {
+	return s.server.BatchRaft(stream)
+}
+
+func (s *raftService) Snapshot(stream tikvpb.Tikv_SnapshotServer) error {
+	return s.server.Snapshot(stream)
+}
+
+// NewCluster bootstraps and starts a cluster, it returns after every region has a leader.
+func NewCluster(cfg ClusterConfig) (*Cluster, error) {
+	if cfg.Stores <= 0 || cfg.Replicas <= 0 || cfg.Replicas > cfg.Stores {
+		return nil, errors.Errorf("invalid %d replicas for %d stores", cfg.Replicas, cfg.Stores)
+	}
+	if cfg.Regions <= 0 || cfg.Regions > cfg.KeySpace {
+		return nil, errors.Errorf("invalid %d regions for %d keys", cfg.Regions, cfg.KeySpace)
+	}
+	c := &Cluster{cfg: cfg, dir: cfg.Dir, pd: newMockPD(cfg.TSO), stores: make(map[uint64]*store, cfg.Stores)}
+	if c.dir == "" {
+		dir, err := ioutil.TempDir("", "unistore_bench")
+		if err != nil {
+			return nil, err
+		}
+		c.dir, c.tempDir = dir, true
+	}
+	if err := c.start(); err != nil {
+		c.Stop()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Cluster) start() error {
+	ctx := context.Background()
+	metas := make([]*metapb.Store, 0, c.cfg.Stores)
+	engines := make([]*raftstore.Engines, 0, c.cfg.Stores)
+	addrs := make(map[uint64]string, c.cfg.Stores)
+	for i := 0; i < c.cfg.Stores; i++ {
+		storeID, _ := c.pd.AllocID(ctx)
+		s, err := c.newStore(storeID)
+		if err != nil {
+			return err
+		}
+		metas = append(metas, s.meta)
+		engines = append(engines, s.engines)
+		addrs[storeID] = s.meta.Address
+	}
+	splitKeys := make([][]byte, 0, c.cfg.Regions-1)
+	for i := 1; i < c.cfg.Regions; i++ {
+		splitKeys = append(splitKeys, Key(i*c.cfg.KeySpace/c.cfg.Regions))
+	}
+	if _, err := raftstore.BulkBootstrap(ctx, c.pd, metas, engines, splitKeys, c.cfg.Replicas); err != nil {
+		return err
+	}
+	c.resolver = raftstore.NewStaticStoreResolver(addrs)
+	for _, meta := range metas {
+		if err := c.startStore(c.stores[meta.Id], c.resolver); err != nil {
+			return err
+		}
+	}
+	return c.waitLeaders()
+}
+
+func (c *Cluster) newStore(storeID uint64) (*store, error) {
+	dir := filepath.Join(c.dir, fmt.Sprintf("store%d", storeID))
+	kvPath, raftPath := filepath.Join(dir, "kv"), filepath.Join(dir, "raft")
+	for _, path := range []string{kvPath, raftPath, filepath.Join(dir, "snap")} {
+		if err := os.MkdirAll(path, os.ModePerm); err != nil {
+			return nil, err
+		}
+	}
+	kvOpts := badger.DefaultOptions
+	kvOpts.Dir, kvOpts.ValueDir = kvPath, kvPath
+	kvOpts.ManagedTxns = true
+	kvDB, err := badger.Open(kvOpts)
+	if err != nil {
+		return nil, err
+	}
+	raftOpts := badger.DefaultOptions
+	raftOpts.Dir, raftOpts.ValueDir = raftPath, raftPath
+	raftOpts.ValueThreshold = 0
+	raftOpts.CompactionFilterFactory = raftstore.CreateRaftLogCompactionFilter
+	raftDB, err := badger.Open(raftOpts)
+	if err != nil {
+		kvDB.Close()
+		return nil, err
+	}
+	bundle := &mvcc.DBBundle{DB: kvDB, LockStore: lockstore.NewMemStore(8 << 20)}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		raftDB.Close()
+		kvDB.Close()
+		return nil, err
+	}
+	s := &store{
+		meta:     &metapb.Store{Id: storeID, Address: lis.Addr().String()},
+		dir:      dir,
+		kvDB:     kvDB,
+		raftDB:   raftDB,
+		engines:  raftstore.NewEngines(bundle, raftDB, kvPath, raftPath),
+		listener: lis,
+	}
+	c.mu.Lock()
+	c.stores[storeID] = s
+	c.mu.Unlock()
+	return s, nil
+}
+
+func (c *Cluster) startStore(s *store, resolver raftstore.StoreResolver) error {
+	globalConf := config.DefaultConf
+	raftConf := raftstore.NewDefaultConfig()
+	raftConf.Addr = s.meta.Address
+	raftConf.SnapPath = filepath.Join(s.dir, "snap")
+	raftConf.RaftBaseTickInterval = c.cfg.RaftBaseTickInterval
+	raftConf.InvariantViolationMode = raftstore.InvariantModePanic
+	raftConf.RaftStoreMaxLeaderLease = c.cfg.RaftBaseTickInterval * time.Duration(raftConf.RaftElectionTimeoutTicks-1)
+	if c.cfg.RaftConfig != nil {
+		c.cfg.RaftConfig(raftConf)
+	}
+	s.server = raftstore.NewRaftInnerServer(&globalConf, s.engines, raftConf)
+	s.server.Setup(c.pd)
+	*s.server.GetStoreMeta() = *s.meta
+	s.server.SetStoreResolver(resolver)
+	s.server.SetPeerEventObserver(noopObserver{})
+	s.router = s.server.GetRaftstoreRouter()
+	s.writer = raftstore.NewDBWriter(&globalConf, s.router)
+
+	s.grpc = grpc.NewServer(
+		grpc.UnaryInterceptor(server.ChainUnaryInterceptors(c.cfg.Interceptors.Unary...)),
+		grpc.StreamInterceptor(server.ChainStreamInterceptors(c.cfg.Interceptors.Stream...)),
+	)
+	tikvpb.RegisterTikvServer(s.grpc, &raftService{server: s.server})
+	go func() {
+		if err := s.grpc.Serve(s.listener); err != nil {
+			log.Warn("bench store stops serving", zap.Uint64("store id", s.meta.Id), zap.Error(err))
+		}
+	}()
+	if err := s.server.Start(c.pd); err != nil {
+		return err
+	}
+	s.started = true
+	return nil
+}
+
+func (c *Cluster) waitLeaders() error {
+	deadline := time.Now().Add(c.cfg.StartTimeout)
+	for {
+		total, withLeader := c.pd.regionCount()
+		if total == c.cfg.Regions && withLeader == total {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.Errorf("only %d of %d regions have a leader after %v", withLeader, total, c.cfg.StartTimeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Stop stops the stores and removes the temporary directory.
+func (c *Cluster) Stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range c.stores {
+		if s.stopped {
+			continue
+		}
+		if s.started {
+			if err := s.server.Stop(); err != nil {
+				log.Warn("failed to stop bench store", zap.Uint64("store id", s.meta.Id), zap.Error(err))
+			}
+		} else {
+			s.raftDB.Close()
+			s.kvDB.Close()
+		}
+		if s.grpc != nil {
+			s.grpc.Stop()
+		} else {
+			s.listener.Close()
+		}
+	}
+	if c.tempDir {
+		os.RemoveAll(c.dir)
+	}
+}
+
+// Router returns the router of the store, nil if the store is not found or stopped.
+func (c *Cluster) Router(storeID uint64) *raftstore.Router {
+	if s := c.getStore(storeID); s != nil {
+		return s.router
+	}
+	return nil
+}
+
+// getStore returns the running store, nil if the store is not found or stopped.
+func (c *Cluster) getStore(storeID uint64) *store {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if s, ok := c.stores[storeID]; ok && !s.stopped {
+		return s
+	}
+	return nil
+}
+
+// StoreStats returns the last stats reported by the store heartbeat, nil if the store hasn't reported yet.
+// The read and written bytes and keys are summed over the heartbeats.
+func (c *Cluster) StoreStats(storeID uint64) *pdpb.StoreStats {
+	return c.pd.getStoreStats(storeID)
+}
+
+// LeaderCount returns the number of the region leaders on the store reported by the region heartbeats, the
+// store heartbeat doesn't carry it.
+func (c *Cluster) LeaderCount(storeID uint64) int {
+	return c.pd.leaderCount(storeID)
+}
+
+// CheckRegionConsistency compares the replicas of the region on the stores of the cluster, see
+// raftstore.Router.CheckRegionConsistency.
+func (c *Cluster) CheckRegionConsistency(ctx context.Context, regionID uint64) (*raftstore.RegionConsistencyReport, error) {
+	region, err := c.pd.GetRegionByID(ctx, regionID)
+	if err != nil {
+		return nil, err
+	}
+	// Compare on the leader if it's running, the followers may not know the latest peers yet.
+	var router *raftstore.Router
+	if region.Leader != nil {
+		router = c.Router(region.Leader.StoreId)
+	}
+	for _, peer := range region.Meta.Peers {
+		if router != nil {
+			break
+		}
+		router = c.Router(peer.StoreId)
+	}
+	if router == nil {
+		return nil, errors.Errorf("region %d has no peer on a running store", regionID)
+	}
+	fetch := func(ctx context.Context, storeID, regionID uint64) (*raftstore.ReplicaState, error) {
+		s := c.getStore(storeID)
+		if s == nil {
+			return nil, errors.Errorf("store %d not found", storeID)
+		}
+		return s.router.ReplicaState(ctx, regionID)
+	}
+	return router.CheckRegionConsistency(ctx, regionID, fetch)
+}
+
+// BoundedStaleSnapshot returns a snapshot of the region containing the raw key on the store, the leader or
+// a follower, for a read tolerating maxStaleness behind a new timestamp, see
+// raftstore.RaftInnerServer.BoundedStaleSnapshot.
+func (c *Cluster) BoundedStaleSnapshot(storeID uint64, key []byte, maxStaleness time.Duration) (*raftstore.MultiRegionSnapshot, error) {
+	s := c.getStore(storeID)
+	if s == nil {
+		return nil, errors.Errorf("store %d not found", storeID)
+	}
+	regionCtx, _, err := c.locate(key)
+	if err != nil {
+		return nil, err
+	}
+	ts, err := c.ts()
+	if err != nil {
+		return nil, err
+	}
+	return s.server.BoundedStaleSnapshot(regionCtx, ts, maxStaleness)
+}
+
+// locate returns the request context and the leader store of the region containing the raw key.
+func (c *Cluster) locate(key []byte) (*kvrpcpb.Context, *store, error) {
+	region, err := c.pd.GetRegion(context.Background(), codec.EncodeBytes(nil, key))
+	if err != nil {
+		return nil, nil, err
+	}
+	if region.Leader == nil {
+		return nil, nil, errors.Errorf("region %d has no leader", region.Meta.Id)
+	}
+	s := c.getStore(region.Leader.StoreId)
+	if s == nil {
+		return nil, nil, errors.Errorf("store %d not found", region.Leader.StoreId)
+	}
+	return &kvrpcpb.Context{
+		RegionId:    region.Meta.Id,
+		RegionEpoch: region.Meta.RegionEpoch,
+		Peer:        region.Leader,
+	}, s, nil
+}
+
+// TSO returns the timestamp oracle of the mock PD.
+func (c *Cluster) TSO() *TSO {
+	return c.pd.tso
+}
+
+// ts returns a new timestamp from the mock PD, it retries while the TSO is unavailable like a client
+// failing over to the new TSO leader.
+func (c *Cluster) ts() (uint64, error) {
+	deadline := time.Now().Add(c.cfg.TSO.RetryTimeout)
+	for {
+		physical, logical, err := c.pd.GetTS(context.Background())
+		if err == nil {
+			return uint64(physical)<<18 + uint64(logical), nil
+		}
+		if errors.Cause(err) != ErrTSOUnavailable || time.Now().After(deadline) {
+			return 0, err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type noopObserver struct{}
+
+func (noopObserver) OnPeerCreate(ctx *raftstore.PeerEventContext, region *metapb.Region)    {}
+func (noopObserver) OnPeerApplySnap(ctx *raftstore.PeerEventContext, region *metapb.Region) {}
+func (noopObserver) OnPeerDestroy(ctx *raftstore.PeerEventContext)                          {}
+func (noopObserver) OnSplitRegion(derived *metapb.Region, regions []*metapb.Region, peers []*raftstore.PeerEventContext) {
+}
+func (noopObserver) OnRegionConfChange(ctx *raftstore.PeerEventContext, epoch *metapb.RegionEpoch) {}
+func (noopObserver) OnRoleChange(regionID uint64, newState raft.StateType)                         {}
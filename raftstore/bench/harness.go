@@ -0,0 +1,233 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bench
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ngaut/unistore/raftstore"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/util/codec"
+	"go.uber.org/zap"
+)
+
+// The methods below drive the topology of the cluster for the multi-store tests. They wait for the cluster
+// to reach the expected state up to ClusterConfig.StartTimeout, the Must variants panic on the failures.
+
+// Stores returns the ids of the running stores in ascending order.
+func (c *Cluster) Stores() []uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	ids := make([]uint64, 0, len(c.stores))
+	for id, s := range c.stores {
+		if !s.stopped {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// AddStore starts a new empty store, the regions are not moved to it since the mock PD never schedules.
+func (c *Cluster) AddStore() (uint64, error) {
+	storeID, _ := c.pd.AllocID(context.Background())
+	s, err := c.newStore(storeID)
+	if err != nil {
+		return 0, err
+	}
+	if err = raftstore.BootstrapStore(s.engines, benchClusterID, storeID); err != nil {
+		return 0, err
+	}
+	c.resolver.SetAddr(storeID, s.meta.Address)
+	if err = c.startStore(s, c.resolver); err != nil {
+		return 0, err
+	}
+	return storeID, nil
+}
+
+// MustAddStore is like AddStore but panics on the failure.
+func (c *Cluster) MustAddStore() uint64 {
+	storeID, err := c.AddStore()
+	if err != nil {
+		panic(err)
+	}
+	return storeID
+}
+
+// StopStore stops the store like a crash, the other stores keep failing to send it the raft messages. A
+// stopped store can't be restarted.
+func (c *Cluster) StopStore(storeID uint64) error {
+	c.mu.Lock()
+	s, ok := c.stores[storeID]
+	if !ok || !s.started || s.stopped {
+		c.mu.Unlock()
+		return errors.Errorf("store %d not found", storeID)
+	}
+	s.stopped = true
+	c.mu.Unlock()
+	err := s.server.Stop()
+	s.grpc.Stop()
+	return err
+}
+
+// MustStopStore is like StopStore but panics on the failure.
+func (c *Cluster) MustStopStore(storeID uint64) {
+	if err := c.StopStore(storeID); err != nil {
+		panic(err)
+	}
+}
+
+// TransferLeader moves the leader of the region to its peer on the store, it returns after PD sees the new
+// leader. The transfer is retried every election timeout since the leader ignores it while the target peer
+// is behind.
+func (c *Cluster) TransferLeader(regionID, storeID uint64) error {
+	electionTimeout := c.cfg.RaftBaseTickInterval * time.Duration(raftstore.NewDefaultConfig().RaftElectionTimeoutTicks)
+	deadline := time.Now().Add(c.cfg.StartTimeout)
+	var retry time.Time
+	for {
+		region, err := c.pd.GetRegionByID(context.Background(), regionID)
+		if err != nil {
+			return err
+		}
+		if region.Leader.GetStoreId() == storeID {
+			return nil
+		}
+		var target *metapb.Peer
+		for _, peer := range region.Meta.Peers {
+			if peer.StoreId == storeID {
+				target = peer
+			}
+		}
+		if target == nil {
+			return errors.Errorf("region %d has no peer on store %d", regionID, storeID)
+		}
+		if s := c.getStore(region.Leader.GetStoreId()); s != nil && time.Now().After(retry) {
+			err = s.router.TransferLeader(&kvrpcpb.Context{
+				RegionId:    regionID,
+				RegionEpoch: region.Meta.RegionEpoch,
+				Peer:        region.Leader,
+			}, target)
+			if err != nil {
+				log.Warn("failed to transfer leader", zap.Uint64("region id", regionID), zap.Uint64("store id", storeID),
+					zap.Error(err))
+			}
+			retry = time.Now().Add(electionTimeout)
+		}
+		if time.Now().After(deadline) {
+			return errors.Errorf("leader of region %d is still on store %d after %v", regionID,
+				region.Leader.GetStoreId(), c.cfg.StartTimeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// MustTransferLeader is like TransferLeader but panics on the failure.
+func (c *Cluster) MustTransferLeader(regionID, storeID uint64) {
+	if err := c.TransferLeader(regionID, storeID); err != nil {
+		panic(err)
+	}
+}
+
+// Split splits the region containing the raw key at the key, it returns the regions derived by the split.
+// The split is retried while PD doesn't know the latest epoch or leader of the region.
+func (c *Cluster) Split(key []byte) ([]*metapb.Region, error) {
+	splitKey := codec.EncodeBytes(nil, key)
+	deadline := time.Now().Add(c.cfg.StartTimeout)
+	for {
+		regionCtx, s, err := c.locate(key)
+		if err == nil {
+			region, _ := c.pd.GetRegionByID(context.Background(), regionCtx.RegionId)
+			if bytes.Equal(region.Meta.StartKey, splitKey) {
+				return nil, errors.Errorf("region %d already starts at key %q", regionCtx.RegionId, key)
+			}
+			var regions []*metapb.Region
+			if regions, err = s.router.SplitRegion(regionCtx, [][]byte{splitKey}); len(regions) > 0 {
+				return regions, nil
+			}
+			if err == nil {
+				err = errors.Errorf("failed to split region %d at key %q", regionCtx.RegionId, key)
+			}
+		}
+		if time.Now().After(deadline) {
+			return nil, err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// MustSplit is like Split but panics on the failure.
+func (c *Cluster) MustSplit(key []byte) []*metapb.Region {
+	regions, err := c.Split(key)
+	if err != nil {
+		panic(err)
+	}
+	return regions
+}
+
+// WaitRegionConvergence waits until every region has a leader on a running store and its replicas on the
+// running stores have the same epoch, applied index and data, see CheckRegionConsistency.
+func (c *Cluster) WaitRegionConvergence(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := c.checkConvergence()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.Annotatef(err, "regions don't converge after %v", timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// MustWaitRegionConvergence is like WaitRegionConvergence but panics on the failure.
+func (c *Cluster) MustWaitRegionConvergence(timeout time.Duration) {
+	if err := c.WaitRegionConvergence(timeout); err != nil {
+		panic(err)
+	}
+}
+
+// checkConvergence returns the first region not converged.
+func (c *Cluster) checkConvergence() error {
+	ctx := context.Background()
+	for _, regionID := range c.pd.regionIDs() {
+		region, err := c.pd.GetRegionByID(ctx, regionID)
+		if err != nil {
+			return err
+		}
+		if region.Leader == nil || c.getStore(region.Leader.StoreId) == nil {
+			return errors.Errorf("region %d has no leader on a running store", regionID)
+		}
+		report, err := c.CheckRegionConsistency(ctx, regionID)
+		if err != nil {
+			return errors.Annotatef(err, "region %d", regionID)
+		}
+		for storeID, msg := range report.Errors {
+			if c.getStore(storeID) != nil {
+				return errors.Errorf("region %d: store %d: %s", regionID, storeID, msg)
+			}
+		}
+		if len(report.Mismatches) > 0 {
+			return errors.Errorf("region %d: %s", regionID, strings.Join(report.Mismatches, "; "))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bench
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/pdpb"
+	"github.com/pingcap/tidb/store/mockstore/unistore/pd"
+	pdclient "github.com/tikv/pd/client"
+)
+
+const benchClusterID = 1
+
+// mockPD is an in-memory PD for the in-process cluster, it allocates ids and timestamps and keeps the
+// regions and leaders reported by the region heartbeats and the stats reported by the store heartbeats. It
+// never schedules anything.
+type mockPD struct {
+	id  uint64
+	tso *TSO
+
+	mu           sync.RWMutex
+	bootstrapped bool
+	stores       map[uint64]*metapb.Store
+	regions      map[uint64]*pdclient.Region
+	storeStats   map[uint64]*pdpb.StoreStats
+	// terms are the raft terms of the last region heartbeats.
+	terms map[uint64]uint64
+}
+
+var _ pd.Client = new(mockPD)
+
+func newMockPD(tsoCfg TSOConfig) *mockPD {
+	return &mockPD{
+		tso:        newTSO(tsoCfg),
+		stores:     make(map[uint64]*metapb.Store),
+		regions:    make(map[uint64]*pdclient.Region),
+		terms:      make(map[uint64]uint64),
+		storeStats: make(map[uint64]*pdpb.StoreStats),
+	}
+}
+
+func (c *mockPD) GetClusterID(ctx context.Context) uint64 {
+	return benchClusterID
+}
+
+func (c *mockPD) AllocID(ctx context.Context) (uint64, error) {
+	return atomic.AddUint64(&c.id, 1), nil
+}
+
+func (c *mockPD) Bootstrap(ctx context.Context, store *metapb.Store, region *metapb.Region) (*pdpb.BootstrapResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.bootstrapped {
+		return &pdpb.BootstrapResponse{Header: &pdpb.ResponseHeader{
+			Error: &pdpb.Error{Type: pdpb.ErrorType_ALREADY_BOOTSTRAPPED, Message: "already bootstrapped"},
+		}}, nil
+	}
+	c.bootstrapped = true
+	c.putRegion(region, nil)
+	return &pdpb.BootstrapResponse{}, nil
+}
+
+func (c *mockPD) IsBootstrapped(ctx context.Context) (bool, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.bootstrapped, nil
+}
+
+func (c *mockPD) PutStore(ctx context.Context, store *metapb.Store) error {
+	c.mu.Lock()
+	c.stores[store.Id] = proto.Clone(store).(*metapb.Store)
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *mockPD) GetStore(ctx context.Context, storeID uint64) (*metapb.Store, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	store, ok := c.stores[storeID]
+	if !ok {
+		return nil, errors.Errorf("store %d not found", storeID)
+	}
+	return store, nil
+}
+
+// GetRegion returns the region containing the encoded key.
+func (c *mockPD) GetRegion(ctx context.Context, key []byte) (*pdclient.Region, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var found *pdclient.Region
+	for _, region := range c.regions {
+		meta := region.Meta
+		if bytes.Compare(key, meta.StartKey) < 0 || (len(meta.EndKey) > 0 && bytes.Compare(key, meta.EndKey) >= 0) {
+			continue
+		}
+		// The stale parent of a split region may still cover the key until it reports its new range.
+		if found == nil || found.Meta.RegionEpoch.Version < meta.RegionEpoch.Version {
+			found = region
+		}
+	}
+	if found == nil {
+		return nil, errors.Errorf("region of key %q not found", key)
+	}
+	return found, nil
+}
+
+func (c *mockPD) GetRegionByID(ctx context.Context, regionID uint64) (*pdclient.Region, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	region, ok := c.regions[regionID]
+	if !ok {
+		return nil, errors.Errorf("region %d not found", regionID)
+	}
+	return region, nil
+}
+
+// ReportRegion keeps the region and its leader, the heartbeat of a stale leader may arrive after the one of the
+// new leader and is ignored by its lower term.
+func (c *mockPD) ReportRegion(req *pdpb.RegionHeartbeatRequest) {
+	c.mu.Lock()
+	if req.Term >= c.terms[req.Region.Id] {
+		c.terms[req.Region.Id] = req.Term
+		c.putRegion(req.Region, req.Leader)
+	}
+	c.mu.Unlock()
+}
+
+// putRegion keeps the region unless a newer version of the region is known, it must be called with the lock.
+func (c *mockPD) putRegion(meta *metapb.Region, leader *metapb.Peer) {
+	if old, ok := c.regions[meta.Id]; ok {
+		oldEpoch, epoch := old.Meta.RegionEpoch, meta.RegionEpoch
+		if epoch.Version < oldEpoch.Version || epoch.ConfVer < oldEpoch.ConfVer {
+			return
+		}
+		if leader == nil {
+			leader = old.Leader
+		}
+	}
+	c.regions[meta.Id] = &pdclient.Region{Meta: meta, Leader: leader}
+}
+
+func (c *mockPD) AskSplit(ctx context.Context, region *metapb.Region) (*pdpb.AskSplitResponse, error) {
+	resp := &pdpb.AskSplitResponse{NewRegionId: atomic.AddUint64(&c.id, 1)}
+	for range region.Peers {
+		resp.NewPeerIds = append(resp.NewPeerIds, atomic.AddUint64(&c.id, 1))
+	}
+	return resp, nil
+}
+
+func (c *mockPD) AskBatchSplit(ctx context.Context, region *metapb.Region, count int) (*pdpb.AskBatchSplitResponse, error) {
+	resp := new(pdpb.AskBatchSplitResponse)
+	for i := 0; i < count; i++ {
+		split, _ := c.AskSplit(ctx, region)
+		resp.Ids = append(resp.Ids, &pdpb.SplitID{NewRegionId: split.NewRegionId, NewPeerIds: split.NewPeerIds})
+	}
+	return resp, nil
+}
+
+func (c *mockPD) ReportBatchSplit(ctx context.Context, regions []*metapb.Region) error {
+	c.mu.Lock()
+	for _, region := range regions {
+		c.putRegion(region, nil)
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *mockPD) GetGCSafePoint(ctx context.Context) (uint64, error) {
+	return 0, nil
+}
+
+// StoreHeartbeat keeps the last stats of the store, the read and written bytes and keys of the intervals are
+// summed up.
+func (c *mockPD) StoreHeartbeat(ctx context.Context, stats *pdpb.StoreStats) error {
+	stats = proto.Clone(stats).(*pdpb.StoreStats)
+	c.mu.Lock()
+	if last, ok := c.storeStats[stats.StoreId]; ok {
+		stats.BytesWritten += last.BytesWritten
+		stats.KeysWritten += last.KeysWritten
+		stats.BytesRead += last.BytesRead
+		stats.KeysRead += last.KeysRead
+	}
+	c.storeStats[stats.StoreId] = stats
+	c.mu.Unlock()
+	return nil
+}
+
+// GetTS returns a strictly increasing timestamp.
+func (c *mockPD) GetTS(ctx context.Context) (int64, int64, error) {
+	return c.tso.GetTS()
+}
+
+func (c *mockPD) SetRegionHeartbeatResponseHandler(h func(*pdpb.RegionHeartbeatResponse)) {}
+
+func (c *mockPD) Close() {}
+
+func (c *mockPD) getStoreStats(storeID uint64) *pdpb.StoreStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if stats, ok := c.storeStats[storeID]; ok {
+		return proto.Clone(stats).(*pdpb.StoreStats)
+	}
+	return nil
+}
+
+// leaderCount returns the number of the region leaders on the store.
+func (c *mockPD) leaderCount(storeID uint64) int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var count int
+	for _, region := range c.regions {
+		if region.Leader.GetStoreId() == storeID {
+			count++
+		}
+	}
+	return count
+}
+
+// regionCount returns the number of regions and the number of regions with a known leader.
+func (c *mockPD) regionCount() (total, withLeader int) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, region := range c.regions {
+		total++
+		if region.Leader != nil && region.Leader.Id != 0 {
+			withLeader++
+		}
+	}
+	return
+}
+
+// regionIDs returns the ids of the known regions.
+func (c *mockPD) regionIDs() []uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	ids := make([]uint64, 0, len(c.regions))
+	for id := range c.regions {
+		ids = append(ids, id)
+	}
+	return ids
+}
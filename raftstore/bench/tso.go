@@ -0,0 +1,168 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bench
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+)
+
+// maxLogical is the number of the logical timestamps of a physical millisecond.
+const maxLogical = 1 << 18
+
+// ErrTSOUnavailable is returned when the TSO is paused or its leader is being elected.
+var ErrTSOUnavailable = errors.New("tso is unavailable")
+
+// TSOConfig is the configuration of the timestamp oracle of the mock PD.
+type TSOConfig struct {
+	// Members is the number of the PD members that may serve the TSO, one at a time.
+	Members int
+	// SaveInterval is the time window the leader reserves ahead of the allocated timestamps, a new leader
+	// starts after the reserved window, so the timestamps never regress across leader transfers.
+	SaveInterval time.Duration
+	// ElectionDelay is the time the TSO is unavailable after the leader is transferred.
+	ElectionDelay time.Duration
+	// RetryTimeout is the time the cluster retries to get a timestamp while the TSO is unavailable.
+	RetryTimeout time.Duration
+}
+
+// DefaultTSOConfig returns a TSO of three members.
+func DefaultTSOConfig() TSOConfig {
+	return TSOConfig{
+		Members:       3,
+		SaveInterval:  3 * time.Second,
+		ElectionDelay: 50 * time.Millisecond,
+		RetryTimeout:  5 * time.Second,
+	}
+}
+
+// TSO is the timestamp oracle of the mock PD. Every member has its own clock, the fault knobs skew the
+// clocks, pause the TSO and transfer its leader, so the failover of the clients and the causal consistency
+// built on the timestamps can be tested.
+type TSO struct {
+	cfg TSOConfig
+
+	mu       sync.Mutex
+	leader   int
+	skews    []time.Duration
+	physical int64
+	logical  int64
+	// savedLimit is the physical time in milliseconds reserved by the leader, it is never reached by the
+	// allocated timestamps.
+	savedLimit int64
+	paused     bool
+	// unavailableUntil is the end of the election of the leader.
+	unavailableUntil time.Time
+}
+
+func newTSO(cfg TSOConfig) *TSO {
+	if cfg.Members <= 0 {
+		cfg.Members = 1
+	}
+	return &TSO{cfg: cfg, skews: make([]time.Duration, cfg.Members)}
+}
+
+// clock returns the physical time of the member in milliseconds, it must be called with the lock.
+func (t *TSO) clock(member int) int64 {
+	return time.Now().Add(t.skews[member]).UnixNano() / int64(time.Millisecond)
+}
+
+// GetTS returns a strictly increasing timestamp.
+func (t *TSO) GetTS() (int64, int64, error) {
+	return t.GetTSBatch(1)
+}
+
+// GetTSBatch allocates count consecutive timestamps at once and returns the last one, the first one is
+// the returned logical time minus count plus one.
+func (t *TSO) GetTSBatch(count int) (int64, int64, error) {
+	if count <= 0 || count >= maxLogical {
+		return 0, 0, errors.Errorf("invalid tso batch size %d", count)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.paused || time.Now().Before(t.unavailableUntil) {
+		return 0, 0, ErrTSOUnavailable
+	}
+	// The physical time doesn't follow the clock if it jumps backward.
+	if physical := t.clock(t.leader); physical > t.physical {
+		t.physical, t.logical = physical, -1
+	}
+	if t.logical+int64(count) >= maxLogical {
+		t.physical, t.logical = t.physical+1, -1
+	}
+	t.logical += int64(count)
+	if t.physical >= t.savedLimit {
+		t.savedLimit = t.physical + int64(t.cfg.SaveInterval/time.Millisecond) + 1
+	}
+	return t.physical, t.logical, nil
+}
+
+// Leader returns the member serving the TSO.
+func (t *TSO) Leader() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.leader
+}
+
+// TransferLeader transfers the TSO to the member, the TSO is unavailable for the election delay. The new
+// leader starts from the window reserved by the former leader, no matter how its clock is skewed.
+func (t *TSO) TransferLeader(member int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if member < 0 || member >= len(t.skews) {
+		return errors.Errorf("tso member %d not found", member)
+	}
+	t.leader = member
+	t.physical, t.logical = t.savedLimit, -1
+	if physical := t.clock(member); physical > t.physical {
+		t.physical = physical
+	}
+	t.savedLimit = t.physical + int64(t.cfg.SaveInterval/time.Millisecond) + 1
+	t.unavailableUntil = time.Now().Add(t.cfg.ElectionDelay)
+	return nil
+}
+
+// SetSkew sets the clock skew of the member.
+func (t *TSO) SetSkew(member int, skew time.Duration) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if member < 0 || member >= len(t.skews) {
+		return errors.Errorf("tso member %d not found", member)
+	}
+	t.skews[member] = skew
+	return nil
+}
+
+// Jump moves the clock of the leader forward, or backward if d is negative.
+func (t *TSO) Jump(d time.Duration) {
+	t.mu.Lock()
+	t.skews[t.leader] += d
+	t.mu.Unlock()
+}
+
+// Pause makes the TSO unavailable until it is resumed.
+func (t *TSO) Pause() {
+	t.mu.Lock()
+	t.paused = true
+	t.mu.Unlock()
+}
+
+// Resume resumes the paused TSO.
+func (t *TSO) Resume() {
+	t.mu.Lock()
+	t.paused = false
+	t.mu.Unlock()
+}
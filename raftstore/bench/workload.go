@@ -0,0 +1,326 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bench
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ngaut/unistore/raftstore"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/mvcc"
+	"go.uber.org/zap"
+)
+
+// WorkloadKind is the kind of the operations of a workload.
+type WorkloadKind int
+
+// WorkloadKind
+const (
+	// PointWrite prewrites and commits a single key in a transaction.
+	PointWrite WorkloadKind = iota
+	// BatchWrite prewrites and commits Workload.BatchSize keys in a transaction, the keys of every
+	// region are written in a single raft command.
+	BatchWrite
+	// Scan reads Workload.BatchSize keys of a region from a consistent snapshot.
+	Scan
+)
+
+func (k WorkloadKind) String() string {
+	switch k {
+	case PointWrite:
+		return "point-write"
+	case BatchWrite:
+		return "batch-write"
+	case Scan:
+		return "scan"
+	}
+	return "unknown"
+}
+
+// Workload describes the operations sent to the cluster.
+type Workload struct {
+	Kind WorkloadKind
+	// Concurrency is the number of clients sending the operations.
+	Concurrency int
+	// Ops is the total number of operations, the workload runs for Duration instead if it is 0.
+	Ops      int
+	Duration time.Duration
+	// BatchSize is the number of keys of a BatchWrite transaction or a Scan.
+	BatchSize int
+	ValueSize int
+	// MaxRetries is the number of times an operation is retried after a region error, such as a
+	// leader change, before it is counted as an error.
+	MaxRetries int
+}
+
+// DefaultWorkload returns a workload of the kind with 16 clients running for 10 seconds.
+func DefaultWorkload(kind WorkloadKind) Workload {
+	return Workload{
+		Kind:        kind,
+		Concurrency: 16,
+		Duration:    10 * time.Second,
+		BatchSize:   16,
+		ValueSize:   128,
+		MaxRetries:  10,
+	}
+}
+
+// Result is the result of a workload. The latency of an operation includes its retries.
+type Result struct {
+	Kind    WorkloadKind
+	Ops     int
+	Errors  int
+	Elapsed time.Duration
+	P50     time.Duration
+	P90     time.Duration
+	P99     time.Duration
+	Max     time.Duration
+}
+
+// Throughput returns the number of succeeded operations per second.
+func (r *Result) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Ops) / r.Elapsed.Seconds()
+}
+
+func (r *Result) String() string {
+	return fmt.Sprintf("%s: %d ops, %d errors in %v, %.1f ops/s, p50 %v, p90 %v, p99 %v, max %v",
+		r.Kind, r.Ops, r.Errors, r.Elapsed, r.Throughput(), r.P50, r.P90, r.P99, r.Max)
+}
+
+// Run runs the workload and returns the result.
+func (c *Cluster) Run(w Workload) (*Result, error) {
+	if w.Concurrency <= 0 {
+		return nil, errors.Errorf("invalid concurrency %d", w.Concurrency)
+	}
+	if w.Ops <= 0 && w.Duration <= 0 {
+		return nil, errors.New("either ops or duration must be positive")
+	}
+	if w.Kind != PointWrite && w.BatchSize <= 0 {
+		return nil, errors.Errorf("invalid batch size %d", w.BatchSize)
+	}
+	var (
+		wg        sync.WaitGroup
+		remaining = int64(w.Ops)
+		errCount  int64
+		latencies = make([][]time.Duration, w.Concurrency)
+	)
+	start := time.Now()
+	deadline := start.Add(w.Duration)
+	for i := 0; i < w.Concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(start.UnixNano() + int64(i)))
+			for {
+				if w.Ops > 0 {
+					if atomic.AddInt64(&remaining, -1) < 0 {
+						return
+					}
+				} else if time.Now().After(deadline) {
+					return
+				}
+				opStart := time.Now()
+				if err := c.runOp(&w, rnd); err != nil {
+					if atomic.AddInt64(&errCount, 1) == 1 {
+						log.Warn("bench operation failed", zap.Stringer("kind", w.Kind), zap.Error(err))
+					}
+					continue
+				}
+				latencies[i] = append(latencies[i], time.Since(opStart))
+			}
+		}(i)
+	}
+	wg.Wait()
+	res := &Result{Kind: w.Kind, Errors: int(errCount), Elapsed: time.Since(start)}
+	res.setLatencies(latencies)
+	return res, nil
+}
+
+func (r *Result) setLatencies(perClient [][]time.Duration) {
+	var all []time.Duration
+	for _, l := range perClient {
+		all = append(all, l...)
+	}
+	r.Ops = len(all)
+	if len(all) == 0 {
+		return
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+	percentile := func(p int) time.Duration {
+		return all[(len(all)-1)*p/100]
+	}
+	r.P50, r.P90, r.P99, r.Max = percentile(50), percentile(90), percentile(99), all[len(all)-1]
+}
+
+func (c *Cluster) runOp(w *Workload, rnd *rand.Rand) error {
+	switch w.Kind {
+	case PointWrite:
+		return c.write([]int{rnd.Intn(c.cfg.KeySpace)}, w, rnd)
+	case BatchWrite:
+		keys := make([]int, w.BatchSize)
+		for i := range keys {
+			keys[i] = rnd.Intn(c.cfg.KeySpace)
+		}
+		return c.write(keys, w, rnd)
+	case Scan:
+		return c.scan(rnd.Intn(c.cfg.KeySpace), w)
+	}
+	return errors.Errorf("unknown workload kind %d", w.Kind)
+}
+
+// write prewrites and then commits the keys in a transaction, the keys are grouped by region and the
+// groups are written one by one.
+func (c *Cluster) write(keyIdxs []int, w *Workload, rnd *rand.Rand) error {
+	sort.Ints(keyIdxs)
+	keys := make([][]byte, 0, len(keyIdxs))
+	for i, idx := range keyIdxs {
+		if i == 0 || idx != keyIdxs[i-1] {
+			keys = append(keys, Key(idx))
+		}
+	}
+	value := make([]byte, w.ValueSize)
+	rnd.Read(value)
+	startTS, err := c.ts()
+	if err != nil {
+		return err
+	}
+	primary := keys[0]
+	newLock := func(key []byte) *mvcc.Lock {
+		return &mvcc.Lock{
+			LockHdr: mvcc.LockHdr{
+				StartTS:    startTS,
+				TTL:        3000,
+				Op:         uint8(kvrpcpb.Op_Put),
+				PrimaryLen: uint16(len(primary)),
+			},
+			Primary: primary,
+			Value:   value,
+		}
+	}
+	err = c.writeGroups(keys, w.MaxRetries, func(s *store, regionCtx *kvrpcpb.Context, keys [][]byte) error {
+		batch := s.writer.NewWriteBatch(startTS, 0, regionCtx)
+		for _, key := range keys {
+			batch.Prewrite(key, newLock(key))
+		}
+		return s.writer.Write(batch)
+	})
+	if err != nil {
+		return err
+	}
+	commitTS, err := c.ts()
+	if err != nil {
+		return err
+	}
+	return c.writeGroups(keys, w.MaxRetries, func(s *store, regionCtx *kvrpcpb.Context, keys [][]byte) error {
+		batch := s.writer.NewWriteBatch(startTS, commitTS, regionCtx)
+		for _, key := range keys {
+			batch.Commit(key, newLock(key))
+		}
+		return s.writer.Write(batch)
+	})
+}
+
+// writeGroups calls write for the sorted keys of every region, a failed group is located and retried.
+func (c *Cluster) writeGroups(keys [][]byte, maxRetries int,
+	write func(s *store, regionCtx *kvrpcpb.Context, keys [][]byte) error) error {
+	for len(keys) > 0 {
+		var err error
+		for retry := 0; ; retry++ {
+			var n int
+			if n, err = c.writeGroup(keys, write); err == nil {
+				keys = keys[n:]
+				break
+			}
+			if retry >= maxRetries {
+				return err
+			}
+			// Wait for the new leader or the new region to be reported to PD.
+			time.Sleep(c.cfg.RaftBaseTickInterval)
+		}
+	}
+	return nil
+}
+
+// writeGroup writes the leading keys in the region of the first key and returns the number of the keys written.
+func (c *Cluster) writeGroup(keys [][]byte, write func(s *store, regionCtx *kvrpcpb.Context, keys [][]byte) error) (int, error) {
+	regionCtx, s, err := c.locate(keys[0])
+	if err != nil {
+		return 0, err
+	}
+	n := 1
+	for n < len(keys) {
+		if ctx, _, err := c.locate(keys[n]); err != nil || ctx.RegionId != regionCtx.RegionId {
+			break
+		}
+		n++
+	}
+	return n, write(s, regionCtx, keys[:n])
+}
+
+// scan reads BatchSize keys from the start of the region containing the key.
+func (c *Cluster) scan(keyIdx int, w *Workload) error {
+	var err error
+	for retry := 0; retry <= w.MaxRetries; retry++ {
+		if retry > 0 {
+			time.Sleep(c.cfg.RaftBaseTickInterval)
+		}
+		var regionCtx *kvrpcpb.Context
+		var s *store
+		if regionCtx, s, err = c.locate(Key(keyIdx)); err != nil {
+			continue
+		}
+		if err = c.scanRegion(s, regionCtx, w.BatchSize); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (c *Cluster) scanRegion(s *store, regionCtx *kvrpcpb.Context, limit int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.cfg.StartTimeout)
+	defer cancel()
+	ts, err := c.ts()
+	if err != nil {
+		return err
+	}
+	snap, err := s.server.ConsistentSnapshot(ctx, []*kvrpcpb.Context{regionCtx}, ts)
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+	var scanErr error
+	err = s.server.ReadPool().Run(ctx, raftstore.ReadQueueScan, func() {
+		it := snap.NewIterator()
+		defer it.Close()
+		for n := 0; n < limit && it.Valid(); n++ {
+			it.Next()
+		}
+		scanErr = it.Err()
+	})
+	if err != nil {
+		return err
+	}
+	return scanErr
+}
@@ -14,11 +14,16 @@
 package raftstore
 
 import (
+	"context"
 	"os"
 	"testing"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/pdpb"
 	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/pingcap/tidb/store/mockstore/unistore/pd"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -59,3 +64,97 @@ func TestBootstrapStore(t *testing.T) {
 	require.Nil(t, err)
 	require.True(t, empty)
 }
+
+type mockBulkPDClient struct {
+	pd.Client
+	id        uint64
+	bootstrap *metapb.Region
+	reported  []*metapb.Region
+}
+
+func (c *mockBulkPDClient) GetClusterID(ctx context.Context) uint64 {
+	return 1
+}
+
+func (c *mockBulkPDClient) AllocID(ctx context.Context) (uint64, error) {
+	c.id++
+	return c.id, nil
+}
+
+func (c *mockBulkPDClient) Bootstrap(ctx context.Context, store *metapb.Store, region *metapb.Region) (*pdpb.BootstrapResponse, error) {
+	c.bootstrap = proto.Clone(region).(*metapb.Region)
+	return &pdpb.BootstrapResponse{}, nil
+}
+
+func (c *mockBulkPDClient) AskBatchSplit(ctx context.Context, region *metapb.Region, count int) (*pdpb.AskBatchSplitResponse, error) {
+	resp := new(pdpb.AskBatchSplitResponse)
+	for i := 0; i < count; i++ {
+		splitID := &pdpb.SplitID{NewRegionId: c.id + 1}
+		c.id++
+		for range region.Peers {
+			c.id++
+			splitID.NewPeerIds = append(splitID.NewPeerIds, c.id)
+		}
+		resp.Ids = append(resp.Ids, splitID)
+	}
+	return resp, nil
+}
+
+func (c *mockBulkPDClient) ReportBatchSplit(ctx context.Context, regions []*metapb.Region) error {
+	c.reported = regions
+	return nil
+}
+
+func TestBulkBootstrap(t *testing.T) {
+	stores := []*metapb.Store{{Id: 101}, {Id: 102}, {Id: 103}}
+	engines := make([]*Engines, len(stores))
+	for i := range engines {
+		engines[i] = newTestEngines(t)
+		defer cleanUpTestEngineData(engines[i])
+	}
+	pdClient := new(mockBulkPDClient)
+	_, err := BulkBootstrap(context.Background(), pdClient, stores, engines, [][]byte{[]byte("b"), []byte("a")}, 2)
+	require.NotNil(t, err)
+	_, err = BulkBootstrap(context.Background(), pdClient, stores, engines, nil, 4)
+	require.NotNil(t, err)
+
+	splitKeys := [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")}
+	regions, err := BulkBootstrap(context.Background(), pdClient, stores, engines, splitKeys, 2)
+	require.Nil(t, err)
+	require.Len(t, regions, 5)
+	assert.Empty(t, pdClient.bootstrap.StartKey)
+	assert.Empty(t, pdClient.bootstrap.EndKey)
+	assert.Equal(t, regions, pdClient.reported)
+	assert.Empty(t, regions[0].StartKey)
+	assert.Empty(t, regions[4].EndKey)
+	peerCount := map[uint64]int{}
+	for i, region := range regions {
+		assert.Equal(t, InitEpochVer+4, region.RegionEpoch.Version)
+		assert.Len(t, region.Peers, 2)
+		if i > 0 {
+			assert.Equal(t, regions[i-1].EndKey, region.StartKey)
+		}
+		for _, peer := range region.Peers {
+			peerCount[peer.StoreId]++
+		}
+	}
+	assert.Equal(t, map[uint64]int{101: 3, 102: 4, 103: 3}, peerCount)
+
+	for i, store := range stores {
+		var ident rspb.StoreIdent
+		require.Nil(t, getMsg(engines[i].kv.DB, storeIdentKey, &ident))
+		assert.Equal(t, store.Id, ident.StoreId)
+		for _, region := range regions {
+			state := new(rspb.RegionLocalState)
+			err = getMsg(engines[i].kv.DB, RegionStateKey(region.Id), state)
+			if findPeer(region, store.Id) == nil {
+				assert.NotNil(t, err)
+				continue
+			}
+			require.Nil(t, err)
+			assert.Equal(t, region.Id, state.Region.Id)
+			_, err = getValue(engines[i].raft, RaftStateKey(region.Id))
+			require.Nil(t, err)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pingcap/badger/y"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/store/mockstore/unistore/pd"
+	"github.com/pingcap/tidb/util/codec"
+	"go.uber.org/zap"
+)
+
+// BulkBootstrap bootstraps a new cluster with len(splitKeys)+1 empty initialized regions split by the raw
+// split keys, every region has replicas peers placed round robin on the stores. It must be called before
+// the stores are started and the engines of the stores must be empty.
+//
+// The region and peer ids are allocated by a single batch split request to PD and the regions are reported
+// to PD in one batch, then the initial states of the regions are written to every store concurrently with a
+// single write batch per engine, so creating a huge number of regions takes seconds instead of splitting
+// them one by one.
+func BulkBootstrap(ctx context.Context, pdClient pd.Client, stores []*metapb.Store, engines []*Engines,
+	splitKeys [][]byte, replicas int) ([]*metapb.Region, error) {
+	if len(stores) != len(engines) {
+		return nil, errors.Errorf("%d stores but %d engines", len(stores), len(engines))
+	}
+	if replicas <= 0 || replicas > len(stores) {
+		return nil, errors.Errorf("invalid replicas %d for %d stores", replicas, len(stores))
+	}
+	for i, key := range splitKeys {
+		if len(key) == 0 || (i > 0 && bytes.Compare(splitKeys[i-1], key) >= 0) {
+			return nil, errors.Errorf("split keys must be non-empty and strictly increasing, index %d", i)
+		}
+	}
+	start := time.Now()
+	clusterID := pdClient.GetClusterID(ctx)
+	for i, store := range stores {
+		if err := BootstrapStore(engines[i], clusterID, store.Id); err != nil {
+			return nil, err
+		}
+	}
+	firstRegion, err := newBootstrapRegion(ctx, pdClient, stores[:replicas])
+	if err != nil {
+		return nil, err
+	}
+	res, err := pdClient.Bootstrap(ctx, stores[0], firstRegion)
+	if err != nil {
+		return nil, err
+	}
+	if resErr := res.GetHeader().GetError(); resErr != nil {
+		return nil, errors.Errorf("bootstrap cluster %d: %s", clusterID, resErr.Message)
+	}
+	regions, err := splitBootstrapRegion(ctx, pdClient, firstRegion, stores, splitKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(stores))
+	for i := range stores {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = writeBulkRegions(engines[i], stores[i].Id, regions)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	log.Info("bulk bootstrap cluster", zap.Uint64("cluster id", clusterID), zap.Int("stores", len(stores)),
+		zap.Int("regions", len(regions)), zap.Duration("takes", time.Since(start)))
+	return regions, nil
+}
+
+// newBootstrapRegion creates the first region covering the whole key space with a peer on every store.
+func newBootstrapRegion(ctx context.Context, pdClient pd.Client, stores []*metapb.Store) (*metapb.Region, error) {
+	regionID, err := pdClient.AllocID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	region := &metapb.Region{
+		Id: regionID,
+		RegionEpoch: &metapb.RegionEpoch{
+			Version: InitEpochVer,
+			ConfVer: InitEpochConfVer,
+		},
+	}
+	for _, store := range stores {
+		peerID, err := pdClient.AllocID(ctx)
+		if err != nil {
+			return nil, err
+		}
+		region.Peers = append(region.Peers, &metapb.Peer{Id: peerID, StoreId: store.Id})
+	}
+	return region, nil
+}
+
+// splitBootstrapRegion splits the first region by the split keys as a batch split, the first region keeps the
+// first range, the peers of the other regions are placed round robin on the stores.
+func splitBootstrapRegion(ctx context.Context, pdClient pd.Client, firstRegion *metapb.Region, stores []*metapb.Store,
+	splitKeys [][]byte) ([]*metapb.Region, error) {
+	if len(splitKeys) == 0 {
+		return []*metapb.Region{firstRegion}, nil
+	}
+	resp, err := pdClient.AskBatchSplit(ctx, firstRegion, len(splitKeys))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Ids) != len(splitKeys) {
+		return nil, errors.Errorf("ask batch split for %d regions but got %d ids", len(splitKeys), len(resp.Ids))
+	}
+	version := InitEpochVer + uint64(len(splitKeys))
+	firstRegion.RegionEpoch.Version = version
+	firstRegion.EndKey = codec.EncodeBytes(nil, splitKeys[0])
+	regions := make([]*metapb.Region, 0, len(splitKeys)+1)
+	regions = append(regions, firstRegion)
+	for i, splitID := range resp.Ids {
+		region := &metapb.Region{
+			Id:       splitID.NewRegionId,
+			StartKey: codec.EncodeBytes(nil, splitKeys[i]),
+			RegionEpoch: &metapb.RegionEpoch{
+				Version: version,
+				ConfVer: InitEpochConfVer,
+			},
+		}
+		if i+1 < len(splitKeys) {
+			region.EndKey = codec.EncodeBytes(nil, splitKeys[i+1])
+		}
+		for j, peerID := range splitID.NewPeerIds {
+			store := stores[(i+1+j)%len(stores)]
+			region.Peers = append(region.Peers, &metapb.Peer{Id: peerID, StoreId: store.Id})
+		}
+		regions = append(regions, region)
+	}
+	if err = pdClient.ReportBatchSplit(ctx, regions); err != nil {
+		return nil, err
+	}
+	return regions, nil
+}
+
+// writeBulkRegions writes the initial states of the regions with a peer on the store, it uses a single
+// write batch for each engine.
+func writeBulkRegions(engines *Engines, storeID uint64, regions []*metapb.Region) error {
+	kvWB, raftWB := new(WriteBatch), new(WriteBatch)
+	for _, region := range regions {
+		if findPeer(region, storeID) == nil {
+			continue
+		}
+		state := &rspb.RegionLocalState{Region: region}
+		if err := kvWB.SetMsg(y.KeyWithTs(RegionStateKey(region.Id), KvTS), state); err != nil {
+			return err
+		}
+		writeInitialApplyState(kvWB, region.Id)
+		writeInitialRaftState(raftWB, region.Id)
+	}
+	if err := engines.WriteKV(kvWB); err != nil {
+		return err
+	}
+	if err := engines.SyncKVWAL(); err != nil {
+		return err
+	}
+	if err := engines.WriteRaft(raftWB); err != nil {
+		return err
+	}
+	return engines.SyncRaftWAL()
+}
@@ -0,0 +1,133 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pingcap/log"
+	"github.com/zhangjinpeng1987/raft"
+	"go.uber.org/zap"
+)
+
+// The reasons the leader gives up catching up a follower by the log.
+const (
+	CatchUpReasonGap = "gap"
+	CatchUpReasonLag = "lag"
+)
+
+// SnapshotCatchUpEvent is recorded when the leader compacts the log past a lagging follower, so the
+// follower catches up by a snapshot instead of the log.
+type SnapshotCatchUpEvent struct {
+	PeerID       uint64
+	Match        uint64
+	LastIndex    uint64
+	CompactIndex uint64
+	// Lag is the time the follower has been lagging behind.
+	Lag    time.Duration
+	Reason string
+	Time   time.Time
+}
+
+const maxRecentCatchUpEvents = 64
+
+// followerLag is the start of the lagging of a follower, the lagging ends when the follower matches the
+// last index of the leader at the start.
+type followerLag struct {
+	since  time.Time
+	target uint64
+}
+
+// catchUpEvents is updated by the peer goroutine and can be read concurrently.
+type catchUpEvents struct {
+	mu     sync.Mutex
+	recent []SnapshotCatchUpEvent
+}
+
+func (e *catchUpEvents) record(event SnapshotCatchUpEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.recent) == maxRecentCatchUpEvents {
+		copy(e.recent, e.recent[1:])
+		e.recent = e.recent[:len(e.recent)-1]
+	}
+	e.recent = append(e.recent, event)
+}
+
+func (e *catchUpEvents) snapshot() []SnapshotCatchUpEvent {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]SnapshotCatchUpEvent{}, e.recent...)
+}
+
+// observeFollowerLag tracks how long the follower has been lagging behind the last index of the leader.
+func (p *Peer) observeFollowerLag(peerID, match, lastIndex uint64, now time.Time) {
+	lag, ok := p.followerLags[peerID]
+	if ok && match < lag.target {
+		return
+	}
+	if match >= lastIndex {
+		delete(p.followerLags, peerID)
+		return
+	}
+	if p.followerLags == nil {
+		p.followerLags = make(map[uint64]followerLag)
+	}
+	p.followerLags[peerID] = followerLag{since: now, target: lastIndex}
+}
+
+// giveUpLogCatchUp returns the reason to catch up the follower by a snapshot, or an empty string if the
+// follower should catch up by the log.
+func (p *Peer) giveUpLogCatchUp(cfg *Config, peerID uint64, pr raft.Progress, lastIndex uint64) string {
+	if peerID == p.PeerID() || pr.State == raft.ProgressStateSnapshot || pr.Match >= lastIndex {
+		return ""
+	}
+	if cfg.SnapshotCatchUpGap > 0 && lastIndex-pr.Match > cfg.SnapshotCatchUpGap {
+		return CatchUpReasonGap
+	}
+	if lag, ok := p.followerLags[peerID]; ok && cfg.SnapshotCatchUpLag > 0 && time.Since(lag.since) > cfg.SnapshotCatchUpLag {
+		return CatchUpReasonLag
+	}
+	return ""
+}
+
+// onSnapshotCatchUp records the event of a follower that is going to catch up by a snapshot because the
+// log is compacted to compactIndex.
+func (p *Peer) onSnapshotCatchUp(peerID, match, lastIndex, compactIndex uint64, reason string) {
+	event := SnapshotCatchUpEvent{
+		PeerID:       peerID,
+		Match:        match,
+		LastIndex:    lastIndex,
+		CompactIndex: compactIndex,
+		Reason:       reason,
+		Time:         time.Now(),
+	}
+	if lag, ok := p.followerLags[peerID]; ok {
+		event.Lag = event.Time.Sub(lag.since)
+	}
+	log.Info("give up catching up follower by log", zap.String("tag", p.Tag), zap.Uint64("peer id", peerID),
+		zap.Uint64("match", match), zap.Uint64("compact index", compactIndex), zap.String("reason", reason))
+	p.catchUpEvents.record(event)
+}
+
+// SnapshotCatchUpEvents returns the recent followers of the region the leader decided to catch up by a
+// snapshot, the oldest first.
+func (r *Router) SnapshotCatchUpEvents(regionID uint64) ([]SnapshotCatchUpEvent, error) {
+	p := r.router.get(regionID)
+	if p == nil {
+		return nil, errPeerNotFound
+	}
+	return p.peer.peer.catchUpEvents.snapshot(), nil
+}
@@ -0,0 +1,194 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/pingcap/badger/y"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// RegionCheckpoint is a recent state of a region held by a store, like a restored backup. The data of the
+// region at Index must already be in the kv engine of the store, Term is the term of the log entry at Index.
+//
+// A new peer of the region created on the store starts from the checkpoint and replays the log after Index
+// instead of receiving a full snapshot. The leader sends a snapshot anyway if its log is compacted past
+// Index. The peer can't be restarted before it applies the conf change adding it if Region doesn't
+// contain it yet.
+type RegionCheckpoint struct {
+	Region *metapb.Region
+	Index  uint64
+	Term   uint64
+}
+
+// regionCheckpoints are the checkpoints of the regions without a peer on the store.
+type regionCheckpoints struct {
+	mu          sync.Mutex
+	checkpoints map[uint64]*RegionCheckpoint
+}
+
+func (c *regionCheckpoints) add(cp *RegionCheckpoint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.checkpoints == nil {
+		c.checkpoints = make(map[uint64]*RegionCheckpoint)
+	}
+	c.checkpoints[cp.Region.Id] = cp
+}
+
+// take removes the checkpoint of the region, a checkpoint is used at most once.
+func (c *regionCheckpoints) take(regionID uint64) *RegionCheckpoint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cp := c.checkpoints[regionID]
+	delete(c.checkpoints, regionID)
+	return cp
+}
+
+// AddCheckpoint registers the checkpoint of a region, the next peer of the region created on the store
+// starts from it.
+func (r *Router) AddCheckpoint(cp *RegionCheckpoint) error {
+	if cp.Region == nil || cp.Region.RegionEpoch == nil || len(cp.Region.Peers) == 0 {
+		return errors.New("checkpoint has no initialized region")
+	}
+	if cp.Index < RaftInitLogIndex || cp.Term < RaftInitLogTerm {
+		return errors.Errorf("invalid checkpoint index %d term %d", cp.Index, cp.Term)
+	}
+	if r.router.get(cp.Region.Id) != nil {
+		return errors.Errorf("region %d already has a peer", cp.Region.Id)
+	}
+	r.router.checkpoints.add(cp)
+	return nil
+}
+
+// checkCheckpoint returns an error if the checkpoint can't initialize the peer the message is sent to. The
+// range and the version of the checkpoint must be the same as the region of the leader, otherwise the region
+// has been split or merged since the checkpoint is taken.
+func checkCheckpoint(cp *RegionCheckpoint, storeID uint64, msg *rspb.RaftMessage) error {
+	if !bytes.Equal(cp.Region.StartKey, msg.StartKey) || !bytes.Equal(cp.Region.EndKey, msg.EndKey) {
+		return errors.New("range not match")
+	}
+	epoch := cp.Region.RegionEpoch
+	if epoch.Version != msg.RegionEpoch.GetVersion() || epoch.ConfVer > msg.RegionEpoch.GetConfVer() {
+		return errors.Errorf("epoch %s not match %s", epoch, msg.RegionEpoch)
+	}
+	if peer := findPeer(cp.Region, storeID); peer != nil && peer.Id != msg.ToPeer.Id {
+		return errors.Errorf("stale peer %d", peer.Id)
+	}
+	return nil
+}
+
+// writeCheckpointState writes the states of the peer starting from the checkpoint, the log is truncated
+// at the checkpoint.
+func writeCheckpointState(engines *Engines, cp *RegionCheckpoint) error {
+	kvWB, raftWB := new(WriteBatch), new(WriteBatch)
+	if err := kvWB.SetMsg(y.KeyWithTs(RegionStateKey(cp.Region.Id), KvTS), &rspb.RegionLocalState{Region: cp.Region}); err != nil {
+		return err
+	}
+	applyState := applyState{appliedIndex: cp.Index, truncatedIndex: cp.Index, truncatedTerm: cp.Term}
+	kvWB.Set(y.KeyWithTs(ApplyStateKey(cp.Region.Id), KvTS), applyState.Marshal())
+	raftState := raftState{lastIndex: cp.Index, term: cp.Term, commit: cp.Index}
+	raftWB.Set(y.KeyWithTs(RaftStateKey(cp.Region.Id), RaftTS), raftState.Marshal())
+	if err := engines.WriteKV(kvWB); err != nil {
+		return err
+	}
+	return engines.WriteRaft(raftWB)
+}
+
+// maybeCreateCheckpointPeer creates the peer from the checkpoint of the region if there is a valid one, it
+// returns nil if the peer should be created uninitialized.
+func (d *storeMsgHandler) maybeCreateCheckpointPeer(regionID uint64, msg *rspb.RaftMessage) (*peerFsm, error) {
+	cp := d.ctx.router.checkpoints.take(regionID)
+	if cp == nil {
+		return nil, nil
+	}
+	if err := checkCheckpoint(cp, d.ctx.store.Id, msg); err != nil {
+		log.Warn("skip checkpoint", zap.Uint64("region id", regionID), zap.Uint64("index", cp.Index), zap.Error(err))
+		return nil, nil
+	}
+	if err := writeCheckpointState(d.ctx.engine, cp); err != nil {
+		return nil, err
+	}
+	peer, err := NewPeer(d.ctx.store.Id, d.ctx.cfg, d.ctx.engine, cp.Region, d.ctx.regionTaskSender, msg.ToPeer)
+	if err != nil {
+		return nil, err
+	}
+	peer.checkpoint = &checkpointState{index: cp.Index, term: cp.Term}
+	log.Info("create peer from checkpoint", zap.String("tag", peer.Tag), zap.Uint64("index", cp.Index),
+		zap.Uint64("term", cp.Term))
+	return &peerFsm{peer: peer, ticker: newTicker(regionID, d.ctx.cfg)}, nil
+}
+
+// checkpointState is the checkpoint of a peer until the log of the leader is proved to continue from it.
+type checkpointState struct {
+	index uint64
+	term  uint64
+	// broken is set if the term of the leader at the index doesn't match.
+	broken bool
+}
+
+// checkCheckpointContinuity verifies that the log of the leader continues from the checkpoint, the first
+// append accepted by the peer is at the checkpoint index. It returns true if the message is handled. If the
+// terms don't match, the appends are rejected with a zero hint, so the leader falls back to a snapshot that
+// replaces the data of the checkpoint.
+func (d *peerMsgHandler) checkCheckpointContinuity(msg *rspb.RaftMessage) bool {
+	cp := d.peer.checkpoint
+	m := msg.Message
+	switch m.MsgType {
+	case eraftpb.MessageType_MsgSnapshot:
+		d.peer.checkpoint = nil
+		return false
+	case eraftpb.MessageType_MsgAppend:
+	default:
+		return false
+	}
+	if !cp.broken && m.Index == cp.index {
+		if m.LogTerm == cp.term {
+			log.Info("log continues from checkpoint", zap.String("tag", d.tag()), zap.Uint64("index", cp.index))
+			d.peer.checkpoint = nil
+			return false
+		}
+		log.Warn("log doesn't continue from checkpoint, wait for snapshot", zap.String("tag", d.tag()),
+			zap.Uint64("index", cp.index), zap.Uint64("term", cp.term), zap.Uint64("leader term", m.LogTerm))
+		cp.broken = true
+	}
+	if !cp.broken {
+		return false
+	}
+	reject := &rspb.RaftMessage{
+		RegionId:    msg.RegionId,
+		FromPeer:    msg.ToPeer,
+		ToPeer:      msg.FromPeer,
+		RegionEpoch: d.region().RegionEpoch,
+		Message: &eraftpb.Message{
+			MsgType: eraftpb.MessageType_MsgAppendResponse,
+			From:    m.To,
+			To:      m.From,
+			Term:    m.Term,
+			Index:   m.Index,
+			Reject:  true,
+		},
+	}
+	if err := d.ctx.trans.Send(reject); err != nil {
+		log.Warn("failed to reject append", zap.String("tag", d.tag()), zap.Error(err))
+	}
+	return true
+}
@@ -0,0 +1,193 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ngaut/unistore/util"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+type fileChecksum struct {
+	size     int64
+	modTime  time.Time
+	checksum uint32
+	// expected is the checksum the file is verified against, it's set once the file is written or verified.
+	expected    uint32
+	hasExpected bool
+}
+
+// ChecksumService computes and caches the CRC32 checksums of the snapshot files and the tables to ingest. A
+// cached checksum is reused while the size and the modification time of the file are unchanged.
+type ChecksumService struct {
+	mu    sync.Mutex
+	files map[string]*fileChecksum
+}
+
+// NewChecksumService creates a ChecksumService.
+func NewChecksumService() *ChecksumService {
+	return &ChecksumService{files: make(map[string]*fileChecksum)}
+}
+
+// Checksum returns the checksum of the file.
+func (c *ChecksumService) Checksum(path string) (uint32, error) {
+	return c.checksum(path, false)
+}
+
+func (c *ChecksumService) checksum(path string, recompute bool) (uint32, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	c.mu.Lock()
+	f, ok := c.files[path]
+	if ok && !recompute && f.size == fi.Size() && f.modTime.Equal(fi.ModTime()) {
+		checksum := f.checksum
+		c.mu.Unlock()
+		return checksum, nil
+	}
+	c.mu.Unlock()
+	checksum, err := util.CalcCRC32(path)
+	if err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	if f, ok = c.files[path]; !ok {
+		f = new(fileChecksum)
+		c.files[path] = f
+	}
+	f.size, f.modTime, f.checksum = fi.Size(), fi.ModTime(), checksum
+	c.mu.Unlock()
+	return checksum, nil
+}
+
+// record caches the checksum of the file just written, computed while writing it, as the expected checksum.
+func (c *ChecksumService) record(path string, checksum uint32) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.files[path] = &fileChecksum{
+		size:        fi.Size(),
+		modTime:     fi.ModTime(),
+		checksum:    checksum,
+		expected:    checksum,
+		hasExpected: true,
+	}
+	return nil
+}
+
+func (c *ChecksumService) setExpected(path string, expected uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f, ok := c.files[path]; ok {
+		f.expected, f.hasExpected = expected, true
+	}
+}
+
+// Verify checks the checksum of the file against the expected one, recompute ignores the cached checksum.
+func (c *ChecksumService) Verify(path string, expected uint32, recompute bool) error {
+	checksum, err := c.checksum(path, recompute)
+	if err != nil {
+		return err
+	}
+	c.setExpected(path, expected)
+	if checksum != expected {
+		return errors.Errorf("invalid checksum %d for file %s, expected %d", checksum, path, expected)
+	}
+	return nil
+}
+
+// forget drops the checksum of the deleted file.
+func (c *ChecksumService) forget(path string) {
+	c.mu.Lock()
+	delete(c.files, path)
+	c.mu.Unlock()
+}
+
+// FileChecksum is the result of verifying a file.
+type FileChecksum struct {
+	Path     string `json:"path"`
+	Expected uint32 `json:"expected"`
+	Actual   uint32 `json:"actual"`
+	Err      string `json:"error,omitempty"`
+}
+
+// OK returns true if the file matches the expected checksum.
+func (f *FileChecksum) OK() bool {
+	return f.Err == "" && f.Actual == f.Expected
+}
+
+// VerifyAll recomputes the checksums of the files with an expected checksum and returns the results sorted by
+// path. The files deleted are dropped.
+func (c *ChecksumService) VerifyAll() []FileChecksum {
+	c.mu.Lock()
+	expected := make(map[string]uint32, len(c.files))
+	for path, f := range c.files {
+		if f.hasExpected {
+			expected[path] = f.expected
+		}
+	}
+	c.mu.Unlock()
+	results := make([]FileChecksum, 0, len(expected))
+	for path, checksum := range expected {
+		actual, err := c.checksum(path, true)
+		if os.IsNotExist(errors.Cause(err)) {
+			c.forget(path)
+			continue
+		}
+		result := FileChecksum{Path: path, Expected: checksum, Actual: actual}
+		if err != nil {
+			result.Err = err.Error()
+		}
+		results = append(results, result)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Path < results[j].Path
+	})
+	return results
+}
+
+// Checksums returns the ChecksumService of the snapshot files.
+func (sm *SnapManager) Checksums() *ChecksumService {
+	return sm.checksums
+}
+
+// VerifyChecksumHandler verifies the checksums of the snapshot files and the tables to ingest for the status
+// server, it responds 200 with the results if all the files match, otherwise 500.
+func (sm *SnapManager) VerifyChecksumHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		results := sm.checksums.VerifyAll()
+		w.Header().Set("Content-Type", "application/json")
+		for i := range results {
+			if !results[i].OK() {
+				w.WriteHeader(http.StatusInternalServerError)
+				break
+			}
+		}
+		if err := json.NewEncoder(w).Encode(results); err != nil {
+			log.Warn("failed to encode checksums", zap.Error(err))
+		}
+	})
+}
@@ -49,6 +49,22 @@ type Config struct {
 	RaftMaxSizePerMsg           uint64
 	RaftMaxInflightMsgs         int
 
+	// Tune the max inflight messages and the max message size of every follower by the leader. They are
+	// halved down to RaftMinInflightMsgs and RaftMinSizePerMsg when the acks of the follower are slower than
+	// RaftFlowTargetLatency or the messages to it are dropped, and grow back up to RaftMaxInflightMsgs and
+	// RaftMaxSizePerMsg while the link is healthy. The windows are reported by Router.ReplicationLag.
+	RaftAdaptiveFlowControl bool
+	RaftMinInflightMsgs     int
+	RaftMinSizePerMsg       uint64
+	RaftFlowTargetLatency   time.Duration
+
+	// The election priority of the peers on this store, the peers with higher priority campaign earlier.
+	ElectionPriority int
+
+	// The number of raft base ticks a follower defers its election after it applies a snapshot or is created
+	// by a split, so it hears from the leader before it times out. 0 disables the grace.
+	RaftElectionGraceTicks int
+
 	// When the entry exceed the max size, reject to propose it.
 	RaftEntryMaxSize uint64
 
@@ -61,8 +77,16 @@ type Config struct {
 	// When the approximate size of raft log entries exceed this value,
 	// gc will be forced trigger.
 	RaftLogGcSizeLimit uint64
+	// The leader compacts the log regardless of a follower, so it catches up by a snapshot instead of
+	// the log, if it is behind the last index by more than SnapshotCatchUpGap entries, or it has been
+	// lagging behind for SnapshotCatchUpLag. 0 means the follower is only given up by the gc limits.
+	SnapshotCatchUpGap uint64
+	SnapshotCatchUpLag time.Duration
 	// When a peer is not responding for this time, leader will not keep entry cache for it.
 	RaftEntryCacheLifeTime time.Duration
+	// RaftEntryCacheCapacity limits the bytes of the entries cached by a region for replicating them to the
+	// followers, the oldest entries are evicted first. 0 means only MaxCacheCapacity entries are cached.
+	RaftEntryCacheCapacity uint64
 	// When a peer is newly added, reject transferring leader to the peer for a while.
 	RaftRejectTransferLeaderDuration time.Duration
 
@@ -71,10 +95,20 @@ type Config struct {
 	// When size change of region exceed the diff since last check, it
 	// will be checked again whether it should be split.
 	RegionSplitCheckDiff uint64
+	// A compaction that declines at least the bytes, or a range deletion, recalculates the approximate
+	// sizes of the regions in its range right away. 0 disables it.
+	SizeRecalcDeclinedBytes uint64
+	// A leader region is scanned for the approximate size at least once in the interval even if the size diff
+	// hint is small, so the drift of the hint is corrected. 0 disables it.
+	RegionSizeReconcileInterval time.Duration
 	// Interval (ms) to check whether start compaction for a region.
 	RegionCompactCheckInterval time.Duration
 	// delay time before deleting a stale peer
 	CleanStalePeerDelay time.Duration
+	// Interval to purge the expired entries in the tombstone region registry.
+	TombstoneGCTickInterval time.Duration
+	// How long a destroyed region is kept in the tombstone region registry.
+	TombstoneRetention time.Duration
 	// Number of regions for each time checking.
 	RegionCompactCheckStep uint64
 	// Minimum number of tombstones to trigger manual compaction.
@@ -87,9 +121,15 @@ type Config struct {
 	SnapMgrGcTickInterval          time.Duration
 	SnapGcTimeout                  time.Duration
 
+	// The region heartbeats after a split or a conf change are sent in a batch after the delay. 0 sends them immediately.
+	PdHeartbeatBatchDelay time.Duration
+
 	NotifyCapacity  uint64
 	MessagesPerTick uint64
 
+	// The max number of pending raft commands of a peer accepted by Router.TrySendRaftCommand. 0 means no limit.
+	PeerMailboxCapacity int64
+
 	// When a peer is not active for max_peer_down_duration,
 	// the peer is considered to be down and is reported to PD.
 	MaxPeerDownDuration time.Duration
@@ -105,8 +145,134 @@ type Config struct {
 
 	LeaderTransferMaxLogLag uint64
 
+	// The max number of uninitialized peers created by raft messages and waiting for snapshots,
+	// messages that would create more peers are rejected with a back off signal. 0 means no limit.
+	MaxPendingUninitializedPeers uint64
+
+	// The quota of the store to model a capacity-limited store, 0 means no limit. The store rejects
+	// creating peers beyond MaxRegionCount with a back off signal, and the leaders on the store reject
+	// the conf changes adding a peer to a store hosting MaxPeerCount peers with ErrQuotaExceeded, the
+	// peers of a store are counted in the regions of the leader's store.
+	MaxRegionCount int
+	MaxPeerCount   int
+
+	// The max number of committed but not applied log entries of a region, normal proposals
+	// are rejected with ServerIsBusy when the gap exceeds it. 0 means no limit.
+	MaxApplyGap uint64
+
+	// Respond the proposals and the reads dropped by the raft group with ErrProposalDropped telling the
+	// reason, instead of NotLeader or StaleCommand.
+	FailFastDroppedProposals bool
+
+	// Allow expiring or suspecting the leader lease through Router.ControlLease, only for tests.
+	EnableLeaseControl bool
+
+	// Allow bumping the region epoch of a peer through Router.SkewRegionEpoch, only for tests.
+	EnableEpochSkew bool
+
+	// Elect the peer of a region whose voters are all on the store without the pre-vote as soon as it is
+	// created, and allow electing it through Router.Campaign, only for tests.
+	FastCampaign bool
+
+	// The number of the idempotency tokens of the applied writes remembered by every region, a write with
+	// a remembered token in the Uuid of its header succeeds without being applied again. 0 disables it.
+	// The custom raft logs have no header, so the writes of the server with custom-raft-log enabled, the
+	// default, are not deduplicated.
+	IdempotencyWindow int
+
+	// The time source of the leader lease, nil means the system clock. Only for tests.
+	LeaseClock LeaseClock
+
+	// Check the invariants of the leader lease renewals and the read index queue, the results are
+	// reported by Router.LeaseCheckEvents. Only for tests.
+	CheckLeaseInvariants bool
+
+	// Check the invariants of the peers and the store every InvariantCheckInterval, 0 disables the checks.
+	// InvariantViolationMode decides what a violation does, see InvariantModePanic, InvariantModeEvent and
+	// InvariantModeMetric, empty means InvariantModeMetric. A hash mismatch of the consistency check panics if
+	// the mode is empty. The checks and the violations are reported by Router.InvariantStats.
+	InvariantCheckInterval time.Duration
+	InvariantViolationMode string
+
+	// The causal ts oracle kept ahead of the max commit ts of the applied snapshots, nil means none.
+	CausalTSOracle CausalTSOracle
+
+	// The leaders advance the safe ts of the bounded staleness reads every SafeTSUpdateInterval, 0 disables
+	// the bounded staleness reads.
+	SafeTSUpdateInterval time.Duration
+
+	// Verify that the reads of a client session observe its finished writes, the session is the TaskId of
+	// the request context. The verifier can be shared by the stores in a process, nil disables it. Only for tests.
+	ReadYourWritesVerifier *ReadYourWritesVerifier
+
+	// The number of the workers running the reads of the store, 0 runs the reads on the callers. The reads of
+	// a queue running at the same time are limited by its concurrency, 0 or a concurrency over ReadPoolSize
+	// means ReadPoolSize. The point gets are taken before the scans.
+	ReadPoolSize                int
+	ReadPoolPointGetConcurrency int
+	ReadPoolScanConcurrency     int
+
+	// The number of hot keys sampled for reads and writes of every leader region. 0 disables sampling.
+	HotKeySampleCapacity int
+
+	// Time one in every ApplyProfileSampleRate apply tasks of a region to estimate the time the apply worker
+	// spends on it, the estimation is served with the hot keys. 0 disables the profiling.
+	ApplyProfileSampleRate int
+
+	// Schedule a split check right away when an oversized region is written near its end key,
+	// instead of waiting for the split check tick.
+	EnableSplitHint bool
+
+	// Split a leader region at its hot key range once the QPS of its reads and writes in a LoadSplitWindow
+	// reaches LoadSplitQPSThreshold, the split keys are reported to PD. 0 disables the load split.
+	LoadSplitQPSThreshold uint64
+	LoadSplitWindow       time.Duration
+
+	// The number of the goroutines validating the regions and creating their peers when the store starts,
+	// 0 means GOMAXPROCS. The progress of every phase is logged and passed to OnRecoveryProgress every
+	// RecoveryProgressInterval and when the phase finishes, 0 reports it only when the phase finishes.
+	PeerInitWorkers          int
+	RecoveryProgressInterval time.Duration
+	OnRecoveryProgress       func(RecoveryProgress)
+
+	// Log the applied admin commands and a sampled fraction of the data commands to the file as JSON lines,
+	// empty disables it. The records are compared with the ones of the AuditReplayer if it is set.
+	AuditLogPath        string
+	AuditDataSampleRate float64
+	AuditReplayer       *AuditReplayer
+
+	// Verify that the locks of the applied snapshots are visible before their other data, and the jobs are
+	// finished after all the data is visible. A violation panics. Only for tests.
+	StrictSnapApplyOrder bool
+
+	// The number of the goroutines persisting the raft ready states, so the raft worker doesn't wait for the
+	// fsync. 0 means the raft worker persists them.
+	AsyncRaftLogWriters int
+
+	// Verify the checksums of the tables built by applying snapshots before ingesting them.
+	VerifyIngestChecksum bool
+
 	SnapApplyBatchSize uint64
 
+	// The commands received while applying a snapshot wait until it's applied. At most SnapWaitersCapacity
+	// commands wait in a region, the others are rejected with ServerIsBusy, and the commands waiting longer
+	// than SnapWaitTimeout fail with ErrSnapWaitTimeout.
+	SnapWaitersCapacity int
+	SnapWaitTimeout     time.Duration
+
+	// The max bytes per second ingested to the kv engine by the applied snapshots and the SST imports, 0 means
+	// no limit. If IngestWriteLatencyTarget is set, the rate drops towards IngestMinRateLimit while the
+	// foreground writes are slower than the target, and recovers while they are not. IngestMinRateLimit must be
+	// between 1 and IngestRateLimit with the target.
+	IngestRateLimit          uint64
+	IngestMinRateLimit       uint64
+	IngestWriteLatencyTarget time.Duration
+
+	// A region worker task gains one priority for every aging interval it waits.
+	RegionTaskAgingInterval time.Duration
+	// Warn about a region worker task waiting longer than the threshold. 0 disables the warning.
+	RegionTaskStarvationThreshold time.Duration
+
 	// Interval (ms) to check region whether the data is consistent.
 	ConsistencyCheckInterval time.Duration
 
@@ -115,6 +281,12 @@ type Config struct {
 	// The lease provided by a successfully proposed and applied entry.
 	RaftStoreMaxLeaderLease time.Duration
 
+	// Renew the leader lease early in the next AdaptiveLeaseWindow if more than AdaptiveLeaseFallbackRate of
+	// the reads on the leader of a region fall back to ReadIndex because the lease is expired in a window.
+	// 0 disables the adaptive renewal. The fallbacks are reported by Router.ReadFallbackMetrics.
+	AdaptiveLeaseFallbackRate float64
+	AdaptiveLeaseWindow       time.Duration
+
 	// Right region derive origin region id when split.
 	RightDeriveWhenSplit bool
 
@@ -140,12 +312,53 @@ type Config struct {
 	GrpcKeepAliveTime     time.Duration
 	GrpcKeepAliveTimeout  time.Duration
 	GrpcRaftConnNum       uint64
+	// How long a resolved store address is cached before resolving it again.
+	StoreResolveTTL time.Duration
 
 	Addr          string
 	AdvertiseAddr string
-	Labels        []StoreLabel
+	// The address of the status server reported to PD, other stores fetch the replica states from it.
+	StatusAddr string
+	Labels     []StoreLabel
+	// The label keys describing the location of stores from the top level, like zone and host.
+	LocationLabels []string
+	// The replicas added by PD are rejected if they share the same location with another replica
+	// of the region down to this label. Empty means no check.
+	IsolationLevel string
+
+	// SnapshotSourcePolicy chooses the peer sending a snapshot, SnapshotSourceClosest sends it from the peer
+	// closest to the receiver by the labels of StoreTopology. Empty means SnapshotSourceLeader.
+	SnapshotSourcePolicy string
+	// A snapshot relayed by a follower which is not received in SnapshotRelayTimeout is sent by the leader.
+	SnapshotRelayTimeout time.Duration
+	// StoreTopology holds the labels of the stores for the SnapshotSourceClosest policy.
+	StoreTopology *StoreTopology
+
+	// HibernateRegions stops ticking the raft groups of the regions idle for HibernateIdleTicks base ticks,
+	// until a message or a proposal wakes them up.
+	HibernateRegions   bool
+	HibernateIdleTicks int
+
+	// PeerDebugLogRate limits the debug logs of a region per second, the burst is PeerDebugLogBurst. 0 means
+	// no limit.
+	PeerDebugLogRate  float64
+	PeerDebugLogBurst int
+
+	// SnapGenLimit is the max number of the snapshots generated for a region in SnapGenLimitWindow, the
+	// snapshots over the limit are refused and reported to PD. 0 means no limit.
+	SnapGenLimit       int
+	SnapGenLimitWindow time.Duration
+
+	// SnapRateLimit is the max bytes per second of the snapshot files generated, sent and received by the
+	// store together, 0 means no limit. The snapshots applied are limited by IngestRateLimit.
+	SnapRateLimit uint64
 
 	SplitCheck *splitCheckConfig
+
+	// RegionSizeAmplification multiplies the size of the written data when calculating the size
+	// diff hint and the approximate region size, so size based splits can be triggered by a tiny
+	// dataset in tests. 0 and 1 mean no amplification.
+	RegionSizeAmplification uint64
 }
 
 type splitCheckConfig struct {
@@ -158,11 +371,11 @@ type splitCheckConfig struct {
 	// batchSplitLimit limits the number of produced split-key for one batch.
 	batchSplitLimit uint64
 
-	// When region [a,e) size meets regionMaxSize, it will be split into
+	// When region [a,e) size meets RegionMaxSize, it will be split into
 	// several regions [a,b), [b,c), [c,d), [d,e). And the size of [a,b),
-	// [b,c), [c,d) will be regionSplitSize (maybe a little larger).
-	regionMaxSize   uint64
-	regionSplitSize uint64
+	// [b,c), [c,d) will be RegionSplitSize (maybe a little larger).
+	RegionMaxSize   uint64
+	RegionSplitSize uint64
 
 	// When the number of keys in region [a,e) meets the region_max_keys,
 	// it will be split into two several regions [a,b), [b,c), [c,d), [d,e).
@@ -172,6 +385,9 @@ type splitCheckConfig struct {
 
 	// number of rows per sample key for half split.
 	rowsPerSample int
+
+	// rules override the split thresholds of some key prefixes at runtime.
+	rules *splitRules
 }
 
 // StoreLabel stores the information of one store label.
@@ -195,6 +411,9 @@ func NewDefaultConfig() *Config {
 		RaftMaxElectionTimeoutTicks: 0,
 		RaftMaxSizePerMsg:           1 * MB,
 		RaftMaxInflightMsgs:         256,
+		RaftMinInflightMsgs:         4,
+		RaftMinSizePerMsg:           16 * KB,
+		RaftFlowTargetLatency:       500 * time.Millisecond,
 		RaftEntryMaxSize:            8 * MB,
 		RaftLogGCTickInterval:       10 * time.Second,
 		RaftLogGcThreshold:          50,
@@ -202,15 +421,21 @@ func NewDefaultConfig() *Config {
 		RaftLogGcCountLimit:              splitSize * 3 / 4 / KB,
 		RaftLogGcSizeLimit:               splitSize * 3 / 4,
 		RaftEntryCacheLifeTime:           30 * time.Second,
+		RaftEntryCacheCapacity:           16 * MB,
 		RaftRejectTransferLeaderDuration: 3 * time.Second,
 		SplitRegionCheckTickInterval:     10 * time.Second,
 		RegionSplitCheckDiff:             splitSize / 8,
+		SizeRecalcDeclinedBytes:          splitSize / 8,
+		RegionSizeReconcileInterval:      10 * time.Minute,
 		CleanStalePeerDelay:              10 * time.Minute,
+		TombstoneGCTickInterval:          1 * time.Minute,
+		TombstoneRetention:               10 * time.Minute,
 		RegionCompactCheckInterval:       5 * time.Minute,
 		RegionCompactCheckStep:           100,
 		RegionCompactMinTombstones:       10000,
 		RegionCompactTombstonesPencent:   30,
 		PdHeartbeatTickInterval:          20 * time.Second,
+		PdHeartbeatBatchDelay:            50 * time.Millisecond,
 		PdStoreHeartbeatTickInterval:     10 * time.Second,
 		NotifyCapacity:                   40960,
 		SnapMgrGcTickInterval:            1 * time.Minute,
@@ -221,12 +446,25 @@ func NewDefaultConfig() *Config {
 		AbnormalLeaderMissingDuration:    10 * time.Minute,
 		PeerStaleStateCheckInterval:      5 * time.Minute,
 		LeaderTransferMaxLogLag:          10,
+		ReadPoolSize:                     8,
+		ReadPoolScanConcurrency:          4,
+		HotKeySampleCapacity:             16,
+		ApplyProfileSampleRate:           8,
+		EnableSplitHint:                  true,
+		LoadSplitQPSThreshold:            3000,
+		LoadSplitWindow:                  10 * time.Second,
+		RecoveryProgressInterval:         5 * time.Second,
 		SnapApplyBatchSize:               10 * MB,
+		SnapWaitersCapacity:              256,
+		SnapWaitTimeout:                  10 * time.Second,
+		RegionTaskAgingInterval:          5 * time.Second,
+		RegionTaskStarvationThreshold:    30 * time.Second,
 		// Disable consistency check by default as it will hurt performance.
 		// We should turn on this only in our tests.
 		ConsistencyCheckInterval: 0,
 		ReportRegionFlowInterval: 1 * time.Minute,
 		RaftStoreMaxLeaderLease:  9 * time.Second,
+		AdaptiveLeaseWindow:      10 * time.Second,
 		RightDeriveWhenSplit:     true,
 		AllowRemoveLeader:        false,
 		MergeMaxLogGap:           10,
@@ -241,7 +479,13 @@ func NewDefaultConfig() *Config {
 		GrpcKeepAliveTime:        3 * time.Second,
 		GrpcKeepAliveTimeout:     60 * time.Second,
 		GrpcRaftConnNum:          1,
+		StoreResolveTTL:          60 * time.Second,
 		Addr:                     "127.0.0.1:20160",
+		SnapshotRelayTimeout:     time.Minute,
+		HibernateIdleTicks:       20,
+		PeerDebugLogRate:         10,
+		PeerDebugLogBurst:        50,
+		SnapGenLimitWindow:       time.Hour,
 		SplitCheck:               newDefaultSplitCheckConfig(),
 	}
 }
@@ -260,18 +504,34 @@ func newDefaultSplitCheckConfig() *splitCheckConfig {
 	return &splitCheckConfig{
 		splitRegionOnTable: true,
 		batchSplitLimit:    batchSplitLimit,
-		regionSplitSize:    splitSize,
-		regionMaxSize:      splitSize / 2 * 3,
+		RegionSplitSize:    splitSize,
+		RegionMaxSize:      splitSize / 2 * 3,
 		RegionSplitKeys:    splitKeys,
 		RegionMaxKeys:      splitKeys / 2 * 3,
 		rowsPerSample:      1024,
+		rules:              new(splitRules),
+	}
+}
+
+// amplifySize applies the region size amplification factor to the size.
+func (c *Config) amplifySize(size uint64) uint64 {
+	if c.RegionSizeAmplification > 1 {
+		return size * c.RegionSizeAmplification
 	}
+	return size
 }
 
-// Validate returns an error message if the check is invalid.
+// Validate fills the derived defaults of the zero fields and checks the fields depending on each other,
+// the error is an *ErrInvalidConfig naming the first invalid field.
 func (c *Config) Validate() error {
+	c.fillDerivedDefaults()
+
+	if c.RaftBaseTickInterval <= 0 {
+		return invalidConfig("RaftBaseTickInterval", c.RaftBaseTickInterval, "must be greater than 0")
+	}
+
 	if c.RaftHeartbeatTicks == 0 {
-		return fmt.Errorf("heartbeat tick must greater than 0")
+		return invalidConfig("RaftHeartbeatTicks", c.RaftHeartbeatTicks, "must be greater than 0")
 	}
 
 	if c.RaftElectionTimeoutTicks != 10 {
@@ -279,76 +539,251 @@ func (c *Config) Validate() error {
 	}
 
 	if c.RaftElectionTimeoutTicks <= c.RaftHeartbeatTicks {
-		return fmt.Errorf("election tick must be greater than heartbeat tick")
+		return invalidConfig("RaftElectionTimeoutTicks", c.RaftElectionTimeoutTicks,
+			"must be greater than heartbeat ticks %v", c.RaftHeartbeatTicks)
 	}
 
-	if c.RaftMinElectionTimeoutTicks == 0 {
-		c.RaftMinElectionTimeoutTicks = c.RaftElectionTimeoutTicks
+	if c.RaftMinElectionTimeoutTicks < c.RaftElectionTimeoutTicks ||
+		c.RaftMinElectionTimeoutTicks >= c.RaftMaxElectionTimeoutTicks {
+		return invalidConfig("RaftMinElectionTimeoutTicks", c.RaftMinElectionTimeoutTicks,
+			"invalid timeout range [%v, %v) for timeout %v",
+			c.RaftMinElectionTimeoutTicks, c.RaftMaxElectionTimeoutTicks, c.RaftElectionTimeoutTicks)
 	}
 
-	if c.RaftMaxElectionTimeoutTicks == 0 {
-		c.RaftMaxElectionTimeoutTicks = c.RaftElectionTimeoutTicks * 2
+	if c.RaftElectionGraceTicks < 0 {
+		return invalidConfig("RaftElectionGraceTicks", c.RaftElectionGraceTicks, "must be greater than or equal to 0")
 	}
 
-	if c.RaftMinElectionTimeoutTicks < c.RaftElectionTimeoutTicks ||
-		c.RaftMinElectionTimeoutTicks >= c.RaftMaxElectionTimeoutTicks {
-		return fmt.Errorf("invalid timeout range [%v, %v) for timeout %v",
-			c.RaftMinElectionTimeoutTicks, c.RaftMaxElectionTimeoutTicks, c.RaftElectionTimeoutTicks)
+	if c.RaftEntryMaxSize == 0 {
+		return invalidConfig("RaftEntryMaxSize", c.RaftEntryMaxSize, "must be greater than 0")
 	}
 
 	if c.RaftLogGcThreshold < 1 {
-		return fmt.Errorf("raft log gc threshold must >= 1, not %v", c.RaftLogGcThreshold)
+		return invalidConfig("RaftLogGcThreshold", c.RaftLogGcThreshold, "must be greater than or equal to 1")
+	}
+
+	if c.RaftLogGcThreshold >= c.RaftLogGcCountLimit {
+		return invalidConfig("RaftLogGcThreshold", c.RaftLogGcThreshold,
+			"must be less than log gc count limit %v", c.RaftLogGcCountLimit)
+	}
+
+	if c.SnapshotCatchUpGap > 0 && c.SnapshotCatchUpGap < c.RaftLogGcThreshold {
+		return invalidConfig("SnapshotCatchUpGap", c.SnapshotCatchUpGap,
+			"must not be less than log gc threshold %v", c.RaftLogGcThreshold)
 	}
 
 	if c.RaftLogGcSizeLimit == 0 {
-		return fmt.Errorf("raft log gc size limit should large than 0")
+		return invalidConfig("RaftLogGcSizeLimit", c.RaftLogGcSizeLimit, "must be greater than 0")
 	}
 
 	electionTimeout := c.RaftBaseTickInterval * time.Duration(c.RaftElectionTimeoutTicks)
 	if electionTimeout < c.RaftStoreMaxLeaderLease {
-		return fmt.Errorf("election timeout %v ns is less than % v ns", electionTimeout, c.RaftStoreMaxLeaderLease)
+		return invalidConfig("RaftStoreMaxLeaderLease", c.RaftStoreMaxLeaderLease,
+			"must not be greater than election timeout %v", electionTimeout)
 	}
 
 	if c.MergeMaxLogGap >= c.RaftLogGcCountLimit {
-		return fmt.Errorf("merge log gap %v should be less than log gc limit %v", c.MergeMaxLogGap, c.RaftLogGcCountLimit)
+		return invalidConfig("MergeMaxLogGap", c.MergeMaxLogGap,
+			"must be less than log gc count limit %v", c.RaftLogGcCountLimit)
 	}
 
 	if c.MergeCheckTickInterval == 0 {
-		return fmt.Errorf("raftstore.merge-check-tick-interval can't be 0")
+		return invalidConfig("MergeCheckTickInterval", c.MergeCheckTickInterval, "must not be 0")
+	}
+
+	// The ticks are counted in base ticks, a shorter interval would never tick.
+	for _, tick := range []struct {
+		field    string
+		interval time.Duration
+	}{
+		{"RaftLogGCTickInterval", c.RaftLogGCTickInterval},
+		{"SplitRegionCheckTickInterval", c.SplitRegionCheckTickInterval},
+		{"PdHeartbeatTickInterval", c.PdHeartbeatTickInterval},
+		{"PdStoreHeartbeatTickInterval", c.PdStoreHeartbeatTickInterval},
+		{"MergeCheckTickInterval", c.MergeCheckTickInterval},
+	} {
+		if tick.interval < c.RaftBaseTickInterval {
+			return invalidConfig(tick.field, tick.interval,
+				"must not be less than base tick interval %v", c.RaftBaseTickInterval)
+		}
 	}
 
 	if c.PeerStaleStateCheckInterval < electionTimeout*2 {
-		return fmt.Errorf("peer stale state check interval %v ns is less than election timeout x 2 %v ns",
-			c.PeerStaleStateCheckInterval, electionTimeout*2)
+		return invalidConfig("PeerStaleStateCheckInterval", c.PeerStaleStateCheckInterval,
+			"must not be less than election timeout x 2 %v", electionTimeout*2)
 	}
 
 	if c.LeaderTransferMaxLogLag < 10 {
-		return fmt.Errorf("ratstore.leader-transfer-max-log-lag should be >= 10")
+		return invalidConfig("LeaderTransferMaxLogLag", c.LeaderTransferMaxLogLag, "must be greater than or equal to 10")
 	}
 
 	if c.AbnormalLeaderMissingDuration < c.PeerStaleStateCheckInterval {
-		return fmt.Errorf("abnormal leader missing %v ns is less than peer stale state check interval %v ns",
-			c.AbnormalLeaderMissingDuration, c.PeerStaleStateCheckInterval)
+		return invalidConfig("AbnormalLeaderMissingDuration", c.AbnormalLeaderMissingDuration,
+			"must not be less than peer stale state check interval %v", c.PeerStaleStateCheckInterval)
 	}
 
 	if c.MaxLeaderMissingDuration < c.AbnormalLeaderMissingDuration {
-		return fmt.Errorf("max leader missing %v ns is less than abnormal leader missing %v ns",
-			c.MaxLeaderMissingDuration, c.AbnormalLeaderMissingDuration)
+		return invalidConfig("MaxLeaderMissingDuration", c.MaxLeaderMissingDuration,
+			"must not be less than abnormal leader missing duration %v", c.AbnormalLeaderMissingDuration)
 	}
 
 	if c.RegionCompactTombstonesPencent < 1 || c.RegionCompactTombstonesPencent > 100 {
-		return fmt.Errorf("region-compact-tombstones-percent must between 1 and 100, current vlaue is %v",
-			c.RegionCompactTombstonesPencent)
+		return invalidConfig("RegionCompactTombstonesPencent", c.RegionCompactTombstonesPencent,
+			"must be between 1 and 100")
+	}
+
+	if c.SplitCheck.RegionSplitSize == 0 {
+		return invalidConfig("SplitCheck.RegionSplitSize", c.SplitCheck.RegionSplitSize, "must be greater than 0")
+	}
+
+	if c.SplitCheck.RegionMaxSize < c.SplitCheck.RegionSplitSize {
+		return invalidConfig("SplitCheck.RegionMaxSize", c.SplitCheck.RegionMaxSize,
+			"must not be less than region split size %v", c.SplitCheck.RegionSplitSize)
+	}
+
+	if c.SplitCheck.RegionMaxKeys < c.SplitCheck.RegionSplitKeys {
+		return invalidConfig("SplitCheck.RegionMaxKeys", c.SplitCheck.RegionMaxKeys,
+			"must not be less than region split keys %v", c.SplitCheck.RegionSplitKeys)
+	}
+
+	if c.PeerMailboxCapacity < 0 {
+		return invalidConfig("PeerMailboxCapacity", c.PeerMailboxCapacity, "must not be negative")
+	}
+
+	if c.PdHeartbeatBatchDelay < 0 {
+		return invalidConfig("PdHeartbeatBatchDelay", c.PdHeartbeatBatchDelay, "must not be negative")
+	}
+
+	if c.RegionTaskAgingInterval < 0 {
+		return invalidConfig("RegionTaskAgingInterval", c.RegionTaskAgingInterval, "must not be negative")
+	}
+
+	switch c.SnapshotSourcePolicy {
+	case "", SnapshotSourceLeader, SnapshotSourceClosest:
+	default:
+		return invalidConfig("SnapshotSourcePolicy", c.SnapshotSourcePolicy, "must be %q or %q",
+			SnapshotSourceLeader, SnapshotSourceClosest)
+	}
+
+	if c.HibernateRegions && c.HibernateIdleTicks <= 0 {
+		return invalidConfig("HibernateIdleTicks", c.HibernateIdleTicks, "must be greater than 0")
+	}
+
+	if c.RaftAdaptiveFlowControl {
+		if c.RaftMinInflightMsgs <= 0 || c.RaftMinInflightMsgs > c.RaftMaxInflightMsgs {
+			return invalidConfig("RaftMinInflightMsgs", c.RaftMinInflightMsgs,
+				"must be greater than 0 and not greater than RaftMaxInflightMsgs %d", c.RaftMaxInflightMsgs)
+		}
+		if c.RaftMinSizePerMsg == 0 || c.RaftMinSizePerMsg > c.RaftMaxSizePerMsg {
+			return invalidConfig("RaftMinSizePerMsg", c.RaftMinSizePerMsg,
+				"must be greater than 0 and not greater than RaftMaxSizePerMsg %d", c.RaftMaxSizePerMsg)
+		}
+		if c.RaftFlowTargetLatency <= 0 {
+			return invalidConfig("RaftFlowTargetLatency", c.RaftFlowTargetLatency, "must be greater than 0")
+		}
+	}
+
+	if c.PeerDebugLogRate < 0 {
+		return invalidConfig("PeerDebugLogRate", c.PeerDebugLogRate, "must not be negative")
+	}
+	if c.PeerDebugLogRate > 0 && c.PeerDebugLogBurst <= 0 {
+		return invalidConfig("PeerDebugLogBurst", c.PeerDebugLogBurst, "must be greater than 0")
+	}
+	if c.AsyncRaftLogWriters < 0 {
+		return invalidConfig("AsyncRaftLogWriters", c.AsyncRaftLogWriters, "must not be negative")
+	}
+	if c.ReadPoolSize < 0 {
+		return invalidConfig("ReadPoolSize", c.ReadPoolSize, "must not be negative")
+	}
+	if c.ReadPoolPointGetConcurrency < 0 {
+		return invalidConfig("ReadPoolPointGetConcurrency", c.ReadPoolPointGetConcurrency, "must not be negative")
+	}
+	if c.ReadPoolScanConcurrency < 0 {
+		return invalidConfig("ReadPoolScanConcurrency", c.ReadPoolScanConcurrency, "must not be negative")
+	}
+	if c.SafeTSUpdateInterval < 0 {
+		return invalidConfig("SafeTSUpdateInterval", c.SafeTSUpdateInterval, "must not be negative")
+	}
+	if c.SafeTSUpdateInterval > 0 && c.SafeTSUpdateInterval < c.RaftBaseTickInterval {
+		return invalidConfig("SafeTSUpdateInterval", c.SafeTSUpdateInterval,
+			"must not be less than base tick interval %v", c.RaftBaseTickInterval)
+	}
+	if c.InvariantCheckInterval < 0 {
+		return invalidConfig("InvariantCheckInterval", c.InvariantCheckInterval, "must not be negative")
+	}
+	if c.InvariantCheckInterval > 0 && c.InvariantCheckInterval < c.RaftBaseTickInterval {
+		return invalidConfig("InvariantCheckInterval", c.InvariantCheckInterval,
+			"must not be less than base tick interval %v", c.RaftBaseTickInterval)
+	}
+	switch c.InvariantViolationMode {
+	case "", InvariantModePanic, InvariantModeEvent, InvariantModeMetric:
+	default:
+		return invalidConfig("InvariantViolationMode", c.InvariantViolationMode, "must be %q, %q or %q",
+			InvariantModePanic, InvariantModeEvent, InvariantModeMetric)
+	}
+	if c.SnapGenLimit < 0 {
+		return invalidConfig("SnapGenLimit", c.SnapGenLimit, "must not be negative")
+	}
+	if c.SnapGenLimit > 0 && c.SnapGenLimitWindow <= 0 {
+		return invalidConfig("SnapGenLimitWindow", c.SnapGenLimitWindow, "must be greater than 0")
+	}
+	if c.SnapWaitersCapacity <= 0 {
+		return invalidConfig("SnapWaitersCapacity", c.SnapWaitersCapacity, "must be greater than 0")
+	}
+	if c.SnapWaitTimeout <= 0 {
+		return invalidConfig("SnapWaitTimeout", c.SnapWaitTimeout, "must be greater than 0")
+	}
+	if c.IngestRateLimit > 0 && c.IngestWriteLatencyTarget > 0 {
+		if c.IngestMinRateLimit == 0 {
+			return invalidConfig("IngestMinRateLimit", c.IngestMinRateLimit,
+				"must be greater than 0 when IngestWriteLatencyTarget is set")
+		}
+		if c.IngestMinRateLimit > c.IngestRateLimit {
+			return invalidConfig("IngestMinRateLimit", c.IngestMinRateLimit,
+				"must not be greater than ingest rate limit %v", c.IngestRateLimit)
+		}
+	}
+	if c.PeerInitWorkers < 0 {
+		return invalidConfig("PeerInitWorkers", c.PeerInitWorkers, "must not be negative")
+	}
+	if c.RecoveryProgressInterval < 0 {
+		return invalidConfig("RecoveryProgressInterval", c.RecoveryProgressInterval, "must not be negative")
+	}
+	if c.LoadSplitQPSThreshold > 0 && c.LoadSplitWindow <= 0 {
+		return invalidConfig("LoadSplitWindow", c.LoadSplitWindow, "must be greater than 0")
 	}
 
 	if c.ApplyPoolSize == 0 {
-		return fmt.Errorf("apply-pool-size should be greater than 0")
+		return invalidConfig("ApplyPoolSize", c.ApplyPoolSize, "must be greater than 0")
 	}
 	if c.ApplyMaxBatchSize == 0 {
-		return fmt.Errorf("apply-max-batch-size should be greater than 0")
+		return invalidConfig("ApplyMaxBatchSize", c.ApplyMaxBatchSize, "must be greater than 0")
 	}
 	if c.StoreMaxBatchSize == 0 {
-		return fmt.Errorf("store-max-batch-size should be greater than 0")
+		return invalidConfig("StoreMaxBatchSize", c.StoreMaxBatchSize, "must be greater than 0")
 	}
 	return nil
 }
+
+// fillDerivedDefaults sets the zero fields whose defaults depend on other fields.
+func (c *Config) fillDerivedDefaults() {
+	if c.RaftMinElectionTimeoutTicks == 0 {
+		c.RaftMinElectionTimeoutTicks = c.RaftElectionTimeoutTicks
+	}
+	if c.RaftMaxElectionTimeoutTicks == 0 {
+		c.RaftMaxElectionTimeoutTicks = c.RaftElectionTimeoutTicks * 2
+	}
+	if c.RaftMaxInflightMsgs == 0 {
+		c.RaftMaxInflightMsgs = 256
+	}
+	if c.SplitCheck == nil {
+		c.SplitCheck = newDefaultSplitCheckConfig()
+	}
+	if c.RegionSplitCheckDiff == 0 {
+		c.RegionSplitCheckDiff = c.SplitCheck.RegionSplitSize / 8
+	}
+}
+
+func invalidConfig(field string, value interface{}, format string, args ...interface{}) error {
+	return &ErrInvalidConfig{Field: field, Value: value, Reason: fmt.Sprintf(format, args...)}
+}
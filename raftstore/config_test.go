@@ -51,6 +51,12 @@ func TestConfigValidate(t *testing.T) {
 	cfg.RaftLogGcSizeLimit = 0
 	require.NotNil(t, cfg.Validate())
 
+	cfg = NewDefaultConfig()
+	cfg.SnapshotCatchUpGap = cfg.RaftLogGcThreshold - 1
+	require.NotNil(t, cfg.Validate())
+	cfg.SnapshotCatchUpGap = cfg.RaftLogGcThreshold
+	require.Nil(t, cfg.Validate())
+
 	cfg = NewDefaultConfig()
 	cfg.RaftBaseTickInterval = 1 * time.Second
 	cfg.RaftElectionTimeoutTicks = 10
@@ -89,4 +95,55 @@ func TestConfigValidate(t *testing.T) {
 	cfg = NewDefaultConfig()
 	cfg.ApplyPoolSize = 0
 	require.NotNil(t, cfg.Validate())
+
+	cfg = NewDefaultConfig()
+	cfg.IngestRateLimit = 100
+	cfg.IngestWriteLatencyTarget = time.Millisecond
+	require.NotNil(t, cfg.Validate())
+	cfg.IngestMinRateLimit = 101
+	require.NotNil(t, cfg.Validate())
+	cfg.IngestMinRateLimit = 10
+	require.Nil(t, cfg.Validate())
+}
+
+func TestConfigValidateDerived(t *testing.T) {
+	cfg := NewDefaultConfig()
+	cfg.RaftMaxInflightMsgs = 0
+	cfg.RegionSplitCheckDiff = 0
+	cfg.SplitCheck = nil
+	require.Nil(t, cfg.Validate())
+	assert.Equal(t, 256, cfg.RaftMaxInflightMsgs)
+	require.NotNil(t, cfg.SplitCheck)
+	assert.Equal(t, cfg.SplitCheck.RegionSplitSize/8, cfg.RegionSplitCheckDiff)
+
+	cfg = NewDefaultConfig()
+	cfg.RaftLogGcCountLimit = 100
+	cfg.MergeMaxLogGap = 110
+	err := cfg.Validate()
+	require.IsType(t, &ErrInvalidConfig{}, err)
+	assert.Equal(t, "MergeMaxLogGap", err.(*ErrInvalidConfig).Field)
+	assert.Equal(t, uint64(110), err.(*ErrInvalidConfig).Value)
+
+	cfg = NewDefaultConfig()
+	cfg.RaftBaseTickInterval = 0
+	err = cfg.Validate()
+	require.IsType(t, &ErrInvalidConfig{}, err)
+	assert.Equal(t, "RaftBaseTickInterval", err.(*ErrInvalidConfig).Field)
+
+	// A tick interval shorter than the base tick would never tick.
+	cfg = NewDefaultConfig()
+	cfg.PdHeartbeatTickInterval = 100 * time.Millisecond
+	err = cfg.Validate()
+	require.IsType(t, &ErrInvalidConfig{}, err)
+	assert.Equal(t, "PdHeartbeatTickInterval", err.(*ErrInvalidConfig).Field)
+
+	cfg = NewDefaultConfig()
+	cfg.SplitCheck.RegionMaxKeys = cfg.SplitCheck.RegionSplitKeys - 1
+	err = cfg.Validate()
+	require.IsType(t, &ErrInvalidConfig{}, err)
+	assert.Equal(t, "SplitCheck.RegionMaxKeys", err.(*ErrInvalidConfig).Field)
+
+	cfg = NewDefaultConfig()
+	cfg.RaftLogGcThreshold = cfg.RaftLogGcCountLimit
+	require.NotNil(t, cfg.Validate())
 }
@@ -0,0 +1,102 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"time"
+
+	"github.com/pingcap/badger"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/store/mockstore/unistore/lockstore"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/mvcc"
+	"go.uber.org/zap"
+)
+
+// invariantConsistentHash is the invariant reporting the hash mismatches of the consistency checks.
+const invariantConsistentHash = "consistent-hash"
+
+// newRegionDataSnapshot takes a snapshot of the data and the locks of the region, the locks are copied
+// because the lock store is not versioned.
+func newRegionDataSnapshot(kv *mvcc.DBBundle, region *metapb.Region) *mvcc.DBSnapshot {
+	start, end := RawStartKey(region), RawEndKey(region)
+	lockSnap := lockstore.NewMemStore(64 << 10)
+	it := kv.LockStore.NewIterator()
+	for it.Seek(start); it.Valid() && bytes.Compare(it.Key(), end) < 0; it.Next() {
+		lockSnap.Put(it.Key(), it.Value())
+	}
+	return &mvcc.DBSnapshot{Txn: kv.DB.NewTransaction(false), LockStore: lockSnap}
+}
+
+// computeRegionHash computes the CRC32 of the locks and the latest versions of the data in the region.
+// The old versions are left out since they are garbage collected by every store on its own.
+func computeRegionHash(region *metapb.Region, snap *mvcc.DBSnapshot) []byte {
+	start, end := RawStartKey(region), RawEndKey(region)
+	digest := crc32.NewIEEE()
+	var buf [8]byte
+	lockIt := snap.LockStore.NewIterator()
+	for lockIt.Seek(start); lockIt.Valid() && bytes.Compare(lockIt.Key(), end) < 0; lockIt.Next() {
+		digest.Write(lockIt.Key())
+		digest.Write(lockIt.Value())
+	}
+	it := snap.Txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	for it.Seek(start); it.Valid(); it.Next() {
+		item := it.Item()
+		if bytes.Compare(item.Key(), end) >= 0 {
+			break
+		}
+		val, err := item.Value()
+		if err != nil {
+			panic(err)
+		}
+		digest.Write(item.Key())
+		binary.BigEndian.PutUint64(buf[:], item.Version())
+		digest.Write(buf[:])
+		digest.Write(item.UserMeta())
+		digest.Write(val)
+	}
+	return digest.Sum(nil)
+}
+
+func (r *computeHashTaskHandler) handle(t task) {
+	hashTask := t.data.(*computeHashTask)
+	defer hashTask.snap.Txn.Discard()
+	regionID := hashTask.region.Id
+	hash := computeRegionHash(hashTask.region, hashTask.snap)
+	msg := NewPeerMsg(MsgTypeComputeResult, regionID, &MsgComputeHashResult{Index: hashTask.index, Hash: hash})
+	if err := r.router.send(regionID, msg); err != nil {
+		log.Warn("failed to send the computed hash", zap.Uint64("region id", regionID), zap.Error(err))
+	}
+}
+
+// onHashMismatch reports the mismatch as a violation of the consistent-hash invariant, it panics if
+// Config.InvariantViolationMode is empty.
+func (d *peerMsgHandler) onHashMismatch(index uint64, expected, actual []byte) {
+	mode := d.ctx.cfg.InvariantViolationMode
+	if mode == "" {
+		mode = InvariantModePanic
+	}
+	d.peer.invariants.report(mode, InvariantViolation{
+		Invariant: invariantConsistentHash,
+		StoreID:   d.storeID(),
+		RegionID:  d.regionID(),
+		Detail:    fmt.Sprintf("hash at %d is %x, expected %x", index, actual, expected),
+		Time:      time.Now(),
+	})
+}
@@ -0,0 +1,292 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/ngaut/unistore/raftstore/raftlog"
+	"github.com/pingcap/badger"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
+	"github.com/pingcap/tidb/store/mockstore/unistore/lockstore"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/dbreader"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/mvcc"
+)
+
+// MultiRegionSnapshot is a consistent point-in-time view of several regions at a ts.
+type MultiRegionSnapshot struct {
+	ts uint64
+	// regions are sorted by start key and never overlap.
+	regions []*metapb.Region
+	txn     *badger.Txn
+}
+
+// ConsistentSnapshot returns a snapshot of the regions at ts. It waits until every region has applied
+// the read index and its resolved ts covers ts, that is no lock with start ts <= ts is left in the region,
+// so all the transactions committed at or before ts are visible in the snapshot.
+func (ris *RaftInnerServer) ConsistentSnapshot(ctx context.Context, regionCtxs []*kvrpcpb.Context, ts uint64) (*MultiRegionSnapshot, error) {
+	return newMultiRegionSnapshot(ctx, ris.router, ris.engines, regionCtxs, ts)
+}
+
+func newMultiRegionSnapshot(ctx context.Context, pr *router, engines *Engines, regionCtxs []*kvrpcpb.Context,
+	ts uint64) (*MultiRegionSnapshot, error) {
+	kv := engines.kv
+	cbs := make([]*Callback, 0, len(regionCtxs))
+	dones := make([]<-chan struct{}, 0, len(regionCtxs))
+	for _, regionCtx := range regionCtxs {
+		cb, done, err := sendReadIndex(pr, regionCtx)
+		if err != nil {
+			return nil, err
+		}
+		cbs = append(cbs, cb)
+		dones = append(dones, done)
+	}
+	regions := make([]*metapb.Region, 0, len(regionCtxs))
+	for i, cb := range cbs {
+		select {
+		case <-dones[i]:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if pbErr := cb.resp.GetHeader().GetError(); pbErr != nil {
+			return nil, errors.Errorf("read index of region %d: %s", regionCtxs[i].RegionId, pbErr.Message)
+		}
+		region, err := currentRegion(pr, regionCtxs[i])
+		if err != nil {
+			return nil, err
+		}
+		regions = append(regions, region)
+	}
+	sort.Slice(regions, func(i, j int) bool {
+		return bytes.Compare(RawStartKey(regions[i]), RawStartKey(regions[j])) < 0
+	})
+	for i := 1; i < len(regions); i++ {
+		if bytes.Compare(RawEndKey(regions[i-1]), RawStartKey(regions[i])) > 0 {
+			return nil, errors.Errorf("region %d overlaps with region %d", regions[i-1].Id, regions[i].Id)
+		}
+	}
+	for _, region := range regions {
+		if err := waitResolvedTS(ctx, engines, region, ts); err != nil {
+			return nil, err
+		}
+	}
+	txn := kv.DB.NewTransaction(false)
+	txn.SetReadTS(ts)
+	// The regions may be split or merged before the transaction is created.
+	for _, region := range regions {
+		if _, err := currentRegion(pr, &kvrpcpb.Context{RegionId: region.Id, RegionEpoch: region.RegionEpoch}); err != nil {
+			txn.Discard()
+			return nil, err
+		}
+	}
+	return &MultiRegionSnapshot{ts: ts, regions: regions, txn: txn}, nil
+}
+
+// sendReadIndex sends a read index command, the returned channel is closed when the callback is done.
+func sendReadIndex(pr *router, regionCtx *kvrpcpb.Context) (*Callback, <-chan struct{}, error) {
+	cb := NewCallback()
+	done := make(chan struct{})
+	cb.onDone = func(*Callback) { close(done) }
+	cmd := &raft_cmdpb.RaftCmdRequest{
+		Header: &raft_cmdpb.RaftRequestHeader{
+			RegionId:    regionCtx.RegionId,
+			Peer:        regionCtx.Peer,
+			RegionEpoch: regionCtx.RegionEpoch,
+			Term:        regionCtx.Term,
+			ReadQuorum:  true,
+		},
+		Requests: []*raft_cmdpb.Request{{CmdType: raft_cmdpb.CmdType_Snap}},
+	}
+	msg := &MsgRaftCmd{
+		SendTime: time.Now(),
+		Request:  raftlog.NewRequest(cmd),
+		Callback: cb,
+	}
+	if err := pr.sendRaftCommand(msg); err != nil {
+		return nil, nil, err
+	}
+	return cb, done, nil
+}
+
+// currentRegion returns the current region of the peer if its version matches the context.
+func currentRegion(pr *router, regionCtx *kvrpcpb.Context) (*metapb.Region, error) {
+	p := pr.get(regionCtx.RegionId)
+	if p == nil {
+		return nil, &ErrRegionNotFound{RegionID: regionCtx.RegionId}
+	}
+	region := (*metapb.Region)(atomic.LoadPointer(&p.peer.peer.leaderChecker.region))
+	if region.GetRegionEpoch().GetVersion() != regionCtx.GetRegionEpoch().GetVersion() {
+		err := &ErrEpochNotMatch{Regions: []*metapb.Region{region}}
+		err.Message = fmt.Sprintf("current epoch of region %d is %s, but you sent %s",
+			region.Id, region.RegionEpoch, regionCtx.RegionEpoch)
+		return nil, err
+	}
+	return region, nil
+}
+
+// resolvedTS returns the max ts that all the transactions in the region committed at or before it
+// are applied, it is the min start ts of the locks in the region minus one.
+func resolvedTS(lockStore *lockstore.MemStore, region *metapb.Region) uint64 {
+	resolved := uint64(math.MaxUint64)
+	startKey, endKey := RawStartKey(region), RawEndKey(region)
+	it := lockStore.NewIterator()
+	for it.Seek(startKey); it.Valid(); it.Next() {
+		if exceedEndKey(it.Key(), endKey) {
+			break
+		}
+		if lock := mvcc.DecodeLock(it.Value()); lock.StartTS <= resolved {
+			resolved = lock.StartTS - 1
+		}
+	}
+	return resolved
+}
+
+// waitResolvedTS waits until the resolved ts of the region covers ts, it's checked again whenever the
+// applied commands release locks.
+func waitResolvedTS(ctx context.Context, engines *Engines, region *metapb.Region, ts uint64) error {
+	for {
+		// Get the channel before the check, so a release after the check is not missed.
+		changed := engines.lockReleased.changed()
+		resolved := resolvedTS(engines.kv.LockStore, region)
+		if resolved >= ts {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return errors.Annotatef(ctx.Err(), "region %d resolved ts %d is behind %d", region.Id, resolved, ts)
+		}
+	}
+}
+
+// TS returns the ts of the snapshot.
+func (s *MultiRegionSnapshot) TS() uint64 {
+	return s.ts
+}
+
+// Regions returns the regions of the snapshot sorted by start key.
+func (s *MultiRegionSnapshot) Regions() []*metapb.Region {
+	return s.regions
+}
+
+// NewIterator returns an iterator over the latest versions visible at the snapshot ts of all
+// the regions in key order.
+func (s *MultiRegionSnapshot) NewIterator() *MultiRegionIterator {
+	it := &MultiRegionIterator{snap: s, idx: -1}
+	it.nextRegion()
+	return it
+}
+
+// Close releases the snapshot, the iterators must be closed before.
+func (s *MultiRegionSnapshot) Close() {
+	s.txn.Discard()
+}
+
+// MultiRegionIterator iterates the keys of a MultiRegionSnapshot region by region.
+type MultiRegionIterator struct {
+	snap   *MultiRegionSnapshot
+	idx    int
+	endKey []byte
+	iter   *badger.Iterator
+	err    error
+}
+
+func (it *MultiRegionIterator) nextRegion() {
+	for {
+		if it.iter != nil {
+			it.iter.Close()
+			it.iter = nil
+		}
+		it.idx++
+		if it.idx >= len(it.snap.regions) {
+			return
+		}
+		region := it.snap.regions[it.idx]
+		startKey := RawStartKey(region)
+		it.endKey = RawEndKey(region)
+		it.iter = dbreader.NewIterator(it.snap.txn, false, startKey, it.endKey)
+		it.iter.Seek(startKey)
+		if it.skipEmpty() {
+			return
+		}
+	}
+}
+
+// skipEmpty skips the deleted keys and returns true if the iterator stops at a key in the region.
+func (it *MultiRegionIterator) skipEmpty() bool {
+	for ; it.iter.Valid(); it.iter.Next() {
+		item := it.iter.Item()
+		if exceedEndKey(item.Key(), it.endKey) {
+			return false
+		}
+		if !item.IsEmpty() {
+			return true
+		}
+	}
+	return false
+}
+
+// Valid returns false if the iteration is done or failed.
+func (it *MultiRegionIterator) Valid() bool {
+	return it.err == nil && it.idx < len(it.snap.regions)
+}
+
+// Next moves to the next key.
+func (it *MultiRegionIterator) Next() {
+	it.iter.Next()
+	if !it.skipEmpty() {
+		it.nextRegion()
+	}
+}
+
+// RegionID returns the region of the current key.
+func (it *MultiRegionIterator) RegionID() uint64 {
+	return it.snap.regions[it.idx].Id
+}
+
+// Key returns the current key, it is only valid until Next is called.
+func (it *MultiRegionIterator) Key() []byte {
+	return it.iter.Item().Key()
+}
+
+// Value returns the value of the current key, the iteration is stopped if the value fails to read.
+func (it *MultiRegionIterator) Value() []byte {
+	val, err := it.iter.Item().Value()
+	if err != nil {
+		it.err = errors.WithStack(err)
+	}
+	return val
+}
+
+// Err returns the error that stopped the iteration.
+func (it *MultiRegionIterator) Err() error {
+	return it.err
+}
+
+// Close closes the iterator.
+func (it *MultiRegionIterator) Close() {
+	if it.iter != nil {
+		it.iter.Close()
+		it.iter = nil
+	}
+}
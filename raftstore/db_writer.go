@@ -175,9 +175,10 @@ func (writer *raftDBWriter) Write(batch mvcc.WriteBatch) error {
 		Callback: NewCallback(),
 	}
 	var reqLen int
+	var ctx *kvrpcpb.Context
 	switch x := batch.(type) {
 	case *raftWriteBatch:
-		ctx := x.ctx
+		ctx = x.ctx
 		header := &rcpb.RaftRequestHeader{
 			RegionId:    ctx.RegionId,
 			Peer:        ctx.Peer,
@@ -190,6 +191,7 @@ func (writer *raftDBWriter) Write(batch mvcc.WriteBatch) error {
 		})
 		reqLen = len(x.requests)
 	case *customWriteBatch:
+		ctx = x.ctx
 		cmd.Request = x.builder.Build()
 		reqLen = x.builder.Len()
 	}
@@ -208,7 +210,12 @@ func (writer *raftDBWriter) Write(batch mvcc.WriteBatch) error {
 		metrics.WriteWaiteStepThree.Observe(cb.applyBeginTime.Sub(cb.raftDoneTime).Seconds())
 		metrics.WriteWaiteStepFour.Observe(cb.applyDoneTime.Sub(cb.applyBeginTime).Seconds())
 	}
-	return writer.checkResponse(cb.resp, reqLen)
+	if err = writer.checkResponse(cb.resp, reqLen); err != nil {
+		return err
+	}
+	writer.router.readYourWrites.observeWrite(ctx, cb.appliedIndex)
+	writer.router.ingestLimiter.observeWriteLatency(waitDoneTime.Sub(start))
+	return nil
 }
 
 func (writer *raftDBWriter) checkResponse(resp *rcpb.RaftCmdResponse, reqCount int) error {
@@ -286,6 +293,7 @@ type customWriteBatch struct {
 	startTS  uint64
 	commitTS uint64
 	builder  *raftlog.CustomBuilder
+	ctx      *kvrpcpb.Context
 }
 
 func (wb *customWriteBatch) setType(tp raftlog.CustomRaftLogType) {
@@ -336,5 +344,6 @@ func NewCustomWriteBatch(startTS, commitTS uint64, ctx *kvrpcpb.Context) mvcc.Wr
 		startTS:  startTS,
 		commitTS: commitTS,
 		builder:  b,
+		ctx:      ctx,
 	}
 }
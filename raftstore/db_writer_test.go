@@ -20,10 +20,13 @@ import (
 
 	"github.com/ngaut/unistore/raftstore/raftlog"
 	"github.com/pingcap/badger"
+	"github.com/pingcap/badger/y"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
 	rfpb "github.com/pingcap/kvproto/pkg/raft_cmdpb"
 	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/mvcc"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestRaftWriteBatch_PrewriteAndCommit(t *testing.T) {
@@ -180,3 +183,173 @@ func TestRaftWriteBatch_Rollback(t *testing.T) {
 	val := engines.kv.LockStore.Get(primary, nil)
 	assert.Nil(t, val)
 }
+
+func TestWriteBatchSavePoint(t *testing.T) {
+	wb := new(WriteBatch)
+	assert.Equal(t, errNoSavePoint, wb.RollbackToSavePoint())
+	assert.Equal(t, errNoSavePoint, wb.PopSavePoint())
+
+	wb.Set(y.KeyWithTs([]byte("a"), 1), []byte("a"))
+	size := wb.size
+	wb.SetSavePoint()
+	wb.SetLock([]byte("b"), []byte("b"))
+	wb.SetSavePoint()
+	wb.Delete(y.KeyWithTs([]byte("c"), 1))
+	wb.DeleteLock([]byte("d"))
+	assert.Equal(t, 4, wb.Len())
+	assert.Nil(t, wb.RollbackToSavePoint())
+	assert.Equal(t, 2, wb.Len())
+	assert.Equal(t, size, wb.size)
+
+	wb.SetSavePoint()
+	wb.Set(y.KeyWithTs([]byte("e"), 1), []byte("e"))
+	assert.Nil(t, wb.PopSavePoint())
+	assert.Nil(t, wb.RollbackToSavePoint())
+	assert.Equal(t, 1, wb.Len())
+	assert.Equal(t, errNoSavePoint, wb.RollbackToSavePoint())
+
+	wb.SetSavePoint()
+	wb.Reset()
+	assert.Equal(t, errNoSavePoint, wb.PopSavePoint())
+}
+
+func TestExecWriteCmdRollbackFailedRequest(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	apply := new(applier)
+	applyCtx := newApplyContext("test", nil, engines, nil, NewDefaultConfig())
+	wb := &raftWriteBatch{startTS: 100}
+	primary := []byte("t00000001_r00000001")
+	wb.Prewrite(primary, &mvcc.Lock{
+		LockHdr: mvcc.LockHdr{StartTS: 100, TTL: 10, Op: uint8(kvrpcpb.Op_Put), PrimaryLen: uint16(len(primary))},
+		Primary: primary,
+		Value:   []byte("value"),
+	})
+	_, _, err := apply.execWriteCmd(applyCtx, raftlog.NewRequest(&rfpb.RaftCmdRequest{
+		Header:   new(rfpb.RaftRequestHeader),
+		Requests: wb.requests,
+	}))
+	assert.Nil(t, err)
+	prewriteLen := applyCtx.wb.Len()
+	applyCtx.wb.Reset()
+
+	// The malformed delete range only reverts its own mutations.
+	_, _, err = apply.execWriteCmd(applyCtx, raftlog.NewRequest(&rfpb.RaftCmdRequest{
+		Header: new(rfpb.RaftRequestHeader),
+		Requests: append(wb.requests, &rfpb.Request{
+			CmdType:     rfpb.CmdType_DeleteRange,
+			DeleteRange: &rfpb.DeleteRangeRequest{StartKey: []byte{1}, EndKey: []byte{2}},
+		}),
+	}))
+	assert.NotNil(t, err)
+	assert.Equal(t, prewriteLen, applyCtx.wb.Len())
+	assert.Equal(t, errNoSavePoint, applyCtx.wb.PopSavePoint())
+}
+
+func TestExecWriteCmdIdempotency(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	apply := new(applier)
+	cfg := NewDefaultConfig()
+	cfg.IdempotencyWindow = 2
+	applyCtx := newApplyContext("test", nil, engines, nil, cfg)
+	prewrite := func(key string) []*rfpb.Request {
+		wb := &raftWriteBatch{startTS: 100}
+		wb.Prewrite([]byte(key), &mvcc.Lock{
+			LockHdr: mvcc.LockHdr{StartTS: 100, TTL: 10, Op: uint8(kvrpcpb.Op_Put), PrimaryLen: uint16(len(key))},
+			Primary: []byte(key),
+			Value:   []byte("value"),
+		})
+		return wb.requests
+	}
+	exec := func(index uint64, token string, requests []*rfpb.Request) (*rfpb.RaftCmdResponse, int) {
+		applyCtx.execCtx = &applyExecContext{index: index}
+		resp, _, err := apply.execWriteCmd(applyCtx, raftlog.NewRequest(&rfpb.RaftCmdRequest{
+			Header:   &rfpb.RaftRequestHeader{Uuid: []byte(token)},
+			Requests: requests,
+		}))
+		require.Nil(t, err)
+		n := applyCtx.wb.Len()
+		applyCtx.wb.Reset()
+		return resp, n
+	}
+
+	resp, n := exec(1, "a", prewrite("k1"))
+	assert.True(t, n > 0)
+	assert.Nil(t, resp.Header.Error)
+
+	// The retry succeeds without writing anything.
+	resp, n = exec(2, "a", prewrite("k1"))
+	assert.Equal(t, 0, n)
+	assert.Nil(t, resp.Header.Error)
+	assert.Equal(t, []byte("a"), resp.Header.Uuid)
+	require.Len(t, resp.Responses, 1)
+	assert.Equal(t, rfpb.CmdType_Put, resp.Responses[0].CmdType)
+
+	// The writes without a token are always applied.
+	_, n = exec(3, "", prewrite("k2"))
+	assert.True(t, n > 0)
+	_, n = exec(4, "", prewrite("k2"))
+	assert.True(t, n > 0)
+
+	// The oldest token is forgotten when the window is full.
+	_, n = exec(5, "b", prewrite("k3"))
+	assert.True(t, n > 0)
+	_, n = exec(6, "c", prewrite("k4"))
+	assert.True(t, n > 0)
+	_, n = exec(7, "b", prewrite("k3"))
+	assert.Equal(t, 0, n)
+	_, n = exec(8, "a", prewrite("k1"))
+	assert.True(t, n > 0)
+
+	// The custom raft logs have no token, the bypass is reported once.
+	assert.False(t, applyCtx.customLogWarned)
+	custom := NewCustomWriteBatch(100, 0, &kvrpcpb.Context{
+		RegionEpoch: &metapb.RegionEpoch{}, Peer: &metapb.Peer{}}).(*customWriteBatch)
+	custom.Prewrite([]byte("k5"), &mvcc.Lock{LockHdr: mvcc.LockHdr{StartTS: 100, TTL: 10, Op: uint8(kvrpcpb.Op_Put)}})
+	applyCtx.execCtx = &applyExecContext{index: 9}
+	_, _, err := apply.execWriteCmd(applyCtx, custom.builder.Build())
+	require.Nil(t, err)
+	assert.True(t, applyCtx.customLogWarned)
+}
+
+func TestExecWriteCmdSizeDiffHint(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	apply := new(applier)
+	applyCtx := newApplyContext("test", nil, engines, nil, NewDefaultConfig())
+	exec := func(wb *raftWriteBatch) {
+		_, _, err := apply.execWriteCmd(applyCtx, raftlog.NewRequest(&rfpb.RaftCmdRequest{
+			Header:   new(rfpb.RaftRequestHeader),
+			Requests: wb.requests,
+		}))
+		require.Nil(t, err)
+		require.Nil(t, applyCtx.wb.WriteToKV(engines.kv))
+		applyCtx.wb.Reset()
+	}
+	primary := []byte("t00000001_r00000001")
+	lock := &mvcc.Lock{
+		LockHdr: mvcc.LockHdr{StartTS: 100, TTL: 10, Op: uint8(kvrpcpb.Op_Put), PrimaryLen: uint16(len(primary))},
+		Primary: primary,
+		Value:   []byte("value"),
+	}
+
+	// The locks are not stored in the region data.
+	wb := &raftWriteBatch{startTS: 100}
+	wb.Prewrite(primary, lock)
+	exec(wb)
+	assert.Equal(t, uint64(0), apply.metrics.sizeDiffHint)
+
+	// The committed value is counted with the encoded key and the user meta.
+	wb = &raftWriteBatch{startTS: 100, commitTS: 200}
+	wb.Commit(primary, lock)
+	exec(wb)
+	committed := uint64(len(primary) + 8 + len(lock.Value) + len(mvcc.NewDBUserMeta(100, 200)))
+	assert.Equal(t, committed, apply.metrics.sizeDiffHint)
+
+	// The rollback tombstone is counted as well.
+	wb = &raftWriteBatch{startTS: 300}
+	wb.Rollback(primary, false)
+	exec(wb)
+	assert.True(t, apply.metrics.sizeDiffHint > committed)
+}
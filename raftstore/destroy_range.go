@@ -0,0 +1,110 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// DestroyRangeEvent is emitted when an UnsafeDestroyRange request is finished.
+type DestroyRangeEvent struct {
+	StartKey []byte
+	EndKey   []byte
+	Err      error
+	Duration time.Duration
+}
+
+// DestroyRangeListener is called for every finished UnsafeDestroyRange request, it must not block.
+type DestroyRangeListener func(event DestroyRangeEvent)
+
+type destroyRangeTask struct {
+	startKey []byte
+	endKey   []byte
+	callback func(err error)
+}
+
+// destroyRange deletes all the data and locks in the range regardless of the regions.
+// It runs in the region worker, so it never overlaps with a snapshot being generated or applied,
+// the pending delete ranges overlapping with it are cleaned up first because they are covered.
+func (snapCtx *snapContext) destroyRange(t *destroyRangeTask) {
+	snapCtx.cleanUpOverlapRanges(t.startKey, t.endKey)
+	err := deleteRange(snapCtx.engiens.kv, t.startKey, t.endKey)
+	if err != nil {
+		log.Error("failed to destroy range", zap.String("start key", hex.EncodeToString(t.startKey)),
+			zap.String("end key", hex.EncodeToString(t.endKey)), zap.Error(err))
+	} else {
+		log.Info("succeed in destroying range", zap.String("start key", hex.EncodeToString(t.startKey)),
+			zap.String("end key", hex.EncodeToString(t.endKey)))
+	}
+	t.callback(err)
+}
+
+// AddDestroyRangeListener registers a listener for the finished UnsafeDestroyRange requests.
+func (ris *RaftInnerServer) AddDestroyRangeListener(l DestroyRangeListener) {
+	ris.destroyRangeMu.Lock()
+	listeners := make([]DestroyRangeListener, 0, len(ris.destroyRangeListeners)+1)
+	listeners = append(listeners, ris.destroyRangeListeners...)
+	ris.destroyRangeListeners = append(listeners, l)
+	ris.destroyRangeMu.Unlock()
+}
+
+// UnsafeDestroyRange removes all the data in the range [startKey, endKey) on this store without going
+// through raft, it is used to clean up the dropped tables after the GC safe point.
+func (ris *RaftInnerServer) UnsafeDestroyRange(ctx context.Context, startKey, endKey []byte) error {
+	if len(endKey) == 0 || bytes.Compare(startKey, endKey) >= 0 {
+		return errors.Errorf("invalid range [%x, %x)", startKey, endKey)
+	}
+	if ris.batchSystem == nil || ris.batchSystem.workers == nil {
+		return errors.New("raftstore is not started")
+	}
+	start := time.Now()
+	done := make(chan error, 1)
+	t := task{
+		tp: taskTypeRegionDestroyRange,
+		data: &destroyRangeTask{
+			startKey: startKey,
+			endKey:   endKey,
+			callback: func(err error) {
+				ris.destroyRangeMu.Lock()
+				listeners := ris.destroyRangeListeners
+				ris.destroyRangeMu.Unlock()
+				event := DestroyRangeEvent{StartKey: startKey, EndKey: endKey, Err: err, Duration: time.Since(start)}
+				for _, l := range listeners {
+					l(event)
+				}
+				done <- err
+			},
+		},
+	}
+	select {
+	case ris.batchSystem.workers.regionWorker.sender <- t:
+	case <-ctx.Done():
+		// The region worker is busy, the range is not destroyed.
+		return ctx.Err()
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		// The task keeps running in the region worker, the listeners are still notified.
+		return ctx.Err()
+	}
+}
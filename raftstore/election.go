@@ -0,0 +1,192 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"math/rand"
+	"sync/atomic"
+
+	"github.com/zhangjinpeng1987/raft"
+)
+
+// ElectionMetrics counts the elections of a peer, it is used to verify the election fairness.
+type ElectionMetrics struct {
+	// Campaigns is the number of times the peer became a candidate.
+	Campaigns uint64
+	// Elected is the number of times the peer became the leader.
+	Elected uint64
+	// Timeout is the current election timeout in ticks, it's 0 if the timeout is randomized by raft.
+	Timeout int64
+	// DeferredTicks is the number of ticks the peer skipped in the election grace.
+	DeferredTicks uint64
+}
+
+// electionTimer drives the elections of a peer with a custom election timeout. The timeout of a peer with
+// priority 0 is randomized in [min, max), a peer with a positive priority always times out at min, so it
+// campaigns before the others, and a peer with a negative priority p times out in [min-p*(max-min), max-p*(max-min)).
+// Raft randomizes its own timeout in [election tick, 2 * election tick), so the election tick of raft is set
+// to the longest timeout of the peer, and the peer campaigns when the timeout of the store expires first.
+type electionTimer struct {
+	min      int
+	max      int
+	priority int
+	// custom is false if the timeout is the same as raft, the elections are left to raft then.
+	custom bool
+
+	term  uint64
+	state raft.StateType
+	// elapsed is the number of the ticks since the peer heard from the leader or changed its term or role.
+	elapsed int
+
+	campaigns uint64
+	elected   uint64
+	timeout   int64
+
+	// graceTicks is Config.RaftElectionGraceTicks, grace is the number of the ticks left in the grace.
+	graceTicks int
+	grace      int
+	deferred   uint64
+}
+
+func newElectionTimer(cfg *Config) *electionTimer {
+	t := &electionTimer{
+		min:      cfg.RaftMinElectionTimeoutTicks,
+		max:      cfg.RaftMaxElectionTimeoutTicks,
+		priority: cfg.ElectionPriority,
+
+		graceTicks: cfg.RaftElectionGraceTicks,
+	}
+	if t.min == 0 {
+		t.min = cfg.RaftElectionTimeoutTicks
+	}
+	if t.max == 0 {
+		t.max = cfg.RaftElectionTimeoutTicks * 2
+	}
+	t.custom = t.min != cfg.RaftElectionTimeoutTicks || t.max != cfg.RaftElectionTimeoutTicks*2 || t.priority != 0
+	if t.custom {
+		t.timeout = int64(t.next())
+	}
+	return t
+}
+
+// raftElectionTick returns the election tick of the raft group. With a custom timeout it's the longest timeout
+// of the peer, so the leader steps down by the check quorum after the longest timeout too.
+func (t *electionTimer) raftElectionTick(cfg *Config) int {
+	if !t.custom {
+		return cfg.RaftElectionTimeoutTicks
+	}
+	if t.priority < 0 {
+		return t.max - t.priority*(t.max-t.min)
+	}
+	return t.max
+}
+
+func (t *electionTimer) next() int {
+	if t.priority > 0 {
+		return t.min
+	}
+	span := t.max - t.min
+	return t.min - t.priority*span + rand.Intn(span)
+}
+
+func (t *electionTimer) reset() {
+	t.elapsed = 0
+	if t.custom {
+		atomic.StoreInt64(&t.timeout, int64(t.next()))
+	}
+}
+
+// observe updates the metrics and restarts the timeout after the term or the role is changed.
+func (t *electionTimer) observe(r *raft.Raft) {
+	if t == nil || r.Term == t.term && r.State == t.state {
+		return
+	}
+	if r.State != t.state {
+		switch r.State {
+		case raft.StateCandidate:
+			atomic.AddUint64(&t.campaigns, 1)
+		case raft.StateLeader:
+			if t.state != raft.StateCandidate {
+				atomic.AddUint64(&t.campaigns, 1)
+			}
+			atomic.AddUint64(&t.elected, 1)
+		}
+	}
+	t.term, t.state = r.Term, r.State
+	t.reset()
+}
+
+// heardFromLeader restarts the timeout when the follower receives a message from the leader, like raft does.
+func (t *electionTimer) heardFromLeader() {
+	if t != nil {
+		t.elapsed = 0
+	}
+}
+
+// tick returns true if the custom timeout of the peer expires and it should campaign. Raft doesn't check
+// whether the peer is a voter when it's asked to campaign, so it's checked here.
+func (t *electionTimer) tick(r *raft.Raft, peerID uint64) bool {
+	if t == nil || !t.custom || r.State == raft.StateLeader {
+		return false
+	}
+	t.elapsed++
+	if t.elapsed < int(atomic.LoadInt64(&t.timeout)) {
+		return false
+	}
+	t.reset()
+	_, voter := r.Prs[peerID]
+	return voter
+}
+
+// startGrace defers the election of the peer by the grace ticks. The peer applying a snapshot doesn't tick,
+// and a peer created by a split may time out before the peer of the parent leader wins the election, they
+// would campaign right away and disrupt the leader.
+func (t *electionTimer) startGrace() {
+	if t != nil {
+		t.grace = t.graceTicks
+	}
+}
+
+// deferTick returns true if the tick of the follower is skipped in the grace, the grace ends once the peer
+// becomes the leader.
+func (t *electionTimer) deferTick(r *raft.Raft) bool {
+	if t == nil || t.grace == 0 {
+		return false
+	}
+	if r.State == raft.StateLeader {
+		t.grace = 0
+		return false
+	}
+	t.grace--
+	atomic.AddUint64(&t.deferred, 1)
+	return true
+}
+
+func (t *electionTimer) metrics() ElectionMetrics {
+	return ElectionMetrics{
+		Campaigns:     atomic.LoadUint64(&t.campaigns),
+		Elected:       atomic.LoadUint64(&t.elected),
+		Timeout:       atomic.LoadInt64(&t.timeout),
+		DeferredTicks: atomic.LoadUint64(&t.deferred),
+	}
+}
+
+// ElectionMetrics returns the election counters of the region.
+func (r *Router) ElectionMetrics(regionID uint64) (ElectionMetrics, error) {
+	p := r.router.get(regionID)
+	if p == nil {
+		return ElectionMetrics{}, errPeerNotFound
+	}
+	return p.peer.peer.electionTimer.metrics(), nil
+}
@@ -16,6 +16,7 @@ package raftstore
 import (
 	"bytes"
 	"math"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -37,6 +38,9 @@ type regionSnapshot struct {
 	lockSnap    *lockstore.MemStore
 	term        uint64
 	index       uint64
+
+	// abort is the status of the generating task, the building stops once it's cancelling.
+	abort *JobStatus
 }
 
 func (rs *regionSnapshot) redoLocks(raft *badger.DB, redoIdx uint64) error {
@@ -71,6 +75,33 @@ type Engines struct {
 	kvPath   string
 	raft     *badger.DB
 	raftPath string
+	// lockReleased is notified when the applied commands delete locks from the lock store.
+	lockReleased lockNotifier
+}
+
+// lockNotifier wakes up the waiters for the lock store changes.
+type lockNotifier struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+// changed returns a channel closed on the next notify.
+func (n *lockNotifier) changed() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ch == nil {
+		n.ch = make(chan struct{})
+	}
+	return n.ch
+}
+
+func (n *lockNotifier) notify() {
+	n.mu.Lock()
+	if n.ch != nil {
+		close(n.ch)
+		n.ch = nil
+	}
+	n.mu.Unlock()
 }
 
 // NewEngines creates a new Engines.
@@ -161,15 +192,20 @@ func (en *Engines) SyncRaftWAL() error {
 
 // WriteBatch writes a batch of entries.
 type WriteBatch struct {
-	entries       []*badger.Entry
-	lockEntries   []*badger.Entry
-	size          int
-	safePoint     int
-	safePointLock int
-	safePointSize int
-	safePointUndo int
+	entries     []*badger.Entry
+	lockEntries []*badger.Entry
+	size        int
+	savePoints  []writeBatchSavePoint
+}
+
+type writeBatchSavePoint struct {
+	entries     int
+	lockEntries int
+	size        int
 }
 
+var errNoSavePoint = errors.New("no save point")
+
 // Len returns the length of the WriteBatch.
 func (wb *WriteBatch) Len() int {
 	return len(wb.entries) + len(wb.lockEntries)
@@ -184,6 +220,16 @@ func (wb *WriteBatch) Set(key y.Key, val []byte) {
 	wb.size += key.Len() + len(val)
 }
 
+// entriesSize returns the encoded size of the entries added since the entry at from, the tombstones are
+// counted by their keys. The lockEntries are not counted as they are not stored in the region data.
+func (wb *WriteBatch) entriesSize(from int) uint64 {
+	var size int
+	for _, e := range wb.entries[from:] {
+		size += e.Key.Len() + len(e.Value) + len(e.UserMeta)
+	}
+	return uint64(size)
+}
+
 // SetLock adds the key-value pair to the lockEntries.
 func (wb *WriteBatch) SetLock(key, val []byte) {
 	wb.lockEntries = append(wb.lockEntries, &badger.Entry{
@@ -201,6 +247,16 @@ func (wb *WriteBatch) DeleteLock(key []byte) {
 	})
 }
 
+// releasesLocks returns true if the WriteBatch deletes locks.
+func (wb *WriteBatch) releasesLocks() bool {
+	for _, entry := range wb.lockEntries {
+		if entry.UserMeta[0] == mvcc.LockUserMetaDeleteByte {
+			return true
+		}
+	}
+	return false
+}
+
 // Rollback rolls back the key.
 func (wb *WriteBatch) Rollback(key y.Key) {
 	rollbackKey := mvcc.EncodeExtraTxnStatusKey(key.UserKey, key.Version)
@@ -250,18 +306,41 @@ func (wb *WriteBatch) SetMsg(key y.Key, msg proto.Message) error {
 	return nil
 }
 
-// SetSafePoint sets a safe point.
-func (wb *WriteBatch) SetSafePoint() {
-	wb.safePoint = len(wb.entries)
-	wb.safePointLock = len(wb.lockEntries)
-	wb.safePointSize = wb.size
+// SetSavePoint pushes a save point, the entries added after it can be reverted by RollbackToSavePoint.
+func (wb *WriteBatch) SetSavePoint() {
+	wb.savePoints = append(wb.savePoints, writeBatchSavePoint{
+		entries:     len(wb.entries),
+		lockEntries: len(wb.lockEntries),
+		size:        wb.size,
+	})
 }
 
-// RollbackToSafePoint rolls back to the safe point.
-func (wb *WriteBatch) RollbackToSafePoint() {
-	wb.entries = wb.entries[:wb.safePoint]
-	wb.lockEntries = wb.lockEntries[:wb.safePointLock]
-	wb.size = wb.safePointSize
+// RollbackToSavePoint removes the entries added after the most recent save point and pops it.
+func (wb *WriteBatch) RollbackToSavePoint() error {
+	if len(wb.savePoints) == 0 {
+		return errNoSavePoint
+	}
+	sp := wb.savePoints[len(wb.savePoints)-1]
+	wb.savePoints = wb.savePoints[:len(wb.savePoints)-1]
+	for i := sp.entries; i < len(wb.entries); i++ {
+		wb.entries[i] = nil
+	}
+	wb.entries = wb.entries[:sp.entries]
+	for i := sp.lockEntries; i < len(wb.lockEntries); i++ {
+		wb.lockEntries[i] = nil
+	}
+	wb.lockEntries = wb.lockEntries[:sp.lockEntries]
+	wb.size = sp.size
+	return nil
+}
+
+// PopSavePoint pops the most recent save point and keeps the entries added after it.
+func (wb *WriteBatch) PopSavePoint() error {
+	if len(wb.savePoints) == 0 {
+		return errNoSavePoint
+	}
+	wb.savePoints = wb.savePoints[:len(wb.savePoints)-1]
+	return nil
 }
 
 // WriteToKV flushes WriteBatch to DB by two steps:
@@ -360,10 +439,7 @@ func (wb *WriteBatch) Reset() {
 	}
 	wb.lockEntries = wb.lockEntries[:0]
 	wb.size = 0
-	wb.safePoint = 0
-	wb.safePointLock = 0
-	wb.safePointSize = 0
-	wb.safePointUndo = 0
+	wb.savePoints = wb.savePoints[:0]
 }
 
 // Todo, the following code redundant to unistore/tikv/worker.go, just as a place holder now.
@@ -0,0 +1,184 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pingcap/badger"
+	"github.com/pingcap/badger/table/sstable"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// LevelStats are the statistics of a level of the LSM tree.
+type LevelStats struct {
+	Level int   `json:"level"`
+	Files int   `json:"files"`
+	Size  int64 `json:"size"`
+	// TargetSize is the size the level is compacted under, level 0 is compacted by the number of files.
+	TargetSize int64 `json:"target_size"`
+}
+
+// DBStats are the statistics of an engine.
+type DBStats struct {
+	LSMSize  int64        `json:"lsm_size"`
+	VLogSize int64        `json:"vlog_size"`
+	Levels   []LevelStats `json:"levels"`
+	// PendingCompactionBytes estimates the bytes to compact to bring every level under its target.
+	PendingCompactionBytes int64 `json:"pending_compaction_bytes"`
+	TableFiles             int   `json:"table_files"`
+	VLogFiles              int   `json:"vlog_files"`
+	// OpenFiles is the number of the files in the engine directory opened by the process, -1 if unknown.
+	OpenFiles int `json:"open_files"`
+	// BlockCacheHitRatio is -1 if the engine doesn't collect the block cache metrics.
+	BlockCacheHitRatio float64 `json:"block_cache_hit_ratio"`
+}
+
+// EngineStats are the statistics of the engines of a store. The default and the write CFs are in the kv
+// engine, the lock CF is kept in memory.
+type EngineStats struct {
+	KV         DBStats `json:"kv"`
+	Raft       DBStats `json:"raft"`
+	LockCFKeys int     `json:"lock_cf_keys"`
+}
+
+// levelOptions are the options the target sizes of the levels are computed from.
+type levelOptions struct {
+	numL0Tables int
+	l1Size      int64
+	multiplier  int
+}
+
+func newLevelOptions(numL0Tables int, l1Size int64) levelOptions {
+	opt := levelOptions{
+		numL0Tables: badger.DefaultOptions.NumLevelZeroTables,
+		l1Size:      badger.DefaultOptions.LevelOneSize,
+		multiplier:  badger.DefaultOptions.TableBuilderOptions.LevelSizeMultiplier,
+	}
+	if numL0Tables > 0 {
+		opt.numL0Tables = numL0Tables
+	}
+	if l1Size > 0 {
+		opt.l1Size = l1Size
+	}
+	return opt
+}
+
+func collectDBStats(db *badger.DB, dir string, opt levelOptions) DBStats {
+	stats := DBStats{OpenFiles: -1, BlockCacheHitRatio: -1}
+	stats.LSMSize, stats.VLogSize = db.Size()
+	for _, t := range db.Tables() {
+		for len(stats.Levels) <= t.Level {
+			stats.Levels = append(stats.Levels, LevelStats{Level: len(stats.Levels)})
+		}
+		l := &stats.Levels[t.Level]
+		l.Files++
+		if fi, err := os.Stat(sstable.NewFilename(t.ID, dir)); err == nil {
+			l.Size += fi.Size()
+		}
+		stats.TableFiles++
+	}
+	stats.estimatePendingCompaction(opt)
+	if infos, err := ioutil.ReadDir(dir); err == nil {
+		for _, info := range infos {
+			if strings.HasSuffix(info.Name(), ".vlog") {
+				stats.VLogFiles++
+			}
+		}
+	}
+	if m := db.CacheMetrics(); m != nil {
+		stats.BlockCacheHitRatio = m.Ratio()
+	}
+	stats.OpenFiles = countOpenFiles(dir)
+	return stats
+}
+
+// estimatePendingCompaction sets the target sizes of the levels and sums the bytes over them, level 0 is
+// compacted as a whole once it has too many files.
+func (s *DBStats) estimatePendingCompaction(opt levelOptions) {
+	s.PendingCompactionBytes = 0
+	target := opt.l1Size
+	for i := range s.Levels {
+		l := &s.Levels[i]
+		if i == 0 {
+			if l.Files > opt.numL0Tables {
+				s.PendingCompactionBytes += l.Size
+			}
+			continue
+		}
+		l.TargetSize = target
+		if l.Size > target {
+			s.PendingCompactionBytes += l.Size - target
+		}
+		target *= int64(opt.multiplier)
+	}
+}
+
+// countOpenFiles counts the file descriptors of the process opened in the directory, -1 if they can't be read.
+func countOpenFiles(dir string) int {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return -1
+	}
+	prefix := dir + string(filepath.Separator)
+	var cnt int
+	for _, fd := range fds {
+		target, err := os.Readlink(filepath.Join("/proc/self/fd", fd.Name()))
+		if err == nil && strings.HasPrefix(target, prefix) {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// Stats returns the statistics of the engines, the target sizes of the levels are computed from the numL0Tables
+// and the l1Size options, the badger defaults are used for the zero ones.
+func (en *Engines) Stats(numL0Tables int, l1Size int64) EngineStats {
+	opt := newLevelOptions(numL0Tables, l1Size)
+	return EngineStats{
+		KV:         collectDBStats(en.kv.DB, en.kvPath, opt),
+		Raft:       collectDBStats(en.raft, en.raftPath, opt),
+		LockCFKeys: en.kv.LockStore.Len(),
+	}
+}
+
+// EngineStats returns the statistics of the engines of the store.
+func (ris *RaftInnerServer) EngineStats() EngineStats {
+	var numL0Tables int
+	var l1Size int64
+	if ris.globalConfig != nil {
+		numL0Tables, l1Size = ris.globalConfig.Engine.NumL0Tables, ris.globalConfig.Engine.L1Size
+	}
+	return ris.engines.Stats(numL0Tables, l1Size)
+}
+
+// EngineStatsHandler serves the engine statistics as JSON for the status server.
+func (ris *RaftInnerServer) EngineStatsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(ris.EngineStats()); err != nil {
+			log.Warn("failed to encode engine stats", zap.Error(err))
+		}
+	})
+}
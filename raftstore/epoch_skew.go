@@ -0,0 +1,81 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// EpochSkew is the amount the region epoch of a peer is bumped by, so the epoch of the peer is ahead of
+// the other replicas of the region.
+type EpochSkew struct {
+	ConfVer uint64
+	Version uint64
+}
+
+// skewEpoch bumps the epoch of the region of the peer. Only the peer sees the skewed epoch, the applier and
+// the persisted region state keep the real one, so the skew is gone after the peer is restarted or the
+// region is changed by an admin command or a snapshot.
+func (p *Peer) skewEpoch(skew EpochSkew) error {
+	if skew.ConfVer == 0 && skew.Version == 0 {
+		return errors.New("empty epoch skew")
+	}
+	region := new(metapb.Region)
+	if err := CloneMsg(p.Region(), region); err != nil {
+		return err
+	}
+	region.RegionEpoch.ConfVer += skew.ConfVer
+	region.RegionEpoch.Version += skew.Version
+	p.SetRegion(region)
+	return nil
+}
+
+func (d *peerMsgHandler) onEpochSkew(skew EpochSkew, cb *Callback) {
+	if !d.ctx.cfg.EnableEpochSkew {
+		cb.Done(ErrResp(errors.New("epoch skew is not enabled")))
+		return
+	}
+	if err := d.peer.skewEpoch(skew); err != nil {
+		cb.Done(ErrResp(err))
+		return
+	}
+	epoch := d.region().GetRegionEpoch()
+	log.Info("region epoch is skewed", zap.String("tag", d.tag()), zap.Uint64("conf ver", epoch.ConfVer),
+		zap.Uint64("version", epoch.Version))
+	// Let PD see the skewed epoch right away.
+	if d.peer.IsLeader() {
+		d.peer.HeartbeatPd(d.ctx.pdTaskSender)
+	}
+	cb.Done(&raft_cmdpb.RaftCmdResponse{Header: &raft_cmdpb.RaftResponseHeader{}})
+}
+
+// SkewRegionEpoch bumps the region epoch of the peer on this store, the other replicas keep their epochs. It
+// exercises the epoch mismatch of the requests, the validation of the stale peers by PD and the reconciliation
+// by snapshots deterministically. It requires Config.EnableEpochSkew.
+func (r *Router) SkewRegionEpoch(regionID uint64, skew EpochSkew) error {
+	cb := NewCallback()
+	err := r.router.send(regionID, Msg{Type: MsgTypeEpochSkew, Data: &MsgEpochSkew{Skew: skew, Callback: cb}})
+	if err != nil {
+		return err
+	}
+	cb.wg.Wait()
+	if pbErr := cb.resp.GetHeader().GetError(); pbErr != nil {
+		return errors.New(pbErr.Message)
+	}
+	return nil
+}
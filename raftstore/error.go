@@ -15,10 +15,12 @@ package raftstore
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/pingcap/errors"
 	"github.com/pingcap/kvproto/pkg/errorpb"
 	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
 )
 
 // ErrNotLeader is returned when this region is not Leader.
@@ -70,6 +72,15 @@ func (e *ErrServerIsBusy) Error() string {
 	return fmt.Sprintf("server is busy, reason %v, backoff ms %v", e.Reason, e.BackoffMs)
 }
 
+// ErrMaxTimestampNotSynced is returned when the leader hasn't synced the max timestamp to serve reads.
+type ErrMaxTimestampNotSynced struct {
+	RegionID uint64
+}
+
+func (e *ErrMaxTimestampNotSynced) Error() string {
+	return fmt.Sprintf("max timestamp of region %d is not synced", e.RegionID)
+}
+
 // ErrStaleCommand is returned when the command is stale.
 type ErrStaleCommand struct{}
 
@@ -97,6 +108,125 @@ func (e *ErrRaftEntryTooLarge) Error() string {
 	return fmt.Sprintf("raft entry too large, region_id: %v, len: %v", e.RegionID, e.EntrySize)
 }
 
+// ErrProposalDropped is returned when a proposal or a read is dropped by the raft group and
+// Config.FailFastDroppedProposals is set.
+type ErrProposalDropped struct {
+	RegionID uint64
+	Reason   ProposalDropReason
+	Read     bool
+	// Leader is the peer the leadership is transferred to, it may be nil.
+	Leader *metapb.Peer
+}
+
+func (e *ErrProposalDropped) Error() string {
+	kind := "proposal"
+	if e.Read {
+		kind = "read"
+	}
+	return fmt.Sprintf("%s of region %v dropped: %v", kind, e.RegionID, e.Reason)
+}
+
+// ErrQueueFull is returned when the mailbox of the peer is full.
+type ErrQueueFull struct {
+	RegionID uint64
+	Pending  int64
+}
+
+func (e *ErrQueueFull) Error() string {
+	return fmt.Sprintf("mailbox of region %v is full, pending commands %v", e.RegionID, e.Pending)
+}
+
+// ErrQuotaExceeded is returned when a conf change exceeds the quota of the store of the new peer.
+type ErrQuotaExceeded struct {
+	RegionID uint64
+	StoreID  uint64
+	// Quota is the name of the exceeded quota of Config.
+	Quota string
+	Limit int
+}
+
+func (e *ErrQuotaExceeded) Error() string {
+	return fmt.Sprintf("conf change of region %v exceeds the %v quota %v of store %v", e.RegionID, e.Quota, e.Limit, e.StoreID)
+}
+
+// ErrPlacementViolation is returned when a new replica breaks the isolation of the location labels.
+type ErrPlacementViolation struct {
+	RegionID uint64
+	StoreID  uint64
+	Location string
+}
+
+func (e *ErrPlacementViolation) Error() string {
+	return fmt.Sprintf("placement violation, region %v already has a replica in location %v of store %v", e.RegionID, e.Location, e.StoreID)
+}
+
+// ErrAdminVetoed is returned when an AdminObserver vetoes the admin command.
+type ErrAdminVetoed struct {
+	RegionID uint64
+	CmdType  raft_cmdpb.AdminCmdType
+	Reason   string
+}
+
+func (e *ErrAdminVetoed) Error() string {
+	return fmt.Sprintf("admin command %v of region %v is vetoed, reason %v", e.CmdType, e.RegionID, e.Reason)
+}
+
+// ErrAdminFaultDropped is returned when an AdminFaultDrop rule drops the admin command.
+type ErrAdminFaultDropped struct {
+	RegionID uint64
+	CmdType  raft_cmdpb.AdminCmdType
+}
+
+func (e *ErrAdminFaultDropped) Error() string {
+	return fmt.Sprintf("admin command %v of region %v is dropped by fault injection", e.CmdType, e.RegionID)
+}
+
+// ErrSnapshotStorm is returned when a region generates more snapshots than Config.SnapGenLimit in the window.
+type ErrSnapshotStorm struct {
+	RegionID uint64
+	Limit    int
+	Window   time.Duration
+	// RetryAfter is the time until the oldest snapshot in the window expires.
+	RetryAfter time.Duration
+}
+
+func (e *ErrSnapshotStorm) Error() string {
+	return fmt.Sprintf("region %v generated %v snapshots in %v, retry after %v", e.RegionID, e.Limit, e.Window, e.RetryAfter)
+}
+
+// ErrSnapWaitTimeout is returned when a command received while applying a snapshot waits longer than
+// Config.SnapWaitTimeout.
+type ErrSnapWaitTimeout struct {
+	RegionID uint64
+	Waited   time.Duration
+}
+
+func (e *ErrSnapWaitTimeout) Error() string {
+	return fmt.Sprintf("command of region %v waited %v for the snapshot to be applied", e.RegionID, e.Waited)
+}
+
+// ErrDataIsNotReady is returned by a bounded staleness read when the safe ts of the region is too stale,
+// SafeTS is the freshest ts the replica can serve.
+type ErrDataIsNotReady struct {
+	RegionID uint64
+	SafeTS   uint64
+}
+
+func (e *ErrDataIsNotReady) Error() string {
+	return fmt.Sprintf("data of region %d is not ready, safe ts %d", e.RegionID, e.SafeTS)
+}
+
+// ErrInvalidConfig is returned by Config.Validate when a field is invalid or inconsistent with other fields.
+type ErrInvalidConfig struct {
+	Field  string
+	Value  interface{}
+	Reason string
+}
+
+func (e *ErrInvalidConfig) Error() string {
+	return fmt.Sprintf("invalid config %v = %v, %v", e.Field, e.Value, e.Reason)
+}
+
 // ErrToPbError converts error to *errorpb.Error.
 func ErrToPbError(e error) *errorpb.Error {
 	ret := new(errorpb.Error)
@@ -114,10 +244,34 @@ func ErrToPbError(e error) *errorpb.Error {
 		ret.ServerIsBusy = &errorpb.ServerIsBusy{Reason: err.Reason, BackoffMs: err.BackoffMs}
 	case *ErrStaleCommand:
 		ret.StaleCommand = &errorpb.StaleCommand{}
+	case *ErrMaxTimestampNotSynced:
+		ret.MaxTimestampNotSynced = &errorpb.MaxTimestampNotSynced{}
 	case *ErrStoreNotMatch:
 		ret.StoreNotMatch = &errorpb.StoreNotMatch{RequestStoreId: err.RequestStoreID, ActualStoreId: err.ActualStoreID}
 	case *ErrRaftEntryTooLarge:
 		ret.RaftEntryTooLarge = &errorpb.RaftEntryTooLarge{RegionId: err.RegionID, EntrySize: err.EntrySize}
+	case *ErrProposalDropped:
+		ret.Message = err.Error()
+		switch err.Reason {
+		case DropReasonTransferLeader, DropReasonNoLeader:
+			ret.NotLeader = &errorpb.NotLeader{RegionId: err.RegionID, Leader: err.Leader}
+		default:
+			ret.ServerIsBusy = &errorpb.ServerIsBusy{Reason: err.Error()}
+		}
+	case *ErrQueueFull:
+		ret.ServerIsBusy = &errorpb.ServerIsBusy{Reason: err.Error()}
+	case *ErrQuotaExceeded:
+		// The store stays full until its peers are removed, retrying the conf change doesn't help.
+		ret.Message = err.Error()
+	case *ErrSnapWaitTimeout:
+		ret.ServerIsBusy = &errorpb.ServerIsBusy{Reason: err.Error()}
+	case *ErrAdminVetoed:
+		// The veto is final, so the error carries no retryable region error.
+		ret.Message = err.Error()
+	case *ErrAdminFaultDropped:
+		// A dropped proposal is retried like a stale command.
+		ret.Message = err.Error()
+		ret.StaleCommand = &errorpb.StaleCommand{}
 	default:
 		ret.Message = e.Error()
 	}
@@ -16,7 +16,9 @@ package raftstore
 import (
 	"testing"
 
+	"github.com/pingcap/errors"
 	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -71,4 +73,11 @@ func TestRaftstoreErrToPbError(t *testing.T) {
 	require.NotNil(t, pbErr.RaftEntryTooLarge)
 	assert.Equal(t, pbErr.RaftEntryTooLarge.RegionId, regionID)
 	assert.Equal(t, pbErr.RaftEntryTooLarge.EntrySize, entrySize)
+
+	vetoed := &ErrAdminVetoed{RegionID: regionID, CmdType: raft_cmdpb.AdminCmdType_Split, Reason: "split is forbidden"}
+	pbErr = ErrToPbError(errors.Annotate(vetoed, "apply"))
+	assert.Equal(t, vetoed.Error(), pbErr.Message)
+	assert.Nil(t, pbErr.ServerIsBusy)
+	assert.Nil(t, pbErr.StaleCommand)
+	assert.Nil(t, pbErr.EpochNotMatch)
 }
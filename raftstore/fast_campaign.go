@@ -0,0 +1,87 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// votersOnStore returns true if the region has voters and all of them are on the store, the peer of the store
+// wins an election with its own vote then.
+func votersOnStore(region *metapb.Region, storeID uint64) bool {
+	var voters int
+	for _, peer := range region.GetPeers() {
+		if peer.GetRole() == metapb.PeerRole_Learner {
+			continue
+		}
+		if peer.GetStoreId() != storeID {
+			return false
+		}
+		voters++
+	}
+	return voters > 0
+}
+
+// campaignAlone elects the peer without the pre-vote and the election timeout, like the target of a leader
+// transfer. The peer must be the only voter of the region, so it is the leader when it returns.
+func (p *Peer) campaignAlone() error {
+	if err := p.RaftGroup.Step(eraftpb.Message{MsgType: eraftpb.MessageType_MsgTimeoutNow, From: p.PeerID()}); err != nil {
+		return err
+	}
+	if !p.IsLeader() {
+		return errors.Errorf("%s is not elected, the role is %v", p.Tag, p.GetRole())
+	}
+	return nil
+}
+
+func (d *peerMsgHandler) onCampaign(cb *Callback) {
+	if !d.ctx.cfg.FastCampaign {
+		cb.Done(ErrResp(errors.New("fast campaign is not enabled")))
+		return
+	}
+	if !d.peer.IsLeader() {
+		if !votersOnStore(d.region(), d.storeID()) {
+			cb.Done(ErrResp(errors.Errorf("%s has voters on the other stores", d.tag())))
+			return
+		}
+		if err := d.peer.campaignAlone(); err != nil {
+			cb.Done(ErrResp(err))
+			return
+		}
+		log.Info("peer campaigns alone", zap.String("tag", d.tag()), zap.Uint64("term", d.peer.Term()))
+		d.hasReady = true
+	}
+	cb.Done(&raft_cmdpb.RaftCmdResponse{Header: &raft_cmdpb.RaftResponseHeader{}})
+}
+
+// Campaign elects the peer of the region on this store right away if all the voters of the region are on the
+// store, it returns after the peer becomes the leader. The leader still has to apply the entry of its term
+// before serving the reads. It requires Config.FastCampaign, only for tests.
+func (r *Router) Campaign(regionID uint64) error {
+	cb := NewCallback()
+	err := r.router.send(regionID, Msg{Type: MsgTypeCampaign, Data: &MsgCampaign{Callback: cb}})
+	if err != nil {
+		return err
+	}
+	cb.wg.Wait()
+	if pbErr := cb.resp.GetHeader().GetError(); pbErr != nil {
+		return errors.New(pbErr.Message)
+	}
+	return nil
+}
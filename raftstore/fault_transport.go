@@ -0,0 +1,246 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"sync"
+	"time"
+
+	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// FaultAction is the fault injected into a raft message.
+type FaultAction int
+
+// The fault actions.
+const (
+	// FaultPass sends the message normally.
+	FaultPass FaultAction = iota
+	// FaultDrop drops the message.
+	FaultDrop
+	// FaultDelay sends the message after Fault.Delay.
+	FaultDelay
+	// FaultDuplicate sends the message twice.
+	FaultDuplicate
+	// FaultReorder holds the message until the next message between the same stores is sent.
+	FaultReorder
+)
+
+// Fault is the fault injected into a raft message by a FilterFunc.
+type Fault struct {
+	Action FaultAction
+	// Delay is the delay of FaultDelay.
+	Delay time.Duration
+}
+
+// FilterFunc returns the fault injected into the raft message.
+type FilterFunc func(msg *rspb.RaftMessage) Fault
+
+// DropFilter drops all the messages.
+func DropFilter(*rspb.RaftMessage) Fault {
+	return Fault{Action: FaultDrop}
+}
+
+// FaultStats are the numbers of the messages with the faults injected.
+type FaultStats struct {
+	Dropped    uint64
+	Delayed    uint64
+	Duplicated uint64
+	Reordered  uint64
+}
+
+// FaultTransport injects the faults into the raft messages sent by the inner Transport. The filters of the
+// store pairs are checked before the filters of the regions, the first fault other than FaultPass is injected.
+// The filters can be changed at runtime.
+type FaultTransport struct {
+	inner Transport
+	wg    sync.WaitGroup
+
+	mu            sync.Mutex
+	closed        bool
+	regionFilters map[uint64]FilterFunc
+	storeFilters  map[storePair]FilterFunc
+	// held are the messages held by FaultReorder.
+	held  map[storePair]*rspb.RaftMessage
+	stats FaultStats
+
+	// links are the numbers of the messages sent and dropped of the store pairs.
+	links map[storePair]linkStats
+}
+
+type linkStats struct {
+	sent    uint64
+	dropped uint64
+}
+
+// NewFaultTransport creates a FaultTransport sending the messages with the inner Transport.
+func NewFaultTransport(inner Transport) *FaultTransport {
+	return &FaultTransport{
+		inner:         inner,
+		regionFilters: make(map[uint64]FilterFunc),
+		storeFilters:  make(map[storePair]FilterFunc),
+		held:          make(map[storePair]*rspb.RaftMessage),
+		links:         make(map[storePair]linkStats),
+	}
+}
+
+// SetFilter sets the filter of the messages of the region, region 0 matches all the regions. A nil filter
+// removes the filter.
+func (t *FaultTransport) SetFilter(regionID uint64, f FilterFunc) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if f == nil {
+		delete(t.regionFilters, regionID)
+		return
+	}
+	t.regionFilters[regionID] = f
+}
+
+// SetStoreFilter sets the filter of the messages from a store to another. A nil filter removes the filter.
+func (t *FaultTransport) SetStoreFilter(from, to uint64, f FilterFunc) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pair := storePair{from: from, to: to}
+	if f == nil {
+		delete(t.storeFilters, pair)
+		return
+	}
+	t.storeFilters[pair] = f
+}
+
+// Partition drops the messages between the stores of the two groups in both directions.
+func (t *FaultTransport) Partition(group1, group2 []uint64) {
+	for _, s1 := range group1 {
+		for _, s2 := range group2 {
+			t.SetStoreFilter(s1, s2, DropFilter)
+			t.SetStoreFilter(s2, s1, DropFilter)
+		}
+	}
+}
+
+// ClearFilters removes all the filters and sends the messages held by FaultReorder.
+func (t *FaultTransport) ClearFilters() {
+	t.mu.Lock()
+	t.regionFilters = make(map[uint64]FilterFunc)
+	t.storeFilters = make(map[storePair]FilterFunc)
+	held := t.held
+	t.held = make(map[storePair]*rspb.RaftMessage)
+	t.mu.Unlock()
+	for _, msg := range held {
+		t.send(msg)
+	}
+}
+
+// Stats returns the numbers of the messages with the faults injected.
+func (t *FaultTransport) Stats() FaultStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stats
+}
+
+// LinkDrops implements the LinkDropCounter LinkDrops method, the messages dropped by the inner Transport are
+// counted too.
+func (t *FaultTransport) LinkDrops(from, to uint64) (sent, dropped uint64) {
+	t.mu.Lock()
+	link := t.links[storePair{from: from, to: to}]
+	t.mu.Unlock()
+	_, innerDropped := linkDrops(t.inner, from, to)
+	return link.sent, link.dropped + innerDropped
+}
+
+func (t *FaultTransport) fault(pair storePair, msg *rspb.RaftMessage) Fault {
+	filters := [3]FilterFunc{t.storeFilters[pair], t.regionFilters[msg.GetRegionId()], t.regionFilters[0]}
+	for _, f := range filters {
+		if f == nil {
+			continue
+		}
+		if fault := f(msg); fault.Action != FaultPass {
+			return fault
+		}
+	}
+	return Fault{}
+}
+
+// Send implements the Transport Send method.
+func (t *FaultTransport) Send(msg *rspb.RaftMessage) error {
+	pair := storePair{from: msg.GetFromPeer().GetStoreId(), to: msg.GetToPeer().GetStoreId()}
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	fault := t.fault(pair, msg)
+	held := t.held[pair]
+	delete(t.held, pair)
+	link := t.links[pair]
+	link.sent++
+	if fault.Action == FaultDrop {
+		link.dropped++
+	}
+	t.links[pair] = link
+	switch fault.Action {
+	case FaultDrop:
+		t.stats.Dropped++
+	case FaultDelay:
+		t.stats.Delayed++
+		t.wg.Add(1)
+	case FaultDuplicate:
+		t.stats.Duplicated++
+	case FaultReorder:
+		t.stats.Reordered++
+		if held == nil {
+			// Wait for the next message.
+			t.held[pair] = msg
+			t.mu.Unlock()
+			return nil
+		}
+	}
+	t.mu.Unlock()
+
+	var err error
+	switch fault.Action {
+	case FaultPass, FaultReorder:
+		err = t.inner.Send(msg)
+	case FaultDelay:
+		time.AfterFunc(fault.Delay, func() {
+			defer t.wg.Done()
+			t.send(msg)
+		})
+	case FaultDuplicate:
+		if err = t.inner.Send(msg); err == nil {
+			err = t.inner.Send(msg)
+		}
+	}
+	if held != nil {
+		t.send(held)
+	}
+	return err
+}
+
+func (t *FaultTransport) send(msg *rspb.RaftMessage) {
+	if err := t.inner.Send(msg); err != nil {
+		log.Warn("failed to send faulty raft message", zap.Uint64("region id", msg.RegionId), zap.Error(err))
+	}
+}
+
+// Close drops the messages held and waits for the delayed messages.
+func (t *FaultTransport) Close() {
+	t.mu.Lock()
+	t.closed = true
+	t.held = make(map[storePair]*rspb.RaftMessage)
+	t.mu.Unlock()
+	t.wg.Wait()
+}
@@ -0,0 +1,285 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"time"
+
+	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/zhangjinpeng1987/raft"
+	"go.uber.org/zap"
+)
+
+// Raft limits the MsgAppend messages in flight and the size of a message by RaftMaxInflightMsgs and
+// RaftMaxSizePerMsg, the same for all the followers, so a slow or lossy link is flooded by the window fit
+// for a fast one. With Config.RaftAdaptiveFlowControl, the leader keeps a smaller window of every follower
+// below raft: it splits the MsgAppend messages by the max size of the follower and holds the ones over the
+// max inflight until the follower acks the earlier ones. The window is halved when the acks are slower than
+// RaftFlowTargetLatency or the messages are lost, and grows while the messages are held on a healthy link.
+
+const (
+	// flowDropRateThreshold is the ratio of the messages lost in a tick to shrink the window.
+	flowDropRateThreshold = 0.05
+	// flowLatencyWeight is the weight of a new sample in the moving average of the ack latency.
+	flowLatencyWeight = 0.25
+)
+
+// LinkDropCounter is implemented by the transports dropping the messages, the leaders take the drop rate of
+// the link to a follower into account with Config.RaftAdaptiveFlowControl.
+type LinkDropCounter interface {
+	// LinkDrops returns the numbers of the messages sent and dropped from a store to another.
+	LinkDrops(from, to uint64) (sent, dropped uint64)
+}
+
+func linkDrops(trans Transport, from, to uint64) (sent, dropped uint64) {
+	if c, ok := trans.(LinkDropCounter); ok {
+		return c.LinkDrops(from, to)
+	}
+	return 0, 0
+}
+
+type flowInflight struct {
+	lastIndex uint64
+	sendTime  time.Time
+}
+
+// followerFlow is the replication window of a follower.
+type followerFlow struct {
+	maxInflight int
+	maxSize     uint64
+	inflights   []flowInflight
+	// held are the MsgAppend messages over the window, in the order raft sent them.
+	held []eraftpb.Message
+	// ackLatency is the moving average of the time from sending a message to its ack.
+	ackLatency time.Duration
+	dropRate   float64
+	// sent and lost count the messages since the last tick, linkSent and linkDropped are the numbers
+	// reported by the transport at the last tick.
+	sent        uint64
+	lost        uint64
+	linkSent    uint64
+	linkDropped uint64
+}
+
+// flowController is the replication windows of the followers of a leader, it's owned by the raft worker.
+type flowController struct {
+	minInflight   int
+	maxInflight   int
+	minSize       uint64
+	maxSize       uint64
+	targetLatency time.Duration
+	// timeout is the time an unacked message is taken as lost.
+	timeout   time.Duration
+	followers map[uint64]*followerFlow
+}
+
+func newFlowController(cfg *Config) *flowController {
+	if !cfg.RaftAdaptiveFlowControl {
+		return nil
+	}
+	return &flowController{
+		minInflight:   cfg.RaftMinInflightMsgs,
+		maxInflight:   cfg.RaftMaxInflightMsgs,
+		minSize:       cfg.RaftMinSizePerMsg,
+		maxSize:       cfg.RaftMaxSizePerMsg,
+		targetLatency: cfg.RaftFlowTargetLatency,
+		timeout:       cfg.RaftBaseTickInterval * time.Duration(cfg.RaftElectionTimeoutTicks),
+		followers:     make(map[uint64]*followerFlow),
+	}
+}
+
+func (fc *flowController) follower(peerID uint64) *followerFlow {
+	f := fc.followers[peerID]
+	if f == nil {
+		f = &followerFlow{maxInflight: fc.maxInflight, maxSize: fc.maxSize}
+		fc.followers[peerID] = f
+	}
+	return f
+}
+
+// get returns the window of the follower, nil if there is none.
+func (fc *flowController) get(peerID uint64) *followerFlow {
+	if fc == nil {
+		return nil
+	}
+	return fc.followers[peerID]
+}
+
+// adjust halves the window if the link is slow or lossy, and grows it if the messages are held.
+func (fc *flowController) adjust(f *followerFlow) {
+	if f.dropRate > flowDropRateThreshold || f.ackLatency > fc.targetLatency {
+		if f.maxInflight /= 2; f.maxInflight < fc.minInflight {
+			f.maxInflight = fc.minInflight
+		}
+		if f.maxSize /= 2; f.maxSize < fc.minSize {
+			f.maxSize = fc.minSize
+		}
+		return
+	}
+	if len(f.held) == 0 {
+		return
+	}
+	if f.maxInflight++; f.maxInflight > fc.maxInflight {
+		f.maxInflight = fc.maxInflight
+	}
+	if f.maxSize *= 2; f.maxSize > fc.maxSize {
+		f.maxSize = fc.maxSize
+	}
+}
+
+// splitAppend splits the entries of a MsgAppend into the messages of at most maxSize bytes, a message has at
+// least one entry. Every message carries the index and the term of the entry before its first one, so the
+// follower appends them one by one.
+func splitAppend(msg eraftpb.Message, maxSize uint64) []eraftpb.Message {
+	if len(msg.Entries) <= 1 {
+		return []eraftpb.Message{msg}
+	}
+	var msgs []eraftpb.Message
+	ents := msg.Entries
+	prevIndex, prevTerm := msg.Index, msg.LogTerm
+	for len(ents) > 0 {
+		n, size := 1, uint64(ents[0].Size())
+		for n < len(ents) && size+uint64(ents[n].Size()) <= maxSize {
+			size += uint64(ents[n].Size())
+			n++
+		}
+		m := msg
+		m.Index, m.LogTerm, m.Entries = prevIndex, prevTerm, ents[:n]
+		msgs = append(msgs, m)
+		prevIndex, prevTerm = ents[n-1].Index, ents[n-1].Term
+		ents = ents[n:]
+	}
+	return msgs
+}
+
+// holdAppend splits the MsgAppend by the window of the follower and holds the messages until they are sent
+// by flushFlow, it returns false if the message is to be sent straight away. A message without entries takes
+// no room of the window, it's held only behind the held ones to keep the order of the log.
+func (p *Peer) holdAppend(msg eraftpb.Message) bool {
+	if len(msg.Entries) == 0 {
+		if f := p.flowControl.get(msg.To); f == nil || len(f.held) == 0 {
+			return false
+		}
+	}
+	f := p.flowControl.follower(msg.To)
+	f.held = append(f.held, splitAppend(msg, f.maxSize)...)
+	return true
+}
+
+// flushFlow sends the held messages within the windows of the followers. A message failed to send is lost,
+// the rest of the follower are sent on the next flush, and the first error is returned after the other
+// followers are flushed.
+func (p *Peer) flushFlow(trans Transport) error {
+	now := time.Now()
+	var firstErr error
+	for _, f := range p.flowControl.followers {
+		for len(f.held) > 0 {
+			msg := f.held[0]
+			if len(msg.Entries) > 0 && len(f.inflights) >= f.maxInflight {
+				break
+			}
+			f.held = f.held[1:]
+			err := p.sendRaftMessage(msg, trans)
+			if len(msg.Entries) > 0 {
+				f.sent++
+				if err == nil {
+					f.inflights = append(f.inflights, flowInflight{lastIndex: msg.Entries[len(msg.Entries)-1].Index, sendTime: now})
+				} else {
+					f.lost++
+				}
+			}
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				break
+			}
+		}
+	}
+	return firstErr
+}
+
+// onFlowAck frees the window of the follower by its MsgAppendResponse after raft steps it. The held messages
+// are dropped once raft stops replicating to the follower, raft sends the log again after probing it.
+func (p *Peer) onFlowAck(m *eraftpb.Message) {
+	f := p.flowControl.get(m.From)
+	if f == nil {
+		return
+	}
+	if pr := p.progress(m.From); pr == nil || pr.State != raft.ProgressStateReplicate {
+		f.held, f.inflights = nil, nil
+		return
+	}
+	if m.Reject {
+		return
+	}
+	n := 0
+	for n < len(f.inflights) && f.inflights[n].lastIndex <= m.Index {
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	sample := time.Since(f.inflights[n-1].sendTime)
+	if f.ackLatency == 0 {
+		f.ackLatency = sample
+	} else {
+		f.ackLatency += time.Duration(flowLatencyWeight * float64(sample-f.ackLatency))
+	}
+	f.inflights = f.inflights[n:]
+}
+
+// tickFlowControl takes the unacked messages out of the windows after the timeout, adjusts the windows by the
+// drop rates and the ack latencies, and sends the held messages. It runs on every raft base tick.
+func (p *Peer) tickFlowControl(trans Transport) {
+	fc := p.flowControl
+	if fc == nil {
+		return
+	}
+	if !p.IsLeader() {
+		if len(fc.followers) > 0 {
+			fc.followers = make(map[uint64]*followerFlow)
+		}
+		return
+	}
+	now := time.Now()
+	for id, f := range fc.followers {
+		peer := p.getPeerFromCache(id)
+		if peer == nil || p.progress(id) == nil {
+			delete(fc.followers, id)
+			continue
+		}
+		n := 0
+		for n < len(f.inflights) && now.Sub(f.inflights[n].sendTime) > fc.timeout {
+			n++
+		}
+		f.inflights = f.inflights[n:]
+		f.lost += uint64(n)
+		f.dropRate = 0
+		if f.sent > 0 {
+			f.dropRate = float64(f.lost) / float64(f.sent)
+		}
+		sent, dropped := linkDrops(trans, p.Meta.StoreId, peer.StoreId)
+		if sent > f.linkSent && dropped >= f.linkDropped {
+			if rate := float64(dropped-f.linkDropped) / float64(sent-f.linkSent); rate > f.dropRate {
+				f.dropRate = rate
+			}
+		}
+		f.sent, f.lost, f.linkSent, f.linkDropped = 0, 0, sent, dropped
+		fc.adjust(f)
+	}
+	if err := p.flushFlow(trans); err != nil {
+		p.debug("failed to send held messages", zap.Error(err))
+	}
+}
@@ -16,6 +16,7 @@ package raftstore
 import (
 	"bytes"
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/ngaut/unistore/raftstore/raftlog"
@@ -127,6 +128,7 @@ func (pf *peerFsm) stop() {
 
 func (pf *peerFsm) setPendingMergeState(state *rspb.MergeState) {
 	pf.peer.PendingMergeState = state
+	pf.peer.pendingMergeTime = time.Now()
 }
 
 func (pf *peerFsm) scheduleApplyingSnapshot() {
@@ -159,6 +161,10 @@ func (d *peerMsgHandler) HandleMsgs(msgs ...Msg) {
 			}
 		case MsgTypeRaftCmd:
 			raftCMD := msg.Data.(*MsgRaftCmd)
+			if raftCMD.pending != nil {
+				atomic.AddInt64(raftCMD.pending, -1)
+			}
+			d.wakeUp(true)
 			d.proposeRaftCommand(raftCMD.Request, raftCMD.Callback)
 		case MsgTypeTick:
 			d.onTick()
@@ -174,6 +180,7 @@ func (d *peerMsgHandler) HandleMsgs(msgs ...Msg) {
 		case MsgTypeSplitRegion:
 			split := msg.Data.(*MsgSplitRegion)
 			log.S().Infof("%s on split with %v", d.peer.Tag, split.SplitKeys)
+			d.wakeUp(true)
 			d.onPrepareSplitRegion(split.RegionEpoch, split.SplitKeys, split.Callback)
 		case MsgTypeComputeResult:
 			result := msg.Data.(*MsgComputeHashResult)
@@ -186,6 +193,7 @@ func (d *peerMsgHandler) HandleMsgs(msgs ...Msg) {
 			d.onCompactionDeclinedBytes(msg.Data.(uint64))
 		case MsgTypeHalfSplitRegion:
 			half := msg.Data.(*MsgHalfSplitRegion)
+			d.wakeUp(true)
 			d.onScheduleHalfSplitRegion(half.RegionEpoch)
 		case MsgTypeMergeResult:
 			result := msg.Data.(*MsgMergeResult)
@@ -195,8 +203,27 @@ func (d *peerMsgHandler) HandleMsgs(msgs ...Msg) {
 			d.onGCSnap(gcSnap.Snaps)
 		case MsgTypeClearRegionSize:
 			d.onClearRegionSize()
+		case MsgTypeRecalculateRegionSize:
+			d.onRecalculateRegionSize()
 		case MsgTypeStart:
 			d.startTicker()
+		case MsgTypeLeaseControl:
+			control := msg.Data.(*MsgLeaseControl)
+			d.onLeaseControl(control.Op, control.Callback)
+		case MsgTypeEpochSkew:
+			skew := msg.Data.(*MsgEpochSkew)
+			d.onEpochSkew(skew.Skew, skew.Callback)
+		case MsgTypeForceLeader:
+			force := msg.Data.(*MsgForceLeader)
+			d.onForceLeader(force.FailedStores, force.Campaign, force.Callback)
+		case MsgTypeUpdateLeaderLease:
+			d.peer.leaderLease.SetMaxLease(msg.Data.(time.Duration))
+		case MsgTypeReplicaState:
+			d.onReplicaState(msg.Data.(*MsgReplicaState))
+		case MsgTypeSafeTS:
+			d.onSafeTS(msg.Data.(*MsgSafeTS))
+		case MsgTypeCampaign:
+			d.onCampaign(msg.Data.(*MsgCampaign).Callback)
 		case MsgTypeNoop:
 		}
 	}
@@ -225,6 +252,12 @@ func (d *peerMsgHandler) onTick() {
 	if d.ticker.isOnTick(PeerTickPeerStaleState) {
 		d.onCheckPeerStaleStateTick()
 	}
+	if d.ticker.isOnTick(PeerTickCheckInvariants) {
+		d.onCheckInvariantsTick()
+	}
+	if d.ticker.isOnTick(PeerTickUpdateSafeTS) {
+		d.onUpdateSafeTSTick()
+	}
 }
 
 func (d *peerMsgHandler) startTicker() {
@@ -237,6 +270,8 @@ func (d *peerMsgHandler) startTicker() {
 	d.ticker.schedule(PeerTickSplitRegionCheck)
 	d.ticker.schedule(PeerTickPdHeartbeat)
 	d.ticker.schedule(PeerTickPeerStaleState)
+	d.ticker.schedule(PeerTickCheckInvariants)
+	d.ticker.schedule(PeerTickUpdateSafeTS)
 	d.onCheckMerge()
 }
 
@@ -317,17 +352,73 @@ func (d *peerMsgHandler) HandleRaftReadyAppend(proposals []*regionProposal) []*r
 	if p := d.peer.takeApplyProposals(); p != nil {
 		proposals = append(proposals, p)
 	}
+	applyingSnap := d.peer.IsApplyingSnapshot()
 	readyRes := d.peer.HandleRaftReadyAppend(d.ctx.trans, d.ctx.applyMsgs, d.ctx.kvWB, d.ctx.raftWB, d.ctx.peerEventObserver)
+	if applyingSnap && !d.peer.IsApplyingSnapshot() {
+		d.onSnapshotApplyFinished()
+	}
 	if readyRes != nil {
 		d.ctx.ReadyRes = append(d.ctx.ReadyRes, readyRes)
 		ss := readyRes.Ready.SoftState
 		if ss != nil && ss.RaftState == raft.StateLeader {
 			d.peer.HeartbeatPd(d.ctx.pdTaskSender)
+			d.scheduleMaxTSSync()
+		} else if ss != nil && ss.RaftState == raft.StateFollower {
+			d.cancelLeaderSnapshots()
 		}
 	}
 	return proposals
 }
 
+// onSnapshotApplyFinished serves the reads whose read index is covered by the applied snapshot and
+// proposes the commands received while applying the snapshot.
+func (d *peerMsgHandler) onSnapshotApplyFinished() {
+	store := d.peer.Store()
+	aborted := store.snapState.StateType == SnapStateApplyAborted
+	waiters := d.peer.snapWaiters
+	d.peer.snapWaiters = nil
+	log.S().Infof("%s snapshot apply finished, aborted %v, resume %d commands", d.tag(), aborted, len(waiters))
+	d.peer.handleReadyReads(d.ctx.engine.kv)
+	d.peer.electionTimer.startGrace()
+	for _, cmd := range waiters {
+		d.proposeRaftCommand(cmd.Request, cmd.Callback)
+	}
+	if !aborted {
+		d.ctx.snapMgr.recordSnapEvent(SnapEvent{
+			Type:  SnapEventActivated,
+			Key:   SnapKey{RegionID: d.regionID(), Term: store.truncatedTerm(), Index: store.truncatedIndex()},
+			Entry: SnapEntryApplying,
+		})
+	}
+}
+
+// expireSnapWaiters fails the commands waiting for the snapshot longer than Config.SnapWaitTimeout.
+func (d *peerMsgHandler) expireSnapWaiters(now time.Time) {
+	waiters := d.peer.snapWaiters[:0]
+	for _, cmd := range d.peer.snapWaiters {
+		if waited := now.Sub(cmd.SendTime); waited >= d.ctx.cfg.SnapWaitTimeout {
+			cmd.Callback.Done(ErrResp(&ErrSnapWaitTimeout{RegionID: d.regionID(), Waited: waited}))
+			continue
+		}
+		waiters = append(waiters, cmd)
+	}
+	for i := len(waiters); i < len(d.peer.snapWaiters); i++ {
+		d.peer.snapWaiters[i] = nil
+	}
+	d.peer.snapWaiters = waiters
+}
+
+// cancelLeaderSnapshots cancels the snapshots generated and sent by the peer when it was the leader.
+// The canceled sends report SnapshotFailure and their snapshot files are deleted.
+func (d *peerMsgHandler) cancelLeaderSnapshots() {
+	genCanceled := d.peer.Store().CancelGeneratingSnap()
+	sendCanceled := d.ctx.snapMgr.CancelSending(d.regionID())
+	if genCanceled || sendCanceled > 0 {
+		log.S().Infof("%s cancel snapshots after stepping down, generating %v, sending %d",
+			d.tag(), genCanceled, sendCanceled)
+	}
+}
+
 func (d *peerMsgHandler) PostRaftReadyPersistent(ready *raft.Ready, invokeCtx *InvokeContext) {
 	isMerging := d.peer.PendingMergeState != nil
 	res := d.peer.PostRaftReadyPersistent(d.ctx.trans, d.ctx.applyMsgs, ready, invokeCtx)
@@ -351,14 +442,37 @@ func (d *peerMsgHandler) onRaftBaseTick() {
 	// the pending conf change check because first index has been updated to
 	// a value that is larger than last index.
 	if d.peer.IsApplyingSnapshot() || d.peer.HasPendingSnapshot() {
+		d.expireSnapWaiters(time.Now())
 		// need to check if snapshot is applied.
 		d.hasReady = true
 		d.ticker.schedule(PeerTickRaft)
 		return
 	}
+	if d.peer.hibernate.isHibernated() {
+		d.ticker.schedule(PeerTickRaft)
+		return
+	}
 	// TODO: make Tick returns bool to indicate if there is ready.
-	d.peer.RaftGroup.Tick()
+	if !d.peer.electionTimer.deferTick(d.peer.RaftGroup.Raft) {
+		d.peer.RaftGroup.Tick()
+		if d.peer.electionTimer.tick(d.peer.RaftGroup.Raft, d.peer.PeerID()) {
+			if err := d.peer.RaftGroup.Campaign(); err != nil {
+				log.S().Warnf("%s failed to campaign: %v", d.tag(), err)
+			}
+		}
+	}
 	d.hasReady = d.peer.RaftGroup.HasReady()
+	d.peer.tickFlowControl(d.ctx.trans)
+	d.peer.updateReplicationLag()
+	d.tickForceLeader()
+	if d.peer.IsLeader() {
+		d.scheduleMaxTSSync()
+		d.peer.maybeRenewLeaseEarly(d.ctx.cfg)
+		d.maybeHibernate()
+	}
+	d.peer.checkSnapshotRelays()
+	d.maybeSendRelayedSnapshot()
+	d.reportSnapshotStorm()
 	d.ticker.schedule(PeerTickRaft)
 }
 
@@ -384,6 +498,9 @@ func (d *peerMsgHandler) onApplyResult(res *applyTaskRes) {
 		if d.peer.PostApply(d.ctx.engine.kv, res.applyState, res.appliedIndexTerm, res.merged, res.metrics) {
 			d.hasReady = true
 		}
+		d.ctx.localStats.engineTotalBytesWritten += res.metrics.writtenBytes
+		d.ctx.localStats.engineTotalKeysWritten += res.metrics.writtenKeys
+		d.maybeAdvanceSafeTS()
 	}
 }
 
@@ -414,6 +531,28 @@ func (d *peerMsgHandler) onRaftMsg(msg *rspb.RaftMessage) error {
 	if d.checkMessage(msg) {
 		return nil
 	}
+	if isHibernateMessage(msg) {
+		d.onHibernateMessage(msg)
+		return nil
+	}
+	if isSafeTSMessage(msg) {
+		d.onSafeTSMessage(msg)
+		return nil
+	}
+	if msg.GetMessage().GetMsgType() != eraftpb.MessageType_MsgHeartbeatResponse {
+		// A late heartbeat response doesn't wake up the hibernated leader.
+		d.wakeUp(false)
+	}
+	if isSnapshotRelay(msg) {
+		d.onSnapshotRelay(msg)
+		return nil
+	}
+	if msg.GetMessage().GetMsgType() == eraftpb.MessageType_MsgUnreachable {
+		// The target store is too busy to create the peer, back off until it responds.
+		log.S().Debugf("%s peer %d is busy, report unreachable", d.tag(), msg.GetFromPeer().GetId())
+		d.peer.RaftGroup.ReportUnreachable(msg.GetFromPeer().GetId())
+		return nil
+	}
 	key, err := d.checkSnapshot(msg)
 	if err != nil {
 		return err
@@ -430,6 +569,9 @@ func (d *peerMsgHandler) onRaftMsg(msg *rspb.RaftMessage) error {
 		d.ctx.snapMgr.DeleteSnapshot(*key, s, false)
 		return nil
 	}
+	if d.peer.checkpoint != nil && d.checkCheckpointContinuity(msg) {
+		return nil
+	}
 	d.peer.insertPeerCache(msg.GetFromPeer())
 	err = d.peer.Step(msg.GetMessage())
 	if err != nil {
@@ -704,6 +846,10 @@ func (d *peerMsgHandler) destroyPeer(mergeByTarget bool) {
 	}
 	delete(meta.mergeLocks, regionID)
 	isInitialized := d.peer.isInitialized()
+	if d.ctx.logWriter != nil {
+		// The ready states in flight must not be written after the peer is destroyed.
+		d.ctx.logWriter.wait()
+	}
 	if err := d.peer.Destroy(d.ctx.engine, mergeByTarget); err != nil {
 		// If not panic here, the peer will be recreated in the next restart,
 		// then it will be gc again. But if some overlap region is created
@@ -719,7 +865,13 @@ func (d *peerMsgHandler) destroyPeer(mergeByTarget bool) {
 	if _, ok := meta.regions[regionID]; !ok && !mergeByTarget {
 		panic(d.tag() + " meta corruption detected")
 	}
-	delete(meta.regions, regionID)
+	meta.removeRegion(regionID)
+	if isInitialized {
+		meta.addTombstone(&rspb.RegionLocalState{
+			State:  rspb.PeerState_Tombstone,
+			Region: d.region(),
+		}, time.Now())
+	}
 	d.ctx.peerEventObserver.OnPeerDestroy(d.peer.getEventContext())
 }
 
@@ -733,6 +885,8 @@ func (d *peerMsgHandler) onReadyChangePeer(cp changePeer) {
 	d.ctx.storeMetaLock.Lock()
 	d.ctx.storeMeta.setRegion(cp.region, d.peer)
 	d.ctx.storeMetaLock.Unlock()
+	// Prune the removed peers and refresh the roles of the others.
+	d.peer.refreshPeerCache(cp.region)
 	d.ctx.peerEventObserver.OnRegionConfChange(d.peer.getEventContext(), &metapb.RegionEpoch{
 		ConfVer: cp.region.RegionEpoch.ConfVer,
 		Version: cp.region.RegionEpoch.Version,
@@ -751,14 +905,11 @@ func (d *peerMsgHandler) onReadyChangePeer(cp changePeer) {
 			d.peer.PeersStartPendingTime[peerID] = now
 		}
 		d.peer.RecentAddedPeer.Update(peerID, now)
-		d.peer.insertPeerCache(cp.peer)
 	case eraftpb.ConfChangeType_RemoveNode:
-		// Remove this peer from cache.
 		delete(d.peer.PeerHeartbeats, peerID)
 		if d.peer.IsLeader() {
 			delete(d.peer.PeersStartPendingTime, peerID)
 		}
-		d.peer.removePeerCache(peerID)
 	}
 
 	// In pattern matching above, if the peer is the leader,
@@ -769,7 +920,7 @@ func (d *peerMsgHandler) onReadyChangePeer(cp changePeer) {
 	if d.peer.IsLeader() {
 		// Notify pd immediately.
 		log.S().Infof("%s notify pd with change peer region %s", d.tag(), d.region())
-		d.peer.HeartbeatPd(d.ctx.pdTaskSender)
+		d.peer.DelayHeartbeatPd(d.ctx.pdTaskSender)
 	}
 	myPeerID := d.peerID()
 
@@ -784,22 +935,15 @@ func (d *peerMsgHandler) onReadyChangePeer(cp changePeer) {
 }
 
 func (d *peerMsgHandler) onReadyCompactLog(firstIndex uint64, truncatedIndex uint64) {
-	totalCnt := d.peer.LastApplyingIdx - firstIndex
-	// the size of current CompactLog command can be ignored.
-	remainCnt := d.peer.LastApplyingIdx - truncatedIndex - 1
-	d.peer.RaftLogSizeHint *= remainCnt / totalCnt
-	raftLogGCTask := &raftLogGCTask{
-		raftEngine: d.ctx.engine.raft,
-		regionID:   d.regionID(),
-		startIdx:   d.peer.LastCompactedIdx,
-		endIdx:     truncatedIndex + 1,
-	}
-	d.peer.LastCompactedIdx = raftLogGCTask.endIdx
-	d.peer.Store().CompactTo(raftLogGCTask.endIdx)
-	d.ctx.raftLogGCTaskSender <- task{
-		tp:   taskTypeRaftLogGC,
-		data: raftLogGCTask,
+	// The size hint is scaled by the remaining entries, the size of current CompactLog command can be ignored.
+	if totalCnt := d.peer.LastApplyingIdx - firstIndex; d.peer.LastApplyingIdx > truncatedIndex && totalCnt > 0 {
+		remainCnt := d.peer.LastApplyingIdx - truncatedIndex - 1
+		d.peer.RaftLogSizeHint = uint64(float64(d.peer.RaftLogSizeHint) * float64(remainCnt) / float64(totalCnt))
+	} else {
+		d.peer.RaftLogSizeHint = 0
 	}
+	d.peer.Store().CompactTo(truncatedIndex + 1)
+	d.scheduleRaftLogGC(truncatedIndex + 1)
 }
 
 func (d *peerMsgHandler) onReadySplitRegion(derived *metapb.Region, regions []*metapb.Region) {
@@ -811,7 +955,7 @@ func (d *peerMsgHandler) onReadySplitRegion(derived *metapb.Region, regions []*m
 	d.peer.PostSplit()
 	isLeader := d.peer.IsLeader()
 	if isLeader {
-		d.peer.HeartbeatPd(d.ctx.pdTaskSender)
+		d.peer.DelayHeartbeatPd(d.ctx.pdTaskSender)
 		// Notify pd immediately to let it update the region meta.
 		log.S().Infof("%s notify pd with split count %d", d.tag(), len(regions))
 		// Now pd only uses ReportBatchSplit for history operation show,
@@ -874,15 +1018,18 @@ func (d *peerMsgHandler) onReadySplitRegion(derived *metapb.Region, regions []*m
 		newPeer.peer.PeerStat = d.peer.PeerStat
 		campaigned := newPeer.peer.MaybeCampaign(isLeader)
 		newPeer.hasReady = newPeer.hasReady || campaigned
+		if !campaigned {
+			newPeer.peer.electionTimer.startGrace()
+		}
 
 		if isLeader {
-			// The new peer is likely to become leader, send a heartbeat immediately to reduce
+			// The new peer is likely to become leader, send a heartbeat in the next batch to reduce
 			// client query miss.
-			newPeer.peer.HeartbeatPd(d.ctx.pdTaskSender)
+			newPeer.peer.DelayHeartbeatPd(d.ctx.pdTaskSender)
 		}
 
 		newPeer.peer.Activate(d.ctx.applyMsgs)
-		meta.regions[newRegionID] = newRegion
+		meta.putRegion(newRegion)
 		if lastRegionID == newRegionID {
 			// To prevent from big region, the right region needs run split
 			// check again after split.
@@ -908,20 +1055,98 @@ func (d *peerMsgHandler) onReadySplitRegion(derived *metapb.Region, regions []*m
 	d.ctx.peerEventObserver.OnSplitRegion(derived, regions, newPeers)
 }
 
+// mergeTimeoutTicks is the merge check ticks a merge is waited for before it's rolled back, the source region
+// rejects the proposals until then. CommitMerge is not implemented and PrepareMerge is rejected at proposal,
+// so this only releases the regions restored in the merging state.
+const mergeTimeoutTicks = 3
+
 func (d *peerMsgHandler) onCheckMerge() {
-	// TODO: merge func
+	state := d.peer.PendingMergeState
+	if d.stopped || state == nil {
+		return
+	}
+	d.ticker.schedule(PeerTickCheckMerge)
+	err := d.checkMergeTarget(state.Target)
+	if err == nil && time.Since(d.peer.pendingMergeTime) > mergeTimeoutTicks*d.ctx.cfg.MergeCheckTickInterval {
+		err = errors.Errorf("merge not committed in %v", time.Since(d.peer.pendingMergeTime))
+	}
+	if err != nil {
+		// The rollback is proposed on every check until it's applied, the duplicated ones are rejected by
+		// the epoch.
+		log.S().Warnf("%s rollback merge, %v", d.tag(), err)
+		if d.peer.IsLeader() {
+			d.proposeRollbackMerge(state.Commit)
+		}
+		return
+	}
+	// TODO: merge func, propose CommitMerge to the target region, the merge is rolled back on timeout until then.
+}
+
+// checkMergeTarget returns an error if the target region is not on this store or has changed since
+// PrepareMerge, the merge can't be committed then.
+func (d *peerMsgHandler) checkMergeTarget(target *metapb.Region) error {
+	d.ctx.storeMetaLock.RLock()
+	region := d.ctx.storeMeta.regions[target.Id]
+	d.ctx.storeMetaLock.RUnlock()
+	if region == nil {
+		return errors.Errorf("target region %d not found", target.Id)
+	}
+	if IsEpochStale(target.RegionEpoch, region.RegionEpoch) {
+		return errors.Errorf("target region changed %s -> %s", target, region)
+	}
+	return nil
+}
+
+func (d *peerMsgHandler) proposeRollbackMerge(commit uint64) {
+	req := newAdminRequest(d.regionID(), d.peer.Meta)
+	req.Header.RegionEpoch = d.region().RegionEpoch
+	req.AdminRequest = &raft_cmdpb.AdminRequest{
+		CmdType:       raft_cmdpb.AdminCmdType_RollbackMerge,
+		RollbackMerge: &raft_cmdpb.RollbackMergeRequest{Commit: commit},
+	}
+	d.proposeRaftCommand(raftlog.NewRequest(req), nil)
 }
 
 func (d *peerMsgHandler) onReadyPrepareMerge(region *metapb.Region, state *rspb.MergeState, merged bool) {
-	// TODO: merge func
+	d.ctx.storeMetaLock.Lock()
+	d.ctx.storeMeta.setRegion(region, d.peer)
+	d.ctx.storeMetaLock.Unlock()
+	d.setPendingMergeState(state)
+	if merged {
+		// The target region is catching up the logs of this region.
+		return
+	}
+	d.onCheckMerge()
 }
 
 func (d *peerMsgHandler) onReadyCommitMerge(region, source *metapb.Region) *uint32 {
-	return nil // TODO: merge func
+	// TODO: merge func
+	// The source region may have served reads the target leader hasn't observed.
+	if d.peer.IsLeader() {
+		d.peer.startMaxTSSync()
+		d.scheduleMaxTSSync()
+	}
+	return nil
 }
 
 func (d *peerMsgHandler) onReadyRollbackMerge(commit uint64, region *metapb.Region) {
-	// TODO: merge func
+	state := d.peer.PendingMergeState
+	if state == nil {
+		return
+	}
+	if commit != 0 && state.Commit != commit {
+		panic(fmt.Sprintf("%s rollbacks a wrong merge %d != %d", d.tag(), commit, state.Commit))
+	}
+	d.peer.PendingMergeState = nil
+	if region != nil {
+		d.ctx.storeMetaLock.Lock()
+		d.ctx.storeMeta.setRegion(region, d.peer)
+		d.ctx.storeMetaLock.Unlock()
+	}
+	log.S().Infof("%s merge is rollbacked, commit %d", d.tag(), state.Commit)
+	if d.peer.IsLeader() {
+		d.peer.HeartbeatPd(d.ctx.pdTaskSender)
+	}
 }
 
 func (d *peerMsgHandler) onMergeResult(target *metapb.Peer, stale bool) {
@@ -949,7 +1174,9 @@ func (d *peerMsgHandler) onReadyApplySnapshot(applyResult *ApplySnapResult) {
 		oldRegionID := regionIDFromBytes(meta.regionRanges.Get(region.EndKey, nil))
 		panic(fmt.Sprintf("%s unexpected old region %d", d.tag(), oldRegionID))
 	}
-	meta.regions[region.Id] = region
+	meta.putRegion(region)
+	d.peer.refreshPeerCache(region)
+	d.observeSnapMaxTS(applyResult.MaxTS)
 	d.ctx.peerEventObserver.OnPeerApplySnap(d.peer.getEventContext(), region)
 }
 
@@ -968,6 +1195,7 @@ func (d *peerMsgHandler) onReadyResult(merged bool, execResults []execResult) (*
 				d.onReadyCompactLog(x.firstIndex, x.truncatedIndex)
 			}
 		case *execResultSplitRegion:
+			d.ctx.router.genealogy.recordSplit(d.regionID(), x.index, x.regions)
 			d.onReadySplitRegion(x.derived, x.regions)
 		case *execResultPrepareMerge:
 			d.onReadyPrepareMerge(x.region, x.state, merged)
@@ -975,6 +1203,7 @@ func (d *peerMsgHandler) onReadyResult(merged bool, execResults []execResult) (*
 			if readyToMerge := d.onReadyCommitMerge(x.region, x.source); readyToMerge != nil {
 				return readyToMerge, execResults[i:]
 			}
+			d.ctx.router.genealogy.recordMerge(x.region, x.source, d.peer.Store().AppliedIndex())
 		case *execResultRollbackMerge:
 			d.onReadyRollbackMerge(x.commit, x.region)
 		case *execResultComputeHash:
@@ -983,15 +1212,51 @@ func (d *peerMsgHandler) onReadyResult(merged bool, execResults []execResult) (*
 			d.onReadyVerifyHash(x.index, x.hash)
 		case *execResultDeleteRange:
 			// TODO: clean user properties?
+			if d.ctx.cfg.SizeRecalcDeclinedBytes > 0 {
+				d.onRecalculateRegionSize()
+			}
 		}
 	}
 	return nil, nil
 }
 
+// checkMergeProposal rejects PrepareMerge, CommitMerge is not implemented so a prepared merge could never
+// finish and would only freeze the region until it's rolled back.
 func (d *peerMsgHandler) checkMergeProposal(msg *raft_cmdpb.RaftCmdRequest) error {
+	if msg.GetAdminRequest().GetCmdType() == raft_cmdpb.AdminCmdType_PrepareMerge {
+		return errors.New("merge is not supported")
+	}
 	return nil // TODO: merge func
 }
 
+// checkPeerQuota rejects the conf change adding a peer to a store already hosting MaxPeerCount peers, the
+// peers of the store are counted in the regions of this store.
+func (d *peerMsgHandler) checkPeerQuota(msg *raft_cmdpb.RaftCmdRequest) error {
+	limit := d.ctx.cfg.MaxPeerCount
+	changePeer := GetChangePeerCmd(msg)
+	if limit <= 0 || changePeer == nil || changePeer.ChangeType == eraftpb.ConfChangeType_RemoveNode {
+		return nil
+	}
+	storeID := changePeer.GetPeer().GetStoreId()
+	// Promoting a learner doesn't add a peer.
+	if findPeer(d.region(), storeID) != nil {
+		return nil
+	}
+	count := 0
+	d.ctx.storeMetaLock.RLock()
+	for _, region := range d.ctx.storeMeta.regions {
+		if findPeer(region, storeID) != nil {
+			count++
+		}
+	}
+	d.ctx.storeMetaLock.RUnlock()
+	if count >= limit {
+		log.S().Warnf("%s rejects conf change %v, store %d has %d peers", d.tag(), changePeer, storeID, count)
+		return &ErrQuotaExceeded{RegionID: d.regionID(), StoreID: storeID, Quota: "MaxPeerCount", Limit: limit}
+	}
+	return nil
+}
+
 func (d *peerMsgHandler) preProposeRaftCommand(rlog raftlog.RaftLog) (*raft_cmdpb.RaftCmdResponse, error) {
 	req := rlog.GetRaftCmdRequest()
 	// Check store_id, make sure that the msg is dispatched to the right place.
@@ -1006,7 +1271,7 @@ func (d *peerMsgHandler) preProposeRaftCommand(rlog raftlog.RaftLog) (*raft_cmdp
 	// Check whether the store has the right peer to handle the request.
 	regionID := d.regionID()
 	leaderID := d.peer.LeaderID()
-	if !d.peer.IsLeader() {
+	if !d.peer.IsLeader() && (!isReplicaRead(req) || leaderID == InvalidID) {
 		leader := d.peer.getPeerFromCache(leaderID)
 		return nil, &ErrNotLeader{regionID, leader}
 	}
@@ -1048,12 +1313,32 @@ func (d *peerMsgHandler) proposeRaftCommand(rlog raftlog.RaftLog, cb *Callback)
 		NotifyReqRegionRemoved(d.regionID(), cb)
 		return
 	}
+	if d.peer.IsApplyingSnapshot() {
+		// The command is proposed again after the snapshot is applied instead of timing out.
+		if len(d.peer.snapWaiters) >= d.ctx.cfg.SnapWaitersCapacity {
+			cb.Done(ErrResp(&ErrServerIsBusy{Reason: fmt.Sprintf("%d commands are waiting for the snapshot",
+				len(d.peer.snapWaiters))}))
+			return
+		}
+		d.peer.snapWaiters = append(d.peer.snapWaiters, &MsgRaftCmd{SendTime: time.Now(), Request: rlog, Callback: cb})
+		return
+	}
 	msg := rlog.GetRaftCmdRequest()
 	if err := d.checkMergeProposal(msg); err != nil {
 		log.S().Warnf("%s failed to process merge, message %s, err %v", d.tag(), msg, err)
 		cb.Done(ErrResp(err))
 		return
 	}
+	if err := d.checkPeerQuota(msg); err != nil {
+		cb.Done(ErrResp(err))
+		return
+	}
+	if adminReq := msg.GetAdminRequest(); adminReq != nil {
+		if err := d.ctx.router.adminFaults.inject(d.regionID(), adminReq.CmdType); err != nil {
+			cb.Done(ErrResp(err))
+			return
+		}
+	}
 
 	// Note:
 	// The peer that is being checked is a leader. It might step down to be a follower later. It
@@ -1065,6 +1350,12 @@ func (d *peerMsgHandler) proposeRaftCommand(rlog raftlog.RaftLog, cb *Callback)
 	if d.peer.Propose(d.ctx.engine.kv, d.ctx.cfg, cb, rlog, resp) {
 		d.hasReady = true
 	}
+	if d.peer.splitHint.pending {
+		d.onSplitHint()
+	}
+	if d.peer.loadSplit.splitKey != nil {
+		d.onLoadSplit()
+	}
 
 	// TODO: add timeout, if the command is not applied after timeout,
 	// we will call the callback with timeout error.
@@ -1098,6 +1389,9 @@ func (d *peerMsgHandler) findSiblingRegion() *metapb.Region {
 
 func (d *peerMsgHandler) onRaftGCLogTick() {
 	d.ticker.schedule(PeerTickRaftLogGC)
+	if end := d.peer.logReaders.deferredGC(); end > d.peer.LastCompactedIdx {
+		d.scheduleRaftLogGC(end)
+	}
 
 	// As leader, we would not keep caches for the peers that didn't response heartbeat in the
 	// last few seconds. That happens probably because another TiKV is down. In this case if we
@@ -1135,8 +1429,12 @@ func (d *peerMsgHandler) onRaftGCLogTick() {
 	}
 	replicatedIdx, aliveCacheIdx := lastIdx, lastIdx
 	prs := d.peer.RaftGroup.Status().Progress
+	// givenUp are the lagging followers to catch up by a snapshot, the log is compacted regardless of them.
+	givenUp := make(map[uint64]string)
 	for peerID, progress := range prs {
-		if replicatedIdx > progress.Match {
+		if reason := d.peer.giveUpLogCatchUp(d.ctx.cfg, peerID, progress, lastIdx); reason != "" {
+			givenUp[peerID] = reason
+		} else if replicatedIdx > progress.Match {
 			replicatedIdx = progress.Match
 		}
 		if lastHeartbeat, ok := d.peer.PeerHeartbeats[peerID]; ok {
@@ -1171,6 +1469,8 @@ func (d *peerMsgHandler) onRaftGCLogTick() {
 	// Have no idea why subtract 1 here, but original code did this by magic.
 	y.Assert(compactIdx > 0)
 	compactIdx--
+	// Keep the entries pinned by the raft log readers.
+	compactIdx = d.peer.logReaders.clampCompactIndex(compactIdx)
 	if compactIdx < firstIdx {
 		// In case compact_idx == first_idx before subtraction.
 		return
@@ -1178,6 +1478,11 @@ func (d *peerMsgHandler) onRaftGCLogTick() {
 
 	totalGCLogs += compactIdx - firstIdx
 	_ = totalGCLogs
+	for peerID, reason := range givenUp {
+		if match := prs[peerID].Match; match < compactIdx {
+			d.peer.onSnapshotCatchUp(peerID, match, lastIdx, compactIdx, reason)
+		}
+	}
 
 	term, err := d.peer.RaftGroup.Raft.RaftLog.Term(compactIdx)
 	if err != nil {
@@ -1201,7 +1506,7 @@ func (d *peerMsgHandler) onSplitRegionCheckTick() {
 	if !d.peer.IsLeader() {
 		return
 	}
-	if d.peer.SizeDiffHint < d.ctx.cfg.RegionSplitCheckDiff {
+	if d.peer.SizeDiffHint < d.ctx.cfg.RegionSplitCheckDiff && !d.approximateOversized() && !d.sizeReconcileDue() {
 		return
 	}
 	d.ctx.splitCheckTaskSender <- task{
@@ -1210,8 +1515,10 @@ func (d *peerMsgHandler) onSplitRegionCheckTick() {
 			region: d.region(),
 		},
 	}
+	d.peer.sizeCheckTime = time.Now()
 	d.peer.SizeDiffHint = 0
 	d.peer.CompactionDeclinedBytes = 0
+	d.peer.splitHint.checking = false
 }
 
 func isTableKey(key []byte) bool {
@@ -1226,6 +1533,23 @@ func isSameTable(leftKey, rightKey []byte) bool {
 		bytes.Equal(leftKey[:tablecodec.TableSplitKeyLen], rightKey[:tablecodec.TableSplitKeyLen])
 }
 
+func (d *peerMsgHandler) onLeaseControl(op LeaseControlOp, cb *Callback) {
+	if !d.ctx.cfg.EnableLeaseControl {
+		cb.Done(ErrResp(errors.New("lease control is not enabled")))
+		return
+	}
+	if !d.peer.IsLeader() {
+		cb.Done(ErrResp(&ErrNotLeader{RegionID: d.regionID(), Leader: d.peer.getPeerFromCache(d.peer.LeaderID())}))
+		return
+	}
+	if err := d.peer.controlLease(op); err != nil {
+		cb.Done(ErrResp(err))
+		return
+	}
+	log.S().Infof("%s leader lease is forced by lease control op %d", d.tag(), op)
+	cb.Done(&raft_cmdpb.RaftCmdResponse{Header: &raft_cmdpb.RaftResponseHeader{}})
+}
+
 func (d *peerMsgHandler) onPrepareSplitRegion(regionEpoch *metapb.RegionEpoch, splitKeys [][]byte, cb *Callback) {
 	if err := d.validateSplitRegion(regionEpoch, splitKeys); err != nil {
 		cb.Done(ErrResp(err))
@@ -1285,10 +1609,14 @@ func (d *peerMsgHandler) validateSplitRegion(epoch *metapb.RegionEpoch, splitKey
 
 func (d *peerMsgHandler) onApproximateRegionSize(size uint64) {
 	d.peer.ApproximateSize = &size
+	// The split check finished without splitting the region.
+	d.peer.splitHint.checking = false
 }
 
 func (d *peerMsgHandler) onApproximateRegionKeys(keys uint64) {
 	d.peer.ApproximateKeys = &keys
+	// The keys are reported after the size.
+	d.onRegionSizeRecalculated()
 }
 
 func (d *peerMsgHandler) onCompactionDeclinedBytes(declinedBytes uint64) {
@@ -1332,6 +1660,11 @@ func (d *peerMsgHandler) onCheckPeerStaleStateTick() {
 	if d.peer.IsApplyingSnapshot() || d.peer.HasPendingSnapshot() {
 		return
 	}
+	if d.peer.hibernate.isHibernated() {
+		// The leader agreed to hibernate, it's not missing.
+		d.peer.leaderMissingTime = nil
+		return
+	}
 
 	// If this peer detects the leader is missing for a long long time,
 	// it should consider itself as a stale peer which is removed from
@@ -1407,9 +1740,11 @@ func (d *peerMsgHandler) verifyAndStoreHash(expectedIndex uint64, expectedHash [
 			log.S().Warnf("%s duplicated consistency check detected, skip.", d.tag())
 			return false
 		}
+		d.peer.invariants.observeCheck()
 		if !bytes.Equal(state.Hash, expectedHash) {
-			panic(fmt.Sprintf("%s hash at %d not correct want %v, got %v",
-				d.tag(), index, expectedHash, state.Hash))
+			d.onHashMismatch(index, expectedHash, state.Hash)
+			state.Hash = nil
+			return false
 		}
 		log.S().Infof("%s consistency check pass, index %d", d.tag(), index)
 		state.Hash = nil
@@ -1421,7 +1756,7 @@ func (d *peerMsgHandler) verifyAndStoreHash(expectedIndex uint64, expectedHash [
 		log.S().Warnf("%s hash belongs to wrong index, skip, index: %d, expected_index: %d",
 			d.tag(), index, expectedIndex)
 	}
-	log.S().Infof("%s save hash for consistency check later, index: %d", d.tag(), index)
+	log.S().Infof("%s save hash for consistency check later, index: %d", d.tag(), expectedIndex)
 	state.Index = expectedIndex
 	state.Hash = expectedHash
 	return true
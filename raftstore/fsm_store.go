@@ -26,6 +26,7 @@ import (
 	"github.com/pingcap/badger"
 	"github.com/pingcap/badger/y"
 	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/eraftpb"
 	"github.com/pingcap/kvproto/pkg/metapb"
 	"github.com/pingcap/kvproto/pkg/pdpb"
 	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
@@ -57,6 +58,16 @@ type storeMeta struct {
 	// later if there is no related lock.
 	// source_region_id -> (version, BiLock).
 	mergeLocks map[uint64]*mergeLock
+	// region_id -> the final state of a destroyed region, used to answer the messages from dead peers
+	// without reading the engine. Entries are purged after Config.TombstoneRetention.
+	tombstones map[uint64]*tombstoneRegion
+	// uninitialized is the number of the regions without peers, it's updated by putRegion and removeRegion.
+	uninitialized uint64
+}
+
+type tombstoneRegion struct {
+	state       *rspb.RegionLocalState
+	destroyTime time.Time
 }
 
 func newStoreMeta() *storeMeta {
@@ -66,14 +77,58 @@ func newStoreMeta() *storeMeta {
 		pendingMergeTargets: map[uint64]map[uint64]*metapb.RegionEpoch{},
 		targetsMap:          map[uint64]uint64{},
 		mergeLocks:          map[uint64]*mergeLock{},
+		tombstones:          map[uint64]*tombstoneRegion{},
 	}
 }
 
 func (m *storeMeta) setRegion(region *metapb.Region, peer *Peer) {
-	m.regions[region.Id] = region
+	m.putRegion(region)
 	peer.SetRegion(region)
 }
 
+// putRegion sets the region of the id, the regions must be changed by putRegion and removeRegion to keep
+// the number of the uninitialized regions.
+func (m *storeMeta) putRegion(region *metapb.Region) {
+	if old := m.regions[region.Id]; old != nil && len(old.Peers) == 0 {
+		m.uninitialized--
+	}
+	if len(region.Peers) == 0 {
+		m.uninitialized++
+	}
+	m.regions[region.Id] = region
+}
+
+func (m *storeMeta) removeRegion(regionID uint64) {
+	if old, ok := m.regions[regionID]; ok {
+		if len(old.Peers) == 0 {
+			m.uninitialized--
+		}
+		delete(m.regions, regionID)
+	}
+}
+
+func (m *storeMeta) addTombstone(state *rspb.RegionLocalState, destroyTime time.Time) {
+	m.tombstones[state.Region.Id] = &tombstoneRegion{state: state, destroyTime: destroyTime}
+}
+
+// purgeTombstones removes the tombstone regions destroyed before the deadline and returns the number of purged regions.
+func (m *storeMeta) purgeTombstones(deadline time.Time) int {
+	var cnt int
+	for id, t := range m.tombstones {
+		if t.destroyTime.Before(deadline) {
+			delete(m.tombstones, id)
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// uninitializedCount returns the number of peers that are created by raft messages and not initialized by
+// snapshots yet.
+func (m *storeMeta) uninitializedCount() uint64 {
+	return m.uninitialized
+}
+
 type mergeLock struct{}
 
 // GlobalContext represents a global context.
@@ -95,6 +150,7 @@ type GlobalContext struct {
 	pdClient              pd.Client
 	peerEventObserver     PeerEventObserver
 	globalStats           *storeStats
+	auditLog              *auditLog
 }
 
 // StoreContext represents a store context.
@@ -113,8 +169,9 @@ type RaftContext struct {
 	pendingCount int
 	hasReady     bool
 	queuedSnaps  map[uint64]struct{}
-	isBusy       bool
 	localStats   *storeStats
+	// logWriter persists the ready states in the background, nil means they are persisted by the raft worker.
+	logWriter *raftLogWriter
 }
 
 type storeStats struct {
@@ -185,6 +242,12 @@ func (d *storeMsgHandler) onTick(tick StoreTick) {
 		d.onSnapMgrGC()
 	case StoreTickConsistencyCheck:
 		d.onComputeHashTick()
+	case StoreTickTombstoneGC:
+		d.onTombstoneGCTick()
+	case StoreTickCheckInvariants:
+		d.onCheckInvariantsTick()
+	case StoreTickIngestLimiter:
+		d.onIngestLimiterTick()
 	}
 }
 
@@ -219,6 +282,9 @@ func (d *storeMsgHandler) start(store *metapb.Store) {
 	d.ticker.scheduleStore(StoreTickPdStoreHeartbeat)
 	d.ticker.scheduleStore(StoreTickSnapGC)
 	d.ticker.scheduleStore(StoreTickConsistencyCheck)
+	d.ticker.scheduleStore(StoreTickTombstoneGC)
+	d.ticker.scheduleStore(StoreTickCheckInvariants)
+	d.ticker.scheduleStore(StoreTickIngestLimiter)
 }
 
 // loadPeers loads peers in this store. It scans the db engine, loads all regions
@@ -240,6 +306,10 @@ func (bs *raftBatchSystem) loadPeers() ([]*peerFsm, error) {
 	raftWB := new(WriteBatch)
 	var applyingRegions []*metapb.Region
 	var mergingCount int
+	// states are the region states of the peers to create.
+	var states []*rspb.RegionLocalState
+	recovery := &bs.router.recovery
+	scan := recovery.begin(ctx.cfg, storeID, RecoveryPhaseScan, 0)
 	ctx.storeMetaLock.Lock()
 	defer ctx.storeMetaLock.Unlock()
 	meta := ctx.storeMeta
@@ -263,6 +333,7 @@ func (bs *raftBatchSystem) loadPeers() ([]*peerFsm, error) {
 				return errors.WithStack(err)
 			}
 			totalCount++
+			scan.advance()
 			localState := new(rspb.RegionLocalState)
 			err = localState.Unmarshal(val)
 			if err != nil {
@@ -272,6 +343,7 @@ func (bs *raftBatchSystem) loadPeers() ([]*peerFsm, error) {
 			if localState.State == rspb.PeerState_Tombstone {
 				tombStoneCount++
 				bs.clearStaleMeta(kvWB, raftWB, localState)
+				meta.addTombstone(localState, t)
 				continue
 			}
 			if localState.State == rspb.PeerState_Applying {
@@ -285,28 +357,14 @@ func (bs *raftBatchSystem) loadPeers() ([]*peerFsm, error) {
 				applyingRegions = append(applyingRegions, region)
 				continue
 			}
-
-			peer, err := createPeerFsm(storeID, ctx.cfg, ctx.regionTaskSender, ctx.engine, region)
-			if err != nil {
-				return err
-			}
-			ctx.peerEventObserver.OnPeerCreate(peer.peer.getEventContext(), region)
-			if localState.State == rspb.PeerState_Merging {
-				log.S().Infof("region %d is merging", regionID)
-				mergingCount++
-				peer.setPendingMergeState(localState.MergeState)
-			}
-			meta.regionRanges.Put(region.EndKey, regionIDToBytes(regionID))
-			meta.regions[regionID] = region
-			// No need to check duplicated here, because we use region id as the key
-			// in DB.
-			regionPeers = append(regionPeers, peer)
+			states = append(states, localState)
 		}
 		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
+	scan.finish()
 	if kvWB.size > 0 {
 		kvWB.MustWriteToKV(ctx.engine.kv)
 	}
@@ -314,6 +372,64 @@ func (bs *raftBatchSystem) loadPeers() ([]*peerFsm, error) {
 		raftWB.MustWriteToRaft(ctx.engine.raft)
 	}
 
+	workers := ctx.cfg.peerInitWorkers()
+	validate := recovery.begin(ctx.cfg, storeID, RecoveryPhaseValidate, len(states))
+	err = runParallel(workers, len(states), func(_, i int) error {
+		if err := validateRegionStates(ctx.engine, states[i].Region); err != nil {
+			return err
+		}
+		validate.advance()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	validate.finish()
+
+	// Every worker recovers the scheduler states to its own write batch.
+	peers := make([]*peerFsm, len(states))
+	workerWBs := make([]*WriteBatch, workers)
+	for i := range workerWBs {
+		workerWBs[i] = new(WriteBatch)
+	}
+	create := recovery.begin(ctx.cfg, storeID, RecoveryPhaseCreate, len(states))
+	err = runParallel(workers, len(states), func(w, i int) error {
+		peer, err := createPeerFsm(storeID, ctx.cfg, ctx.regionTaskSender, ctx.engine, states[i].Region)
+		if err != nil {
+			return err
+		}
+		if err = peer.peer.recoverSchedulerState(workerWBs[w]); err != nil {
+			return err
+		}
+		peers[i] = peer
+		create.advance()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, wb := range workerWBs {
+		if wb.size > 0 {
+			wb.MustWriteToRaft(ctx.engine.raft)
+		}
+	}
+	for i, peer := range peers {
+		localState := states[i]
+		region := localState.Region
+		ctx.peerEventObserver.OnPeerCreate(peer.peer.getEventContext(), region)
+		if localState.State == rspb.PeerState_Merging {
+			log.S().Infof("region %d is merging", region.Id)
+			mergingCount++
+			peer.setPendingMergeState(localState.MergeState)
+		}
+		meta.regionRanges.Put(region.EndKey, regionIDToBytes(region.Id))
+		meta.putRegion(region)
+		// No need to check duplicated here, because we use region id as the key
+		// in DB.
+		regionPeers = append(regionPeers, peer)
+	}
+	create.finish()
+
 	// schedule applying snapshot after raft write batch were written.
 	for _, region := range applyingRegions {
 		log.S().Infof("region %d is applying snapshot", region.Id)
@@ -323,7 +439,7 @@ func (bs *raftBatchSystem) loadPeers() ([]*peerFsm, error) {
 		}
 		peer.scheduleApplyingSnapshot()
 		meta.regionRanges.Put(region.EndKey, regionIDToBytes(region.Id))
-		meta.regions[region.Id] = region
+		meta.putRegion(region)
 		regionPeers = append(regionPeers, peer)
 	}
 	log.S().Infof("start store %d, region_count %d, tombstone_count %d, applying_count %d, merge_count %d, takes %v",
@@ -368,6 +484,8 @@ type raftBatchSystem struct {
 	closeCh   chan struct{}
 	wg        *sync.WaitGroup
 	globalCfg *config.Config
+	// raftWorker holds the messages of the paused peers, they are failed on shutdown.
+	raftWorker *raftWorker
 }
 
 func (bs *raftBatchSystem) start(
@@ -388,6 +506,10 @@ func (bs *raftBatchSystem) start(
 	if err != nil {
 		return err
 	}
+	auditLog, err := openAuditLog(cfg.AuditLogPath, cfg.AuditDataSampleRate, cfg.AuditReplayer)
+	if err != nil {
+		return err
+	}
 	wg := new(sync.WaitGroup)
 	bs.workers = &workers{
 		splitCheckWorker:  newWorker("split-check", wg),
@@ -416,6 +538,7 @@ func (bs *raftBatchSystem) start(
 		pdClient:              pdClient,
 		peerEventObserver:     observer,
 		globalStats:           new(storeStats),
+		auditLog:              auditLog,
 	}
 	regionPeers, err := bs.loadPeers()
 	if err != nil {
@@ -436,6 +559,7 @@ func (bs *raftBatchSystem) startWorkers(peers []*peerFsm) {
 
 	bs.wg.Add(3) // raftWorker, applyWorker, storeWorker
 	rw := newRaftWorker(ctx, router.peerSender, router)
+	bs.raftWorker = rw
 	go rw.run(bs.closeCh, bs.wg)
 	aw := newApplyWorker(router, rw.applyCh, rw.applyCtx)
 	go aw.run(bs.wg)
@@ -451,11 +575,17 @@ func (bs *raftBatchSystem) startWorkers(peers []*peerFsm) {
 	}
 	engines := ctx.engine
 	cfg := ctx.cfg
-	workers.splitCheckWorker.start(newSplitCheckRunner(engines.kv.DB, router, cfg.SplitCheck))
-	workers.regionWorker.start(newRegionTaskHandler(bs.globalCfg, engines, ctx.snapMgr, cfg.SnapApplyBatchSize, cfg.CleanStalePeerDelay))
+	workers.splitCheckWorker.start(newSplitCheckRunner(engines.kv.DB, router, cfg.SplitCheck, cfg.amplifySize(1)))
+	regionTasks := newRegionTaskQueue(cfg, router.regionTaskListeners)
+	router.regionTasks, router.regionTaskSender = regionTasks, workers.regionWorker.sender
+	regionTaskHandler := newRegionTaskHandler(bs.globalCfg, engines, ctx.snapMgr, cfg.SnapApplyBatchSize, cfg.CleanStalePeerDelay)
+	regionTaskHandler.ctx.strictApplyOrder = cfg.StrictSnapApplyOrder
+	regionTaskHandler.ctx.verifyIngestChecksum = cfg.VerifyIngestChecksum
+	workers.regionWorker.startPrioritized(regionTaskHandler, regionTasks)
 	workers.raftLogGCWorker.start(&raftLogGCTaskHandler{})
 	workers.compactWorker.start(&compactTaskHandler{engine: engines.kv.DB})
-	workers.pdWorker.start(newPDTaskHandler(ctx.store.Id, ctx.pdClient, bs.router))
+	workers.pdWorker.start(newPDTaskHandler(ctx.store.Id, ctx.pdClient, bs.router, newPlacementChecker(cfg, ctx.pdClient),
+		newHeartbeatBatch(cfg.PdHeartbeatBatchDelay, workers.pdWorker.sender)))
 	workers.computeHashWorker.start(&computeHashTaskHandler{router: bs.router})
 }
 
@@ -465,6 +595,8 @@ func (bs *raftBatchSystem) shutDown() {
 	}
 	close(bs.closeCh)
 	bs.wg.Wait()
+	bs.failPendingCallbacks()
+	bs.ctx.auditLog.close()
 	workers := bs.workers
 	bs.workers = nil
 	stopTask := task{tp: taskTypeStop}
@@ -480,6 +612,9 @@ func (bs *raftBatchSystem) shutDown() {
 func createRaftBatchSystem(globalCfg *config.Config, raftCfg *Config) (*router, *raftBatchSystem) {
 	storeSender, storeFsm := newStoreFsm(raftCfg)
 	router := newRouter(storeSender, storeFsm)
+	router.mailboxCapacity = raftCfg.PeerMailboxCapacity
+	router.readYourWrites = raftCfg.ReadYourWritesVerifier
+	router.ingestLimiter = newIngestLimiter(raftCfg.IngestRateLimit, raftCfg.IngestMinRateLimit, raftCfg.IngestWriteLatencyTarget)
 	raftBatchSystem := &raftBatchSystem{
 		router:    router,
 		closeCh:   make(chan struct{}),
@@ -500,14 +635,21 @@ func (d *storeMsgHandler) checkMsg(msg *rspb.RaftMessage) (bool, error) {
 	fromStoreID := msg.FromPeer.StoreId
 
 	// Check if the target is tombstone,
-	stateKey := RegionStateKey(regionID)
-	localState := new(rspb.RegionLocalState)
-	err := getMsg(d.ctx.engine.kv.DB, stateKey, localState)
-	if err != nil {
-		if err == badger.ErrKeyNotFound {
-			return false, nil
+	d.ctx.storeMetaLock.RLock()
+	tombstone := d.ctx.storeMeta.tombstones[regionID]
+	d.ctx.storeMetaLock.RUnlock()
+	var localState *rspb.RegionLocalState
+	if tombstone != nil {
+		localState = tombstone.state
+	} else {
+		localState = new(rspb.RegionLocalState)
+		err := getMsg(d.ctx.engine.kv.DB, RegionStateKey(regionID), localState)
+		if err != nil {
+			if err == badger.ErrKeyNotFound {
+				return false, nil
+			}
+			return false, err
 		}
-		return false, err
 	}
 	if localState.State != rspb.PeerState_Tombstone {
 		// Maybe split, but not registered yet.
@@ -641,15 +783,44 @@ func (d *storeMsgHandler) maybeCreatePeer(regionID uint64, msg *rspb.RaftMessage
 		return false, nil
 	}
 
-	// New created peers should know it's learner or not.
-	peer, err := replicatePeerFsm(
-		d.ctx.store.Id, d.ctx.cfg, d.ctx.regionTaskSender, d.ctx.engine, regionID, msg.ToPeer)
-	if err != nil {
-		return false, err
+	if limit := d.ctx.cfg.MaxPendingUninitializedPeers; limit > 0 && meta.uninitializedCount() >= limit {
+		log.S().Warnf("too many uninitialized peers, reject creating peer %s of region %d, limit %d",
+			msg.ToPeer, regionID, limit)
+		regionsToDestroy = nil
+		d.replyBusy(msg)
+		return false, nil
+	}
+
+	if quota := d.ctx.cfg.MaxRegionCount; quota > 0 && len(meta.regions) >= quota {
+		log.S().Warnf("store %d has %d regions, reject creating peer %s of region %d, quota %d",
+			d.ctx.store.Id, len(meta.regions), msg.ToPeer, regionID, quota)
+		regionsToDestroy = nil
+		d.replyBusy(msg)
+		return false, nil
+	}
+
+	var peer *peerFsm
+	var err error
+	// The range of a checkpoint overlaps the regions to be destroyed.
+	if len(regionsToDestroy) == 0 {
+		peer, err = d.maybeCreateCheckpointPeer(regionID, msg)
+		if err != nil {
+			return false, err
+		}
+	}
+	if peer != nil {
+		meta.regionRanges.Put(peer.region().EndKey, regionIDToBytes(regionID))
+	} else {
+		// New created peers should know it's learner or not.
+		peer, err = replicatePeerFsm(
+			d.ctx.store.Id, d.ctx.cfg, d.ctx.regionTaskSender, d.ctx.engine, regionID, msg.ToPeer)
+		if err != nil {
+			return false, err
+		}
 	}
 	// following snapshot may overlap, should insert into region_ranges after
 	// snapshot is applied.
-	meta.regions[regionID] = peer.peer.Region()
+	meta.putRegion(peer.peer.Region())
 	d.ctx.router.register(peer)
 	if err := d.ctx.router.send(regionID, Msg{Type: MsgTypeStart}); err != nil {
 		log.S().Error(err)
@@ -658,6 +829,25 @@ func (d *storeMsgHandler) maybeCreatePeer(regionID uint64, msg *rspb.RaftMessage
 	return true, nil
 }
 
+// replyBusy tells the sender that the peer can't be created now, the sender treats the peer as unreachable
+// and backs off.
+func (d *storeMsgHandler) replyBusy(msg *rspb.RaftMessage) {
+	reply := &rspb.RaftMessage{
+		RegionId:    msg.RegionId,
+		FromPeer:    msg.ToPeer,
+		ToPeer:      msg.FromPeer,
+		RegionEpoch: msg.RegionEpoch,
+		Message: &eraftpb.Message{
+			MsgType: eraftpb.MessageType_MsgUnreachable,
+			From:    msg.ToPeer.Id,
+			To:      msg.FromPeer.Id,
+		},
+	}
+	if err := d.ctx.trans.Send(reply); err != nil {
+		log.S().Errorf("send busy reply for region %d failed: %v", msg.RegionId, err)
+	}
+}
+
 func destroyRegions(router *router, regionsToDestroy []uint64, toPeer *metapb.Peer) {
 	for _, id := range regionsToDestroy {
 		if err := router.send(id, Msg{Type: MsgTypeMergeResult, Data: &MsgMergeResult{
@@ -669,10 +859,6 @@ func destroyRegions(router *router, regionsToDestroy []uint64, toPeer *metapb.Pe
 	}
 }
 
-func (d *storeMsgHandler) onCompactionFinished(event *rocksdb.CompactedEvent) {
-	// TODO: not supported.
-}
-
 func (d *storeMsgHandler) onCompactCheckTick() {
 	// TODO: not supported.
 }
@@ -688,7 +874,7 @@ func (d *storeMsgHandler) storeHeartbeatPD() {
 	stats.SendingSnapCount = uint32(snapStats.SendingCount)
 	stats.ReceivingSnapCount = uint32(snapStats.ReceivingCount)
 	stats.ApplyingSnapCount = uint32(atomic.LoadUint64(d.ctx.applyingSnapCount))
-	stats.StartTime = uint32(d.startTime.Second())
+	stats.StartTime = uint32(d.startTime.Unix())
 	globalStats := d.ctx.globalStats
 	stats.BytesWritten = atomic.SwapUint64(&globalStats.engineTotalBytesWritten, 0)
 	stats.KeysWritten = atomic.SwapUint64(&globalStats.engineTotalKeysWritten, 0)
@@ -773,6 +959,16 @@ func (d *storeMsgHandler) onSnapMgrGC() {
 	d.ticker.scheduleStore(StoreTickSnapGC)
 }
 
+func (d *storeMsgHandler) onTombstoneGCTick() {
+	d.ticker.scheduleStore(StoreTickTombstoneGC)
+	d.ctx.storeMetaLock.Lock()
+	purged := d.ctx.storeMeta.purgeTombstones(time.Now().Add(-d.ctx.cfg.TombstoneRetention))
+	d.ctx.storeMetaLock.Unlock()
+	if purged > 0 {
+		log.S().Infof("store %d purged %d tombstone regions", d.storeFsm.id, purged)
+	}
+}
+
 func (d *storeMsgHandler) onComputeHashTick() {
 	d.ticker.scheduleStore(StoreTickConsistencyCheck)
 	if len(d.ctx.computeHashTaskSender) > 0 {
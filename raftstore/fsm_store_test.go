@@ -0,0 +1,932 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ngaut/unistore/rocksdb"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/pdpb"
+	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
+	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/pingcap/tidb/store/mockstore/unistore/pd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhangjinpeng1987/raft"
+)
+
+type mockTransport struct {
+	sync.Mutex
+	msgs []*rspb.RaftMessage
+}
+
+func (t *mockTransport) Send(msg *rspb.RaftMessage) error {
+	t.Lock()
+	t.msgs = append(t.msgs, msg)
+	t.Unlock()
+	return nil
+}
+
+func newTestStoreMsgHandler(cfg *Config, trans Transport) *storeMsgHandler {
+	_, fsm := newStoreFsm(cfg)
+	ctx := &StoreContext{GlobalContext: &GlobalContext{
+		cfg:           cfg,
+		store:         &metapb.Store{Id: 1},
+		storeMeta:     newStoreMeta(),
+		storeMetaLock: new(sync.RWMutex),
+		trans:         trans,
+	}}
+	return newStoreFsmDelegate(fsm, ctx)
+}
+
+func TestMaxPendingUninitializedPeers(t *testing.T) {
+	cfg := NewDefaultConfig()
+	cfg.MaxPendingUninitializedPeers = 1
+	trans := new(mockTransport)
+	d := newTestStoreMsgHandler(cfg, trans)
+	meta := d.ctx.storeMeta
+	meta.putRegion(&metapb.Region{Id: 2, RegionEpoch: &metapb.RegionEpoch{}})
+	meta.putRegion(&metapb.Region{Id: 3, Peers: []*metapb.Peer{{Id: 4, StoreId: 1}}})
+	assert.Equal(t, uint64(1), meta.uninitializedCount())
+
+	msg := &rspb.RaftMessage{
+		RegionId:    5,
+		FromPeer:    &metapb.Peer{Id: 6, StoreId: 2},
+		ToPeer:      &metapb.Peer{Id: 7, StoreId: 1},
+		RegionEpoch: &metapb.RegionEpoch{ConfVer: 2, Version: 1},
+		Message:     &eraftpb.Message{MsgType: eraftpb.MessageType_MsgHeartbeat},
+	}
+	created, err := d.maybeCreatePeer(5, msg)
+	require.Nil(t, err)
+	assert.False(t, created)
+	require.Len(t, trans.msgs, 1)
+	reply := trans.msgs[0]
+	assert.Equal(t, eraftpb.MessageType_MsgUnreachable, reply.Message.MsgType)
+	assert.Equal(t, msg.FromPeer, reply.ToPeer)
+	assert.Equal(t, msg.ToPeer, reply.FromPeer)
+	_, ok := meta.regions[5]
+	assert.False(t, ok)
+
+	// The count follows the regions initialized and removed.
+	meta.putRegion(&metapb.Region{Id: 2, Peers: []*metapb.Peer{{Id: 8, StoreId: 1}}})
+	assert.Equal(t, uint64(0), meta.uninitializedCount())
+	meta.putRegion(&metapb.Region{Id: 5, RegionEpoch: &metapb.RegionEpoch{}})
+	assert.Equal(t, uint64(1), meta.uninitializedCount())
+	meta.removeRegion(5)
+	meta.removeRegion(5)
+	assert.Equal(t, uint64(0), meta.uninitializedCount())
+}
+
+func TestMaxRegionCount(t *testing.T) {
+	cfg := NewDefaultConfig()
+	cfg.MaxRegionCount = 2
+	trans := new(mockTransport)
+	d := newTestStoreMsgHandler(cfg, trans)
+	meta := d.ctx.storeMeta
+	meta.regions[2] = &metapb.Region{Id: 2, Peers: []*metapb.Peer{{Id: 3, StoreId: 1}}}
+	meta.regions[4] = &metapb.Region{Id: 4, Peers: []*metapb.Peer{{Id: 5, StoreId: 1}}}
+
+	msg := &rspb.RaftMessage{
+		RegionId:    6,
+		FromPeer:    &metapb.Peer{Id: 7, StoreId: 2},
+		ToPeer:      &metapb.Peer{Id: 8, StoreId: 1},
+		RegionEpoch: &metapb.RegionEpoch{ConfVer: 2, Version: 1},
+		Message:     &eraftpb.Message{MsgType: eraftpb.MessageType_MsgHeartbeat},
+	}
+	created, err := d.maybeCreatePeer(6, msg)
+	require.Nil(t, err)
+	assert.False(t, created)
+	require.Len(t, trans.msgs, 1)
+	assert.Equal(t, eraftpb.MessageType_MsgUnreachable, trans.msgs[0].Message.MsgType)
+	_, ok := meta.regions[6]
+	assert.False(t, ok)
+}
+
+func TestTombstoneRegistry(t *testing.T) {
+	cfg := NewDefaultConfig()
+	trans := new(mockTransport)
+	d := newTestStoreMsgHandler(cfg, trans)
+	meta := d.ctx.storeMeta
+	destroyTime := time.Now()
+	meta.addTombstone(&rspb.RegionLocalState{
+		State: rspb.PeerState_Tombstone,
+		Region: &metapb.Region{
+			Id:          2,
+			RegionEpoch: &metapb.RegionEpoch{ConfVer: 3, Version: 2},
+			Peers:       []*metapb.Peer{{Id: 3, StoreId: 1}},
+		},
+	}, destroyTime)
+
+	// A vote from a removed peer with a stale epoch is answered with a GC message.
+	msg := &rspb.RaftMessage{
+		RegionId:    2,
+		FromPeer:    &metapb.Peer{Id: 4, StoreId: 2},
+		ToPeer:      &metapb.Peer{Id: 3, StoreId: 1},
+		RegionEpoch: &metapb.RegionEpoch{ConfVer: 2, Version: 2},
+		Message:     &eraftpb.Message{MsgType: eraftpb.MessageType_MsgRequestVote},
+	}
+	handled, err := d.checkMsg(msg)
+	require.Nil(t, err)
+	assert.True(t, handled)
+	require.Len(t, trans.msgs, 1)
+	assert.True(t, trans.msgs[0].IsTombstone)
+	assert.Equal(t, uint64(3), trans.msgs[0].RegionEpoch.ConfVer)
+
+	// A stale non-vote message is dropped without reply.
+	msg.Message = &eraftpb.Message{MsgType: eraftpb.MessageType_MsgHeartbeat}
+	handled, err = d.checkMsg(msg)
+	require.Nil(t, err)
+	assert.True(t, handled)
+	assert.Len(t, trans.msgs, 1)
+
+	// A message with the same conf version is invalid.
+	msg.RegionEpoch = &metapb.RegionEpoch{ConfVer: 3, Version: 2}
+	_, err = d.checkMsg(msg)
+	assert.NotNil(t, err)
+
+	assert.Equal(t, 0, meta.purgeTombstones(destroyTime))
+	assert.Len(t, meta.tombstones, 1)
+	assert.Equal(t, 1, meta.purgeTombstones(destroyTime.Add(cfg.TombstoneRetention)))
+	assert.Len(t, meta.tombstones, 0)
+}
+
+type mockStorePDClient struct {
+	pd.Client
+	stores map[uint64]*metapb.Store
+}
+
+func (c *mockStorePDClient) GetStore(ctx context.Context, storeID uint64) (*metapb.Store, error) {
+	store, ok := c.stores[storeID]
+	if !ok {
+		return nil, errors.Errorf("store %d not found", storeID)
+	}
+	return store, nil
+}
+
+func TestPlacementChecker(t *testing.T) {
+	newStore := func(id uint64, zone, host string) *metapb.Store {
+		return &metapb.Store{Id: id, Labels: []*metapb.StoreLabel{{Key: "zone", Value: zone}, {Key: "host", Value: host}}}
+	}
+	pdClient := &mockStorePDClient{stores: map[uint64]*metapb.Store{
+		1: newStore(1, "z1", "h1"),
+		2: newStore(2, "z1", "h2"),
+		3: newStore(3, "z2", "h3"),
+	}}
+	cfg := NewDefaultConfig()
+	cfg.LocationLabels = []string{"zone", "host"}
+	assert.Nil(t, newPlacementChecker(cfg, pdClient))
+	cfg.IsolationLevel = "rack"
+	assert.Nil(t, newPlacementChecker(cfg, pdClient))
+
+	region := &metapb.Region{Id: 1, Peers: []*metapb.Peer{{Id: 11, StoreId: 1}}}
+	cfg.IsolationLevel = "zone"
+	checker := newPlacementChecker(cfg, pdClient)
+	err := checker.checkAddPeer(region, &metapb.Peer{Id: 12, StoreId: 2})
+	require.IsType(t, &ErrPlacementViolation{}, err)
+	assert.Equal(t, "z1", err.(*ErrPlacementViolation).Location)
+	assert.Nil(t, checker.checkAddPeer(region, &metapb.Peer{Id: 13, StoreId: 3}))
+	// Promoting a learner on the same store is allowed.
+	assert.Nil(t, checker.checkAddPeer(region, &metapb.Peer{Id: 11, StoreId: 1}))
+	assert.NotNil(t, checker.checkAddPeer(region, &metapb.Peer{Id: 14, StoreId: 4}))
+
+	cfg.IsolationLevel = "host"
+	checker = newPlacementChecker(cfg, pdClient)
+	assert.Nil(t, checker.checkAddPeer(region, &metapb.Peer{Id: 12, StoreId: 2}))
+}
+
+type mockHeartbeatPDClient struct {
+	pd.Client
+	reported []*pdpb.RegionHeartbeatRequest
+}
+
+func (c *mockHeartbeatPDClient) ReportRegion(req *pdpb.RegionHeartbeatRequest) {
+	c.reported = append(c.reported, req)
+}
+
+func TestHeartbeatBatch(t *testing.T) {
+	heartbeat := func(regionID, version uint64) *pdRegionHeartbeatTask {
+		return &pdRegionHeartbeatTask{region: &metapb.Region{Id: regionID, RegionEpoch: &metapb.RegionEpoch{Version: version}}}
+	}
+	pdClient := &mockHeartbeatPDClient{}
+	ch := make(chan task, 1)
+	batch := newHeartbeatBatch(10*time.Millisecond, ch)
+	handler := newPDTaskHandler(1, pdClient, nil, nil, batch)
+
+	handler.handle(task{tp: taskTypePDDelayedHeartbeat, data: heartbeat(3, 1)})
+	handler.handle(task{tp: taskTypePDDelayedHeartbeat, data: heartbeat(2, 1)})
+	handler.handle(task{tp: taskTypePDDelayedHeartbeat, data: heartbeat(3, 2)})
+	handler.handle(task{tp: taskTypePDDelayedHeartbeat, data: heartbeat(4, 1)})
+	// The immediate heartbeat replaces the delayed one.
+	handler.handle(task{tp: taskTypePDHeartbeat, data: heartbeat(4, 2)})
+	require.Len(t, pdClient.reported, 1)
+	assert.Equal(t, uint64(4), pdClient.reported[0].Region.Id)
+
+	flush := <-ch
+	require.Equal(t, taskTypePDFlushHeartbeats, flush.tp)
+	handler.handle(flush)
+	require.Len(t, pdClient.reported, 3)
+	assert.Equal(t, uint64(2), pdClient.reported[1].Region.Id)
+	assert.Equal(t, uint64(3), pdClient.reported[2].Region.Id)
+	assert.Equal(t, uint64(2), pdClient.reported[2].Region.RegionEpoch.Version)
+
+	// The next delayed heartbeat starts a new batch.
+	handler.handle(task{tp: taskTypePDDelayedHeartbeat, data: heartbeat(5, 1)})
+	handler.handle(<-ch)
+	require.Len(t, pdClient.reported, 4)
+	assert.Equal(t, uint64(5), pdClient.reported[3].Region.Id)
+
+	// The flush is retried instead of blocking the timer while the pd worker channel is full.
+	ch <- task{tp: taskTypePDHeartbeat, data: heartbeat(6, 1)}
+	handler.handle(task{tp: taskTypePDDelayedHeartbeat, data: heartbeat(7, 1)})
+	require.Eventually(t, func() bool {
+		return atomic.LoadUint64(&batch.flushRetries) > 0
+	}, 10*time.Second, time.Millisecond)
+	handler.handle(<-ch)
+	handler.handle(<-ch)
+	require.Len(t, pdClient.reported, 6)
+	assert.Equal(t, uint64(7), pdClient.reported[5].Region.Id)
+
+	// The heartbeats are not delayed without the delay window.
+	handler = newPDTaskHandler(1, pdClient, nil, nil, newHeartbeatBatch(0, ch))
+	handler.handle(task{tp: taskTypePDDelayedHeartbeat, data: heartbeat(8, 1)})
+	require.Len(t, pdClient.reported, 7)
+	assert.Len(t, ch, 0)
+}
+
+type mockTSPDClient struct {
+	pd.Client
+	physical int64
+	err      error
+}
+
+func (c *mockTSPDClient) GetTS(ctx context.Context) (int64, int64, error) {
+	return c.physical, 1, c.err
+}
+
+func TestUpdateMaxTS(t *testing.T) {
+	pdClient := &mockTSPDClient{physical: 100, err: errors.New("pd unavailable")}
+	r := newRouter(nil, nil)
+	handler := newPDTaskHandler(1, pdClient, r, nil, nil)
+	oracle := &testCausalTSOracle{}
+	p := &Peer{}
+	p.onMaxTSRoleChanged(raft.StateLeader)
+	require.NotNil(t, p.leaderChecker.maxTSSyncedErr(1).MaxTimestampNotSynced)
+
+	syncTask := func() task {
+		return task{tp: taskTypePDUpdateMaxTS, data: &pdUpdateMaxTSTask{
+			regionID: 1, checker: &p.leaderChecker, state: &p.maxTSSync, seq: p.leaderChecker.maxTSSyncing.Load(),
+			oracle: oracle}}
+	}
+	// The reads are still rejected if PD fails, the sync is retried later.
+	handler.handle(syncTask())
+	assert.NotNil(t, p.leaderChecker.maxTSSyncedErr(1))
+	assert.Equal(t, uint64(0), r.maxTS.load())
+	assert.Equal(t, uint32(1), p.maxTSSync.failures.Load())
+
+	pdClient.err = nil
+	stale := syncTask()
+	// The leader bounces before the sync of the former leadership is done.
+	p.onMaxTSRoleChanged(raft.StateFollower)
+	assert.Nil(t, p.leaderChecker.maxTSSyncedErr(1))
+	p.onMaxTSRoleChanged(raft.StateLeader)
+	handler.handle(stale)
+	assert.NotNil(t, p.leaderChecker.maxTSSyncedErr(1))
+	ts := uint64(100)<<18 + 1
+	assert.Equal(t, ts, r.maxTS.load())
+	assert.Equal(t, []uint64{ts}, oracle.observed)
+
+	pdClient.physical = 200
+	handler.handle(syncTask())
+	assert.Nil(t, p.leaderChecker.maxTSSyncedErr(1))
+	assert.Equal(t, uint64(200)<<18+1, r.maxTS.load())
+	assert.Len(t, oracle.observed, 2)
+	assert.Zero(t, p.maxTSSync.failures.Load())
+}
+
+func TestScheduleMaxTSSync(t *testing.T) {
+	cfg := NewDefaultConfig()
+	cfg.RaftBaseTickInterval = time.Hour
+	ch := make(chan task, 10)
+	p := &Peer{regionID: 1}
+	d := &peerMsgHandler{peerFsm: &peerFsm{peer: p}, ctx: &RaftContext{GlobalContext: &GlobalContext{
+		cfg: cfg, pdTaskSender: ch}}}
+	d.scheduleMaxTSSync()
+	assert.Len(t, ch, 0)
+
+	// Only one sync is in flight.
+	p.onMaxTSRoleChanged(raft.StateLeader)
+	d.scheduleMaxTSSync()
+	d.scheduleMaxTSSync()
+	require.Len(t, ch, 1)
+	pdClient := &mockTSPDClient{physical: 100, err: errors.New("pd unavailable")}
+	handler := newPDTaskHandler(1, pdClient, newRouter(nil, nil), nil, nil)
+	handler.handle(<-ch)
+	assert.False(t, p.maxTSSync.inFlight.Load())
+
+	// The failed sync is retried after the backoff.
+	d.scheduleMaxTSSync()
+	assert.Len(t, ch, 0)
+	p.maxTSSync.lastSent = time.Now().Add(-time.Hour)
+	d.scheduleMaxTSSync()
+	require.Len(t, ch, 1)
+	handler.handle(<-ch)
+	assert.Equal(t, 2*time.Second, p.maxTSSync.backoff(time.Second))
+	assert.Equal(t, maxTSSyncMaxBackoff, p.maxTSSync.backoff(time.Hour))
+
+	pdClient.err = nil
+	p.maxTSSync.lastSent = time.Time{}
+	d.scheduleMaxTSSync()
+	handler.handle(<-ch)
+	assert.Nil(t, p.leaderChecker.maxTSSyncedErr(1))
+	d.scheduleMaxTSSync()
+	assert.Len(t, ch, 0)
+}
+
+func TestMaxTSPDClient(t *testing.T) {
+	pdClient := &mockTSPDClient{physical: 100}
+	r := newRouter(nil, nil)
+	client := (&Router{router: r}).MaxTSPDClient(pdClient)
+	physical, logical, err := client.GetTS(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, int64(100), physical)
+	assert.Equal(t, int64(1), logical)
+
+	// A snapshot raises the max ts above the ts of PD, the min commit ts is kept above the max ts.
+	r.maxTS.raise(uint64(200)<<18+5, nil)
+	physical, logical, err = client.GetTS(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, int64(200), physical)
+	assert.Equal(t, int64(6), logical)
+
+	pdClient.err = errors.New("pd unavailable")
+	_, _, err = client.GetTS(context.Background())
+	assert.NotNil(t, err)
+}
+
+func TestCheckpointPeer(t *testing.T) {
+	cfg := NewDefaultConfig()
+	trans := new(mockTransport)
+	d := newTestStoreMsgHandler(cfg, trans)
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	d.ctx.engine = engines
+	d.ctx.router = newRouter(nil, nil)
+	d.ctx.regionTaskSender = make(chan task, 16)
+	r := &Router{router: d.ctx.router}
+
+	// The region at the checkpoint doesn't contain the new peer yet.
+	region := &metapb.Region{
+		Id:          6,
+		StartKey:    []byte("a"),
+		EndKey:      []byte("z"),
+		RegionEpoch: &metapb.RegionEpoch{ConfVer: 2, Version: 3},
+		Peers:       []*metapb.Peer{{Id: 7, StoreId: 2}},
+	}
+	msg := &rspb.RaftMessage{
+		RegionId:    6,
+		FromPeer:    &metapb.Peer{Id: 7, StoreId: 2},
+		ToPeer:      &metapb.Peer{Id: 8, StoreId: 1},
+		RegionEpoch: &metapb.RegionEpoch{ConfVer: 3, Version: 3},
+		StartKey:    []byte("a"),
+		EndKey:      []byte("z"),
+		Message:     &eraftpb.Message{MsgType: eraftpb.MessageType_MsgHeartbeat},
+	}
+	assert.NotNil(t, r.AddCheckpoint(&RegionCheckpoint{Region: region, Index: 1, Term: 1}))
+	assert.NotNil(t, r.AddCheckpoint(&RegionCheckpoint{Region: &metapb.Region{Id: 6}, Index: 10, Term: 6}))
+
+	// A checkpoint taken before a split is skipped.
+	require.Nil(t, r.AddCheckpoint(&RegionCheckpoint{Region: region, Index: 10, Term: 6}))
+	msg.RegionEpoch.Version = 4
+	peer, err := d.maybeCreateCheckpointPeer(6, msg)
+	require.Nil(t, err)
+	assert.Nil(t, peer)
+	msg.RegionEpoch.Version = 3
+	peer, err = d.maybeCreateCheckpointPeer(6, msg)
+	require.Nil(t, err)
+	assert.Nil(t, peer, "a checkpoint is used at most once")
+
+	require.Nil(t, r.AddCheckpoint(&RegionCheckpoint{Region: region, Index: 10, Term: 6}))
+	peer, err = d.maybeCreateCheckpointPeer(6, msg)
+	require.Nil(t, err)
+	require.NotNil(t, peer)
+	assert.True(t, peer.peer.isInitialized())
+	assert.Equal(t, uint64(10), peer.peer.Store().AppliedIndex())
+	assert.Equal(t, uint64(10), peer.peer.Store().truncatedIndex())
+	lastIdx, err := peer.peer.Store().LastIndex()
+	require.Nil(t, err)
+	assert.Equal(t, uint64(10), lastIdx)
+	term, err := peer.peer.Store().Term(10)
+	require.Nil(t, err)
+	assert.Equal(t, uint64(6), term)
+
+	h := newRaftMsgHandler(peer, &RaftContext{GlobalContext: d.ctx.GlobalContext})
+	appendMsg := func(index, logTerm uint64) *rspb.RaftMessage {
+		return &rspb.RaftMessage{
+			RegionId:    6,
+			FromPeer:    msg.FromPeer,
+			ToPeer:      msg.ToPeer,
+			RegionEpoch: msg.RegionEpoch,
+			Message: &eraftpb.Message{MsgType: eraftpb.MessageType_MsgAppend, From: 7, To: 8, Term: 7,
+				Index: index, LogTerm: logTerm},
+		}
+	}
+	// The appends before the proof of the continuity are left to raft.
+	assert.False(t, h.checkCheckpointContinuity(appendMsg(12, 7)))
+	assert.NotNil(t, h.peer.checkpoint)
+
+	// The log of the leader diverges at the checkpoint, the appends are rejected until a snapshot arrives.
+	assert.True(t, h.checkCheckpointContinuity(appendMsg(10, 5)))
+	assert.True(t, h.checkCheckpointContinuity(appendMsg(9, 5)))
+	require.Len(t, trans.msgs, 2)
+	reject := trans.msgs[1].Message
+	assert.Equal(t, eraftpb.MessageType_MsgAppendResponse, reject.MsgType)
+	assert.True(t, reject.Reject)
+	assert.Equal(t, uint64(9), reject.Index)
+	assert.Equal(t, uint64(0), reject.RejectHint)
+	assert.Equal(t, uint64(7), reject.Term)
+	snapMsg := appendMsg(0, 0)
+	snapMsg.Message.MsgType = eraftpb.MessageType_MsgSnapshot
+	assert.False(t, h.checkCheckpointContinuity(snapMsg))
+	assert.Nil(t, h.peer.checkpoint)
+
+	// The log of the leader continues from the checkpoint.
+	h.peer.checkpoint = &checkpointState{index: 10, term: 6}
+	assert.False(t, h.checkCheckpointContinuity(appendMsg(10, 6)))
+	assert.Nil(t, h.peer.checkpoint)
+}
+
+func TestCompactionRecalculatesSize(t *testing.T) {
+	cfg := NewDefaultConfig()
+	cfg.SizeRecalcDeclinedBytes = 100
+	d := newTestStoreMsgHandler(cfg, new(mockTransport))
+	d.ctx.router = newRouter(nil, nil)
+	meta := d.ctx.storeMeta
+	meta.regions[2] = &metapb.Region{Id: 2, EndKey: []byte("b"), Peers: []*metapb.Peer{{Id: 3, StoreId: 1}}}
+	meta.regions[4] = &metapb.Region{Id: 4, StartKey: []byte("b"), EndKey: []byte("d"), Peers: []*metapb.Peer{{Id: 5, StoreId: 1}}}
+	meta.regions[6] = &metapb.Region{Id: 6, StartKey: []byte("d"), Peers: []*metapb.Peer{{Id: 7, StoreId: 1}}}
+	meta.regions[8] = &metapb.Region{Id: 8, RegionEpoch: &metapb.RegionEpoch{}}
+	for id := range meta.regions {
+		d.ctx.router.peers.Store(id, &peerState{})
+	}
+	recalculated := func() []uint64 {
+		var ids []uint64
+		for len(d.ctx.router.peerSender) > 0 {
+			msg := <-d.ctx.router.peerSender
+			assert.Equal(t, MsgTypeRecalculateRegionSize, msg.Type)
+			ids = append(ids, msg.RegionID)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		return ids
+	}
+
+	// A compaction declining few bytes is ignored.
+	d.onCompactionFinished(&rocksdb.CompactedEvent{TotalInputBytes: 150, TotalOutputBytes: 100, StartKey: []byte("a"), EndKey: []byte("c")})
+	assert.Nil(t, recalculated())
+
+	d.onCompactionFinished(&rocksdb.CompactedEvent{TotalInputBytes: 300, TotalOutputBytes: 100, StartKey: []byte("a"), EndKey: []byte("c")})
+	assert.Equal(t, []uint64{2, 4}, recalculated())
+	d.onCompactionFinished(&rocksdb.CompactedEvent{TotalInputBytes: 300, StartKey: []byte("b"), EndKey: []byte("d")})
+	assert.Equal(t, []uint64{4}, recalculated())
+	d.onCompactionFinished(&rocksdb.CompactedEvent{TotalInputBytes: 300, StartKey: []byte("c")})
+	assert.Equal(t, []uint64{4, 6}, recalculated())
+
+	cfg.SizeRecalcDeclinedBytes = 0
+	d.onCompactionFinished(&rocksdb.CompactedEvent{TotalInputBytes: 300, StartKey: []byte("a")})
+	assert.Nil(t, recalculated())
+}
+
+type timedTransport struct {
+	sent chan *rspb.RaftMessage
+}
+
+func (t *timedTransport) Send(msg *rspb.RaftMessage) error {
+	t.sent <- msg
+	return nil
+}
+
+func TestWANTransport(t *testing.T) {
+	inner := &timedTransport{sent: make(chan *rspb.RaftMessage, 16)}
+	trans := NewWANTransport(inner)
+	defer trans.Close()
+	newMsg := func(from, to uint64, size int) *rspb.RaftMessage {
+		return &rspb.RaftMessage{
+			FromPeer: &metapb.Peer{StoreId: from},
+			ToPeer:   &metapb.Peer{StoreId: to},
+			Message:  &eraftpb.Message{Context: make([]byte, size)},
+		}
+	}
+
+	// The messages without a link are sent directly.
+	require.Nil(t, trans.Send(newMsg(1, 2, 10)))
+	assert.Len(t, inner.sent, 1)
+	<-inner.sent
+
+	// The messages are delayed by the latency and kept in order.
+	trans.SetLink(1, 2, WANLink{Latency: UniformLatency{Min: 20 * time.Millisecond, Max: 60 * time.Millisecond}})
+	start := time.Now()
+	for i := 1; i <= 5; i++ {
+		require.Nil(t, trans.Send(newMsg(1, 2, i)))
+	}
+	for i := 1; i <= 5; i++ {
+		msg := <-inner.sent
+		assert.Len(t, msg.Message.Context, i)
+	}
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+
+	// A link transmits its bandwidth in a second, the first 1/10 second is the burst.
+	trans.SetLinks(2, 3, WANLink{Bandwidth: 100000, Latency: FixedLatency(0)})
+	start = time.Now()
+	for i := 0; i < 3; i++ {
+		require.Nil(t, trans.Send(newMsg(3, 2, 9990)))
+	}
+	for i := 0; i < 3; i++ {
+		<-inner.sent
+	}
+	assert.True(t, time.Since(start) >= 190*time.Millisecond)
+	assert.Equal(t, uint64(0), trans.Dropped())
+	sent, dropped := trans.LinkDrops(3, 2)
+	assert.Equal(t, uint64(3), sent)
+	assert.Equal(t, uint64(0), dropped)
+
+	r := rand.New(rand.NewSource(1))
+	assert.Equal(t, time.Duration(0), NormalLatency{Mean: -time.Second}.Sample(r))
+	assert.Equal(t, time.Second, FixedLatency(time.Second).Sample(r))
+}
+
+func TestFaultTransport(t *testing.T) {
+	inner := &timedTransport{sent: make(chan *rspb.RaftMessage, 16)}
+	trans := NewFaultTransport(inner)
+	defer trans.Close()
+	newMsg := func(regionID, from, to uint64, index uint64) *rspb.RaftMessage {
+		return &rspb.RaftMessage{
+			RegionId: regionID,
+			FromPeer: &metapb.Peer{StoreId: from},
+			ToPeer:   &metapb.Peer{StoreId: to},
+			Message:  &eraftpb.Message{Index: index},
+		}
+	}
+	received := func() []uint64 {
+		var indexes []uint64
+		for len(inner.sent) > 0 {
+			indexes = append(indexes, (<-inner.sent).Message.Index)
+		}
+		return indexes
+	}
+
+	// A partition drops the messages between the groups only.
+	trans.Partition([]uint64{1}, []uint64{2, 3})
+	require.Nil(t, trans.Send(newMsg(1, 1, 2, 1)))
+	require.Nil(t, trans.Send(newMsg(1, 3, 1, 2)))
+	require.Nil(t, trans.Send(newMsg(1, 2, 3, 3)))
+	assert.Equal(t, []uint64{3}, received())
+
+	// The store filters are checked before the region filters.
+	trans.ClearFilters()
+	trans.SetFilter(2, func(*rspb.RaftMessage) Fault { return Fault{Action: FaultDuplicate} })
+	trans.SetStoreFilter(1, 2, func(msg *rspb.RaftMessage) Fault {
+		if msg.Message.Index == 1 {
+			return Fault{Action: FaultReorder}
+		}
+		return Fault{}
+	})
+	require.Nil(t, trans.Send(newMsg(1, 1, 2, 1)))
+	assert.Empty(t, received())
+	require.Nil(t, trans.Send(newMsg(2, 1, 2, 2)))
+	assert.Equal(t, []uint64{2, 2, 1}, received())
+
+	// The delayed messages are sent later.
+	trans.SetFilter(0, func(*rspb.RaftMessage) Fault { return Fault{Action: FaultDelay, Delay: 20 * time.Millisecond} })
+	start := time.Now()
+	require.Nil(t, trans.Send(newMsg(1, 2, 3, 4)))
+	assert.Equal(t, uint64(4), (<-inner.sent).Message.Index)
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+	trans.SetFilter(0, nil)
+	require.Nil(t, trans.Send(newMsg(1, 2, 3, 5)))
+	assert.Equal(t, []uint64{5}, received())
+	assert.Equal(t, FaultStats{Dropped: 2, Delayed: 1, Duplicated: 1, Reordered: 1}, trans.Stats())
+}
+
+func TestMessageFilters(t *testing.T) {
+	inner := &timedTransport{sent: make(chan *rspb.RaftMessage, 16)}
+	filters := new(messageFilters)
+	trans := &filterTransport{inner: inner, filters: filters}
+	newMsg := func(from, to uint64, index uint64) *rspb.RaftMessage {
+		return &rspb.RaftMessage{
+			RegionId: 1,
+			FromPeer: &metapb.Peer{StoreId: from},
+			ToPeer:   &metapb.Peer{StoreId: to},
+			Message:  &eraftpb.Message{Index: index},
+		}
+	}
+
+	// The filters are composed in the order of registration, the later ones see the modifications.
+	var seen []uint64
+	bump := filters.add(MessageFilterFunc(func(dir MessageDirection, msg *rspb.RaftMessage) bool {
+		msg.Message.Index += 10
+		return true
+	}))
+	isolate := filters.add(IsolateStoresFilter(3))
+	filters.add(MessageFilterFunc(func(dir MessageDirection, msg *rspb.RaftMessage) bool {
+		if dir == MessageInbound {
+			seen = append(seen, msg.Message.Index)
+		}
+		return true
+	}))
+	require.Nil(t, trans.Send(newMsg(1, 2, 1)))
+	require.Nil(t, trans.Send(newMsg(1, 3, 2)))
+	assert.Equal(t, uint64(11), (<-inner.sent).Message.Index)
+	assert.Empty(t, inner.sent)
+	assert.True(t, filters.pass(MessageInbound, newMsg(2, 1, 3)))
+	assert.False(t, filters.pass(MessageInbound, newMsg(3, 1, 4)))
+	assert.Equal(t, []uint64{13}, seen)
+
+	// The filters can be removed at runtime.
+	assert.True(t, filters.remove(isolate))
+	assert.False(t, filters.remove(isolate))
+	assert.True(t, filters.remove(bump))
+	require.Nil(t, trans.Send(newMsg(1, 3, 5)))
+	assert.Equal(t, uint64(5), (<-inner.sent).Message.Index)
+	assert.True(t, filters.pass(MessageInbound, newMsg(3, 1, 6)))
+	assert.Equal(t, []uint64{13, 6}, seen)
+}
+
+func TestFailPendingCallbacksOnShutdown(t *testing.T) {
+	ps := newTestPeerStorage(t)
+	defer cleanUpTestData(ps)
+	rn, err := raft.NewRawNode(&raft.Config{
+		ID:              1,
+		ElectionTick:    10,
+		HeartbeatTick:   2,
+		Storage:         ps,
+		Applied:         ps.AppliedIndex(),
+		MaxInflightMsgs: 256,
+	}, nil)
+	require.Nil(t, err)
+	regionID := ps.region.Id
+	p := &Peer{regionID: regionID, RaftGroup: rn, peerStorage: ps, pendingReads: new(ReadIndexQueue)}
+	var cbs []*Callback
+	newCb := func() *Callback {
+		cb := NewCallback()
+		cbs = append(cbs, cb)
+		return cb
+	}
+	p.applyProposals = []*proposal{{index: 6, term: 5, cb: newCb()}}
+	p.pendingReads.reads = []*ReadIndexRequest{{cmds: []*ReqCbPair{{Cb: newCb()}, {Cb: newCb()}}}}
+	p.snapWaiters = []*MsgRaftCmd{{Callback: newCb()}}
+	a := &applier{id: 1, region: ps.region, applyState: applyState{appliedIndex: 5}}
+	a.pendingCmds.appendNormal(pendingCmd{index: 7, term: 5, cb: newCb()})
+
+	r := newRouter(nil, nil)
+	r.peers.Store(regionID, &peerState{peer: &peerFsm{peer: p}, apply: a})
+	r.peerSender <- NewPeerMsg(MsgTypeRaftCmd, regionID, &MsgRaftCmd{Callback: newCb()})
+	rw := &raftWorker{paused: map[uint64][]Msg{
+		regionID: {NewPeerMsg(MsgTypeRaftCmd, regionID, &MsgRaftCmd{Callback: newCb()})},
+	}}
+	bs := &raftBatchSystem{ctx: &GlobalContext{engine: ps.Engines}, router: r, raftWorker: rw}
+	bs.failPendingCallbacks()
+
+	// Every callback is failed exactly once with a deterministic error.
+	for _, cb := range cbs {
+		cb.wg.Wait()
+		require.NotNil(t, cb.resp.Header.Error.RegionNotFound)
+	}
+	assert.Empty(t, p.applyProposals)
+	assert.Empty(t, p.pendingReads.reads)
+	assert.Empty(t, p.snapWaiters)
+	assert.Empty(t, a.pendingCmds.normals)
+	assert.Empty(t, rw.paused)
+	assert.Len(t, r.peerSender, 0)
+
+	// The state is recovered once by the restarted peer.
+	raftWB := new(WriteBatch)
+	require.Nil(t, p.recoverSchedulerState(raftWB))
+	require.Nil(t, raftWB.WriteToRaft(ps.Engines.raft))
+	want := SchedulerState{LastProposedIndex: rn.Raft.RaftLog.LastIndex(), AppliedIndex: 5, OutstandingCallbacks: 7}
+	state, ok, err := (&Router{router: r}).LastShutdownState(regionID)
+	require.Nil(t, err)
+	require.True(t, ok)
+	assert.Equal(t, want, state)
+	p.lastShutdown = nil
+	require.Nil(t, p.recoverSchedulerState(new(WriteBatch)))
+	assert.Nil(t, p.lastShutdown)
+}
+
+func TestRegionHistory(t *testing.T) {
+	r := &Router{router: newRouter(nil, nil)}
+	g := &r.router.genealogy
+	newRegion := func(id uint64, start, end string, version uint64) *metapb.Region {
+		return &metapb.Region{Id: id, StartKey: []byte(start), EndKey: []byte(end), RegionEpoch: &metapb.RegionEpoch{Version: version}}
+	}
+	t0 := time.Now()
+	g.recordSplit(1, 10, []*metapb.Region{newRegion(1, "", "m", 2), newRegion(2, "m", "", 2)})
+	t1 := time.Now()
+	g.recordSplit(2, 20, []*metapb.Region{newRegion(2, "m", "t", 3), newRegion(3, "t", "", 3)})
+	t2 := time.Now()
+	g.recordMerge(newRegion(2, "m", "", 4), newRegion(3, "t", "", 3), 30)
+
+	assert.Len(t, r.RegionHistory(0), 3)
+	events := r.RegionHistory(3)
+	require.Len(t, events, 2)
+	assert.Equal(t, RegionEventSplit, events[0].Type)
+	assert.Equal(t, uint64(20), events[0].Index)
+	assert.Equal(t, RegionEventMerge, events[1].Type)
+	assert.Equal(t, []uint64{2, 3}, events[1].Parents)
+
+	// A key is owned by region 2, then region 3 after the split and region 2 again after the merge.
+	_, ok := r.LocateKeyAt([]byte("x"), t0)
+	assert.False(t, ok)
+	for _, c := range []struct {
+		at time.Time
+		id uint64
+	}{{t1, 2}, {t2, 3}, {time.Now(), 2}} {
+		id, ok := r.LocateKeyAt([]byte("x"), c.at)
+		assert.True(t, ok)
+		assert.Equal(t, c.id, id)
+	}
+
+	w := httptest.NewRecorder()
+	r.RegionHistoryHandler().ServeHTTP(w, httptest.NewRequest("GET", "/debug/region_history?key=78&time="+t2.Format(time.RFC3339Nano), nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"region_id":3,"found":true}`, w.Body.String())
+	w = httptest.NewRecorder()
+	r.RegionHistoryHandler().ServeHTTP(w, httptest.NewRequest("GET", "/debug/region_history?region=x", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestRecoveryProgress(t *testing.T) {
+	cfg := NewDefaultConfig()
+	cfg.RecoveryProgressInterval = time.Nanosecond
+	var mu sync.Mutex
+	var reports []RecoveryProgress
+	cfg.OnRecoveryProgress = func(p RecoveryProgress) {
+		mu.Lock()
+		reports = append(reports, p)
+		mu.Unlock()
+	}
+	r := &Router{router: &router{}}
+	_, ok := r.RecoveryProgress()
+	assert.False(t, ok)
+
+	phase := r.router.recovery.begin(cfg, 1, RecoveryPhaseCreate, 100)
+	visited := make([]int32, 100)
+	require.Nil(t, runParallel(4, 100, func(w, i int) error {
+		assert.True(t, w >= 0 && w < 4)
+		visited[i]++
+		phase.advance()
+		return nil
+	}))
+	for i := range visited {
+		assert.Equal(t, int32(1), visited[i])
+	}
+	phase.finish()
+	progress, ok := r.RecoveryProgress()
+	require.True(t, ok)
+	assert.Equal(t, RecoveryProgress{StoreID: 1, Phase: RecoveryPhaseCreate, Done: 100, Total: 100,
+		Finished: true, Elapsed: progress.Elapsed}, progress)
+	require.True(t, len(reports) > 2)
+	assert.Equal(t, 0, reports[0].Done)
+	assert.Equal(t, progress, reports[len(reports)-1])
+
+	// The workers stop at the first error.
+	err := runParallel(4, 100, func(_, i int) error {
+		if i >= 10 {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	assert.EqualError(t, err, "failed")
+}
+
+func TestOperatorMsg(t *testing.T) {
+	epoch := &metapb.RegionEpoch{ConfVer: 2, Version: 3}
+	target := &metapb.Peer{Id: 11, StoreId: 1}
+	newResp := func() *pdpb.RegionHeartbeatResponse {
+		return &pdpb.RegionHeartbeatResponse{RegionId: 1, RegionEpoch: epoch, TargetPeer: target}
+	}
+	adminReq := func(msg *Msg) *raft_cmdpb.RaftCmdRequest {
+		require.Equal(t, MsgTypeRaftCmd, msg.Type)
+		req := msg.Data.(*MsgRaftCmd).Request.GetRaftCmdRequest()
+		assert.Equal(t, uint64(1), req.Header.RegionId)
+		assert.Equal(t, target, req.Header.Peer)
+		assert.Equal(t, epoch, req.Header.RegionEpoch)
+		return req
+	}
+
+	msg, err := operatorMsg(newResp())
+	require.Nil(t, err)
+	assert.Nil(t, msg)
+
+	resp := newResp()
+	addPeer := &pdpb.ChangePeer{ChangeType: eraftpb.ConfChangeType_AddNode, Peer: &metapb.Peer{Id: 12, StoreId: 2}}
+	resp.ChangePeer = addPeer
+	msg, err = operatorMsg(resp)
+	require.Nil(t, err)
+	req := adminReq(msg)
+	assert.Equal(t, raft_cmdpb.AdminCmdType_ChangePeer, req.AdminRequest.CmdType)
+	assert.Equal(t, addPeer.Peer, req.AdminRequest.ChangePeer.Peer)
+
+	// A single change of ChangePeerV2 is executed as ChangePeer.
+	resp = newResp()
+	resp.ChangePeerV2 = &pdpb.ChangePeerV2{Changes: []*pdpb.ChangePeer{addPeer}}
+	msg, err = operatorMsg(resp)
+	require.Nil(t, err)
+	assert.Equal(t, eraftpb.ConfChangeType_AddNode, adminReq(msg).AdminRequest.ChangePeer.ChangeType)
+	resp.ChangePeerV2.Changes = append(resp.ChangePeerV2.Changes, addPeer)
+	_, err = operatorMsg(resp)
+	assert.NotNil(t, err)
+	resp.ChangePeerV2.Changes = nil
+	msg, err = operatorMsg(resp)
+	require.Nil(t, err)
+	assert.Nil(t, msg)
+
+	resp = newResp()
+	resp.TransferLeader = &pdpb.TransferLeader{Peer: &metapb.Peer{Id: 12, StoreId: 2}}
+	msg, err = operatorMsg(resp)
+	require.Nil(t, err)
+	req = adminReq(msg)
+	assert.Equal(t, raft_cmdpb.AdminCmdType_TransferLeader, req.AdminRequest.CmdType)
+	assert.Equal(t, uint64(12), req.AdminRequest.TransferLeader.Peer.Id)
+
+	resp = newResp()
+	resp.SplitRegion = &pdpb.SplitRegion{Policy: pdpb.CheckPolicy_APPROXIMATE}
+	msg, err = operatorMsg(resp)
+	require.Nil(t, err)
+	assert.Equal(t, MsgTypeHalfSplitRegion, msg.Type)
+	assert.Equal(t, epoch, msg.Data.(*MsgHalfSplitRegion).RegionEpoch)
+	resp.SplitRegion = &pdpb.SplitRegion{Policy: pdpb.CheckPolicy_USEKEY, Keys: [][]byte{[]byte("k")}}
+	msg, err = operatorMsg(resp)
+	require.Nil(t, err)
+	assert.Equal(t, MsgTypeSplitRegion, msg.Type)
+	assert.Equal(t, [][]byte{[]byte("k")}, msg.Data.(*MsgSplitRegion).SplitKeys)
+	resp.SplitRegion.Keys = nil
+	_, err = operatorMsg(resp)
+	assert.NotNil(t, err)
+
+	resp = newResp()
+	resp.Merge = &pdpb.Merge{Target: &metapb.Region{Id: 2}}
+	msg, err = operatorMsg(resp)
+	require.Nil(t, err)
+	req = adminReq(msg)
+	assert.Equal(t, raft_cmdpb.AdminCmdType_PrepareMerge, req.AdminRequest.CmdType)
+	assert.Equal(t, uint64(2), req.AdminRequest.PrepareMerge.Target.Id)
+}
+
+func TestRegionConsistencyReport(t *testing.T) {
+	region := &metapb.Region{Id: 1, RegionEpoch: &metapb.RegionEpoch{ConfVer: 1, Version: 1}}
+	newReplicas := func() []ReplicaState {
+		var replicas []ReplicaState
+		for storeID := uint64(3); storeID >= 1; storeID-- {
+			replicas = append(replicas, ReplicaState{StoreID: storeID, Region: region, AppliedIndex: 10,
+				AppliedTerm: 6, Hash: "abcd"})
+		}
+		return replicas
+	}
+	report := &RegionConsistencyReport{RegionID: 1, Replicas: newReplicas()}
+	report.compare()
+	assert.True(t, report.Converged)
+	assert.Empty(t, report.Mismatches)
+	assert.Equal(t, uint64(1), report.Replicas[0].StoreID)
+
+	// The hashes are not compared at different applied indexes.
+	report = &RegionConsistencyReport{RegionID: 1, Replicas: newReplicas()}
+	report.Replicas[0].AppliedIndex, report.Replicas[0].Hash = 11, "ef01"
+	report.Replicas[1].Hash = "ef01"
+	report.compare()
+	assert.False(t, report.Converged)
+	require.Len(t, report.Mismatches, 2)
+	assert.Equal(t, "hash of store 2 is ef01, but abcd on store 1", report.Mismatches[0])
+	assert.Equal(t, "applied index of store 3 is 11, but 10 on store 1", report.Mismatches[1])
+
+	report = &RegionConsistencyReport{RegionID: 1, Replicas: newReplicas()}
+	report.Replicas[0].Region = &metapb.Region{Id: 1, RegionEpoch: &metapb.RegionEpoch{ConfVer: 1, Version: 2}}
+	report.compare()
+	assert.Equal(t, []string{"epoch of store 3 is conf_ver 1 version 2, but conf_ver 1 version 1 on store 1"},
+		report.Mismatches)
+
+	report = &RegionConsistencyReport{RegionID: 1, Replicas: newReplicas()[:1],
+		Errors: map[uint64]string{2: "store 2 not found"}}
+	report.compare()
+	assert.False(t, report.Converged)
+}
@@ -0,0 +1,227 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"sync/atomic"
+
+	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/pingcap/log"
+	"github.com/zhangjinpeng1987/raft"
+	"go.uber.org/zap"
+)
+
+// hibernateState stops ticking the raft group of an idle region. The leader asks the followers to hibernate
+// after HibernateIdleTicks idle ticks, and hibernates itself once all of them agree. A follower hibernates
+// when it agrees, it doesn't campaign because it doesn't tick. Any raft message or proposal wakes the peer up,
+// a follower woken by a local request wakes the leader up too.
+type hibernateState struct {
+	idleTicks int
+	// votes are the peers agreeing to hibernate in the term.
+	votes map[uint64]struct{}
+	term  uint64
+
+	// hibernated is read by Router.IsHibernated concurrently.
+	hibernated uint32
+}
+
+func newHibernateState(cfg *Config) *hibernateState {
+	if !cfg.HibernateRegions {
+		return nil
+	}
+	return &hibernateState{votes: make(map[uint64]struct{})}
+}
+
+func (s *hibernateState) isHibernated() bool {
+	return s != nil && atomic.LoadUint32(&s.hibernated) == 1
+}
+
+func (s *hibernateState) setHibernated(hibernated bool) {
+	var v uint32
+	if hibernated {
+		v = 1
+	}
+	atomic.StoreUint32(&s.hibernated, v)
+}
+
+// reset clears the idle ticks and the votes, it returns true if the peer was hibernated.
+func (s *hibernateState) reset() bool {
+	s.idleTicks = 0
+	if len(s.votes) > 0 {
+		s.votes = make(map[uint64]struct{})
+	}
+	if !s.isHibernated() {
+		return false
+	}
+	s.setHibernated(false)
+	return true
+}
+
+// readyToHibernate returns true if the leader has nothing to replicate and nothing in flight.
+func (p *Peer) readyToHibernate() bool {
+	if !p.IsLeader() || p.isSplitting() || p.isMerging() || p.HasPendingSnapshot() || p.IsApplyingSnapshot() {
+		return false
+	}
+	if len(p.proposals.queue) > 0 || len(p.applyProposals) > 0 || len(p.pendingReads.reads) > 0 {
+		return false
+	}
+	if p.snapSource != nil && len(p.snapSource.relays) > 0 {
+		return false
+	}
+	status := p.RaftGroup.StatusWithoutProgress()
+	lastIndex := p.RaftGroup.Raft.RaftLog.LastIndex()
+	if status.LeadTransferee != 0 || status.Commit != lastIndex || p.Store().AppliedIndex() != lastIndex {
+		return false
+	}
+	for _, prs := range []map[uint64]*raft.Progress{p.RaftGroup.Raft.Prs, p.RaftGroup.Raft.LearnerPrs} {
+		for id, pr := range prs {
+			if id != p.PeerID() && pr.Match != lastIndex {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// readyToHibernateFollower returns true if the follower has applied all the entries of the leader.
+func (p *Peer) readyToHibernateFollower(leaderID, term uint64) bool {
+	if p.IsLeader() || p.LeaderID() != leaderID || p.Term() != term {
+		return false
+	}
+	if p.HasPendingSnapshot() || p.IsApplyingSnapshot() || len(p.pendingReads.reads) > 0 {
+		return false
+	}
+	return p.Store().AppliedIndex() == p.RaftGroup.Raft.RaftLog.LastIndex()
+}
+
+func (p *Peer) newHibernateMessage(tp rspb.ExtraMessageType, to *metapb.Peer) *rspb.RaftMessage {
+	return &rspb.RaftMessage{
+		RegionId:    p.regionID,
+		FromPeer:    p.Meta,
+		ToPeer:      to,
+		RegionEpoch: p.Region().RegionEpoch,
+		Message:     &eraftpb.Message{From: p.PeerID(), To: to.Id, Term: p.Term()},
+		ExtraMsg:    &rspb.ExtraMessage{Type: tp},
+	}
+}
+
+func isHibernateMessage(msg *rspb.RaftMessage) bool {
+	if msg.GetExtraMsg() == nil {
+		return false
+	}
+	switch msg.ExtraMsg.Type {
+	case rspb.ExtraMessageType_MsgHibernateRequest, rspb.ExtraMessageType_MsgHibernateResponse,
+		rspb.ExtraMessageType_MsgRegionWakeUp:
+		return true
+	}
+	return false
+}
+
+// maybeHibernate counts the idle ticks of the leader, it asks the followers to hibernate when the region is
+// idle long enough and hibernates when all of them agree.
+func (d *peerMsgHandler) maybeHibernate() {
+	s := d.peer.hibernate
+	if s == nil || !d.peer.IsLeader() {
+		return
+	}
+	if !d.peer.readyToHibernate() {
+		s.reset()
+		return
+	}
+	if s.term != d.peer.Term() {
+		s.term = d.peer.Term()
+		s.votes = make(map[uint64]struct{})
+	}
+	s.idleTicks++
+	if s.idleTicks < d.ctx.cfg.HibernateIdleTicks {
+		return
+	}
+	var waiting bool
+	for _, peer := range d.region().Peers {
+		if peer.Id == d.peer.PeerID() {
+			continue
+		}
+		if _, ok := s.votes[peer.Id]; ok {
+			continue
+		}
+		waiting = true
+		msg := d.peer.newHibernateMessage(rspb.ExtraMessageType_MsgHibernateRequest, peer)
+		if err := d.ctx.trans.Send(msg); err != nil {
+			log.Debug("failed to send hibernate request", zap.String("tag", d.tag()), zap.Error(err))
+		}
+	}
+	if !waiting {
+		log.Debug("region hibernates", zap.String("tag", d.tag()), zap.Int("idle ticks", s.idleTicks))
+		s.setHibernated(true)
+	}
+}
+
+func (d *peerMsgHandler) onHibernateMessage(msg *rspb.RaftMessage) {
+	s := d.peer.hibernate
+	if s == nil {
+		return
+	}
+	from := msg.GetFromPeer()
+	switch msg.ExtraMsg.Type {
+	case rspb.ExtraMessageType_MsgHibernateRequest:
+		if !d.peer.readyToHibernateFollower(from.Id, msg.Message.Term) {
+			d.wakeUp(false)
+			return
+		}
+		resp := d.peer.newHibernateMessage(rspb.ExtraMessageType_MsgHibernateResponse, from)
+		if err := d.ctx.trans.Send(resp); err != nil {
+			log.Debug("failed to send hibernate response", zap.String("tag", d.tag()), zap.Error(err))
+			return
+		}
+		s.setHibernated(true)
+	case rspb.ExtraMessageType_MsgHibernateResponse:
+		if d.peer.IsLeader() && msg.Message.Term == d.peer.Term() && s.term == d.peer.Term() {
+			s.votes[from.Id] = struct{}{}
+		}
+	case rspb.ExtraMessageType_MsgRegionWakeUp:
+		d.wakeUp(false)
+	}
+}
+
+// wakeUp resumes ticking the raft group. A follower woken up by a local request wakes the leader up as well,
+// otherwise it may campaign before the hibernated leader sends any heartbeat.
+func (d *peerMsgHandler) wakeUp(local bool) {
+	s := d.peer.hibernate
+	if s == nil || !s.reset() {
+		return
+	}
+	log.Debug("region wakes up", zap.String("tag", d.tag()))
+	if !local || d.peer.IsLeader() {
+		return
+	}
+	leader := d.peer.getPeerFromCache(d.peer.LeaderID())
+	if leader == nil {
+		return
+	}
+	msg := d.peer.newHibernateMessage(rspb.ExtraMessageType_MsgRegionWakeUp, leader)
+	if err := d.ctx.trans.Send(msg); err != nil {
+		log.Debug("failed to send wake up message", zap.String("tag", d.tag()), zap.Error(err))
+	}
+}
+
+// IsHibernated returns true if the peer of the region on the store stops ticking its raft group.
+func (r *Router) IsHibernated(regionID uint64) (bool, error) {
+	p := r.router.get(regionID)
+	if p == nil {
+		return false, errPeerNotFound
+	}
+	return p.peer.peer.hibernate.isHibernated(), nil
+}
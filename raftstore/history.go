@@ -0,0 +1,162 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
+)
+
+// HistoryInput is the invocation of an operation recorded by a HistoryRecorder.
+type HistoryInput struct {
+	RegionID uint64
+	// Write is true if the command has a put or a delete, false for the reads.
+	Write bool
+	// Admin is the admin command type of an admin command.
+	Admin raft_cmdpb.AdminCmdType
+	Keys  [][]byte
+}
+
+// HistoryOutput is the response of an operation recorded by a HistoryRecorder.
+type HistoryOutput struct {
+	// Index is the applied index of a write or the read index of a read index request, 0 if it is unknown.
+	Index uint64
+	Err   string
+}
+
+// HistoryOperation is an operation in the format of porcupine.Operation, the times are the nanoseconds since
+// the recorder is created. The Return of a failed write is math.MaxInt64, because the write may or may not
+// take effect, so the checker assumes it can be linearized at any time after its invocation.
+type HistoryOperation struct {
+	// ClientId identifies the command, every command is a client of its own.
+	ClientId int
+	Input    HistoryInput
+	Call     int64
+	Output   HistoryOutput
+	Return   int64
+}
+
+// HistoryRecorder records the commands sent through the Routers of a cluster and their responses, so the
+// linearizability of the lease and read index reads can be checked after a chaos run. The applied index of a
+// region is a counter, a read linearized after a write must observe an index not smaller than the write.
+type HistoryRecorder struct {
+	start time.Time
+
+	mu      sync.Mutex
+	nextID  int
+	history []HistoryOperation
+}
+
+// NewHistoryRecorder creates a HistoryRecorder.
+func NewHistoryRecorder() *HistoryRecorder {
+	return &HistoryRecorder{start: time.Now()}
+}
+
+func (h *HistoryRecorder) now() int64 {
+	return int64(time.Since(h.start))
+}
+
+// invoke records the invocation of the command, the response is recorded when the callback is done. A
+// command failed to be sent is never proposed, so it is not recorded.
+func (h *HistoryRecorder) invoke(req *raft_cmdpb.RaftCmdRequest, cb *Callback) {
+	input := HistoryInput{RegionID: req.GetHeader().GetRegionId()}
+	if req.AdminRequest != nil {
+		input.Admin = req.AdminRequest.CmdType
+	}
+	for _, r := range req.Requests {
+		switch r.CmdType {
+		case raft_cmdpb.CmdType_Put:
+			input.Write = true
+			input.Keys = append(input.Keys, r.Put.GetKey())
+		case raft_cmdpb.CmdType_Delete:
+			input.Write = true
+			input.Keys = append(input.Keys, r.Delete.GetKey())
+		case raft_cmdpb.CmdType_Get:
+			input.Keys = append(input.Keys, r.Get.GetKey())
+		}
+	}
+	h.mu.Lock()
+	h.nextID++
+	id := h.nextID
+	h.mu.Unlock()
+	call := &historyCall{recorder: h, op: HistoryOperation{ClientId: id, Input: input, Call: h.now()}}
+	cb.onDone = call.done
+}
+
+// Operations returns the recorded operations in the order of their responses.
+func (h *HistoryRecorder) Operations() []HistoryOperation {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]HistoryOperation{}, h.history...)
+}
+
+// Reset drops the recorded operations.
+func (h *HistoryRecorder) Reset() {
+	h.mu.Lock()
+	h.history = nil
+	h.mu.Unlock()
+}
+
+type historyCall struct {
+	recorder *HistoryRecorder
+	op       HistoryOperation
+}
+
+func (c *historyCall) done(cb *Callback) {
+	c.op.Return = c.recorder.now()
+	resp := cb.resp
+	if err := resp.GetHeader().GetError(); err != nil {
+		if !c.op.Input.Write && c.op.Input.Admin == raft_cmdpb.AdminCmdType_InvalidAdmin {
+			// A failed read observes nothing.
+			return
+		}
+		c.op.Output.Err = err.String()
+		c.op.Return = math.MaxInt64
+	} else if c.op.Input.Write {
+		c.op.Output.Index = cb.appliedIndex
+	} else {
+		for _, r := range resp.GetResponses() {
+			if r.ReadIndex != nil {
+				c.op.Output.Index = r.ReadIndex.ReadIndex
+			}
+		}
+	}
+	c.recorder.append(c.op)
+}
+
+func (h *HistoryRecorder) append(op HistoryOperation) {
+	h.mu.Lock()
+	h.history = append(h.history, op)
+	h.mu.Unlock()
+}
+
+// RecordHistory starts recording the commands sent through the Router to the recorder, nil stops recording.
+// The recorder can be shared by the Routers of a cluster.
+func (r *Router) RecordHistory(h *HistoryRecorder) {
+	r.router.history.Store(historyHolder{recorder: h})
+}
+
+type historyHolder struct {
+	recorder *HistoryRecorder
+}
+
+func (pr *router) historyRecorder() *HistoryRecorder {
+	if v, ok := pr.history.Load().(historyHolder); ok {
+		return v.recorder
+	}
+	return nil
+}
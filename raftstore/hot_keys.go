@@ -0,0 +1,227 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/ngaut/unistore/raftstore/raftlog"
+	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// HotKey is a sampled hot key, the real frequency of the key is in [Count-Error, Count].
+type HotKey struct {
+	Key   []byte
+	Count uint64
+	Error uint64
+}
+
+// RegionHotKeys is the sampled top read and write keys of a region, and the sampled time the apply worker
+// spends on it.
+type RegionHotKeys struct {
+	RegionID uint64
+	Read     []HotKey
+	Write    []HotKey
+	Apply    ApplyStats
+}
+
+// spaceSaving is the space-saving sketch, it keeps the top frequent keys with at most capacity counters.
+type spaceSaving struct {
+	capacity int
+	counters map[string]*HotKey
+}
+
+func newSpaceSaving(capacity int) *spaceSaving {
+	return &spaceSaving{capacity: capacity, counters: make(map[string]*HotKey, capacity)}
+}
+
+func (s *spaceSaving) add(key []byte) {
+	if c, ok := s.counters[string(key)]; ok {
+		c.Count++
+		return
+	}
+	if len(s.counters) < s.capacity {
+		s.counters[string(key)] = &HotKey{Key: append([]byte{}, key...), Count: 1}
+		return
+	}
+	// Replace the counter with the minimum count, the new key inherits its count as the error.
+	var minKey string
+	var min *HotKey
+	for k, c := range s.counters {
+		if min == nil || c.Count < min.Count {
+			minKey, min = k, c
+		}
+	}
+	delete(s.counters, minKey)
+	s.counters[string(key)] = &HotKey{Key: append(min.Key[:0], key...), Count: min.Count + 1, Error: min.Count}
+}
+
+func (s *spaceSaving) top() []HotKey {
+	keys := make([]HotKey, 0, len(s.counters))
+	for _, c := range s.counters {
+		keys = append(keys, HotKey{Key: append([]byte{}, c.Key...), Count: c.Count, Error: c.Error})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Count != keys[j].Count {
+			return keys[i].Count > keys[j].Count
+		}
+		return bytes.Compare(keys[i].Key, keys[j].Key) < 0
+	})
+	return keys
+}
+
+// hotKeySampler samples the read and write keys of a peer, it is updated by the peer goroutine
+// and can be read concurrently.
+type hotKeySampler struct {
+	mu    sync.Mutex
+	read  *spaceSaving
+	write *spaceSaving
+}
+
+func newHotKeySampler(capacity int) *hotKeySampler {
+	if capacity <= 0 {
+		return nil
+	}
+	return &hotKeySampler{read: newSpaceSaving(capacity), write: newSpaceSaving(capacity)}
+}
+
+func (s *hotKeySampler) sampleRead(req *raft_cmdpb.RaftCmdRequest) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	for _, r := range req.GetRequests() {
+		if r.GetCmdType() == raft_cmdpb.CmdType_Get {
+			s.read.add(r.GetGet().GetKey())
+		}
+	}
+	s.mu.Unlock()
+}
+
+func (s *hotKeySampler) sampleWrite(rlog raftlog.RaftLog) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	iterateWriteKeys(rlog, s.write.add)
+	s.mu.Unlock()
+}
+
+// iterateWriteKeys calls fn for every key written by the raft log.
+func iterateWriteKeys(rlog raftlog.RaftLog, fn func(key []byte)) {
+	if cl, ok := rlog.(*raftlog.CustomRaftLog); ok {
+		switch cl.Type() {
+		case raftlog.TypePrewrite, raftlog.TypePessimisticLock:
+			cl.IterateLock(func(key, _ []byte) { fn(key) })
+		case raftlog.TypeCommit:
+			cl.IterateCommit(func(key, _ []byte, _ uint64) { fn(key) })
+		case raftlog.TypeRolback:
+			cl.IterateRollback(func(key []byte, _ uint64, _ bool) { fn(key) })
+		case raftlog.TypePessimisticRollback:
+			cl.IteratePessimisticRollback(func(key []byte) { fn(key) })
+		}
+		return
+	}
+	for _, r := range rlog.GetRaftCmdRequest().GetRequests() {
+		switch r.GetCmdType() {
+		case raft_cmdpb.CmdType_Put:
+			fn(r.GetPut().GetKey())
+		case raft_cmdpb.CmdType_Delete:
+			fn(r.GetDelete().GetKey())
+		}
+	}
+}
+
+func (s *hotKeySampler) reset() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.read = newSpaceSaving(s.read.capacity)
+	s.write = newSpaceSaving(s.write.capacity)
+	s.mu.Unlock()
+}
+
+func (s *hotKeySampler) hotKeys(regionID uint64) RegionHotKeys {
+	hot := RegionHotKeys{RegionID: regionID}
+	if s == nil {
+		return hot
+	}
+	s.mu.Lock()
+	hot.Read = s.read.top()
+	hot.Write = s.write.top()
+	s.mu.Unlock()
+	return hot
+}
+
+// HotKeys returns the sampled hot keys of the region, the keys are sorted by count in descending order.
+func (r *Router) HotKeys(regionID uint64) (RegionHotKeys, error) {
+	p := r.router.get(regionID)
+	if p == nil {
+		return RegionHotKeys{}, errPeerNotFound
+	}
+	return p.peer.peer.regionHotKeys(regionID), nil
+}
+
+func (p *Peer) regionHotKeys(regionID uint64) RegionHotKeys {
+	hot := p.hotKeys.hotKeys(regionID)
+	hot.Apply = p.applyProfiler.stats()
+	return hot
+}
+
+// ServeHTTP serves the sampled hot keys and apply time of the regions as JSON for the status server, the
+// regions are sorted by the estimated apply time in descending order. The region_id query parameter selects
+// a single region.
+func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var regions []RegionHotKeys
+	if idStr := req.URL.Query().Get("region_id"); idStr != "" {
+		regionID, err := strconv.ParseUint(idStr, 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hot, err := r.HotKeys(regionID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		regions = append(regions, hot)
+	} else {
+		r.router.peers.Range(func(key, value interface{}) bool {
+			// Only the leader samples keys, so the regions without any sample are skipped.
+			hot := value.(*peerState).peer.peer.regionHotKeys(key.(uint64))
+			if len(hot.Read) > 0 || len(hot.Write) > 0 || hot.Apply.Sampled > 0 {
+				regions = append(regions, hot)
+			}
+			return true
+		})
+		sort.Slice(regions, func(i, j int) bool {
+			if regions[i].Apply.EstimatedTime != regions[j].Apply.EstimatedTime {
+				return regions[i].Apply.EstimatedTime > regions[j].Apply.EstimatedTime
+			}
+			return regions[i].RegionID < regions[j].RegionID
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(regions); err != nil {
+		log.Warn("failed to encode hot keys", zap.Error(err))
+	}
+}
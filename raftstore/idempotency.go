@@ -0,0 +1,99 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// The Uuid in the header of a write command is its idempotency token, a client retries a write with the
+// same token. The applier remembers the tokens of the recently applied writes of the region, a write with
+// a remembered token is not applied again and succeeds. The tokens are remembered in memory, so a duplicate
+// of a write applied before the restart of the store or the snapshot of the region is applied again.
+//
+// Only the RaftCmdRequest writes carry a token, like the commands sent through Router.SendCommand. The
+// custom raft logs, which the MVCC store writes by default, have no token and are never deduplicated.
+
+// idempotencyTokens is the bounded window of the tokens of the applied writes of a region, the oldest token
+// is forgotten first.
+type idempotencyTokens struct {
+	capacity int
+	indexes  map[string]uint64
+	order    []string
+}
+
+func newIdempotencyTokens(capacity int) *idempotencyTokens {
+	return &idempotencyTokens{capacity: capacity, indexes: make(map[string]uint64, capacity)}
+}
+
+// appliedIndex returns the index the write with the token is applied at.
+func (t *idempotencyTokens) appliedIndex(token []byte) (uint64, bool) {
+	idx, ok := t.indexes[string(token)]
+	return idx, ok
+}
+
+func (t *idempotencyTokens) add(token []byte, index uint64) {
+	if len(t.order) == t.capacity {
+		delete(t.indexes, t.order[0])
+		t.order[0] = ""
+		t.order = t.order[1:]
+	}
+	key := string(token)
+	t.indexes[key] = index
+	t.order = append(t.order, key)
+}
+
+// warnCustomLogTokens reports once per apply worker that the custom raft logs are applied without checking
+// the idempotency tokens.
+func (aCtx *applyContext) warnCustomLogTokens() {
+	if aCtx.idempotencyWindow <= 0 || aCtx.customLogWarned {
+		return
+	}
+	aCtx.customLogWarned = true
+	log.Warn("custom raft logs carry no idempotency token, the duplicate writes are applied again",
+		zap.String("tag", aCtx.tag), zap.Int("idempotency window", aCtx.idempotencyWindow))
+}
+
+// checkDuplicate returns the response of a duplicate write, or nil if the write should be applied.
+func (a *applier) checkDuplicate(aCtx *applyContext, req *raft_cmdpb.RaftCmdRequest) *raft_cmdpb.RaftCmdResponse {
+	token := req.GetHeader().GetUuid()
+	if len(token) == 0 || a.idempotencyTokens == nil {
+		return nil
+	}
+	idx, ok := a.idempotencyTokens.appliedIndex(token)
+	if !ok {
+		return nil
+	}
+	log.Info("skip duplicate write", zap.String("tag", a.tag), zap.Uint64("applied index", idx),
+		zap.Uint64("index", aCtx.execCtx.index))
+	resp := newCmdRespForReq(req)
+	for _, r := range req.Requests {
+		resp.Responses = append(resp.Responses, &raft_cmdpb.Response{CmdType: r.CmdType})
+	}
+	return resp
+}
+
+// rememberToken remembers the token of the applied write.
+func (a *applier) rememberToken(aCtx *applyContext, req *raft_cmdpb.RaftCmdRequest) {
+	token := req.GetHeader().GetUuid()
+	if len(token) == 0 || aCtx.idempotencyWindow <= 0 {
+		return
+	}
+	if a.idempotencyTokens == nil {
+		a.idempotencyTokens = newIdempotencyTokens(aCtx.idempotencyWindow)
+	}
+	a.idempotencyTokens.add(token, aCtx.execCtx.index)
+}
@@ -0,0 +1,148 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// ingestLimiterMinBurst is larger than the write buffer of the table builder, which waits for a full
+	// buffer at once.
+	ingestLimiterMinBurst = 8 << 20
+	// ingestAdjustInterval is the window of the foreground write latencies the ingest rate is adjusted by.
+	ingestAdjustInterval = time.Second
+	// The rate is halved if more than 1/ingestSlowWriteRatio of the writes in a window are slow.
+	ingestSlowWriteRatio = 10
+	// The rate grows by 1/ingestRateSteps of the max rate after a window without too many slow writes.
+	ingestRateSteps = 10
+)
+
+// IngestLimiter limits the bandwidth of the data ingested to the kv engine of a store, it is shared by the
+// snapshot applying and the SST imports. If a write latency target is set, the rate is halved when the
+// foreground writes are slow and recovers gradually when they are not, between the min and the max rate.
+// The rate is adjusted on the store tick, so it recovers while there are no foreground writes.
+type IngestLimiter struct {
+	limiter *IOLimiter
+	maxRate float64
+	minRate float64
+	target  time.Duration
+
+	mu          sync.Mutex
+	windowStart time.Time
+	writes      int
+	slowWrites  int
+}
+
+// newIngestLimiter creates an IngestLimiter, a zero maxRate means no limit and a zero target disables the
+// adjustment. The min rate is validated by Config.Validate to be positive and not greater than the max rate
+// when the adjustment is enabled.
+func newIngestLimiter(maxRate, minRate uint64, target time.Duration) *IngestLimiter {
+	if maxRate == 0 {
+		return &IngestLimiter{limiter: NewInfLimiter()}
+	}
+	return &IngestLimiter{
+		limiter: newIOLimiter(maxRate, ingestLimiterMinBurst),
+		maxRate: float64(maxRate),
+		minRate: float64(minRate),
+		target:  target,
+	}
+}
+
+// Limiter returns the underlying IOLimiter, it can be passed to the table builders.
+func (l *IngestLimiter) Limiter() *IOLimiter {
+	return l.limiter
+}
+
+// Rate returns the current rate in bytes per second, 0 means no limit.
+func (l *IngestLimiter) Rate() uint64 {
+	if l.maxRate == 0 {
+		return 0
+	}
+	return uint64(l.limiter.Limit())
+}
+
+// WaitN blocks until n bytes can be ingested or the ctx is done.
+func (l *IngestLimiter) WaitN(ctx context.Context, n int) error {
+	return waitIO(ctx, l.limiter, n)
+}
+
+// observeWriteLatency records the latency of a foreground write.
+func (l *IngestLimiter) observeWriteLatency(d time.Duration) {
+	if l == nil || l.target == 0 {
+		return
+	}
+	l.observe(time.Now(), d)
+}
+
+func (l *IngestLimiter) observe(now time.Time, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.windowStart.IsZero() {
+		l.windowStart = now
+	}
+	l.writes++
+	if d > l.target {
+		l.slowWrites++
+	}
+	l.adjust(now)
+}
+
+// tick adjusts the rate if the window is finished, a window without any write recovers the rate.
+func (l *IngestLimiter) tick(now time.Time) {
+	if l == nil || l.target == 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.windowStart.IsZero() {
+		l.windowStart = now
+	}
+	l.adjust(now)
+}
+
+func (l *IngestLimiter) adjust(now time.Time) {
+	if now.Sub(l.windowStart) < ingestAdjustInterval {
+		return
+	}
+	r := float64(l.limiter.Limit())
+	if l.slowWrites*ingestSlowWriteRatio > l.writes {
+		r /= 2
+	} else {
+		r += l.maxRate / ingestRateSteps
+	}
+	if r < l.minRate {
+		r = l.minRate
+	}
+	if r > l.maxRate {
+		r = l.maxRate
+	}
+	l.limiter.SetLimitAt(now, rate.Limit(r))
+	l.windowStart, l.writes, l.slowWrites = now, 0, 0
+}
+
+func (d *storeMsgHandler) onIngestLimiterTick() {
+	d.ticker.scheduleStore(StoreTickIngestLimiter)
+	d.ctx.router.ingestLimiter.tick(time.Now())
+}
+
+// IngestLimiter returns the ingest limiter of the store, the SST importers should wait on it before
+// ingesting files to the kv engine.
+func (r *Router) IngestLimiter() *IngestLimiter {
+	return r.router.ingestLimiter
+}
@@ -0,0 +1,254 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// The modes of Config.InvariantViolationMode.
+const (
+	// A violation panics, so a simulation stops at the first broken invariant.
+	InvariantModePanic = "panic"
+	// A violation is logged and sent to the InvariantListeners.
+	InvariantModeEvent = "event"
+	// A violation only increases the violation count of the invariant.
+	InvariantModeMetric = "metric"
+)
+
+// InvariantViolation is a failed check of an invariant, RegionID is 0 for the store invariants.
+type InvariantViolation struct {
+	Invariant string
+	StoreID   uint64
+	RegionID  uint64
+	Detail    string
+	Time      time.Time
+}
+
+// InvariantListener is called for every violation in the event mode, it must not block.
+type InvariantListener func(v InvariantViolation)
+
+// InvariantStats is the number of the invariant checks and the violations of every invariant on the store.
+type InvariantStats struct {
+	Checks     uint64            `json:"checks"`
+	Violations map[string]uint64 `json:"violations"`
+}
+
+// peerInvariant is checked on the peer goroutine, check returns the detail of the violation or "".
+type peerInvariant struct {
+	name  string
+	check func(p *Peer) string
+}
+
+// storeInvariant is checked on the store goroutine with the store meta locked.
+type storeInvariant struct {
+	name  string
+	check func(meta *storeMeta) string
+}
+
+// peerInvariants and storeInvariants are the invariants checked every Config.InvariantCheckInterval.
+var (
+	peerInvariants = []peerInvariant{
+		{"applied-le-committed", checkAppliedLeCommitted},
+		{"truncated-le-applied", checkTruncatedLeApplied},
+		{"follower-lease-invalid", checkFollowerLeaseInvalid},
+	}
+	storeInvariants = []storeInvariant{
+		{"region-ranges-disjoint", checkRegionRangesDisjoint},
+	}
+)
+
+func checkAppliedLeCommitted(p *Peer) string {
+	applied, committed := p.Store().AppliedIndex(), p.RaftGroup.StatusWithoutProgress().Commit
+	if applied > committed {
+		return fmt.Sprintf("applied index %d is greater than committed index %d", applied, committed)
+	}
+	return ""
+}
+
+func checkTruncatedLeApplied(p *Peer) string {
+	truncated, applied := p.Store().truncatedIndex(), p.Store().AppliedIndex()
+	if truncated > applied {
+		return fmt.Sprintf("truncated index %d is greater than applied index %d", truncated, applied)
+	}
+	return ""
+}
+
+// checkFollowerLeaseInvalid skips a peer with a pending ready, the lease of a leader stepping down is
+// expired when the ready of the role change is handled.
+func checkFollowerLeaseInvalid(p *Peer) string {
+	if p.IsLeader() || p.RaftGroup.HasReady() {
+		return ""
+	}
+	if p.leaderLease.Inspect(nil) == LeaseStateValid {
+		return fmt.Sprintf("the leader lease is valid on a %v", p.GetRole())
+	}
+	return ""
+}
+
+// checkRegionRangesDisjoint checks the ranges of the initialized regions, an uninitialized region has no range.
+func checkRegionRangesDisjoint(meta *storeMeta) string {
+	regions := make([]*metapb.Region, 0, len(meta.regions))
+	for _, region := range meta.regions {
+		if len(region.Peers) > 0 {
+			regions = append(regions, region)
+		}
+	}
+	sort.Slice(regions, func(i, j int) bool {
+		return bytes.Compare(regions[i].StartKey, regions[j].StartKey) < 0
+	})
+	for i := 1; i < len(regions); i++ {
+		prev, cur := regions[i-1], regions[i]
+		if len(prev.EndKey) == 0 || bytes.Compare(prev.EndKey, cur.StartKey) > 0 {
+			return fmt.Sprintf("region %d [%x, %x) overlaps with region %d [%x, %x)", prev.Id, prev.StartKey,
+				prev.EndKey, cur.Id, cur.StartKey, cur.EndKey)
+		}
+	}
+	return ""
+}
+
+// invariantChecker counts the checks and the violations of the store, it is shared by the peers and can be
+// read concurrently.
+type invariantChecker struct {
+	mu         sync.Mutex
+	checks     uint64
+	violations map[string]uint64
+	listeners  []InvariantListener
+}
+
+func (c *invariantChecker) addListener(l InvariantListener) {
+	c.mu.Lock()
+	listeners := make([]InvariantListener, 0, len(c.listeners)+1)
+	listeners = append(listeners, c.listeners...)
+	c.listeners = append(listeners, l)
+	c.mu.Unlock()
+}
+
+// report handles the violation by the mode, a nil checker only panics in the panic mode.
+func (c *invariantChecker) report(mode string, v InvariantViolation) {
+	if mode == InvariantModePanic {
+		panic(fmt.Sprintf("invariant %s violated on store %d region %d: %s", v.Invariant, v.StoreID,
+			v.RegionID, v.Detail))
+	}
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	if c.violations == nil {
+		c.violations = make(map[string]uint64)
+	}
+	c.violations[v.Invariant]++
+	listeners := c.listeners
+	c.mu.Unlock()
+	if mode != InvariantModeEvent {
+		return
+	}
+	log.Warn("invariant violated", zap.String("invariant", v.Invariant), zap.Uint64("store", v.StoreID),
+		zap.Uint64("region", v.RegionID), zap.String("detail", v.Detail))
+	for _, l := range listeners {
+		l(v)
+	}
+}
+
+func (c *invariantChecker) observeCheck() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.checks++
+	c.mu.Unlock()
+}
+
+func (c *invariantChecker) stats() InvariantStats {
+	stats := InvariantStats{Violations: make(map[string]uint64, len(peerInvariants)+len(storeInvariants))}
+	for _, inv := range peerInvariants {
+		stats.Violations[inv.name] = 0
+	}
+	for _, inv := range storeInvariants {
+		stats.Violations[inv.name] = 0
+	}
+	stats.Violations[invariantConsistentHash] = 0
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats.Checks = c.checks
+	for name, cnt := range c.violations {
+		stats.Violations[name] = cnt
+	}
+	return stats
+}
+
+// checkInvariants checks the peer invariants, the violations are handled by the mode.
+func (p *Peer) checkInvariants(mode string) {
+	for _, inv := range peerInvariants {
+		p.invariants.observeCheck()
+		if detail := inv.check(p); detail != "" {
+			p.invariants.report(mode, InvariantViolation{Invariant: inv.name, StoreID: p.Meta.StoreId,
+				RegionID: p.regionID, Detail: detail, Time: time.Now()})
+		}
+	}
+}
+
+func (d *peerMsgHandler) onCheckInvariantsTick() {
+	d.ticker.schedule(PeerTickCheckInvariants)
+	d.peer.checkInvariants(d.ctx.cfg.InvariantViolationMode)
+}
+
+func (d *storeMsgHandler) onCheckInvariantsTick() {
+	d.ticker.scheduleStore(StoreTickCheckInvariants)
+	checker := &d.ctx.router.invariants
+	var violations []InvariantViolation
+	d.ctx.storeMetaLock.RLock()
+	for _, inv := range storeInvariants {
+		checker.observeCheck()
+		if detail := inv.check(d.ctx.storeMeta); detail != "" {
+			violations = append(violations, InvariantViolation{Invariant: inv.name, StoreID: d.id,
+				Detail: detail, Time: time.Now()})
+		}
+	}
+	d.ctx.storeMetaLock.RUnlock()
+	for _, v := range violations {
+		checker.report(d.ctx.cfg.InvariantViolationMode, v)
+	}
+}
+
+// AddInvariantListener registers a listener for the invariant violations in the event mode, it must be
+// called after Setup.
+func (ris *RaftInnerServer) AddInvariantListener(l InvariantListener) {
+	ris.router.invariants.addListener(l)
+}
+
+// InvariantStats returns the number of the invariant checks and the violations of every invariant.
+func (r *Router) InvariantStats() InvariantStats {
+	return r.router.invariants.stats()
+}
+
+// InvariantStatsHandler serves the invariant stats of the store as JSON for the status server.
+func (r *Router) InvariantStatsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(r.InvariantStats()); err != nil {
+			log.Warn("failed to encode invariant stats", zap.Error(err))
+		}
+	})
+}
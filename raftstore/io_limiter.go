@@ -27,6 +27,7 @@
 package raftstore
 
 import (
+	"context"
 	"io"
 
 	"golang.org/x/time/rate"
@@ -40,6 +41,35 @@ func NewInfLimiter() *IOLimiter {
 	return rate.NewLimiter(rate.Inf, 0)
 }
 
+// newIOLimiter returns an IOLimiter of the bytes per second, 0 means no limit. The burst is at least
+// minBurst, so a write of minBurst bytes waits once.
+func newIOLimiter(bytesPerSec uint64, minBurst int) *IOLimiter {
+	if bytesPerSec == 0 {
+		return NewInfLimiter()
+	}
+	burst := int(bytesPerSec)
+	if burst < minBurst {
+		burst = minBurst
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), burst)
+}
+
+// waitIO blocks until n bytes are allowed by the limiter or the ctx is done, n may be larger than the burst.
+func waitIO(ctx context.Context, l *IOLimiter, n int) error {
+	burst := l.Burst()
+	for n > 0 {
+		size := n
+		if burst > 0 && size > burst {
+			size = burst
+		}
+		if err := l.WaitN(ctx, size); err != nil {
+			return err
+		}
+		n -= size
+	}
+	return nil
+}
+
 // LimitWriter represents a limit writer.
 type LimitWriter struct {
 	writer io.Writer
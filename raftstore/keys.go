@@ -41,6 +41,7 @@ const (
 	RaftStateSuffix         byte = 0x02
 	ApplyStateSuffix        byte = 0x03
 	SnapshotRaftStateSuffix byte = 0x04
+	SchedulerStateSuffix    byte = 0x05
 
 	// For region meta
 	RegionStateSuffix byte = 0x01
@@ -112,6 +113,11 @@ func SnapshotRaftStateKey(regionID uint64) []byte {
 	return makeRaftRegionPrefix(regionID, SnapshotRaftStateSuffix)
 }
 
+// SchedulerStateKey makes the scheduler state key with the given region id.
+func SchedulerStateKey(regionID uint64) []byte {
+	return makeRaftRegionPrefix(regionID, SchedulerStateSuffix)
+}
+
 func decodeRegionMetaKey(key []byte) (uint64, byte, error) {
 	if len(RegionMetaMinKey)+8+1 != len(key) {
 		return 0, 0, errors.Errorf("invalid region meta key length for key %v", key)
@@ -0,0 +1,169 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// LeaseCheck is an invariant of the leader lease bookkeeping, it is checked if Config.CheckLeaseInvariants is set.
+type LeaseCheck int
+
+// LeaseCheck
+const (
+	// The lease is renewed by the leader of the current term.
+	LeaseCheckRenewTerm LeaseCheck = 1 + iota
+	// The renew time is not earlier than the time the peer became the leader of the term, so it is
+	// never the propose time of an earlier term.
+	LeaseCheckRenewAfterElection
+	// The renew time is not later than the lease clock.
+	LeaseCheckRenewNotFuture
+	// The ready reads of the ReadIndex queue are at the front, the reads are ordered by term and the
+	// uncommitted reads of a leader are proposed in the current term.
+	LeaseCheckReadQueue
+)
+
+// String returns a string representation of the lease check.
+func (c LeaseCheck) String() string {
+	switch c {
+	case LeaseCheckRenewTerm:
+		return "renew-term"
+	case LeaseCheckRenewAfterElection:
+		return "renew-after-election"
+	case LeaseCheckRenewNotFuture:
+		return "renew-not-future"
+	case LeaseCheckReadQueue:
+		return "read-queue"
+	}
+	return "unknown"
+}
+
+// LeaseCheckEvent is the result of a lease invariant check, Detail describes the violation of a failed check.
+type LeaseCheckEvent struct {
+	Check  LeaseCheck
+	Passed bool
+	Term   uint64
+	Detail string
+	Time   time.Time
+}
+
+const maxRecentLeaseChecks = 64
+
+// leaseChecks is updated by the peer goroutine and can be read concurrently.
+type leaseChecks struct {
+	mu     sync.Mutex
+	recent []LeaseCheckEvent
+}
+
+func (c *leaseChecks) record(tag string, check LeaseCheck, term uint64, detail string) {
+	passed := detail == ""
+	if !passed {
+		log.Warn("lease invariant violated", zap.String("tag", tag), zap.Stringer("check", check),
+			zap.Uint64("term", term), zap.String("detail", detail))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.recent) == maxRecentLeaseChecks {
+		copy(c.recent, c.recent[1:])
+		c.recent = c.recent[:len(c.recent)-1]
+	}
+	c.recent = append(c.recent, LeaseCheckEvent{Check: check, Passed: passed, Term: term, Detail: detail, Time: time.Now()})
+}
+
+func (c *leaseChecks) snapshot() []LeaseCheckEvent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]LeaseCheckEvent{}, c.recent...)
+}
+
+// observeLeaderTerm records the time the peer is first seen as the leader of the current term, it must be
+// called before a renew time of the term is taken.
+func (p *Peer) observeLeaderTerm() {
+	if p.IsLeader() && p.leaderTerm != p.Term() {
+		p.leaderTerm, p.leaderStartTime = p.Term(), p.leaderLease.Now()
+	}
+}
+
+// renewLeaseByProposal renews the leader lease by the propose time of a proposal or a read index of the
+// term. The leadership may have bounced after a proposal of an earlier term, so its propose time is stale
+// and never renews the lease.
+func (p *Peer) renewLeaseByProposal(proposeTime time.Time, term uint64) bool {
+	if term != p.Term() {
+		log.S().Debugf("%v skips renewing lease by a proposal of term %d at term %d", p.Tag, term, p.Term())
+		return false
+	}
+	p.MaybeRenewLeaderLease(proposeTime)
+	return true
+}
+
+// checkLeaseRenew checks the renew time of the leader lease.
+func (p *Peer) checkLeaseRenew(ts time.Time) {
+	if !p.checkLeaseInvariants {
+		return
+	}
+	term := p.Term()
+	var detail string
+	if p.leaderTerm != term {
+		detail = fmt.Sprintf("the leadership is observed at term %d", p.leaderTerm)
+	}
+	p.leaseChecks.record(p.Tag, LeaseCheckRenewTerm, term, detail)
+	detail = ""
+	if p.leaderTerm == term && ts.Before(p.leaderStartTime) {
+		detail = fmt.Sprintf("renew time %v is before the election at %v", ts, p.leaderStartTime)
+	}
+	p.leaseChecks.record(p.Tag, LeaseCheckRenewAfterElection, term, detail)
+	detail = ""
+	if now := p.leaderLease.Now(); ts.After(now) {
+		detail = fmt.Sprintf("renew time %v is after now %v", ts, now)
+	}
+	p.leaseChecks.record(p.Tag, LeaseCheckRenewNotFuture, term, detail)
+}
+
+// checkReadQueue checks the ReadIndex queue after the read states of a ready are handled.
+func (p *Peer) checkReadQueue() {
+	if !p.checkLeaseInvariants {
+		return
+	}
+	q, term := p.pendingReads, p.Term()
+	var detail string
+	if q.readyCnt > len(q.reads) {
+		detail = fmt.Sprintf("%d ready reads of %d reads", q.readyCnt, len(q.reads))
+	}
+	for i := 0; i < len(q.reads) && detail == ""; i++ {
+		read := q.reads[i]
+		switch {
+		case read.term > term:
+			detail = fmt.Sprintf("read %d is proposed at a future term %d", read.id, read.term)
+		case i > 0 && read.term < q.reads[i-1].term:
+			detail = fmt.Sprintf("read %d of term %d is behind term %d", read.id, read.term, q.reads[i-1].term)
+		case i >= q.readyCnt && p.IsLeader() && read.term != term:
+			detail = fmt.Sprintf("uncommitted read %d is proposed at a stale term %d", read.id, read.term)
+		}
+	}
+	p.leaseChecks.record(p.Tag, LeaseCheckReadQueue, term, detail)
+}
+
+// LeaseCheckEvents returns the recent results of the lease invariant checks of the region, the oldest first.
+func (r *Router) LeaseCheckEvents(regionID uint64) ([]LeaseCheckEvent, error) {
+	p := r.router.get(regionID)
+	if p == nil {
+		return nil, errPeerNotFound
+	}
+	return p.peer.peer.leaseChecks.snapshot(), nil
+}
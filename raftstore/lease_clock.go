@@ -0,0 +1,121 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LeaseClock is the time source of the leader lease, Config.LeaseClock replaces the default monotonic
+// clock to test the lease reads under virtualized, skewed or jumping time.
+type LeaseClock interface {
+	Now() time.Time
+}
+
+// MonotonicClock returns the wall time it is created at plus the time elapsed since then measured by the
+// monotonic clock, so a jump of the wall clock neither extends nor shortens the leases.
+type MonotonicClock struct {
+	base    time.Time
+	elapsed func() time.Duration
+}
+
+// NewMonotonicClock creates a MonotonicClock starting at the current wall time.
+func NewMonotonicClock() *MonotonicClock {
+	start := time.Now()
+	return &MonotonicClock{
+		// Round to strip the monotonic reading, the time returned is compared as a wall time.
+		base: start.Round(0),
+		elapsed: func() time.Duration {
+			return time.Since(start)
+		},
+	}
+}
+
+// Now returns the current time of the clock.
+func (c *MonotonicClock) Now() time.Time {
+	return c.base.Add(c.elapsed())
+}
+
+// defaultLeaseClock is shared by the leases and the local readers, the times of them are compared.
+var defaultLeaseClock = NewMonotonicClock()
+
+func leaseClockOrDefault(clock LeaseClock) LeaseClock {
+	if clock == nil {
+		return defaultLeaseClock
+	}
+	return clock
+}
+
+// ManualClock is a monotonic fake clock which only moves when it is advanced.
+type ManualClock struct {
+	nanos int64
+}
+
+// NewManualClock creates a ManualClock starting at the time.
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{nanos: start.UnixNano()}
+}
+
+// Now returns the current time of the clock.
+func (c *ManualClock) Now() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.nanos))
+}
+
+// Advance moves the clock forward by d, a negative d is ignored to keep the clock monotonic.
+func (c *ManualClock) Advance(d time.Duration) {
+	if d > 0 {
+		atomic.AddInt64(&c.nanos, int64(d))
+	}
+}
+
+// HybridLogicalClock follows the physical clock but never goes backwards. When the physical clock
+// doesn't move forward, the logical part advances the time by one nanosecond for every reading.
+// Update merges the time observed from another node, so a skewed physical clock doesn't break the
+// causal order.
+type HybridLogicalClock struct {
+	physical LeaseClock
+	mu       sync.Mutex
+	last     time.Time
+}
+
+// NewHybridLogicalClock creates a HybridLogicalClock on top of the physical clock, nil means the
+// default monotonic clock.
+func NewHybridLogicalClock(physical LeaseClock) *HybridLogicalClock {
+	return &HybridLogicalClock{physical: leaseClockOrDefault(physical)}
+}
+
+// Now returns a time later than all the times returned or updated before.
+func (c *HybridLogicalClock) Now() time.Time {
+	// Round to strip the monotonic reading, the wall time is compared with the updated times.
+	now := c.physical.Now().Round(0)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !now.After(c.last) {
+		now = c.last.Add(time.Nanosecond)
+	}
+	c.last = now
+	return now
+}
+
+// Update moves the clock forward to the time observed from another node.
+func (c *HybridLogicalClock) Update(observed time.Time) {
+	observed = observed.Round(0)
+	c.mu.Lock()
+	if observed.After(c.last) {
+		c.last = observed
+	}
+	c.mu.Unlock()
+}
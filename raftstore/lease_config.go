@@ -0,0 +1,83 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// setMaxLeaderLease changes the max leader lease of the registered peers and the peers registered later.
+func (pr *router) setMaxLeaderLease(maxLease time.Duration) {
+	atomic.StoreInt64(&pr.maxLeaderLease, int64(maxLease))
+	pr.peers.Range(func(key, _ interface{}) bool {
+		regionID := key.(uint64)
+		if err := pr.send(regionID, NewPeerMsg(MsgTypeUpdateLeaderLease, regionID, maxLease)); err != nil {
+			log.Warn("failed to update leader lease", zap.Uint64("region id", regionID), zap.Error(err))
+		}
+		return true
+	})
+}
+
+// MaxLeaderLease returns the max leader lease of the peers.
+func (ris *RaftInnerServer) MaxLeaderLease() time.Duration {
+	if maxLease := atomic.LoadInt64(&ris.router.maxLeaderLease); maxLease > 0 {
+		return time.Duration(maxLease)
+	}
+	return ris.raftConfig.RaftStoreMaxLeaderLease
+}
+
+// SetMaxLeaderLease changes the max leader lease of the peers at runtime, it must not be greater than the
+// election timeout. A shorter lease takes effect on the current leases right away, a longer one on the next
+// renewals.
+func (ris *RaftInnerServer) SetMaxLeaderLease(maxLease time.Duration) error {
+	cfg := ris.raftConfig
+	electionTimeout := cfg.RaftBaseTickInterval * time.Duration(cfg.RaftElectionTimeoutTicks)
+	if maxLease <= 0 || maxLease > electionTimeout {
+		return errors.Errorf("max leader lease %v must be in (0, %v]", maxLease, electionTimeout)
+	}
+	log.Info("update max leader lease", zap.Duration("from", ris.MaxLeaderLease()), zap.Duration("to", maxLease))
+	ris.router.setMaxLeaderLease(maxLease)
+	return nil
+}
+
+// LeaderLeaseHandler serves the max leader lease for the status server, a POST with the max_leader_lease
+// query parameter, like 5s, changes it.
+func (ris *RaftInnerServer) LeaderLeaseHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodPost {
+			maxLease, err := time.ParseDuration(req.URL.Query().Get("max_leader_lease"))
+			if err == nil {
+				err = ris.SetMaxLeaderLease(maxLease)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		resp := struct {
+			MaxLeaderLease string `json:"max_leader_lease"`
+		}{ris.MaxLeaderLease().String()}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Warn("failed to encode leader lease", zap.Error(err))
+		}
+	})
+}
@@ -0,0 +1,171 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// String returns a string representation of the lease state.
+func (s LeaseState) String() string {
+	switch s {
+	case LeaseStateSuspect:
+		return "suspect"
+	case LeaseStateValid:
+		return "valid"
+	case LeaseStateExpired:
+		return "expired"
+	}
+	return "unknown"
+}
+
+// LeaseReason represents the reason of a leader lease state transition.
+type LeaseReason int
+
+// LeaseReason
+const (
+	// The lease is renewed by an applied proposal or a new leader.
+	LeaseReasonRenew LeaseReason = 1 + iota
+	// The lease is suspected after MsgTimeoutNow is sent for a leader transfer.
+	LeaseReasonTransferLeader
+	// The lease is suspected after a prepare merge is committed.
+	LeaseReasonMergeSuspect
+	// The lease is expired because the peer stepped down.
+	LeaseReasonElection
+	// The lease is expired because the clock went over its bound.
+	LeaseReasonTimeout
+	// The lease is changed by Router.ControlLease.
+	LeaseReasonControl
+)
+
+// String returns a string representation of the lease reason.
+func (r LeaseReason) String() string {
+	switch r {
+	case LeaseReasonRenew:
+		return "renew"
+	case LeaseReasonTransferLeader:
+		return "transfer-leader"
+	case LeaseReasonMergeSuspect:
+		return "merge-suspect"
+	case LeaseReasonElection:
+		return "election"
+	case LeaseReasonTimeout:
+		return "timeout"
+	case LeaseReasonControl:
+		return "control"
+	}
+	return "unknown"
+}
+
+// LeaseEvent represents a leader lease state transition of a peer.
+type LeaseEvent struct {
+	From   LeaseState
+	To     LeaseState
+	Reason LeaseReason
+	Term   uint64
+	Time   time.Time
+}
+
+// LeaseMetrics counts the leader lease state transitions of a peer by the target state.
+type LeaseMetrics struct {
+	State   LeaseState
+	Valid   uint64
+	Suspect uint64
+	Expired uint64
+}
+
+const maxRecentLeaseEvents = 64
+
+// leaseStats is updated by the peer goroutine and can be read concurrently.
+type leaseStats struct {
+	mu      sync.Mutex
+	metrics LeaseMetrics
+	recent  []LeaseEvent
+}
+
+func newLeaseStats() *leaseStats {
+	return &leaseStats{metrics: LeaseMetrics{State: LeaseStateExpired}}
+}
+
+func (s *leaseStats) record(tag string, to LeaseState, reason LeaseReason, term uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	from := s.metrics.State
+	if from == to {
+		return
+	}
+	s.metrics.State = to
+	switch to {
+	case LeaseStateValid:
+		s.metrics.Valid++
+	case LeaseStateSuspect:
+		s.metrics.Suspect++
+	case LeaseStateExpired:
+		s.metrics.Expired++
+	}
+	if len(s.recent) == maxRecentLeaseEvents {
+		copy(s.recent, s.recent[1:])
+		s.recent = s.recent[:len(s.recent)-1]
+	}
+	s.recent = append(s.recent, LeaseEvent{From: from, To: to, Reason: reason, Term: term, Time: time.Now()})
+	log.Debug("leader lease state changed", zap.String("tag", tag), zap.Stringer("from", from),
+		zap.Stringer("to", to), zap.Stringer("reason", reason))
+}
+
+func (s *leaseStats) lastReason() LeaseReason {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.recent) == 0 {
+		return 0
+	}
+	return s.recent[len(s.recent)-1].Reason
+}
+
+func (s *leaseStats) snapshot() (LeaseMetrics, []LeaseEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.metrics, append([]LeaseEvent{}, s.recent...)
+}
+
+// recordLeaseState records the current state of the leader lease if it is changed.
+func (p *Peer) recordLeaseState(reason LeaseReason) {
+	if p.leaseStats == nil {
+		return
+	}
+	p.leaseStats.record(p.Tag, p.leaderLease.Inspect(nil), reason, p.Term())
+}
+
+// LeaseMetrics returns the leader lease transition counters of the region.
+func (r *Router) LeaseMetrics(regionID uint64) (LeaseMetrics, error) {
+	p := r.router.get(regionID)
+	if p == nil {
+		return LeaseMetrics{}, errPeerNotFound
+	}
+	metrics, _ := p.peer.peer.leaseStats.snapshot()
+	return metrics, nil
+}
+
+// LeaseEvents returns the recent leader lease transitions of the region, the oldest first.
+func (r *Router) LeaseEvents(regionID uint64) ([]LeaseEvent, error) {
+	p := r.router.get(regionID)
+	if p == nil {
+		return nil, errPeerNotFound
+	}
+	_, events := p.peer.peer.leaseStats.snapshot()
+	return events, nil
+}
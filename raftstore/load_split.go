@@ -0,0 +1,130 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bytes"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/ngaut/unistore/raftstore/raftlog"
+	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/util/codec"
+	"go.uber.org/zap"
+)
+
+// loadSplitSamples is the number of the keys sampled in a load split window.
+const loadSplitSamples = 64
+
+// loadSplitter detects the hot key range of a leader region by the load. It counts the reads and the writes
+// proposed in a window of Config.LoadSplitWindow and keeps a reservoir sample of their keys. Once the QPS of
+// a window reaches Config.LoadSplitQPSThreshold, the region is split at the sampled key balancing the load
+// of both sides. A region with a single hot key is not split.
+type loadSplitter struct {
+	windowStart time.Time
+	requests    uint64
+	// keys is the number of the keys seen in the window, samples keeps a uniform sample of them.
+	keys    uint64
+	samples [][]byte
+	// splitKey is the raw key to split the region at, it is set at the end of a hot window.
+	splitKey []byte
+}
+
+func (l *loadSplitter) observeRead(cfg *Config, req *raft_cmdpb.RaftCmdRequest) {
+	if cfg.LoadSplitQPSThreshold == 0 {
+		return
+	}
+	l.observe(cfg, time.Now(), func(fn func(key []byte)) {
+		for _, r := range req.GetRequests() {
+			if r.GetCmdType() == raft_cmdpb.CmdType_Get {
+				fn(r.GetGet().GetKey())
+			}
+		}
+	})
+}
+
+func (l *loadSplitter) observeWrite(cfg *Config, rlog raftlog.RaftLog) {
+	if cfg.LoadSplitQPSThreshold == 0 {
+		return
+	}
+	l.observe(cfg, time.Now(), func(fn func(key []byte)) {
+		iterateWriteKeys(rlog, fn)
+	})
+}
+
+// observe counts a request with the keys iterated by iterate.
+func (l *loadSplitter) observe(cfg *Config, now time.Time, iterate func(fn func(key []byte))) {
+	if l.windowStart.IsZero() {
+		l.windowStart = now
+	}
+	if elapsed := now.Sub(l.windowStart); elapsed >= cfg.LoadSplitWindow {
+		if float64(l.requests)/elapsed.Seconds() >= float64(cfg.LoadSplitQPSThreshold) && l.splitKey == nil {
+			l.splitKey = l.findSplitKey()
+		}
+		l.windowStart, l.requests, l.keys, l.samples = now, 0, 0, l.samples[:0]
+	}
+	l.requests++
+	iterate(func(key []byte) {
+		l.keys++
+		if len(l.samples) < loadSplitSamples {
+			l.samples = append(l.samples, append([]byte{}, key...))
+		} else if i := rand.Int63n(int64(l.keys)); i < loadSplitSamples {
+			l.samples[i] = append(l.samples[i][:0], key...)
+		}
+	})
+}
+
+// findSplitKey returns the sampled key with the most balanced samples on both sides, the samples before
+// the key go to the left region. nil is returned if a quarter of the samples can't be moved to either side.
+func (l *loadSplitter) findSplitKey() []byte {
+	samples := l.samples
+	sort.Slice(samples, func(i, j int) bool {
+		return bytes.Compare(samples[i], samples[j]) < 0
+	})
+	var best []byte
+	bestLeft := 0
+	for i := 1; i < len(samples); i++ {
+		if bytes.Equal(samples[i], samples[i-1]) {
+			continue
+		}
+		if best == nil || abs(len(samples)-2*i) < abs(len(samples)-2*bestLeft) {
+			best, bestLeft = samples[i], i
+		}
+	}
+	if best == nil || bestLeft*4 < len(samples) || (len(samples)-bestLeft)*4 < len(samples) {
+		return nil
+	}
+	return append([]byte{}, best...)
+}
+
+func (l *loadSplitter) reset() {
+	*l = loadSplitter{samples: l.samples[:0]}
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// onLoadSplit asks PD to split the hot region at the split key of the load splitter.
+func (d *peerMsgHandler) onLoadSplit() {
+	key := codec.EncodeBytes(nil, d.peer.loadSplit.splitKey)
+	d.peer.loadSplit.splitKey = nil
+	log.Info("split hot region by load", zap.String("tag", d.tag()), zap.Binary("split key", key))
+	d.onPrepareSplitRegion(d.region().RegionEpoch, [][]byte{key}, NewCallback())
+}
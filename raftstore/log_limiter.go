@@ -0,0 +1,179 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"sync/atomic"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/time/rate"
+)
+
+// The modules of the raftstore with their own log levels.
+const (
+	LogModulePeer    = "peer"
+	LogModuleApply   = "apply"
+	LogModuleStorage = "storage"
+)
+
+// LogLevelGlobal is the level of a module following the global log level.
+const LogLevelGlobal = "global"
+
+// moduleLevel overrides the global log level for the logs of a module in both directions, the debug logs of
+// a module at the debug level are written even if the global level is info.
+type moduleLevel struct {
+	// overridden is 1 if the level is set, otherwise the module follows the global level.
+	overridden int32
+	level      zap.AtomicLevel
+}
+
+var moduleLevels = map[string]*moduleLevel{
+	LogModulePeer:    {level: zap.NewAtomicLevel()},
+	LogModuleApply:   {level: zap.NewAtomicLevel()},
+	LogModuleStorage: {level: zap.NewAtomicLevel()},
+}
+
+// SetModuleLogLevel changes the log level of the module at runtime, the level is one of "debug", "info",
+// "warn", "error", or LogLevelGlobal to follow the global level again.
+func SetModuleLogLevel(module, level string) error {
+	l, ok := moduleLevels[module]
+	if !ok {
+		return errors.Errorf("unknown log module %q", module)
+	}
+	if level == LogLevelGlobal {
+		atomic.StoreInt32(&l.overridden, 0)
+		return nil
+	}
+	var lv zapcore.Level
+	if err := lv.UnmarshalText([]byte(level)); err != nil {
+		return err
+	}
+	l.level.SetLevel(lv)
+	atomic.StoreInt32(&l.overridden, 1)
+	return nil
+}
+
+// ModuleLogLevels returns the log levels of the modules.
+func ModuleLogLevels() map[string]string {
+	levels := make(map[string]string, len(moduleLevels))
+	for module, l := range moduleLevels {
+		if atomic.LoadInt32(&l.overridden) == 0 {
+			levels[module] = LogLevelGlobal
+		} else {
+			levels[module] = l.level.Level().String()
+		}
+	}
+	return levels
+}
+
+// moduleLogger returns the logger of the module, nil if the module follows the global level.
+func moduleLogger(module string) *zap.Logger {
+	l := moduleLevels[module]
+	if atomic.LoadInt32(&l.overridden) == 0 {
+		return nil
+	}
+	return log.L().WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return &levelOverrideCore{Core: core, level: l.level}
+	}))
+}
+
+func debugEnabled(module string) bool {
+	if l := moduleLevels[module]; atomic.LoadInt32(&l.overridden) == 1 {
+		return l.level.Enabled(zapcore.DebugLevel)
+	}
+	return log.L().Core().Enabled(zapcore.DebugLevel)
+}
+
+// levelOverrideCore checks the entries with the level of the module instead of the level of the wrapped core.
+type levelOverrideCore struct {
+	zapcore.Core
+	level zapcore.LevelEnabler
+}
+
+func (c *levelOverrideCore) Enabled(lvl zapcore.Level) bool {
+	return c.level.Enabled(lvl)
+}
+
+func (c *levelOverrideCore) With(fields []zapcore.Field) zapcore.Core {
+	return &levelOverrideCore{Core: c.Core.With(fields), level: c.level}
+}
+
+func (c *levelOverrideCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+// logBudget limits the debug logs of a region, the logs over the budget are counted and reported by the next
+// log written.
+type logBudget struct {
+	limiter    *rate.Limiter
+	suppressed uint64
+}
+
+func newLogBudget(cfg *Config) *logBudget {
+	if cfg.PeerDebugLogRate <= 0 {
+		return nil
+	}
+	return &logBudget{limiter: rate.NewLimiter(rate.Limit(cfg.PeerDebugLogRate), cfg.PeerDebugLogBurst)}
+}
+
+// take returns false if the budget is used up, otherwise it returns the number of the logs suppressed since
+// the last one.
+func (b *logBudget) take() (uint64, bool) {
+	if b == nil {
+		return 0, true
+	}
+	if !b.limiter.Allow() {
+		atomic.AddUint64(&b.suppressed, 1)
+		return 0, false
+	}
+	return atomic.SwapUint64(&b.suppressed, 0), true
+}
+
+// debugLog writes a debug log of the module within the log budget of the region.
+func debugLog(module string, budget *logBudget, tag string, msg string, fields ...zap.Field) {
+	if !debugEnabled(module) {
+		return
+	}
+	suppressed, ok := budget.take()
+	if !ok {
+		return
+	}
+	fields = append(fields, zap.String("tag", tag))
+	if suppressed > 0 {
+		fields = append(fields, zap.Uint64("suppressed", suppressed))
+	}
+	if logger := moduleLogger(module); logger != nil {
+		logger.Debug(msg, fields...)
+		return
+	}
+	log.Debug(msg, fields...)
+}
+
+func (p *Peer) debug(msg string, fields ...zap.Field) {
+	debugLog(LogModulePeer, p.logBudget, p.Tag, msg, fields...)
+}
+
+func (a *applier) debug(msg string, fields ...zap.Field) {
+	debugLog(LogModuleApply, a.logBudget, a.tag, msg, fields...)
+}
+
+func (ps *PeerStorage) debug(msg string, fields ...zap.Field) {
+	debugLog(LogModuleStorage, ps.logBudget, ps.Tag, msg, fields...)
+}
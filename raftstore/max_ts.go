@@ -0,0 +1,238 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	stdatomic "sync/atomic"
+	"time"
+
+	"github.com/pingcap/kvproto/pkg/errorpb"
+	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/store/mockstore/unistore/pd"
+	"github.com/uber-go/atomic"
+	"github.com/zhangjinpeng1987/raft"
+	"go.uber.org/zap"
+)
+
+// CausalTSOracle allocates the causal timestamps of a store, Config.CausalTSOracle is kept ahead of the
+// timestamps the store receives from the other stores.
+type CausalTSOracle interface {
+	// Observe makes the timestamps allocated later greater than ts.
+	Observe(ts uint64)
+}
+
+// maxTS is the max timestamp observed by a store. A region migrated to the store by a snapshot carries the
+// max commit ts of its data, so the timestamps of the store don't regress behind the data. The min commit ts
+// of the async commit transactions is kept above it by the pd client of Router.MaxTSPDClient.
+type maxTS struct {
+	ts uint64
+}
+
+// observe raises the max timestamp to ts and returns true if it is raised.
+func (m *maxTS) observe(ts uint64) bool {
+	for {
+		old := stdatomic.LoadUint64(&m.ts)
+		if ts <= old {
+			return false
+		}
+		if stdatomic.CompareAndSwapUint64(&m.ts, old, ts) {
+			return true
+		}
+	}
+}
+
+func (m *maxTS) load() uint64 {
+	return stdatomic.LoadUint64(&m.ts)
+}
+
+// raise raises the max timestamp to ts, and the causal ts oracle if the max timestamp is raised.
+func (m *maxTS) raise(ts uint64, oracle CausalTSOracle) {
+	if ts == 0 || !m.observe(ts) {
+		return
+	}
+	if oracle != nil {
+		oracle.Observe(ts)
+	}
+}
+
+// snapMaxTSKey is the key of the max commit ts in the data of a snapshot.
+var snapMaxTSKey = []byte("max_ts")
+
+// setSnapMaxTS records the max commit ts of the data of a snapshot.
+func setSnapMaxTS(snapData *rspb.RaftSnapshotData, ts uint64) {
+	if ts == 0 {
+		return
+	}
+	val := make([]byte, 8)
+	binary.BigEndian.PutUint64(val, ts)
+	snapData.Data = append(snapData.Data, &rspb.KeyValue{Key: snapMaxTSKey, Value: val})
+}
+
+// getSnapMaxTS returns the max commit ts of the data of a snapshot, it is 0 for the snapshots built by the
+// earlier versions.
+func getSnapMaxTS(snapData *rspb.RaftSnapshotData) uint64 {
+	for _, kv := range snapData.Data {
+		if bytes.Equal(kv.Key, snapMaxTSKey) && len(kv.Value) == 8 {
+			return binary.BigEndian.Uint64(kv.Value)
+		}
+	}
+	return 0
+}
+
+// observeSnapMaxTS raises the max timestamp of the store and the causal ts oracle after a snapshot is applied.
+func (d *peerMsgHandler) observeSnapMaxTS(ts uint64) {
+	d.ctx.router.maxTS.raise(ts, d.ctx.cfg.CausalTSOracle)
+}
+
+// A new leader or a merged region may serve reads with timestamps the store hasn't observed, like the reads
+// served by the former leader or the source region. So the leader fetches a fresh ts from PD to raise the max
+// timestamp before serving reads, otherwise an async commit transaction may compute a commit ts smaller than
+// the ts of a served read.
+
+// startMaxTSSync marks the max timestamp of the leader not synced, the reads are rejected until it is synced.
+func (p *Peer) startMaxTSSync() {
+	p.maxTSSyncSeq++
+	p.leaderChecker.maxTSSyncing.Store(p.maxTSSyncSeq)
+}
+
+// onMaxTSRoleChanged starts a max ts sync when the peer becomes the leader, a follower has nothing to sync.
+func (p *Peer) onMaxTSRoleChanged(state raft.StateType) {
+	if state == raft.StateLeader {
+		p.startMaxTSSync()
+	} else {
+		p.leaderChecker.maxTSSyncing.Store(0)
+	}
+}
+
+// maxTSSyncedErr returns an error if the max timestamp of the leader is not synced.
+func (c *leaderChecker) maxTSSyncedErr(regionID uint64) *errorpb.Error {
+	if c.maxTSSyncing.Load() != 0 {
+		return ErrToPbError(&ErrMaxTimestampNotSynced{RegionID: regionID})
+	}
+	return nil
+}
+
+// maxTSSyncMaxBackoff is the max delay between the retries of a failing max ts sync.
+const maxTSSyncMaxBackoff = 5 * time.Second
+
+// maxTSSyncState keeps at most one max ts sync of a peer in the PD worker, and backs off the retries while
+// PD fails.
+type maxTSSyncState struct {
+	// inFlight is set by the raft worker when the task is sent and cleared by the PD worker.
+	inFlight atomic.Bool
+	// failures is the number of the consecutive failed syncs, it is updated by the PD worker.
+	failures atomic.Uint32
+	// lastSent is only accessed by the raft worker.
+	lastSent time.Time
+}
+
+// backoff returns the delay before the next retry, it doubles on every failure from the base interval.
+func (s *maxTSSyncState) backoff(base time.Duration) time.Duration {
+	failures := s.failures.Load()
+	if failures == 0 {
+		return 0
+	}
+	backoff := base
+	for i := uint32(1); i < failures && backoff < maxTSSyncMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxTSSyncMaxBackoff {
+		backoff = maxTSSyncMaxBackoff
+	}
+	return backoff
+}
+
+// scheduleMaxTSSync asks the PD worker to sync the max timestamp if it is not synced. It is called on every
+// raft base tick until it is synced, but a sync is only sent when the last one is finished and the backoff
+// of the failed syncs has passed.
+func (d *peerMsgHandler) scheduleMaxTSSync() {
+	seq := d.peer.leaderChecker.maxTSSyncing.Load()
+	if seq == 0 {
+		return
+	}
+	state := &d.peer.maxTSSync
+	if state.inFlight.Load() {
+		return
+	}
+	now := time.Now()
+	if now.Sub(state.lastSent) < state.backoff(d.ctx.cfg.RaftBaseTickInterval) {
+		return
+	}
+	state.inFlight.Store(true)
+	state.lastSent = now
+	d.ctx.pdTaskSender <- task{tp: taskTypePDUpdateMaxTS, data: &pdUpdateMaxTSTask{
+		regionID: d.regionID(),
+		checker:  &d.peer.leaderChecker,
+		state:    state,
+		seq:      seq,
+		oracle:   d.ctx.cfg.CausalTSOracle,
+	}}
+}
+
+type pdUpdateMaxTSTask struct {
+	regionID uint64
+	checker  *leaderChecker
+	state    *maxTSSyncState
+	seq      uint64
+	oracle   CausalTSOracle
+}
+
+func (r *pdTaskHandler) onUpdateMaxTS(t *pdUpdateMaxTSTask) {
+	defer t.state.inFlight.Store(false)
+	physical, logical, err := r.pdClient.GetTS(context.TODO())
+	if err != nil {
+		log.Warn("failed to get ts to sync max ts", zap.Uint64("region id", t.regionID), zap.Error(err))
+		t.state.failures.Inc()
+		return
+	}
+	t.state.failures.Store(0)
+	ts := uint64(physical)<<18 + uint64(logical)
+	r.router.maxTS.raise(ts, t.oracle)
+	// A sync of an earlier leadership doesn't mark the current one synced.
+	if t.checker.maxTSSyncing.CAS(t.seq, 0) {
+		log.S().Debugf("region %d synced max ts %d", t.regionID, ts)
+	}
+}
+
+// MaxTS returns the max timestamp observed by the store.
+func (r *Router) MaxTS() uint64 {
+	return r.router.maxTS.load()
+}
+
+// MaxTSPDClient wraps the pd client of the MVCC store, the MVCC store gets the min commit ts of an async
+// commit or 1PC prewrite from GetTS, so the commit ts is greater than the max timestamp of the store.
+func (r *Router) MaxTSPDClient(client pd.Client) pd.Client {
+	return &maxTSPDClient{Client: client, maxTS: r.router.maxTS}
+}
+
+type maxTSPDClient struct {
+	pd.Client
+	maxTS *maxTS
+}
+
+func (c *maxTSPDClient) GetTS(ctx context.Context) (int64, int64, error) {
+	physical, logical, err := c.Client.GetTS(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	if maxTS := c.maxTS.load(); uint64(physical)<<18+uint64(logical) <= maxTS {
+		ts := maxTS + 1
+		return int64(ts >> 18), int64(ts & (1<<18 - 1)), nil
+	}
+	return physical, logical, nil
+}
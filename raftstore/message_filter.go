@@ -0,0 +1,146 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"sync"
+
+	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
+)
+
+// MessageDirection is the direction of a raft message seen by the store filtering it.
+type MessageDirection int
+
+// The message directions.
+const (
+	// MessageOutbound is a message sent by the store.
+	MessageOutbound MessageDirection = iota
+	// MessageInbound is a message received by the store, including the messages carrying the snapshots.
+	MessageInbound
+)
+
+// MessageFilter inspects the raft messages of a store, it may modify the message in place and returns false
+// to drop it. The outbound messages are filtered before the transport wrappers, so a filter sees the messages
+// the store intends to send. It is called by the raft worker and the gRPC streams, so it must not block.
+type MessageFilter interface {
+	Filter(dir MessageDirection, msg *rspb.RaftMessage) bool
+}
+
+// MessageFilterFunc adapts a function to a MessageFilter.
+type MessageFilterFunc func(dir MessageDirection, msg *rspb.RaftMessage) bool
+
+// Filter implements the MessageFilter Filter method.
+func (f MessageFilterFunc) Filter(dir MessageDirection, msg *rspb.RaftMessage) bool {
+	return f(dir, msg)
+}
+
+// IsolateStoresFilter drops the messages between the filtering store and the stores, it isolates the stores
+// if it is registered on every other store, and isolates the filtering store if it covers all the others.
+func IsolateStoresFilter(storeIDs ...uint64) MessageFilter {
+	isolated := make(map[uint64]struct{}, len(storeIDs))
+	for _, id := range storeIDs {
+		isolated[id] = struct{}{}
+	}
+	return MessageFilterFunc(func(dir MessageDirection, msg *rspb.RaftMessage) bool {
+		peer := msg.GetToPeer()
+		if dir == MessageInbound {
+			peer = msg.GetFromPeer()
+		}
+		_, ok := isolated[peer.GetStoreId()]
+		return !ok
+	})
+}
+
+// MessageFilterID identifies a registered MessageFilter.
+type MessageFilterID uint64
+
+type registeredFilter struct {
+	id     MessageFilterID
+	filter MessageFilter
+}
+
+// messageFilters is shared by the raft workers and the gRPC streams of a store, the filters are called in the
+// order of registration and see the modifications of the earlier ones.
+type messageFilters struct {
+	mu      sync.Mutex
+	nextID  MessageFilterID
+	filters []registeredFilter
+}
+
+func (m *messageFilters) add(f MessageFilter) MessageFilterID {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextID++
+	filters := make([]registeredFilter, 0, len(m.filters)+1)
+	filters = append(filters, m.filters...)
+	m.filters = append(filters, registeredFilter{id: m.nextID, filter: f})
+	return m.nextID
+}
+
+func (m *messageFilters) remove(id MessageFilterID) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, f := range m.filters {
+		if f.id == id {
+			filters := make([]registeredFilter, 0, len(m.filters)-1)
+			filters = append(filters, m.filters[:i]...)
+			m.filters = append(filters, m.filters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// pass returns false if a filter drops the message.
+func (m *messageFilters) pass(dir MessageDirection, msg *rspb.RaftMessage) bool {
+	m.mu.Lock()
+	filters := m.filters
+	m.mu.Unlock()
+	for _, f := range filters {
+		if !f.filter.Filter(dir, msg) {
+			return false
+		}
+	}
+	return true
+}
+
+// filterTransport filters the outbound messages of the store.
+type filterTransport struct {
+	inner   Transport
+	filters *messageFilters
+}
+
+// Send implements the Transport Send method.
+func (t *filterTransport) Send(msg *rspb.RaftMessage) error {
+	if !t.filters.pass(MessageOutbound, msg) {
+		return nil
+	}
+	return t.inner.Send(msg)
+}
+
+// LinkDrops implements the LinkDropCounter LinkDrops method with the inner Transport.
+func (t *filterTransport) LinkDrops(from, to uint64) (sent, dropped uint64) {
+	return linkDrops(t.inner, from, to)
+}
+
+// AddMessageFilter registers a filter of the raft messages sent and received by the store, it can be called
+// at runtime.
+func (r *Router) AddMessageFilter(f MessageFilter) MessageFilterID {
+	return r.router.messageFilters.add(f)
+}
+
+// RemoveMessageFilter deregisters the filter, it returns false if the filter is not registered.
+func (r *Router) RemoveMessageFilter(id MessageFilterID) bool {
+	return r.router.messageFilters.remove(id)
+}
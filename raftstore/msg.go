@@ -14,6 +14,7 @@
 package raftstore
 
 import (
+	"fmt"
 	"sync"
 	"time"
 
@@ -45,6 +46,16 @@ const (
 	MsgTypeStart                  MsgType = 14
 	MsgTypeApplyRes               MsgType = 15
 	MsgTypeNoop                   MsgType = 16
+	MsgTypeLeaseControl           MsgType = 17
+	MsgTypeEpochSkew              MsgType = 18
+	MsgTypeRecalculateRegionSize  MsgType = 19
+	MsgTypePausePeer              MsgType = 20
+	MsgTypeResumePeer             MsgType = 21
+	MsgTypeForceLeader            MsgType = 22
+	MsgTypeUpdateLeaderLease      MsgType = 23
+	MsgTypeReplicaState           MsgType = 24
+	MsgTypeSafeTS                 MsgType = 25
+	MsgTypeCampaign               MsgType = 26
 
 	MsgTypeStoreRaftMessage   MsgType = 101
 	MsgTypeStoreSnapshotStats MsgType = 102
@@ -67,6 +78,59 @@ const (
 	MsgTypeApplySnapshot     MsgType = 307
 )
 
+var msgTypeNames = map[MsgType]string{
+	MsgTypeNull:                        "Null",
+	MsgTypeRaftMessage:                 "RaftMessage",
+	MsgTypeRaftCmd:                     "RaftCmd",
+	MsgTypeSplitRegion:                 "SplitRegion",
+	MsgTypeComputeResult:               "ComputeResult",
+	MsgTypeRegionApproximateSize:       "RegionApproximateSize",
+	MsgTypeRegionApproximateKeys:       "RegionApproximateKeys",
+	MsgTypeCompactionDeclineBytes:      "CompactionDeclineBytes",
+	MsgTypeHalfSplitRegion:             "HalfSplitRegion",
+	MsgTypeMergeResult:                 "MergeResult",
+	MsgTypeGcSnap:                      "GcSnap",
+	MsgTypeClearRegionSize:             "ClearRegionSize",
+	MsgTypeTick:                        "Tick",
+	MsgTypeSignificantMsg:              "SignificantMsg",
+	MsgTypeStart:                       "Start",
+	MsgTypeApplyRes:                    "ApplyRes",
+	MsgTypeNoop:                        "Noop",
+	MsgTypeLeaseControl:                "LeaseControl",
+	MsgTypeEpochSkew:                   "EpochSkew",
+	MsgTypeRecalculateRegionSize:       "RecalculateRegionSize",
+	MsgTypePausePeer:                   "PausePeer",
+	MsgTypeResumePeer:                  "ResumePeer",
+	MsgTypeForceLeader:                 "ForceLeader",
+	MsgTypeUpdateLeaderLease:           "UpdateLeaderLease",
+	MsgTypeReplicaState:                "ReplicaState",
+	MsgTypeSafeTS:                      "SafeTS",
+	MsgTypeCampaign:                    "Campaign",
+	MsgTypeStoreRaftMessage:            "StoreRaftMessage",
+	MsgTypeStoreSnapshotStats:          "StoreSnapshotStats",
+	MsgTypeStoreClearRegionSizeInRange: "StoreClearRegionSizeInRange",
+	MsgTypeStoreCompactedEvent:         "StoreCompactedEvent",
+	MsgTypeStoreTick:                   "StoreTick",
+	MsgTypeStoreStart:                  "StoreStart",
+	MsgTypeFsmNormal:                   "FsmNormal",
+	MsgTypeFsmControl:                  "FsmControl",
+	MsgTypeApply:                       "Apply",
+	MsgTypeApplyRegistration:           "ApplyRegistration",
+	MsgTypeApplyProposal:               "ApplyProposal",
+	MsgTypeApplyCatchUpLogs:            "ApplyCatchUpLogs",
+	MsgTypeApplyLogsUpToDate:           "ApplyLogsUpToDate",
+	MsgTypeApplyDestroy:                "ApplyDestroy",
+	MsgTypeApplySnapshot:               "ApplySnapshot",
+}
+
+// String returns the name of the msg type.
+func (t MsgType) String() string {
+	if name, ok := msgTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("MsgType(%d)", int64(t))
+}
+
 // Msg represents a message.
 type Msg struct {
 	Type     MsgType
@@ -92,12 +156,23 @@ type Callback struct {
 	raftDoneTime   time.Time
 	applyBeginTime time.Time
 	applyDoneTime  time.Time
+	// appliedIndex is the index the command is applied at.
+	appliedIndex uint64
+	// onDone is called before the waiters of the callback are woken up.
+	onDone func(cb *Callback)
+
+	// subs are the callbacks of the sub commands of a batched command.
+	subs []subCallback
 }
 
 // Done sets the RaftCmdResponse and calls Done() on the WaitGroup.
 func (cb *Callback) Done(resp *raft_cmdpb.RaftCmdResponse) {
 	if cb != nil {
 		cb.resp = resp
+		if cb.onDone != nil {
+			cb.onDone(cb)
+		}
+		cb.demux()
 		cb.wg.Done()
 	}
 }
@@ -120,6 +195,8 @@ const (
 	PeerTickPdHeartbeat      PeerTick = 3
 	PeerTickCheckMerge       PeerTick = 4
 	PeerTickPeerStaleState   PeerTick = 5
+	PeerTickCheckInvariants  PeerTick = 6
+	PeerTickUpdateSafeTS     PeerTick = 7
 )
 
 // StoreTick represents a store tick.
@@ -131,6 +208,9 @@ const (
 	StoreTickPdStoreHeartbeat StoreTick = 1
 	StoreTickSnapGC           StoreTick = 2
 	StoreTickConsistencyCheck StoreTick = 3
+	StoreTickTombstoneGC      StoreTick = 4
+	StoreTickCheckInvariants  StoreTick = 5
+	StoreTickIngestLimiter    StoreTick = 6
 )
 
 // MsgSignificantType represents a significant type of msg.
@@ -154,6 +234,8 @@ type MsgRaftCmd struct {
 	SendTime time.Time
 	Request  raftlog.RaftLog
 	Callback *Callback
+	// pending is the pending command counter of the peer mailbox.
+	pending *int64
 }
 
 // MsgSplitRegion defines a message which is used to split region.
@@ -165,6 +247,42 @@ type MsgSplitRegion struct {
 	Callback  *Callback
 }
 
+// LeaseControlOp represents an operation on the leader lease used to simulate lease anomalies in tests.
+type LeaseControlOp int
+
+// LeaseControlOp
+const (
+	LeaseControlExpire  LeaseControlOp = 1
+	LeaseControlSuspect LeaseControlOp = 2
+)
+
+// MsgLeaseControl defines a message which is used to force the leader lease of a region into a state,
+// it is only handled when Config.EnableLeaseControl is true.
+type MsgLeaseControl struct {
+	Op       LeaseControlOp
+	Callback *Callback
+}
+
+// MsgEpochSkew defines a message which is used to bump the region epoch of a peer, it is only handled when
+// Config.EnableEpochSkew is true.
+type MsgEpochSkew struct {
+	Skew     EpochSkew
+	Callback *Callback
+}
+
+// MsgCampaign defines a message which is used to elect a peer without waiting for the election timeout, it
+// is only handled when Config.FastCampaign is true.
+type MsgCampaign struct {
+	Callback *Callback
+}
+
+// MsgForceLeader drops the peers on the failed stores from the region, and campaigns if Campaign is true.
+type MsgForceLeader struct {
+	FailedStores []uint64
+	Campaign     bool
+	Callback     *Callback
+}
+
 // MsgComputeHashResult defines a message which is used to compute hash result.
 type MsgComputeHashResult struct {
 	Index uint64
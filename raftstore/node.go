@@ -48,6 +48,7 @@ func NewNode(system *raftBatchSystem, store *metapb.Store, cfg *Config, pdClient
 	} else {
 		store.Address = cfg.Addr
 	}
+	store.StatusAddress = cfg.StatusAddr
 	store.Version = "3.0.0-bata.1"
 	for _, l := range cfg.Labels {
 		store.Labels = append(store.Labels, &metapb.StoreLabel{Key: l.LabelKey, Value: l.LabelValue})
@@ -0,0 +1,108 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// heartbeatBatch delays the region heartbeats scheduled after a split or a conf change is applied. A
+// mass split schedules a heartbeat for every new region at once, the heartbeats received in the delay
+// window are sent together and only the latest heartbeat of a region is kept. It is only accessed by
+// the pd worker.
+type heartbeatBatch struct {
+	delay   time.Duration
+	sender  chan<- task
+	pending map[uint64]*pdRegionHeartbeatTask
+	// flushRetries counts the flushes retried on a full channel, it's accessed by the timer goroutines.
+	flushRetries uint64
+}
+
+func newHeartbeatBatch(delay time.Duration, sender chan<- task) *heartbeatBatch {
+	return &heartbeatBatch{
+		delay:   delay,
+		sender:  sender,
+		pending: make(map[uint64]*pdRegionHeartbeatTask),
+	}
+}
+
+// add returns false if the heartbeat is not delayed and should be sent immediately.
+func (b *heartbeatBatch) add(t *pdRegionHeartbeatTask) bool {
+	if b == nil || b.delay <= 0 {
+		return false
+	}
+	b.pending[t.region.GetId()] = t
+	if len(b.pending) == 1 {
+		// The first heartbeat of the batch starts the window.
+		b.scheduleFlush()
+	}
+	return true
+}
+
+// scheduleFlush sends the flush task to the pd worker after the delay. The timer goroutine must not block
+// on a busy pd worker, so the flush is retried after another delay if the channel is full.
+func (b *heartbeatBatch) scheduleFlush() {
+	time.AfterFunc(b.delay, func() {
+		select {
+		case b.sender <- task{tp: taskTypePDFlushHeartbeats}:
+		default:
+			atomic.AddUint64(&b.flushRetries, 1)
+			b.scheduleFlush()
+		}
+	})
+}
+
+// remove drops the delayed heartbeat of the region, it is called when a newer heartbeat is sent.
+func (b *heartbeatBatch) remove(regionID uint64) {
+	if b != nil {
+		delete(b.pending, regionID)
+	}
+}
+
+// take returns the delayed heartbeats ordered by region id and starts a new batch.
+func (b *heartbeatBatch) take() []*pdRegionHeartbeatTask {
+	if b == nil || len(b.pending) == 0 {
+		return nil
+	}
+	tasks := make([]*pdRegionHeartbeatTask, 0, len(b.pending))
+	for _, t := range b.pending {
+		tasks = append(tasks, t)
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].region.GetId() < tasks[j].region.GetId()
+	})
+	b.pending = make(map[uint64]*pdRegionHeartbeatTask)
+	return tasks
+}
+
+func (r *pdTaskHandler) onDelayedHeartbeat(t *pdRegionHeartbeatTask) {
+	if !r.heartbeats.add(t) {
+		r.onHeartbeat(t)
+	}
+}
+
+func (r *pdTaskHandler) onFlushHeartbeats() {
+	tasks := r.heartbeats.take()
+	for _, t := range tasks {
+		r.onHeartbeat(t)
+	}
+	if len(tasks) > 0 {
+		log.Debug("flush delayed region heartbeats", zap.Int("regions", len(tasks)))
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"time"
+
+	"github.com/ngaut/unistore/raftstore/raftlog"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/pdpb"
+	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// operatorMsg converts the operator step carried by the region heartbeat response to the message routed to
+// the region. The admin requests are sent as MsgTypeRaftCmd, and the splits as MsgTypeSplitRegion if PD
+// gives the split keys, or MsgTypeHalfSplitRegion otherwise. nil is returned if there is no step to execute.
+func operatorMsg(resp *pdpb.RegionHeartbeatResponse) (*Msg, error) {
+	regionID := resp.GetRegionId()
+	switch {
+	case resp.GetChangePeer() != nil:
+		return operatorAdminMsg(resp, "change peer", changePeerRequest(resp.GetChangePeer())), nil
+	case resp.GetChangePeerV2() != nil:
+		// The store doesn't enter the joint state, so only a single change is executed as ChangePeer and
+		// there is nothing to do to leave the joint state.
+		changes := resp.GetChangePeerV2().GetChanges()
+		switch len(changes) {
+		case 0:
+			return nil, nil
+		case 1:
+			return operatorAdminMsg(resp, "change peer", changePeerRequest(changes[0])), nil
+		}
+		return nil, errors.Errorf("region %d ChangePeerV2 with %d changes is not supported", regionID, len(changes))
+	case resp.GetTransferLeader() != nil:
+		return operatorAdminMsg(resp, "transfer leader", &raft_cmdpb.AdminRequest{
+			CmdType: raft_cmdpb.AdminCmdType_TransferLeader,
+			TransferLeader: &raft_cmdpb.TransferLeaderRequest{
+				Peer: resp.GetTransferLeader().GetPeer(),
+			},
+		}), nil
+	case resp.GetSplitRegion() != nil:
+		split := resp.GetSplitRegion()
+		if split.GetPolicy() == pdpb.CheckPolicy_USEKEY {
+			if len(split.GetKeys()) == 0 {
+				return nil, errors.Errorf("region %d split by keys without a split key", regionID)
+			}
+			return &Msg{
+				Type:     MsgTypeSplitRegion,
+				RegionID: regionID,
+				Data: &MsgSplitRegion{
+					RegionEpoch: resp.GetRegionEpoch(),
+					SplitKeys:   split.GetKeys(),
+					Callback:    newOperatorCallback(regionID, "split"),
+				},
+			}, nil
+		}
+		return &Msg{
+			Type:     MsgTypeHalfSplitRegion,
+			RegionID: regionID,
+			Data: &MsgHalfSplitRegion{
+				RegionEpoch: resp.GetRegionEpoch(),
+			},
+		}, nil
+	case resp.GetMerge() != nil:
+		return operatorAdminMsg(resp, "merge", &raft_cmdpb.AdminRequest{
+			CmdType: raft_cmdpb.AdminCmdType_PrepareMerge,
+			PrepareMerge: &raft_cmdpb.PrepareMergeRequest{
+				Target: resp.GetMerge().GetTarget(),
+			},
+		}), nil
+	}
+	return nil, nil
+}
+
+func changePeerRequest(changePeer *pdpb.ChangePeer) *raft_cmdpb.AdminRequest {
+	return &raft_cmdpb.AdminRequest{
+		CmdType: raft_cmdpb.AdminCmdType_ChangePeer,
+		ChangePeer: &raft_cmdpb.ChangePeerRequest{
+			ChangeType: changePeer.GetChangeType(),
+			Peer:       changePeer.GetPeer(),
+		},
+	}
+}
+
+// operatorAdminMsg builds the raft command of the admin request for the leader targeted by PD.
+func operatorAdminMsg(resp *pdpb.RegionHeartbeatResponse, op string, req *raft_cmdpb.AdminRequest) *Msg {
+	regionID := resp.GetRegionId()
+	return &Msg{
+		Type:     MsgTypeRaftCmd,
+		RegionID: regionID,
+		Data: &MsgRaftCmd{
+			SendTime: time.Now(),
+			Request: raftlog.NewRequest(&raft_cmdpb.RaftCmdRequest{
+				Header: &raft_cmdpb.RaftRequestHeader{
+					RegionId:    regionID,
+					Peer:        resp.GetTargetPeer(),
+					RegionEpoch: resp.GetRegionEpoch(),
+				},
+				AdminRequest: req,
+			}),
+			Callback: newOperatorCallback(regionID, op),
+		},
+	}
+}
+
+// newOperatorCallback returns a callback logging the failure of the operator step, PD retries the step
+// or times out the operator by the following heartbeats.
+func newOperatorCallback(regionID uint64, op string) *Callback {
+	cb := NewCallback()
+	cb.onDone = func(cb *Callback) {
+		if err := cb.resp.GetHeader().GetError(); err != nil {
+			log.Warn("failed to execute pd operator", zap.Uint64("region id", regionID), zap.String("op", op),
+				zap.Stringer("error", err))
+		}
+	}
+	return cb
+}
+
+// dispatchOperator routes the operator step of the region heartbeat response to the region.
+func (r *pdTaskHandler) dispatchOperator(resp *pdpb.RegionHeartbeatResponse) {
+	if changePeer := resp.GetChangePeer(); changePeer != nil {
+		if err := r.checkPlacement(resp.RegionId, changePeer); err != nil {
+			log.Warn("reject change peer", zap.Uint64("region id", resp.RegionId), zap.Error(err))
+			return
+		}
+	} else if changes := resp.GetChangePeerV2().GetChanges(); len(changes) == 1 {
+		if err := r.checkPlacement(resp.RegionId, changes[0]); err != nil {
+			log.Warn("reject change peer", zap.Uint64("region id", resp.RegionId), zap.Error(err))
+			return
+		}
+	}
+	msg, err := operatorMsg(resp)
+	if err != nil {
+		log.Warn("reject pd operator", zap.Uint64("region id", resp.RegionId), zap.Error(err))
+		return
+	}
+	if msg == nil {
+		return
+	}
+	if msg.Type == MsgTypeRaftCmd {
+		err = r.router.sendRaftCommand(msg.Data.(*MsgRaftCmd))
+	} else {
+		err = r.router.send(msg.RegionID, *msg)
+	}
+	if err != nil {
+		log.S().Error(err)
+	}
+}
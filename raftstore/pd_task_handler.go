@@ -28,21 +28,28 @@ import (
 )
 
 type pdTaskHandler struct {
-	storeID  uint64
-	pdClient pd.Client
-	router   *router
+	storeID   uint64
+	pdClient  pd.Client
+	router    *router
+	placement *placementChecker
+	// heartbeats are the delayed region heartbeats.
+	heartbeats *heartbeatBatch
 
 	// statistics
 	storeStats storeStatistics
 	peerStats  map[uint64]*peerStatistics
 }
 
-func newPDTaskHandler(storeID uint64, pdClient pd.Client, router *router) *pdTaskHandler {
+func newPDTaskHandler(storeID uint64, pdClient pd.Client, router *router, placement *placementChecker,
+	heartbeats *heartbeatBatch) *pdTaskHandler {
 	return &pdTaskHandler{
-		storeID:   storeID,
-		pdClient:  pdClient,
-		router:    router,
-		peerStats: make(map[uint64]*peerStatistics),
+		storeID:    storeID,
+		pdClient:   pdClient,
+		router:     router,
+		placement:  placement,
+		heartbeats: heartbeats,
+		storeStats: storeStatistics{lastReport: time.Now()},
+		peerStats:  make(map[uint64]*peerStatistics),
 	}
 }
 
@@ -53,7 +60,14 @@ func (r *pdTaskHandler) handle(t task) {
 	case taskTypePDAskBatchSplit:
 		r.onAskBatchSplit(t.data.(*pdAskBatchSplitTask))
 	case taskTypePDHeartbeat:
-		r.onHeartbeat(t.data.(*pdRegionHeartbeatTask))
+		hb := t.data.(*pdRegionHeartbeatTask)
+		// The delayed heartbeat of the region is stale now.
+		r.heartbeats.remove(hb.region.GetId())
+		r.onHeartbeat(hb)
+	case taskTypePDDelayedHeartbeat:
+		r.onDelayedHeartbeat(t.data.(*pdRegionHeartbeatTask))
+	case taskTypePDFlushHeartbeats:
+		r.onFlushHeartbeats()
 	case taskTypePDStoreHeartbeat:
 		r.onStoreHeartbeat(t.data.(*pdStoreHeartbeatTask))
 	case taskTypePDReportBatchSplit:
@@ -64,49 +78,19 @@ func (r *pdTaskHandler) handle(t task) {
 		r.onReadStats(t.data.(readStats))
 	case taskTypePDDestroyPeer:
 		r.onDestroyPeer(t.data.(*pdDestroyPeerTask))
+	case taskTypePDUpdateMaxTS:
+		r.onUpdateMaxTS(t.data.(*pdUpdateMaxTSTask))
+	case taskTypePDSnapStorm:
+		r.onSnapStorm(t.data.(*pdSnapStormTask))
+	case taskTypePDUpdateSafeTS:
+		r.onUpdateSafeTS(t.data.(*pdUpdateSafeTSTask))
 	default:
 		log.S().Error("unsupported task type:", t.tp)
 	}
 }
 
 func (r *pdTaskHandler) start() {
-	r.pdClient.SetRegionHeartbeatResponseHandler(r.onRegionHeartbeatResponse)
-}
-
-func (r *pdTaskHandler) onRegionHeartbeatResponse(resp *pdpb.RegionHeartbeatResponse) {
-	if changePeer := resp.GetChangePeer(); changePeer != nil {
-		r.sendAdminRequest(resp.RegionId, resp.RegionEpoch, resp.TargetPeer, &raft_cmdpb.AdminRequest{
-			CmdType: raft_cmdpb.AdminCmdType_ChangePeer,
-			ChangePeer: &raft_cmdpb.ChangePeerRequest{
-				ChangeType: changePeer.ChangeType,
-				Peer:       changePeer.Peer,
-			},
-		}, NewCallback())
-	} else if transferLeader := resp.GetTransferLeader(); transferLeader != nil {
-		r.sendAdminRequest(resp.RegionId, resp.RegionEpoch, resp.TargetPeer, &raft_cmdpb.AdminRequest{
-			CmdType: raft_cmdpb.AdminCmdType_TransferLeader,
-			TransferLeader: &raft_cmdpb.TransferLeaderRequest{
-				Peer: transferLeader.Peer,
-			},
-		}, NewCallback())
-	} else if splitRegion := resp.GetSplitRegion(); splitRegion != nil {
-		if err := r.router.send(resp.RegionId, Msg{
-			Type:     MsgTypeHalfSplitRegion,
-			RegionID: resp.RegionId,
-			Data: &MsgHalfSplitRegion{
-				RegionEpoch: resp.RegionEpoch,
-			},
-		}); err != nil {
-			log.S().Error(err)
-		}
-	} else if merge := resp.GetMerge(); merge != nil {
-		r.sendAdminRequest(resp.RegionId, resp.RegionEpoch, resp.TargetPeer, &raft_cmdpb.AdminRequest{
-			CmdType: raft_cmdpb.AdminCmdType_PrepareMerge,
-			PrepareMerge: &raft_cmdpb.PrepareMergeRequest{
-				Target: merge.Target,
-			},
-		}, NewCallback())
-	}
+	r.pdClient.SetRegionHeartbeatResponseHandler(r.dispatchOperator)
 }
 
 func (r *pdTaskHandler) onAskSplit(t *pdAskSplitTask) {
@@ -163,6 +147,7 @@ func (r *pdTaskHandler) onHeartbeat(t *pdRegionHeartbeatTask) {
 	req := &pdpb.RegionHeartbeatRequest{
 		Region:          t.region,
 		Leader:          t.peer,
+		Term:            t.term,
 		DownPeers:       t.downPeers,
 		PendingPeers:    t.pendingPeers,
 		ApproximateSize: uint64(size),
@@ -24,6 +24,7 @@ import (
 
 	"github.com/ngaut/unistore/raftstore/raftlog"
 	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 	"github.com/pingcap/kvproto/pkg/metapb"
 	"github.com/pingcap/kvproto/pkg/pdpb"
 	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
@@ -31,6 +32,7 @@ import (
 	"github.com/pingcap/log"
 	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/mvcc"
 	"github.com/zhangjinpeng1987/raft"
+	"go.uber.org/zap"
 )
 
 // ReadyICPair represents a ready IC pair.
@@ -60,6 +62,14 @@ type ReadIndexRequest struct {
 	id             uint64
 	cmds           []*ReqCbPair
 	renewLeaseTime *time.Time
+	// term is the term the read is proposed in, the renewLeaseTime of an earlier term is stale.
+	term uint64
+	// readIndex is the committed index returned by the leader, the read can be served after it is applied.
+	readIndex uint64
+	// ranges are the key ranges read by the cmds, they are carried in the read index context.
+	ranges []*kvrpcpb.KeyRange
+	// rejected is set if the leader rejects the read index.
+	rejected bool
 }
 
 // NewReadIndexRequest creates a new ReadIndexRequest.
@@ -72,9 +82,7 @@ func NewReadIndexRequest(id uint64, cmds []*ReqCbPair, renewLeaseTime *time.Time
 }
 
 func (r *ReadIndexRequest) binaryID() []byte {
-	var buf = make([]byte, 8)
-	binary.BigEndian.PutUint64(buf, r.id)
-	return buf
+	return encodeReadIndexContext(r.id, r.ranges)
 }
 
 // ReadIndexQueue defines a ReadIndex queue.
@@ -82,6 +90,47 @@ type ReadIndexQueue struct {
 	idAllocator uint64
 	reads       []*ReadIndexRequest
 	readyCnt    int
+	metrics     readIndexMetrics
+}
+
+// ReadIndexMetrics represents the metrics of a ReadIndex queue.
+type ReadIndexMetrics struct {
+	// Pending is the number of ReadIndex requests waiting for the read state, it is a gauge.
+	Pending int64
+	// Ready is the number of ReadIndex requests waiting to be applied, it is a gauge.
+	Ready int64
+	// Dropped is the total number of read commands dropped by ClearUncommitted.
+	Dropped uint64
+	// LastDropTerm is the term of the last ClearUncommitted that dropped reads.
+	LastDropTerm uint64
+	// LastDropped is the number of read commands dropped by the last ClearUncommitted that dropped reads.
+	LastDropped uint64
+}
+
+// readIndexMetrics is updated by the peer goroutine and can be loaded concurrently.
+type readIndexMetrics struct {
+	pending      int64
+	ready        int64
+	dropped      uint64
+	lastDropTerm uint64
+	lastDropped  uint64
+}
+
+// Metrics returns the metrics of the ReadIndex queue, it is safe to be called concurrently.
+func (q *ReadIndexQueue) Metrics() ReadIndexMetrics {
+	return ReadIndexMetrics{
+		Pending:      atomic.LoadInt64(&q.metrics.pending),
+		Ready:        atomic.LoadInt64(&q.metrics.ready),
+		Dropped:      atomic.LoadUint64(&q.metrics.dropped),
+		LastDropTerm: atomic.LoadUint64(&q.metrics.lastDropTerm),
+		LastDropped:  atomic.LoadUint64(&q.metrics.lastDropped),
+	}
+}
+
+// updateGauges publishes the current queue length, it must be called after the queue is modified.
+func (q *ReadIndexQueue) updateGauges() {
+	atomic.StoreInt64(&q.metrics.pending, int64(len(q.reads)-q.readyCnt))
+	atomic.StoreInt64(&q.metrics.ready, int64(q.readyCnt))
 }
 
 // PopFront pops the front ReadIndexRequest from the ReadIndex queue.
@@ -112,16 +161,40 @@ func (q *ReadIndexQueue) NextID() uint64 {
 	return q.idAllocator
 }
 
-// ClearUncommitted clears the uncommitted ReadIndex requests.
-func (q *ReadIndexQueue) ClearUncommitted(term uint64) {
+// ClearUncommitted clears the uncommitted ReadIndex requests and returns the number of dropped read commands.
+func (q *ReadIndexQueue) ClearUncommitted(term uint64) int {
+	return q.clearUncommitted(term, func(*ReadIndexRequest) bool { return true })
+}
+
+// ClearStale clears the uncommitted ReadIndex requests proposed before the term and returns the number of
+// dropped read commands. The raft group drops its pending reads on a term change, which doesn't change the
+// soft state if the leadership bounces back before the next ready.
+func (q *ReadIndexQueue) ClearStale(term uint64) int {
+	return q.clearUncommitted(term, func(read *ReadIndexRequest) bool { return read.term < term })
+}
+
+func (q *ReadIndexQueue) clearUncommitted(term uint64, stale func(*ReadIndexRequest) bool) int {
 	uncommitted := q.reads[q.readyCnt:]
-	q.reads = q.reads[:q.readyCnt]
+	q.reads = q.reads[:q.readyCnt:q.readyCnt]
+	var dropped int
 	for _, read := range uncommitted {
+		if !stale(read) {
+			q.reads = append(q.reads, read)
+			continue
+		}
 		for _, reqCbPair := range read.cmds {
 			NotifyStaleReq(term, reqCbPair.Cb)
 		}
+		dropped += len(read.cmds)
 		read.cmds = nil
 	}
+	if dropped > 0 {
+		atomic.AddUint64(&q.metrics.dropped, uint64(dropped))
+		atomic.StoreUint64(&q.metrics.lastDropTerm, term)
+		atomic.StoreUint64(&q.metrics.lastDropped, uint64(dropped))
+	}
+	q.updateGauges()
+	return dropped
 }
 
 // ProposalMeta represents a proposal meta.
@@ -164,32 +237,39 @@ const (
 	ProposalContextSyncLog      ProposalContext = 1
 	ProposalContextSplit        ProposalContext = 1 << 1
 	ProposalContextPrepareMerge ProposalContext = 1 << 2
+	// Reserved for the flashback proposals.
+	ProposalContextFlashback ProposalContext = 1 << 3
+	// Reserved for the proposals refreshing the region buckets.
+	ProposalContextBucketRefresh ProposalContext = 1 << 4
 )
 
-// ProposalContext represents a proposal context.
-type ProposalContext byte
+// ProposalContext represents a proposal context, it is a set of flags carried in the context of a raft entry.
+type ProposalContext uint64
 
-// ToBytes converts the ProposalContext to bytes.
+// ToBytes converts the ProposalContext to bytes. The flags are encoded as a uvarint, so the flags below
+// 1 << 7 are encoded in a single byte as the earlier versions do.
 func (c ProposalContext) ToBytes() []byte {
-	return []byte{byte(c)}
+	buf := make([]byte, binary.MaxVarintLen64)
+	return buf[:binary.PutUvarint(buf, uint64(c))]
 }
 
-// NewProposalContextFromBytes creates a ProposalContext with the given bytes.
+// NewProposalContextFromBytes creates a ProposalContext with the given bytes, it returns nil if the bytes
+// are empty. The unknown flags are kept and the bytes after the flags are ignored, they are left for the
+// later versions.
 func NewProposalContextFromBytes(ctx []byte) *ProposalContext {
-	var res ProposalContext
-	l := len(ctx)
-	if l == 0 {
+	if len(ctx) == 0 {
 		return nil
-	} else if l == 1 {
-		res = ProposalContext(ctx[0])
-	} else {
+	}
+	flags, n := binary.Uvarint(ctx)
+	if n <= 0 {
 		panic(fmt.Sprintf("Invalid ProposalContext %v", ctx))
 	}
+	res := ProposalContext(flags)
 	return &res
 }
 
 func (c *ProposalContext) contains(flag ProposalContext) bool {
-	return byte(*c)&byte(flag) != 0
+	return c != nil && *c&flag != 0
 }
 
 func (c *ProposalContext) insert(flag ProposalContext) {
@@ -202,6 +282,22 @@ type PeerStat struct {
 	WrittenKeys  uint64
 }
 
+// ApplyGapMetrics represents the gap between the committed and the applied index of a region.
+type ApplyGapMetrics struct {
+	Committed uint64
+	Applied   uint64
+	Gap       uint64
+	// Rejected is the number of proposals rejected with ServerIsBusy because the gap exceeds Config.MaxApplyGap.
+	Rejected uint64
+}
+
+// applyGapMetrics is updated by the peer goroutine and can be loaded concurrently.
+type applyGapMetrics struct {
+	committed uint64
+	applied   uint64
+	rejected  uint64
+}
+
 // WaitApplyResultState is a struct that stores the state to wait for `PrepareMerge` apply result.
 //
 // When handling the apply result of a `CommitMerge`, the source peer may have
@@ -272,8 +368,44 @@ type Peer struct {
 	proposals      *ProposalQueue
 	applyProposals []*proposal
 	pendingReads   *ReadIndexQueue
-
-	peerCache map[uint64]*metapb.Peer
+	applyGap       applyGapMetrics
+	// droppedProposals is shared by the peers of the store, it is nil before the peer is registered.
+	droppedProposals *dropCounter
+	// invariants is shared by the peers of the store, it is nil before the peer is registered.
+	invariants *invariantChecker
+	hotKeys        *hotKeySampler
+	applyProfiler  *applyProfiler
+	// replicationLag holds a *RegionReplicationLag, it is nil if the peer is not the leader.
+	replicationLag atomic.Value
+	leaseStats     *leaseStats
+	leaseChecks    leaseChecks
+	splitHint      splitHint
+	loadSplit      loadSplitter
+	electionTimer  *electionTimer
+
+	// followerLags are the lagging followers of the leader.
+	followerLags  map[uint64]followerLag
+	catchUpEvents catchUpEvents
+
+	// snapWaiters are the commands received while applying a snapshot, they are proposed after the
+	// snapshot is applied, or fail after Config.SnapWaitTimeout.
+	snapWaiters []*MsgRaftCmd
+
+	// sizeRecalculating is set when the approximate size is being recalculated after a compaction or a range
+	// deletion, the size is reported to PD once it is recalculated.
+	sizeRecalculating bool
+	// persisting is set when the last ready is being persisted by the async raft log writer.
+	persisting bool
+	// sizeCheckTime is the time the region is last scanned for the approximate size, see
+	// Config.RegionSizeReconcileInterval.
+	sizeCheckTime time.Time
+
+	// checkpoint is the checkpoint the peer is created from, it is nil after the log of the leader is proved
+	// to continue from it.
+	checkpoint *checkpointState
+
+	peerCache      map[uint64]*metapb.Peer
+	peerCacheStats peerCacheStats
 
 	// Record the last instant of each peer's heartbeat response.
 	PeerHeartbeats map[uint64]time.Time
@@ -312,10 +444,52 @@ type Peer struct {
 	// The index of the latest committed prepare merge command.
 	lastCommittedPrepareMergeIdx uint64
 	PendingMergeState            *rspb.MergeState
+	pendingMergeTime             time.Time
 	leaderMissingTime            *time.Time
 	leaderLease                  *Lease
 	leaderChecker                leaderChecker
 
+	// leaderTerm is the term the peer is last seen as the leader of, leaderStartTime is the lease clock
+	// time it is first seen. A lease of the term is never renewed by a time before leaderStartTime.
+	leaderTerm           uint64
+	leaderStartTime      time.Time
+	checkLeaseInvariants bool
+
+	// readFallback counts the reads falling back to ReadIndex and renews the lease early if there are many.
+	readFallback *readFallbackStats
+
+	// snapSource relays the snapshots by the followers closer to the receivers, nil if the leader sends them.
+	snapSource *snapSource
+
+	// hibernate stops ticking the raft group when the region is idle, nil if HibernateRegions is disabled.
+	hibernate *hibernateState
+
+	// flowControl tunes the replication windows of the followers, nil if RaftAdaptiveFlowControl is disabled.
+	flowControl *flowController
+
+	// logReaders pins the raft log entries still read by the readers out of the peer.
+	logReaders *raftLogReaders
+
+	// lastShutdown is the scheduler state saved by the last shutdown of the store, nil if there is none.
+	lastShutdown *SchedulerState
+
+	// logBudget limits the debug logs of the region, it's shared by the applier and the storage of the peer.
+	logBudget *logBudget
+
+	// forceLeader is the ForceLeader state, nil if the peer isn't forced to be the leader.
+	forceLeader *forceLeaderState
+
+	// maxTSSyncSeq is the sequence number of the last max ts sync.
+	maxTSSyncSeq uint64
+	// maxTSSync is the state of the max ts sync task sent to the PD worker.
+	maxTSSync maxTSSyncState
+
+	// safeTS advances the safe ts of the bounded staleness reads.
+	safeTS safeTSState
+
+	// The source regions of the committed but not applied commit merge commands.
+	pendingMergeSources []pendingMergeSource
+
 	// If a snapshot is being applied asynchronously, messages should not be sent.
 	pendingMessages         []eraftpb.Message
 	PendingMergeApplyResult *WaitApplyResultState
@@ -337,9 +511,10 @@ func NewPeer(storeID uint64, cfg *Config, engines *Engines, region *metapb.Regio
 
 	appliedIndex := ps.AppliedIndex()
 
+	electionTimer := newElectionTimer(cfg)
 	raftCfg := &raft.Config{
 		ID:              peer.GetId(),
-		ElectionTick:    cfg.RaftElectionTimeoutTicks,
+		ElectionTick:    electionTimer.raftElectionTick(cfg),
 		HeartbeatTick:   cfg.RaftHeartbeatTicks,
 		MaxSizePerMsg:   cfg.RaftMaxSizePerMsg,
 		MaxInflightMsgs: cfg.RaftMaxInflightMsgs,
@@ -373,21 +548,43 @@ func NewPeer(storeID uint64, cfg *Config, engines *Engines, region *metapb.Regio
 		Tag:                   tag,
 		LastApplyingIdx:       appliedIndex,
 		lastUrgentProposalIdx: math.MaxInt64,
-		leaderLease:           NewLease(cfg.RaftStoreMaxLeaderLease),
-	}
+		leaderLease:           NewLeaseWithClock(cfg.RaftStoreMaxLeaderLease, cfg.LeaseClock),
+		hotKeys:               newHotKeySampler(cfg.HotKeySampleCapacity),
+		applyProfiler:         newApplyProfiler(cfg.ApplyProfileSampleRate),
+		leaseStats:            newLeaseStats(),
+		electionTimer:         electionTimer,
+		checkLeaseInvariants:  cfg.CheckLeaseInvariants,
+	}
+	p.readFallback = newReadFallbackStats(cfg)
+	p.snapSource = newSnapSource(cfg)
+	p.hibernate = newHibernateState(cfg)
+	p.flowControl = newFlowController(cfg)
+	p.logReaders = newRaftLogReaders()
+	p.logBudget = newLogBudget(cfg)
+	ps.logBudget = p.logBudget
+	ps.snapGenGuard = newSnapGenGuard(cfg)
+	ps.cache.capacity = cfg.RaftEntryCacheCapacity
 
 	p.leaderChecker.peerID = p.PeerID()
+	p.leaderChecker.clock = cfg.LeaseClock
+	p.leaderChecker.readFallback = p.readFallback
 	p.leaderChecker.region = unsafe.Pointer(region)
 	p.leaderChecker.term.Store(p.Term())
 	p.leaderChecker.appliedIndexTerm.Store(ps.appliedIndexTerm)
+	p.leaderChecker.appliedIndex.Store(ps.AppliedIndex())
 
 	// If this region has only one peer and I am the one, campaign directly.
-	if len(region.GetPeers()) == 1 && region.GetPeers()[0].GetStoreId() == storeID {
+	if cfg.FastCampaign && votersOnStore(region, storeID) {
+		if err = p.campaignAlone(); err != nil {
+			return nil, err
+		}
+	} else if len(region.GetPeers()) == 1 && region.GetPeers()[0].GetStoreId() == storeID {
 		err = p.RaftGroup.Campaign()
 		if err != nil {
 			return nil, err
 		}
 	}
+	p.electionTimer.observe(p.RaftGroup.Raft)
 
 	return p, nil
 }
@@ -401,16 +598,15 @@ func (p *Peer) getEventContext() *PeerEventContext {
 
 func (p *Peer) insertPeerCache(peer *metapb.Peer) {
 	p.peerCache[peer.GetId()] = peer
-}
-
-func (p *Peer) removePeerCache(peerID uint64) {
-	delete(p.peerCache, peerID)
+	atomic.StoreInt64(&p.peerCacheStats.size, int64(len(p.peerCache)))
 }
 
 func (p *Peer) getPeerFromCache(peerID uint64) *metapb.Peer {
 	if peer, ok := p.peerCache[peerID]; ok {
+		atomic.AddUint64(&p.peerCacheStats.hits, 1)
 		return peer
 	}
+	atomic.AddUint64(&p.peerCacheStats.misses, 1)
 	for _, peer := range p.peerStorage.Region().GetPeers() {
 		if peer.GetId() == peerID {
 			p.insertPeerCache(peer)
@@ -496,6 +692,10 @@ func (p *Peer) Destroy(engine *Engines, keepData bool) error {
 		}
 	}
 
+	if p.Store().CancelGeneratingSnap() {
+		log.S().Infof("%v cancel generating snapshot for destroy", p.Tag)
+	}
+
 	for _, read := range p.pendingReads.reads {
 		for _, r := range read.cmds {
 			NotifyReqRegionRemoved(region.Id, r.Cb)
@@ -503,6 +703,13 @@ func (p *Peer) Destroy(engine *Engines, keepData bool) error {
 		read.cmds = nil
 	}
 	p.pendingReads.reads = nil
+	p.pendingReads.readyCnt = 0
+	p.pendingReads.updateGauges()
+
+	for _, cmd := range p.snapWaiters {
+		NotifyReqRegionRemoved(region.Id, cmd.Callback)
+	}
+	p.snapWaiters = nil
 
 	for _, proposal := range p.applyProposals {
 		NotifyReqRegionRemoved(region.Id, proposal.cb)
@@ -527,10 +734,18 @@ func (p *Peer) Region() *metapb.Region {
 // This will update the region of the peer, caller must ensure the region
 // has been preserved in a durable device.
 func (p *Peer) SetRegion(region *metapb.Region) {
-	if p.Region().GetRegionEpoch().GetVersion() < region.GetRegionEpoch().GetVersion() {
+	oldEpoch, newEpoch := p.Region().GetRegionEpoch(), region.GetRegionEpoch()
+	if oldEpoch.GetVersion() < newEpoch.GetVersion() {
 		// Epoch version changed, disable read on the localreader for this region.
 		p.leaderLease.ExpireRemoteLease()
 	}
+	if oldEpoch.GetVersion() != newEpoch.GetVersion() || oldEpoch.GetConfVer() != newEpoch.GetConfVer() {
+		// The snapshot of the old epoch is rejected by the peers, stop generating it.
+		if p.Store().CancelGeneratingSnap() {
+			log.S().Infof("%v cancel generating snapshot after epoch changed from %s to %s",
+				p.Tag, epochString(oldEpoch), epochString(newEpoch))
+		}
+	}
 	p.Store().SetRegion(region)
 
 	// Always update leaderChecker's region to avoid stale region info after a follower
@@ -584,6 +799,20 @@ func (p *Peer) HasPendingSnapshot() bool {
 func (p *Peer) Send(trans Transport, msgs []eraftpb.Message) error {
 	for _, msg := range msgs {
 		msgType := msg.MsgType
+		if p.flowControl != nil {
+			switch msgType {
+			case eraftpb.MessageType_MsgAppend:
+				if p.holdAppend(msg) {
+					continue
+				}
+			case eraftpb.MessageType_MsgSnapshot:
+				// The log sent before the snapshot is useless.
+				delete(p.flowControl.followers, msg.To)
+			}
+		}
+		if msgType == eraftpb.MessageType_MsgSnapshot && p.relaySnapshot(&msg, trans) {
+			continue
+		}
 		err := p.sendRaftMessage(msg, trans)
 		if err != nil {
 			return err
@@ -596,10 +825,14 @@ func (p *Peer) Send(trans Transport, msgs []eraftpb.Message) error {
 			// network partition from the new leader.
 			// For lease safety during leader transfer, transit `leader_lease`
 			// to suspect.
-			p.leaderLease.Suspect(time.Now())
+			p.leaderLease.Suspect(p.leaderLease.Now())
+			p.recordLeaseState(LeaseReasonTransferLeader)
 		default:
 		}
 	}
+	if p.flowControl != nil {
+		return p.flushFlow(trans)
+	}
 	return nil
 }
 
@@ -612,8 +845,67 @@ func (p *Peer) Step(m *eraftpb.Message) error {
 	} else if m.GetFrom() == p.LeaderID() {
 		// As another role know we're not missing.
 		p.leaderMissingTime = nil
+		if m.Term >= p.Term() {
+			p.electionTimer.heardFromLeader()
+		}
+	}
+	if p.IsLeader() {
+		switch m.MsgType {
+		case eraftpb.MessageType_MsgHeartbeatResponse:
+			// Learners are never counted for the read index quorum.
+			if len(m.Context) > 0 && p.isLearnerPeer(m.From) {
+				m.Context = nil
+			}
+		case eraftpb.MessageType_MsgReadIndex:
+			if m.From != p.PeerID() && p.maybeRejectReadIndex(m) {
+				return nil
+			}
+			// A leader without other voters answers the read index as a local one in raft,
+			// the read index forwarded from a learner must be answered here instead.
+			if m.From != p.PeerID() && p.voterCount() == 1 {
+				p.respondReadIndex(m)
+				return nil
+			}
+		}
+	}
+	if err := p.RaftGroup.Step(*m); err != nil {
+		return err
+	}
+	if p.flowControl != nil && m.MsgType == eraftpb.MessageType_MsgAppendResponse && p.IsLeader() {
+		p.onFlowAck(m)
 	}
-	return p.RaftGroup.Step(*m)
+	return nil
+}
+
+func (p *Peer) isLearnerPeer(peerID uint64) bool {
+	peer := p.getPeerFromCache(peerID)
+	return peer != nil && peer.Role == metapb.PeerRole_Learner
+}
+
+func (p *Peer) voterCount() int {
+	var cnt int
+	for _, peer := range p.Region().Peers {
+		if peer.Role != metapb.PeerRole_Learner {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+func (p *Peer) respondReadIndex(m *eraftpb.Message) {
+	commit := p.RaftGroup.StatusWithoutProgress().Commit
+	if term, err := p.RaftGroup.Raft.RaftLog.Term(commit); err != nil || term != p.Term() {
+		// Like raft, reject the read index when the leader has not committed any log entry at its term.
+		return
+	}
+	p.pendingMessages = append(p.pendingMessages, eraftpb.Message{
+		MsgType: eraftpb.MessageType_MsgReadIndexResp,
+		To:      m.From,
+		From:    p.PeerID(),
+		Term:    p.Term(),
+		Index:   commit,
+		Entries: m.Entries,
+	})
 }
 
 // CheckPeers checks and updates `peer_heartbeats` for the peer.
@@ -675,7 +967,7 @@ func (p *Peer) CollectPendingPeers() []*metapb.Peer {
 				if _, ok := p.PeersStartPendingTime[id]; !ok {
 					now := time.Now()
 					p.PeersStartPendingTime[id] = now
-					log.S().Debugf("%v peer %v start pending at %v", p.Tag, id, now)
+					p.debug("peer start pending", zap.Uint64("peer", id), zap.Time("time", now))
 				}
 			}
 		}
@@ -709,7 +1001,7 @@ func (p *Peer) AnyNewPeerCatchUp(peerID uint64) bool {
 			if progress.Match >= truncatedIdx {
 				delete(p.PeersStartPendingTime, peerID)
 				elapsed := time.Since(startPendingTime)
-				log.S().Debugf("%v peer %v has caught up logs, elapsed: %v", p.Tag, peerID, elapsed)
+				p.debug("peer has caught up logs", zap.Uint64("peer", peerID), zap.Duration("elapsed", elapsed))
 				return true
 			}
 		}
@@ -759,6 +1051,7 @@ func (p *Peer) CheckStaleState(cfg *Config) StaleState {
 func (p *Peer) OnRoleChanged(observer PeerEventObserver, ready *raft.Ready) {
 	ss := ready.SoftState
 	if ss != nil {
+		p.onMaxTSRoleChanged(ss.RaftState)
 		if ss.RaftState == raft.StateLeader {
 			// The local read can only be performed after a new leader has applied
 			// the first empty entry on its term. After that the lease expiring time
@@ -768,13 +1061,20 @@ func (p *Peer) OnRoleChanged(observer PeerEventObserver, ready *raft.Ready) {
 			// It is recommended to update the lease expiring time right after
 			// this peer becomes leader because it's more convenient to do it here and
 			// it has no impact on the correctness.
-			p.MaybeRenewLeaderLease(time.Now())
+			p.observeLeaderTerm()
+			p.MaybeRenewLeaderLease(p.leaderLease.Now())
 			if !p.PendingRemove {
 				p.leaderChecker.term.Store(p.Term())
 			}
 			observer.OnRoleChange(p.getEventContext().RegionID, ss.RaftState)
+			p.finishForceLeader(nil)
 		} else if ss.RaftState == raft.StateFollower {
+			p.finishForceLeader(fmt.Errorf("another peer is elected"))
 			p.leaderLease.Expire()
+			p.recordLeaseState(LeaseReasonElection)
+			p.hotKeys.reset()
+			p.splitHint.reset()
+			p.loadSplit.reset()
 			observer.OnRoleChange(p.getEventContext().RegionID, ss.RaftState)
 		}
 	}
@@ -829,7 +1129,7 @@ func (p *Peer) HandleRaftReadyAppend(trans Transport, applyMsgs *applyMsgs, kvWB
 		// If we continue to handle all the messages, it may cause too many messages because
 		// leader will send all the remaining messages to this follower, which can lead
 		// to full message queue under high load.
-		log.S().Debugf("%v still applying snapshot, skip further handling", p.Tag)
+		p.debug("still applying snapshot, skip further handling")
 		return nil
 	}
 
@@ -842,7 +1142,8 @@ func (p *Peer) HandleRaftReadyAppend(trans Transport, applyMsgs *applyMsgs, kvWB
 	}
 
 	if p.HasPendingSnapshot() && !p.ReadyToHandlePendingSnap() {
-		log.S().Debugf("%v [apply_id: %v, last_applying_idx: %v] is not ready to apply snapshot.", p.Tag, p.Store().AppliedIndex(), p.LastApplyingIdx)
+		p.debug("not ready to apply snapshot", zap.Uint64("applied index", p.Store().AppliedIndex()),
+			zap.Uint64("last applying index", p.LastApplyingIdx))
 		return nil
 	}
 
@@ -854,11 +1155,16 @@ func (p *Peer) HandleRaftReadyAppend(trans Transport, applyMsgs *applyMsgs, kvWB
 		p.peerStorage.genSnapTask = nil
 	}
 
+	if p.persisting {
+		// The last ready is not persisted by the async raft log writer yet.
+		return nil
+	}
+
 	if !p.RaftGroup.HasReadySince(&p.LastApplyingIdx) {
 		return nil
 	}
 
-	log.S().Debugf("%v handle raft ready", p.Tag)
+	p.debug("handle raft ready")
 
 	ready := p.RaftGroup.ReadySince(p.LastApplyingIdx)
 	// TODO: workaround for:
@@ -868,6 +1174,7 @@ func (p *Peer) HandleRaftReadyAppend(trans Transport, applyMsgs *applyMsgs, kvWB
 		ready.Snapshot.Metadata = &eraftpb.SnapshotMetadata{}
 	}
 	p.OnRoleChanged(observer, &ready)
+	p.electionTimer.observe(p.RaftGroup.Raft)
 
 	// The leader can write to disk and replicate to the followers concurrently
 	// For more details, check raft thesis 10.2.1.
@@ -893,6 +1200,7 @@ func (p *Peer) PostRaftReadyPersistent(trans Transport, applyMsgs *applyMsgs, re
 	}
 
 	applySnapResult := p.Store().PostReadyPersistent(invokeCtx)
+	p.updateApplyGap()
 	if applySnapResult != nil && p.Meta.GetRole() == metapb.PeerRole_Learner {
 		// The peer may change from learner to voter after snapshot applied.
 		var pr *metapb.Peer
@@ -941,7 +1249,9 @@ func (p *Peer) MaybeRenewLeaderLease(ts time.Time) {
 	if !p.IsLeader() || p.isSplitting() || p.isMerging() {
 		return
 	}
+	p.checkLeaseRenew(ts)
 	p.leaderLease.Renew(ts)
+	p.recordLeaseState(LeaseReasonRenew)
 	remoteLease := p.leaderLease.MaybeNewRemoteLease(p.Term())
 	if !p.PendingRemove && remoteLease != nil {
 		atomic.StorePointer(&p.leaderChecker.leaderLease, unsafe.Pointer(remoteLease))
@@ -987,18 +1297,26 @@ func (p *Peer) Stop() {
 
 // HeartbeatPd adds a region heartbeat task to the pd scheduler.
 func (p *Peer) HeartbeatPd(pdScheduler chan<- task) {
-	pdScheduler <- task{
-		tp: taskTypePDHeartbeat,
-		data: &pdRegionHeartbeatTask{
-			region:          p.Region(),
-			peer:            p.Meta,
-			downPeers:       p.CollectDownPeers(time.Minute * 5),
-			pendingPeers:    p.CollectPendingPeers(),
-			writtenBytes:    p.PeerStat.WrittenBytes,
-			writtenKeys:     p.PeerStat.WrittenKeys,
-			approximateSize: p.ApproximateSize,
-			approximateKeys: p.ApproximateKeys,
-		},
+	pdScheduler <- task{tp: taskTypePDHeartbeat, data: p.heartbeatTask()}
+}
+
+// DelayHeartbeatPd adds a region heartbeat task which is batched with the other heartbeats received in
+// Config.PdHeartbeatBatchDelay, it is used after a split or a conf change is applied.
+func (p *Peer) DelayHeartbeatPd(pdScheduler chan<- task) {
+	pdScheduler <- task{tp: taskTypePDDelayedHeartbeat, data: p.heartbeatTask()}
+}
+
+func (p *Peer) heartbeatTask() *pdRegionHeartbeatTask {
+	return &pdRegionHeartbeatTask{
+		region:          p.Region(),
+		peer:            p.Meta,
+		term:            p.Term(),
+		downPeers:       p.CollectDownPeers(time.Minute * 5),
+		pendingPeers:    p.CollectPendingPeers(),
+		writtenBytes:    p.PeerStat.WrittenBytes,
+		writtenKeys:     p.PeerStat.WrittenKeys,
+		approximateSize: p.ApproximateSize,
+		approximateKeys: p.ApproximateKeys,
 	}
 }
 
@@ -1016,7 +1334,7 @@ func (p *Peer) sendRaftMessage(msg eraftpb.Message, trans Transport) error {
 	if toPeer == nil {
 		return fmt.Errorf("failed to lookup recipient peer %v in region %v", msg.To, p.regionID)
 	}
-	log.S().Debugf("%v, send raft msg %v from %v to %v", p.Tag, msg.MsgType, fromPeer.Id, toPeer.Id)
+	p.debug("send raft msg", zap.Stringer("type", msg.MsgType), zap.Uint64("from", fromPeer.Id), zap.Uint64("to", toPeer.Id))
 
 	sendMsg.FromPeer = &fromPeer
 	sendMsg.ToPeer = toPeer
@@ -1063,18 +1381,17 @@ func (p *Peer) HandleRaftReadyApply(kv *mvcc.DBBundle, applyMsgs *applyMsgs, rea
 		for _, entry := range committedEntries {
 			// raft meta is very small, can be ignored.
 			p.RaftLogSizeHint += uint64(len(entry.Data))
+			p.observeCommitMerge(&entry)
 			if leaseToBeUpdated {
 				proposeTime := p.findProposeTime(entry.Index, entry.Term)
-				if proposeTime != nil {
-					p.MaybeRenewLeaderLease(*proposeTime)
+				if proposeTime != nil && p.renewLeaseByProposal(*proposeTime, entry.Term) {
 					leaseToBeUpdated = false
 				}
 			}
 
 			// We care about split/merge commands that are committed in the current term.
 			if entry.Term == p.Term() && (splitToBeUpdated || mergeToBeUpdated) {
-				//ctx := NewProposalContextFromBytes(entry.Context)
-				proposalCtx := NewProposalContextFromBytes([]byte{0})
+				proposalCtx := NewProposalContextFromBytes(entry.Context)
 				if splitToBeUpdated && proposalCtx.contains(ProposalContextSplit) {
 					// We dont need to suspect its lease because peers of new region that
 					// in other store do not start election before theirs election timeout
@@ -1092,7 +1409,8 @@ func (p *Peer) HandleRaftReadyApply(kv *mvcc.DBBundle, applyMsgs *applyMsgs, rea
 					// when the target region merges majority of this region, also
 					// it can not know when the target region writes new values.
 					// To prevent unsafe local read, we suspect its leader lease.
-					p.leaderLease.Suspect(time.Now())
+					p.leaderLease.Suspect(p.leaderLease.Now())
+					p.recordLeaseState(LeaseReasonMergeSuspect)
 					mergeToBeUpdated = false
 				}
 			}
@@ -1128,7 +1446,8 @@ func (p *Peer) HandleRaftReadyApply(kv *mvcc.DBBundle, applyMsgs *applyMsgs, rea
 // ApplyReads applies reads.
 func (p *Peer) ApplyReads(kv *mvcc.DBBundle, ready *raft.Ready) {
 	var proposeTime *time.Time
-	if p.readyToHandleRead() {
+	var proposeTerm uint64
+	if p.IsLeader() && p.readyToHandleRead() {
 		for _, state := range ready.ReadStates {
 			read := p.pendingReads.PopFront()
 			if read == nil {
@@ -1142,7 +1461,7 @@ func (p *Peer) ApplyReads(kv *mvcc.DBBundle, ready *raft.Ready) {
 				reqCb.Cb.Done(resp)
 			}
 			read.cmds = nil
-			proposeTime = read.renewLeaseTime
+			proposeTime, proposeTerm = read.renewLeaseTime, read.term
 		}
 	} else {
 		for _, state := range ready.ReadStates {
@@ -1150,17 +1469,26 @@ func (p *Peer) ApplyReads(kv *mvcc.DBBundle, ready *raft.Ready) {
 			if !bytes.Equal(state.RequestCtx, read.binaryID()) {
 				panic(fmt.Sprintf("request ctx: %v not equal to read id: %v", state.RequestCtx, read.binaryID()))
 			}
+			read.readIndex = state.Index
+			read.rejected = state.Index == rejectedReadIndex
 			p.pendingReads.readyCnt++
-			proposeTime = read.renewLeaseTime
+			proposeTime, proposeTerm = read.renewLeaseTime, read.term
 		}
+		p.handleReadyReads(kv)
 	}
 
 	// Note that only after handle read_states can we identify what requests are
 	// actually stale.
 	if ready.SoftState != nil {
 		// all uncommitted reads will be dropped silently in raft.
-		p.pendingReads.ClearUncommitted(p.Term())
+		if dropped := p.pendingReads.ClearUncommitted(p.Term()); dropped > 0 {
+			log.S().Infof("%v dropped %d uncommitted reads at term %d", p.Tag, dropped, p.Term())
+		}
+	} else if dropped := p.pendingReads.ClearStale(p.Term()); dropped > 0 {
+		log.S().Infof("%v dropped %d uncommitted reads of earlier terms at term %d", p.Tag, dropped, p.Term())
 	}
+	p.pendingReads.updateGauges()
+	p.checkReadQueue()
 
 	if proposeTime != nil {
 		// `propose_time` is a placeholder, here cares about `Suspect` only,
@@ -1168,10 +1496,35 @@ func (p *Peer) ApplyReads(kv *mvcc.DBBundle, ready *raft.Ready) {
 		if p.leaderLease.Inspect(proposeTime) == LeaseStateSuspect {
 			return
 		}
-		p.MaybeRenewLeaderLease(*proposeTime)
+		p.renewLeaseByProposal(*proposeTime, proposeTerm)
 	}
 }
 
+// handleReadyReads responds the ready reads whose read index has been applied.
+func (p *Peer) handleReadyReads(kv *mvcc.DBBundle) {
+	// The applied index is the snapshot index before the data of the snapshot is ingested.
+	if p.pendingReads.readyCnt == 0 || !p.readyToHandleRead() || p.IsApplyingSnapshot() {
+		return
+	}
+	appliedIndex := p.Store().AppliedIndex()
+	for p.pendingReads.readyCnt > 0 && p.pendingReads.reads[0].readIndex <= appliedIndex {
+		read := p.pendingReads.PopFront()
+		for _, reqCb := range read.cmds {
+			if read.rejected {
+				resp := ErrResp(fmt.Errorf("read index is rejected by the leader due to merge"))
+				BindRespTerm(resp, p.Term())
+				reqCb.Cb.Done(resp)
+				continue
+			}
+			resp := p.handleRead(kv, reqCb.Req, true)
+			reqCb.Cb.Done(resp)
+		}
+		read.cmds = nil
+		p.pendingReads.readyCnt--
+	}
+	p.pendingReads.updateGauges()
+}
+
 // PostApply returns a boolean value indicating whether the peer has ready.
 func (p *Peer) PostApply(kv *mvcc.DBBundle, applyState applyState, appliedIndexTerm uint64, merged bool, applyMetrics applyMetrics) bool {
 	hasReady := false
@@ -1201,33 +1554,71 @@ func (p *Peer) PostApply(kv *mvcc.DBBundle, applyState applyState, appliedIndexT
 		hasReady = true
 	}
 
-	if p.pendingReads.readyCnt > 0 && p.readyToHandleRead() {
-		for i := 0; i < p.pendingReads.readyCnt; i++ {
-			read := p.pendingReads.PopFront()
-			if read == nil {
-				panic("read is nil, this should not happen")
-			}
-			for _, reqCb := range read.cmds {
-				resp := p.handleRead(kv, reqCb.Req, true)
-				reqCb.Cb.Done(resp)
-			}
-			read.cmds = nil
-		}
-		p.pendingReads.readyCnt = 0
-	}
+	p.handleReadyReads(kv)
 
 	// Only leaders need to update applied_index_term.
 	if progressToBeUpdated && p.IsLeader() && !p.PendingRemove {
 		p.leaderChecker.appliedIndexTerm.Store(appliedIndexTerm)
 	}
+	p.updateApplyGap()
 
 	return hasReady
 }
 
+// ApplyGap returns the number of committed but not applied log entries.
+func (p *Peer) ApplyGap() uint64 {
+	committed, applied := p.Store().raftState.commit, p.Store().AppliedIndex()
+	if committed < applied {
+		return 0
+	}
+	return committed - applied
+}
+
+func (p *Peer) updateApplyGap() {
+	atomic.StoreUint64(&p.applyGap.committed, p.Store().raftState.commit)
+	atomic.StoreUint64(&p.applyGap.applied, p.Store().AppliedIndex())
+}
+
+// ApplyGapMetrics returns the apply gap metrics of the peer, it is safe to be called concurrently.
+func (p *Peer) ApplyGapMetrics() ApplyGapMetrics {
+	m := ApplyGapMetrics{
+		Committed: atomic.LoadUint64(&p.applyGap.committed),
+		Applied:   atomic.LoadUint64(&p.applyGap.applied),
+		Rejected:  atomic.LoadUint64(&p.applyGap.rejected),
+	}
+	if m.Committed > m.Applied {
+		m.Gap = m.Committed - m.Applied
+	}
+	return m
+}
+
+// checkApplyGap rejects the normal proposals when too many committed entries are waiting to be applied,
+// admin commands are not rejected so the region can still split or compact its log.
+func (p *Peer) checkApplyGap(cfg *Config, rlog raftlog.RaftLog) error {
+	if cfg.MaxApplyGap == 0 {
+		return nil
+	}
+	if req := rlog.GetRaftCmdRequest(); req != nil && req.AdminRequest != nil {
+		return nil
+	}
+	gap := p.ApplyGap()
+	if gap <= cfg.MaxApplyGap {
+		return nil
+	}
+	atomic.AddUint64(&p.applyGap.rejected, 1)
+	return &ErrServerIsBusy{
+		Reason:    fmt.Sprintf("region %d apply gap %d exceeds %d", p.regionID, gap, cfg.MaxApplyGap),
+		BackoffMs: uint64(cfg.RaftBaseTickInterval / time.Millisecond),
+	}
+}
+
 // PostSplit resets delete_keys_hint and size_diff_hint.
 func (p *Peer) PostSplit() {
 	p.deleteKeysHint = 0
 	p.SizeDiffHint = 0
+	p.hotKeys.reset()
+	p.splitHint.reset()
+	p.loadSplit.reset()
 }
 
 // Propose a request.
@@ -1248,15 +1639,27 @@ func (p *Peer) Propose(kv *mvcc.DBBundle, cfg *Config, cb *Callback, rlog raftlo
 		return false
 	}
 	req := rlog.GetRaftCmdRequest()
+	p.observeRead(req, policy)
 	var idx uint64
 	switch policy {
 	case RequestPolicyReadLocal:
+		p.hotKeys.sampleRead(req)
+		p.loadSplit.observeRead(cfg, req)
 		p.readLocal(kv, req, cb)
 		return false
 	case RequestPolicyReadIndex:
+		p.hotKeys.sampleRead(req)
+		p.loadSplit.observeRead(cfg, req)
 		return p.readIndex(cfg, req, errResp, cb)
 	case RequestPolicyProposeNormal:
-		idx, err = p.ProposeNormal(cfg, rlog)
+		if err = p.checkApplyGap(cfg, rlog); err == nil {
+			idx, err = p.ProposeNormal(cfg, rlog)
+		}
+		if err == nil {
+			p.hotKeys.sampleWrite(rlog)
+			p.maybeHintSplit(cfg, rlog)
+			p.loadSplit.observeWrite(cfg, rlog)
+		}
 	case RequestPolicyProposeTransferLeader:
 		return p.ProposeTransferLeader(cfg, req, cb)
 	case RequestPolicyProposeConfChange:
@@ -1287,7 +1690,8 @@ func (p *Peer) Propose(kv *mvcc.DBBundle, cfg *Config, cb *Callback, rlog raftlo
 
 // PostPropose tries to renew leader lease on every consistent read/write request.
 func (p *Peer) PostPropose(meta *ProposalMeta, isConfChange bool, cb *Callback) {
-	t := time.Now()
+	p.observeLeaderTerm()
+	t := p.leaderLease.Now()
 	meta.RenewLeaseTime = &t
 	proposal := &proposal{
 		isConfChange: isConfChange,
@@ -1413,7 +1817,7 @@ func (p *Peer) readyToTransferLeader(cfg *Config, peer *metapb.Peer) bool {
 		}
 	}
 	if p.RecentAddedPeer.Contains(peerID) {
-		log.S().Debugf("%v reject tranfer leader to %v due to the peer was added recently", p.Tag, peer)
+		p.debug("reject transfer leader due to the peer was added recently", zap.Uint64("peer", peer.Id))
 		return false
 	}
 
@@ -1447,19 +1851,27 @@ func (p *Peer) preReadIndex() error {
 // 3. There is already a read request proposed in the current lease;
 func (p *Peer) readIndex(cfg *Config, req *raft_cmdpb.RaftCmdRequest, errResp *raft_cmdpb.RaftCmdResponse, cb *Callback) bool {
 	err := p.preReadIndex()
+	ranges := readKeyRanges(req)
+	if err == nil {
+		err = p.checkReadRanges(ranges)
+	}
 	if err != nil {
-		log.S().Debugf("%v prevents unsafe read index, err: %v", p.Tag, err)
+		p.debug("prevents unsafe read index", zap.Error(err))
 		BindRespError(errResp, err)
 		cb.Done(errResp)
 		return false
 	}
 
-	now := time.Now()
+	p.observeLeaderTerm()
+	now := p.leaderLease.Now()
 	renewLeaseTime := &now
 	readsLen := len(p.pendingReads.reads)
-	if readsLen > 0 {
+	// A follower can only batch into a read which is still waiting for the read index from the leader.
+	// The ranges of a read are sent with its read index, so a read with ranges is never batched.
+	if readsLen > 0 && len(ranges) == 0 && (p.IsLeader() || readsLen > p.pendingReads.readyCnt) {
 		read := p.pendingReads.reads[readsLen-1]
-		if read.renewLeaseTime.Add(cfg.RaftStoreMaxLeaderLease).After(*renewLeaseTime) {
+		// A read of an earlier term is dropped by the raft group, its renewLeaseTime is stale.
+		if read.term == p.Term() && read.renewLeaseTime.Add(p.leaderLease.MaxLease()).After(*renewLeaseTime) {
 			read.cmds = append(read.cmds, &ReqCbPair{Req: req, Cb: cb})
 			return false
 		}
@@ -1469,25 +1881,34 @@ func (p *Peer) readIndex(cfg *Config, req *raft_cmdpb.RaftCmdRequest, errResp *r
 	lastReadyReadCount := p.RaftGroup.Raft.ReadyReadCount()
 
 	id := p.pendingReads.NextID()
-	ctx := make([]byte, 8)
-	binary.BigEndian.PutUint64(ctx, id)
-	p.RaftGroup.ReadIndex(ctx)
+	p.RaftGroup.ReadIndex(encodeReadIndexContext(id, ranges))
 
 	pendingReadCount := p.RaftGroup.Raft.PendingReadCount()
 	readyReadCount := p.RaftGroup.Raft.ReadyReadCount()
 
-	if pendingReadCount == lastPendingReadCount && readyReadCount == lastReadyReadCount {
+	// A follower forwards the read index to the leader, it is dropped if there is no leader.
+	if (p.IsLeader() && pendingReadCount == lastPendingReadCount && readyReadCount == lastReadyReadCount) ||
+		(!p.IsLeader() && p.LeaderID() == InvalidID) {
 		// The message gets dropped silently, can't be handled anymore.
-		NotifyStaleReq(p.Term(), cb)
+		reason, transferee := p.dropReason(true)
+		if err := p.onDropped(cfg, true, reason, transferee, nil); err != nil {
+			cb.Done(ErrRespWithTerm(err, p.Term()))
+		} else {
+			NotifyStaleReq(p.Term(), cb)
+		}
 		return false
 	}
 
 	cmds := []*ReqCbPair{{req, cb}}
-	p.pendingReads.reads = append(p.pendingReads.reads, NewReadIndexRequest(id, cmds, renewLeaseTime))
+	read := NewReadIndexRequest(id, cmds, renewLeaseTime)
+	read.ranges = ranges
+	read.term = p.Term()
+	p.pendingReads.reads = append(p.pendingReads.reads, read)
+	p.pendingReads.updateGauges()
 
 	// TimeoutNow has been sent out, so we need to propose explicitly to
 	// update leader lease.
-	if p.leaderLease.Inspect(renewLeaseTime) == LeaseStateSuspect {
+	if p.IsLeader() && p.leaderLease.Inspect(renewLeaseTime) == LeaseStateSuspect {
 		req := new(raft_cmdpb.RaftCmdRequest)
 		if index, err := p.ProposeNormal(cfg, raftlog.NewRequest(req)); err == nil {
 			meta := &ProposalMeta{
@@ -1616,18 +2037,24 @@ func (p *Peer) ProposeNormal(cfg *Config, rlog raftlog.RaftLog) (uint64, error)
 
 	if uint64(len(data)) > cfg.RaftEntryMaxSize {
 		log.S().Errorf("entry is too large, entry size %v", len(data))
+		p.droppedProposals.observe(false, DropReasonEntryTooLarge)
 		return 0, &ErrRaftEntryTooLarge{RegionID: p.regionID, EntrySize: uint64(len(data))}
 	}
 
 	proposeIndex := p.nextProposalIndex()
 	err = p.RaftGroup.Propose(ctx.ToBytes(), data)
+	if err == raft.ErrProposalDropped {
+		reason, transferee := p.dropReason(false)
+		return 0, p.onDropped(cfg, false, reason, transferee, err)
+	}
 	if err != nil {
 		return 0, err
 	}
 	if proposeIndex == p.nextProposalIndex() {
 		// The message is dropped silently, this usually due to leader absence
 		// or transferring leader. Both cases can be considered as NotLeader error.
-		return 0, &ErrNotLeader{RegionID: p.regionID}
+		reason, transferee := p.dropReason(false)
+		return 0, p.onDropped(cfg, false, reason, transferee, &ErrNotLeader{RegionID: p.regionID})
 	}
 
 	return proposeIndex, nil
@@ -1666,7 +2093,8 @@ func (p *Peer) ProposeConfChange(cfg *Config, req *raft_cmdpb.RaftCmdRequest) (u
 
 	if p.RaftGroup.Raft.PendingConfIndex > p.Store().AppliedIndex() {
 		log.S().Infof("%v there is a pending conf change, try later", p.Tag)
-		return 0, fmt.Errorf("%v there is a pending conf change, try later", p.Tag)
+		err := fmt.Errorf("%v there is a pending conf change, try later", p.Tag)
+		return 0, p.onDropped(cfg, false, DropReasonConfChangePending, InvalidID, err)
 	}
 
 	if err := p.checkConfChange(cfg, req); err != nil {
@@ -1688,13 +2116,19 @@ func (p *Peer) ProposeConfChange(cfg *Config, req *raft_cmdpb.RaftCmdRequest) (u
 
 	proposeIndex := p.nextProposalIndex()
 	var proposalCtx = ProposalContextSyncLog
-	if err = p.RaftGroup.ProposeConfChange(proposalCtx.ToBytes(), cc); err != nil {
+	err = p.RaftGroup.ProposeConfChange(proposalCtx.ToBytes(), cc)
+	if err == raft.ErrProposalDropped {
+		reason, transferee := p.dropReason(false)
+		return 0, p.onDropped(cfg, false, reason, transferee, err)
+	}
+	if err != nil {
 		return 0, err
 	}
 	if p.nextProposalIndex() == proposeIndex {
 		// The message is dropped silently, this usually due to leader absence
 		// or transferring leader. Both cases can be considered as NotLeader error.
-		return 0, &ErrNotLeader{RegionID: p.regionID}
+		reason, transferee := p.dropReason(false)
+		return 0, p.onDropped(cfg, false, reason, transferee, &ErrNotLeader{RegionID: p.regionID})
 	}
 
 	return proposeIndex, nil
@@ -1703,6 +2137,11 @@ func (p *Peer) ProposeConfChange(cfg *Config, req *raft_cmdpb.RaftCmdRequest) (u
 func (p *Peer) handleRead(kv *mvcc.DBBundle, req *raft_cmdpb.RaftCmdRequest, checkEpoch bool) *raft_cmdpb.RaftCmdResponse {
 	readExecutor := NewReadExecutor(checkEpoch)
 	resp := readExecutor.Execute(req, p.Region())
+	for _, r := range resp.Responses {
+		if r.ReadIndex != nil {
+			r.ReadIndex.ReadIndex = p.Store().AppliedIndex()
+		}
+	}
 	BindRespTerm(resp, p.Term())
 	return resp
 }
@@ -1734,6 +2173,20 @@ func (p *Peer) hasAppliedToCurrentTerm() bool {
 	return p.Store().appliedIndexTerm == p.Term()
 }
 
+// controlLease forces the leader lease into the state of the op, the lease is renewed as usual afterwards.
+func (p *Peer) controlLease(op LeaseControlOp) error {
+	switch op {
+	case LeaseControlExpire:
+		p.leaderLease.Expire()
+	case LeaseControlSuspect:
+		p.leaderLease.Suspect(p.leaderLease.Now())
+	default:
+		return fmt.Errorf("unknown lease control op %d", op)
+	}
+	p.recordLeaseState(LeaseReasonControl)
+	return nil
+}
+
 func (p *Peer) inspectLease() LeaseState {
 	if !p.RaftGroup.Raft.InLease() {
 		return LeaseStateSuspect
@@ -1741,8 +2194,9 @@ func (p *Peer) inspectLease() LeaseState {
 	// nil means now.
 	state := p.leaderLease.Inspect(nil)
 	if state == LeaseStateExpired {
-		log.S().Debugf("%v leader lease is expired %v", p.Tag, p.leaderLease)
+		p.debug("leader lease is expired")
 		p.leaderLease.Expire()
+		p.recordLeaseState(LeaseReasonTimeout)
 	}
 	return state
 }
@@ -1752,12 +2206,34 @@ func (p *Peer) inspect(rlog raftlog.RaftLog) (RequestPolicy, error) {
 	if req == nil {
 		return RequestPolicyProposeNormal, nil
 	}
+	if !p.IsLeader() && isReplicaRead(req) {
+		// Followers and learners never hold the lease, they always ask the leader for the read index.
+		return RequestPolicyReadIndex, nil
+	}
 	return Inspect(p, req)
 }
 
+// isReplicaRead returns true if the request is a read only request which can be served by followers and learners.
+func isReplicaRead(req *raft_cmdpb.RaftCmdRequest) bool {
+	if !req.GetHeader().GetReplicaRead() || req.GetAdminRequest() != nil || len(req.GetRequests()) == 0 {
+		return false
+	}
+	for _, r := range req.Requests {
+		if r.CmdType != raft_cmdpb.CmdType_Get && r.CmdType != raft_cmdpb.CmdType_Snap &&
+			r.CmdType != raft_cmdpb.CmdType_ReadIndex {
+			return false
+		}
+	}
+	return true
+}
+
 // Inspect returns a request policy with the given RaftCmdRequest.
 func Inspect(i RequestInspector, req *raft_cmdpb.RaftCmdRequest) (RequestPolicy, error) {
 	if req.AdminRequest != nil {
+		if req.AdminRequest.CmdType == raft_cmdpb.AdminCmdType_ChangePeerV2 {
+			// The raft library has no joint consensus, peers can only be changed one at a time.
+			return RequestPolicyProposeNormal, fmt.Errorf("ChangePeerV2 is not supported")
+		}
 		if GetChangePeerCmd(req) != nil {
 			return RequestPolicyProposeConfChange, nil
 		}
@@ -1767,11 +2243,13 @@ func Inspect(i RequestInspector, req *raft_cmdpb.RaftCmdRequest) (RequestPolicy,
 		return RequestPolicyProposeNormal, nil
 	}
 
-	hasRead, hasWrite := false, false
+	hasRead, hasWrite, hasReadIndex := false, false, false
 	for _, r := range req.Requests {
 		switch r.CmdType {
 		case raft_cmdpb.CmdType_Get, raft_cmdpb.CmdType_Snap:
 			hasRead = true
+		case raft_cmdpb.CmdType_ReadIndex:
+			hasRead, hasReadIndex = true, true
 		case raft_cmdpb.CmdType_Delete, raft_cmdpb.CmdType_Put, raft_cmdpb.CmdType_DeleteRange,
 			raft_cmdpb.CmdType_IngestSST:
 			hasWrite = true
@@ -1788,7 +2266,7 @@ func Inspect(i RequestInspector, req *raft_cmdpb.RaftCmdRequest) (RequestPolicy,
 		return RequestPolicyProposeNormal, nil
 	}
 
-	if req.Header != nil && req.Header.ReadQuorum {
+	if (req.Header != nil && req.Header.ReadQuorum) || hasReadIndex {
 		return RequestPolicyReadIndex, nil
 	}
 
@@ -1837,6 +2315,10 @@ func (r *ReadExecutor) Execute(msg *raft_cmdpb.RaftCmdRequest, region *metapb.Re
 		case raft_cmdpb.CmdType_Snap:
 			resp = new(raft_cmdpb.Response)
 			resp.CmdType = req.CmdType
+		case raft_cmdpb.CmdType_ReadIndex:
+			resp = new(raft_cmdpb.Response)
+			resp.CmdType = req.CmdType
+			resp.ReadIndex = new(raft_cmdpb.ReadIndexResponse)
 		default:
 			panic("unreachable")
 		}
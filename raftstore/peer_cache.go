@@ -0,0 +1,84 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"sync/atomic"
+
+	"github.com/pingcap/kvproto/pkg/metapb"
+)
+
+// PeerCacheStats represents the statistics of the peer cache of a region.
+type PeerCacheStats struct {
+	// Size is the number of the cached peers.
+	Size int64
+	// Hits and Misses count the lookups, a miss falls back to the region metadata.
+	Hits   uint64
+	Misses uint64
+	// Pruned is the total number of the peers removed from the cache because they are not in the region.
+	Pruned uint64
+	// Refreshes is the number of times the cache is refreshed from the region metadata.
+	Refreshes uint64
+}
+
+// peerCacheStats is updated by the peer goroutine and can be loaded concurrently.
+type peerCacheStats struct {
+	size      int64
+	hits      uint64
+	misses    uint64
+	pruned    uint64
+	refreshes uint64
+}
+
+func (s *peerCacheStats) load() PeerCacheStats {
+	return PeerCacheStats{
+		Size:      atomic.LoadInt64(&s.size),
+		Hits:      atomic.LoadUint64(&s.hits),
+		Misses:    atomic.LoadUint64(&s.misses),
+		Pruned:    atomic.LoadUint64(&s.pruned),
+		Refreshes: atomic.LoadUint64(&s.refreshes),
+	}
+}
+
+// refreshPeerCache makes the peer cache match the peers of the region, it must be called after the peers of
+// the region are changed by a conf change or a snapshot. Otherwise the raft messages may still be sent to the
+// removed peers.
+func (p *Peer) refreshPeerCache(region *metapb.Region) {
+	peers := make(map[uint64]*metapb.Peer, len(region.GetPeers()))
+	for _, peer := range region.GetPeers() {
+		peers[peer.GetId()] = peer
+	}
+	var pruned int
+	for id := range p.peerCache {
+		if _, ok := peers[id]; !ok {
+			delete(p.peerCache, id)
+			pruned++
+		}
+	}
+	for id, peer := range peers {
+		p.peerCache[id] = peer
+	}
+	atomic.AddUint64(&p.peerCacheStats.pruned, uint64(pruned))
+	atomic.AddUint64(&p.peerCacheStats.refreshes, 1)
+	atomic.StoreInt64(&p.peerCacheStats.size, int64(len(p.peerCache)))
+}
+
+// PeerCacheStats returns the statistics of the peer cache of the region.
+func (r *Router) PeerCacheStats(regionID uint64) (PeerCacheStats, error) {
+	p := r.router.get(regionID)
+	if p == nil {
+		return PeerCacheStats{}, errPeerNotFound
+	}
+	return p.peer.peer.peerCacheStats.load(), nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import "sync/atomic"
+
+// pausedPeerMaxHeldCmds is the max number of the raft commands held for a paused peer, the commands beyond it
+// are rejected with ServerIsBusy.
+const pausedPeerMaxHeldCmds = 1024
+
+// PausePeer freezes the peer of the region without stopping the store, the peer handles no ticks and no
+// messages until it is resumed. The messages sent after PausePeer are held and handled in order after
+// ResumePeer, the ticks are dropped. The messages already in the queue are handled before the pause. If the
+// peer is gone when it is resumed, the held raft commands fail with RegionNotFound.
+func (r *Router) PausePeer(regionID uint64) error {
+	return r.router.send(regionID, Msg{Type: MsgTypePausePeer})
+}
+
+// ResumePeer resumes the peer paused by PausePeer.
+func (r *Router) ResumePeer(regionID uint64) error {
+	return r.router.send(regionID, Msg{Type: MsgTypeResumePeer})
+}
+
+// filterPaused handles the pause control messages and holds the messages of the paused peers, it returns the
+// messages to handle.
+func (rw *raftWorker) filterPaused(msgs []Msg) []Msg {
+	if len(rw.paused) == 0 && !hasPauseControl(msgs) {
+		return msgs
+	}
+	out := make([]Msg, 0, len(msgs))
+	for _, msg := range msgs {
+		switch msg.Type {
+		case MsgTypePausePeer:
+			if _, ok := rw.paused[msg.RegionID]; !ok {
+				rw.paused[msg.RegionID] = nil
+			}
+			continue
+		case MsgTypeResumePeer:
+			held := rw.paused[msg.RegionID]
+			delete(rw.paused, msg.RegionID)
+			if rw.pr.get(msg.RegionID) != nil {
+				out = append(out, held...)
+				continue
+			}
+			for _, heldMsg := range held {
+				if heldMsg.Type == MsgTypeRaftCmd {
+					cmd := heldMsg.Data.(*MsgRaftCmd)
+					releasePending(cmd)
+					notifyReqRegionRemoved(msg.RegionID, cmd.Callback)
+				}
+			}
+			continue
+		}
+		held, ok := rw.paused[msg.RegionID]
+		if !ok {
+			out = append(out, msg)
+		} else if msg.Type == MsgTypeRaftCmd && countRaftCmds(held) >= pausedPeerMaxHeldCmds {
+			cmd := msg.Data.(*MsgRaftCmd)
+			releasePending(cmd)
+			cmd.Callback.Done(ErrResp(&ErrServerIsBusy{Reason: "peer is paused"}))
+		} else if msg.Type != MsgTypeTick {
+			rw.paused[msg.RegionID] = append(held, msg)
+		}
+	}
+	return out
+}
+
+func countRaftCmds(msgs []Msg) int {
+	n := 0
+	for _, msg := range msgs {
+		if msg.Type == MsgTypeRaftCmd {
+			n++
+		}
+	}
+	return n
+}
+
+// releasePending untracks a raft command failed before it reaches the peer.
+func releasePending(cmd *MsgRaftCmd) {
+	if cmd.pending != nil {
+		atomic.AddInt64(cmd.pending, -1)
+	}
+}
+
+func hasPauseControl(msgs []Msg) bool {
+	for _, msg := range msgs {
+		if msg.Type == MsgTypePausePeer || msg.Type == MsgTypeResumePeer {
+			return true
+		}
+	}
+	return false
+}
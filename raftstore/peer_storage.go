@@ -31,6 +31,7 @@ import (
 	"github.com/pingcap/log"
 	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/dbreader"
 	"github.com/zhangjinpeng1987/raft"
+	"go.uber.org/zap"
 )
 
 // JobStatus represents a job status.
@@ -98,6 +99,10 @@ func CompactRaftLog(tag string, state *applyState, compactIndex, compactTerm uin
 // EntryCache represents an entry cache.
 type EntryCache struct {
 	cache []eraftpb.Entry
+	// size is the total size of the cached entries.
+	size uint64
+	// capacity limits the size of the cached entries, the oldest entries are evicted first. 0 means no limit.
+	capacity uint64
 }
 
 func (ec *EntryCache) front() eraftpb.Entry {
@@ -145,21 +150,35 @@ func (ec *EntryCache) append(tag string, entries []eraftpb.Entry) {
 		firstIndex := entries[0].Index
 		cacheLastIndex := ec.back().Index
 		if cacheLastIndex >= firstIndex {
-			if ec.front().Index >= firstIndex {
-				ec.cache = ec.cache[:0]
-			} else {
-				left := ec.length() - int(cacheLastIndex-firstIndex+1)
-				ec.cache = ec.cache[:left]
+			left := 0
+			if ec.front().Index < firstIndex {
+				left = ec.length() - int(cacheLastIndex-firstIndex+1)
 			}
+			ec.size -= entriesSize(ec.cache[left:])
+			ec.cache = ec.cache[:left]
 		} else if cacheLastIndex+1 < firstIndex {
 			panic(fmt.Sprintf("%s unexpected hole %d < %d", tag, cacheLastIndex, firstIndex))
 		}
 	}
 	ec.cache = append(ec.cache, entries...)
+	ec.size += entriesSize(entries)
+	evicted := 0
 	if ec.length() > MaxCacheCapacity {
-		extraSize := ec.length() - MaxCacheCapacity
-		ec.cache = ec.cache[extraSize:]
+		evicted = ec.length() - MaxCacheCapacity
+		ec.size -= entriesSize(ec.cache[:evicted])
 	}
+	for ec.capacity > 0 && ec.size > ec.capacity && evicted < ec.length() {
+		ec.size -= uint64(ec.cache[evicted].Size())
+		evicted++
+	}
+	ec.cache = ec.cache[evicted:]
+}
+
+func entriesSize(entries []eraftpb.Entry) (size uint64) {
+	for i := range entries {
+		size += uint64(entries[i].Size())
+	}
+	return
 }
 
 func (ec *EntryCache) compactTo(idx uint64) {
@@ -171,6 +190,7 @@ func (ec *EntryCache) compactTo(idx uint64) {
 		return
 	}
 	pos := mathutil.Min(int(idx-firstIdx), ec.length())
+	ec.size -= entriesSize(ec.cache[:pos])
 	ec.cache = ec.cache[pos:]
 }
 
@@ -179,6 +199,8 @@ type ApplySnapResult struct {
 	// PrevRegion is the region before snapshot applied
 	PrevRegion *metapb.Region
 	Region     *metapb.Region
+	// MaxTS is the max commit ts of the snapshot data.
+	MaxTS uint64
 }
 
 // InvokeContext represents a invoker context.
@@ -188,6 +210,7 @@ type InvokeContext struct {
 	ApplyState applyState
 	lastTerm   uint64
 	SnapRegion *metapb.Region
+	snapMaxTS  uint64
 }
 
 // NewInvokeContext returns a new InvokeContext.
@@ -269,9 +292,15 @@ type PeerStorage struct {
 	genSnapTask  *GenSnapTask
 	regionSched  chan<- task
 	snapTriedCnt int
+	// snapGenGuard limits the snapshots generated for the region, snapStorm is the last refusal of it.
+	snapGenGuard      *snapGenGuard
+	snapStorm         *ErrSnapshotStorm
+	snapStormReported bool
 
 	cache *EntryCache
 	stats *CacheQueryStats
+	// logBudget is the log budget of the peer.
+	logBudget *logBudget
 
 	Tag string
 }
@@ -627,14 +656,29 @@ func (ps *PeerStorage) Snapshot() (eraftpb.Snapshot, error) {
 		return snap, err
 	}
 
+	if err := ps.snapGenGuard.check(ps.region.GetId(), time.Now()); err != nil {
+		if ps.snapStorm == nil {
+			log.Warn("refuse to generate snapshot", zap.String("tag", ps.Tag), zap.Error(err))
+		}
+		ps.snapStorm = err
+		// Raft panics on the other errors, it asks for the snapshot again later.
+		return snap, raft.ErrSnapshotTemporarilyUnavailable
+	}
+	if ps.snapStorm != nil {
+		log.Info("snapshot storm ends", zap.String("tag", ps.Tag))
+		ps.snapStorm, ps.snapStormReported = nil, false
+	}
+
 	log.S().Infof("requesting snapshot, regionID: %d, peerID: %d", ps.region.GetId(), ps.peerID)
 	ps.snapTriedCnt++
 	ch := make(chan *eraftpb.Snapshot, 1)
+	status := JobStatusPending
 	ps.snapState = SnapState{
 		StateType: SnapStateGenerating,
+		Status:    &status,
 		Receiver:  ch,
 	}
-	ps.genSnapTask = newGenSnapTask(ps.region.GetId(), ch)
+	ps.genSnapTask = newGenSnapTask(ps.region.GetId(), ps.region.GetRegionEpoch(), ch, &status)
 
 	return snap, raft.ErrSnapshotTemporarilyUnavailable
 }
@@ -643,7 +687,7 @@ func (ps *PeerStorage) Snapshot() (eraftpb.Snapshot, error) {
 // Return the new last index for later update. After we commit in engine, we can set last_index
 // to the return one.
 func (ps *PeerStorage) Append(invokeCtx *InvokeContext, entries []eraftpb.Entry, raftWB *WriteBatch) error {
-	log.S().Debugf("%s append %d entries", ps.Tag, len(entries))
+	ps.debug("append entries", zap.Int("count", len(entries)))
 	prevLastIndex := invokeCtx.RaftState.lastIndex
 	if len(entries) == 0 {
 		return nil
@@ -838,6 +882,7 @@ func ClearMeta(engines *Engines, kvWB, raftWB *WriteBatch, regionID uint64, last
 		raftWB.Delete(y.KeyWithTs(RaftLogKey(regionID, i), RaftTS))
 	}
 	raftWB.Delete(y.KeyWithTs(RaftStateKey(regionID), RaftTS))
+	raftWB.Delete(y.KeyWithTs(SchedulerStateKey(regionID), RaftTS))
 	log.S().Infof(
 		"[region %d] clear peer 1 meta key 1 apply key 1 raft key and %d raft logs, takes %v",
 		regionID,
@@ -899,6 +944,7 @@ func (ps *PeerStorage) ApplySnapshot(ctx *InvokeContext, snap *eraftpb.Snapshot,
 	log.S().Debugf("%v apply snapshot for region %v with state %v ok", ps.Tag, snapData.Region, ctx.ApplyState)
 
 	ctx.SnapRegion = snapData.Region
+	ctx.snapMaxTS = getSnapMaxTS(snapData)
 	return nil
 }
 
@@ -989,6 +1035,7 @@ func (ps *PeerStorage) PostReadyPersistent(ctx *InvokeContext) *ApplySnapResult
 	return &ApplySnapResult{
 		PrevRegion: prevRegion,
 		Region:     ps.region,
+		MaxTS:      ctx.snapMaxTS,
 	}
 }
 
@@ -1025,6 +1072,23 @@ func (ps *PeerStorage) CancelApplyingSnap() bool {
 	return true
 }
 
+// CancelGeneratingSnap cancels the snapshot being generated, the region worker skips the task or
+// deletes the generated snapshot files. It returns false if no snapshot is being generated.
+func (ps *PeerStorage) CancelGeneratingSnap() bool {
+	if ps.snapState.StateType != SnapStateGenerating {
+		return false
+	}
+	if status := ps.snapState.Status; status != nil {
+		if !atomic.CompareAndSwapUint32(status, JobStatusPending, JobStatusCancelling) {
+			atomic.CompareAndSwapUint32(status, JobStatusRunning, JobStatusCancelling)
+		}
+	}
+	ps.snapState = SnapState{StateType: SnapStateRelax}
+	ps.genSnapTask = nil
+	ps.snapTriedCnt = 0
+	return true
+}
+
 // CheckApplyingSnap checks if the storage is applying a snapshot.
 func (ps *PeerStorage) CheckApplyingSnap() bool {
 	switch ps.snapState.StateType {
@@ -1062,8 +1126,13 @@ func createAndInitSnapshot(snap *regionSnapshot, key SnapKey, mgr *SnapManager)
 	snapshotStatics := SnapStatistics{}
 	err = s.Build(snap, region, snapshotData, &snapshotStatics, mgr)
 	if err != nil {
+		if err == errAbort {
+			// Clean up the partly written files of the cancelled task.
+			s.Delete()
+		}
 		return nil, err
 	}
+	mgr.recordSnapEvent(SnapEvent{Type: SnapEventGenerated, Key: key, Entry: SnapEntryGenerating, Total: s.TotalSize()})
 	snapshot.Data, err = snapshotData.Marshal()
 	return snapshot, err
 }
@@ -1090,7 +1159,7 @@ func getAppliedIdxTermForSnapshot(raft *badger.DB, kv *badger.Txn, regionID uint
 	return idx, term, nil
 }
 
-func doSnapshot(engines *Engines, mgr *SnapManager, regionID, redoIdx uint64) (*eraftpb.Snapshot, error) {
+func doSnapshot(engines *Engines, mgr *SnapManager, regionID, redoIdx uint64, epoch *metapb.RegionEpoch, status *JobStatus) (*eraftpb.Snapshot, error) {
 	log.S().Debugf("begin to generate a snapshot. [regionID: %d]", regionID)
 
 	snap, err := engines.newRegionSnapshot(regionID, redoIdx)
@@ -1101,6 +1170,11 @@ func doSnapshot(engines *Engines, mgr *SnapManager, regionID, redoIdx uint64) (*
 	if snap.regionState.GetState() != rspb.PeerState_Normal {
 		return nil, storageError(fmt.Sprintf("snap job %d seems stale, skip", regionID))
 	}
+	// The peer rejects the snapshot of a stale epoch, and the region may be split or destroyed already.
+	if epoch != nil && IsEpochStale(epoch, snap.regionState.GetRegion().GetRegionEpoch()) {
+		return nil, errSnapEpochChanged
+	}
+	snap.abort = status
 
 	key := SnapKey{RegionID: regionID, Index: snap.index, Term: snap.term}
 	mgr.Register(key, SnapEntryGenerating)
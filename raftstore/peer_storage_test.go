@@ -17,9 +17,13 @@ import (
 	"bytes"
 	"math"
 	"testing"
+	"time"
 
+	"github.com/ngaut/unistore/raftstore/raftlog"
 	"github.com/pingcap/badger"
+	"github.com/pingcap/badger/y"
 	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/zhangjinpeng1987/raft"
@@ -402,3 +406,274 @@ func TestPeerStorageCacheUpdate(t *testing.T) {
 	// invalid compaction should be ignored.
 	peerStore.CompactTo(capacity)
 }
+
+func TestEntryCacheEviction(t *testing.T) {
+	newEntries := func(low, high, term uint64) []eraftpb.Entry {
+		var entries []eraftpb.Entry
+		for i := low; i < high; i++ {
+			entries = append(entries, newTestEntry(i, term))
+		}
+		return entries
+	}
+	entry := newTestEntry(10, 5)
+	entrySize := uint64(entry.Size())
+	ec := &EntryCache{capacity: 3 * entrySize}
+	ec.append("", newEntries(10, 12, 5))
+	assert.Equal(t, 2*entrySize, ec.size)
+
+	// The oldest entries are evicted.
+	ec.append("", newEntries(12, 15, 5))
+	assert.Equal(t, newEntries(12, 15, 5), ec.cache)
+	assert.Equal(t, 3*entrySize, ec.size)
+
+	// The rewritten entries are not counted.
+	ec.append("", newEntries(13, 14, 6))
+	assert.Equal(t, append(newEntries(12, 13, 5), newEntries(13, 14, 6)...), ec.cache)
+	assert.Equal(t, 2*entrySize, ec.size)
+
+	ec.compactTo(13)
+	assert.Equal(t, entrySize, ec.size)
+	ec.compactTo(20)
+	assert.Equal(t, uint64(0), ec.size)
+
+	// An entry larger than the capacity is not cached.
+	ec.capacity = entrySize - 1
+	ec.append("", newEntries(14, 15, 6))
+	assert.Equal(t, 0, ec.length())
+	assert.Equal(t, uint64(0), ec.size)
+}
+
+func TestScanRaftLog(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+
+	builder := raftlog.NewBuilder(raftlog.CustomHeader{RegionID: 1, Epoch: raftlog.NewEpoch(2, 3)})
+	builder.SetType(raftlog.TypeCommit)
+	builder.AppendCommit([]byte("k"), nil, 10)
+	write := &raft_cmdpb.RaftCmdRequest{Requests: []*raft_cmdpb.Request{
+		{CmdType: raft_cmdpb.CmdType_Put, Put: &raft_cmdpb.PutRequest{Key: []byte("a")}},
+		{CmdType: raft_cmdpb.CmdType_Put, Put: &raft_cmdpb.PutRequest{Key: []byte("b")}},
+		{CmdType: raft_cmdpb.CmdType_Delete, Delete: &raft_cmdpb.DeleteRequest{Key: []byte("c")}},
+	}}
+	writeData, err := write.Marshal()
+	require.Nil(t, err)
+	admin := &raft_cmdpb.RaftCmdRequest{AdminRequest: &raft_cmdpb.AdminRequest{
+		CmdType:    raft_cmdpb.AdminCmdType_CompactLog,
+		CompactLog: &raft_cmdpb.CompactLogRequest{CompactIndex: 3, CompactTerm: 5},
+	}}
+	adminData, err := admin.Marshal()
+	require.Nil(t, err)
+	cc := &eraftpb.ConfChange{ChangeType: eraftpb.ConfChangeType_AddNode, NodeId: 4}
+	ccData, err := cc.Marshal()
+	require.Nil(t, err)
+	ents := []eraftpb.Entry{
+		{Index: 5, Term: 5},
+		{Index: 6, Term: 5, Data: builder.Build().Marshal()},
+		{Index: 7, Term: 5, Data: writeData},
+		{Index: 8, Term: 5, Data: adminData},
+		{Index: 9, Term: 5, EntryType: eraftpb.EntryType_EntryConfChange, Data: ccData},
+	}
+	wb := new(WriteBatch)
+	for i := range ents {
+		require.Nil(t, wb.SetMsg(y.KeyWithTs(RaftLogKey(1, ents[i].Index), RaftTS), &ents[i]))
+	}
+	require.Nil(t, wb.SetMsg(y.KeyWithTs(RaftLogKey(2, 1), RaftTS), &eraftpb.Entry{Index: 1, Term: 1}))
+	require.Nil(t, wb.WriteToRaft(engines.raft))
+
+	var summaries []string
+	require.Nil(t, ScanRaftLog(engines.raft, 1, 0, 0, func(entry *eraftpb.Entry) bool {
+		summaries = append(summaries, EntrySummary(entry))
+		return true
+	}))
+	assert.Equal(t, []string{
+		"[index 5 term 5] empty entry",
+		"[index 6 term 5] Commit epoch {Ver:2, ConfVer:3}",
+		"[index 7 term 5] write Put x2, Delete x1",
+		"[index 8 term 5] admin CompactLog index 3 term 5",
+		"[index 9 term 5] conf change AddNode node 4",
+	}, summaries)
+
+	var indexes []uint64
+	require.Nil(t, ScanRaftLog(engines.raft, 1, 6, 9, func(entry *eraftpb.Entry) bool {
+		indexes = append(indexes, entry.Index)
+		return entry.Index < 7
+	}))
+	assert.Equal(t, []uint64{6, 7}, indexes)
+
+	rlog, err := DecodeEntry(&ents[2])
+	require.Nil(t, err)
+	assert.Len(t, rlog.GetRaftCmdRequest().Requests, 3)
+	_, err = DecodeEntry(&ents[4])
+	assert.NotNil(t, err)
+}
+
+func TestPeerStorageCancelGeneratingSnap(t *testing.T) {
+	ps := newTestPeerStorage(t)
+	defer cleanUpTestData(ps)
+	assert.False(t, ps.CancelGeneratingSnap())
+
+	_, err := ps.Snapshot()
+	assert.Equal(t, raft.ErrSnapshotTemporarilyUnavailable, err)
+	require.NotNil(t, ps.genSnapTask)
+	status := ps.genSnapTask.status
+	assert.Equal(t, JobStatusPending, *status)
+
+	assert.True(t, ps.CancelGeneratingSnap())
+	assert.Equal(t, JobStatusCancelling, *status)
+	assert.Nil(t, ps.genSnapTask)
+	assert.Equal(t, SnapStateRelax, ps.snapState.StateType)
+	assert.False(t, ps.CancelGeneratingSnap())
+}
+
+func TestSnapGenLimit(t *testing.T) {
+	cfg := NewDefaultConfig()
+	cfg.SnapGenLimit = 2
+	g := newSnapGenGuard(cfg)
+	now := time.Now()
+	assert.Nil(t, g.check(1, now))
+	assert.Nil(t, g.check(1, now.Add(time.Minute)))
+	err := g.check(1, now.Add(2*time.Minute))
+	require.NotNil(t, err)
+	assert.Equal(t, 58*time.Minute, err.RetryAfter)
+	// The first snapshot expires.
+	assert.Nil(t, g.check(1, now.Add(time.Hour)))
+	assert.NotNil(t, g.check(1, now.Add(time.Hour+30*time.Second)))
+	cfg.SnapGenLimit = 0
+	assert.Nil(t, newSnapGenGuard(cfg).check(1, now))
+
+	ps := newTestPeerStorage(t)
+	defer cleanUpTestData(ps)
+	cfg.SnapGenLimit = 1
+	ps.snapGenGuard = newSnapGenGuard(cfg)
+	_, err1 := ps.Snapshot()
+	assert.Equal(t, raft.ErrSnapshotTemporarilyUnavailable, err1)
+	require.NotNil(t, ps.genSnapTask)
+	assert.Nil(t, ps.SnapshotStorm())
+	assert.True(t, ps.CancelGeneratingSnap())
+
+	// The refused snapshot is not generated, raft retries later.
+	_, err1 = ps.Snapshot()
+	assert.Equal(t, raft.ErrSnapshotTemporarilyUnavailable, err1)
+	assert.Nil(t, ps.genSnapTask)
+	storm, ok := ps.SnapshotStorm().(*ErrSnapshotStorm)
+	require.True(t, ok)
+	assert.Equal(t, uint64(1), storm.RegionID)
+	assert.Equal(t, 1, storm.Limit)
+}
+
+func TestEngineStats(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	engines.kv.LockStore.Put([]byte("k"), []byte("lock"))
+
+	stats := engines.Stats(0, 0)
+	assert.Equal(t, 1, stats.LockCFKeys)
+	assert.Equal(t, -1.0, stats.KV.BlockCacheHitRatio)
+	// The value log files are kept open.
+	assert.True(t, stats.KV.VLogFiles > 0)
+	assert.True(t, stats.KV.OpenFiles >= stats.KV.VLogFiles)
+	assert.True(t, stats.Raft.OpenFiles >= stats.Raft.VLogFiles)
+
+	s := DBStats{Levels: []LevelStats{{Level: 0, Files: 3, Size: 30}, {Level: 1, Files: 2, Size: 150}, {Level: 2, Size: 500}}}
+	s.estimatePendingCompaction(levelOptions{numL0Tables: 2, l1Size: 100, multiplier: 10})
+	assert.Equal(t, int64(100), s.Levels[1].TargetSize)
+	assert.Equal(t, int64(1000), s.Levels[2].TargetSize)
+	assert.Equal(t, int64(30+50), s.PendingCompactionBytes)
+	s.estimatePendingCompaction(levelOptions{numL0Tables: 3, l1Size: 200, multiplier: 10})
+	assert.Equal(t, int64(0), s.PendingCompactionBytes)
+}
+
+func TestRaftLogReader(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	wb := new(WriteBatch)
+	for i := uint64(1); i <= 10; i++ {
+		require.Nil(t, wb.SetMsg(y.KeyWithTs(RaftLogKey(1, i), RaftTS), &eraftpb.Entry{Index: i, Term: 5}))
+	}
+	require.Nil(t, wb.WriteToRaft(engines.raft))
+
+	readers := newRaftLogReaders()
+	id, err := readers.acquire("cdc", 4)
+	require.Nil(t, err)
+	reader := &RaftLogReader{readers: readers, id: id, raftDB: engines.raft, regionID: 1}
+	assert.Equal(t, uint64(3), readers.clampCompactIndex(8))
+	assert.Equal(t, uint64(2), readers.clampCompactIndex(2))
+
+	ch := make(chan task, 4)
+	h := &peerMsgHandler{
+		peerFsm: &peerFsm{peer: &Peer{regionID: 1, logReaders: readers}},
+		ctx:     &RaftContext{GlobalContext: &GlobalContext{engine: engines, raftLogGCTaskSender: ch}},
+	}
+	gc := func(start, end uint64) {
+		tk := <-ch
+		gcTask := tk.data.(*raftLogGCTask)
+		require.Equal(t, start, gcTask.startIdx)
+		require.Equal(t, end, gcTask.endIdx)
+		_, err := new(raftLogGCTaskHandler).gcRaftLog(engines.raft, 1, gcTask.startIdx, gcTask.endIdx)
+		require.Nil(t, err)
+	}
+	scan := func(low uint64) []uint64 {
+		var indexes []uint64
+		require.Nil(t, reader.Scan(low, 0, func(entry *eraftpb.Entry) bool {
+			indexes = append(indexes, entry.Index)
+			return true
+		}))
+		return indexes
+	}
+
+	// The entries pinned by the reader are kept, the truncation is deferred.
+	h.scheduleRaftLogGC(9)
+	gc(0, 4)
+	assert.Equal(t, []uint64{4, 5, 6, 7, 8, 9, 10}, scan(4))
+	assert.NotNil(t, reader.Scan(3, 0, func(*eraftpb.Entry) bool { return true }))
+	_, err = readers.acquire("dump", 2)
+	assert.NotNil(t, err)
+	assert.Equal(t, uint64(9), readers.deferredGC())
+
+	// The deferred truncation continues as the reader moves on.
+	reader.Advance(7)
+	h.scheduleRaftLogGC(readers.deferredGC())
+	gc(4, 7)
+	assert.Equal(t, []uint64{7, 8, 9, 10}, scan(7))
+	reader.Release()
+	h.scheduleRaftLogGC(readers.deferredGC())
+	gc(7, 9)
+	assert.Equal(t, uint64(0), readers.deferredGC())
+	assert.NotNil(t, reader.Scan(9, 0, func(*eraftpb.Entry) bool { return true }))
+	h.scheduleRaftLogGC(readers.deferredGC())
+	assert.Len(t, ch, 0)
+
+	var indexes []uint64
+	require.Nil(t, ScanRaftLog(engines.raft, 1, 0, 0, func(entry *eraftpb.Entry) bool {
+		indexes = append(indexes, entry.Index)
+		return true
+	}))
+	assert.Equal(t, []uint64{9, 10}, indexes)
+	m := readers.snapshot()
+	assert.Empty(t, m.Readers)
+	assert.Equal(t, uint64(1), m.DeferredCompactions)
+	assert.Equal(t, uint64(1), m.DeferredGCs)
+}
+
+func TestReadyCompactLogSizeHint(t *testing.T) {
+	ps := newTestPeerStorage(t)
+	defer cleanUpTestData(ps)
+	ch := make(chan task, 2)
+	peer := &Peer{regionID: 1, peerStorage: ps, logReaders: newRaftLogReaders(), LastApplyingIdx: 105, RaftLogSizeHint: 1000}
+	h := &peerMsgHandler{
+		peerFsm: &peerFsm{peer: peer},
+		ctx:     &RaftContext{GlobalContext: &GlobalContext{engine: ps.Engines, raftLogGCTaskSender: ch}},
+	}
+
+	// Half of the entries remain after the compaction.
+	h.onReadyCompactLog(5, 54)
+	assert.Equal(t, uint64(500), peer.RaftLogSizeHint)
+	assert.Equal(t, uint64(55), (<-ch).data.(*raftLogGCTask).endIdx)
+	assert.Equal(t, uint64(55), peer.LastCompactedIdx)
+
+	h.onReadyCompactLog(55, 104)
+	assert.Equal(t, uint64(0), peer.RaftLogSizeHint)
+	gcTask := (<-ch).data.(*raftLogGCTask)
+	assert.Equal(t, uint64(55), gcTask.startIdx)
+	assert.Equal(t, uint64(105), gcTask.endIdx)
+}
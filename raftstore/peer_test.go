@@ -14,11 +14,29 @@
 package raftstore
 
 import (
+	"bytes"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unsafe"
 
 	"github.com/ngaut/unistore/raftstore/raftlog"
+	"github.com/pingcap/badger/y"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
 	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
+	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/util/codec"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhangjinpeng1987/raft"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/time/rate"
 )
 
 func TestGetSyncLogFromRequest(t *testing.T) {
@@ -76,6 +94,9 @@ func TestEntryCtx(t *testing.T) {
 		{ProposalContextPrepareMerge},
 		{ProposalContextSplit, ProposalContextSyncLog},
 		{ProposalContextPrepareMerge, ProposalContextSyncLog},
+		{ProposalContextFlashback},
+		{ProposalContextBucketRefresh, ProposalContextSplit},
+		{ProposalContext(1 << 40), ProposalContextSyncLog},
 	}
 	for _, flags := range tbl {
 		var ctx ProposalContext
@@ -89,7 +110,22 @@ func TestEntryCtx(t *testing.T) {
 		for _, f := range flags {
 			assert.True(t, de.contains(f))
 		}
+		assert.Equal(t, ctx, *de)
 	}
+
+	// The single byte contexts of the earlier versions.
+	assert.Equal(t, []byte{byte(ProposalContextSplit | ProposalContextSyncLog)}, (ProposalContextSplit | ProposalContextSyncLog).ToBytes())
+	assert.Equal(t, []byte{0}, ProposalContext(0).ToBytes())
+	// The unknown flags and the trailing bytes of the later versions.
+	de := NewProposalContextFromBytes([]byte{0x82, 0x01, 0xff})
+	assert.True(t, de.contains(ProposalContextSplit))
+	assert.False(t, de.contains(ProposalContextSyncLog))
+	assert.Equal(t, ProposalContextSplit|1<<7, *de)
+
+	de = NewProposalContextFromBytes(nil)
+	assert.Nil(t, de)
+	assert.False(t, de.contains(ProposalContextSplit))
+	assert.Panics(t, func() { NewProposalContextFromBytes([]byte{0x80}) })
 }
 
 type DummyInspector struct {
@@ -205,6 +241,12 @@ func TestRequestInspector(t *testing.T) {
 	put.CmdType = raft_cmdpb.CmdType_Put
 	req = new(raft_cmdpb.RaftCmdRequest)
 	req.Requests = []*raft_cmdpb.Request{snap, put}
+	req = new(raft_cmdpb.RaftCmdRequest)
+	req.AdminRequest = &raft_cmdpb.AdminRequest{
+		CmdType:      raft_cmdpb.AdminCmdType_ChangePeerV2,
+		ChangePeerV2: new(raft_cmdpb.ChangePeerV2Request),
+	}
+	errTbl = append(errTbl, req)
 
 	for _, req := range errTbl {
 		inspector := DummyInspector{
@@ -215,3 +257,1929 @@ func TestRequestInspector(t *testing.T) {
 		assert.NotNil(t, err)
 	}
 }
+
+func TestReadIndexQueueMetrics(t *testing.T) {
+	q := new(ReadIndexQueue)
+	for i := 0; i < 3; i++ {
+		cmds := []*ReqCbPair{{Cb: NewCallback()}, {Cb: NewCallback()}}
+		q.reads = append(q.reads, NewReadIndexRequest(q.NextID(), cmds, nil))
+	}
+	q.readyCnt = 1
+	q.updateGauges()
+	assert.Equal(t, ReadIndexMetrics{Pending: 2, Ready: 1}, q.Metrics())
+
+	assert.Equal(t, 4, q.ClearUncommitted(5))
+	assert.Equal(t, ReadIndexMetrics{Ready: 1, Dropped: 4, LastDropTerm: 5, LastDropped: 4}, q.Metrics())
+
+	// Clearing without uncommitted reads doesn't reset the last drop.
+	assert.Equal(t, 0, q.ClearUncommitted(6))
+	assert.Equal(t, uint64(5), q.Metrics().LastDropTerm)
+}
+
+func TestCheckApplyGap(t *testing.T) {
+	cfg := NewDefaultConfig()
+	p := &Peer{regionID: 1, peerStorage: &PeerStorage{}}
+	p.Store().raftState.commit = 20
+	p.Store().applyState.appliedIndex = 10
+	p.updateApplyGap()
+	assert.Equal(t, ApplyGapMetrics{Committed: 20, Applied: 10, Gap: 10}, p.ApplyGapMetrics())
+
+	normal := raftlog.NewRequest(&raft_cmdpb.RaftCmdRequest{})
+	assert.Nil(t, p.checkApplyGap(cfg, normal))
+
+	cfg.MaxApplyGap = 5
+	err := p.checkApplyGap(cfg, normal)
+	busy, ok := err.(*ErrServerIsBusy)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(cfg.RaftBaseTickInterval/time.Millisecond), busy.BackoffMs)
+	assert.Equal(t, uint64(1), p.ApplyGapMetrics().Rejected)
+
+	admin := raftlog.NewRequest(&raft_cmdpb.RaftCmdRequest{
+		AdminRequest: &raft_cmdpb.AdminRequest{CmdType: raft_cmdpb.AdminCmdType_CompactLog},
+	})
+	assert.Nil(t, p.checkApplyGap(cfg, admin))
+
+	p.Store().applyState.appliedIndex = 15
+	assert.Nil(t, p.checkApplyGap(cfg, normal))
+}
+
+func TestControlLease(t *testing.T) {
+	p := &Peer{leaderLease: NewLease(10 * time.Second)}
+	p.leaderLease.Renew(time.Now())
+	remote := p.leaderLease.MaybeNewRemoteLease(1)
+	assert.Equal(t, LeaseStateValid, p.leaderLease.Inspect(nil))
+	assert.Equal(t, LeaseStateValid, remote.Inspect(nil))
+
+	assert.Nil(t, p.controlLease(LeaseControlSuspect))
+	assert.Equal(t, LeaseStateSuspect, p.leaderLease.Inspect(nil))
+	assert.Equal(t, LeaseStateExpired, remote.Inspect(nil))
+
+	p.leaderLease.Renew(time.Now().Add(time.Second))
+	assert.Equal(t, LeaseStateValid, p.leaderLease.Inspect(nil))
+	assert.Nil(t, p.controlLease(LeaseControlExpire))
+	assert.Equal(t, LeaseStateExpired, p.leaderLease.Inspect(nil))
+
+	assert.NotNil(t, p.controlLease(LeaseControlOp(0)))
+}
+
+func TestSkewEpoch(t *testing.T) {
+	ps := newTestPeerStorage(t)
+	defer cleanUpTestData(ps)
+	p := &Peer{peerStorage: ps, leaderLease: NewLease(10 * time.Second)}
+	p.leaderLease.Renew(time.Now())
+	remote := p.leaderLease.MaybeNewRemoteLease(1)
+	origin := cloneEpoch(p.Region().RegionEpoch)
+
+	assert.NotNil(t, p.skewEpoch(EpochSkew{}))
+	require.Nil(t, p.skewEpoch(EpochSkew{ConfVer: 2}))
+	assert.Equal(t, origin.ConfVer+2, p.Region().RegionEpoch.ConfVer)
+	assert.Equal(t, origin.Version, p.Region().RegionEpoch.Version)
+	assert.Equal(t, LeaseStateValid, remote.Inspect(nil))
+	assert.Equal(t, p.Region(), (*metapb.Region)(atomic.LoadPointer(&p.leaderChecker.region)))
+
+	// A request with the real epoch doesn't match the skewed one.
+	req := &raft_cmdpb.RaftCmdRequest{
+		Header:   &raft_cmdpb.RaftRequestHeader{RegionEpoch: origin},
+		Requests: []*raft_cmdpb.Request{{CmdType: raft_cmdpb.CmdType_Put}},
+	}
+	assert.Nil(t, CheckRegionEpoch(req, p.Region(), true))
+	req.AdminRequest = &raft_cmdpb.AdminRequest{CmdType: raft_cmdpb.AdminCmdType_ChangePeer}
+	req.Requests = nil
+	_, ok := CheckRegionEpoch(req, p.Region(), true).(*ErrEpochNotMatch)
+	assert.True(t, ok)
+
+	// A version skew expires the remote lease, like a split.
+	require.Nil(t, p.skewEpoch(EpochSkew{Version: 1}))
+	assert.Equal(t, origin.Version+1, p.Region().RegionEpoch.Version)
+	assert.Equal(t, LeaseStateExpired, remote.Inspect(nil))
+}
+
+func TestLearnerReadIndex(t *testing.T) {
+	ps := newTestPeerStorage(t)
+	defer cleanUpTestData(ps)
+	ps.region.Peers = append(ps.region.Peers, &metapb.Peer{Id: 2, StoreId: 2, Role: metapb.PeerRole_Learner})
+	rn, err := raft.NewRawNode(&raft.Config{
+		ID:              1,
+		ElectionTick:    10,
+		HeartbeatTick:   2,
+		Storage:         ps,
+		Applied:         ps.AppliedIndex(),
+		MaxInflightMsgs: 256,
+	}, nil)
+	require.Nil(t, err)
+	require.Nil(t, rn.Campaign())
+	p := &Peer{
+		Meta:           &metapb.Peer{Id: 1, StoreId: 1},
+		RaftGroup:      rn,
+		peerStorage:    ps,
+		peerCache:      map[uint64]*metapb.Peer{},
+		PeerHeartbeats: map[uint64]time.Time{},
+	}
+	require.True(t, p.IsLeader())
+	assert.Equal(t, 1, p.voterCount())
+
+	// The heartbeat ack from a learner is not counted for the read index quorum.
+	ack := &eraftpb.Message{MsgType: eraftpb.MessageType_MsgHeartbeatResponse, From: 2, To: 1, Term: p.Term(), Context: []byte("ctx")}
+	require.Nil(t, p.Step(ack))
+	assert.Nil(t, ack.Context)
+
+	// The read index forwarded from the learner is answered with the committed index.
+	readIndex := &eraftpb.Message{MsgType: eraftpb.MessageType_MsgReadIndex, From: 2, To: 1,
+		Entries: []*eraftpb.Entry{{Data: []byte("ctx")}}}
+	require.Nil(t, p.Step(readIndex))
+	require.Len(t, p.pendingMessages, 1)
+	resp := p.pendingMessages[0]
+	assert.Equal(t, eraftpb.MessageType_MsgReadIndexResp, resp.MsgType)
+	assert.Equal(t, uint64(2), resp.To)
+	assert.Equal(t, rn.StatusWithoutProgress().Commit, resp.Index)
+	assert.Equal(t, []byte("ctx"), resp.Entries[0].Data)
+	assert.Equal(t, 0, rn.Raft.ReadyReadCount())
+}
+
+func TestIsReplicaRead(t *testing.T) {
+	get := &raft_cmdpb.Request{CmdType: raft_cmdpb.CmdType_Get}
+	put := &raft_cmdpb.Request{CmdType: raft_cmdpb.CmdType_Put}
+	header := &raft_cmdpb.RaftRequestHeader{ReplicaRead: true}
+	assert.False(t, isReplicaRead(nil))
+	assert.False(t, isReplicaRead(&raft_cmdpb.RaftCmdRequest{Requests: []*raft_cmdpb.Request{get}}))
+	assert.True(t, isReplicaRead(&raft_cmdpb.RaftCmdRequest{Header: header, Requests: []*raft_cmdpb.Request{get}}))
+	assert.False(t, isReplicaRead(&raft_cmdpb.RaftCmdRequest{Header: header, Requests: []*raft_cmdpb.Request{get, put}}))
+	assert.False(t, isReplicaRead(&raft_cmdpb.RaftCmdRequest{Header: header}))
+}
+
+func TestHotKeySampler(t *testing.T) {
+	s := newSpaceSaving(2)
+	for _, k := range []string{"a", "a", "a", "b", "b", "c"} {
+		s.add([]byte(k))
+	}
+	// "c" replaces "b" with the minimum count and inherits it as the error.
+	top := s.top()
+	require.Len(t, top, 2)
+	assert.Equal(t, HotKey{Key: []byte("a"), Count: 3}, top[0])
+	assert.Equal(t, HotKey{Key: []byte("c"), Count: 3, Error: 2}, top[1])
+
+	assert.Nil(t, newHotKeySampler(0))
+	sampler := newHotKeySampler(4)
+	sampler.sampleRead(&raft_cmdpb.RaftCmdRequest{Requests: []*raft_cmdpb.Request{
+		{CmdType: raft_cmdpb.CmdType_Get, Get: &raft_cmdpb.GetRequest{Key: []byte("r")}},
+		{CmdType: raft_cmdpb.CmdType_Snap},
+	}})
+	sampler.sampleWrite(raftlog.NewRequest(&raft_cmdpb.RaftCmdRequest{Requests: []*raft_cmdpb.Request{
+		{CmdType: raft_cmdpb.CmdType_Put, Put: &raft_cmdpb.PutRequest{Key: []byte("w")}},
+		{CmdType: raft_cmdpb.CmdType_Delete, Delete: &raft_cmdpb.DeleteRequest{Key: []byte("w")}},
+	}}))
+	builder := raftlog.NewBuilder(raftlog.CustomHeader{RegionID: 1})
+	builder.SetType(raftlog.TypeCommit)
+	builder.AppendCommit([]byte("w"), nil, 10)
+	builder.AppendCommit([]byte("x"), nil, 10)
+	sampler.sampleWrite(builder.Build())
+
+	hot := sampler.hotKeys(1)
+	assert.Equal(t, []HotKey{{Key: []byte("r"), Count: 1}}, hot.Read)
+	require.Len(t, hot.Write, 2)
+	assert.Equal(t, HotKey{Key: []byte("w"), Count: 3}, hot.Write[0])
+	assert.Equal(t, HotKey{Key: []byte("x"), Count: 1}, hot.Write[1])
+
+	sampler.reset()
+	hot = sampler.hotKeys(1)
+	assert.Empty(t, hot.Read)
+	assert.Empty(t, hot.Write)
+}
+
+func TestApplyProfiler(t *testing.T) {
+	assert.Nil(t, newApplyProfiler(0))
+	var disabled *applyProfiler
+	assert.False(t, disabled.begin(1))
+	assert.Equal(t, ApplyStats{}, disabled.stats())
+
+	p := newApplyProfiler(4)
+	var sampled int
+	for i := 0; i < 8; i++ {
+		if p.begin(2) {
+			sampled++
+			p.end(time.Now().Add(-time.Millisecond))
+		}
+	}
+	assert.Equal(t, 2, sampled)
+	stats := p.stats()
+	assert.Equal(t, uint64(8), stats.Applies)
+	assert.Equal(t, uint64(2), stats.Sampled)
+	assert.Equal(t, uint64(16), stats.Entries)
+	assert.True(t, stats.SampledTime >= 2*time.Millisecond)
+	assert.Equal(t, stats.SampledTime*4, stats.EstimatedTime)
+}
+
+func TestLeaseStats(t *testing.T) {
+	ps := newTestPeerStorage(t)
+	defer cleanUpTestData(ps)
+	rn, err := raft.NewRawNode(&raft.Config{
+		ID:              1,
+		ElectionTick:    10,
+		HeartbeatTick:   2,
+		Storage:         ps,
+		Applied:         ps.AppliedIndex(),
+		MaxInflightMsgs: 256,
+	}, nil)
+	require.Nil(t, err)
+	require.Nil(t, rn.Campaign())
+	p := &Peer{
+		Meta:        &metapb.Peer{Id: 1, StoreId: 1},
+		RaftGroup:   rn,
+		peerStorage: ps,
+		leaderLease: NewLease(10 * time.Second),
+		leaseStats:  newLeaseStats(),
+	}
+	require.True(t, p.IsLeader())
+
+	p.MaybeRenewLeaderLease(time.Now())
+	p.MaybeRenewLeaderLease(time.Now())
+	require.Nil(t, p.controlLease(LeaseControlSuspect))
+	p.MaybeRenewLeaderLease(time.Now().Add(11 * time.Second))
+	require.Nil(t, p.controlLease(LeaseControlExpire))
+
+	metrics, events := p.leaseStats.snapshot()
+	assert.Equal(t, LeaseMetrics{State: LeaseStateExpired, Valid: 2, Suspect: 1, Expired: 1}, metrics)
+	require.Len(t, events, 4)
+	expected := []struct {
+		from, to LeaseState
+		reason   LeaseReason
+	}{
+		{LeaseStateExpired, LeaseStateValid, LeaseReasonRenew},
+		{LeaseStateValid, LeaseStateSuspect, LeaseReasonControl},
+		{LeaseStateSuspect, LeaseStateValid, LeaseReasonRenew},
+		{LeaseStateValid, LeaseStateExpired, LeaseReasonControl},
+	}
+	for i, e := range expected {
+		assert.Equal(t, e.from, events[i].From)
+		assert.Equal(t, e.to, events[i].To)
+		assert.Equal(t, e.reason, events[i].Reason)
+		assert.Equal(t, p.Term(), events[i].Term)
+	}
+	assert.Equal(t, "control", events[1].Reason.String())
+	assert.Equal(t, "suspect", events[1].To.String())
+}
+
+func TestSplitHint(t *testing.T) {
+	cfg := NewDefaultConfig()
+	newPut := func(key string) raftlog.RaftLog {
+		return raftlog.NewRequest(&raft_cmdpb.RaftCmdRequest{Requests: []*raft_cmdpb.Request{{
+			CmdType: raft_cmdpb.CmdType_Put,
+			Put:     &raft_cmdpb.PutRequest{Key: []byte(key), Value: []byte(key)},
+		}}})
+	}
+	p := &Peer{peerStorage: &PeerStorage{region: new(metapb.Region)}}
+	p.maybeHintSplit(cfg, newPut("b"))
+	assert.Equal(t, []byte("b"), p.splitHint.tailKey)
+	assert.False(t, p.splitHint.pending)
+
+	// The region is oversized, but the write is not at the tail.
+	size := cfg.SplitCheck.RegionMaxSize - 10
+	p.ApproximateSize = &size
+	p.SizeDiffHint = 10
+	p.maybeHintSplit(cfg, newPut("a"))
+	assert.Equal(t, []byte("b"), p.splitHint.tailKey)
+	assert.False(t, p.splitHint.pending)
+
+	p.maybeHintSplit(cfg, newPut("c"))
+	assert.Equal(t, []byte("c"), p.splitHint.tailKey)
+	assert.True(t, p.splitHint.pending)
+
+	// No more hint until the hinted split check is finished.
+	p.splitHint.pending = false
+	p.splitHint.checking = true
+	p.maybeHintSplit(cfg, newPut("d"))
+	assert.False(t, p.splitHint.pending)
+
+	p.PostSplit()
+	assert.Nil(t, p.splitHint.tailKey)
+	assert.False(t, p.splitHint.checking)
+	p.SizeDiffHint = 10
+	cfg.EnableSplitHint = false
+	p.maybeHintSplit(cfg, newPut("e"))
+	assert.False(t, p.splitHint.pending)
+}
+
+func TestLoadSplitter(t *testing.T) {
+	cfg := NewDefaultConfig()
+	cfg.LoadSplitQPSThreshold = 10
+	cfg.LoadSplitWindow = time.Second
+	observeKeys := func(l *loadSplitter, now time.Time, keys ...string) {
+		for _, key := range keys {
+			l.observe(cfg, now, func(fn func(key []byte)) { fn([]byte(key)) })
+		}
+	}
+	start := time.Now()
+	l := &loadSplitter{}
+	observeKeys(l, start, "a", "b", "c", "d", "e", "f", "g", "h")
+	// The QPS of the window is below the threshold.
+	observeKeys(l, start.Add(time.Second), "a")
+	assert.Nil(t, l.splitKey)
+
+	for i := 0; i < 3; i++ {
+		observeKeys(l, start.Add(time.Second), "a", "b", "c", "d", "e", "f", "g", "h")
+	}
+	observeKeys(l, start.Add(2*time.Second), "a")
+	assert.Equal(t, []byte("e"), l.splitKey)
+
+	// A single hot key is not split.
+	l.reset()
+	assert.Nil(t, l.splitKey)
+	for i := 0; i < 20; i++ {
+		observeKeys(l, start, "a")
+	}
+	observeKeys(l, start.Add(time.Second), "a")
+	assert.Nil(t, l.splitKey)
+
+	cfg.LoadSplitQPSThreshold = 0
+	l.reset()
+	l.observeRead(cfg, &raft_cmdpb.RaftCmdRequest{Requests: []*raft_cmdpb.Request{
+		{CmdType: raft_cmdpb.CmdType_Get, Get: &raft_cmdpb.GetRequest{Key: []byte("a")}},
+	}})
+	assert.Zero(t, l.requests)
+}
+
+func TestApproximateOversized(t *testing.T) {
+	cfg := NewDefaultConfig()
+	ps := newTestPeerStorage(t)
+	defer cleanUpTestData(ps)
+	p := &Peer{peerStorage: ps}
+	d := &peerMsgHandler{peerFsm: &peerFsm{peer: p}, ctx: &RaftContext{GlobalContext: &GlobalContext{cfg: cfg}}}
+	assert.False(t, d.approximateOversized())
+
+	size := cfg.SplitCheck.RegionMaxSize - 10
+	p.ApproximateSize = &size
+	assert.False(t, d.approximateOversized())
+	p.SizeDiffHint = 10
+	assert.True(t, d.approximateOversized())
+
+	p.ApproximateSize, p.SizeDiffHint = nil, 0
+	keys := cfg.SplitCheck.RegionMaxKeys
+	p.ApproximateKeys = &keys
+	assert.True(t, d.approximateOversized())
+
+	// A split rule covering the region overrides the thresholds, a rule overlapping part of it only lowers them.
+	require.Nil(t, cfg.SplitCheck.setRules([]SplitRule{{KeyPrefix: []byte("t"), RegionMaxKeys: keys + 1}}))
+	assert.True(t, d.approximateOversized())
+	require.Nil(t, cfg.SplitCheck.setRules([]SplitRule{{RegionMaxKeys: keys + 1}}))
+	assert.False(t, d.approximateOversized())
+}
+
+func TestReadIndexContext(t *testing.T) {
+	req := &raft_cmdpb.RaftCmdRequest{Requests: []*raft_cmdpb.Request{
+		{CmdType: raft_cmdpb.CmdType_Get, Get: &raft_cmdpb.GetRequest{Key: []byte("b")}},
+		{CmdType: raft_cmdpb.CmdType_ReadIndex, ReadIndex: &raft_cmdpb.ReadIndexRequest{
+			KeyRanges: []*kvrpcpb.KeyRange{{StartKey: []byte("x")}}}},
+	}}
+	ranges := readKeyRanges(req)
+	require.Len(t, ranges, 2)
+	assert.Equal(t, []byte("b\x00"), ranges[0].EndKey)
+	assert.Equal(t, []byte("b"), req.Requests[0].Get.Key)
+
+	id, decoded, err := decodeReadIndexContext(encodeReadIndexContext(7, ranges))
+	require.Nil(t, err)
+	assert.Equal(t, uint64(7), id)
+	require.Len(t, decoded, 2)
+	assert.Equal(t, []byte("b"), decoded[0].StartKey)
+	assert.Equal(t, []byte("x"), decoded[1].StartKey)
+	assert.Empty(t, decoded[1].EndKey)
+	read := NewReadIndexRequest(8, nil, nil)
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 8}, read.binaryID())
+	_, _, err = decodeReadIndexContext([]byte{0, 0, 0, 0, 0, 0, 0, 8, 5, 'a'})
+	assert.NotNil(t, err)
+
+	ps := newTestPeerStorage(t)
+	defer cleanUpTestData(ps)
+	rn, err := raft.NewRawNode(&raft.Config{
+		ID:              1,
+		ElectionTick:    10,
+		HeartbeatTick:   2,
+		Storage:         ps,
+		Applied:         ps.AppliedIndex(),
+		MaxInflightMsgs: 256,
+	}, nil)
+	require.Nil(t, err)
+	require.Nil(t, rn.Campaign())
+	p := &Peer{
+		Meta:           &metapb.Peer{Id: 1, StoreId: 1},
+		RaftGroup:      rn,
+		peerStorage:    ps,
+		peerCache:      map[uint64]*metapb.Peer{},
+		PeerHeartbeats: map[uint64]time.Time{},
+	}
+	require.True(t, p.IsLeader())
+	source := &metapb.Region{
+		Id:       2,
+		StartKey: codec.EncodeBytes(nil, []byte("c")),
+		EndKey:   codec.EncodeBytes(nil, []byte("e")),
+		Peers:    []*metapb.Peer{{Id: 3, StoreId: 1}},
+	}
+	p.pendingMergeSources = []pendingMergeSource{{index: ps.AppliedIndex() + 1, region: source}}
+	newReadIndex := func(key string) *eraftpb.Message {
+		ranges := []*kvrpcpb.KeyRange{{StartKey: []byte(key), EndKey: []byte(key + "\x00")}}
+		return &eraftpb.Message{MsgType: eraftpb.MessageType_MsgReadIndex, From: 2, To: 1,
+			Entries: []*eraftpb.Entry{{Data: encodeReadIndexContext(1, ranges)}}}
+	}
+
+	// The read index of the pending merge source range is rejected.
+	require.Nil(t, p.Step(newReadIndex("d")))
+	require.Len(t, p.pendingMessages, 1)
+	assert.Equal(t, eraftpb.MessageType_MsgReadIndexResp, p.pendingMessages[0].MsgType)
+	assert.Equal(t, uint64(rejectedReadIndex), p.pendingMessages[0].Index)
+	assert.NotNil(t, p.checkReadRanges([]*kvrpcpb.KeyRange{{StartKey: []byte("a")}}))
+	assert.Nil(t, p.checkReadRanges([]*kvrpcpb.KeyRange{{StartKey: []byte("a"), EndKey: []byte("c")}}))
+
+	// The read index out of the range is answered as usual.
+	p.pendingMessages = nil
+	require.Nil(t, p.Step(newReadIndex("f")))
+	require.Len(t, p.pendingMessages, 1)
+	assert.Equal(t, rn.StatusWithoutProgress().Commit, p.pendingMessages[0].Index)
+
+	// The pending merge source is cleared once the commit merge is applied.
+	p.pendingMergeSources[0].index = ps.AppliedIndex()
+	assert.Nil(t, p.checkReadRanges([]*kvrpcpb.KeyRange{{StartKey: []byte("d")}}))
+	assert.Empty(t, p.pendingMergeSources)
+}
+
+func TestElectionTimer(t *testing.T) {
+	cfg := NewDefaultConfig()
+	require.Nil(t, cfg.Validate())
+	timer := newElectionTimer(cfg)
+	assert.False(t, timer.custom)
+	assert.Equal(t, cfg.RaftElectionTimeoutTicks, timer.raftElectionTick(cfg))
+	assert.Equal(t, int64(0), timer.metrics().Timeout)
+
+	cfg.RaftMinElectionTimeoutTicks = 12
+	cfg.RaftMaxElectionTimeoutTicks = 15
+	timer = newElectionTimer(cfg)
+	require.True(t, timer.custom)
+	// Raft never times out before the timeout of the store.
+	assert.Equal(t, 15, timer.raftElectionTick(cfg))
+
+	ps := newTestPeerStorage(t)
+	defer cleanUpTestData(ps)
+	rn, err := raft.NewRawNode(&raft.Config{
+		ID:              1,
+		ElectionTick:    timer.raftElectionTick(cfg),
+		HeartbeatTick:   cfg.RaftHeartbeatTicks,
+		Storage:         ps,
+		Applied:         ps.AppliedIndex(),
+		MaxInflightMsgs: 256,
+	}, nil)
+	require.Nil(t, err)
+	timer.observe(rn.Raft)
+	timeout := int(timer.metrics().Timeout)
+	assert.True(t, timeout >= 12 && timeout < 15, timeout)
+
+	// Hearing from the leader restarts the timeout.
+	for i := 0; i < timeout-1; i++ {
+		require.False(t, timer.tick(rn.Raft, 1))
+	}
+	timer.heardFromLeader()
+	ticks := 0
+	for campaign := false; !campaign && ticks <= 15; ticks++ {
+		rn.Tick()
+		campaign = timer.tick(rn.Raft, 1)
+	}
+	assert.Equal(t, timeout, ticks)
+	require.Equal(t, raft.StateFollower, rn.Raft.State)
+	// A peer not in the voters never campaigns.
+	for i := 0; i < 15; i++ {
+		require.False(t, timer.tick(rn.Raft, 2))
+	}
+
+	// The timeout is picked again after the term is changed.
+	require.Nil(t, rn.Campaign())
+	require.True(t, rn.Raft.State == raft.StateLeader)
+	timer.observe(rn.Raft)
+	metrics := timer.metrics()
+	assert.Equal(t, uint64(1), metrics.Campaigns)
+	assert.Equal(t, uint64(1), metrics.Elected)
+	assert.False(t, timer.tick(rn.Raft, 1))
+
+	timer.priority = 1
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, 12, timer.next())
+	}
+	timer.priority = -2
+	for i := 0; i < 10; i++ {
+		timeout = timer.next()
+		assert.True(t, timeout >= 18 && timeout < 21, timeout)
+	}
+	assert.Equal(t, 21, timer.raftElectionTick(cfg))
+}
+
+func TestElectionGrace(t *testing.T) {
+	cfg := NewDefaultConfig()
+	cfg.RaftElectionGraceTicks = 5
+	require.Nil(t, cfg.Validate())
+	cfg.RaftElectionGraceTicks = -1
+	assert.NotNil(t, cfg.Validate())
+	cfg.RaftElectionGraceTicks = 5
+
+	ps := newTestPeerStorage(t)
+	defer cleanUpTestData(ps)
+	rn, err := raft.NewRawNode(&raft.Config{
+		ID:              1,
+		ElectionTick:    cfg.RaftElectionTimeoutTicks,
+		HeartbeatTick:   cfg.RaftHeartbeatTicks,
+		Storage:         ps,
+		Applied:         ps.AppliedIndex(),
+		MaxInflightMsgs: 256,
+	}, nil)
+	require.Nil(t, err)
+	timer := newElectionTimer(cfg)
+	tick := func() {
+		if !timer.deferTick(rn.Raft) {
+			rn.Tick()
+		}
+	}
+
+	// The follower doesn't tick in the grace.
+	timer.startGrace()
+	for i := 0; i < cfg.RaftElectionGraceTicks; i++ {
+		tick()
+	}
+	assert.Equal(t, uint64(cfg.RaftElectionGraceTicks), timer.metrics().DeferredTicks)
+	assert.Equal(t, raft.StateFollower, rn.Raft.State)
+
+	// The election times out after the grace.
+	for i := 0; i < 2*cfg.RaftElectionTimeoutTicks && rn.Raft.State == raft.StateFollower; i++ {
+		tick()
+	}
+	assert.NotEqual(t, raft.StateFollower, rn.Raft.State)
+	assert.Equal(t, uint64(cfg.RaftElectionGraceTicks), timer.metrics().DeferredTicks)
+
+	// The leader ends the grace.
+	require.Nil(t, rn.Campaign())
+	require.True(t, rn.Raft.State == raft.StateLeader)
+	timer.startGrace()
+	assert.False(t, timer.deferTick(rn.Raft))
+	assert.Equal(t, 0, timer.grace)
+}
+
+func TestSnapshotApplyWaiters(t *testing.T) {
+	ps := newTestPeerStorage(t)
+	defer cleanUpTestData(ps)
+	rn, err := raft.NewRawNode(&raft.Config{
+		ID:              1,
+		ElectionTick:    10,
+		HeartbeatTick:   2,
+		Storage:         ps,
+		Applied:         ps.AppliedIndex(),
+		MaxInflightMsgs: 256,
+	}, nil)
+	require.Nil(t, err)
+	rn.Raft.Lead = 2
+	p := &Peer{
+		Meta:           &metapb.Peer{Id: 1, StoreId: 1},
+		regionID:       ps.region.Id,
+		RaftGroup:      rn,
+		peerStorage:    ps,
+		proposals:      new(ProposalQueue),
+		pendingReads:   new(ReadIndexQueue),
+		leaderLease:    NewLease(10 * time.Second),
+		peerCache:      map[uint64]*metapb.Peer{},
+		PeerHeartbeats: map[uint64]time.Time{},
+	}
+	snapMgr := NewSnapManager(ps.Engines.kvPath, nil)
+	var events []SnapEvent
+	snapMgr.AddSnapEventListener(func(event SnapEvent) {
+		events = append(events, event)
+	})
+	cfg := NewDefaultConfig()
+	cfg.SnapWaitersCapacity = 1
+	d := newRaftMsgHandler(&peerFsm{peer: p}, &RaftContext{GlobalContext: &GlobalContext{
+		cfg:     cfg,
+		engine:  ps.Engines,
+		snapMgr: snapMgr,
+	}})
+	status := JobStatusRunning
+	ps.snapState = SnapState{StateType: SnapStateApplying, Status: &status}
+	replicaRead := func() *Callback {
+		cb := NewCallback()
+		d.proposeRaftCommand(raftlog.NewRequest(&raft_cmdpb.RaftCmdRequest{
+			Header: &raft_cmdpb.RaftRequestHeader{
+				RegionId:    ps.region.Id,
+				Peer:        p.Meta,
+				RegionEpoch: ps.region.RegionEpoch,
+				ReplicaRead: true,
+			},
+			Requests: []*raft_cmdpb.Request{{CmdType: raft_cmdpb.CmdType_Snap, Snap: &raft_cmdpb.SnapRequest{}}},
+		}), cb)
+		return cb
+	}
+
+	// The replica read received while applying the snapshot waits for the snapshot.
+	replicaRead()
+	require.Len(t, p.snapWaiters, 1)
+	assert.Empty(t, p.pendingReads.reads)
+
+	// The waiters are full.
+	cb := replicaRead()
+	cb.wg.Wait()
+	assert.NotNil(t, cb.resp.Header.Error.ServerIsBusy)
+	require.Len(t, p.snapWaiters, 1)
+
+	// The waiter is not expired yet.
+	d.expireSnapWaiters(time.Now())
+	require.Len(t, p.snapWaiters, 1)
+
+	// The read is proposed once the peer notices the finished snapshot.
+	status = JobStatusFinished
+	assert.False(t, ps.CheckApplyingSnap())
+	d.onSnapshotApplyFinished()
+	assert.Empty(t, p.snapWaiters)
+	assert.Len(t, p.pendingReads.reads, 1)
+	require.Len(t, events, 1)
+	assert.Equal(t, SnapEventActivated, events[0].Type)
+	assert.Equal(t, ps.region.Id, events[0].Key.RegionID)
+	assert.Equal(t, ps.truncatedIndex(), events[0].Key.Index)
+
+	// The waiter fails after the timeout.
+	status = JobStatusRunning
+	ps.snapState = SnapState{StateType: SnapStateApplying, Status: &status}
+	cb = replicaRead()
+	require.Len(t, p.snapWaiters, 1)
+	d.expireSnapWaiters(time.Now().Add(cfg.SnapWaitTimeout))
+	assert.Empty(t, p.snapWaiters)
+	cb.wg.Wait()
+	require.NotNil(t, cb.resp.Header.Error.ServerIsBusy)
+	assert.Contains(t, cb.resp.Header.Error.ServerIsBusy.Reason, "waited")
+}
+
+func TestReplicationLag(t *testing.T) {
+	ps := newTestPeerStorage(t)
+	defer cleanUpTestData(ps)
+	ps.region.Peers = append(ps.region.Peers, &metapb.Peer{Id: 2, StoreId: 2, Role: metapb.PeerRole_Learner})
+	rn, err := raft.NewRawNode(&raft.Config{
+		ID:              1,
+		ElectionTick:    10,
+		HeartbeatTick:   2,
+		Storage:         ps,
+		Applied:         ps.AppliedIndex(),
+		MaxInflightMsgs: 256,
+	}, nil)
+	require.Nil(t, err)
+	p := &Peer{
+		Meta:           &metapb.Peer{Id: 1, StoreId: 1},
+		regionID:       ps.region.Id,
+		RaftGroup:      rn,
+		peerStorage:    ps,
+		peerCache:      map[uint64]*metapb.Peer{},
+		PeerHeartbeats: map[uint64]time.Time{},
+	}
+	p.updateReplicationLag()
+	assert.Nil(t, p.loadReplicationLag())
+
+	require.Nil(t, rn.Campaign())
+	require.True(t, p.IsLeader())
+	p.updateReplicationLag()
+	lag := p.loadReplicationLag()
+	require.NotNil(t, lag)
+	lastIndex := rn.Raft.RaftLog.LastIndex()
+	assert.Equal(t, ps.region.Id, lag.RegionID)
+	assert.Equal(t, uint64(1), lag.LeaderID)
+	assert.Equal(t, lastIndex, lag.LastIndex)
+	require.Len(t, lag.Followers, 1)
+	follower := lag.Followers[0]
+	assert.Equal(t, uint64(2), follower.PeerID)
+	assert.Equal(t, uint64(2), follower.StoreID)
+	assert.True(t, follower.Learner)
+	assert.Equal(t, "ProgressStateProbe", follower.State)
+	assert.Equal(t, lastIndex-follower.Match, follower.Gap)
+	assert.Equal(t, follower.Gap, lag.MaxGap)
+	assert.True(t, lag.hasProbingFollower())
+
+	// The learner catches up with the leader.
+	resp := &eraftpb.Message{MsgType: eraftpb.MessageType_MsgAppendResponse, From: 2, To: 1, Term: p.Term(), Index: lastIndex}
+	require.Nil(t, p.Step(resp))
+	p.updateReplicationLag()
+	lag = p.loadReplicationLag()
+	assert.Equal(t, uint64(0), lag.MaxGap)
+	assert.Equal(t, "ProgressStateReplicate", lag.Followers[0].State)
+	assert.False(t, lag.hasProbingFollower())
+
+	// A heartbeat with a higher term steps down the leader.
+	require.Nil(t, p.Step(&eraftpb.Message{MsgType: eraftpb.MessageType_MsgHeartbeat, From: 2, To: 1, Term: p.Term() + 1}))
+	require.False(t, p.IsLeader())
+	p.updateReplicationLag()
+	assert.Nil(t, p.loadReplicationLag())
+}
+
+func TestAdaptiveFlowControl(t *testing.T) {
+	ps := newTestPeerStorage(t)
+	defer cleanUpTestData(ps)
+	ps.region.Peers = append(ps.region.Peers, &metapb.Peer{Id: 2, StoreId: 2, Role: metapb.PeerRole_Learner})
+	rn, err := raft.NewRawNode(&raft.Config{
+		ID:              1,
+		ElectionTick:    10,
+		HeartbeatTick:   2,
+		Storage:         ps,
+		Applied:         ps.AppliedIndex(),
+		MaxInflightMsgs: 256,
+	}, nil)
+	require.Nil(t, err)
+	cfg := NewDefaultConfig()
+	cfg.RaftAdaptiveFlowControl = true
+	cfg.RaftMaxInflightMsgs = 3
+	cfg.RaftMinInflightMsgs = 1
+	cfg.RaftMinSizePerMsg = 1
+	require.Nil(t, cfg.Validate())
+	p := &Peer{
+		Meta:           &metapb.Peer{Id: 1, StoreId: 1},
+		regionID:       ps.region.Id,
+		RaftGroup:      rn,
+		peerStorage:    ps,
+		peerCache:      map[uint64]*metapb.Peer{},
+		PeerHeartbeats: map[uint64]time.Time{},
+		flowControl:    newFlowController(cfg),
+	}
+	inner := &timedTransport{sent: make(chan *rspb.RaftMessage, 16)}
+	trans := NewFaultTransport(inner)
+	defer trans.Close()
+	received := func() []uint64 {
+		var indexes []uint64
+		for len(inner.sent) > 0 {
+			msg := (<-inner.sent).Message
+			for _, e := range msg.Entries {
+				indexes = append(indexes, e.Index)
+			}
+		}
+		return indexes
+	}
+	require.Nil(t, rn.Campaign())
+	require.True(t, p.IsLeader())
+	lastIndex := rn.Raft.RaftLog.LastIndex()
+	ack := func(index uint64) {
+		resp := &eraftpb.Message{MsgType: eraftpb.MessageType_MsgAppendResponse, From: 2, To: 1, Term: p.Term(), Index: index}
+		require.Nil(t, p.Step(resp))
+	}
+	ack(lastIndex)
+	appendMsg := func(first, count uint64) eraftpb.Message {
+		msg := eraftpb.Message{MsgType: eraftpb.MessageType_MsgAppend, From: 1, To: 2, Term: p.Term(), LogTerm: p.Term(), Index: first - 1}
+		for i := first; i < first+count; i++ {
+			msg.Entries = append(msg.Entries, &eraftpb.Entry{Term: p.Term(), Index: i, Data: make([]byte, 100)})
+		}
+		return msg
+	}
+
+	// A message is split by the max size, every part is appended after the previous one.
+	msgs := splitAppend(appendMsg(lastIndex+1, 5), 250)
+	require.Len(t, msgs, 3)
+	assert.Equal(t, lastIndex+2, msgs[1].Index)
+	assert.Len(t, msgs[1].Entries, 2)
+	assert.Equal(t, lastIndex+4, msgs[2].Index)
+	assert.Len(t, msgs[2].Entries, 1)
+
+	// The messages over the window are held until the earlier ones are acked.
+	p.flowControl.follower(2).maxSize = 1
+	require.Nil(t, p.Send(trans, []eraftpb.Message{appendMsg(lastIndex+1, 5)}))
+	assert.Equal(t, []uint64{lastIndex + 1, lastIndex + 2, lastIndex + 3}, received())
+	// A message without entries is held behind the held ones.
+	commit := eraftpb.Message{MsgType: eraftpb.MessageType_MsgAppend, From: 1, To: 2, Term: p.Term(), LogTerm: p.Term(),
+		Index: lastIndex + 5, Commit: lastIndex + 5}
+	require.Nil(t, p.Send(trans, []eraftpb.Message{commit}))
+	assert.Len(t, inner.sent, 0)
+	ack(lastIndex + 2)
+	require.Nil(t, p.Send(trans, nil))
+	assert.Len(t, inner.sent, 3)
+	assert.Equal(t, []uint64{lastIndex + 4, lastIndex + 5}, received())
+	// It's sent straight away if nothing is held, even if the window is full.
+	require.Nil(t, p.Send(trans, []eraftpb.Message{commit}))
+	assert.Len(t, inner.sent, 1)
+	received()
+	p.updateReplicationLag()
+	follower := p.loadReplicationLag().Followers[0]
+	assert.Equal(t, 3, follower.MaxInflight)
+	assert.Equal(t, uint64(1), follower.MaxSizePerMsg)
+	assert.Equal(t, 3, follower.Inflight)
+	assert.Equal(t, 0, follower.Held)
+	assert.True(t, follower.AckLatency > 0)
+
+	// The window is halved when the messages are dropped, and grows while the messages are held.
+	ack(lastIndex + 5)
+	p.tickFlowControl(trans)
+	trans.SetStoreFilter(1, 2, DropFilter)
+	require.Nil(t, p.Send(trans, []eraftpb.Message{appendMsg(lastIndex+6, 6)}))
+	p.tickFlowControl(trans)
+	f := p.flowControl.get(2)
+	assert.Equal(t, 1.0, f.dropRate)
+	assert.Equal(t, 1, f.maxInflight)
+	assert.Equal(t, uint64(1), f.maxSize)
+	trans.ClearFilters()
+	ack(lastIndex + 8)
+	p.tickFlowControl(trans)
+	assert.Equal(t, 0.0, f.dropRate)
+	assert.Equal(t, 2, f.maxInflight)
+	assert.Equal(t, uint64(2), f.maxSize)
+	assert.Equal(t, []uint64{lastIndex + 9, lastIndex + 10}, received())
+
+	// A slow follower shrinks the window.
+	f.ackLatency = cfg.RaftFlowTargetLatency + time.Millisecond
+	p.tickFlowControl(trans)
+	assert.Equal(t, 1, f.maxInflight)
+
+	// The held messages are dropped once the follower rejects the log, raft probes it again.
+	reject := &eraftpb.Message{MsgType: eraftpb.MessageType_MsgAppendResponse, From: 2, To: 1, Term: p.Term(),
+		Index: lastIndex + 9, Reject: true, RejectHint: lastIndex + 8}
+	require.Nil(t, p.Step(reject))
+	assert.Empty(t, f.held)
+	assert.Empty(t, f.inflights)
+
+	// A message failed to send is lost, the other followers are still flushed.
+	unknown := appendMsg(lastIndex+9, 1)
+	unknown.To = 3
+	p.flowControl.follower(3).held = []eraftpb.Message{unknown}
+	f.held = []eraftpb.Message{appendMsg(lastIndex+9, 1)}
+	assert.NotNil(t, p.flushFlow(trans))
+	assert.Equal(t, []uint64{lastIndex + 9}, received())
+	lost := p.flowControl.get(3)
+	assert.Empty(t, lost.held)
+	assert.Equal(t, uint64(1), lost.sent)
+	assert.Equal(t, uint64(1), lost.lost)
+
+	// The windows are gone after the leader steps down.
+	require.Nil(t, p.Step(&eraftpb.Message{MsgType: eraftpb.MessageType_MsgHeartbeat, From: 2, To: 1, Term: p.Term() + 1}))
+	p.tickFlowControl(trans)
+	assert.Nil(t, p.flowControl.get(2))
+}
+
+func TestLeaseRenewAcrossLeaderBounce(t *testing.T) {
+	ps := newTestPeerStorage(t)
+	defer cleanUpTestData(ps)
+	rn, err := raft.NewRawNode(&raft.Config{
+		ID:              1,
+		ElectionTick:    10,
+		HeartbeatTick:   2,
+		Storage:         ps,
+		Applied:         ps.AppliedIndex(),
+		MaxInflightMsgs: 256,
+	}, nil)
+	require.Nil(t, err)
+	clock := NewManualClock(time.Now())
+	p := &Peer{
+		Meta:                 &metapb.Peer{Id: 1, StoreId: 1},
+		regionID:             ps.region.Id,
+		RaftGroup:            rn,
+		peerStorage:          ps,
+		proposals:            new(ProposalQueue),
+		pendingReads:         new(ReadIndexQueue),
+		PeerHeartbeats:       map[uint64]time.Time{},
+		leaderLease:          NewLeaseWithClock(10*time.Second, clock),
+		checkLeaseInvariants: true,
+	}
+	ready := func() raft.Ready {
+		rd := rn.ReadySince(p.LastApplyingIdx)
+		rd.Snapshot.Metadata = &eraftpb.SnapshotMetadata{}
+		return rd
+	}
+	advance := func(rd raft.Ready) {
+		ctx := NewInvokeContext(ps)
+		raftWB := new(WriteBatch)
+		require.Nil(t, ps.Append(ctx, rd.Entries, raftWB))
+		require.Nil(t, ps.Engines.WriteRaft(raftWB))
+		ps.raftState = ctx.RaftState
+		rn.Advance(rd)
+	}
+	require.Nil(t, rn.Campaign())
+	require.True(t, p.IsLeader())
+	rd := ready()
+	require.NotNil(t, rd.SoftState)
+	advance(rd)
+	staleTerm := p.Term()
+
+	// A read index is pending when the leadership bounces back.
+	p.observeLeaderTerm()
+	staleTime := clock.Now()
+	cb := NewCallback()
+	read := NewReadIndexRequest(p.pendingReads.NextID(), []*ReqCbPair{{Cb: cb}}, &staleTime)
+	read.term = staleTerm
+	p.pendingReads.reads = append(p.pendingReads.reads, read)
+	clock.Advance(time.Second)
+	require.Nil(t, p.Step(&eraftpb.Message{MsgType: eraftpb.MessageType_MsgHeartbeat, From: 2, To: 1, Term: staleTerm + 1}))
+	require.False(t, p.IsLeader())
+	require.Nil(t, p.Step(&eraftpb.Message{MsgType: eraftpb.MessageType_MsgTimeoutNow, From: 2, To: 1, Term: p.Term()}))
+	require.True(t, p.IsLeader())
+	assert.Equal(t, staleTerm+2, p.Term())
+
+	// The soft state doesn't change, but the read of the earlier term is dropped.
+	rd = ready()
+	assert.Nil(t, rd.SoftState)
+	p.ApplyReads(nil, &rd)
+	advance(rd)
+	assert.Empty(t, p.pendingReads.reads)
+	cb.wg.Wait()
+	assert.NotNil(t, cb.resp.Header.Error.StaleCommand)
+	assert.Equal(t, uint64(1), p.pendingReads.Metrics().Dropped)
+
+	// The propose time of the earlier term doesn't renew the lease.
+	assert.False(t, p.renewLeaseByProposal(staleTime, staleTerm))
+	assert.Equal(t, LeaseStateExpired, p.leaderLease.Inspect(nil))
+	p.observeLeaderTerm()
+	assert.True(t, p.renewLeaseByProposal(clock.Now(), p.Term()))
+	assert.Equal(t, LeaseStateValid, p.leaderLease.Inspect(nil))
+	events := p.leaseChecks.snapshot()
+	require.Len(t, events, 4)
+	for i, check := range []LeaseCheck{LeaseCheckReadQueue, LeaseCheckRenewTerm, LeaseCheckRenewAfterElection, LeaseCheckRenewNotFuture} {
+		assert.Equal(t, check, events[i].Check)
+		assert.True(t, events[i].Passed, events[i].Detail)
+		assert.Equal(t, p.Term(), events[i].Term)
+	}
+
+	// The violations are reported.
+	p.checkLeaseRenew(staleTime)
+	p.checkLeaseRenew(clock.Now().Add(time.Second))
+	read = NewReadIndexRequest(p.pendingReads.NextID(), nil, &staleTime)
+	read.term = staleTerm
+	p.pendingReads.reads = append(p.pendingReads.reads, read)
+	p.checkReadQueue()
+	events = p.leaseChecks.snapshot()[4:]
+	require.Len(t, events, 7)
+	failed := map[LeaseCheck]int{}
+	for _, e := range events {
+		if !e.Passed {
+			failed[e.Check]++
+		}
+	}
+	assert.Equal(t, map[LeaseCheck]int{LeaseCheckRenewAfterElection: 1, LeaseCheckRenewNotFuture: 1, LeaseCheckReadQueue: 1}, failed)
+	assert.Equal(t, "read-queue", events[6].Check.String())
+}
+
+func TestPeerCache(t *testing.T) {
+	ps := newTestPeerStorage(t)
+	defer cleanUpTestData(ps)
+	p := &Peer{peerStorage: ps, peerCache: map[uint64]*metapb.Peer{}}
+	// The peer of the region is cached on a miss.
+	require.NotNil(t, p.getPeerFromCache(1))
+	require.NotNil(t, p.getPeerFromCache(1))
+	assert.Nil(t, p.getPeerFromCache(2))
+	// Peer 2 and 3 are known from the raft messages.
+	p.insertPeerCache(&metapb.Peer{Id: 2, StoreId: 2})
+	p.insertPeerCache(&metapb.Peer{Id: 3, StoreId: 3, Role: metapb.PeerRole_Learner})
+	assert.Equal(t, PeerCacheStats{Size: 3, Hits: 1, Misses: 2}, p.peerCacheStats.load())
+
+	// Peer 2 is removed and the learner 3 is promoted.
+	region := &metapb.Region{Id: ps.region.Id, Peers: []*metapb.Peer{{Id: 1, StoreId: 1}, {Id: 3, StoreId: 3}, {Id: 4, StoreId: 4}}}
+	p.refreshPeerCache(region)
+	assert.Len(t, p.peerCache, 3)
+	assert.NotContains(t, p.peerCache, uint64(2))
+	assert.Equal(t, metapb.PeerRole_Voter, p.peerCache[3].Role)
+	assert.Equal(t, region.Peers[2], p.getPeerFromCache(4))
+	assert.Equal(t, PeerCacheStats{Size: 3, Hits: 2, Misses: 2, Pruned: 1, Refreshes: 1}, p.peerCacheStats.load())
+}
+
+func TestConfChangePeerQuota(t *testing.T) {
+	ps := newTestPeerStorage(t)
+	defer cleanUpTestData(ps)
+	p := &Peer{peerStorage: ps, regionID: ps.region.Id, Meta: &metapb.Peer{Id: 1, StoreId: 1}}
+	cfg := NewDefaultConfig()
+	cfg.MaxPeerCount = 2
+	meta := newStoreMeta()
+	meta.regions[ps.region.Id] = ps.region
+	d := &peerMsgHandler{peerFsm: &peerFsm{peer: p}, ctx: &RaftContext{GlobalContext: &GlobalContext{
+		cfg: cfg, storeMeta: meta, storeMetaLock: new(sync.RWMutex)}}}
+	addPeer := func(peer *metapb.Peer) *raft_cmdpb.RaftCmdRequest {
+		return &raft_cmdpb.RaftCmdRequest{AdminRequest: &raft_cmdpb.AdminRequest{
+			CmdType:    raft_cmdpb.AdminCmdType_ChangePeer,
+			ChangePeer: &raft_cmdpb.ChangePeerRequest{ChangeType: eraftpb.ConfChangeType_AddNode, Peer: peer},
+		}}
+	}
+	// The quota counts the peers of the store of the new peer, not the peers of the region.
+	assert.Nil(t, d.checkPeerQuota(addPeer(&metapb.Peer{Id: 2, StoreId: 2})))
+	for id := uint64(10); id < 12; id++ {
+		meta.regions[id] = &metapb.Region{Id: id, Peers: []*metapb.Peer{{Id: id, StoreId: 2}}}
+	}
+	err := d.checkPeerQuota(addPeer(&metapb.Peer{Id: 2, StoreId: 2}))
+	assert.Equal(t, &ErrQuotaExceeded{RegionID: ps.region.Id, StoreID: 2, Quota: "MaxPeerCount", Limit: 2}, err)
+	pbErr := ErrToPbError(err)
+	assert.Equal(t, err.Error(), pbErr.Message)
+	assert.Nil(t, pbErr.ServerIsBusy)
+	assert.Nil(t, d.checkPeerQuota(addPeer(&metapb.Peer{Id: 3, StoreId: 3})))
+
+	// Removing a peer or promoting a learner doesn't add a peer to the store.
+	assert.Nil(t, d.checkPeerQuota(addPeer(&metapb.Peer{Id: 1, StoreId: 1})))
+	remove := addPeer(&metapb.Peer{Id: 2, StoreId: 2})
+	remove.AdminRequest.ChangePeer.ChangeType = eraftpb.ConfChangeType_RemoveNode
+	assert.Nil(t, d.checkPeerQuota(remove))
+}
+
+func TestSnapshotCatchUp(t *testing.T) {
+	p := &Peer{Meta: &metapb.Peer{Id: 1, StoreId: 1}}
+	cfg := NewDefaultConfig()
+	replicate := raft.Progress{State: raft.ProgressStateReplicate}
+	progress := func(match uint64) raft.Progress {
+		pr := replicate
+		pr.Match = match
+		return pr
+	}
+	// The follower is only given up by the gc limits by default.
+	start := time.Now().Add(-time.Hour)
+	p.observeFollowerLag(2, 10, 1000, start)
+	assert.Equal(t, "", p.giveUpLogCatchUp(cfg, 2, progress(10), 1000))
+
+	cfg.SnapshotCatchUpGap = 500
+	assert.Equal(t, CatchUpReasonGap, p.giveUpLogCatchUp(cfg, 2, progress(10), 1000))
+	assert.Equal(t, "", p.giveUpLogCatchUp(cfg, 2, progress(600), 1000))
+	// The leader itself and the followers receiving a snapshot are never given up.
+	assert.Equal(t, "", p.giveUpLogCatchUp(cfg, 1, progress(10), 1000))
+	assert.Equal(t, "", p.giveUpLogCatchUp(cfg, 2, raft.Progress{State: raft.ProgressStateSnapshot}, 1000))
+
+	cfg.SnapshotCatchUpLag = time.Minute
+	assert.Equal(t, CatchUpReasonLag, p.giveUpLogCatchUp(cfg, 2, progress(600), 1000))
+	// The follower keeps lagging until it matches the last index at the start of the lagging.
+	p.observeFollowerLag(2, 999, 2000, time.Now())
+	assert.Equal(t, CatchUpReasonLag, p.giveUpLogCatchUp(cfg, 2, progress(1999), 2000))
+	p.observeFollowerLag(2, 1000, 2000, time.Now())
+	assert.Equal(t, "", p.giveUpLogCatchUp(cfg, 2, progress(1999), 2000))
+	p.observeFollowerLag(2, 2000, 2000, time.Now())
+	assert.Empty(t, p.followerLags)
+
+	p.observeFollowerLag(3, 10, 2000, start)
+	p.onSnapshotCatchUp(3, 10, 2000, 1500, CatchUpReasonGap)
+	events := p.catchUpEvents.snapshot()
+	require.Len(t, events, 1)
+	assert.Equal(t, uint64(3), events[0].PeerID)
+	assert.Equal(t, uint64(1500), events[0].CompactIndex)
+	assert.Equal(t, CatchUpReasonGap, events[0].Reason)
+	assert.True(t, events[0].Lag >= time.Hour)
+}
+
+func TestPausePeer(t *testing.T) {
+	rw := &raftWorker{pr: newRouter(nil, nil), paused: make(map[uint64][]Msg)}
+	rw.pr.peers.Store(uint64(1), &peerState{})
+	router := &Router{router: rw.pr}
+	assert.Equal(t, errPeerNotFound, router.PausePeer(3))
+
+	msgs := []Msg{
+		NewPeerMsg(MsgTypeRaftMessage, 1, "a"),
+		NewPeerMsg(MsgTypePausePeer, 1, nil),
+		NewPeerMsg(MsgTypeTick, 1, nil),
+		NewPeerMsg(MsgTypeRaftCmd, 1, "b"),
+		NewPeerMsg(MsgTypeRaftMessage, 2, "c"),
+	}
+	out := rw.filterPaused(msgs)
+	require.Len(t, out, 2)
+	assert.Equal(t, "a", out[0].Data)
+	assert.Equal(t, "c", out[1].Data)
+
+	// The held messages are handled in order on resume, the ticks are dropped.
+	msgs = []Msg{
+		NewPeerMsg(MsgTypeTick, 1, nil),
+		NewPeerMsg(MsgTypeRaftMessage, 1, "d"),
+		NewPeerMsg(MsgTypeResumePeer, 1, nil),
+		NewPeerMsg(MsgTypeRaftMessage, 1, "e"),
+	}
+	out = rw.filterPaused(msgs)
+	require.Len(t, out, 3)
+	assert.Equal(t, "b", out[0].Data)
+	assert.Equal(t, "d", out[1].Data)
+	assert.Equal(t, "e", out[2].Data)
+	assert.Empty(t, rw.paused)
+
+	// The commands beyond the cap are rejected, the held commands fail if the peer is gone on resume.
+	var pending int64
+	newCmd := func() (Msg, *Callback) {
+		cb := NewCallback()
+		pending++
+		return NewPeerMsg(MsgTypeRaftCmd, 1, &MsgRaftCmd{Callback: cb, pending: &pending}), cb
+	}
+	require.Len(t, rw.filterPaused([]Msg{NewPeerMsg(MsgTypePausePeer, 1, nil)}), 0)
+	callbacks := make([]*Callback, 0, pausedPeerMaxHeldCmds)
+	for i := 0; i < pausedPeerMaxHeldCmds; i++ {
+		msg, cb := newCmd()
+		callbacks = append(callbacks, cb)
+		require.Len(t, rw.filterPaused([]Msg{msg}), 0)
+	}
+	msg, cb := newCmd()
+	require.Len(t, rw.filterPaused([]Msg{msg}), 0)
+	assert.NotNil(t, cb.resp.GetHeader().GetError().GetServerIsBusy())
+	assert.Equal(t, int64(pausedPeerMaxHeldCmds), pending)
+
+	rw.pr.peers.Delete(uint64(1))
+	require.Len(t, rw.filterPaused([]Msg{NewPeerMsg(MsgTypeResumePeer, 1, nil)}), 0)
+	for _, cb := range callbacks {
+		assert.Equal(t, uint64(1), cb.resp.GetHeader().GetError().GetRegionNotFound().GetRegionId())
+	}
+	assert.Zero(t, pending)
+}
+
+func TestReadFallback(t *testing.T) {
+	ps := newTestPeerStorage(t)
+	defer cleanUpTestData(ps)
+	rn, err := raft.NewRawNode(&raft.Config{
+		ID:              1,
+		ElectionTick:    10,
+		HeartbeatTick:   2,
+		Storage:         ps,
+		Applied:         ps.AppliedIndex(),
+		MaxInflightMsgs: 256,
+		CheckQuorum:     true,
+	}, nil)
+	require.Nil(t, err)
+	clock := NewManualClock(time.Now())
+	cfg := NewDefaultConfig()
+	cfg.AdaptiveLeaseFallbackRate = 0.5
+	cfg.AdaptiveLeaseWindow = time.Second
+	p := &Peer{
+		Meta:           &metapb.Peer{Id: 1, StoreId: 1},
+		regionID:       ps.region.Id,
+		RaftGroup:      rn,
+		peerStorage:    ps,
+		proposals:      new(ProposalQueue),
+		pendingReads:   new(ReadIndexQueue),
+		PeerHeartbeats: map[uint64]time.Time{},
+		leaderLease:    NewLeaseWithClock(10*time.Second, clock),
+		leaseStats:     newLeaseStats(),
+		readFallback:   newReadFallbackStats(cfg),
+	}
+	require.Nil(t, rn.Campaign())
+	require.True(t, p.IsLeader())
+	ps.appliedIndexTerm = p.Term()
+	get := raftlog.NewRequest(&raft_cmdpb.RaftCmdRequest{Requests: []*raft_cmdpb.Request{{CmdType: raft_cmdpb.CmdType_Get}}})
+	read := func() RequestPolicy {
+		policy, err := p.inspect(get)
+		require.Nil(t, err)
+		p.observeRead(get.GetRaftCmdRequest(), policy)
+		return policy
+	}
+
+	// The first tick starts the window.
+	assert.False(t, p.needEarlyLeaseRenew())
+	assert.Equal(t, RequestPolicyReadIndex, read())
+	assert.Equal(t, RequestPolicyReadIndex, read())
+	p.MaybeRenewLeaderLease(clock.Now())
+	assert.Equal(t, RequestPolicyReadLocal, read())
+	require.Nil(t, p.controlLease(LeaseControlSuspect))
+	assert.Equal(t, RequestPolicyReadIndex, read())
+	p.MaybeRenewLeaderLease(clock.Now().Add(time.Second))
+	ps.appliedIndexTerm--
+	assert.Equal(t, RequestPolicyReadIndex, read())
+	ps.appliedIndexTerm++
+	// An explicit read index is not a fallback.
+	p.observeRead(&raft_cmdpb.RaftCmdRequest{Header: &raft_cmdpb.RaftRequestHeader{ReadQuorum: true}}, RequestPolicyReadIndex)
+
+	// 2 of the 5 reads fall back because the lease is expired, it is under the threshold.
+	clock.Advance(time.Second)
+	assert.False(t, p.needEarlyLeaseRenew())
+	assert.Equal(t, ReadFallbackMetrics{LocalReads: 1, LeaseExpired: 2, LeaseSuspect: 1, TermMismatch: 1,
+		LastWindowRate: 0.4}, p.readFallback.snapshot())
+
+	// All the reads fall back in the next window, the lease is renewed early.
+	require.Nil(t, p.controlLease(LeaseControlExpire))
+	assert.Equal(t, RequestPolicyReadIndex, read())
+	clock.Advance(time.Second)
+	assert.True(t, p.needEarlyLeaseRenew())
+	lastIndex := p.nextProposalIndex()
+	p.maybeRenewLeaseEarly(cfg)
+	assert.Equal(t, lastIndex+1, p.nextProposalIndex())
+	// The renewal is not applied yet.
+	assert.False(t, p.needEarlyLeaseRenew())
+	metrics := p.readFallback.snapshot()
+	assert.Equal(t, uint64(1), metrics.EarlyRenewals)
+	assert.Equal(t, uint64(1), metrics.AdaptiveWindows)
+	assert.Equal(t, 1.0, metrics.LastWindowRate)
+
+	// A valid lease is renewed only if it is going to expire.
+	p.readFallback.renewIndex = 0
+	assert.Equal(t, RequestPolicyReadIndex, read())
+	p.MaybeRenewLeaderLease(clock.Now())
+	assert.False(t, p.needEarlyLeaseRenew())
+	clock.Advance(7 * time.Second)
+	assert.True(t, p.needEarlyLeaseRenew())
+	assert.Equal(t, "lease-expired", ReadFallbackLeaseExpired.String())
+}
+
+func TestReadFallbackLeaseRead(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	lease := NewLeaseWithClock(10*time.Second, clock)
+	lease.Renew(clock.Now())
+	region := &metapb.Region{Id: 1, RegionEpoch: &metapb.RegionEpoch{Version: 1}}
+	checker := &leaderChecker{
+		peerID:       1,
+		clock:        clock,
+		region:       unsafe.Pointer(region),
+		leaderLease:  unsafe.Pointer(lease.MaybeNewRemoteLease(1)),
+		readFallback: newReadFallbackStats(NewDefaultConfig()),
+	}
+	checker.term.Store(1)
+	checker.appliedIndexTerm.Store(1)
+	ctx := &kvrpcpb.Context{RegionId: 1, Peer: &metapb.Peer{Id: 1}, RegionEpoch: region.RegionEpoch, Term: 1}
+	router := &Router{router: newRouter(nil, nil)}
+
+	// The reads served by the lease without proposing are counted as the local reads.
+	require.Nil(t, checker.IsLeader(ctx, router))
+	require.Nil(t, checker.IsLeader(ctx, router))
+	assert.Equal(t, uint64(2), checker.readFallback.snapshot().LocalReads)
+	checker.maxTSSyncing.Store(1)
+	require.NotNil(t, checker.IsLeader(ctx, router))
+	assert.Equal(t, uint64(2), checker.readFallback.snapshot().LocalReads)
+}
+
+func TestSnapshotSource(t *testing.T) {
+	topology := NewStoreTopology()
+	zone := func(z string) []StoreLabel { return []StoreLabel{{LabelKey: "zone", LabelValue: z}} }
+	topology.SetLabels(1, zone("z1"))
+	topology.SetLabels(2, zone("z2"))
+	topology.SetLabels(3, zone("z2"))
+	labels := []string{"zone"}
+	d, ok := topology.distance(labels, 2, 3)
+	assert.True(t, ok)
+	assert.Equal(t, 0, d)
+	d, ok = topology.distance(labels, 1, 3)
+	assert.True(t, ok)
+	assert.Equal(t, 1, d)
+	_, ok = topology.distance(labels, 1, 4)
+	assert.False(t, ok)
+
+	cfg := NewDefaultConfig()
+	cfg.SnapshotSourcePolicy = SnapshotSourceClosest
+	cfg.LocationLabels = labels
+	cfg.StoreTopology = topology
+	newPeer := func(id uint64) *Peer {
+		ps := newTestPeerStorage(t)
+		ps.region.Peers = []*metapb.Peer{{Id: 1, StoreId: 1}, {Id: 2, StoreId: 2}, {Id: 3, StoreId: 3}}
+		rn, err := raft.NewRawNode(&raft.Config{
+			ID:              id,
+			ElectionTick:    10,
+			HeartbeatTick:   2,
+			Storage:         ps,
+			Applied:         ps.AppliedIndex(),
+			MaxInflightMsgs: 256,
+		}, nil)
+		require.Nil(t, err)
+		return &Peer{
+			Meta:           &metapb.Peer{Id: id, StoreId: id},
+			regionID:       ps.region.Id,
+			RaftGroup:      rn,
+			peerStorage:    ps,
+			peerCache:      map[uint64]*metapb.Peer{},
+			PeerHeartbeats: map[uint64]time.Time{},
+			leaderLease:    NewLease(10 * time.Second),
+			snapSource:     newSnapSource(cfg),
+		}
+	}
+	leader := newPeer(1)
+	defer cleanUpTestData(leader.peerStorage)
+	rn := leader.RaftGroup
+	require.Nil(t, rn.Campaign())
+	require.Nil(t, rn.Step(eraftpb.Message{MsgType: eraftpb.MessageType_MsgRequestVoteResponse, From: 2, To: 1, Term: rn.Raft.Term}))
+	require.True(t, leader.IsLeader())
+	pr2, pr3 := rn.Raft.Prs[2], rn.Raft.Prs[3]
+	pr2.Match, pr2.RecentActive = 10, true
+	pr3.State, pr3.PendingSnapshot = raft.ProgressStateSnapshot, 10
+	snapMsg := eraftpb.Message{
+		MsgType:  eraftpb.MessageType_MsgSnapshot,
+		From:     1,
+		To:       3,
+		Term:     leader.Term(),
+		Snapshot: &eraftpb.Snapshot{Metadata: &eraftpb.SnapshotMetadata{Index: 10}},
+	}
+
+	// Peer 2 is in the zone of peer 3, it sends the snapshot.
+	trans := new(mockTransport)
+	require.Nil(t, leader.Send(trans, []eraftpb.Message{snapMsg}))
+	require.Len(t, trans.msgs, 1)
+	relay := trans.msgs[0]
+	assert.True(t, isSnapshotRelay(relay))
+	assert.Equal(t, uint64(2), relay.ToPeer.Id)
+	assert.Equal(t, uint64(3), relay.ExtraMsg.CheckPeers[0].Id)
+	assert.Equal(t, uint64(10), relay.Message.Index)
+
+	// A follower behind the snapshot index can't send it.
+	pr2.Match = 9
+	require.Nil(t, leader.Send(trans, []eraftpb.Message{snapMsg}))
+	require.Len(t, trans.msgs, 2)
+	assert.Equal(t, eraftpb.MessageType_MsgSnapshot, trans.msgs[1].Message.MsgType)
+	assert.Equal(t, uint64(3), trans.msgs[1].ToPeer.Id)
+	pr2.Match = 10
+
+	// The leader sends the snapshot itself after the relay times out, until the receiver catches up.
+	leader.snapSource.relays[3] = snapRelay{source: 2, index: 10, since: time.Now().Add(-time.Hour)}
+	leader.checkSnapshotRelays()
+	assert.Equal(t, raft.ProgressStateProbe, pr3.State)
+	require.Nil(t, leader.Send(trans, []eraftpb.Message{snapMsg}))
+	require.Len(t, trans.msgs, 3)
+	assert.Equal(t, uint64(3), trans.msgs[2].ToPeer.Id)
+	pr3.Match = 10
+	leader.checkSnapshotRelays()
+	assert.Empty(t, leader.snapSource.fallbacks)
+	events := leader.snapSource.snapshot()
+	require.Len(t, events, 2)
+	assert.Equal(t, SnapSourceEventRelay, events[0].Type)
+	assert.Equal(t, SnapSourceEventTimeout, events[1].Type)
+
+	// The follower sends its snapshot on behalf of the leader when it is generated.
+	follower := newPeer(2)
+	defer cleanUpTestData(follower.peerStorage)
+	require.Nil(t, follower.RaftGroup.Step(eraftpb.Message{MsgType: eraftpb.MessageType_MsgHeartbeat, From: 1, To: 2, Term: leader.Term()}))
+	require.Equal(t, uint64(1), follower.LeaderID())
+	trans = new(mockTransport)
+	h := &peerMsgHandler{peerFsm: &peerFsm{peer: follower}, ctx: &RaftContext{GlobalContext: &GlobalContext{cfg: cfg, trans: trans}}}
+	relay.Message.Index = follower.Store().AppliedIndex()
+	h.onSnapshotRelay(relay)
+	assert.True(t, h.hasReady)
+	require.NotNil(t, follower.peerStorage.genSnapTask)
+	data, err := (&rspb.RaftSnapshotData{Region: follower.Region()}).Marshal()
+	require.Nil(t, err)
+	follower.peerStorage.snapState.Receiver <- &eraftpb.Snapshot{
+		Data:     data,
+		Metadata: &eraftpb.SnapshotMetadata{Index: relay.Message.Index, Term: follower.Store().appliedIndexTerm},
+	}
+	h.maybeSendRelayedSnapshot()
+	require.Len(t, trans.msgs, 1)
+	sent := trans.msgs[0]
+	assert.Equal(t, eraftpb.MessageType_MsgSnapshot, sent.Message.MsgType)
+	assert.Equal(t, uint64(1), sent.FromPeer.Id)
+	assert.Equal(t, uint64(3), sent.ToPeer.Id)
+	assert.Equal(t, leader.Term(), sent.Message.Term)
+	assert.Nil(t, follower.snapSource.pending)
+}
+
+func TestHibernate(t *testing.T) {
+	cfg := NewDefaultConfig()
+	cfg.HibernateRegions = true
+	cfg.HibernateIdleTicks = 2
+	newPeer := func(id uint64) (*Peer, *peerMsgHandler, *mockTransport) {
+		ps := newTestPeerStorage(t)
+		ps.region.Peers = []*metapb.Peer{{Id: 1, StoreId: 1}, {Id: 2, StoreId: 2}, {Id: 3, StoreId: 3}}
+		rn, err := raft.NewRawNode(&raft.Config{
+			ID:              id,
+			ElectionTick:    10,
+			HeartbeatTick:   2,
+			Storage:         ps,
+			Applied:         ps.AppliedIndex(),
+			MaxInflightMsgs: 256,
+		}, nil)
+		require.Nil(t, err)
+		p := &Peer{
+			Meta:           &metapb.Peer{Id: id, StoreId: id},
+			regionID:       ps.region.Id,
+			RaftGroup:      rn,
+			peerStorage:    ps,
+			peerCache:      map[uint64]*metapb.Peer{},
+			PeerHeartbeats: map[uint64]time.Time{},
+			leaderLease:    NewLease(10 * time.Second),
+			proposals:      new(ProposalQueue),
+			pendingReads:   new(ReadIndexQueue),
+			hibernate:      newHibernateState(cfg),
+		}
+		trans := new(mockTransport)
+		h := &peerMsgHandler{peerFsm: &peerFsm{peer: p}, ctx: &RaftContext{GlobalContext: &GlobalContext{cfg: cfg, trans: trans}}}
+		return p, h, trans
+	}
+	leader, lh, ltrans := newPeer(1)
+	defer cleanUpTestData(leader.peerStorage)
+	rn := leader.RaftGroup
+	require.Nil(t, rn.Campaign())
+	term := rn.Raft.Term
+	require.Nil(t, rn.Step(eraftpb.Message{MsgType: eraftpb.MessageType_MsgRequestVoteResponse, From: 2, To: 1, Term: term}))
+	require.True(t, leader.IsLeader())
+	assert.False(t, leader.readyToHibernate())
+
+	// The leader is ready to hibernate after the followers catch up and the entries are applied.
+	lastIndex := rn.Raft.RaftLog.LastIndex()
+	for _, id := range []uint64{2, 3} {
+		require.Nil(t, rn.Step(eraftpb.Message{MsgType: eraftpb.MessageType_MsgAppendResponse, From: id, To: 1, Term: term, Index: lastIndex}))
+	}
+	leader.peerStorage.applyState.appliedIndex = lastIndex
+	require.True(t, leader.readyToHibernate())
+	lh.maybeHibernate()
+	assert.Empty(t, ltrans.msgs)
+	lh.maybeHibernate()
+	require.Len(t, ltrans.msgs, 2)
+	req := ltrans.msgs[0]
+	assert.True(t, isHibernateMessage(req))
+	assert.Equal(t, rspb.ExtraMessageType_MsgHibernateRequest, req.ExtraMsg.Type)
+	assert.False(t, leader.hibernate.isHibernated())
+
+	// A follower hibernates when it agrees.
+	follower, fh, ftrans := newPeer(2)
+	defer cleanUpTestData(follower.peerStorage)
+	require.Nil(t, follower.RaftGroup.Step(eraftpb.Message{MsgType: eraftpb.MessageType_MsgHeartbeat, From: 1, To: 2, Term: term}))
+	require.Equal(t, uint64(1), follower.LeaderID())
+	fh.onHibernateMessage(req)
+	require.Len(t, ftrans.msgs, 1)
+	assert.Equal(t, rspb.ExtraMessageType_MsgHibernateResponse, ftrans.msgs[0].ExtraMsg.Type)
+	assert.True(t, follower.hibernate.isHibernated())
+
+	// The leader hibernates when all the followers agree.
+	lh.onHibernateMessage(ftrans.msgs[0])
+	lh.maybeHibernate()
+	assert.False(t, leader.hibernate.isHibernated())
+	// Only the peer not agreeing yet is asked again.
+	require.Len(t, ltrans.msgs, 3)
+	assert.Equal(t, uint64(3), ltrans.msgs[2].ToPeer.Id)
+	resp := leader.newHibernateMessage(rspb.ExtraMessageType_MsgHibernateResponse, leader.Meta)
+	resp.FromPeer = &metapb.Peer{Id: 3, StoreId: 3}
+	lh.onHibernateMessage(resp)
+	lh.maybeHibernate()
+	assert.True(t, leader.hibernate.isHibernated())
+
+	// A follower woken up by a local request wakes the leader up.
+	fh.wakeUp(true)
+	assert.False(t, follower.hibernate.isHibernated())
+	require.Len(t, ftrans.msgs, 2)
+	wake := ftrans.msgs[1]
+	assert.Equal(t, rspb.ExtraMessageType_MsgRegionWakeUp, wake.ExtraMsg.Type)
+	assert.Equal(t, uint64(1), wake.ToPeer.Id)
+	lh.onHibernateMessage(wake)
+	assert.False(t, leader.hibernate.isHibernated())
+	assert.Equal(t, 0, leader.hibernate.idleTicks)
+
+	// A follower behind the leader refuses to hibernate.
+	follower.peerStorage.applyState.appliedIndex--
+	fh.onHibernateMessage(req)
+	assert.Len(t, ftrans.msgs, 2)
+	assert.False(t, follower.hibernate.isHibernated())
+
+	// A proposal in flight keeps the leader awake.
+	leader.proposals.Push(&ProposalMeta{Index: lastIndex + 1, Term: term})
+	lh.maybeHibernate()
+	lh.maybeHibernate()
+	assert.Equal(t, 0, leader.hibernate.idleTicks)
+	assert.Len(t, ltrans.msgs, 3)
+
+	// Hibernation is disabled by default.
+	assert.Nil(t, newHibernateState(NewDefaultConfig()))
+	assert.False(t, (*hibernateState)(nil).isHibernated())
+}
+
+func TestLogBudget(t *testing.T) {
+	cfg := NewDefaultConfig()
+	cfg.PeerDebugLogRate = 0.001
+	cfg.PeerDebugLogBurst = 2
+	b := newLogBudget(cfg)
+	for i := 0; i < 2; i++ {
+		suppressed, ok := b.take()
+		assert.True(t, ok)
+		assert.Equal(t, uint64(0), suppressed)
+	}
+	for i := 0; i < 3; i++ {
+		_, ok := b.take()
+		assert.False(t, ok)
+	}
+	// The suppressed logs are reported by the next log written.
+	b.limiter = rate.NewLimiter(rate.Inf, 1)
+	suppressed, ok := b.take()
+	assert.True(t, ok)
+	assert.Equal(t, uint64(3), suppressed)
+
+	cfg.PeerDebugLogRate = 0
+	_, ok = newLogBudget(cfg).take()
+	assert.True(t, ok)
+
+	assert.NotNil(t, SetModuleLogLevel("unknown", "info"))
+	assert.NotNil(t, SetModuleLogLevel(LogModulePeer, "verbose"))
+	require.Nil(t, SetModuleLogLevel(LogModulePeer, "info"))
+	assert.Equal(t, "info", ModuleLogLevels()[LogModulePeer])
+	assert.False(t, debugEnabled(LogModulePeer))
+
+	// The module level overrides an info global level.
+	buf := new(bytes.Buffer)
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(buf), zapcore.InfoLevel)
+	logger := log.L()
+	log.ReplaceGlobals(zap.New(core), nil)
+	defer log.ReplaceGlobals(logger, nil)
+	require.Nil(t, SetModuleLogLevel(LogModulePeer, "debug"))
+	assert.True(t, debugEnabled(LogModulePeer))
+	assert.False(t, debugEnabled(LogModuleApply))
+	debugLog(LogModulePeer, newLogBudget(cfg), "peer", "module debug log")
+	debugLog(LogModuleApply, newLogBudget(cfg), "apply", "global debug log")
+	assert.Contains(t, buf.String(), "module debug log")
+	assert.NotContains(t, buf.String(), "global debug log")
+
+	require.Nil(t, SetModuleLogLevel(LogModulePeer, LogLevelGlobal))
+	assert.Equal(t, LogLevelGlobal, ModuleLogLevels()[LogModulePeer])
+	assert.False(t, debugEnabled(LogModulePeer))
+}
+
+type roleObserver struct {
+	PeerEventObserver
+}
+
+func (o roleObserver) OnRoleChange(regionID uint64, newState raft.StateType) {}
+
+func TestFastCampaign(t *testing.T) {
+	cfg := NewDefaultConfig()
+	cfg.FastCampaign = true
+	ps := newTestPeerStorage(t)
+	defer cleanUpTestData(ps)
+	region := ps.region
+	region.Peers = []*metapb.Peer{{Id: 1, StoreId: 1}, {Id: 2, StoreId: 2, Role: metapb.PeerRole_Learner}}
+	assert.True(t, votersOnStore(region, 1))
+	assert.False(t, votersOnStore(region, 2))
+
+	// The only voter is elected when it is created, without ticking.
+	p, err := NewPeer(1, cfg, ps.Engines, region, nil, region.Peers[0])
+	require.Nil(t, err)
+	assert.True(t, p.IsLeader())
+	assert.Equal(t, uint64(RaftInitLogTerm+1), p.Term())
+
+	result := func(h *peerMsgHandler) error {
+		cb := NewCallback()
+		h.onCampaign(cb)
+		cb.wg.Wait()
+		if pbErr := cb.resp.GetHeader().GetError(); pbErr != nil {
+			return errors.New(pbErr.Message)
+		}
+		return nil
+	}
+	newHandler := func(cfg *Config, region *metapb.Region) *peerMsgHandler {
+		p, err := NewPeer(1, cfg, ps.Engines, region, nil, region.Peers[0])
+		require.Nil(t, err)
+		ctx := &RaftContext{GlobalContext: &GlobalContext{cfg: cfg}}
+		return &peerMsgHandler{peerFsm: &peerFsm{peer: p}, ctx: ctx}
+	}
+	h := newHandler(NewDefaultConfig(), region)
+	assert.NotNil(t, result(h))
+	assert.False(t, h.peer.IsLeader())
+	h = newHandler(cfg, region)
+	assert.Nil(t, result(h))
+	assert.True(t, h.peer.IsLeader())
+
+	// A peer can't be elected alone if the other voters are on the other stores.
+	region.Peers[1].Role = metapb.PeerRole_Voter
+	h = newHandler(cfg, region)
+	assert.False(t, h.peer.IsLeader())
+	assert.NotNil(t, result(h))
+	assert.False(t, h.peer.IsLeader())
+}
+
+func TestForceLeader(t *testing.T) {
+	cfg := NewDefaultConfig()
+	newHandler := func(peerID uint64) (*peerMsgHandler, *PeerStorage) {
+		ps := newTestPeerStorage(t)
+		ps.region.Peers = []*metapb.Peer{{Id: 1, StoreId: 1}, {Id: 2, StoreId: 2}, {Id: 3, StoreId: 3}}
+		rn, err := raft.NewRawNode(&raft.Config{
+			ID:              peerID,
+			ElectionTick:    10,
+			HeartbeatTick:   2,
+			Storage:         ps,
+			Applied:         ps.AppliedIndex(),
+			MaxInflightMsgs: 256,
+		}, nil)
+		require.Nil(t, err)
+		p := &Peer{
+			Meta:                  &metapb.Peer{Id: peerID, StoreId: peerID},
+			regionID:              ps.region.Id,
+			RaftGroup:             rn,
+			peerStorage:           ps,
+			peerCache:             map[uint64]*metapb.Peer{},
+			PeerHeartbeats:        map[uint64]time.Time{},
+			PeersStartPendingTime: map[uint64]time.Time{},
+			leaderLease:           NewLease(10 * time.Second),
+			proposals:             new(ProposalQueue),
+			pendingReads:          new(ReadIndexQueue),
+			LastApplyingIdx:       ps.AppliedIndex(),
+		}
+		ctx := &RaftContext{
+			GlobalContext: &GlobalContext{cfg: cfg, engine: ps.Engines, storeMeta: newStoreMeta(), storeMetaLock: new(sync.RWMutex)},
+			applyMsgs:     new(applyMsgs),
+		}
+		return &peerMsgHandler{peerFsm: &peerFsm{peer: p}, ctx: ctx}, ps
+	}
+	result := func(cb *Callback) error {
+		cb.wg.Wait()
+		if pbErr := cb.resp.GetHeader().GetError(); pbErr != nil {
+			return errors.New(pbErr.Message)
+		}
+		return nil
+	}
+
+	// The only surviving peer drops the others and is elected.
+	h, ps := newHandler(1)
+	defer cleanUpTestData(ps)
+	cb := NewCallback()
+	h.onForceLeader([]uint64{1}, true, cb)
+	assert.NotNil(t, result(cb))
+	cb = NewCallback()
+	h.onForceLeader([]uint64{2, 3}, true, cb)
+	require.NotNil(t, h.peer.forceLeader)
+	assert.Equal(t, []*metapb.Peer{{Id: 1, StoreId: 1}}, h.region().Peers)
+	assert.Equal(t, uint64(3), h.region().RegionEpoch.ConfVer)
+	state, err := getRegionLocalState(ps.Engines.kv.DB, ps.region.Id)
+	require.Nil(t, err)
+	assert.Len(t, state.Region.Peers, 1)
+	require.Len(t, h.ctx.applyMsgs.msgs, 1)
+	assert.Equal(t, MsgTypeApplyRegistration, h.ctx.applyMsgs.msgs[0].Type)
+	require.True(t, h.peer.RaftGroup.HasReady())
+	ready := h.peer.RaftGroup.Ready()
+	h.peer.OnRoleChanged(roleObserver{}, &ready)
+	require.Nil(t, result(cb))
+	assert.True(t, h.peer.IsLeader())
+	assert.Nil(t, h.peer.forceLeader)
+
+	// A peer without the votes of the other survivors gives up.
+	h2, ps2 := newHandler(2)
+	defer cleanUpTestData(ps2)
+	cb = NewCallback()
+	h2.onForceLeader([]uint64{1}, true, cb)
+	require.NotNil(t, h2.peer.forceLeader)
+	assert.Len(t, h2.region().Peers, 2)
+	for i := 0; i <= 2*cfg.RaftElectionTimeoutTicks; i++ {
+		h2.tickForceLeader()
+	}
+	assert.NotNil(t, result(cb))
+	assert.Nil(t, h2.peer.forceLeader)
+}
+
+func TestRollbackMerge(t *testing.T) {
+	cfg := NewDefaultConfig()
+	ps := newTestPeerStorage(t)
+	defer cleanUpTestData(ps)
+	ps.region.Peers = []*metapb.Peer{{Id: 1, StoreId: 1}}
+	target := &metapb.Region{Id: 2, RegionEpoch: &metapb.RegionEpoch{Version: 1, ConfVer: 1}}
+
+	// PrepareMerge bumps the epoch and persists the merge state.
+	applyCtx := newApplyContext("test", nil, ps.Engines, nil, cfg)
+	applyCtx.execCtx = &applyExecContext{index: 7}
+	a := &applier{tag: "test", region: ps.region}
+	_, result, err := a.execAdminCmd(applyCtx, &raft_cmdpb.RaftCmdRequest{Header: new(raft_cmdpb.RaftRequestHeader), AdminRequest: &raft_cmdpb.AdminRequest{
+		CmdType:      raft_cmdpb.AdminCmdType_PrepareMerge,
+		PrepareMerge: &raft_cmdpb.PrepareMergeRequest{MinIndex: 6, Target: target},
+	}})
+	require.Nil(t, err)
+	prepared := result.data.(*execResultPrepareMerge)
+	assert.Equal(t, uint64(7), prepared.state.Commit)
+	assert.Equal(t, ps.region.RegionEpoch.Version+1, prepared.region.RegionEpoch.Version)
+	require.Nil(t, applyCtx.wb.WriteToKV(ps.Engines.kv))
+	applyCtx.wb.Reset()
+	a.region = prepared.region
+
+	rn, err := raft.NewRawNode(&raft.Config{
+		ID:              1,
+		ElectionTick:    10,
+		HeartbeatTick:   2,
+		Storage:         ps,
+		Applied:         ps.AppliedIndex(),
+		MaxInflightMsgs: 256,
+	}, nil)
+	require.Nil(t, err)
+	require.Nil(t, rn.Campaign())
+	p := &Peer{
+		Meta:                  &metapb.Peer{Id: 1, StoreId: 1},
+		regionID:              ps.region.Id,
+		RaftGroup:             rn,
+		peerStorage:           ps,
+		peerCache:             map[uint64]*metapb.Peer{},
+		PeerHeartbeats:        map[uint64]time.Time{},
+		PeersStartPendingTime: map[uint64]time.Time{},
+		leaderLease:           NewLease(10 * time.Second),
+		proposals:             new(ProposalQueue),
+		pendingReads:          new(ReadIndexQueue),
+		LastApplyingIdx:       ps.AppliedIndex(),
+	}
+	pdTasks := make(chan task, 10)
+	ctx := &RaftContext{
+		GlobalContext: &GlobalContext{cfg: cfg, engine: ps.Engines, storeMeta: newStoreMeta(),
+			storeMetaLock: new(sync.RWMutex), router: newRouter(nil, nil), pdTaskSender: pdTasks},
+		applyMsgs: new(applyMsgs),
+	}
+	h := &peerMsgHandler{peerFsm: &peerFsm{peer: p, ticker: newTicker(ps.region.Id, cfg)}, ctx: ctx}
+	require.True(t, p.IsLeader())
+
+	// The target region is on this store and unchanged, the merge waits.
+	ctx.storeMeta.regions[2] = target
+	lastIndex := rn.Raft.RaftLog.LastIndex()
+	h.onReadyPrepareMerge(prepared.region, prepared.state, false)
+	require.NotNil(t, p.PendingMergeState)
+	assert.Equal(t, prepared.region.RegionEpoch.Version, h.region().RegionEpoch.Version)
+	assert.Nil(t, h.checkMergeTarget(target))
+	assert.Equal(t, lastIndex, rn.Raft.RaftLog.LastIndex())
+	_, err = p.ProposeNormal(cfg, raftlog.NewRequest(&raft_cmdpb.RaftCmdRequest{Header: &raft_cmdpb.RaftRequestHeader{}}))
+	assert.NotNil(t, err)
+
+	// A missing or changed target region can't be merged.
+	ctx.storeMeta.regions[2] = &metapb.Region{Id: 2, RegionEpoch: &metapb.RegionEpoch{Version: 2, ConfVer: 1}}
+	assert.NotNil(t, h.checkMergeTarget(target))
+	delete(ctx.storeMeta.regions, 2)
+	assert.NotNil(t, h.checkMergeTarget(target))
+
+	// The merge is not committed in time, the leader proposes RollbackMerge.
+	ctx.storeMeta.regions[2] = target
+	p.pendingMergeTime = time.Now().Add(-mergeTimeoutTicks*cfg.MergeCheckTickInterval - time.Second)
+	h.onCheckMerge()
+	require.Equal(t, lastIndex+1, rn.Raft.RaftLog.LastIndex())
+
+	// RollbackMerge restores the normal state with a new version.
+	applyCtx.execCtx = &applyExecContext{index: lastIndex + 1}
+	_, result, err = a.execAdminCmd(applyCtx, &raft_cmdpb.RaftCmdRequest{Header: new(raft_cmdpb.RaftRequestHeader), AdminRequest: &raft_cmdpb.AdminRequest{
+		CmdType:       raft_cmdpb.AdminCmdType_RollbackMerge,
+		RollbackMerge: &raft_cmdpb.RollbackMergeRequest{Commit: 7},
+	}})
+	require.Nil(t, err)
+	rollbacked := result.data.(*execResultRollbackMerge)
+	assert.Equal(t, prepared.region.RegionEpoch.Version+1, rollbacked.region.RegionEpoch.Version)
+	require.Nil(t, applyCtx.wb.WriteToKV(ps.Engines.kv))
+	state, err := getRegionLocalState(ps.Engines.kv.DB, ps.region.Id)
+	require.Nil(t, err)
+	assert.Equal(t, rspb.PeerState_Normal, state.State)
+	assert.Nil(t, state.MergeState)
+
+	h.onReadyRollbackMerge(rollbacked.commit, rollbacked.region)
+	assert.Nil(t, p.PendingMergeState)
+	assert.Equal(t, rollbacked.region.RegionEpoch.Version, h.region().RegionEpoch.Version)
+	require.Len(t, pdTasks, 1)
+	assert.Equal(t, taskTypePDHeartbeat, (<-pdTasks).tp)
+	_, err = p.ProposeNormal(cfg, raftlog.NewRequest(&raft_cmdpb.RaftCmdRequest{Header: &raft_cmdpb.RaftRequestHeader{}}))
+	assert.Nil(t, err)
+}
+
+func TestDroppedProposals(t *testing.T) {
+	cfg := NewDefaultConfig()
+	ps := newTestPeerStorage(t)
+	defer cleanUpTestData(ps)
+	ps.region.Peers = []*metapb.Peer{{Id: 1, StoreId: 1}, {Id: 2, StoreId: 2}, {Id: 3, StoreId: 3}}
+	rn, err := raft.NewRawNode(&raft.Config{
+		ID:              1,
+		ElectionTick:    10,
+		HeartbeatTick:   2,
+		Storage:         ps,
+		Applied:         ps.AppliedIndex(),
+		MaxInflightMsgs: 256,
+	}, nil)
+	require.Nil(t, err)
+	counter := new(dropCounter)
+	p := &Peer{
+		Meta:             &metapb.Peer{Id: 1, StoreId: 1},
+		regionID:         ps.region.Id,
+		RaftGroup:        rn,
+		peerStorage:      ps,
+		peerCache:        map[uint64]*metapb.Peer{},
+		leaderLease:      NewLease(10 * time.Second),
+		proposals:        new(ProposalQueue),
+		pendingReads:     new(ReadIndexQueue),
+		droppedProposals: counter,
+	}
+
+	// The follower without a leader drops the proposals.
+	normal := raftlog.NewRequest(&raft_cmdpb.RaftCmdRequest{Header: new(raft_cmdpb.RaftRequestHeader)})
+	_, err = p.ProposeNormal(cfg, normal)
+	assert.Equal(t, raft.ErrProposalDropped, err)
+	cfg.FailFastDroppedProposals = true
+	_, err = p.ProposeNormal(cfg, normal)
+	dropErr, ok := err.(*ErrProposalDropped)
+	require.True(t, ok)
+	assert.Equal(t, DropReasonNoLeader, dropErr.Reason)
+	assert.NotNil(t, ErrToPbError(err).NotLeader)
+
+	// The read is responded with the reason instead of StaleCommand.
+	readReq := &raft_cmdpb.RaftCmdRequest{
+		Header:   new(raft_cmdpb.RaftRequestHeader),
+		Requests: []*raft_cmdpb.Request{{CmdType: raft_cmdpb.CmdType_Snap, Snap: new(raft_cmdpb.SnapRequest)}},
+	}
+	cb := NewCallback()
+	assert.False(t, p.readIndex(cfg, readReq, nil, cb))
+	cb.wg.Wait()
+	assert.NotNil(t, cb.resp.Header.Error.NotLeader)
+	assert.Nil(t, cb.resp.Header.Error.StaleCommand)
+	cfg.FailFastDroppedProposals = false
+	cb = NewCallback()
+	assert.False(t, p.readIndex(cfg, readReq, nil, cb))
+	cb.wg.Wait()
+	assert.NotNil(t, cb.resp.Header.Error.StaleCommand)
+
+	// The conf change is rejected while the last one is not applied.
+	rn.Raft.PendingConfIndex = ps.AppliedIndex() + 1
+	_, err = p.ProposeConfChange(cfg, &raft_cmdpb.RaftCmdRequest{})
+	assert.NotNil(t, err)
+
+	dropped := counter.load()
+	assert.Equal(t, uint64(2), dropped.Proposals[DropReasonNoLeader.String()])
+	assert.Equal(t, uint64(1), dropped.Proposals[DropReasonConfChangePending.String()])
+	assert.Equal(t, uint64(2), dropped.Reads[DropReasonNoLeader.String()])
+	assert.Equal(t, uint64(0), dropped.Reads[DropReasonTransferLeader.String()])
+}
+
+func TestInvariants(t *testing.T) {
+	ps := newTestPeerStorage(t)
+	defer cleanUpTestData(ps)
+	rn, err := raft.NewRawNode(&raft.Config{
+		ID:              1,
+		ElectionTick:    10,
+		HeartbeatTick:   2,
+		Storage:         ps,
+		Applied:         ps.AppliedIndex(),
+		MaxInflightMsgs: 256,
+	}, nil)
+	require.Nil(t, err)
+	checker := new(invariantChecker)
+	p := &Peer{
+		Meta:        &metapb.Peer{Id: 1, StoreId: 1},
+		regionID:    ps.region.Id,
+		RaftGroup:   rn,
+		peerStorage: ps,
+		leaderLease: NewLease(10 * time.Second),
+		invariants:  checker,
+	}
+	p.checkInvariants(InvariantModePanic)
+	stats := checker.stats()
+	assert.Equal(t, uint64(len(peerInvariants)), stats.Checks)
+	assert.Equal(t, map[string]uint64{
+		"applied-le-committed":   0,
+		"truncated-le-applied":   0,
+		"follower-lease-invalid": 0,
+		"region-ranges-disjoint": 0,
+		"consistent-hash":        0,
+	}, stats.Violations)
+
+	// A valid lease on a follower is counted in the metric mode.
+	p.leaderLease.Renew(p.leaderLease.Now())
+	p.checkInvariants(InvariantModeMetric)
+	assert.Equal(t, uint64(1), checker.stats().Violations["follower-lease-invalid"])
+
+	// The listeners are notified in the event mode.
+	var violations []InvariantViolation
+	checker.addListener(func(v InvariantViolation) {
+		violations = append(violations, v)
+	})
+	p.checkInvariants(InvariantModeEvent)
+	require.Len(t, violations, 1)
+	assert.Equal(t, "follower-lease-invalid", violations[0].Invariant)
+	assert.Equal(t, ps.region.Id, violations[0].RegionID)
+	assert.Equal(t, uint64(2), checker.stats().Violations["follower-lease-invalid"])
+
+	// The panic mode stops at the violation.
+	p.leaderLease.Expire()
+	p.checkInvariants(InvariantModePanic)
+	ps.applyState.truncatedIndex = ps.applyState.appliedIndex + 1
+	assert.Panics(t, func() { p.checkInvariants(InvariantModePanic) })
+
+	meta := newStoreMeta()
+	peers := []*metapb.Peer{{Id: 1, StoreId: 1}}
+	meta.regions[1] = &metapb.Region{Id: 1, EndKey: []byte("b"), Peers: peers}
+	meta.regions[2] = &metapb.Region{Id: 2, StartKey: []byte("b"), EndKey: []byte("d"), Peers: peers}
+	// An uninitialized region has no range.
+	meta.regions[3] = &metapb.Region{Id: 3}
+	assert.Equal(t, "", checkRegionRangesDisjoint(meta))
+	meta.regions[4] = &metapb.Region{Id: 4, StartKey: []byte("c"), Peers: peers}
+	assert.Equal(t, "region 2 [62, 64) overlaps with region 4 [63, )", checkRegionRangesDisjoint(meta))
+}
+
+func TestConsistencyCheckHash(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	region := &metapb.Region{Id: 1, Peers: []*metapb.Peer{{Id: 1, StoreId: 1}}}
+	engines.kv.LockStore.Put([]byte("ta"), []byte("lock a"))
+	wb := new(WriteBatch)
+	wb.Set(y.KeyWithTs([]byte("tb"), 10), []byte("value b"))
+	require.Nil(t, wb.WriteToKV(engines.kv))
+
+	// The snapshot isn't changed by the later writes.
+	snap := newRegionDataSnapshot(engines.kv, region)
+	engines.kv.LockStore.Put([]byte("tc"), []byte("lock c"))
+	hash := computeRegionHash(region, snap)
+	snap.Txn.Discard()
+	engines.kv.LockStore.Delete([]byte("tc"))
+	snap = newRegionDataSnapshot(engines.kv, region)
+	assert.Equal(t, hash, computeRegionHash(region, snap))
+	snap.Txn.Discard()
+	wb = new(WriteBatch)
+	wb.Set(y.KeyWithTs([]byte("tb"), 11), []byte("value b"))
+	require.Nil(t, wb.WriteToKV(engines.kv))
+	snap = newRegionDataSnapshot(engines.kv, region)
+	assert.NotEqual(t, hash, computeRegionHash(region, snap))
+	snap.Txn.Discard()
+
+	cfg := NewDefaultConfig()
+	cfg.InvariantViolationMode = InvariantModeEvent
+	checker := new(invariantChecker)
+	var violations []InvariantViolation
+	checker.addListener(func(v InvariantViolation) {
+		violations = append(violations, v)
+	})
+	p := &Peer{
+		Meta:             &metapb.Peer{Id: 1, StoreId: 1},
+		regionID:         region.Id,
+		ConsistencyState: &ConsistencyState{},
+		invariants:       checker,
+	}
+	d := &peerMsgHandler{peerFsm: &peerFsm{peer: p}, ctx: &RaftContext{GlobalContext: &GlobalContext{cfg: cfg}}}
+	assert.True(t, d.verifyAndStoreHash(5, hash))
+	assert.False(t, d.verifyAndStoreHash(5, hash))
+	assert.Equal(t, uint64(1), checker.stats().Checks)
+	assert.Len(t, violations, 0)
+
+	assert.True(t, d.verifyAndStoreHash(6, hash))
+	assert.False(t, d.verifyAndStoreHash(6, []byte{1, 2, 3, 4}))
+	require.Len(t, violations, 1)
+	assert.Equal(t, invariantConsistentHash, violations[0].Invariant)
+	assert.Equal(t, region.Id, violations[0].RegionID)
+
+	// The mismatch panics by default.
+	cfg.InvariantViolationMode = ""
+	assert.True(t, d.verifyAndStoreHash(7, hash))
+	assert.Panics(t, func() { d.verifyAndStoreHash(7, []byte{1, 2, 3, 4}) })
+}
+
+func TestRejectPrepareMerge(t *testing.T) {
+	d := &peerMsgHandler{}
+	err := d.checkMergeProposal(&raft_cmdpb.RaftCmdRequest{AdminRequest: &raft_cmdpb.AdminRequest{
+		CmdType: raft_cmdpb.AdminCmdType_PrepareMerge,
+	}})
+	assert.NotNil(t, err)
+	err = d.checkMergeProposal(&raft_cmdpb.RaftCmdRequest{AdminRequest: &raft_cmdpb.AdminRequest{
+		CmdType: raft_cmdpb.AdminCmdType_RollbackMerge,
+	}})
+	assert.Nil(t, err)
+}
@@ -24,9 +24,14 @@ import (
 // peerState contains the peer states that needs to run raft command and apply command.
 // It binds to a worker to make sure the commands are always executed on a same goroutine.
 type peerState struct {
-	closed uint32
-	peer   *peerFsm
-	apply  *applier
+	// pendingCmds is the number of raft commands sent to the peer but not handled yet.
+	pendingCmds int64
+	closed      uint32
+	peer        *peerFsm
+	apply       *applier
+	// mailbox and applyBacklog track the messages queued for the peer and its applier.
+	mailbox      msgBacklog
+	applyBacklog msgBacklog
 }
 
 type applyBatch struct {
@@ -59,6 +64,9 @@ type raftWorker struct {
 
 	msgCnt            uint64
 	movePeerCandidate uint64
+
+	// paused holds the messages of the paused peers.
+	paused map[uint64][]Msg
 }
 
 func newRaftWorker(ctx *GlobalContext, ch chan Msg, pm *router) *raftWorker {
@@ -70,14 +78,21 @@ func newRaftWorker(ctx *GlobalContext, ch chan Msg, pm *router) *raftWorker {
 		raftWB:        new(WriteBatch),
 		localStats:    new(storeStats),
 	}
+	if ctx.cfg.AsyncRaftLogWriters > 0 {
+		raftCtx.logWriter = newRaftLogWriter(ctx.engine, ctx.cfg.AsyncRaftLogWriters)
+	}
 	applyResCh := make(chan Msg, cap(ch))
+	applyCtx := newApplyContext("", ctx.regionTaskSender, ctx.engine, applyResCh, ctx.cfg)
+	applyCtx.adminObservers = pm.adminObservers
+	applyCtx.auditLog = ctx.auditLog
 	return &raftWorker{
 		raftCh:     ch,
 		applyResCh: applyResCh,
 		raftCtx:    raftCtx,
 		pr:         pm,
 		applyCh:    make(chan *applyBatch, 1),
-		applyCtx:   newApplyContext("", ctx.regionTaskSender, ctx.engine, applyResCh, ctx.cfg),
+		applyCtx:   applyCtx,
+		paused:     make(map[uint64][]Msg),
 	}
 }
 
@@ -87,6 +102,10 @@ func newRaftWorker(ctx *GlobalContext, ch chan Msg, pm *router) *raftWorker {
 func (rw *raftWorker) run(closeCh <-chan struct{}, wg *sync.WaitGroup) {
 	defer wg.Done()
 	timeTicker := time.NewTicker(rw.raftCtx.cfg.RaftBaseTickInterval)
+	var persistedCh <-chan struct{}
+	if rw.raftCtx.logWriter != nil {
+		persistedCh = rw.raftCtx.logWriter.notify
+	}
 	var msgs []Msg
 	for {
 		for i := range msgs {
@@ -95,9 +114,14 @@ func (rw *raftWorker) run(closeCh <-chan struct{}, wg *sync.WaitGroup) {
 		msgs = msgs[:0]
 		select {
 		case <-closeCh:
+			if rw.raftCtx.logWriter != nil {
+				rw.raftCtx.logWriter.stop()
+			}
 			rw.applyCh <- nil
 			return
+		case <-persistedCh:
 		case msg := <-rw.raftCh:
+			rw.received(msg)
 			msgs = append(msgs, msg)
 		case msg := <-rw.applyResCh:
 			msgs = append(msgs, msg)
@@ -109,12 +133,15 @@ func (rw *raftWorker) run(closeCh <-chan struct{}, wg *sync.WaitGroup) {
 		}
 		pending := len(rw.raftCh)
 		for i := 0; i < pending; i++ {
-			msgs = append(msgs, <-rw.raftCh)
+			msg := <-rw.raftCh
+			rw.received(msg)
+			msgs = append(msgs, msg)
 		}
 		resLen := len(rw.applyResCh)
 		for i := 0; i < resLen; i++ {
 			msgs = append(msgs, <-rw.applyResCh)
 		}
+		msgs = rw.filterPaused(msgs)
 		metrics.RaftBatchSize.Observe(float64(len(msgs)))
 		atomic.AddUint64(&rw.msgCnt, uint64(len(msgs)))
 		peerStateMap := make(map[uint64]*peerState)
@@ -128,6 +155,7 @@ func (rw *raftWorker) run(closeCh <-chan struct{}, wg *sync.WaitGroup) {
 			peerState := rw.getPeerState(peerStateMap, msg.RegionID)
 			newRaftMsgHandler(peerState.peer, rw.raftCtx).HandleMsgs(msg)
 		}
+		rw.handlePersisted(peerStateMap)
 		var movePeer uint64
 		for id, peerState := range peerStateMap {
 			movePeer = id
@@ -151,10 +179,26 @@ func (rw *raftWorker) run(closeCh <-chan struct{}, wg *sync.WaitGroup) {
 		}
 		applyMsgs.msgs = applyMsgs.msgs[:0]
 		rw.removeQueuedSnapshots()
+		for _, msg := range batch.msgs {
+			ps, ok := peerStateMap[msg.RegionID]
+			if !ok {
+				ps = rw.pr.get(msg.RegionID)
+			}
+			if ps != nil {
+				ps.applyBacklog.push(msg.Type)
+			}
+		}
 		rw.applyCh <- batch
 	}
 }
 
+// received untracks a message received from the peer channel.
+func (rw *raftWorker) received(msg Msg) {
+	if ps := rw.pr.get(msg.RegionID); ps != nil {
+		ps.mailbox.pop()
+	}
+}
+
 func (rw *raftWorker) getPeerState(peersMap map[uint64]*peerState, regionID uint64) *peerState {
 	peer, ok := peersMap[regionID]
 	if !ok {
@@ -169,6 +213,21 @@ func (rw *raftWorker) handleRaftReady(peers map[uint64]*peerState, batch *applyB
 		msg := Msg{Type: MsgTypeApplyProposal, Data: proposal}
 		rw.raftCtx.applyMsgs.appendMsg(proposal.RegionID, msg)
 	}
+	if rw.raftCtx.logWriter != nil && (len(rw.raftCtx.kvWB.entries) > 0 || len(rw.raftCtx.raftWB.entries) > 0) {
+		rw.submitReady(peers)
+	} else {
+		rw.persistReady(peers)
+	}
+	dur := time.Since(rw.raftStartTime)
+	electionTimeout := rw.raftCtx.cfg.RaftBaseTickInterval * time.Duration(rw.raftCtx.cfg.RaftElectionTimeoutTicks)
+	if dur > electionTimeout {
+		// The busy flag is reported by the next store heartbeat.
+		rw.raftCtx.localStats.isBusy = 1
+	}
+}
+
+// persistReady writes the ready states and finishes the readies.
+func (rw *raftWorker) persistReady(peers map[uint64]*peerState) {
 	kvWB := rw.raftCtx.kvWB
 	if len(kvWB.entries) > 0 {
 		err := kvWB.WriteToKV(rw.raftCtx.engine.kv)
@@ -193,11 +252,50 @@ func (rw *raftWorker) handleRaftReady(peers map[uint64]*peerState, batch *applyB
 			newRaftMsgHandler(peers[regionID].peer, rw.raftCtx).PostRaftReadyPersistent(&pair.Ready, pair.IC)
 		}
 	}
-	dur := time.Since(rw.raftStartTime)
-	if !rw.raftCtx.isBusy {
-		electionTimeout := rw.raftCtx.cfg.RaftBaseTickInterval * time.Duration(rw.raftCtx.cfg.RaftElectionTimeoutTicks)
-		if dur > electionTimeout {
-			rw.raftCtx.isBusy = true
+}
+
+// submitReady sends the ready states to the async raft log writer, the peers don't handle another ready
+// until theirs are persisted.
+func (rw *raftWorker) submitReady(peers map[uint64]*peerState) {
+	ctx := rw.raftCtx
+	t := &raftLogWriteTask{
+		kvWB:     ctx.kvWB,
+		raftWB:   ctx.raftWB,
+		readyRes: ctx.ReadyRes,
+		peers:    make([]*peerFsm, 0, len(ctx.ReadyRes)),
+	}
+	for _, pair := range t.readyRes {
+		fsm := peers[pair.IC.RegionID].peer
+		fsm.peer.persisting = true
+		t.peers = append(t.peers, fsm)
+	}
+	ctx.kvWB, ctx.raftWB, ctx.ReadyRes = new(WriteBatch), new(WriteBatch), nil
+	ctx.logWriter.submit(t)
+}
+
+// handlePersisted finishes the readies persisted by the async raft log writer, the messages of the
+// followers are sent and the committed entries are applied.
+func (rw *raftWorker) handlePersisted(peers map[uint64]*peerState) {
+	if rw.raftCtx.logWriter == nil {
+		return
+	}
+	for _, t := range rw.raftCtx.logWriter.takePersisted() {
+		for i, pair := range t.readyRes {
+			regionID := pair.IC.RegionID
+			ps, ok := peers[regionID]
+			if !ok {
+				if ps = rw.pr.get(regionID); ps == nil {
+					// The peer is destroyed.
+					continue
+				}
+			}
+			if ps.peer != t.peers[i] {
+				continue
+			}
+			peers[regionID] = ps
+			ps.peer.peer.persisting = false
+			ps.peer.hasReady = true
+			newRaftMsgHandler(ps.peer, rw.raftCtx).PostRaftReadyPersistent(&pair.Ready, pair.IC)
 		}
 	}
 }
@@ -254,6 +352,7 @@ func (aw *applyWorker) run(wg *sync.WaitGroup) {
 				batch.peers[msg.RegionID] = ps
 			}
 			ps.apply.handleTask(aw.ctx, msg)
+			ps.applyBacklog.pop()
 		}
 		aw.ctx.flush()
 	}
@@ -0,0 +1,94 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/pdpb"
+	"github.com/pingcap/tidb/store/mockstore/unistore/pd"
+)
+
+// placementChecker emulates the label based placement rules of PD: the replicas of a region must be
+// in different locations down to the isolation level, like one replica per zone.
+type placementChecker struct {
+	pdClient pd.Client
+	// labels are the location labels from the top level to the isolation level.
+	labels []string
+}
+
+func newPlacementChecker(cfg *Config, pdClient pd.Client) *placementChecker {
+	for i, label := range cfg.LocationLabels {
+		if label == cfg.IsolationLevel {
+			return &placementChecker{pdClient: pdClient, labels: cfg.LocationLabels[:i+1]}
+		}
+	}
+	return nil
+}
+
+func (c *placementChecker) location(store *metapb.Store) string {
+	values := make([]string, len(c.labels))
+	for i, key := range c.labels {
+		for _, l := range store.GetLabels() {
+			if l.Key == key {
+				values[i] = l.Value
+				break
+			}
+		}
+	}
+	return strings.Join(values, "/")
+}
+
+// checkAddPeer returns ErrPlacementViolation if the new peer shares the location with another replica.
+func (c *placementChecker) checkAddPeer(region *metapb.Region, peer *metapb.Peer) error {
+	if c == nil {
+		return nil
+	}
+	ctx := context.Background()
+	store, err := c.pdClient.GetStore(ctx, peer.GetStoreId())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	location := c.location(store)
+	for _, p := range region.GetPeers() {
+		if p.GetStoreId() == peer.GetStoreId() {
+			continue
+		}
+		other, err := c.pdClient.GetStore(ctx, p.GetStoreId())
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if c.location(other) == location {
+			return &ErrPlacementViolation{RegionID: region.GetId(), StoreID: other.GetId(), Location: location}
+		}
+	}
+	return nil
+}
+
+func (r *pdTaskHandler) checkPlacement(regionID uint64, changePeer *pdpb.ChangePeer) error {
+	if r.placement == nil || changePeer.ChangeType == eraftpb.ConfChangeType_RemoveNode {
+		return nil
+	}
+	p := r.router.get(regionID)
+	if p == nil {
+		return errPeerNotFound
+	}
+	region := (*metapb.Region)(atomic.LoadPointer(&p.peer.peer.leaderChecker.region))
+	return r.placement.checkAddPeer(region, changePeer.Peer)
+}
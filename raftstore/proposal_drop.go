@@ -0,0 +1,136 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// ProposalDropReason is the reason a proposal or a read is dropped by the raft group.
+type ProposalDropReason int
+
+const (
+	// DropReasonTransferLeader means the leader is transferring the leadership.
+	DropReasonTransferLeader ProposalDropReason = iota
+	// DropReasonNoLeader means the peer is not the leader, or it is removed from the region.
+	DropReasonNoLeader
+	// DropReasonConfChangePending means the last conf change is not applied yet.
+	DropReasonConfChangePending
+	// DropReasonEntryTooLarge means the entry exceeds Config.RaftEntryMaxSize.
+	DropReasonEntryTooLarge
+	// DropReasonNotCommitted means the leader has not committed an entry in its term, so it can't serve reads.
+	DropReasonNotCommitted
+
+	dropReasonCount
+)
+
+var dropReasonNames = [dropReasonCount]string{
+	"transfer_leader",
+	"no_leader",
+	"conf_change_pending",
+	"entry_too_large",
+	"not_committed",
+}
+
+func (r ProposalDropReason) String() string {
+	if r < 0 || r >= dropReasonCount {
+		return "unknown"
+	}
+	return dropReasonNames[r]
+}
+
+// DroppedProposals is the number of the proposals and the reads dropped on the store by reason.
+type DroppedProposals struct {
+	Proposals map[string]uint64 `json:"proposals"`
+	Reads     map[string]uint64 `json:"reads"`
+}
+
+// dropCounter is shared by the peers of the store, it's updated by the raft workers and can be loaded
+// concurrently.
+type dropCounter struct {
+	proposals [dropReasonCount]uint64
+	reads     [dropReasonCount]uint64
+}
+
+func (c *dropCounter) observe(read bool, reason ProposalDropReason) {
+	if c == nil {
+		return
+	}
+	if read {
+		atomic.AddUint64(&c.reads[reason], 1)
+	} else {
+		atomic.AddUint64(&c.proposals[reason], 1)
+	}
+}
+
+func (c *dropCounter) load() DroppedProposals {
+	dropped := DroppedProposals{
+		Proposals: make(map[string]uint64, dropReasonCount),
+		Reads:     make(map[string]uint64, dropReasonCount),
+	}
+	for r := ProposalDropReason(0); r < dropReasonCount; r++ {
+		dropped.Proposals[r.String()] = atomic.LoadUint64(&c.proposals[r])
+		dropped.Reads[r.String()] = atomic.LoadUint64(&c.reads[r])
+	}
+	return dropped
+}
+
+// dropReason returns why the raft group dropped the proposal or the read just now, transferee is the peer
+// the leadership is transferred to.
+func (p *Peer) dropReason(read bool) (reason ProposalDropReason, transferee uint64) {
+	if !p.IsLeader() {
+		return DropReasonNoLeader, InvalidID
+	}
+	if transferee = p.RaftGroup.StatusWithoutProgress().LeadTransferee; transferee != InvalidID {
+		return DropReasonTransferLeader, transferee
+	}
+	if read {
+		return DropReasonNotCommitted, InvalidID
+	}
+	return DropReasonNoLeader, InvalidID
+}
+
+// onDropped counts the proposal or the read dropped for the reason, it returns err unless
+// Config.FailFastDroppedProposals is set, then an ErrProposalDropped telling the reason is returned.
+func (p *Peer) onDropped(cfg *Config, read bool, reason ProposalDropReason, transferee uint64, err error) error {
+	p.droppedProposals.observe(read, reason)
+	if !cfg.FailFastDroppedProposals {
+		return err
+	}
+	dropErr := &ErrProposalDropped{RegionID: p.regionID, Reason: reason, Read: read}
+	if transferee != InvalidID {
+		dropErr.Leader = p.getPeerFromCache(transferee)
+	}
+	return dropErr
+}
+
+// DroppedProposals returns the number of the proposals and the reads dropped on the store by reason.
+func (r *Router) DroppedProposals() DroppedProposals {
+	return r.router.droppedProposals.load()
+}
+
+// DroppedProposalsHandler serves the dropped proposals of the store as JSON for the status server.
+func (r *Router) DroppedProposalsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(r.DroppedProposals()); err != nil {
+			log.Warn("failed to encode dropped proposals", zap.Error(err))
+		}
+	})
+}
@@ -18,43 +18,40 @@ import (
 	"sync"
 	"time"
 
-	"github.com/pingcap/errors"
-	"github.com/pingcap/kvproto/pkg/metapb"
 	"github.com/pingcap/kvproto/pkg/raft_serverpb"
 	"github.com/pingcap/kvproto/pkg/tikvpb"
 	"github.com/pingcap/log"
-	"github.com/pingcap/tidb/store/mockstore/unistore/pd"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/keepalive"
 )
 
 type raftConn struct {
-	msgCh           chan *raft_serverpb.RaftMessage
-	ctx             context.Context
-	cancel          context.CancelFunc
-	nextRetryTime   time.Time
-	lastResolveTime time.Time
-	addr            string
-	storeID         uint64
-	cfg             *Config
-
-	pdCli        pd.Client
+	msgCh         chan *raft_serverpb.RaftMessage
+	ctx           context.Context
+	cancel        context.CancelFunc
+	nextRetryTime time.Time
+	addr          string
+	storeID       uint64
+	cfg           *Config
+
+	resolver     StoreResolver
 	batch        *tikvpb.BatchRaftMessage
+	cc           *grpc.ClientConn
 	stream       tikvpb.Tikv_BatchRaftClient
 	streamCancel context.CancelFunc
 }
 
-func newRaftConn(storeID uint64, cfg *Config, pdCli pd.Client) *raftConn {
+func newRaftConn(storeID uint64, cfg *Config, resolver StoreResolver) *raftConn {
 	ctx, cancel := context.WithCancel(context.Background())
 	rc := &raftConn{
-		msgCh:   make(chan *raft_serverpb.RaftMessage, 256),
-		ctx:     ctx,
-		cancel:  cancel,
-		storeID: storeID,
-		cfg:     cfg,
-		pdCli:   pdCli,
-		batch:   new(tikvpb.BatchRaftMessage),
+		msgCh:    make(chan *raft_serverpb.RaftMessage, 256),
+		ctx:      ctx,
+		cancel:   cancel,
+		storeID:  storeID,
+		cfg:      cfg,
+		resolver: resolver,
+		batch:    new(tikvpb.BatchRaftMessage),
 	}
 	go rc.runSender()
 	return rc
@@ -69,6 +66,7 @@ func (c *raftConn) runSender() {
 			c.senderHandleMsg(msg)
 		case <-c.ctx.Done():
 			log.Info("raftConn done")
+			c.closeStream()
 			return
 		}
 	}
@@ -90,17 +88,32 @@ func (c *raftConn) senderHandleMsg(msg *raft_serverpb.RaftMessage) {
 		}
 		err = c.newStream()
 		if err != nil {
+			// The store may have been moved to another address.
+			c.resolver.Invalidate(c.storeID)
 			c.nextRetryTime = time.Now().Add(time.Second)
-			log.Warn("failed to create raft stream", zap.Error(err))
+			log.Warn("failed to create raft stream", zap.Uint64("store id", c.storeID), zap.Error(err))
 			return
 		}
-		log.Info("new raft stream")
+		log.Info("new raft stream", zap.Uint64("store id", c.storeID), zap.String("addr", c.addr))
 	}
 	err = c.stream.Send(batch)
 	if err != nil {
+		c.closeStream()
+		c.resolver.Invalidate(c.storeID)
+		log.Warn("failed to send batch raft message", zap.Uint64("store id", c.storeID), zap.Error(err))
+	}
+}
+
+func (c *raftConn) closeStream() {
+	if c.stream != nil {
 		c.streamCancel()
 		c.stream = nil
-		log.Warn("failed to send batch raft message", zap.Error(err))
+	}
+	if c.cc != nil {
+		if err := c.cc.Close(); err != nil {
+			log.Warn("failed to close raft connection", zap.Uint64("store id", c.storeID), zap.Error(err))
+		}
+		c.cc = nil
 	}
 }
 
@@ -111,26 +124,12 @@ func (c *raftConn) resetBatchRaftMsg() {
 	c.batch.Msgs = c.batch.Msgs[:0]
 }
 
-const resolveRefreshInterval = time.Second * 60
-
-func (c *raftConn) resolveAddr() (string, error) {
-	if c.addr != "" && time.Since(c.lastResolveTime) < resolveRefreshInterval {
-		return c.addr, nil
-	}
-	addr, err := getStoreAddr(c.storeID, c.pdCli)
-	if err != nil {
-		return "", err
-	}
-	c.addr = addr
-	c.lastResolveTime = time.Now()
-	return c.addr, nil
-}
-
 func (c *raftConn) newStream() error {
-	addr, err := c.resolveAddr()
+	addr, err := c.resolver.Resolve(c.storeID)
 	if err != nil {
 		return err
 	}
+	c.addr = addr
 	cc, err := grpc.Dial(addr, grpc.WithInsecure(),
 		grpc.WithInitialWindowSize(int32(c.cfg.GrpcInitialWindowSize)),
 		grpc.WithKeepaliveParams(keepalive.ClientParameters{
@@ -145,8 +144,10 @@ func (c *raftConn) newStream() error {
 	c.stream, err = tikvpb.NewTikvClient(cc).BatchRaft(ctx)
 	if err != nil {
 		cancelFunc()
+		cc.Close()
 		return err
 	}
+	c.cc = cc
 	c.streamCancel = cancelFunc
 	return err
 }
@@ -173,15 +174,15 @@ type connKey struct {
 type RaftClient struct {
 	config *Config
 	sync.RWMutex
-	conns map[connKey]*raftConn
-	pdCli pd.Client
+	conns    map[connKey]*raftConn
+	resolver StoreResolver
 }
 
-func newRaftClient(config *Config, pdCli pd.Client) *RaftClient {
+func newRaftClient(config *Config, resolver StoreResolver) *RaftClient {
 	return &RaftClient{
-		config: config,
-		conns:  make(map[connKey]*raftConn),
-		pdCli:  pdCli,
+		config:   config,
+		conns:    make(map[connKey]*raftConn),
+		resolver: resolver,
 	}
 }
 
@@ -193,7 +194,7 @@ func (c *RaftClient) getConn(storeID, regionID uint64) *raftConn {
 	if ok {
 		return conn
 	}
-	conn = newRaftConn(storeID, c.config, c.pdCli)
+	conn = newRaftConn(storeID, c.config, c.resolver)
 	c.conns[key] = conn
 	return conn
 }
@@ -221,18 +222,3 @@ func (c *RaftClient) Stop() {
 		conn.Stop()
 	}
 }
-
-func getStoreAddr(id uint64, pdCli pd.Client) (string, error) {
-	store, err := pdCli.GetStore(context.TODO(), id)
-	if err != nil {
-		return "", err
-	}
-	if store.GetState() == metapb.StoreState_Tombstone {
-		return "", errors.Errorf("store %d has been removed", id)
-	}
-	addr := store.GetAddress()
-	if addr == "" {
-		return "", errors.Errorf("invalid empty address for store %d", id)
-	}
-	return addr, nil
-}
@@ -0,0 +1,109 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"sync"
+)
+
+// raftLogWriteTask is the raft ready states of a raft worker loop to persist.
+type raftLogWriteTask struct {
+	kvWB     *WriteBatch
+	raftWB   *WriteBatch
+	readyRes []*ReadyICPair
+	// peers are the peers of the readyRes, a peer recreated for the region doesn't take the stale ready.
+	peers []*peerFsm
+}
+
+// raftLogWriter persists the raft ready states in a pool of goroutines, so the raft worker handles the other
+// regions while the writes are in flight, see Config.AsyncRaftLogWriters. A peer has at most one ready in
+// flight, the messages of a follower are sent and the committed entries are applied after its ready is
+// persisted.
+type raftLogWriter struct {
+	engines  *Engines
+	taskCh   chan *raftLogWriteTask
+	inflight sync.WaitGroup
+	wg       sync.WaitGroup
+
+	mu        sync.Mutex
+	persisted []*raftLogWriteTask
+	// notify is signaled when a task is persisted, the persisted tasks are taken by takePersisted.
+	notify chan struct{}
+}
+
+func newRaftLogWriter(engines *Engines, workers int) *raftLogWriter {
+	w := &raftLogWriter{
+		engines: engines,
+		taskCh:  make(chan *raftLogWriteTask, workers),
+		notify:  make(chan struct{}, 1),
+	}
+	w.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go w.run()
+	}
+	return w
+}
+
+func (w *raftLogWriter) run() {
+	defer w.wg.Done()
+	for t := range w.taskCh {
+		// The kv states are written first in case of restart happens between the two writes.
+		if len(t.kvWB.entries) > 0 {
+			if err := t.kvWB.WriteToKV(w.engines.kv); err != nil {
+				panic(err)
+			}
+		}
+		if len(t.raftWB.entries) > 0 {
+			if err := t.raftWB.WriteToRaft(w.engines.raft); err != nil {
+				panic(err)
+			}
+		}
+		w.mu.Lock()
+		w.persisted = append(w.persisted, t)
+		w.mu.Unlock()
+		w.inflight.Done()
+		select {
+		case w.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// submit sends the task to the pool, the peers of the task must not handle another ready before the task
+// is persisted.
+func (w *raftLogWriter) submit(t *raftLogWriteTask) {
+	w.inflight.Add(1)
+	w.taskCh <- t
+}
+
+// takePersisted returns the tasks persisted since the last call in the order they are persisted.
+func (w *raftLogWriter) takePersisted() []*raftLogWriteTask {
+	w.mu.Lock()
+	tasks := w.persisted
+	w.persisted = nil
+	w.mu.Unlock()
+	return tasks
+}
+
+// wait waits until the submitted tasks are persisted, it's called before the raft state of a peer is
+// written out of the writer.
+func (w *raftLogWriter) wait() {
+	w.inflight.Wait()
+}
+
+// stop waits until the submitted tasks are persisted and stops the pool.
+func (w *raftLogWriter) stop() {
+	close(w.taskCh)
+	w.wg.Wait()
+}
@@ -36,6 +36,23 @@ const (
 	TypePessimisticRollback CustomRaftLogType = 5
 )
 
+// String returns the name of the CustomRaftLogType.
+func (t CustomRaftLogType) String() string {
+	switch t {
+	case TypePrewrite:
+		return "Prewrite"
+	case TypeCommit:
+		return "Commit"
+	case TypeRolback:
+		return "Rollback"
+	case TypePessimisticLock:
+		return "PessimisticLock"
+	case TypePessimisticRollback:
+		return "PessimisticRollback"
+	}
+	return fmt.Sprintf("Unknown(%d)", byte(t))
+}
+
 // CustomRaftLog is the raft log format for unistore to store Prewrite/Commit/PessimisticLock.
 //  | flag(1) | type(1) | version(2) | header(40) | entries
 //
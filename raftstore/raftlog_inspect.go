@@ -0,0 +1,148 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/ngaut/unistore/raftstore/raftlog"
+	"github.com/pingcap/badger"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/dbreader"
+)
+
+// ScanRaftLog iterates the raft log entries of the region in [low, high) in the raft engine,
+// high 0 means no upper bound. The iteration stops when fn returns false.
+func ScanRaftLog(raftDB *badger.DB, regionID, low, high uint64, fn func(entry *eraftpb.Entry) bool) error {
+	if high == 0 {
+		high = math.MaxUint64
+	}
+	startKey := RaftLogKey(regionID, low)
+	endKey := RaftLogKey(regionID, high)
+	txn := raftDB.NewTransaction(false)
+	defer txn.Discard()
+	iter := dbreader.NewIterator(txn, false, startKey, endKey)
+	defer iter.Close()
+	for iter.Seek(startKey); iter.Valid(); iter.Next() {
+		item := iter.Item()
+		if bytes.Compare(item.Key(), endKey) >= 0 {
+			break
+		}
+		val, err := item.Value()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		entry := new(eraftpb.Entry)
+		if err = entry.Unmarshal(val); err != nil {
+			return errors.Annotatef(err, "decode raft log key %x", item.Key())
+		}
+		if !fn(entry) {
+			break
+		}
+	}
+	return nil
+}
+
+// DecodeEntry decodes the data of a normal entry into a RaftLog, it returns nil for the empty entry
+// proposed by a new leader.
+func DecodeEntry(entry *eraftpb.Entry) (raftlog.RaftLog, error) {
+	if entry.EntryType != eraftpb.EntryType_EntryNormal {
+		return nil, errors.Errorf("entry %d is not a normal entry", entry.Index)
+	}
+	if len(entry.Data) == 0 {
+		return nil, nil
+	}
+	if entry.Data[0] == raftlog.CustomRaftLogFlag {
+		return raftlog.NewCustom(entry.Data), nil
+	}
+	cmd := new(raft_cmdpb.RaftCmdRequest)
+	if err := cmd.Unmarshal(entry.Data); err != nil {
+		return nil, errors.Annotatef(err, "decode entry %d", entry.Index)
+	}
+	return raftlog.NewRequest(cmd), nil
+}
+
+// EntrySummary returns a one line summary of the entry, admin commands and conf changes are
+// described in detail, while write commands are summarized by their command types.
+func EntrySummary(entry *eraftpb.Entry) string {
+	prefix := fmt.Sprintf("[index %d term %d]", entry.Index, entry.Term)
+	if entry.EntryType == eraftpb.EntryType_EntryConfChange {
+		cc := new(eraftpb.ConfChange)
+		if err := cc.Unmarshal(entry.Data); err != nil {
+			return fmt.Sprintf("%s conf change: %v", prefix, err)
+		}
+		return fmt.Sprintf("%s conf change %s node %d", prefix, cc.ChangeType, cc.NodeId)
+	}
+	rlog, err := DecodeEntry(entry)
+	if err != nil {
+		return fmt.Sprintf("%s %v", prefix, err)
+	}
+	if rlog == nil {
+		return prefix + " empty entry"
+	}
+	if cl, ok := rlog.(*raftlog.CustomRaftLog); ok {
+		return fmt.Sprintf("%s %s epoch %s", prefix, cl.Type(), cl.Epoch())
+	}
+	req := rlog.GetRaftCmdRequest()
+	if admin := req.GetAdminRequest(); admin != nil {
+		return fmt.Sprintf("%s admin %s", prefix, adminSummary(admin))
+	}
+	counts := make(map[raft_cmdpb.CmdType]int)
+	var types []raft_cmdpb.CmdType
+	for _, r := range req.GetRequests() {
+		if counts[r.CmdType] == 0 {
+			types = append(types, r.CmdType)
+		}
+		counts[r.CmdType]++
+	}
+	parts := make([]string, 0, len(types))
+	for _, tp := range types {
+		parts = append(parts, fmt.Sprintf("%s x%d", tp, counts[tp]))
+	}
+	return fmt.Sprintf("%s write %s", prefix, strings.Join(parts, ", "))
+}
+
+func adminSummary(admin *raft_cmdpb.AdminRequest) string {
+	switch admin.CmdType {
+	case raft_cmdpb.AdminCmdType_ChangePeer:
+		cp := admin.ChangePeer
+		return fmt.Sprintf("ChangePeer %s peer %d store %d", cp.GetChangeType(), cp.GetPeer().GetId(), cp.GetPeer().GetStoreId())
+	case raft_cmdpb.AdminCmdType_Split:
+		return fmt.Sprintf("Split key %x new region %d", admin.GetSplit().GetSplitKey(), admin.GetSplit().GetNewRegionId())
+	case raft_cmdpb.AdminCmdType_BatchSplit:
+		keys := make([]string, 0, len(admin.GetSplits().GetRequests()))
+		for _, r := range admin.GetSplits().GetRequests() {
+			keys = append(keys, fmt.Sprintf("%x", r.SplitKey))
+		}
+		return fmt.Sprintf("BatchSplit keys [%s]", strings.Join(keys, ", "))
+	case raft_cmdpb.AdminCmdType_CompactLog:
+		return fmt.Sprintf("CompactLog index %d term %d", admin.GetCompactLog().GetCompactIndex(), admin.GetCompactLog().GetCompactTerm())
+	case raft_cmdpb.AdminCmdType_TransferLeader:
+		return fmt.Sprintf("TransferLeader peer %d", admin.GetTransferLeader().GetPeer().GetId())
+	case raft_cmdpb.AdminCmdType_PrepareMerge:
+		return fmt.Sprintf("PrepareMerge target region %d min index %d",
+			admin.GetPrepareMerge().GetTarget().GetId(), admin.GetPrepareMerge().GetMinIndex())
+	case raft_cmdpb.AdminCmdType_CommitMerge:
+		return fmt.Sprintf("CommitMerge source region %d commit %d",
+			admin.GetCommitMerge().GetSource().GetId(), admin.GetCommitMerge().GetCommit())
+	case raft_cmdpb.AdminCmdType_RollbackMerge:
+		return fmt.Sprintf("RollbackMerge commit %d", admin.GetRollbackMerge().GetCommit())
+	}
+	return admin.CmdType.String()
+}
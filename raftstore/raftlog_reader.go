@@ -0,0 +1,242 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"sync"
+
+	"github.com/pingcap/badger"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/eraftpb"
+)
+
+var errRaftLogCompacted = errors.New("raft log is compacted")
+
+// RaftLogReaderInfo is a reader pinning the raft log of a region.
+type RaftLogReaderInfo struct {
+	Name string
+	// Low is the first index pinned by the reader.
+	Low uint64
+}
+
+// RaftLogReaderMetrics are the readers of the raft log of a region and the truncations deferred by them.
+type RaftLogReaderMetrics struct {
+	Readers []RaftLogReaderInfo
+	// DeferredCompactions is the number of the CompactLog proposals lowered to keep the pinned entries.
+	DeferredCompactions uint64
+	// DeferredGCs is the number of the raft log truncations deferred because of the pinned entries.
+	DeferredGCs uint64
+}
+
+// raftLogReaders tracks the readers of the raft log of a peer, it's updated by the readers and the peer
+// goroutine concurrently.
+type raftLogReaders struct {
+	mu      sync.Mutex
+	nextID  uint64
+	pins    map[uint64]RaftLogReaderInfo
+	metrics RaftLogReaderMetrics
+	// compacted is the end of the raft log GC tasks scheduled, the entries before it may be deleted.
+	compacted uint64
+	// deferredEnd is the end of the raft log GC deferred by the readers.
+	deferredEnd uint64
+}
+
+func newRaftLogReaders() *raftLogReaders {
+	return &raftLogReaders{pins: make(map[uint64]RaftLogReaderInfo)}
+}
+
+func (rs *raftLogReaders) acquire(name string, low uint64) (uint64, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if low < rs.compacted {
+		return 0, errors.Annotatef(errRaftLogCompacted, "entries before %d may be deleted, want %d", rs.compacted, low)
+	}
+	rs.nextID++
+	rs.pins[rs.nextID] = RaftLogReaderInfo{Name: name, Low: low}
+	return rs.nextID, nil
+}
+
+func (rs *raftLogReaders) advance(id, low uint64) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if pin, ok := rs.pins[id]; ok && low > pin.Low {
+		pin.Low = low
+		rs.pins[id] = pin
+	}
+}
+
+func (rs *raftLogReaders) release(id uint64) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	delete(rs.pins, id)
+}
+
+// minLow returns the smallest index pinned by the readers.
+func (rs *raftLogReaders) minLow() (uint64, bool) {
+	if rs == nil {
+		return 0, false
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.minLowLocked()
+}
+
+func (rs *raftLogReaders) minLowLocked() (low uint64, ok bool) {
+	for _, pin := range rs.pins {
+		if !ok || pin.Low < low {
+			low, ok = pin.Low, true
+		}
+	}
+	return
+}
+
+// clampCompactIndex lowers the index of a CompactLog proposal below the pinned entries.
+func (rs *raftLogReaders) clampCompactIndex(compactIdx uint64) uint64 {
+	low, ok := rs.minLow()
+	if !ok || compactIdx < low {
+		return compactIdx
+	}
+	rs.mu.Lock()
+	rs.metrics.DeferredCompactions++
+	rs.mu.Unlock()
+	if low == 0 {
+		return 0
+	}
+	return low - 1
+}
+
+// deferredGC returns the end of the deferred raft log GC, 0 if nothing is deferred.
+func (rs *raftLogReaders) deferredGC() uint64 {
+	if rs == nil {
+		return 0
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.deferredEnd
+}
+
+// clampGC returns the end of the raft log GC in [start, end) keeping the pinned entries, the rest of the
+// range is deferred until the readers move on.
+func (rs *raftLogReaders) clampGC(start, end uint64) uint64 {
+	if rs == nil {
+		return end
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if low, ok := rs.minLowLocked(); ok && low < end {
+		if rs.deferredEnd < end {
+			rs.deferredEnd = end
+			rs.metrics.DeferredGCs++
+		}
+		end = low
+		if end < start {
+			end = start
+		}
+	} else if rs.deferredEnd <= end {
+		rs.deferredEnd = 0
+	}
+	if rs.compacted < end {
+		rs.compacted = end
+	}
+	return end
+}
+
+func (rs *raftLogReaders) snapshot() RaftLogReaderMetrics {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	m := rs.metrics
+	m.Readers = make([]RaftLogReaderInfo, 0, len(rs.pins))
+	for _, pin := range rs.pins {
+		m.Readers = append(m.Readers, pin)
+	}
+	return m
+}
+
+// scheduleRaftLogGC deletes the raft log before end from the raft engine, the entries pinned by the readers
+// are deleted by a later raft log GC tick after they are released.
+func (d *peerMsgHandler) scheduleRaftLogGC(end uint64) {
+	start := d.peer.LastCompactedIdx
+	end = d.peer.logReaders.clampGC(start, end)
+	if end == 0 || (start != 0 && end <= start) {
+		return
+	}
+	d.peer.LastCompactedIdx = end
+	d.ctx.raftLogGCTaskSender <- task{
+		tp: taskTypeRaftLogGC,
+		data: &raftLogGCTask{
+			raftEngine: d.ctx.engine.raft,
+			regionID:   d.regionID(),
+			startIdx:   start,
+			endIdx:     end,
+		},
+	}
+}
+
+// RaftLogReader pins the raft log entries of a region from an index, the pinned entries are neither compacted
+// by the leader nor deleted from the raft engine until the reader advances past them or is released.
+type RaftLogReader struct {
+	readers  *raftLogReaders
+	id       uint64
+	raftDB   *badger.DB
+	regionID uint64
+}
+
+// AcquireRaftLogReader pins the raft log of the region from low on the store, it fails if the entries may be
+// deleted already. The reader must be released.
+func (r *Router) AcquireRaftLogReader(regionID uint64, name string, low uint64) (*RaftLogReader, error) {
+	p := r.router.get(regionID)
+	if p == nil {
+		return nil, errPeerNotFound
+	}
+	peer := p.peer.peer
+	id, err := peer.logReaders.acquire(name, low)
+	if err != nil {
+		return nil, err
+	}
+	return &RaftLogReader{readers: peer.logReaders, id: id, raftDB: peer.peerStorage.Engines.raft, regionID: regionID}, nil
+}
+
+// Scan iterates the entries in [low, high) of the raft engine, high 0 means no upper bound. low must not be
+// less than the pinned index.
+func (r *RaftLogReader) Scan(low, high uint64, fn func(entry *eraftpb.Entry) bool) error {
+	r.readers.mu.Lock()
+	pin, ok := r.readers.pins[r.id]
+	r.readers.mu.Unlock()
+	if !ok {
+		return errors.New("raft log reader is released")
+	}
+	if low < pin.Low {
+		return errors.Errorf("scan from %d before the pinned index %d", low, pin.Low)
+	}
+	return ScanRaftLog(r.raftDB, r.regionID, low, high, fn)
+}
+
+// Advance unpins the entries before low.
+func (r *RaftLogReader) Advance(low uint64) {
+	r.readers.advance(r.id, low)
+}
+
+// Release unpins the entries of the reader.
+func (r *RaftLogReader) Release() {
+	r.readers.release(r.id)
+}
+
+// RaftLogReaderMetrics returns the readers of the raft log of the region and the truncations they deferred.
+func (r *Router) RaftLogReaderMetrics(regionID uint64) (RaftLogReaderMetrics, error) {
+	p := r.router.get(regionID)
+	if p == nil {
+		return RaftLogReaderMetrics{}, errPeerNotFound
+	}
+	return p.peer.peer.logReaders.snapshot(), nil
+}
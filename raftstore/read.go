@@ -40,16 +40,31 @@ type leaderChecker struct {
 	appliedIndexTerm atomic.Uint64
 	leaderLease      unsafe.Pointer // *RemoteLease
 	region           unsafe.Pointer // *metapb.Region
+	// clock is the clock of the leader lease, nil means the system clock.
+	clock LeaseClock
+	// maxTSSyncing is the sequence number of the pending max ts sync of the leader, 0 means synced.
+	maxTSSyncing atomic.Uint64
+	// appliedIndex is the index applied to the kv engine, it is published by the apply worker before the
+	// callbacks of the applied commands are invoked.
+	appliedIndex atomic.Uint64
+	// safeTS is the safe ts of the bounded staleness reads, see safeTSState.
+	safeTS atomic.Uint64
+	// readFallback counts the reads served by the lease, it is set before the peer is registered.
+	readFallback *readFallbackStats
 }
 
 func (c *leaderChecker) IsLeader(ctx *kvrpcpb.Context, router *Router) *errorpb.Error {
-	snapTime := time.Now()
+	snapTime := leaseClockOrDefault(c.clock).Now()
 	isExpired, err := c.isExpired(ctx, &snapTime)
 	if err != nil {
 		return ErrToPbError(err)
 	}
 	if !isExpired {
-		return nil
+		pbErr := c.readErr(ctx, router)
+		if pbErr == nil {
+			c.readFallback.observeLocalRead()
+		}
+		return pbErr
 	}
 
 	cb := NewCallback()
@@ -81,6 +96,15 @@ func (c *leaderChecker) IsLeader(ctx *kvrpcpb.Context, router *Router) *errorpb.
 	if cb.resp.Header.Error != nil {
 		return cb.resp.Header.Error
 	}
+	return c.readErr(ctx, router)
+}
+
+// readErr checks the read after the leadership is confirmed.
+func (c *leaderChecker) readErr(ctx *kvrpcpb.Context, router *Router) *errorpb.Error {
+	if err := c.maxTSSyncedErr(ctx.RegionId); err != nil {
+		return err
+	}
+	router.router.readYourWrites.checkRead(ctx, c.peerID, c.appliedIndex.Load())
 	return nil
 }
 
@@ -0,0 +1,264 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ngaut/unistore/raftstore/raftlog"
+	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// ReadFallbackReason is the reason a read on the leader falls back from ReadLocal to ReadIndex.
+type ReadFallbackReason int
+
+// ReadFallbackReason
+const (
+	// The lease is expired, usually because no proposal renewed it in time.
+	ReadFallbackLeaseExpired ReadFallbackReason = 1 + iota
+	// The lease is suspected by a leader transfer or Router.ControlLease.
+	ReadFallbackLeaseSuspect
+	// The term of the applied index is not the current term, the leadership changed recently.
+	ReadFallbackTermMismatch
+	// The region is splitting.
+	ReadFallbackSplitting
+	// The region is merging, or the lease is suspected by a committed prepare merge.
+	ReadFallbackMerging
+)
+
+// String returns a string representation of the fallback reason.
+func (r ReadFallbackReason) String() string {
+	switch r {
+	case ReadFallbackLeaseExpired:
+		return "lease-expired"
+	case ReadFallbackLeaseSuspect:
+		return "lease-suspect"
+	case ReadFallbackTermMismatch:
+		return "term-mismatch"
+	case ReadFallbackSplitting:
+		return "splitting"
+	case ReadFallbackMerging:
+		return "merging"
+	}
+	return "unknown"
+}
+
+// ReadFallbackMetrics counts the reads served locally by the leader of a region and the ones falling back to
+// ReadIndex by the reason.
+type ReadFallbackMetrics struct {
+	LocalReads   uint64
+	LeaseExpired uint64
+	LeaseSuspect uint64
+	TermMismatch uint64
+	Splitting    uint64
+	Merging      uint64
+
+	// LastWindowRate is the ratio of the reads falling back because the lease is expired in the last window.
+	LastWindowRate float64
+	// AdaptiveWindows is the number of the windows the lease is renewed early in.
+	AdaptiveWindows uint64
+	// EarlyRenewals is the number of the proposals made to renew the lease early.
+	EarlyRenewals uint64
+}
+
+// readFallbackStats is updated by the peer goroutine and the metrics can be read concurrently.
+type readFallbackStats struct {
+	threshold float64
+	window    time.Duration
+
+	mu      sync.Mutex
+	metrics ReadFallbackMetrics
+
+	// windowReads is also counted by the lease reads of the leaderChecker, so it is accessed atomically.
+	windowReads uint64
+	// The window and the early renewal state are only accessed by the peer goroutine.
+	windowStart  time.Time
+	windowMisses uint64
+	adaptive     bool
+	renewIndex   uint64
+	renewTerm    uint64
+}
+
+func newReadFallbackStats(cfg *Config) *readFallbackStats {
+	return &readFallbackStats{threshold: cfg.AdaptiveLeaseFallbackRate, window: cfg.AdaptiveLeaseWindow}
+}
+
+// observeLocalRead records a read served locally by the lease of the leader, it may be called by the
+// leaderChecker concurrently.
+func (s *readFallbackStats) observeLocalRead() {
+	if s != nil {
+		s.observe(0)
+	}
+}
+
+// observe records a read, a zero reason means it is served locally.
+func (s *readFallbackStats) observe(reason ReadFallbackReason) {
+	atomic.AddUint64(&s.windowReads, 1)
+	if reason == ReadFallbackLeaseExpired {
+		s.windowMisses++
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch reason {
+	case 0:
+		s.metrics.LocalReads++
+	case ReadFallbackLeaseExpired:
+		s.metrics.LeaseExpired++
+	case ReadFallbackLeaseSuspect:
+		s.metrics.LeaseSuspect++
+	case ReadFallbackTermMismatch:
+		s.metrics.TermMismatch++
+	case ReadFallbackSplitting:
+		s.metrics.Splitting++
+	case ReadFallbackMerging:
+		s.metrics.Merging++
+	}
+}
+
+// tick closes the window if it is over and returns true if the lease should be renewed early in the window.
+func (s *readFallbackStats) tick(tag string, now time.Time) bool {
+	if s.threshold <= 0 {
+		return false
+	}
+	if s.windowStart.IsZero() {
+		s.windowStart = now
+	}
+	if now.Sub(s.windowStart) < s.window {
+		return s.adaptive
+	}
+	var rate float64
+	if reads := atomic.SwapUint64(&s.windowReads, 0); reads > 0 {
+		rate = float64(s.windowMisses) / float64(reads)
+	}
+	adaptive := rate > s.threshold
+	if adaptive != s.adaptive {
+		log.Info("adaptive lease renewal changed", zap.String("tag", tag), zap.Bool("enabled", adaptive),
+			zap.Float64("fallback rate", rate))
+	}
+	s.adaptive = adaptive
+	s.windowStart, s.windowMisses = now, 0
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metrics.LastWindowRate = rate
+	if adaptive {
+		s.metrics.AdaptiveWindows++
+	}
+	return adaptive
+}
+
+func (s *readFallbackStats) snapshot() ReadFallbackMetrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.metrics
+}
+
+// readFallbackReason returns the reason the read falls back to ReadIndex, false means the read never reads
+// locally, like a read on a follower or a read asking for the read index explicitly.
+func (p *Peer) readFallbackReason(req *raft_cmdpb.RaftCmdRequest) (ReadFallbackReason, bool) {
+	if !p.IsLeader() || req.GetHeader().GetReadQuorum() {
+		return 0, false
+	}
+	for _, r := range req.Requests {
+		if r.CmdType == raft_cmdpb.CmdType_ReadIndex {
+			return 0, false
+		}
+	}
+	switch {
+	case p.isSplitting():
+		return ReadFallbackSplitting, true
+	case p.isMerging():
+		return ReadFallbackMerging, true
+	case p.Store().appliedIndexTerm != p.Term():
+		return ReadFallbackTermMismatch, true
+	}
+	if p.RaftGroup.Raft.InLease() && p.leaderLease.Inspect(nil) != LeaseStateSuspect {
+		return ReadFallbackLeaseExpired, true
+	}
+	if p.leaseStats != nil && p.leaseStats.lastReason() == LeaseReasonMergeSuspect {
+		return ReadFallbackMerging, true
+	}
+	return ReadFallbackLeaseSuspect, true
+}
+
+// observeRead records the policy of a read request.
+func (p *Peer) observeRead(req *raft_cmdpb.RaftCmdRequest, policy RequestPolicy) {
+	if p.readFallback == nil {
+		return
+	}
+	switch policy {
+	case RequestPolicyReadLocal:
+		p.readFallback.observe(0)
+	case RequestPolicyReadIndex:
+		if reason, ok := p.readFallbackReason(req); ok {
+			p.readFallback.observe(reason)
+		}
+	}
+}
+
+// needEarlyLeaseRenew returns true if the fallback rate is high and the lease is going to expire. The lease
+// can't be longer than the election timeout, so the leader proposes more often to keep it valid instead.
+func (p *Peer) needEarlyLeaseRenew() bool {
+	s := p.readFallback
+	now := p.leaderLease.Now()
+	if s == nil || !s.tick(p.Tag, now) || !p.IsLeader() || p.isSplitting() || p.isMerging() {
+		return false
+	}
+	if s.renewTerm == p.Term() && s.renewIndex > p.Store().AppliedIndex() {
+		// The last renewal is not applied yet.
+		return false
+	}
+	switch p.leaderLease.Inspect(&now) {
+	case LeaseStateSuspect:
+		return false
+	case LeaseStateValid:
+		return p.leaderLease.boundValid.Sub(now) <= p.leaderLease.maxDrift
+	}
+	return true
+}
+
+// maybeRenewLeaseEarly proposes an empty command to renew the lease if the adaptive renewal needs it.
+func (p *Peer) maybeRenewLeaseEarly(cfg *Config) {
+	if !p.needEarlyLeaseRenew() {
+		return
+	}
+	now := p.leaderLease.Now()
+	index, err := p.ProposeNormal(cfg, raftlog.NewRequest(new(raft_cmdpb.RaftCmdRequest)))
+	if err != nil {
+		return
+	}
+	meta := &ProposalMeta{
+		Index:          index,
+		Term:           p.Term(),
+		RenewLeaseTime: &now,
+	}
+	p.PostPropose(meta, false, NewCallback())
+	s := p.readFallback
+	s.renewIndex, s.renewTerm = index, p.Term()
+	s.mu.Lock()
+	s.metrics.EarlyRenewals++
+	s.mu.Unlock()
+}
+
+// ReadFallbackMetrics returns the read fallback counters of the region.
+func (r *Router) ReadFallbackMetrics(regionID uint64) (ReadFallbackMetrics, error) {
+	p := r.router.get(regionID)
+	if p == nil {
+		return ReadFallbackMetrics{}, errPeerNotFound
+	}
+	return p.peer.peer.readFallback.snapshot(), nil
+}
@@ -0,0 +1,167 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ngaut/unistore/raftstore/raftlog"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
+)
+
+// rejectedReadIndex is the index of the read index response for a read rejected by the leader,
+// a leader never answers a read index with index 0 as it must have committed an entry at its term.
+const rejectedReadIndex = 0
+
+// encodeReadIndexContext encodes the read index context, it is the 8 bytes id followed by the
+// length prefixed start and end keys of the ranges.
+func encodeReadIndexContext(id uint64, ranges []*kvrpcpb.KeyRange) []byte {
+	size := 8
+	for _, r := range ranges {
+		size += 2*binary.MaxVarintLen64 + len(r.StartKey) + len(r.EndKey)
+	}
+	buf := make([]byte, 8, size)
+	binary.BigEndian.PutUint64(buf, id)
+	for _, r := range ranges {
+		buf = appendLenPrefixed(buf, r.StartKey)
+		buf = appendLenPrefixed(buf, r.EndKey)
+	}
+	return buf
+}
+
+func appendLenPrefixed(buf, data []byte) []byte {
+	var l [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(l[:], uint64(len(data)))
+	buf = append(buf, l[:n]...)
+	return append(buf, data...)
+}
+
+// decodeReadIndexContext decodes the id and the key ranges of a read index context.
+func decodeReadIndexContext(ctx []byte) (uint64, []*kvrpcpb.KeyRange, error) {
+	if len(ctx) < 8 {
+		return 0, nil, errors.Errorf("read index context %v is too short", ctx)
+	}
+	id := binary.BigEndian.Uint64(ctx)
+	data := ctx[8:]
+	var ranges []*kvrpcpb.KeyRange
+	for len(data) > 0 {
+		var startKey, endKey []byte
+		var err error
+		if startKey, data, err = cutLenPrefixed(data); err != nil {
+			return 0, nil, err
+		}
+		if endKey, data, err = cutLenPrefixed(data); err != nil {
+			return 0, nil, err
+		}
+		ranges = append(ranges, &kvrpcpb.KeyRange{StartKey: startKey, EndKey: endKey})
+	}
+	return id, ranges, nil
+}
+
+func cutLenPrefixed(data []byte) ([]byte, []byte, error) {
+	l, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < l {
+		return nil, nil, errors.New("corrupted read index context")
+	}
+	data = data[n:]
+	return data[:l], data[l:], nil
+}
+
+// readKeyRanges returns the raw key ranges read by the request, the end key of a range is exclusive
+// and an empty end key means unbounded.
+func readKeyRanges(req *raft_cmdpb.RaftCmdRequest) []*kvrpcpb.KeyRange {
+	var ranges []*kvrpcpb.KeyRange
+	for _, r := range req.GetRequests() {
+		switch r.GetCmdType() {
+		case raft_cmdpb.CmdType_Get:
+			key := r.GetGet().GetKey()
+			ranges = append(ranges, &kvrpcpb.KeyRange{StartKey: key, EndKey: append(key[:len(key):len(key)], 0)})
+		case raft_cmdpb.CmdType_ReadIndex:
+			ranges = append(ranges, r.GetReadIndex().GetKeyRanges()...)
+		}
+	}
+	return ranges
+}
+
+// pendingMergeSource is the source region of a committed but not applied CommitMerge.
+type pendingMergeSource struct {
+	index  uint64
+	region *metapb.Region
+}
+
+// observeCommitMerge records the source region if the committed entry is a CommitMerge. The target
+// region can't serve the reads of the source range until the merge is applied.
+func (p *Peer) observeCommitMerge(entry *eraftpb.Entry) {
+	if entry.EntryType != eraftpb.EntryType_EntryNormal || len(entry.Data) == 0 || entry.Data[0] == raftlog.CustomRaftLogFlag {
+		return
+	}
+	rlog, err := DecodeEntry(entry)
+	if err != nil {
+		return
+	}
+	if source := rlog.GetRaftCmdRequest().GetAdminRequest().GetCommitMerge().GetSource(); source != nil {
+		p.pendingMergeSources = append(p.pendingMergeSources, pendingMergeSource{index: entry.Index, region: source})
+	}
+}
+
+// overlappedMergeSource returns the pending merge source region overlapping the ranges.
+func (p *Peer) overlappedMergeSource(ranges []*kvrpcpb.KeyRange) *metapb.Region {
+	appliedIndex := p.Store().AppliedIndex()
+	for len(p.pendingMergeSources) > 0 && p.pendingMergeSources[0].index <= appliedIndex {
+		p.pendingMergeSources = p.pendingMergeSources[1:]
+	}
+	for _, source := range p.pendingMergeSources {
+		startKey, endKey := RawStartKey(source.region), RawEndKey(source.region)
+		for _, r := range ranges {
+			if (len(r.EndKey) == 0 || bytes.Compare(r.EndKey, startKey) > 0) && bytes.Compare(r.StartKey, endKey) < 0 {
+				return source.region
+			}
+		}
+	}
+	return nil
+}
+
+func (p *Peer) checkReadRanges(ranges []*kvrpcpb.KeyRange) error {
+	if source := p.overlappedMergeSource(ranges); source != nil {
+		return fmt.Errorf("can not read index due to merge source region %d", source.Id)
+	}
+	return nil
+}
+
+// maybeRejectReadIndex rejects the read index forwarded by another peer if it reads the range of
+// a pending merge source, it returns true if the read index is rejected.
+func (p *Peer) maybeRejectReadIndex(m *eraftpb.Message) bool {
+	if len(m.Entries) != 1 {
+		return false
+	}
+	_, ranges, err := decodeReadIndexContext(m.Entries[0].Data)
+	if err != nil || len(ranges) == 0 || p.checkReadRanges(ranges) == nil {
+		return false
+	}
+	p.pendingMessages = append(p.pendingMessages, eraftpb.Message{
+		MsgType: eraftpb.MessageType_MsgReadIndexResp,
+		To:      m.From,
+		From:    p.PeerID(),
+		Term:    p.Term(),
+		Index:   rejectedReadIndex,
+		Entries: m.Entries,
+	})
+	return true
+}
@@ -0,0 +1,238 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// ReadQueue is the queue of a read in the ReadPool.
+type ReadQueue int
+
+// The read queues in the order of priority.
+const (
+	// ReadQueuePointGet is the queue of the reads of a few keys.
+	ReadQueuePointGet ReadQueue = iota
+	// ReadQueueScan is the queue of the range scans and the coprocessor requests.
+	ReadQueueScan
+
+	readQueueCount
+)
+
+func (q ReadQueue) String() string {
+	switch q {
+	case ReadQueuePointGet:
+		return "point-get"
+	case ReadQueueScan:
+		return "scan"
+	}
+	return "unknown"
+}
+
+// ReadQueueMetrics are the metrics of a queue of the ReadPool, the wait time is the time a read waits in the
+// queue before it runs.
+type ReadQueueMetrics struct {
+	Tasks    uint64
+	Canceled uint64
+	Pending  int
+	Running  int
+	// Concurrency is the max number of the reads of the queue running at the same time.
+	Concurrency int
+	TotalWait   time.Duration
+	MaxWait     time.Duration
+}
+
+// AvgWait returns the average wait time of the reads run.
+func (m ReadQueueMetrics) AvgWait() time.Duration {
+	if m.Tasks == 0 {
+		return 0
+	}
+	return m.TotalWait / time.Duration(m.Tasks)
+}
+
+var errReadPoolStopped = errors.New("read pool is stopped")
+
+type readTask struct {
+	fn       func()
+	enqueued time.Time
+	// elem and started are protected by the mutex of the pool.
+	elem    *list.Element
+	started bool
+	done    chan struct{}
+}
+
+type readQueue struct {
+	tasks   list.List
+	limit   int
+	running int
+	metrics ReadQueueMetrics
+}
+
+// ReadPool runs the reads of a store by a fixed number of workers. The workers take the reads from the
+// queues in the order of priority, and a queue runs at most its concurrency of reads at the same time, so the
+// long scans can't occupy the workers needed by the point gets.
+type ReadPool struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queues  [readQueueCount]readQueue
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+// newReadPool starts the workers of Config.ReadPoolSize, it returns nil if the size is 0.
+func newReadPool(cfg *Config) *ReadPool {
+	if cfg.ReadPoolSize <= 0 {
+		return nil
+	}
+	p := new(ReadPool)
+	p.cond = sync.NewCond(&p.mu)
+	limits := [readQueueCount]int{cfg.ReadPoolPointGetConcurrency, cfg.ReadPoolScanConcurrency}
+	for i := range p.queues {
+		if limits[i] <= 0 {
+			limits[i] = cfg.ReadPoolSize
+		}
+		p.queues[i].limit = limits[i]
+		p.queues[i].metrics.Concurrency = limits[i]
+	}
+	p.wg.Add(cfg.ReadPoolSize)
+	for i := 0; i < cfg.ReadPoolSize; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *ReadPool) work() {
+	defer p.wg.Done()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		q, t := p.next()
+		if t == nil {
+			if p.stopped {
+				return
+			}
+			p.cond.Wait()
+			continue
+		}
+		p.mu.Unlock()
+		t.fn()
+		close(t.done)
+		p.mu.Lock()
+		q.running--
+		q.metrics.Running--
+		// A slot of the queue is freed for the waiting workers.
+		p.cond.Broadcast()
+	}
+}
+
+// next pops the next read to run, it must be called with the mutex locked.
+func (p *ReadPool) next() (*readQueue, *readTask) {
+	for i := range p.queues {
+		q := &p.queues[i]
+		if q.running < q.limit && q.tasks.Len() > 0 {
+			t := q.tasks.Remove(q.tasks.Front()).(*readTask)
+			q.metrics.Pending--
+			t.started = true
+			wait := time.Since(t.enqueued)
+			q.running++
+			q.metrics.Running++
+			q.metrics.Tasks++
+			q.metrics.TotalWait += wait
+			if wait > q.metrics.MaxWait {
+				q.metrics.MaxWait = wait
+			}
+			return q, t
+		}
+	}
+	return nil, nil
+}
+
+// Run runs fn in the queue and returns after it's done. If ctx is done before fn starts, fn is skipped and
+// the error of ctx is returned. If the pool is nil, fn runs on the caller.
+func (p *ReadPool) Run(ctx context.Context, queue ReadQueue, fn func()) error {
+	if p == nil {
+		fn()
+		return nil
+	}
+	t := &readTask{fn: fn, enqueued: time.Now(), done: make(chan struct{})}
+	q := &p.queues[queue]
+	p.mu.Lock()
+	if p.stopped {
+		p.mu.Unlock()
+		return errReadPoolStopped
+	}
+	t.elem = q.tasks.PushBack(t)
+	q.metrics.Pending++
+	p.cond.Signal()
+	p.mu.Unlock()
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+	}
+	p.mu.Lock()
+	if !t.started {
+		q.tasks.Remove(t.elem)
+		q.metrics.Pending--
+		q.metrics.Canceled++
+		p.mu.Unlock()
+		return ctx.Err()
+	}
+	p.mu.Unlock()
+	<-t.done
+	return nil
+}
+
+// Metrics returns the metrics of the queue.
+func (p *ReadPool) Metrics(queue ReadQueue) ReadQueueMetrics {
+	if p == nil {
+		return ReadQueueMetrics{}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.queues[queue].metrics
+}
+
+// ServeHTTP serves the metrics of the queues by name as JSON for the status server.
+func (p *ReadPool) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	metrics := make(map[string]ReadQueueMetrics, readQueueCount)
+	for q := ReadQueue(0); q < readQueueCount; q++ {
+		metrics[q.String()] = p.Metrics(q)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(metrics); err != nil {
+		log.Warn("failed to encode read pool metrics", zap.Error(err))
+	}
+}
+
+// stop lets the workers exit after the queued reads are done.
+func (p *ReadPool) stop() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.stopped = true
+	p.cond.Broadcast()
+	p.mu.Unlock()
+	p.wg.Wait()
+}
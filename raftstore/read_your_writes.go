@@ -0,0 +1,118 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// ReadYourWritesViolation is recorded when a read of a session observes an applied index smaller than the
+// index of a write the session has finished.
+type ReadYourWritesViolation struct {
+	Session  uint64
+	RegionID uint64
+	// PeerID is the peer that served the read.
+	PeerID     uint64
+	WriteIndex uint64
+	ReadIndex  uint64
+	Time       time.Time
+}
+
+const maxReadYourWritesViolations = 64
+
+type sessionRegion struct {
+	session  uint64
+	regionID uint64
+}
+
+// ReadYourWritesVerifier checks that the reads of a client session observe the writes the session has
+// finished. The session is the TaskId in the request context, 0 means no session. A verifier can be shared
+// by the stores of a cluster, so the reads served by a new leader are checked against the writes applied
+// by the former one.
+type ReadYourWritesVerifier struct {
+	mu         sync.Mutex
+	writes     map[sessionRegion]uint64
+	violations []ReadYourWritesViolation
+	total      uint64
+}
+
+// NewReadYourWritesVerifier creates a ReadYourWritesVerifier.
+func NewReadYourWritesVerifier() *ReadYourWritesVerifier {
+	return &ReadYourWritesVerifier{writes: make(map[sessionRegion]uint64)}
+}
+
+// observeWrite records the applied index of a finished write of the session.
+func (v *ReadYourWritesVerifier) observeWrite(ctx *kvrpcpb.Context, index uint64) {
+	if v == nil || ctx.GetTaskId() == 0 || index == 0 {
+		return
+	}
+	key := sessionRegion{session: ctx.TaskId, regionID: ctx.RegionId}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if index > v.writes[key] {
+		v.writes[key] = index
+	}
+}
+
+// checkRead flags a violation if the read of the session observes an applied index smaller than the index of
+// its latest write, it returns false on a violation.
+func (v *ReadYourWritesVerifier) checkRead(ctx *kvrpcpb.Context, peerID, appliedIndex uint64) bool {
+	if v == nil || ctx.GetTaskId() == 0 {
+		return true
+	}
+	key := sessionRegion{session: ctx.TaskId, regionID: ctx.RegionId}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	writeIndex := v.writes[key]
+	if appliedIndex >= writeIndex {
+		return true
+	}
+	violation := ReadYourWritesViolation{
+		Session:    ctx.TaskId,
+		RegionID:   ctx.RegionId,
+		PeerID:     peerID,
+		WriteIndex: writeIndex,
+		ReadIndex:  appliedIndex,
+		Time:       time.Now(),
+	}
+	log.Error("read doesn't observe the write of the session", zap.Uint64("session", ctx.TaskId),
+		zap.Uint64("region id", ctx.RegionId), zap.Uint64("peer id", peerID),
+		zap.Uint64("write index", writeIndex), zap.Uint64("read index", appliedIndex))
+	v.total++
+	if len(v.violations) == maxReadYourWritesViolations {
+		copy(v.violations, v.violations[1:])
+		v.violations = v.violations[:len(v.violations)-1]
+	}
+	v.violations = append(v.violations, violation)
+	return false
+}
+
+// Violations returns the total number of the violations and the recent ones, the oldest first.
+func (v *ReadYourWritesVerifier) Violations() (uint64, []ReadYourWritesViolation) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.total, append([]ReadYourWritesViolation{}, v.violations...)
+}
+
+// publishAppliedIndex makes the index visible to the reads after the applied data is written to the kv engine.
+func (c *applyCallback) publishAppliedIndex() {
+	if c.visibleIndex != nil && c.appliedIndex > c.visibleIndex.Load() {
+		c.visibleIndex.Store(c.appliedIndex)
+	}
+}
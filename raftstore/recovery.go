@@ -0,0 +1,186 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// RecoveryPhase is a phase of recovering the regions of a store when it starts.
+type RecoveryPhase string
+
+const (
+	// RecoveryPhaseScan scans the region meta of the store.
+	RecoveryPhaseScan RecoveryPhase = "scan"
+	// RecoveryPhaseValidate validates the raft state and the apply state of the regions.
+	RecoveryPhaseValidate RecoveryPhase = "validate"
+	// RecoveryPhaseCreate creates the peers of the regions.
+	RecoveryPhaseCreate RecoveryPhase = "create"
+)
+
+// RecoveryProgress is the progress of a recovery phase.
+type RecoveryProgress struct {
+	StoreID uint64
+	Phase   RecoveryPhase
+	// Done is the number of the regions processed by the phase, Total is 0 if it is unknown.
+	Done     int
+	Total    int
+	Finished bool
+	// Elapsed is the time since the phase started, ETA is the estimated time to finish it, 0 if unknown.
+	Elapsed time.Duration
+	ETA     time.Duration
+}
+
+// recoveryTracker keeps the latest recovery progress of the store.
+type recoveryTracker struct {
+	// progress holds a RecoveryProgress, it is nil before the store starts.
+	progress atomic.Value
+}
+
+// recoveryPhase reports the progress of a recovery phase every Config.RecoveryProgressInterval and when
+// it finishes. advance can be called concurrently.
+type recoveryPhase struct {
+	done     int64
+	reported int64 // the elapsed nanoseconds of the last report.
+	tracker  *recoveryTracker
+	cfg      *Config
+	storeID  uint64
+	phase    RecoveryPhase
+	total    int
+	start    time.Time
+	mu       sync.Mutex
+}
+
+func (t *recoveryTracker) begin(cfg *Config, storeID uint64, phase RecoveryPhase, total int) *recoveryPhase {
+	p := &recoveryPhase{tracker: t, cfg: cfg, storeID: storeID, phase: phase, total: total, start: time.Now()}
+	p.report(0, 0, false)
+	return p
+}
+
+func (p *recoveryPhase) advance() {
+	done := atomic.AddInt64(&p.done, 1)
+	if p.cfg.RecoveryProgressInterval <= 0 {
+		return
+	}
+	elapsed := time.Since(p.start)
+	reported := atomic.LoadInt64(&p.reported)
+	if elapsed-time.Duration(reported) >= p.cfg.RecoveryProgressInterval &&
+		atomic.CompareAndSwapInt64(&p.reported, reported, int64(elapsed)) {
+		p.report(int(done), elapsed, false)
+	}
+}
+
+func (p *recoveryPhase) finish() {
+	p.report(int(atomic.LoadInt64(&p.done)), time.Since(p.start), true)
+}
+
+func (p *recoveryPhase) report(done int, elapsed time.Duration, finished bool) {
+	progress := RecoveryProgress{
+		StoreID:  p.storeID,
+		Phase:    p.phase,
+		Done:     done,
+		Total:    p.total,
+		Finished: finished,
+		Elapsed:  elapsed,
+	}
+	if !finished && done > 0 && p.total > done {
+		progress.ETA = elapsed * time.Duration(p.total-done) / time.Duration(done)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tracker.progress.Store(progress)
+	if done > 0 || finished {
+		log.Info("recovering regions", zap.Uint64("store", p.storeID), zap.String("phase", string(p.phase)),
+			zap.Int("done", done), zap.Int("total", p.total), zap.Bool("finished", finished),
+			zap.Duration("elapsed", elapsed), zap.Duration("eta", progress.ETA))
+	}
+	if p.cfg.OnRecoveryProgress != nil {
+		p.cfg.OnRecoveryProgress(progress)
+	}
+}
+
+// peerInitWorkers returns the number of the goroutines initializing the peers.
+func (c *Config) peerInitWorkers() int {
+	if c.PeerInitWorkers > 0 {
+		return c.PeerInitWorkers
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// runParallel calls fn for every index in [0, n) by the workers, the worker argument is in [0, workers).
+// It stops at the first error and returns it.
+func runParallel(workers, n int, fn func(worker, i int) error) error {
+	if workers > n {
+		workers = n
+	}
+	var (
+		next     int64 = -1
+		failed   int32
+		firstErr error
+		once     sync.Once
+		wg       sync.WaitGroup
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for atomic.LoadInt32(&failed) == 0 {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= n {
+					return
+				}
+				if err := fn(w, i); err != nil {
+					once.Do(func() { firstErr = err })
+					atomic.StoreInt32(&failed, 1)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// validateRegionStates loads the raft state and the apply state of the region, and checks that its raft log
+// covers the applied index.
+func validateRegionStates(engines *Engines, region *metapb.Region) error {
+	raftState, err := initRaftState(engines.raft, region)
+	if err != nil {
+		return err
+	}
+	applyState, err := initApplyState(engines.kv.DB, region)
+	if err != nil {
+		return err
+	}
+	if raftState.lastIndex < applyState.appliedIndex {
+		return errors.Errorf("region %d unexpected raft log index: lastIndex %d < appliedIndex %d",
+			region.Id, raftState.lastIndex, applyState.appliedIndex)
+	}
+	return nil
+}
+
+// RecoveryProgress returns the latest progress of recovering the regions when the store started, ok is
+// false before the store starts.
+func (r *Router) RecoveryProgress() (progress RecoveryProgress, ok bool) {
+	progress, ok = r.router.recovery.progress.Load().(RecoveryProgress)
+	return
+}
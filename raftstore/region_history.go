@@ -0,0 +1,216 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// maxRegionHistoryEvents is the max number of the events kept by the region genealogy, the oldest ones are
+// dropped.
+const maxRegionHistoryEvents = 10000
+
+// RegionEventType is the type of a RegionHistoryEvent.
+type RegionEventType string
+
+// The region event types.
+const (
+	RegionEventSplit RegionEventType = "split"
+	RegionEventMerge RegionEventType = "merge"
+)
+
+// RegionRange is the range of a region after a RegionHistoryEvent, the keys are the keys of the region meta.
+type RegionRange struct {
+	ID       uint64 `json:"id"`
+	StartKey []byte `json:"start_key"`
+	EndKey   []byte `json:"end_key"`
+	Version  uint64 `json:"version"`
+}
+
+func (r *RegionRange) contains(key []byte) bool {
+	return bytes.Compare(key, r.StartKey) >= 0 && (len(r.EndKey) == 0 || bytes.Compare(key, r.EndKey) < 0)
+}
+
+// RegionHistoryEvent is a split or a merge applied on the store.
+type RegionHistoryEvent struct {
+	Type RegionEventType `json:"type"`
+	Time time.Time       `json:"time"`
+	// Index is the raft log index of the admin command in the parent region.
+	Index uint64 `json:"index"`
+	// Parents are the split region, or the target and the source regions of a merge.
+	Parents []uint64 `json:"parents"`
+	// Regions are the regions after the event.
+	Regions []RegionRange `json:"regions"`
+}
+
+func (e *RegionHistoryEvent) involves(regionID uint64) bool {
+	for _, id := range e.Parents {
+		if id == regionID {
+			return true
+		}
+	}
+	for _, r := range e.Regions {
+		if r.ID == regionID {
+			return true
+		}
+	}
+	return false
+}
+
+// regionGenealogy records the splits and the merges applied on the store in order.
+type regionGenealogy struct {
+	mu     sync.Mutex
+	events []RegionHistoryEvent
+}
+
+func newRegionRanges(regions []*metapb.Region) []RegionRange {
+	ranges := make([]RegionRange, 0, len(regions))
+	for _, r := range regions {
+		ranges = append(ranges, RegionRange{
+			ID:       r.Id,
+			StartKey: r.StartKey,
+			EndKey:   r.EndKey,
+			Version:  r.GetRegionEpoch().GetVersion(),
+		})
+	}
+	return ranges
+}
+
+func (g *regionGenealogy) record(e RegionHistoryEvent) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.events) >= maxRegionHistoryEvents {
+		g.events = append(g.events[:0], g.events[len(g.events)-maxRegionHistoryEvents+1:]...)
+	}
+	g.events = append(g.events, e)
+}
+
+func (g *regionGenealogy) recordSplit(parent uint64, index uint64, regions []*metapb.Region) {
+	g.record(RegionHistoryEvent{
+		Type:    RegionEventSplit,
+		Time:    time.Now(),
+		Index:   index,
+		Parents: []uint64{parent},
+		Regions: newRegionRanges(regions),
+	})
+}
+
+func (g *regionGenealogy) recordMerge(target, source *metapb.Region, index uint64) {
+	g.record(RegionHistoryEvent{
+		Type:    RegionEventMerge,
+		Time:    time.Now(),
+		Index:   index,
+		Parents: []uint64{target.Id, source.Id},
+		Regions: newRegionRanges([]*metapb.Region{target}),
+	})
+}
+
+// query returns the events involving the region, all the events if regionID is 0.
+func (g *regionGenealogy) query(regionID uint64) []RegionHistoryEvent {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var events []RegionHistoryEvent
+	for _, e := range g.events {
+		if regionID == 0 || e.involves(regionID) {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// locate returns the region owning the key at the time. The regions of an event cover the ranges of its parents,
+// so the last event before the time with a region containing the key tells the owner.
+func (g *regionGenealogy) locate(key []byte, at time.Time) (uint64, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for i := len(g.events) - 1; i >= 0; i-- {
+		e := &g.events[i]
+		if e.Time.After(at) {
+			continue
+		}
+		for j := range e.Regions {
+			if e.Regions[j].contains(key) {
+				return e.Regions[j].ID, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// RegionHistory returns the splits and the merges involving the region applied on the store, all of them if
+// regionID is 0.
+func (r *Router) RegionHistory(regionID uint64) []RegionHistoryEvent {
+	return r.router.genealogy.query(regionID)
+}
+
+// LocateKeyAt returns the region owning the key of the region meta at the time by the splits and the merges
+// applied on the store, false if no recorded region contains the key then.
+func (r *Router) LocateKeyAt(key []byte, at time.Time) (uint64, bool) {
+	return r.router.genealogy.locate(key, at)
+}
+
+type keyLocation struct {
+	RegionID uint64 `json:"region_id"`
+	Found    bool   `json:"found"`
+}
+
+// RegionHistoryHandler serves the region genealogy as JSON for the status server. "?region=ID" returns the
+// events of the region, "?key=HEX&time=RFC3339" returns the region owning the key at the time, the time
+// defaults to now.
+func (r *Router) RegionHistoryHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var resp interface{}
+		if keyHex := req.FormValue("key"); keyHex != "" {
+			key, err := hex.DecodeString(keyHex)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			at := time.Now()
+			if ts := req.FormValue("time"); ts != "" {
+				if at, err = time.Parse(time.RFC3339Nano, ts); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			loc := keyLocation{}
+			loc.RegionID, loc.Found = r.LocateKeyAt(key, at)
+			resp = loc
+		} else {
+			var regionID uint64
+			if id := req.FormValue("region"); id != "" {
+				var err error
+				if regionID, err = strconv.ParseUint(id, 10, 64); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			resp = r.RegionHistory(regionID)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Warn("failed to encode region history", zap.Error(err))
+		}
+	})
+}
@@ -0,0 +1,254 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// The base priorities of the region worker tasks, a task with a higher priority runs first.
+// Destroying a range is cheap and releases the space, generating a snapshot may take minutes.
+const (
+	regionTaskPriorityGen     = 1
+	regionTaskPriorityApply   = 2
+	regionTaskPriorityDestroy = 3
+)
+
+func regionTaskPriority(tp taskType) int {
+	switch tp {
+	case taskTypeRegionApply:
+		return regionTaskPriorityApply
+	case taskTypeRegionDestroy, taskTypeRegionDestroyRange:
+		return regionTaskPriorityDestroy
+	}
+	return regionTaskPriorityGen
+}
+
+func regionTaskName(tp taskType) string {
+	switch tp {
+	case taskTypeRegionGen:
+		return "generate snapshot"
+	case taskTypeRegionApply:
+		return "apply snapshot"
+	case taskTypeRegionDestroy:
+		return "destroy"
+	case taskTypeRegionDestroyRange:
+		return "destroy range"
+	}
+	return "unknown"
+}
+
+// RegionTaskStarvedEvent is emitted when a region worker task waits longer than the starvation threshold.
+type RegionTaskStarvedEvent struct {
+	Task string
+	// RegionID is 0 for the destroy range tasks.
+	RegionID uint64
+	Priority int
+	Waited   time.Duration
+}
+
+// RegionTaskStarvedListener is called for every starved region worker task, it must not block.
+type RegionTaskStarvedListener func(event RegionTaskStarvedEvent)
+
+type regionTaskListeners struct {
+	mu        sync.Mutex
+	listeners []RegionTaskStarvedListener
+}
+
+func (l *regionTaskListeners) add(listener RegionTaskStarvedListener) {
+	l.mu.Lock()
+	listeners := make([]RegionTaskStarvedListener, 0, len(l.listeners)+1)
+	listeners = append(listeners, l.listeners...)
+	l.listeners = append(listeners, listener)
+	l.mu.Unlock()
+}
+
+func (l *regionTaskListeners) notify(event RegionTaskStarvedEvent) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	listeners := l.listeners
+	l.mu.Unlock()
+	for _, listener := range listeners {
+		listener(event)
+	}
+}
+
+type queuedRegionTask struct {
+	task     task
+	seq      uint64
+	enqueued time.Time
+	starved  bool
+}
+
+// regionTaskQueue orders the region worker tasks by priority. The priority of a task grows by one for
+// every aging interval it waits, so the low priority tasks still run under a steady flow of high
+// priority tasks. The tasks with the same priority run in the order they are received, so the snapshots
+// are still applied in order. The apply and destroy tasks of a region always run in the order they are
+// received, so a destroy never runs before an earlier apply of the region, the first of them takes the
+// highest priority of them instead.
+type regionTaskQueue struct {
+	// mu guards tasks for the backlog dump, the queue is only changed by the region worker.
+	mu                  sync.Mutex
+	tasks               []*queuedRegionTask
+	nextSeq             uint64
+	agingInterval       time.Duration
+	starvationThreshold time.Duration
+	listeners           *regionTaskListeners
+}
+
+func newRegionTaskQueue(cfg *Config, listeners *regionTaskListeners) *regionTaskQueue {
+	return &regionTaskQueue{
+		agingInterval:       cfg.RegionTaskAgingInterval,
+		starvationThreshold: cfg.RegionTaskStarvationThreshold,
+		listeners:           listeners,
+	}
+}
+
+func (q *regionTaskQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.tasks)
+}
+
+func (q *regionTaskQueue) push(t task, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.tasks = append(q.tasks, &queuedRegionTask{task: t, seq: q.nextSeq, enqueued: now})
+	q.nextSeq++
+}
+
+func (q *regionTaskQueue) priority(t *queuedRegionTask, now time.Time) int {
+	priority := regionTaskPriority(t.task.tp)
+	if q.agingInterval > 0 {
+		priority += int(now.Sub(t.enqueued) / q.agingInterval)
+	}
+	return priority
+}
+
+// pop removes and returns the task with the highest priority, the queue must not be empty.
+func (q *regionTaskQueue) pop(now time.Time) task {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	// heads are the first apply or destroy tasks of the regions.
+	var heads map[uint64]int
+	best, bestPriority := -1, 0
+	for i, t := range q.tasks {
+		idx := i
+		if t.task.tp == taskTypeRegionApply || t.task.tp == taskTypeRegionDestroy {
+			regionID := regionTaskRegionID(t.task)
+			if head, ok := heads[regionID]; ok {
+				idx = head
+			} else {
+				if heads == nil {
+					heads = make(map[uint64]int)
+				}
+				heads[regionID] = i
+			}
+		}
+		// The tasks are kept in the order of seq, so the earlier task wins a tie.
+		if priority := q.priority(t, now); best == -1 || priority > bestPriority ||
+			priority == bestPriority && idx < best {
+			best, bestPriority = idx, priority
+		}
+	}
+	t := q.tasks[best].task
+	copy(q.tasks[best:], q.tasks[best+1:])
+	q.tasks[len(q.tasks)-1] = nil
+	q.tasks = q.tasks[:len(q.tasks)-1]
+	return t
+}
+
+// checkStarvation emits an event for every task that has waited longer than the threshold, a task is
+// reported only once.
+func (q *regionTaskQueue) checkStarvation(now time.Time) {
+	if q.starvationThreshold <= 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, t := range q.tasks {
+		waited := now.Sub(t.enqueued)
+		if t.starved || waited < q.starvationThreshold {
+			continue
+		}
+		t.starved = true
+		event := RegionTaskStarvedEvent{
+			Task:     regionTaskName(t.task.tp),
+			RegionID: regionTaskRegionID(t.task),
+			Priority: q.priority(t, now),
+			Waited:   waited,
+		}
+		log.Warn("region worker task is starved", zap.String("task", event.Task),
+			zap.Uint64("region id", event.RegionID), zap.Int("priority", event.Priority),
+			zap.Duration("waited", waited), zap.Int("queued", len(q.tasks)))
+		q.listeners.notify(event)
+	}
+}
+
+func regionTaskRegionID(t task) uint64 {
+	switch data := t.data.(type) {
+	case *regionTask:
+		return data.regionID
+	case regionTask:
+		return data.regionID
+	}
+	return 0
+}
+
+// startPrioritized is like start but it receives all the pending tasks into the queue before handling
+// a task, so the task with the highest priority runs next.
+func (w *worker) startPrioritized(handler taskHandler, q *regionTaskQueue) {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		if s, ok := handler.(starter); ok {
+			s.start()
+		}
+		for {
+			if q.len() == 0 {
+				t := <-w.receiver
+				if t.tp == taskTypeStop {
+					return
+				}
+				q.push(t, time.Now())
+			}
+			for received := true; received; {
+				select {
+				case t := <-w.receiver:
+					if t.tp == taskTypeStop {
+						return
+					}
+					q.push(t, time.Now())
+				default:
+					received = false
+				}
+			}
+			now := time.Now()
+			q.checkStarvation(now)
+			handler.handle(q.pop(now))
+		}
+	}()
+}
+
+// AddRegionTaskStarvedListener registers a listener for the starved region worker tasks, it must be
+// called after Setup.
+func (ris *RaftInnerServer) AddRegionTaskStarvedListener(l RegionTaskStarvedListener) {
+	ris.router.regionTaskListeners.add(l)
+}
@@ -0,0 +1,283 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/store/mockstore/unistore/pd"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/mvcc"
+	"go.uber.org/zap"
+)
+
+// ReplicaState is the state of a replica of a region on a store. The Hash is the region hash of the
+// consistency check, it covers the data applied by the store when the state is taken.
+type ReplicaState struct {
+	StoreID         uint64         `json:"store_id"`
+	PeerID          uint64         `json:"peer_id"`
+	Region          *metapb.Region `json:"region"`
+	Term            uint64         `json:"term"`
+	AppliedIndex    uint64         `json:"applied_index"`
+	AppliedTerm     uint64         `json:"applied_term"`
+	ApproximateSize uint64         `json:"approximate_size"`
+	Hash            string         `json:"hash"`
+
+	// TruncatedIndex is the last index of the compacted raft log, the entries before CompactedIndex are
+	// deleted from the raft engine. They are not compared between the replicas.
+	TruncatedIndex uint64 `json:"truncated_index"`
+	CompactedIndex uint64 `json:"compacted_index"`
+}
+
+// MsgReplicaState asks a peer for its replica state. The callback is called by the raft worker with a
+// snapshot of the region data to hash, the callback must discard the snapshot.
+type MsgReplicaState struct {
+	Callback func(state ReplicaState, snap *mvcc.DBSnapshot)
+}
+
+func (d *peerMsgHandler) onReplicaState(msg *MsgReplicaState) {
+	state := ReplicaState{
+		StoreID:        d.storeID(),
+		PeerID:         d.peer.PeerID(),
+		Region:         d.region(),
+		Term:           d.peer.Term(),
+		AppliedIndex:   d.peer.Store().AppliedIndex(),
+		AppliedTerm:    d.peer.Store().appliedIndexTerm,
+		TruncatedIndex: d.peer.Store().truncatedIndex(),
+		CompactedIndex: d.peer.LastCompactedIdx,
+	}
+	if d.peer.ApproximateSize != nil {
+		state.ApproximateSize = *d.peer.ApproximateSize
+	}
+	msg.Callback(state, newRegionDataSnapshot(d.ctx.engine.kv, d.region()))
+}
+
+// ReplicaState returns the state of the replica of the region on the store. The hash is computed out of the
+// raft worker.
+func (r *Router) ReplicaState(ctx context.Context, regionID uint64) (*ReplicaState, error) {
+	type result struct {
+		state ReplicaState
+		snap  *mvcc.DBSnapshot
+	}
+	ch := make(chan result, 1)
+	// abandoned is set if the caller returns before the callback, the callback discards the snapshot then.
+	var (
+		mu        sync.Mutex
+		abandoned bool
+	)
+	err := r.router.send(regionID, NewPeerMsg(MsgTypeReplicaState, regionID, &MsgReplicaState{
+		Callback: func(state ReplicaState, snap *mvcc.DBSnapshot) {
+			mu.Lock()
+			defer mu.Unlock()
+			if abandoned {
+				snap.Txn.Discard()
+				return
+			}
+			ch <- result{state: state, snap: snap}
+		},
+	}))
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case res := <-ch:
+		defer res.snap.Txn.Discard()
+		res.state.Hash = hex.EncodeToString(computeRegionHash(res.state.Region, res.snap))
+		return &res.state, nil
+	case <-ctx.Done():
+		mu.Lock()
+		abandoned = true
+		select {
+		case res := <-ch:
+			res.snap.Txn.Discard()
+		default:
+		}
+		mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// ReplicaFetcher returns the replica state of the region on the store.
+type ReplicaFetcher func(ctx context.Context, storeID, regionID uint64) (*ReplicaState, error)
+
+// RegionConsistencyReport compares the replicas of a region. The replicas converge if they have the same
+// region epoch, applied index, applied term and hash.
+type RegionConsistencyReport struct {
+	RegionID uint64         `json:"region_id"`
+	Replicas []ReplicaState `json:"replicas"`
+	// Errors are the failures to fetch the replica states by store ID.
+	Errors     map[uint64]string `json:"errors,omitempty"`
+	Mismatches []string          `json:"mismatches,omitempty"`
+	Converged  bool              `json:"converged"`
+}
+
+// CheckRegionConsistency gathers the replica states of the region from the stores of its peers and compares
+// them. The peers are the ones of the region on this store, fetch is called for the other stores.
+func (r *Router) CheckRegionConsistency(ctx context.Context, regionID uint64, fetch ReplicaFetcher) (*RegionConsistencyReport, error) {
+	local, err := r.ReplicaState(ctx, regionID)
+	if err != nil {
+		return nil, err
+	}
+	report := &RegionConsistencyReport{RegionID: regionID, Replicas: []ReplicaState{*local}}
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, peer := range local.Region.GetPeers() {
+		if peer.StoreId == local.StoreID {
+			continue
+		}
+		wg.Add(1)
+		go func(storeID uint64) {
+			defer wg.Done()
+			state, err := fetch(ctx, storeID, regionID)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if report.Errors == nil {
+					report.Errors = make(map[uint64]string)
+				}
+				report.Errors[storeID] = err.Error()
+				return
+			}
+			report.Replicas = append(report.Replicas, *state)
+		}(peer.StoreId)
+	}
+	wg.Wait()
+	report.compare()
+	return report, nil
+}
+
+func (report *RegionConsistencyReport) compare() {
+	sort.Slice(report.Replicas, func(i, j int) bool {
+		return report.Replicas[i].StoreID < report.Replicas[j].StoreID
+	})
+	base := report.Replicas[0]
+	for _, replica := range report.Replicas[1:] {
+		mismatch := func(what string, baseVal, val interface{}) {
+			report.Mismatches = append(report.Mismatches, fmt.Sprintf("%s of store %d is %v, but %v on store %d",
+				what, replica.StoreID, val, baseVal, base.StoreID))
+		}
+		baseEpoch, epoch := base.Region.GetRegionEpoch(), replica.Region.GetRegionEpoch()
+		if baseEpoch.GetVersion() != epoch.GetVersion() || baseEpoch.GetConfVer() != epoch.GetConfVer() {
+			mismatch("epoch", epochString(baseEpoch), epochString(epoch))
+		}
+		if base.AppliedIndex != replica.AppliedIndex {
+			mismatch("applied index", base.AppliedIndex, replica.AppliedIndex)
+			continue
+		}
+		if base.AppliedTerm != replica.AppliedTerm {
+			mismatch("applied term", base.AppliedTerm, replica.AppliedTerm)
+		}
+		// The hashes are comparable only at the same applied index.
+		if base.Hash != replica.Hash {
+			mismatch("hash", base.Hash, replica.Hash)
+		}
+	}
+	report.Converged = len(report.Errors) == 0 && len(report.Mismatches) == 0
+}
+
+func epochString(epoch *metapb.RegionEpoch) string {
+	return fmt.Sprintf("conf_ver %d version %d", epoch.GetConfVer(), epoch.GetVersion())
+}
+
+// NewHTTPReplicaFetcher returns a ReplicaFetcher getting the replica states from the status servers of the
+// stores, the status addresses are resolved by PD.
+func NewHTTPReplicaFetcher(pdClient pd.Client) ReplicaFetcher {
+	return func(ctx context.Context, storeID, regionID uint64) (*ReplicaState, error) {
+		store, err := pdClient.GetStore(ctx, storeID)
+		if err != nil {
+			return nil, err
+		}
+		if store.GetStatusAddress() == "" {
+			return nil, errors.Errorf("store %d has no status address", storeID)
+		}
+		url := fmt.Sprintf("http://%s/regions/replica_state?region=%d", store.GetStatusAddress(), regionID)
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.Errorf("store %d responds %s", storeID, resp.Status)
+		}
+		state := new(ReplicaState)
+		if err = json.NewDecoder(resp.Body).Decode(state); err != nil {
+			return nil, err
+		}
+		return state, nil
+	}
+}
+
+func parseRegionID(w http.ResponseWriter, req *http.Request) (uint64, bool) {
+	regionID, err := strconv.ParseUint(req.FormValue("region"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return 0, false
+	}
+	return regionID, true
+}
+
+// ReplicaStateHandler serves the replica state of the region "?region=ID" on the store as JSON for the
+// status server.
+func (r *Router) ReplicaStateHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		regionID, ok := parseRegionID(w, req)
+		if !ok {
+			return
+		}
+		state, err := r.ReplicaState(req.Context(), regionID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(state); err != nil {
+			log.Warn("failed to encode replica state", zap.Error(err))
+		}
+	})
+}
+
+// RegionConsistencyHandler serves the consistency report of the region "?region=ID" as JSON for the status
+// server, the replica states of the other stores are fetched by fetch.
+func (r *Router) RegionConsistencyHandler(fetch ReplicaFetcher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		regionID, ok := parseRegionID(w, req)
+		if !ok {
+			return
+		}
+		report, err := r.CheckRegionConsistency(req.Context(), regionID, fetch)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			log.Warn("failed to encode region consistency report", zap.Error(err))
+		}
+	})
+}
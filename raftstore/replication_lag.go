@@ -0,0 +1,199 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pingcap/log"
+	"github.com/zhangjinpeng1987/raft"
+	"go.uber.org/zap"
+)
+
+// FollowerLag is the replication progress of a follower or a learner seen by the leader.
+type FollowerLag struct {
+	PeerID  uint64
+	StoreID uint64
+	Learner bool
+	Match   uint64
+	Next    uint64
+	// Gap is the number of log entries the follower is behind the last index of the leader.
+	Gap uint64
+	// State is one of probe, replicate and snapshot.
+	State           string
+	Paused          bool
+	PendingSnapshot uint64
+	RecentActive    bool
+
+	// The replication window of the follower tuned by Config.RaftAdaptiveFlowControl, MaxInflight is 0 if
+	// the window is not tuned. Held is the number of the messages over the window, DropRate is the ratio of
+	// the messages lost in the last tick.
+	MaxInflight   int
+	MaxSizePerMsg uint64
+	Inflight      int
+	Held          int
+	AckLatency    time.Duration
+	DropRate      float64
+}
+
+// RegionReplicationLag is the replication progress of the followers of a leader region.
+type RegionReplicationLag struct {
+	RegionID  uint64
+	LeaderID  uint64
+	Term      uint64
+	LastIndex uint64
+	Commit    uint64
+	Applied   uint64
+	// MaxGap is the largest gap of the followers.
+	MaxGap    uint64
+	Followers []FollowerLag
+}
+
+// updateReplicationLag takes the replication progress from the raft status on every raft base tick, so it
+// can be loaded by the status server without touching the raft group owned by the raft worker.
+func (p *Peer) updateReplicationLag() {
+	if !p.IsLeader() {
+		if p.replicationLag.Load() != (*RegionReplicationLag)(nil) {
+			p.replicationLag.Store((*RegionReplicationLag)(nil))
+		}
+		p.followerLags = nil
+		return
+	}
+	status := p.RaftGroup.Status()
+	lastIndex := p.RaftGroup.Raft.RaftLog.LastIndex()
+	lag := &RegionReplicationLag{
+		RegionID:  p.regionID,
+		LeaderID:  status.ID,
+		Term:      status.Term,
+		LastIndex: lastIndex,
+		Commit:    status.Commit,
+		Applied:   status.Applied,
+		Followers: make([]FollowerLag, 0, len(status.Progress)),
+	}
+	now := time.Now()
+	for id, pr := range status.Progress {
+		if id == status.ID {
+			continue
+		}
+		p.observeFollowerLag(id, pr.Match, lastIndex, now)
+		follower := FollowerLag{
+			PeerID:          id,
+			Learner:         pr.IsLearner,
+			Match:           pr.Match,
+			Next:            pr.Next,
+			State:           pr.State.String(),
+			Paused:          pr.Paused,
+			PendingSnapshot: pr.PendingSnapshot,
+			RecentActive:    pr.RecentActive,
+		}
+		if peer := p.getPeerFromCache(id); peer != nil {
+			follower.StoreID = peer.StoreId
+		}
+		if f := p.flowControl.get(id); f != nil {
+			follower.MaxInflight, follower.MaxSizePerMsg = f.maxInflight, f.maxSize
+			follower.Inflight, follower.Held = len(f.inflights), len(f.held)
+			follower.AckLatency, follower.DropRate = f.ackLatency, f.dropRate
+		}
+		if lastIndex > pr.Match {
+			follower.Gap = lastIndex - pr.Match
+		}
+		if follower.Gap > lag.MaxGap {
+			lag.MaxGap = follower.Gap
+		}
+		lag.Followers = append(lag.Followers, follower)
+	}
+	sort.Slice(lag.Followers, func(i, j int) bool {
+		return lag.Followers[i].PeerID < lag.Followers[j].PeerID
+	})
+	p.replicationLag.Store(lag)
+}
+
+func (p *Peer) loadReplicationLag() *RegionReplicationLag {
+	lag, _ := p.replicationLag.Load().(*RegionReplicationLag)
+	return lag
+}
+
+// isProbing returns true if the leader doesn't know the match index of the follower.
+func (f *FollowerLag) isProbing() bool {
+	return f.State == raft.ProgressStateProbe.String()
+}
+
+// ReplicationLag returns the replication progress of the region, it returns nil if the peer is not the leader.
+func (r *Router) ReplicationLag(regionID uint64) (*RegionReplicationLag, error) {
+	p := r.router.get(regionID)
+	if p == nil {
+		return nil, errPeerNotFound
+	}
+	return p.peer.peer.loadReplicationLag(), nil
+}
+
+// ReplicationLagReport returns the replication progress of all the leader regions on the store, the
+// regions with the largest gap come first, so the stragglers are easy to find.
+func (r *Router) ReplicationLagReport() []*RegionReplicationLag {
+	var report []*RegionReplicationLag
+	r.router.peers.Range(func(key, value interface{}) bool {
+		if lag := value.(*peerState).peer.peer.loadReplicationLag(); lag != nil {
+			report = append(report, lag)
+		}
+		return true
+	})
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].MaxGap != report[j].MaxGap {
+			return report[i].MaxGap > report[j].MaxGap
+		}
+		return report[i].RegionID < report[j].RegionID
+	})
+	return report
+}
+
+// ReplicationLagHandler serves the replication lag report as JSON for the status server, the
+// min_gap query parameter skips the regions whose max gap is smaller, the probe query parameter
+// keeps only the regions having a follower in the probe state.
+func (r *Router) ReplicationLagHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var minGap uint64
+		if gapStr := req.URL.Query().Get("min_gap"); gapStr != "" {
+			var err error
+			if minGap, err = strconv.ParseUint(gapStr, 10, 64); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		probeOnly := req.URL.Query().Get("probe") != ""
+		report := make([]*RegionReplicationLag, 0)
+		for _, lag := range r.ReplicationLagReport() {
+			if lag.MaxGap < minGap || probeOnly && !lag.hasProbingFollower() {
+				continue
+			}
+			report = append(report, lag)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			log.Warn("failed to encode replication lag", zap.Error(err))
+		}
+	})
+}
+
+func (lag *RegionReplicationLag) hasProbingFollower() bool {
+	for i := range lag.Followers {
+		if lag.Followers[i].isProbing() {
+			return true
+		}
+	}
+	return false
+}
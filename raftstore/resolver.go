@@ -0,0 +1,206 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/store/mockstore/unistore/pd"
+	"go.uber.org/zap"
+)
+
+// StoreResolver resolves a store ID to its network address.
+type StoreResolver interface {
+	Resolve(storeID uint64) (string, error)
+	// Invalidate drops any cached address of the store, it is called when sending to the store fails.
+	Invalidate(storeID uint64)
+}
+
+// PDStoreResolver resolves store addresses by querying PD.
+type PDStoreResolver struct {
+	pdCli pd.Client
+}
+
+// NewPDStoreResolver creates a new PDStoreResolver.
+func NewPDStoreResolver(pdCli pd.Client) *PDStoreResolver {
+	return &PDStoreResolver{pdCli: pdCli}
+}
+
+// Resolve implements the StoreResolver Resolve method.
+func (r *PDStoreResolver) Resolve(storeID uint64) (string, error) {
+	return getStoreAddr(storeID, r.pdCli)
+}
+
+// Invalidate implements the StoreResolver Invalidate method.
+func (r *PDStoreResolver) Invalidate(storeID uint64) {}
+
+// StaticStoreResolver resolves store addresses from an address book, the address book can be
+// modified at runtime to simulate store movement.
+type StaticStoreResolver struct {
+	mu    sync.RWMutex
+	addrs map[uint64]string
+}
+
+// NewStaticStoreResolver creates a new StaticStoreResolver with the given address book.
+func NewStaticStoreResolver(addrs map[uint64]string) *StaticStoreResolver {
+	r := &StaticStoreResolver{addrs: make(map[uint64]string, len(addrs))}
+	for id, addr := range addrs {
+		r.addrs[id] = addr
+	}
+	return r
+}
+
+// SetAddr sets the address of the store.
+func (r *StaticStoreResolver) SetAddr(storeID uint64, addr string) {
+	r.mu.Lock()
+	r.addrs[storeID] = addr
+	r.mu.Unlock()
+}
+
+// RemoveAddr removes the store from the address book.
+func (r *StaticStoreResolver) RemoveAddr(storeID uint64) {
+	r.mu.Lock()
+	delete(r.addrs, storeID)
+	r.mu.Unlock()
+}
+
+// Resolve implements the StoreResolver Resolve method.
+func (r *StaticStoreResolver) Resolve(storeID uint64) (string, error) {
+	r.mu.RLock()
+	addr, ok := r.addrs[storeID]
+	r.mu.RUnlock()
+	if !ok {
+		return "", errors.Errorf("no address for store %d", storeID)
+	}
+	return addr, nil
+}
+
+// Invalidate implements the StoreResolver Invalidate method.
+func (r *StaticStoreResolver) Invalidate(storeID uint64) {}
+
+// DNSStoreResolver resolves the host name of the address returned by the upstream resolver to an IP address.
+type DNSStoreResolver struct {
+	upstream   StoreResolver
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+}
+
+// NewDNSStoreResolver creates a new DNSStoreResolver.
+func NewDNSStoreResolver(upstream StoreResolver) *DNSStoreResolver {
+	return &DNSStoreResolver{
+		upstream:   upstream,
+		lookupHost: net.DefaultResolver.LookupHost,
+	}
+}
+
+// Resolve implements the StoreResolver Resolve method.
+func (r *DNSStoreResolver) Resolve(storeID uint64) (string, error) {
+	addr, err := r.upstream.Resolve(storeID)
+	if err != nil {
+		return "", err
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if net.ParseIP(host) != nil {
+		return addr, nil
+	}
+	ips, err := r.lookupHost(context.TODO(), host)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if len(ips) == 0 {
+		return "", errors.Errorf("no ip found for host %s of store %d", host, storeID)
+	}
+	return net.JoinHostPort(ips[0], port), nil
+}
+
+// Invalidate implements the StoreResolver Invalidate method.
+func (r *DNSStoreResolver) Invalidate(storeID uint64) {
+	r.upstream.Invalidate(storeID)
+}
+
+type cachedStoreAddr struct {
+	addr       string
+	resolvedAt time.Time
+}
+
+// CachedStoreResolver caches the addresses resolved by the upstream resolver for a TTL.
+type CachedStoreResolver struct {
+	upstream StoreResolver
+	ttl      time.Duration
+
+	mu    sync.Mutex
+	cache map[uint64]cachedStoreAddr
+}
+
+// NewCachedStoreResolver creates a new CachedStoreResolver.
+func NewCachedStoreResolver(upstream StoreResolver, ttl time.Duration) *CachedStoreResolver {
+	return &CachedStoreResolver{
+		upstream: upstream,
+		ttl:      ttl,
+		cache:    make(map[uint64]cachedStoreAddr),
+	}
+}
+
+// Resolve implements the StoreResolver Resolve method.
+func (r *CachedStoreResolver) Resolve(storeID uint64) (string, error) {
+	r.mu.Lock()
+	cached, ok := r.cache[storeID]
+	r.mu.Unlock()
+	if ok && time.Since(cached.resolvedAt) < r.ttl {
+		return cached.addr, nil
+	}
+	addr, err := r.upstream.Resolve(storeID)
+	if err != nil {
+		return "", err
+	}
+	if ok && cached.addr != addr {
+		log.Info("store address changed", zap.Uint64("store id", storeID),
+			zap.String("old addr", cached.addr), zap.String("new addr", addr))
+	}
+	r.mu.Lock()
+	r.cache[storeID] = cachedStoreAddr{addr: addr, resolvedAt: time.Now()}
+	r.mu.Unlock()
+	return addr, nil
+}
+
+// Invalidate implements the StoreResolver Invalidate method.
+func (r *CachedStoreResolver) Invalidate(storeID uint64) {
+	r.mu.Lock()
+	delete(r.cache, storeID)
+	r.mu.Unlock()
+	r.upstream.Invalidate(storeID)
+}
+
+func getStoreAddr(id uint64, pdCli pd.Client) (string, error) {
+	store, err := pdCli.GetStore(context.TODO(), id)
+	if err != nil {
+		return "", err
+	}
+	if store.GetState() == metapb.StoreState_Tombstone {
+		return "", errors.Errorf("store %d has been removed", id)
+	}
+	addr := store.GetAddress()
+	if addr == "" {
+		return "", errors.Errorf("invalid empty address for store %d", id)
+	}
+	return addr, nil
+}
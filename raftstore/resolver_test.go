@@ -0,0 +1,74 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachedStoreResolver(t *testing.T) {
+	static := NewStaticStoreResolver(map[uint64]string{1: "127.0.0.1:20160"})
+	resolver := NewCachedStoreResolver(static, time.Hour)
+
+	addr, err := resolver.Resolve(1)
+	require.Nil(t, err)
+	assert.Equal(t, "127.0.0.1:20160", addr)
+	_, err = resolver.Resolve(2)
+	assert.NotNil(t, err)
+
+	// The cached address is used until it is invalidated.
+	static.SetAddr(1, "127.0.0.1:20161")
+	addr, err = resolver.Resolve(1)
+	require.Nil(t, err)
+	assert.Equal(t, "127.0.0.1:20160", addr)
+	resolver.Invalidate(1)
+	addr, err = resolver.Resolve(1)
+	require.Nil(t, err)
+	assert.Equal(t, "127.0.0.1:20161", addr)
+
+	// The cached address expires after the TTL.
+	resolver = NewCachedStoreResolver(static, 0)
+	static.SetAddr(1, "127.0.0.1:20162")
+	addr, err = resolver.Resolve(1)
+	require.Nil(t, err)
+	assert.Equal(t, "127.0.0.1:20162", addr)
+	static.RemoveAddr(1)
+	_, err = resolver.Resolve(1)
+	assert.NotNil(t, err)
+}
+
+func TestDNSStoreResolver(t *testing.T) {
+	static := NewStaticStoreResolver(map[uint64]string{1: "store1:20160", 2: "10.0.0.2:20160", 3: "store3:20160"})
+	resolver := NewDNSStoreResolver(static)
+	resolver.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		if host == "store1" {
+			return []string{"10.0.0.1"}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	addr, err := resolver.Resolve(1)
+	require.Nil(t, err)
+	assert.Equal(t, "10.0.0.1:20160", addr)
+	addr, err = resolver.Resolve(2)
+	require.Nil(t, err)
+	assert.Equal(t, "10.0.0.2:20160", addr)
+	_, err = resolver.Resolve(3)
+	assert.NotNil(t, err)
+}
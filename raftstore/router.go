@@ -32,13 +32,47 @@ type router struct {
 	peerSender  chan Msg
 	storeSender chan<- Msg
 	storeFsm    *storeFsm
+	// mailboxCapacity limits the pending raft commands of a peer for trySendRaftCommand.
+	mailboxCapacity     int64
+	adminObservers      *adminObservers
+	regionTaskListeners *regionTaskListeners
+	adminFaults         *adminFaultInjector
+	maxTS               *maxTS
+	// regionTasks and regionTaskSender are the queue and the channel of the region worker, they are nil
+	// before the workers are started.
+	regionTasks      *regionTaskQueue
+	regionTaskSender chan<- task
+	// readYourWrites verifies the reads of the client sessions, nil means disabled.
+	readYourWrites *ReadYourWritesVerifier
+	// history holds the HistoryRecorder of the commands sent through the Router.
+	history     atomic.Value
+	checkpoints regionCheckpoints
+	// ingestLimiter is shared by the snapshot applying and the SST imports of the store.
+	ingestLimiter *IngestLimiter
+	// genealogy records the splits and the merges applied on the store.
+	genealogy regionGenealogy
+	// droppedProposals counts the proposals and the reads dropped by the peers of the store.
+	droppedProposals dropCounter
+	// maxLeaderLease is the max leader lease in nanoseconds set at runtime, 0 means
+	// Config.RaftStoreMaxLeaderLease.
+	maxLeaderLease int64
+	// invariants counts the invariant checks and the violations of the store.
+	invariants invariantChecker
+	// recovery keeps the progress of recovering the regions when the store starts.
+	recovery recoveryTracker
+	// messageFilters filter the raft messages sent and received by the store.
+	messageFilters messageFilters
 }
 
 func newRouter(storeSender chan<- Msg, storeFsm *storeFsm) *router {
 	pm := &router{
-		peerSender:  make(chan Msg, 4096),
-		storeSender: storeSender,
-		storeFsm:    storeFsm,
+		peerSender:          make(chan Msg, 4096),
+		storeSender:         storeSender,
+		storeFsm:            storeFsm,
+		adminObservers:      new(adminObservers),
+		regionTaskListeners: new(regionTaskListeners),
+		adminFaults:         new(adminFaultInjector),
+		maxTS:               new(maxTS),
 	}
 	return pm
 }
@@ -53,6 +87,11 @@ func (pr *router) get(regionID uint64) *peerState {
 
 func (pr *router) register(peer *peerFsm) {
 	id := peer.peer.regionID
+	peer.peer.droppedProposals = &pr.droppedProposals
+	peer.peer.invariants = &pr.invariants
+	if maxLease := atomic.LoadInt64(&pr.maxLeaderLease); maxLease > 0 {
+		peer.peer.leaderLease.SetMaxLease(time.Duration(maxLease))
+	}
 	apply := newApplierFromPeer(peer)
 	newPeer := &peerState{
 		peer:  peer,
@@ -76,16 +115,52 @@ func (pr *router) send(regionID uint64, msg Msg) error {
 	if p == nil || atomic.LoadUint32(&p.closed) == 1 {
 		return errPeerNotFound
 	}
+	p.mailbox.push(msg.Type)
 	pr.peerSender <- msg
 	return nil
 }
 
 func (pr *router) sendRaftCommand(cmd *MsgRaftCmd) error {
 	regionID := cmd.Request.RegionID()
-	return pr.send(regionID, NewPeerMsg(MsgTypeRaftCmd, regionID, cmd))
+	p := pr.get(regionID)
+	if p == nil || atomic.LoadUint32(&p.closed) == 1 {
+		return errPeerNotFound
+	}
+	cmd.pending = &p.pendingCmds
+	atomic.AddInt64(cmd.pending, 1)
+	p.mailbox.push(MsgTypeRaftCmd)
+	pr.peerSender <- NewPeerMsg(MsgTypeRaftCmd, regionID, cmd)
+	return nil
+}
+
+// trySendRaftCommand returns ErrQueueFull instead of blocking if the peer has too many pending
+// commands or the peer channel is full.
+func (pr *router) trySendRaftCommand(cmd *MsgRaftCmd) error {
+	regionID := cmd.Request.RegionID()
+	p := pr.get(regionID)
+	if p == nil || atomic.LoadUint32(&p.closed) == 1 {
+		return errPeerNotFound
+	}
+	cmd.pending = &p.pendingCmds
+	pending := atomic.AddInt64(cmd.pending, 1)
+	if pr.mailboxCapacity > 0 && pending > pr.mailboxCapacity {
+		atomic.AddInt64(cmd.pending, -1)
+		return &ErrQueueFull{RegionID: regionID, Pending: pending - 1}
+	}
+	seq := p.mailbox.push(MsgTypeRaftCmd)
+	select {
+	case pr.peerSender <- NewPeerMsg(MsgTypeRaftCmd, regionID, cmd):
+		return nil
+	default:
+		p.mailbox.remove(seq)
+		return &ErrQueueFull{RegionID: regionID, Pending: atomic.AddInt64(cmd.pending, -1)}
+	}
 }
 
 func (pr *router) sendRaftMessage(msg *raft_serverpb.RaftMessage) error {
+	if !pr.messageFilters.pass(MessageInbound, msg) {
+		return nil
+	}
 	regionID := msg.RegionId
 	if pr.send(regionID, NewPeerMsg(MsgTypeRaftMessage, regionID, msg)) != nil {
 		pr.sendStore(NewPeerMsg(MsgTypeStoreRaftMessage, regionID, msg))
@@ -106,12 +181,59 @@ type Router struct {
 // SendCommand sends the RaftCmdRequest with the given Callback.
 func (r *Router) SendCommand(req *raft_cmdpb.RaftCmdRequest, cb *Callback) error {
 	// TODO: support local reader
+	if h := r.router.historyRecorder(); h != nil {
+		h.invoke(req, cb)
+	}
+	msg := &MsgRaftCmd{
+		SendTime: time.Now(),
+		Request:  raftlog.NewRequest(req),
+		Callback: cb,
+	}
+	err := r.router.sendRaftCommand(msg)
+	if err != nil {
+		cb.onDone = nil
+	}
+	return err
+}
+
+// TrySendRaftCommand sends the RaftCmdRequest like SendCommand, but fails fast with ErrQueueFull
+// instead of blocking when the peer mailbox is saturated.
+func (r *Router) TrySendRaftCommand(req *raft_cmdpb.RaftCmdRequest, cb *Callback) error {
+	if h := r.router.historyRecorder(); h != nil {
+		h.invoke(req, cb)
+	}
 	msg := &MsgRaftCmd{
 		SendTime: time.Now(),
 		Request:  raftlog.NewRequest(req),
 		Callback: cb,
 	}
-	return r.router.sendRaftCommand(msg)
+	err := r.router.trySendRaftCommand(msg)
+	if err != nil {
+		cb.onDone = nil
+	}
+	return err
+}
+
+// MailboxDepth returns the number of pending raft commands of the region.
+func (r *Router) MailboxDepth(regionID uint64) (int64, error) {
+	p := r.router.get(regionID)
+	if p == nil {
+		return 0, errPeerNotFound
+	}
+	return atomic.LoadInt64(&p.pendingCmds), nil
+}
+
+// MailboxDepths returns the number of pending raft commands of all the regions with pending commands,
+// and the number of messages queued in the shared peer channel.
+func (r *Router) MailboxDepths() (map[uint64]int64, int) {
+	depths := make(map[uint64]int64)
+	r.router.peers.Range(func(key, value interface{}) bool {
+		if pending := atomic.LoadInt64(&value.(*peerState).pendingCmds); pending > 0 {
+			depths[key.(uint64)] = pending
+		}
+		return true
+	})
+	return depths, len(r.router.peerSender)
 }
 
 // SplitRegion splits region by the split keys.
@@ -130,4 +252,62 @@ func (r *Router) SplitRegion(ctx *kvrpcpb.Context, keys [][]byte) ([]*metapb.Reg
 	return cb.resp.GetAdminResponse().GetSplits().GetRegions(), nil
 }
 
+// TransferLeader asks the leader of the region on this store to transfer the leadership to the peer, it
+// returns once the leader starts the transfer, the transfer may still fail if the peer doesn't catch up.
+func (r *Router) TransferLeader(ctx *kvrpcpb.Context, peer *metapb.Peer) error {
+	cb := NewCallback()
+	err := r.SendCommand(&raft_cmdpb.RaftCmdRequest{
+		Header: &raft_cmdpb.RaftRequestHeader{
+			RegionId:    ctx.RegionId,
+			Peer:        ctx.Peer,
+			RegionEpoch: ctx.RegionEpoch,
+		},
+		AdminRequest: &raft_cmdpb.AdminRequest{
+			CmdType:        raft_cmdpb.AdminCmdType_TransferLeader,
+			TransferLeader: &raft_cmdpb.TransferLeaderRequest{Peer: peer},
+		},
+	}, cb)
+	if err != nil {
+		return err
+	}
+	cb.wg.Wait()
+	if pbErr := cb.resp.GetHeader().GetError(); pbErr != nil {
+		return errors.New(pbErr.Message)
+	}
+	return nil
+}
+
+// ReadIndexMetrics returns the ReadIndex queue metrics of the region.
+func (r *Router) ReadIndexMetrics(regionID uint64) (ReadIndexMetrics, error) {
+	p := r.router.get(regionID)
+	if p == nil {
+		return ReadIndexMetrics{}, errPeerNotFound
+	}
+	return p.peer.peer.pendingReads.Metrics(), nil
+}
+
+// ApplyGapMetrics returns the apply gap metrics of the region.
+func (r *Router) ApplyGapMetrics(regionID uint64) (ApplyGapMetrics, error) {
+	p := r.router.get(regionID)
+	if p == nil {
+		return ApplyGapMetrics{}, errPeerNotFound
+	}
+	return p.peer.peer.ApplyGapMetrics(), nil
+}
+
+// ControlLease forces the leader lease of the region to be expired or suspect, so the stale read
+// prevention can be tested deterministically. It requires Config.EnableLeaseControl.
+func (r *Router) ControlLease(regionID uint64, op LeaseControlOp) error {
+	cb := NewCallback()
+	err := r.router.send(regionID, Msg{Type: MsgTypeLeaseControl, Data: &MsgLeaseControl{Op: op, Callback: cb}})
+	if err != nil {
+		return err
+	}
+	cb.wg.Wait()
+	if pbErr := cb.resp.GetHeader().GetError(); pbErr != nil {
+		return errors.New(pbErr.Message)
+	}
+	return nil
+}
+
 var errPeerNotFound = errors.New("peer not found")
@@ -0,0 +1,188 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/pingcap/badger"
+	"github.com/pingcap/badger/y"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// SchedulerState is the command scheduling state of a region saved when the store shuts down. The commands
+// proposed in (AppliedIndex, LastProposedIndex] were in flight, their callbacks are failed with RegionNotFound,
+// so the clients should read the result again before retrying them.
+type SchedulerState struct {
+	LastProposedIndex uint64
+	AppliedIndex      uint64
+	// OutstandingCallbacks is the number of the callbacks failed by the shutdown.
+	OutstandingCallbacks uint64
+}
+
+// Marshal encodes the state.
+func (s SchedulerState) Marshal() []byte {
+	bin := make([]byte, 24)
+	binary.LittleEndian.PutUint64(bin, s.LastProposedIndex)
+	binary.LittleEndian.PutUint64(bin[8:], s.AppliedIndex)
+	binary.LittleEndian.PutUint64(bin[16:], s.OutstandingCallbacks)
+	return bin
+}
+
+// Unmarshal decodes the state.
+func (s *SchedulerState) Unmarshal(data []byte) {
+	s.LastProposedIndex = binary.LittleEndian.Uint64(data)
+	s.AppliedIndex = binary.LittleEndian.Uint64(data[8:])
+	s.OutstandingCallbacks = binary.LittleEndian.Uint64(data[16:])
+}
+
+func (s SchedulerState) String() string {
+	return fmt.Sprintf("{lastProposedIndex:%d, appliedIndex:%d, outstandingCallbacks:%d}",
+		s.LastProposedIndex, s.AppliedIndex, s.OutstandingCallbacks)
+}
+
+// recoverSchedulerState loads the state saved by the last shutdown and deletes it, so a crash after the
+// restart is not mistaken for a clean shutdown.
+func (p *Peer) recoverSchedulerState(raftWB *WriteBatch) error {
+	val, err := getValue(p.peerStorage.Engines.raft, SchedulerStateKey(p.regionID))
+	if err == badger.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	state := new(SchedulerState)
+	state.Unmarshal(val)
+	p.lastShutdown = state
+	raftWB.Delete(y.KeyWithTs(SchedulerStateKey(p.regionID), RaftTS))
+	if state.OutstandingCallbacks > 0 {
+		log.Info("recovered scheduler state", zap.Uint64("region", p.regionID), zap.Stringer("state", state))
+	}
+	return nil
+}
+
+// failPendingCallbacks fails the callbacks of the commands left by the stopped workers and saves the
+// scheduler state of the regions, it must be called after the raft worker and the apply worker exit.
+func (bs *raftBatchSystem) failPendingCallbacks() {
+	outstanding := make(map[uint64]uint64)
+	failMsg := func(msg Msg) {
+		if msg.Type != MsgTypeRaftCmd {
+			return
+		}
+		cmd := msg.Data.(*MsgRaftCmd)
+		if cmd.Callback != nil {
+			outstanding[msg.RegionID]++
+		}
+		notifyReqRegionRemoved(msg.RegionID, cmd.Callback)
+	}
+	for pending := len(bs.router.peerSender); pending > 0; pending-- {
+		failMsg(<-bs.router.peerSender)
+	}
+	if bs.raftWorker != nil {
+		for _, held := range bs.raftWorker.paused {
+			for _, msg := range held {
+				failMsg(msg)
+			}
+		}
+		bs.raftWorker.paused = make(map[uint64][]Msg)
+	}
+	raftWB := new(WriteBatch)
+	bs.router.peers.Range(func(key, value interface{}) bool {
+		ps := value.(*peerState)
+		regionID := key.(uint64)
+		state := SchedulerState{OutstandingCallbacks: outstanding[regionID]}
+		state.OutstandingCallbacks += ps.peer.peer.failPendingCallbacks()
+		if ps.apply != nil {
+			state.OutstandingCallbacks += ps.apply.failPendingCmds()
+			state.AppliedIndex = ps.apply.applyState.appliedIndex
+		}
+		if ps.peer.stopped {
+			return true
+		}
+		state.LastProposedIndex = ps.peer.peer.RaftGroup.Raft.RaftLog.LastIndex()
+		raftWB.Set(y.KeyWithTs(SchedulerStateKey(regionID), RaftTS), state.Marshal())
+		return true
+	})
+	if err := raftWB.WriteToRaft(bs.ctx.engine.raft); err != nil {
+		log.Error("failed to save scheduler state", zap.Error(err))
+	}
+}
+
+// failPendingCallbacks fails the callbacks of the proposals, the reads and the ForceLeader state of the peer,
+// it returns the number of the callbacks.
+func (p *Peer) failPendingCallbacks() (n uint64) {
+	for _, prop := range p.applyProposals {
+		if prop.cb != nil {
+			n++
+		}
+		notifyReqRegionRemoved(p.regionID, prop.cb)
+	}
+	p.applyProposals = nil
+	for _, read := range p.pendingReads.reads {
+		for _, reqCb := range read.cmds {
+			if reqCb.Cb != nil {
+				n++
+			}
+			notifyReqRegionRemoved(p.regionID, reqCb.Cb)
+		}
+	}
+	p.pendingReads.reads = nil
+	p.pendingReads.readyCnt = 0
+	for _, cmd := range p.snapWaiters {
+		if cmd.Callback != nil {
+			n++
+		}
+		notifyReqRegionRemoved(p.regionID, cmd.Callback)
+	}
+	p.snapWaiters = nil
+	if p.forceLeader != nil {
+		n++
+		notifyReqRegionRemoved(p.regionID, p.forceLeader.cb)
+		p.forceLeader = nil
+	}
+	return n
+}
+
+// failPendingCmds fails the callbacks of the commands waiting to be applied, it returns the number of the
+// callbacks.
+func (a *applier) failPendingCmds() (n uint64) {
+	cmds := a.pendingCmds.normals
+	if cmd := a.pendingCmds.takeConfChange(); cmd != nil {
+		cmds = append(cmds, *cmd)
+	}
+	for _, cmd := range cmds {
+		if cmd.cb != nil {
+			n++
+		}
+		notifyRegionRemoved(a.region.Id, a.id, cmd)
+	}
+	a.pendingCmds.normals = nil
+	return n
+}
+
+// LastShutdownState returns the scheduler state of the region saved by the last shutdown of the store, false
+// if the store didn't shut down cleanly or the peer is created after the restart.
+func (r *Router) LastShutdownState(regionID uint64) (SchedulerState, bool, error) {
+	p := r.router.get(regionID)
+	if p == nil {
+		return SchedulerState{}, false, errPeerNotFound
+	}
+	state := p.peer.peer.lastShutdown
+	if state == nil {
+		return SchedulerState{}, false, nil
+	}
+	return *state, true, nil
+}
@@ -16,12 +16,15 @@ package raftstore
 import (
 	"context"
 	"encoding/binary"
+	"io"
 	"path/filepath"
 	"sync"
 	"time"
 
 	"github.com/ngaut/unistore/config"
+	"github.com/pingcap/errors"
 	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/raft_serverpb"
 	"github.com/pingcap/kvproto/pkg/tikvpb"
 	"github.com/pingcap/log"
 	"github.com/pingcap/tidb/store/mockstore/unistore/pd"
@@ -44,6 +47,14 @@ type RaftInnerServer struct {
 	snapWorker  *worker
 	lsDumper    *lockStoreDumper
 	raftCli     *RaftClient
+	resolver    StoreResolver
+	// wrapTransport wraps the transport of the raft messages, like a WANTransport.
+	wrapTransport func(Transport) Transport
+	// readPool runs the reads of the store, nil if Config.ReadPoolSize is 0.
+	readPool *ReadPool
+
+	destroyRangeMu        sync.Mutex
+	destroyRangeListeners []DestroyRangeListener
 }
 
 // Raft implements the tikv.InnerServer Raft method.
@@ -51,10 +62,13 @@ func (ris *RaftInnerServer) Raft(stream tikvpb.Tikv_RaftServer) error {
 	for {
 		msg, err := stream.Recv()
 		if err != nil {
+			if err == io.EOF {
+				return stream.SendAndClose(&raft_serverpb.Done{})
+			}
 			return err
 		}
-		if err := ris.router.sendRaftMessage(msg); err != nil {
-			log.S().Error(err)
+		if err := ris.handleRaftMessage(msg); err != nil {
+			return err
 		}
 	}
 }
@@ -64,16 +78,34 @@ func (ris *RaftInnerServer) BatchRaft(stream tikvpb.Tikv_BatchRaftServer) error
 	for {
 		msgs, err := stream.Recv()
 		if err != nil {
+			if err == io.EOF {
+				return stream.SendAndClose(&raft_serverpb.Done{})
+			}
 			return err
 		}
 		for _, msg := range msgs.GetMsgs() {
-			if err := ris.router.sendRaftMessage(msg); err != nil {
-				log.S().Error(err)
+			if err := ris.handleRaftMessage(msg); err != nil {
+				return err
 			}
 		}
 	}
 }
 
+// handleRaftMessage dispatches a raft message received from another store. It returns an error only if
+// the message is sent to a wrong store, which means the sender resolved a stale address and the stream
+// should be closed.
+func (ris *RaftInnerServer) handleRaftMessage(msg *raft_serverpb.RaftMessage) error {
+	if storeID := ris.storeMeta.GetId(); storeID != InvalidID && msg.GetToPeer().GetStoreId() != storeID {
+		log.Warn("store id mismatch, reject raft message", zap.Uint64("region id", msg.GetRegionId()),
+			zap.Uint64("to store", msg.GetToPeer().GetStoreId()), zap.Uint64("store id", storeID))
+		return errors.Errorf("to store id mismatch %d != %d", msg.GetToPeer().GetStoreId(), storeID)
+	}
+	if err := ris.router.sendRaftMessage(msg); err != nil {
+		log.S().Error(err)
+	}
+	return nil
+}
+
 // Snapshot implements the tikv.InnerServer Snapshot method.
 func (ris *RaftInnerServer) Snapshot(stream tikvpb.Tikv_SnapshotServer) error {
 	var err error
@@ -108,15 +140,14 @@ func (ris *RaftInnerServer) Setup(pdClient pd.Client) {
 	ris.snapWorker = newWorker("snap-worker", &wg)
 
 	// TODO: create local reader
-	// TODO: create storage read pool
-	// TODO: create cop read pool
 	// TODO: create cop endpoint
 
 	cfg := ris.raftConfig
+	ris.readPool = newReadPool(cfg)
 	router, batchSystem := createRaftBatchSystem(ris.globalConfig, cfg)
 
 	ris.router = router // TODO: init with local reader
-	ris.snapManager = NewSnapManager(cfg.SnapPath, router)
+	ris.snapManager = new(SnapManagerBuilder).RateLimit(cfg.SnapRateLimit).Build(cfg.SnapPath, router)
 	ris.batchSystem = batchSystem
 	ris.lsDumper = &lockStoreDumper{
 		stopCh:      make(chan struct{}),
@@ -130,11 +161,34 @@ func (ris *RaftInnerServer) GetRaftstoreRouter() *Router {
 	return &Router{router: ris.router}
 }
 
+// ReadPool returns the pool running the reads of the store, the reads run on the callers if it is nil.
+func (ris *RaftInnerServer) ReadPool() *ReadPool {
+	return ris.readPool
+}
+
 // GetStoreMeta gets the store meta of the RaftInnerServer.
 func (ris *RaftInnerServer) GetStoreMeta() *metapb.Store {
 	return &ris.storeMeta
 }
 
+// GetSnapManager gets the snapshot manager of the RaftInnerServer.
+func (ris *RaftInnerServer) GetSnapManager() *SnapManager {
+	return ris.snapManager
+}
+
+// SetTransportWrapper sets the function wrapping the transport of the raft messages, it must be called
+// before Start. It can install a WANTransport to simulate a geo-distributed cluster, or a FaultTransport to
+// simulate network partitions.
+func (ris *RaftInnerServer) SetTransportWrapper(wrap func(Transport) Transport) {
+	ris.wrapTransport = wrap
+}
+
+// SetStoreResolver sets the resolver used to find the address of other stores, it must be called before Start.
+// By default the addresses are queried from PD and cached for StoreResolveTTL.
+func (ris *RaftInnerServer) SetStoreResolver(resolver StoreResolver) {
+	ris.resolver = resolver
+}
+
 // SetPeerEventObserver sets the peer event observer.
 func (ris *RaftInnerServer) SetPeerEventObserver(ob PeerEventObserver) {
 	ris.eventObserver = ob
@@ -144,14 +198,21 @@ func (ris *RaftInnerServer) SetPeerEventObserver(ob PeerEventObserver) {
 func (ris *RaftInnerServer) Start(pdClient pd.Client) error {
 	ris.node = NewNode(ris.batchSystem, &ris.storeMeta, ris.raftConfig, pdClient, ris.eventObserver)
 
-	raftClient := newRaftClient(ris.raftConfig, pdClient)
-	trans := NewServerTransport(raftClient, ris.snapWorker.sender, ris.router)
+	if ris.resolver == nil {
+		ris.resolver = NewCachedStoreResolver(NewPDStoreResolver(pdClient), ris.raftConfig.StoreResolveTTL)
+	}
+	raftClient := newRaftClient(ris.raftConfig, ris.resolver)
+	var trans Transport = NewServerTransport(raftClient, ris.snapWorker.sender, ris.router)
+	if ris.wrapTransport != nil {
+		trans = ris.wrapTransport(trans)
+	}
+	trans = &filterTransport{inner: trans, filters: &ris.router.messageFilters}
 	err := ris.node.Start(context.TODO(), ris.engines, trans, ris.snapManager, ris.pdWorker, ris.router)
 	if err != nil {
 		return err
 	}
 	ris.raftCli = raftClient
-	snapRunner := newSnapRunner(ris.snapManager, ris.raftConfig, ris.router, pdClient)
+	snapRunner := newSnapRunner(ris.snapManager, ris.raftConfig, ris.router, ris.resolver)
 	ris.snapWorker.start(snapRunner)
 	go ris.lsDumper.run()
 	return nil
@@ -159,6 +220,7 @@ func (ris *RaftInnerServer) Start(pdClient pd.Client) error {
 
 // Stop implements the tikv.InnerServer Stop method.
 func (ris *RaftInnerServer) Stop() error {
+	ris.readPool.stop()
 	ris.snapWorker.stop()
 	ris.node.stop()
 	ris.raftCli.Stop()
@@ -0,0 +1,590 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/ngaut/unistore/raftstore/raftlog"
+	"github.com/pingcap/badger"
+	"github.com/pingcap/badger/y"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
+	"github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/pingcap/kvproto/pkg/tikvpb"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/mvcc"
+	"github.com/pingcap/tidb/util/codec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+type mockBatchRaftStream struct {
+	grpc.ServerStream
+	batches []*tikvpb.BatchRaftMessage
+	done    bool
+}
+
+func (s *mockBatchRaftStream) Recv() (*tikvpb.BatchRaftMessage, error) {
+	if len(s.batches) == 0 {
+		return nil, io.EOF
+	}
+	batch := s.batches[0]
+	s.batches = s.batches[1:]
+	return batch, nil
+}
+
+func (s *mockBatchRaftStream) SendAndClose(*raft_serverpb.Done) error {
+	s.done = true
+	return nil
+}
+
+func TestBatchRaftDispatch(t *testing.T) {
+	storeCh := make(chan Msg, 10)
+	ris := &RaftInnerServer{
+		storeMeta: metapb.Store{Id: 1},
+		router:    newRouter(storeCh, nil),
+	}
+	newMsg := func(regionID, storeID uint64) *raft_serverpb.RaftMessage {
+		return &raft_serverpb.RaftMessage{
+			RegionId: regionID,
+			ToPeer:   &metapb.Peer{Id: regionID + 100, StoreId: storeID},
+		}
+	}
+
+	stream := &mockBatchRaftStream{batches: []*tikvpb.BatchRaftMessage{
+		{Msgs: []*raft_serverpb.RaftMessage{newMsg(2, 1), newMsg(3, 1)}},
+	}}
+	require.Nil(t, ris.BatchRaft(stream))
+	assert.True(t, stream.done)
+	// Messages of unknown regions are sent to the store.
+	require.Len(t, storeCh, 2)
+	assert.Equal(t, uint64(2), (<-storeCh).RegionID)
+	assert.Equal(t, uint64(3), (<-storeCh).RegionID)
+
+	stream = &mockBatchRaftStream{batches: []*tikvpb.BatchRaftMessage{
+		{Msgs: []*raft_serverpb.RaftMessage{newMsg(2, 2)}},
+	}}
+	assert.NotNil(t, ris.BatchRaft(stream))
+	assert.False(t, stream.done)
+	assert.Len(t, storeCh, 0)
+}
+
+func TestTrySendRaftCommand(t *testing.T) {
+	pr := newRouter(make(chan Msg, 1), nil)
+	pr.mailboxCapacity = 2
+	pr.peers.Store(uint64(1), &peerState{})
+	r := &Router{router: pr}
+	req := &raft_cmdpb.RaftCmdRequest{Header: &raft_cmdpb.RaftRequestHeader{RegionId: 1}}
+
+	require.Nil(t, r.TrySendRaftCommand(req, NewCallback()))
+	require.Nil(t, r.TrySendRaftCommand(req, NewCallback()))
+	err := r.TrySendRaftCommand(req, NewCallback())
+	require.IsType(t, &ErrQueueFull{}, err)
+	assert.Equal(t, int64(2), err.(*ErrQueueFull).Pending)
+	assert.NotNil(t, ErrToPbError(err).ServerIsBusy)
+	depth, err := r.MailboxDepth(1)
+	require.Nil(t, err)
+	assert.Equal(t, int64(2), depth)
+	_, err = r.MailboxDepth(2)
+	assert.Equal(t, errPeerNotFound, err)
+	assert.Equal(t, errPeerNotFound, r.TrySendRaftCommand(&raft_cmdpb.RaftCmdRequest{
+		Header: &raft_cmdpb.RaftRequestHeader{RegionId: 2}}, NewCallback()))
+
+	// The peer handles a command.
+	msg := <-pr.peerSender
+	atomic.AddInt64(msg.Data.(*MsgRaftCmd).pending, -1)
+	depths, queued := r.MailboxDepths()
+	assert.Equal(t, map[uint64]int64{1: 1}, depths)
+	assert.Equal(t, 1, queued)
+
+	// The shared peer channel is full.
+	pr.mailboxCapacity = 0
+	pr.peerSender = make(chan Msg, 1)
+	require.Nil(t, r.TrySendRaftCommand(req, NewCallback()))
+	err = r.TrySendRaftCommand(req, NewCallback())
+	require.IsType(t, &ErrQueueFull{}, err)
+	depth, err = r.MailboxDepth(1)
+	require.Nil(t, err)
+	assert.Equal(t, int64(2), depth)
+}
+
+func TestConsistentSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testConsistentSnapshot")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	kv := openDBBundle(t, dir)
+	defer kv.DB.Close()
+	engines := &Engines{kv: kv}
+	pr := newRouter(nil, nil)
+	var regionCtxs []*kvrpcpb.Context
+	for i, keys := range [][2]string{{"c", "e"}, {"a", "c"}} {
+		region := &metapb.Region{
+			Id:          uint64(i + 1),
+			StartKey:    codec.EncodeBytes(nil, []byte(keys[0])),
+			EndKey:      codec.EncodeBytes(nil, []byte(keys[1])),
+			RegionEpoch: &metapb.RegionEpoch{Version: 1, ConfVer: 1},
+			Peers:       []*metapb.Peer{{Id: uint64(i + 1), StoreId: 1}},
+		}
+		p := &Peer{leaderChecker: leaderChecker{region: unsafe.Pointer(region)}}
+		pr.peers.Store(region.Id, &peerState{peer: &peerFsm{peer: p}})
+		regionCtxs = append(regionCtxs, &kvrpcpb.Context{RegionId: region.Id, RegionEpoch: region.RegionEpoch})
+	}
+	// The peers answer the read index requests.
+	go func() {
+		for msg := range pr.peerSender {
+			msg.Data.(*MsgRaftCmd).Callback.Done(&raft_cmdpb.RaftCmdResponse{Header: &raft_cmdpb.RaftResponseHeader{}})
+		}
+	}()
+	defer close(pr.peerSender)
+
+	require.Nil(t, kv.DB.Update(func(txn *badger.Txn) error {
+		for _, e := range []struct {
+			key string
+			ts  uint64
+		}{{"a", 5}, {"b", 15}, {"d", 5}, {"e", 5}} {
+			require.Nil(t, txn.SetEntry(&badger.Entry{Key: y.KeyWithTs([]byte(e.key), e.ts), Value: []byte(e.key)}))
+		}
+		return nil
+	}))
+	lock := &mvcc.Lock{LockHdr: mvcc.LockHdr{StartTS: 8, PrimaryLen: 1}, Primary: []byte("c")}
+	kv.LockStore.Put([]byte("c"), lock.MarshalBinary())
+	assert.Equal(t, uint64(7), resolvedTS(kv.LockStore, (*metapb.Region)(pr.get(1).peer.peer.leaderChecker.region)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	_, err = newMultiRegionSnapshot(ctx, pr, engines, regionCtxs, 10)
+	cancel()
+	require.NotNil(t, err)
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+
+	// The lock is committed while waiting for the resolved ts.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		require.Nil(t, kv.DB.Update(func(txn *badger.Txn) error {
+			return txn.SetEntry(&badger.Entry{Key: y.KeyWithTs([]byte("c"), 9), Value: []byte("c")})
+		}))
+		wb := new(WriteBatch)
+		wb.DeleteLock([]byte("c"))
+		require.True(t, wb.releasesLocks())
+		require.Nil(t, wb.WriteToKV(kv))
+		engines.lockReleased.notify()
+	}()
+	snap, err := newMultiRegionSnapshot(context.Background(), pr, engines, regionCtxs, 10)
+	require.Nil(t, err)
+	defer snap.Close()
+	require.Len(t, snap.Regions(), 2)
+	assert.Equal(t, uint64(2), snap.Regions()[0].Id)
+	var keys []string
+	var regionIDs []uint64
+	it := snap.NewIterator()
+	for ; it.Valid(); it.Next() {
+		keys = append(keys, string(it.Key()))
+		regionIDs = append(regionIDs, it.RegionID())
+		assert.Equal(t, it.Key(), it.Value())
+	}
+	require.Nil(t, it.Err())
+	it.Close()
+	assert.Equal(t, []string{"a", "c", "d"}, keys)
+	assert.Equal(t, []uint64{2, 1, 1}, regionIDs)
+
+	// The region is split after the read index.
+	regionCtxs[0].RegionEpoch = &metapb.RegionEpoch{Version: 2}
+	_, err = newMultiRegionSnapshot(context.Background(), pr, engines, regionCtxs, 10)
+	assert.IsType(t, &ErrEpochNotMatch{}, err)
+}
+
+func TestAdminObserver(t *testing.T) {
+	ris := &RaftInnerServer{router: newRouter(nil, nil)}
+	var observed []raft_cmdpb.AdminCmdType
+	ris.AddAdminObserver(func(region *metapb.Region, req *raft_cmdpb.AdminRequest) error {
+		observed = append(observed, req.CmdType)
+		switch req.CmdType {
+		case raft_cmdpb.AdminCmdType_PrepareMerge:
+			return errors.New("merge is forbidden")
+		case raft_cmdpb.AdminCmdType_TransferLeader:
+			req.CmdType = raft_cmdpb.AdminCmdType_InvalidAdmin
+		}
+		return nil
+	})
+	ris.AddAdminObserver(func(region *metapb.Region, req *raft_cmdpb.AdminRequest) error {
+		observed = append(observed, req.CmdType)
+		return nil
+	})
+
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	applyCtx := newApplyContext("test", nil, engines, nil, NewDefaultConfig())
+	applyCtx.adminObservers = ris.router.adminObservers
+	applyCtx.execCtx = &applyExecContext{}
+	apply := &applier{region: &metapb.Region{Id: 3}}
+	newAdmin := func(cmdType raft_cmdpb.AdminCmdType) *raft_cmdpb.RaftCmdRequest {
+		return &raft_cmdpb.RaftCmdRequest{AdminRequest: &raft_cmdpb.AdminRequest{CmdType: cmdType}}
+	}
+
+	// The first veto stops the observers.
+	_, _, err := apply.execAdminCmd(applyCtx, newAdmin(raft_cmdpb.AdminCmdType_PrepareMerge))
+	vetoed, ok := err.(*ErrAdminVetoed)
+	require.True(t, ok)
+	assert.Equal(t, uint64(3), vetoed.RegionID)
+	assert.Equal(t, raft_cmdpb.AdminCmdType_PrepareMerge, vetoed.CmdType)
+	assert.Equal(t, "merge is forbidden", vetoed.Reason)
+	assert.Equal(t, []raft_cmdpb.AdminCmdType{raft_cmdpb.AdminCmdType_PrepareMerge}, observed)
+
+	// The rewritten command is executed.
+	observed = nil
+	_, _, err = apply.execAdminCmd(applyCtx, newAdmin(raft_cmdpb.AdminCmdType_TransferLeader))
+	require.NotNil(t, err)
+	assert.Equal(t, "unsupported command type", err.Error())
+	assert.Equal(t, []raft_cmdpb.AdminCmdType{raft_cmdpb.AdminCmdType_TransferLeader,
+		raft_cmdpb.AdminCmdType_InvalidAdmin}, observed)
+}
+
+func TestAdminFaults(t *testing.T) {
+	r := &Router{router: newRouter(nil, nil)}
+	faults := r.router.adminFaults
+	_, err := r.AddAdminFault(AdminFaultRule{CmdType: raft_cmdpb.AdminCmdType_BatchSplit, Action: "retry"})
+	assert.NotNil(t, err)
+	_, err = r.AddAdminFault(AdminFaultRule{CmdType: raft_cmdpb.AdminCmdType_BatchSplit, Action: AdminFaultFail})
+	assert.NotNil(t, err)
+
+	// Fail the 3rd batch split of region 2.
+	failID, err := r.AddAdminFault(AdminFaultRule{
+		RegionID: 2,
+		CmdType:  raft_cmdpb.AdminCmdType_BatchSplit,
+		Nth:      3,
+		Action:   AdminFaultFail,
+		Error:    AdminFaultEpochNotMatch,
+	})
+	require.Nil(t, err)
+	for i := 1; i <= 4; i++ {
+		err := faults.inject(2, raft_cmdpb.AdminCmdType_BatchSplit)
+		if i == 3 {
+			assert.IsType(t, &ErrEpochNotMatch{}, err)
+		} else {
+			assert.Nil(t, err, "%d", i)
+		}
+		assert.Nil(t, faults.inject(3, raft_cmdpb.AdminCmdType_BatchSplit))
+	}
+
+	// Drop every change peer of any region.
+	dropID, err := r.AddAdminFault(AdminFaultRule{CmdType: raft_cmdpb.AdminCmdType_ChangePeer, Action: AdminFaultDrop})
+	require.Nil(t, err)
+	for _, regionID := range []uint64{2, 3} {
+		err := faults.inject(regionID, raft_cmdpb.AdminCmdType_ChangePeer)
+		assert.Equal(t, &ErrAdminFaultDropped{RegionID: regionID, CmdType: raft_cmdpb.AdminCmdType_ChangePeer}, err)
+		assert.NotNil(t, ErrToPbError(err).StaleCommand)
+	}
+	assert.Nil(t, faults.inject(2, raft_cmdpb.AdminCmdType_CompactLog))
+
+	list := r.AdminFaults()
+	require.Len(t, list, 2)
+	assert.Equal(t, AdminFault{ID: failID, Rule: list[0].Rule, Matched: 4, Injected: 1}, list[0])
+	assert.Equal(t, AdminFault{ID: dropID, Rule: list[1].Rule, Matched: 2, Injected: 2}, list[1])
+	assert.True(t, r.RemoveAdminFault(dropID))
+	assert.False(t, r.RemoveAdminFault(dropID))
+	assert.Len(t, r.AdminFaults(), 1)
+
+	// The debug API.
+	handler := r.AdminFaultHandler()
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+		return rec
+	}
+	assert.Equal(t, http.StatusBadRequest, serve("POST", "/debug/admin_faults?cmd_type=Unknown&action=drop").Code)
+	rec := serve("POST", "/debug/admin_faults?region_id=5&cmd_type=Split&nth=1&action=fail&error=not_leader")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var added AdminFault
+	require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &added))
+	assert.Equal(t, AdminFaultRule{
+		RegionID: 5,
+		CmdType:  raft_cmdpb.AdminCmdType_Split,
+		Nth:      1,
+		Action:   AdminFaultFail,
+		Error:    AdminFaultNotLeader,
+	}, added.Rule)
+	err = faults.inject(5, raft_cmdpb.AdminCmdType_Split)
+	assert.IsType(t, &ErrNotLeader{}, err)
+
+	rec = serve("GET", "/debug/admin_faults")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &list))
+	assert.Len(t, list, 2)
+	assert.Equal(t, http.StatusNotFound, serve("DELETE", "/debug/admin_faults?id=100").Code)
+	rec = serve("DELETE", "/debug/admin_faults")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, r.AdminFaults())
+}
+
+func TestDumpBacklog(t *testing.T) {
+	r := &Router{router: newRouter(nil, nil)}
+	ps1, ps2 := new(peerState), new(peerState)
+	r.router.peers.Store(uint64(1), ps1)
+	r.router.peers.Store(uint64(2), ps2)
+	dump := r.DumpBacklog()
+	assert.Empty(t, dump.Regions)
+
+	ps2.applyBacklog.push(MsgTypeApply)
+	time.Sleep(time.Millisecond)
+	require.Nil(t, r.router.send(1, Msg{Type: MsgTypeNoop}))
+	require.Nil(t, r.router.send(1, Msg{Type: MsgTypeSplitRegion}))
+	require.Nil(t, r.router.send(2, Msg{Type: MsgTypeHalfSplitRegion}))
+	regionTasks := newRegionTaskQueue(NewDefaultConfig(), nil)
+	regionTasks.push(task{tp: taskTypeRegionApply}, time.Now())
+	ch := make(chan task, 1)
+	ch <- task{tp: taskTypeRegionGen}
+	r.router.regionTasks, r.router.regionTaskSender = regionTasks, ch
+
+	dump = r.DumpBacklog()
+	assert.Equal(t, 3, dump.PeerChannel)
+	require.Len(t, dump.Regions, 2)
+	// Region 2 has the oldest message in its apply queue.
+	assert.Equal(t, uint64(2), dump.Regions[0].RegionID)
+	assert.Equal(t, []string{"Apply"}, dump.Regions[0].Apply.HeadTypes)
+	assert.Equal(t, 1, dump.Regions[0].Mailbox.Count)
+	assert.Equal(t, []string{"Noop", "SplitRegion"}, dump.Regions[1].Mailbox.HeadTypes)
+	assert.Equal(t, 2, dump.RegionTasks.Count)
+	assert.Equal(t, []string{"apply snapshot"}, dump.RegionTasks.HeadTypes)
+
+	// The messages received by the raft worker and handled by the apply worker are untracked.
+	rw := &raftWorker{pr: r.router}
+	for i := 0; i < 3; i++ {
+		rw.received(<-r.router.peerSender)
+	}
+	ps2.applyBacklog.pop()
+	assert.Empty(t, r.DumpBacklog().Regions)
+}
+
+func TestReadYourWrites(t *testing.T) {
+	verifier := NewReadYourWritesVerifier()
+	r := &Router{router: newRouter(nil, nil)}
+	r.router.readYourWrites = verifier
+	checker := &leaderChecker{peerID: 1}
+
+	// The applied index is published before the callback of the write is invoked.
+	cb := NewCallback()
+	applyCB := applyCallback{visibleIndex: &checker.appliedIndex, appliedIndex: 10}
+	applyCB.push(cb, nil)
+	applyCB.invokeAll(time.Now())
+	cb.wg.Wait()
+	assert.Equal(t, uint64(10), checker.appliedIndex.Load())
+
+	session := &kvrpcpb.Context{RegionId: 1, TaskId: 7}
+	verifier.observeWrite(session, 10)
+	assert.Nil(t, checker.readErr(session, r))
+	total, _ := verifier.Violations()
+	assert.Equal(t, uint64(0), total)
+
+	// The reads without a session and the reads of the other regions are not checked.
+	verifier.observeWrite(session, 12)
+	assert.Nil(t, checker.readErr(&kvrpcpb.Context{RegionId: 1}, r))
+	assert.Nil(t, checker.readErr(&kvrpcpb.Context{RegionId: 2, TaskId: 7}, r))
+	total, _ = verifier.Violations()
+	assert.Equal(t, uint64(0), total)
+
+	// A read of the session behind its write is flagged.
+	assert.Nil(t, checker.readErr(session, r))
+	total, violations := verifier.Violations()
+	assert.Equal(t, uint64(1), total)
+	require.Len(t, violations, 1)
+	assert.Equal(t, uint64(7), violations[0].Session)
+	assert.Equal(t, uint64(12), violations[0].WriteIndex)
+	assert.Equal(t, uint64(10), violations[0].ReadIndex)
+
+	// A stale write doesn't lower the tracked index.
+	verifier.observeWrite(session, 11)
+	checker.appliedIndex.Store(12)
+	assert.Nil(t, checker.readErr(session, r))
+	total, _ = verifier.Violations()
+	assert.Equal(t, uint64(1), total)
+}
+
+func TestHistoryRecorder(t *testing.T) {
+	r := &Router{router: newRouter(nil, nil)}
+	h := NewHistoryRecorder()
+	r.RecordHistory(h)
+
+	// A command failed to be sent is not recorded.
+	header := &raft_cmdpb.RaftRequestHeader{RegionId: 1}
+	put := &raft_cmdpb.RaftCmdRequest{Header: header, Requests: []*raft_cmdpb.Request{{
+		CmdType: raft_cmdpb.CmdType_Put,
+		Put:     &raft_cmdpb.PutRequest{Key: []byte("k"), Value: []byte("v")},
+	}}}
+	cb := NewCallback()
+	require.Equal(t, errPeerNotFound, r.SendCommand(put, cb))
+	cb.Done(ErrResp(errPeerNotFound))
+	assert.Len(t, h.Operations(), 0)
+
+	cb = NewCallback()
+	h.invoke(put, cb)
+	cb.appliedIndex = 6
+	cb.Done(&raft_cmdpb.RaftCmdResponse{Header: &raft_cmdpb.RaftResponseHeader{}})
+
+	read := &raft_cmdpb.RaftCmdRequest{Header: header, Requests: []*raft_cmdpb.Request{{CmdType: raft_cmdpb.CmdType_ReadIndex}}}
+	cb = NewCallback()
+	h.invoke(read, cb)
+	cb.Done(&raft_cmdpb.RaftCmdResponse{Header: &raft_cmdpb.RaftResponseHeader{}, Responses: []*raft_cmdpb.Response{{
+		CmdType:   raft_cmdpb.CmdType_ReadIndex,
+		ReadIndex: &raft_cmdpb.ReadIndexResponse{ReadIndex: 6},
+	}}})
+
+	// A failed read is dropped and a failed write may or may not take effect.
+	cb = NewCallback()
+	h.invoke(read, cb)
+	cb.Done(ErrResp(&ErrNotLeader{RegionID: 1}))
+	cb = NewCallback()
+	h.invoke(put, cb)
+	cb.Done(ErrResp(&ErrNotLeader{RegionID: 1}))
+
+	ops := h.Operations()
+	require.Len(t, ops, 3)
+	assert.True(t, ops[0].Input.Write)
+	assert.Equal(t, [][]byte{[]byte("k")}, ops[0].Input.Keys)
+	assert.Equal(t, uint64(6), ops[0].Output.Index)
+	assert.True(t, ops[0].Call <= ops[0].Return)
+	assert.False(t, ops[1].Input.Write)
+	assert.Equal(t, uint64(6), ops[1].Output.Index)
+	assert.True(t, ops[0].Return <= ops[1].Call)
+	assert.NotEmpty(t, ops[2].Output.Err)
+	assert.Equal(t, int64(math.MaxInt64), ops[2].Return)
+
+	r.RecordHistory(nil)
+	h.Reset()
+	cb = NewCallback()
+	require.Error(t, r.SendCommand(put, cb))
+	assert.Nil(t, cb.onDone)
+	assert.Len(t, h.Operations(), 0)
+}
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit_log")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := dir + "/audit.log"
+	split := raftlog.NewRequest(&raft_cmdpb.RaftCmdRequest{AdminRequest: &raft_cmdpb.AdminRequest{
+		CmdType: raft_cmdpb.AdminCmdType_BatchSplit,
+	}})
+	put := func(key string) raftlog.RaftLog {
+		return raftlog.NewRequest(&raft_cmdpb.RaftCmdRequest{Requests: []*raft_cmdpb.Request{{
+			CmdType: raft_cmdpb.CmdType_Put,
+			Put:     &raft_cmdpb.PutRequest{Key: []byte(key), Value: []byte("v")},
+		}}})
+	}
+	ok := &raft_cmdpb.RaftCmdResponse{Header: &raft_cmdpb.RaftResponseHeader{}}
+
+	// Without sampling only the admin commands are logged.
+	l, err := openAuditLog(path, 0, nil)
+	require.Nil(t, err)
+	l.record(1, 5, 6, put("a"), ok)
+	l.record(1, 6, 6, split, ErrResp(&ErrEpochNotMatch{}))
+	l.close()
+	l, err = openAuditLog(path, 1, nil)
+	require.Nil(t, err)
+	l.record(1, 7, 6, put("a"), ok)
+	l.close()
+
+	f, err := os.Open(path)
+	require.Nil(t, err)
+	records, err := ReadAuditLog(f)
+	f.Close()
+	require.Nil(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, "BatchSplit", records[0].Type)
+	assert.Equal(t, uint64(6), records[0].Index)
+	assert.NotEmpty(t, records[0].Error)
+	assert.Equal(t, "Write", records[1].Type)
+	assert.Equal(t, 1, records[1].Keys)
+	assert.NotEmpty(t, records[1].KeyDigest)
+
+	// The sample is the same on every store.
+	l = &auditLog{sampleRate: 0.5}
+	for i := uint64(0); i < 100; i++ {
+		assert.Equal(t, l.sampled(1, i), l.sampled(1, i))
+	}
+
+	// Replay the log against another store, which applies a different key at index 7.
+	replayer := NewAuditReplayer(records)
+	l, err = openAuditLog("", 1, replayer)
+	require.Nil(t, err)
+	l.record(1, 6, 6, split, ErrResp(&ErrEpochNotMatch{}))
+	assert.Empty(t, replayer.Mismatches())
+	assert.Equal(t, 1, replayer.Pending())
+	l.record(1, 7, 6, put("b"), ok)
+	assert.Equal(t, 0, replayer.Pending())
+	mismatches := replayer.Mismatches()
+	require.Len(t, mismatches, 1)
+	assert.Equal(t, records[1], mismatches[0].Expected)
+	assert.NotEqual(t, records[1].KeyDigest, mismatches[0].Actual.KeyDigest)
+}
+
+func TestSendBatchCommand(t *testing.T) {
+	pr := newRouter(make(chan Msg, 2), nil)
+	pr.peers.Store(uint64(1), &peerState{})
+	r := &Router{router: pr}
+	put := func(key string) *raft_cmdpb.Request {
+		return &raft_cmdpb.Request{CmdType: raft_cmdpb.CmdType_Put, Put: &raft_cmdpb.PutRequest{Key: []byte(key)}}
+	}
+	cb1, cb2 := NewCallback(), NewCallback()
+	header := &raft_cmdpb.RaftRequestHeader{RegionId: 1}
+	require.Nil(t, r.SendBatchCommand(header, []SubCommand{
+		{Requests: []*raft_cmdpb.Request{put("a"), put("b")}, Callback: cb1},
+		{Requests: []*raft_cmdpb.Request{put("c")}, Callback: cb2},
+	}))
+	assert.Equal(t, errPeerNotFound, r.SendBatchCommand(&raft_cmdpb.RaftRequestHeader{RegionId: 2}, nil))
+
+	// The responses are demultiplexed when the merged command is applied.
+	msg := (<-pr.peerSender).Data.(*MsgRaftCmd)
+	req := msg.Request.GetRaftCmdRequest()
+	require.Len(t, req.Requests, 3)
+	resp := newCmdRespForReq(req)
+	for _, r := range req.Requests {
+		resp.Responses = append(resp.Responses, &raft_cmdpb.Response{CmdType: r.CmdType})
+	}
+	checker := &leaderChecker{}
+	applyCB := applyCallback{visibleIndex: &checker.appliedIndex, appliedIndex: 10}
+	msg.Callback.appliedIndex = 10
+	applyCB.push(msg.Callback, resp)
+	applyCB.invokeAll(time.Now())
+	cb1.wg.Wait()
+	cb2.wg.Wait()
+	assert.Len(t, cb1.resp.Responses, 2)
+	assert.Len(t, cb2.resp.Responses, 1)
+	assert.Equal(t, uint64(10), cb2.appliedIndex)
+
+	// An error is responded to every sub command.
+	cb1, cb2 = NewCallback(), NewCallback()
+	_, cb := NewBatchCommand(header, []SubCommand{
+		{Requests: []*raft_cmdpb.Request{put("a")}, Callback: cb1},
+		{Requests: []*raft_cmdpb.Request{put("b")}, Callback: cb2},
+	})
+	cb.Done(ErrRespStaleCommand(5))
+	cb1.wg.Wait()
+	cb2.wg.Wait()
+	assert.NotNil(t, cb1.resp.Header.Error.StaleCommand)
+	assert.NotNil(t, cb2.resp.Header.Error.StaleCommand)
+	assert.Empty(t, cb2.resp.Responses)
+}
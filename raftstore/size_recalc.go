@@ -0,0 +1,137 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/ngaut/unistore/rocksdb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// A large compaction or a range deletion shrinks the regions at once, the size diff hints only catch up with
+// the writes. So the approximate sizes of the affected regions are recalculated right away and reported to PD,
+// see Config.SizeRecalcDeclinedBytes.
+
+// NotifyCompaction is the hook of the engine called after a compaction finishes, the keys of the event are
+// in the key space of the regions.
+func (r *Router) NotifyCompaction(event *rocksdb.CompactedEvent) {
+	r.router.sendStore(NewMsg(MsgTypeStoreCompactedEvent, event))
+}
+
+// declinedBytes returns the bytes removed by the compaction.
+func declinedBytes(event *rocksdb.CompactedEvent) uint64 {
+	if event.TotalOutputBytes >= event.TotalInputBytes {
+		return 0
+	}
+	return uint64(event.TotalInputBytes - event.TotalOutputBytes)
+}
+
+// regionsOverlapRange returns the regions overlapping the range, an empty end key means unbounded.
+func regionsOverlapRange(meta *storeMeta, startKey, endKey []byte) []*metapb.Region {
+	var regions []*metapb.Region
+	for _, region := range meta.regions {
+		if len(region.Peers) == 0 {
+			// An uninitialized region has no data.
+			continue
+		}
+		if len(region.EndKey) > 0 && bytes.Compare(region.EndKey, startKey) <= 0 {
+			continue
+		}
+		if len(endKey) > 0 && bytes.Compare(region.StartKey, endKey) >= 0 {
+			continue
+		}
+		regions = append(regions, region)
+	}
+	return regions
+}
+
+func (d *storeMsgHandler) onCompactionFinished(event *rocksdb.CompactedEvent) {
+	threshold := d.ctx.cfg.SizeRecalcDeclinedBytes
+	declined := declinedBytes(event)
+	if threshold == 0 || declined < threshold {
+		return
+	}
+	d.ctx.storeMetaLock.RLock()
+	regions := regionsOverlapRange(d.ctx.storeMeta, event.StartKey, event.EndKey)
+	d.ctx.storeMetaLock.RUnlock()
+	log.Info("recalculate region sizes after compaction", zap.Uint64("declined bytes", declined),
+		zap.Int("regions", len(regions)))
+	for _, region := range regions {
+		if err := d.ctx.router.send(region.Id, NewPeerMsg(MsgTypeRecalculateRegionSize, region.Id, nil)); err != nil {
+			log.S().Error(err)
+		}
+	}
+}
+
+// onRecalculateRegionSize makes the leader scan the region to recalculate the approximate size and report it
+// to PD once it is recalculated, a follower drops the stale size.
+func (d *peerMsgHandler) onRecalculateRegionSize() {
+	if !d.peer.IsLeader() {
+		d.onClearRegionSize()
+		return
+	}
+	d.peer.sizeRecalculating = true
+	d.ctx.splitCheckTaskSender <- task{
+		tp:   taskTypeSplitCheck,
+		data: &splitCheckTask{region: d.region()},
+	}
+	d.peer.sizeCheckTime = time.Now()
+	d.peer.SizeDiffHint = 0
+}
+
+// sizeReconcileDue returns true if the region is not scanned for the approximate size in
+// Config.RegionSizeReconcileInterval. The first call only starts the interval, so the regions are not all
+// scanned at once after the store starts.
+func (d *peerMsgHandler) sizeReconcileDue() bool {
+	interval := d.ctx.cfg.RegionSizeReconcileInterval
+	if interval == 0 {
+		return false
+	}
+	now := time.Now()
+	if d.peer.sizeCheckTime.IsZero() {
+		d.peer.sizeCheckTime = now
+		return false
+	}
+	return now.Sub(d.peer.sizeCheckTime) >= interval
+}
+
+// approximateOversized returns true if the approximate size or keys of the region reach the max thresholds,
+// so the region is scanned for the split keys even if the size diff hint is small, like a region whose last
+// split is refused by PD.
+func (d *peerMsgHandler) approximateOversized() bool {
+	th := d.ctx.cfg.SplitCheck.regionThresholds(d.region())
+	size := d.peer.SizeDiffHint
+	if d.peer.ApproximateSize != nil {
+		size += *d.peer.ApproximateSize
+	}
+	if size >= th.maxSize {
+		return true
+	}
+	return d.peer.ApproximateKeys != nil && *d.peer.ApproximateKeys >= th.maxKeys
+}
+
+// onRegionSizeRecalculated reports the recalculated size to PD.
+func (d *peerMsgHandler) onRegionSizeRecalculated() {
+	if !d.peer.sizeRecalculating {
+		return
+	}
+	d.peer.sizeRecalculating = false
+	if d.peer.IsLeader() {
+		d.peer.HeartbeatPd(d.ctx.pdTaskSender)
+	}
+}
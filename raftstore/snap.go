@@ -15,6 +15,7 @@ package raftstore
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"hash"
 	"hash/crc32"
@@ -71,6 +72,8 @@ var (
 	writeCFIdx   = 2
 
 	errAbort = applySnapAbortError("abort")
+	// errSnapEpochChanged means the region epoch changed after the snapshot is requested.
+	errSnapEpochChanged = errors.New("region epoch changed")
 )
 
 // SnapKey represents the snapshot key.
@@ -117,6 +120,8 @@ type ApplyOptions struct {
 	Abort    *uint32
 	Builder  *sstable.Builder
 	WB       *WriteBatch
+	// CollectLockKeys returns the keys of the applied locks in the result, so the apply order can be verified.
+	CollectLockKeys bool
 }
 
 func newApplyOptions(db *mvcc.DBBundle, region *metapb.Region, abort *uint32, builder *sstable.Builder, wb *WriteBatch) *ApplyOptions {
@@ -133,6 +138,7 @@ func newApplyOptions(db *mvcc.DBBundle, region *metapb.Region, abort *uint32, bu
 type ApplyResult struct {
 	HasPut      bool
 	RegionState *rspb.RegionLocalState
+	LockKeys    [][]byte
 }
 
 // Snapshot is an interface for snapshot.
@@ -280,6 +286,11 @@ type Snap struct {
 	SizeTrack    *int64
 	limiter      *IOLimiter
 	holdTmpFiles bool
+	// checksums caches the checksums of the cf files, nil if the snap isn't created by a SnapManager.
+	checksums *ChecksumService
+	// throttle waits for the bytes written by building the snap to be allowed by Config.SnapRateLimit, nil if
+	// the snap isn't created by a SnapManager.
+	throttle func(ctx context.Context, n int) error
 }
 
 // NewSnap returns a new snap.
@@ -526,6 +537,17 @@ func (s *Snap) validate() error {
 			// this is checked when loading the snapshot meta.
 			continue
 		}
+		if s.checksums != nil {
+			// The cached checksums are cheap, so the sst files are verified too.
+			err := checkFileSize(cfFile.Path, cfFile.Size)
+			if err == nil {
+				err = s.checksums.Verify(cfFile.Path, cfFile.Checksum, false)
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
 		if plainFileUsed(cfFile.CF) {
 			err := checkFileSizeAndChecksum(cfFile.Path, cfFile.Size, cfFile.Checksum)
 			if err != nil {
@@ -569,6 +591,11 @@ func (s *Snap) saveCFFiles() error {
 			if err != nil {
 				return err
 			}
+			if s.checksums != nil {
+				if err = s.checksums.record(cfFile.Path, cfFile.Checksum); err != nil {
+					return err
+				}
+			}
 		} else {
 			// Clean up the `tmp_path` if this cf file is empty.
 			_, err = util.DeleteFileIfExists(cfFile.TmpPath)
@@ -620,6 +647,7 @@ func (s *Snap) Build(dbSnap *regionSnapshot, region *metapb.Region, snapData *rs
 	if err != nil {
 		return err
 	}
+	builder.throttle = s.throttle
 	err = builder.build()
 	if err != nil {
 		return err
@@ -645,6 +673,7 @@ func (s *Snap) Build(dbSnap *regionSnapshot, region *metapb.Region, snapData *rs
 	snapData.FileSize = totalSize
 	snapData.Version = snapshotVersion
 	snapData.Meta = s.MetaFile.Meta
+	setSnapMaxTS(snapData, builder.maxTS)
 	return nil
 }
 
@@ -681,6 +710,9 @@ func (s *Snap) Delete() {
 		if err != nil {
 			panic(err)
 		}
+		if s.checksums != nil {
+			s.checksums.forget(cfFile.Path)
+		}
 		if deleted {
 			atomic.AddInt64(s.SizeTrack, -int64(cfFile.Size))
 		}
@@ -737,6 +769,11 @@ func (s *Snap) Save() error {
 			return errors.WithStack(err)
 		}
 		atomic.AddInt64(s.SizeTrack, int64(cfFile.Size))
+		if s.checksums != nil {
+			if err = s.checksums.record(cfFile.Path, checksum); err != nil {
+				return err
+			}
+		}
 	}
 	// write meta file
 	bin, err := s.MetaFile.Meta.Marshal()
@@ -759,7 +796,8 @@ func (s *Snap) Save() error {
 	return nil
 }
 
-// Apply implements the Snapshot Apply method.
+// Apply implements the Snapshot Apply method. The locks are written to the lock store right away, the other
+// entries are only visible after the builder and the write batch are ingested, see finishApply.
 func (s *Snap) Apply(opts ApplyOptions) (ApplyResult, error) {
 	var result ApplyResult
 	err := s.validate()
@@ -770,6 +808,10 @@ func (s *Snap) Apply(opts ApplyOptions) (ApplyResult, error) {
 	if err != nil {
 		return result, err
 	}
+	err = validateSnapData(s.CFFiles, opts.Region)
+	if err != nil {
+		return result, err
+	}
 	applier, err := newSnapApplier(s.CFFiles)
 	if err != nil {
 		return result, err
@@ -795,6 +837,9 @@ func (s *Snap) Apply(opts ApplyOptions) (ApplyResult, error) {
 			}
 		case applySnapTypeLock:
 			opts.DBBundle.LockStore.Put(item.key.UserKey, item.val)
+			if opts.CollectLockKeys {
+				result.LockKeys = append(result.LockKeys, item.key.UserKey)
+			}
 		case applySnapTypeRollback:
 			opts.WB.Rollback(item.key)
 		case applySnapTypeOpLock:
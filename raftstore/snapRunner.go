@@ -24,7 +24,6 @@ import (
 	"github.com/pingcap/kvproto/pkg/raft_serverpb"
 	"github.com/pingcap/kvproto/pkg/tikvpb"
 	"github.com/pingcap/log"
-	"github.com/pingcap/tidb/store/mockstore/unistore/pd"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/keepalive"
@@ -36,15 +35,15 @@ type snapRunner struct {
 	router         *router
 	sendingCount   int64
 	receivingCount int64
-	pdCli          pd.Client
+	resolver       StoreResolver
 }
 
-func newSnapRunner(snapManager *SnapManager, config *Config, router *router, pdCli pd.Client) *snapRunner {
+func newSnapRunner(snapManager *SnapManager, config *Config, router *router, resolver StoreResolver) *snapRunner {
 	return &snapRunner{
 		config:      config,
 		snapManager: snapManager,
 		router:      router,
-		pdCli:       pdCli,
+		resolver:    resolver,
 	}
 }
 
@@ -60,18 +59,41 @@ func (r *snapRunner) handle(t task) {
 func (r *snapRunner) send(t sendSnapTask) {
 	if n := atomic.LoadInt64(&r.sendingCount); n > int64(r.config.ConcurrentSendSnapLimit) {
 		log.Warn("too many sending snapshot tasks, drop send snap", zap.Uint64("to", t.storeID), zap.Stringer("snap", t.msg))
-		t.callback(errors.New("too many sending snapshot tasks"))
+		err := errors.New("too many sending snapshot tasks")
+		r.recordFailure(t.msg, t.storeID, SnapEntrySending, err)
+		t.callback(err)
 		return
 	}
 
 	atomic.AddInt64(&r.sendingCount, 1)
 	defer atomic.AddInt64(&r.sendingCount, -1)
-	t.callback(r.sendSnap(t.storeID, t.msg))
+	err := r.sendSnap(t.storeID, t.msg)
+	if errors.Cause(err) == context.Canceled {
+		// The leader stepped down, the snapshot is not needed anymore.
+		snapKey, _ := SnapKeyFromSnap(t.msg.GetMessage().GetSnapshot())
+		r.snapManager.deleteSnapshotFiles(snapKey)
+		r.snapManager.recordSnapEvent(SnapEvent{Type: SnapEventCanceled, Key: snapKey, Entry: SnapEntrySending,
+			StoreID: t.storeID, Reason: err.Error()})
+	} else if err != nil {
+		r.resolver.Invalidate(t.storeID)
+		r.recordFailure(t.msg, t.storeID, SnapEntrySending, err)
+	}
+	// The failure is reported to raft even if the sending is canceled, so the progress of the follower
+	// is not stuck in the snapshot state.
+	t.callback(err)
+}
+
+func (r *snapRunner) recordFailure(msg *raft_serverpb.RaftMessage, storeID uint64, entry SnapEntry, err error) {
+	event := SnapEvent{Type: SnapEventFailed, Entry: entry, StoreID: storeID, Reason: err.Error()}
+	if snap := msg.GetMessage().GetSnapshot(); snap != nil {
+		event.Key, _ = SnapKeyFromSnap(snap)
+	}
+	r.snapManager.recordSnapEvent(event)
 }
 
 const snapChunkLen = 1024 * 1024
 
-func (r *snapRunner) sendSnap(storeID uint64, msg *raft_serverpb.RaftMessage) error {
+func (r *snapRunner) sendSnap(storeID uint64, msg *raft_serverpb.RaftMessage) (err error) {
 	start := time.Now()
 	msgSnap := msg.GetMessage().GetSnapshot()
 	snapKey, err := SnapKeyFromSnap(msgSnap)
@@ -81,6 +103,13 @@ func (r *snapRunner) sendSnap(storeID uint64, msg *raft_serverpb.RaftMessage) er
 
 	r.snapManager.Register(snapKey, SnapEntrySending)
 	defer r.snapManager.Deregister(snapKey, SnapEntrySending)
+	ctx, done := r.snapManager.sendingContext(snapKey.RegionID)
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = errors.Annotate(ctx.Err(), "sending snapshot is canceled")
+		}
+		done()
+	}()
 
 	snap, err := r.snapManager.GetSnapshotForSending(snapKey)
 	if err != nil {
@@ -89,8 +118,7 @@ func (r *snapRunner) sendSnap(storeID uint64, msg *raft_serverpb.RaftMessage) er
 	if !snap.Exists() {
 		return errors.Errorf("missing snap file: %v", snap.Path())
 	}
-	// Send snap shot is a low frequent operation, we can afford resolving the store address every time.
-	addr, err := getStoreAddr(storeID, r.pdCli)
+	addr, err := r.resolver.Resolve(storeID)
 	if err != nil {
 		return err
 	}
@@ -104,8 +132,9 @@ func (r *snapRunner) sendSnap(storeID uint64, msg *raft_serverpb.RaftMessage) er
 	if err != nil {
 		return err
 	}
+	defer cc.Close()
 	client := tikvpb.NewTikvClient(cc)
-	stream, err := client.Snapshot(context.TODO())
+	stream, err := client.Snapshot(ctx)
 	if err != nil {
 		return err
 	}
@@ -114,8 +143,10 @@ func (r *snapRunner) sendSnap(storeID uint64, msg *raft_serverpb.RaftMessage) er
 		return err
 	}
 
+	total := snap.TotalSize()
+	var sent uint64
 	buf := make([]byte, snapChunkLen)
-	for remain := snap.TotalSize(); remain > 0; remain -= uint64(len(buf)) {
+	for remain := total; remain > 0; remain -= uint64(len(buf)) {
 		if remain < uint64(len(buf)) {
 			buf = buf[:remain]
 		}
@@ -123,15 +154,23 @@ func (r *snapRunner) sendSnap(storeID uint64, msg *raft_serverpb.RaftMessage) er
 		if err != nil {
 			return errors.Errorf("failed to read snapshot chunk: %v", err)
 		}
+		if err = r.snapManager.throttle(ctx, len(buf)); err != nil {
+			return err
+		}
 		err = stream.Send(&raft_serverpb.SnapshotChunk{Data: buf})
 		if err != nil {
 			return err
 		}
+		sent += uint64(len(buf))
+		r.snapManager.recordSnapEvent(SnapEvent{Type: SnapEventSending, Key: snapKey, Entry: SnapEntrySending,
+			StoreID: storeID, Bytes: sent, Total: total})
 	}
 	_, err = stream.CloseAndRecv()
 	if err != nil {
 		return err
 	}
+	r.snapManager.recordSnapEvent(SnapEvent{Type: SnapEventSent, Key: snapKey, Entry: SnapEntrySending,
+		StoreID: storeID, Bytes: sent, Total: total})
 
 	log.Info("sent snapshot", zap.Uint64("region id", snapKey.RegionID), zap.Stringer("snap key", snapKey), zap.Uint64("size", snap.TotalSize()), zap.Duration("duration", time.Since(start)))
 	return nil
@@ -140,7 +179,9 @@ func (r *snapRunner) sendSnap(storeID uint64, msg *raft_serverpb.RaftMessage) er
 func (r *snapRunner) recv(t recvSnapTask) {
 	if n := atomic.LoadInt64(&r.receivingCount); n > int64(r.config.ConcurrentRecvSnapLimit) {
 		log.Warn("too many recving snapshot tasks, ignore")
-		t.callback(errors.New("too many recving snapshot tasks"))
+		err := errors.New("too many recving snapshot tasks")
+		r.snapManager.recordSnapEvent(SnapEvent{Type: SnapEventFailed, Entry: SnapEntryReceiving, Reason: err.Error()})
+		t.callback(err)
 		return
 	}
 	atomic.AddInt64(&r.receivingCount, 1)
@@ -150,6 +191,8 @@ func (r *snapRunner) recv(t recvSnapTask) {
 		if err := r.router.sendRaftMessage(msg); err != nil {
 			log.S().Error(err)
 		}
+	} else {
+		r.snapManager.recordSnapEvent(SnapEvent{Type: SnapEventFailed, Entry: SnapEntryReceiving, Reason: err.Error()})
 	}
 	t.callback(err)
 }
@@ -195,6 +238,9 @@ func (r *snapRunner) recvSnap(stream tikvpb.Tikv_SnapshotServer) (*raft_serverpb
 		if len(data) == 0 {
 			return nil, errors.Errorf("%v receive chunk with empty data", snapKey)
 		}
+		if err = r.snapManager.throttle(stream.Context(), len(data)); err != nil {
+			return nil, err
+		}
 		_, err = bytes.NewReader(data).WriteTo(snap)
 		if err != nil {
 			return nil, errors.Errorf("%v failed to write snapshot file %v: %v", snapKey, snap.Path(), err)
@@ -205,6 +251,8 @@ func (r *snapRunner) recvSnap(stream tikvpb.Tikv_SnapshotServer) (*raft_serverpb
 	if err != nil {
 		return nil, err
 	}
+	r.snapManager.recordSnapEvent(SnapEvent{Type: SnapEventReceived, Key: snapKey, Entry: SnapEntryReceiving,
+		StoreID: head.GetMessage().GetFromPeer().GetStoreId(), Bytes: snap.TotalSize(), Total: snap.TotalSize()})
 
 	if err := stream.SendAndClose(&raft_serverpb.Done{}); err != nil {
 		return nil, err
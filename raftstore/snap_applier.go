@@ -64,9 +64,8 @@ func newSnapApplier(cfs []*CFFile) (*snapApplier, error) {
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
-		it.curLockKey, it.curLockValue, it.lockCFData, err = readEntryFromPlainFile(it.lockCFData)
-		if err != nil {
-			return nil, errors.WithStack(err)
+		if err = it.readLockEntry(); err != nil {
+			return nil, err
 		}
 	}
 	if cfs[defaultCFIdx].Size > 0 {
@@ -141,8 +140,7 @@ func (ai *snapApplier) nextLock() (*applySnapItem, error) {
 	mvccLock.Value = val
 	item.val = mvccLock.MarshalBinary()
 	if len(ai.lockCFData) > 1 {
-		ai.curLockKey, ai.curLockValue, ai.lockCFData, err = readEntryFromPlainFile(ai.lockCFData)
-		if err != nil {
+		if err = ai.readLockEntry(); err != nil {
 			return nil, err
 		}
 	} else {
@@ -151,6 +149,21 @@ func (ai *snapApplier) nextLock() (*applySnapItem, error) {
 	return item, err
 }
 
+// readLockEntry reads the next entry of the lock CF, the key in the file is memcomparable encoded.
+func (ai *snapApplier) readLockEntry() error {
+	encodedKey, val, remain, err := readEntryFromPlainFile(ai.lockCFData)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	ai.curLockValue, ai.lockCFData = val, remain
+	if len(encodedKey) == 0 {
+		ai.curLockKey = nil
+		return nil
+	}
+	_, ai.curLockKey, err = codec.DecodeBytes(encodedKey, nil)
+	return errors.WithStack(err)
+}
+
 func (ai *snapApplier) popFullValue(key []byte, startTS uint64, shortVal []byte, op byte) ([]byte, error) {
 	return ai.loadFullValueOpt(key, startTS, shortVal, op, true)
 }
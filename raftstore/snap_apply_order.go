@@ -0,0 +1,52 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"sync/atomic"
+
+	"github.com/pingcap/errors"
+)
+
+// finishApplyJob finishes the job of an applied snapshot, the peer starts to serve once the job is finished.
+func (snapCtx *snapContext) finishApplyJob(state regionApplyState, visible bool) {
+	event := SnapEvent{Key: SnapKey{RegionID: state.localState.GetRegion().GetId()}, Entry: SnapEntryApplying}
+	if visible {
+		atomic.StoreUint32(state.status, JobStatusFinished)
+		event.Type = SnapEventApplied
+	} else {
+		atomic.StoreUint32(state.status, JobStatusFailed)
+		event.Type = SnapEventFailed
+		event.Reason = "snapshot data is not ingested"
+	}
+	snapCtx.mgr.recordSnapEvent(event)
+}
+
+// checkApplyOrder verifies that the applied snapshots are not visible to the peers yet and their locks are
+// already in the lock store before the other data is ingested.
+func (snapCtx *snapContext) checkApplyOrder(states []regionApplyState) error {
+	lockStore := snapCtx.engiens.kv.LockStore
+	for _, state := range states {
+		regionID := state.localState.GetRegion().GetId()
+		if status := atomic.LoadUint32(state.status); status == JobStatusFinished {
+			return errors.Errorf("region %d snapshot job finished before its data is visible", regionID)
+		}
+		for _, key := range state.lockKeys {
+			if lockStore.Get(key, nil) == nil {
+				return errors.Errorf("region %d lock %q is not visible before the write CF", regionID, key)
+			}
+		}
+	}
+	return nil
+}
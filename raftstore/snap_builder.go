@@ -15,6 +15,7 @@ package raftstore
 
 import (
 	"bytes"
+	"context"
 	"math"
 	"os"
 
@@ -34,6 +35,7 @@ func newSnapBuilder(cfFiles []*CFFile, snap *regionSnapshot, region *metapb.Regi
 	b.endKey = RawEndKey(region)
 	b.extraEndKey = mvcc.EncodeExtraTxnStatusKey(b.endKey, 0)
 	b.txn = snap.txn
+	b.abort = snap.abort
 	itOpt := badger.DefaultIteratorOptions
 	itOpt.AllVersions = true
 	b.dbIterator = b.txn.NewIterator(itOpt)
@@ -91,8 +93,18 @@ type snapBuilder struct {
 	buf2            []byte
 	kvCount         int
 	size            int
+	// maxTS is the max commit ts of the data.
+	maxTS uint64
+
+	abort *JobStatus
+	// throttle is called for every snapThrottleBatch bytes written, throttled is the size already throttled.
+	throttle  func(ctx context.Context, n int) error
+	throttled int
 }
 
+// snapThrottleBatch is the bytes written by the builder between the waits on the snapshot rate limit.
+const snapThrottleBatch = 64 * 1024
+
 func (b *snapBuilder) build() error {
 	defer func() {
 		b.dbIterator.Close()
@@ -100,6 +112,12 @@ func (b *snapBuilder) build() error {
 		b.txn.Discard()
 	}()
 	for {
+		// Stop early to release the engine snapshot if the task is cancelled.
+		if b.abort != nil {
+			if err := checkAbort(b.abort); err != nil {
+				return err
+			}
+		}
 		var err error
 		switch b.currentKeyType() {
 		case currentKeyDB:
@@ -121,6 +139,12 @@ func (b *snapBuilder) build() error {
 		if err != nil {
 			return err
 		}
+		if b.throttle != nil && b.size-b.throttled >= snapThrottleBatch {
+			if err = b.throttle(context.Background(), b.size-b.throttled); err != nil {
+				return err
+			}
+			b.throttled = b.size
+		}
 	}
 }
 
@@ -132,10 +156,11 @@ const (
 
 func (b *snapBuilder) currentKeyType() (keyType int) {
 	curKey := b.curDBKey
-	if len(curKey) == 0 || (len(b.curLockKey) > 0 && bytes.Compare(b.curLockKey, curKey) < 0) {
-		keyType = currentKeyLock
+	// The lock goes first on the same key, the default CF value of a lock is newer than the committed ones.
+	if len(b.curLockKey) > 0 && (len(curKey) == 0 || bytes.Compare(b.curLockKey, curKey) <= 0) {
+		keyType, curKey = currentKeyLock, b.curLockKey
 	}
-	if len(curKey) == 0 || (len(b.curExtraKey) > 0 && bytes.Compare(b.curExtraKey, curKey) < 0) {
+	if len(b.curExtraKey) > 0 && (len(curKey) == 0 || bytes.Compare(b.curExtraKey, curKey) < 0) {
 		keyType = currentKeyExtra
 	}
 	return
@@ -247,6 +272,9 @@ func (b *snapBuilder) addExtraEntry() error {
 }
 
 func (b *snapBuilder) addSSTKey(key []byte, startTS, commitTS uint64, val []byte, writeType byte) error {
+	if commitTS > b.maxTS {
+		b.maxTS = commitTS
+	}
 	writeCFKey := encodeRocksDBSSTKey(key, &commitTS)
 	writeCFVal := new(writeCFValue)
 	writeCFVal.writeType = writeType
@@ -28,6 +28,8 @@ var (
 	errBadLockFormat   = errors.New("bad format lock data")
 	errInvalidSnapshot = errors.New("invalid snapshot")
 	errBadKeyPrefix    = errors.New("bad key prefix")
+	errBadKeyLength    = errors.New("bad key length")
+	errBadWriteFormat  = errors.New("bad format write data")
 )
 
 type writeCFValue struct {
@@ -39,6 +41,10 @@ type writeCFValue struct {
 const rocksDBSSTKeyDataPrefix = 'z'
 
 func decodeRocksDBSSTKey(k []byte) (key []byte, ts uint64, err error) {
+	// The key has the prefix and the ts at least, a corrupted snapshot may have shorter ones.
+	if len(k) < 9 {
+		return nil, 0, errors.WithStack(errBadKeyLength)
+	}
 	if k[0] != rocksDBSSTKeyDataPrefix {
 		return nil, 0, errors.WithStack(errBadKeyPrefix)
 	}
@@ -68,22 +74,31 @@ func encodeRocksDBSSTKey(k []byte, ts *uint64) []byte {
 }
 
 func decodeWriteCFValue(b []byte) *writeCFValue {
+	w, err := parseWriteCFValue(b)
+	y.Assert(err == nil)
+	return w
+}
+
+func parseWriteCFValue(b []byte) (*writeCFValue, error) {
+	if len(b) == 0 {
+		return nil, errBadWriteFormat
+	}
 	w := new(writeCFValue)
 	w.writeType = b[0]
 	b = b[1:]
 	var err error
 	b, w.startTS, err = codec.DecodeUvarint(b)
-	y.Assert(err == nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
 	if len(b) == 0 {
-		return w
-	}
-	flag := b[0]
-	y.Assert(flag == shortValuePrefix)
-	l := b[1]
-	b = b[2:]
-	y.Assert(int(l) == len(b))
-	w.shortValue = b
-	return w
+		return w, nil
+	}
+	if len(b) < 2 || b[0] != shortValuePrefix || int(b[1]) != len(b)-2 {
+		return nil, errBadWriteFormat
+	}
+	w.shortValue = b[2:]
+	return w, nil
 }
 
 func encodeWriteCFValue(v *writeCFValue) []byte {
@@ -135,11 +150,10 @@ func decodeLockCFValue(b []byte) (*lockCFValue, error) {
 	if len(b) == 0 {
 		return lv, nil
 	}
-	flag, l := b[0], b[1]
-	b = b[2:]
-	y.Assert(flag == shortValuePrefix)
-	y.Assert(int(l) == len(b))
-	lv.shortVal = b
+	if len(b) < 2 || b[0] != shortValuePrefix || int(b[1]) != len(b)-2 {
+		return nil, errBadLockFormat
+	}
+	lv.shortVal = b[2:]
 	return lv, nil
 }
 
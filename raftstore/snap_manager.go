@@ -14,6 +14,7 @@
 package raftstore
 
 import (
+	"context"
 	"io/ioutil"
 	"math"
 	"os"
@@ -28,6 +29,7 @@ import (
 	"github.com/pingcap/errors"
 	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
 	"github.com/pingcap/log"
+	"golang.org/x/time/rate"
 )
 
 // SnapEntry represents a snapshot entry.
@@ -60,6 +62,13 @@ func (e SnapEntry) String() string {
 type SnapStats struct {
 	ReceivingCount int
 	SendingCount   int
+
+	// GeneratingCount and ApplyingCount are the snapshots being generated and applied, they are also counted
+	// in SendingCount and ReceivingCount.
+	GeneratingCount int
+	ApplyingCount   int
+	// Throttled is the total time the snapshot generating, sending and receiving waited on SnapRateLimit.
+	Throttled time.Duration
 }
 
 func notifyStats(router *router) {
@@ -77,6 +86,19 @@ type SnapManager struct {
 	router       *router
 	limiter      *IOLimiter
 	MaxTotalSize uint64
+	events       snapEventRecorder
+
+	// ingestLimiter limits the tables built by applying snapshots.
+	ingestLimiter *IngestLimiter
+	// throttled is the nanoseconds waited on the limiter.
+	throttled int64
+	// checksums caches the checksums of the snapshot files and the tables to ingest.
+	checksums *ChecksumService
+
+	sendingLock sync.Mutex
+	sendingSeq  uint64
+	// sending holds the cancel functions of the snapshots being sent by region.
+	sending map[uint64]map[uint64]context.CancelFunc
 }
 
 // NewSnapManager returns a new SnapManager.
@@ -201,7 +223,25 @@ func (sm *SnapManager) GetSnapshotForBuilding(key SnapKey) (Snapshot, error) {
 			return nil, err
 		}
 	}
-	return NewSnapForBuilding(sm.base, key, sm.snapSize, sm, sm.limiter)
+	snap, err := NewSnapForBuilding(sm.base, key, sm.snapSize, sm, sm.limiter)
+	if err != nil {
+		return nil, err
+	}
+	snap.checksums = sm.checksums
+	snap.throttle = sm.throttle
+	return snap, nil
+}
+
+// throttle waits for n bytes of the snapshot files generated, sent or received to be allowed by
+// Config.SnapRateLimit.
+func (sm *SnapManager) throttle(ctx context.Context, n int) error {
+	if sm.limiter.Limit() == rate.Inf {
+		return nil
+	}
+	start := time.Now()
+	err := waitIO(ctx, sm.limiter, n)
+	atomic.AddInt64(&sm.throttled, int64(time.Since(start)))
+	return err
 }
 
 func (sm *SnapManager) deleteOldIdleSnaps() error {
@@ -245,7 +285,12 @@ func (sm *SnapManager) deleteOldIdleSnaps() error {
 
 // GetSnapshotForSending gets the snapshot for sending with the given snapshot key.
 func (sm *SnapManager) GetSnapshotForSending(snapKey SnapKey) (Snapshot, error) {
-	return NewSnapForSending(sm.base, snapKey, sm.snapSize, sm)
+	snap, err := NewSnapForSending(sm.base, snapKey, sm.snapSize, sm)
+	if err != nil {
+		return nil, err
+	}
+	snap.checksums = sm.checksums
+	return snap, nil
 }
 
 // GetSnapshotForReceiving gets the snapshot for receiving with the given snapshot key and data.
@@ -255,7 +300,12 @@ func (sm *SnapManager) GetSnapshotForReceiving(snapKey SnapKey, data []byte) (Sn
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	return NewSnapForReceiving(sm.base, snapKey, snapshotData.Meta, sm.snapSize, sm, sm.limiter)
+	snap, err := NewSnapForReceiving(sm.base, snapKey, snapshotData.Meta, sm.snapSize, sm, sm.limiter)
+	if err != nil {
+		return nil, err
+	}
+	snap.checksums = sm.checksums
+	return snap, nil
 }
 
 // GetSnapshotForApplying gets the snapshot for applying with the given snapshot key.
@@ -267,6 +317,7 @@ func (sm *SnapManager) GetSnapshotForApplying(snapKey SnapKey) (Snapshot, error)
 	if !snap.Exists() {
 		return nil, errors.Errorf("snapshot of %s not exists", snapKey)
 	}
+	snap.checksums = sm.checksums
 	return snap, nil
 }
 
@@ -321,7 +372,7 @@ func (sm *SnapManager) Deregister(key SnapKey, entry SnapEntry) {
 func (sm *SnapManager) Stats() SnapStats {
 	sm.registryLock.RLock()
 	defer sm.registryLock.RUnlock()
-	var sendingCount, receivingCount int
+	stats := SnapStats{Throttled: time.Duration(atomic.LoadInt64(&sm.throttled))}
 	for _, entries := range sm.registry {
 		var isSending, isReceiving bool
 		for _, entry := range entries {
@@ -331,15 +382,21 @@ func (sm *SnapManager) Stats() SnapStats {
 			case SnapEntryReceiving, SnapEntryApplying:
 				isReceiving = true
 			}
+			switch entry {
+			case SnapEntryGenerating:
+				stats.GeneratingCount++
+			case SnapEntryApplying:
+				stats.ApplyingCount++
+			}
 		}
 		if isSending {
-			sendingCount++
+			stats.SendingCount++
 		}
 		if isReceiving {
-			receivingCount++
+			stats.ReceivingCount++
 		}
 	}
-	return SnapStats{SendingCount: sendingCount, ReceivingCount: receivingCount}
+	return stats
 }
 
 // DeleteSnapshot deletes a snapshot.
@@ -362,9 +419,54 @@ func (sm *SnapManager) DeleteSnapshot(key SnapKey, snapshot Snapshot, checkEntry
 	return true
 }
 
+// deleteSnapshotFiles deletes the snapshot files of the key if the snapshot is not registered.
+func (sm *SnapManager) deleteSnapshotFiles(key SnapKey) {
+	snap, err := sm.GetSnapshotForSending(key)
+	if err != nil {
+		log.S().Warnf("failed to delete snapshot %s, err: %v", key, err)
+		return
+	}
+	sm.DeleteSnapshot(key, snap, true)
+}
+
+// sendingContext returns a context for sending a snapshot of the region, the context is canceled by
+// CancelSending. The returned function must be called after the sending is finished.
+func (sm *SnapManager) sendingContext(regionID uint64) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sm.sendingLock.Lock()
+	sm.sendingSeq++
+	seq := sm.sendingSeq
+	if sm.sending[regionID] == nil {
+		sm.sending[regionID] = make(map[uint64]context.CancelFunc)
+	}
+	sm.sending[regionID][seq] = cancel
+	sm.sendingLock.Unlock()
+	return ctx, func() {
+		sm.sendingLock.Lock()
+		delete(sm.sending[regionID], seq)
+		if len(sm.sending[regionID]) == 0 {
+			delete(sm.sending, regionID)
+		}
+		sm.sendingLock.Unlock()
+		cancel()
+	}
+}
+
+// CancelSending cancels the snapshots of the region being sent, it returns the number of canceled snapshots.
+func (sm *SnapManager) CancelSending(regionID uint64) int {
+	sm.sendingLock.Lock()
+	defer sm.sendingLock.Unlock()
+	cancels := sm.sending[regionID]
+	for _, cancel := range cancels {
+		cancel()
+	}
+	return len(cancels)
+}
+
 // SnapManagerBuilder represents a snapshot manager builder.
 type SnapManagerBuilder struct {
 	maxTotalSize uint64
+	rateLimit    uint64
 }
 
 // MaxTotalSize returns the max total size of the SnapManagerBuilder.
@@ -373,18 +475,32 @@ func (smb *SnapManagerBuilder) MaxTotalSize(v uint64) *SnapManagerBuilder {
 	return smb
 }
 
+// RateLimit sets the max bytes per second of the snapshot files generated, sent and received, 0 means no
+// limit.
+func (smb *SnapManagerBuilder) RateLimit(v uint64) *SnapManagerBuilder {
+	smb.rateLimit = v
+	return smb
+}
+
 // Build builds a router with the given path.
 func (smb *SnapManagerBuilder) Build(path string, router *router) *SnapManager {
 	var maxTotalSize uint64 = math.MaxUint64
 	if smb.maxTotalSize > 0 {
 		maxTotalSize = smb.maxTotalSize
 	}
+	ingestLimiter := newIngestLimiter(0, 0, 0)
+	if router != nil && router.ingestLimiter != nil {
+		ingestLimiter = router.ingestLimiter
+	}
 	return &SnapManager{
-		base:         path,
-		snapSize:     new(int64),
-		registry:     map[SnapKey][]SnapEntry{},
-		router:       router,
-		limiter:      NewInfLimiter(),
-		MaxTotalSize: maxTotalSize,
+		base:          path,
+		snapSize:      new(int64),
+		registry:      map[SnapKey][]SnapEntry{},
+		sending:       map[uint64]map[uint64]context.CancelFunc{},
+		router:        router,
+		limiter:       newIOLimiter(smb.rateLimit, snapChunkLen),
+		ingestLimiter: ingestLimiter,
+		checksums:     NewChecksumService(),
+		MaxTotalSize:  maxTotalSize,
 	}
 }
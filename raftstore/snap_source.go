@@ -0,0 +1,382 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/pingcap/log"
+	"github.com/zhangjinpeng1987/raft"
+	"go.uber.org/zap"
+)
+
+// The policies to choose the peer sending a snapshot.
+const (
+	// The leader always sends the snapshots.
+	SnapshotSourceLeader = "leader"
+	// The peer closest to the receiver by the store labels sends the snapshot, the leader is preferred on a tie.
+	SnapshotSourceClosest = "closest"
+)
+
+// The types of the SnapshotSourceEvent.
+const (
+	// The leader asks a follower to send the snapshot.
+	SnapSourceEventRelay = "relay"
+	// The follower sends its snapshot on behalf of the leader.
+	SnapSourceEventSent = "sent"
+	// The receiver doesn't catch up in time, the leader sends the next snapshot itself.
+	SnapSourceEventTimeout = "timeout"
+)
+
+// extraMsgSnapshotRelay is the type of the extra message asking a follower to send its snapshot to a peer on
+// behalf of the leader, it is not one of the kvproto types.
+const extraMsgSnapshotRelay rspb.ExtraMessageType = 100
+
+// StoreTopology holds the labels of the stores, the snapshot sources are chosen by them.
+type StoreTopology struct {
+	mu     sync.RWMutex
+	labels map[uint64][]StoreLabel
+}
+
+// NewStoreTopology creates an empty StoreTopology.
+func NewStoreTopology() *StoreTopology {
+	return &StoreTopology{labels: make(map[uint64][]StoreLabel)}
+}
+
+// SetLabels sets the labels of the store.
+func (t *StoreTopology) SetLabels(storeID uint64, labels []StoreLabel) {
+	t.mu.Lock()
+	t.labels[storeID] = append([]StoreLabel{}, labels...)
+	t.mu.Unlock()
+}
+
+func (t *StoreTopology) label(storeID uint64, key string) (string, bool) {
+	labels, ok := t.labels[storeID]
+	if !ok {
+		return "", false
+	}
+	for _, l := range labels {
+		if l.LabelKey == key {
+			return l.LabelValue, true
+		}
+	}
+	return "", true
+}
+
+// distance returns the number of the location labels the stores differ in from the first different level,
+// false means the labels of a store are unknown.
+func (t *StoreTopology) distance(locationLabels []string, store1, store2 uint64) (int, bool) {
+	if t == nil {
+		return 0, false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for i, key := range locationLabels {
+		v1, ok1 := t.label(store1, key)
+		v2, ok2 := t.label(store2, key)
+		if !ok1 || !ok2 {
+			return 0, false
+		}
+		if v1 != v2 {
+			return len(locationLabels) - i, true
+		}
+	}
+	_, ok1 := t.labels[store1]
+	_, ok2 := t.labels[store2]
+	return 0, ok1 && ok2
+}
+
+// SnapshotSourceEvent is recorded when a snapshot is relayed by a follower.
+type SnapshotSourceEvent struct {
+	Type     string
+	ToPeerID uint64
+	SourceID uint64
+	// Index is the snapshot index of the leader, the relayed snapshot is not older than it.
+	Index uint64
+	Time  time.Time
+}
+
+const maxRecentSnapSourceEvents = 64
+
+// snapRelay is a snapshot the leader asked a follower to send.
+type snapRelay struct {
+	source uint64
+	index  uint64
+	since  time.Time
+}
+
+// pendingSnapRelay is a snapshot the follower is going to send on behalf of the leader.
+type pendingSnapRelay struct {
+	leader *metapb.Peer
+	to     *metapb.Peer
+	term   uint64
+	index  uint64
+	since  time.Time
+}
+
+// snapSource chooses the snapshot sources on the leader and relays the snapshots on the followers.
+type snapSource struct {
+	policy         string
+	locationLabels []string
+	topology       *StoreTopology
+	timeout        time.Duration
+
+	// relays are the snapshots being relayed by the receiver, fallbacks are the receivers the leader sends the
+	// snapshots to itself until they catch up the index.
+	relays    map[uint64]snapRelay
+	fallbacks map[uint64]uint64
+	pending   *pendingSnapRelay
+
+	mu     sync.Mutex
+	recent []SnapshotSourceEvent
+}
+
+func newSnapSource(cfg *Config) *snapSource {
+	if cfg.SnapshotSourcePolicy != SnapshotSourceClosest {
+		return nil
+	}
+	return &snapSource{
+		policy:         cfg.SnapshotSourcePolicy,
+		locationLabels: cfg.LocationLabels,
+		topology:       cfg.StoreTopology,
+		timeout:        cfg.SnapshotRelayTimeout,
+		relays:         make(map[uint64]snapRelay),
+		fallbacks:      make(map[uint64]uint64),
+	}
+}
+
+func (s *snapSource) record(tp string, toPeerID, sourceID, index uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.recent) == maxRecentSnapSourceEvents {
+		copy(s.recent, s.recent[1:])
+		s.recent = s.recent[:len(s.recent)-1]
+	}
+	s.recent = append(s.recent, SnapshotSourceEvent{
+		Type:     tp,
+		ToPeerID: toPeerID,
+		SourceID: sourceID,
+		Index:    index,
+		Time:     time.Now(),
+	})
+}
+
+func (s *snapSource) snapshot() []SnapshotSourceEvent {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]SnapshotSourceEvent{}, s.recent...)
+}
+
+func (p *Peer) progress(peerID uint64) *raft.Progress {
+	if pr, ok := p.RaftGroup.Raft.Prs[peerID]; ok {
+		return pr
+	}
+	return p.RaftGroup.Raft.LearnerPrs[peerID]
+}
+
+// closestSnapshotSource returns the follower closer to the receiver than the leader, which has applied the
+// snapshot index of the leader, nil means the leader should send the snapshot.
+func (p *Peer) closestSnapshotSource(to *metapb.Peer, index uint64) *metapb.Peer {
+	s := p.snapSource
+	best, ok := s.topology.distance(s.locationLabels, p.Meta.StoreId, to.StoreId)
+	if !ok {
+		return nil
+	}
+	var source *metapb.Peer
+	for _, peer := range p.Region().GetPeers() {
+		if peer.Id == p.PeerID() || peer.Id == to.Id {
+			continue
+		}
+		pr := p.progress(peer.Id)
+		if pr == nil || !pr.RecentActive || pr.State == raft.ProgressStateSnapshot || pr.Match < index {
+			continue
+		}
+		if d, ok := s.topology.distance(s.locationLabels, peer.StoreId, to.StoreId); ok && d < best {
+			best, source = d, peer
+		}
+	}
+	return source
+}
+
+// relaySnapshot asks a follower closer to the receiver to send its snapshot instead, it returns false if the
+// leader should send the snapshot.
+func (p *Peer) relaySnapshot(msg *eraftpb.Message, trans Transport) bool {
+	s := p.snapSource
+	if s == nil || !p.IsLeader() {
+		return false
+	}
+	if _, ok := s.fallbacks[msg.To]; ok {
+		return false
+	}
+	to := p.getPeerFromCache(msg.To)
+	if to == nil {
+		return false
+	}
+	index := msg.GetSnapshot().GetMetadata().GetIndex()
+	source := p.closestSnapshotSource(to, index)
+	if source == nil {
+		return false
+	}
+	from := *p.Meta
+	err := trans.Send(&rspb.RaftMessage{
+		RegionId:    p.regionID,
+		FromPeer:    &from,
+		ToPeer:      source,
+		RegionEpoch: &metapb.RegionEpoch{ConfVer: p.Region().RegionEpoch.ConfVer, Version: p.Region().RegionEpoch.Version},
+		Message: &eraftpb.Message{
+			MsgType: eraftpb.MessageType_MsgSnapStatus,
+			From:    p.PeerID(),
+			To:      source.Id,
+			Term:    p.Term(),
+			Index:   index,
+		},
+		ExtraMsg: &rspb.ExtraMessage{Type: extraMsgSnapshotRelay, CheckPeers: []*metapb.Peer{to}},
+	})
+	if err != nil {
+		log.Warn("failed to relay snapshot", zap.String("tag", p.Tag), zap.Uint64("source", source.Id), zap.Error(err))
+		return false
+	}
+	log.Info("relay snapshot", zap.String("tag", p.Tag), zap.Uint64("to", to.Id), zap.Uint64("source", source.Id),
+		zap.Uint64("index", index))
+	s.relays[to.Id] = snapRelay{source: source.Id, index: index, since: time.Now()}
+	s.record(SnapSourceEventRelay, to.Id, source.Id, index)
+	return true
+}
+
+// checkSnapshotRelays fails the relayed snapshots not received in time, so the leader sends the next ones.
+func (p *Peer) checkSnapshotRelays() {
+	s := p.snapSource
+	if s == nil {
+		return
+	}
+	if !p.IsLeader() {
+		s.relays = make(map[uint64]snapRelay)
+		s.fallbacks = make(map[uint64]uint64)
+		return
+	}
+	for peerID, index := range s.fallbacks {
+		if pr := p.progress(peerID); pr == nil || pr.Match >= index {
+			delete(s.fallbacks, peerID)
+		}
+	}
+	for peerID, relay := range s.relays {
+		pr := p.progress(peerID)
+		if pr == nil || pr.State != raft.ProgressStateSnapshot || pr.Match >= relay.index {
+			delete(s.relays, peerID)
+			continue
+		}
+		if time.Since(relay.since) < s.timeout {
+			continue
+		}
+		log.Warn("relayed snapshot timed out", zap.String("tag", p.Tag), zap.Uint64("to", peerID),
+			zap.Uint64("source", relay.source))
+		delete(s.relays, peerID)
+		s.fallbacks[peerID] = relay.index
+		s.record(SnapSourceEventTimeout, peerID, relay.source, relay.index)
+		p.RaftGroup.ReportSnapshot(peerID, raft.SnapshotFailure)
+	}
+}
+
+func isSnapshotRelay(msg *rspb.RaftMessage) bool {
+	return msg.GetExtraMsg().GetType() == extraMsgSnapshotRelay
+}
+
+// onSnapshotRelay accepts the request of the leader to send the snapshot to a peer.
+func (d *peerMsgHandler) onSnapshotRelay(msg *rspb.RaftMessage) {
+	p := d.peer
+	s := p.snapSource
+	term := msg.GetMessage().GetTerm()
+	to := msg.GetExtraMsg().GetCheckPeers()
+	if s == nil || p.IsLeader() || len(to) != 1 || term != p.Term() || msg.GetFromPeer().GetId() != p.LeaderID() {
+		log.S().Infof("%s ignore snapshot relay from %d at term %d", d.tag(), msg.GetFromPeer().GetId(), term)
+		return
+	}
+	s.pending = &pendingSnapRelay{
+		leader: msg.FromPeer,
+		to:     to[0],
+		term:   term,
+		index:  msg.Message.Index,
+		since:  time.Now(),
+	}
+	d.maybeSendRelayedSnapshot()
+}
+
+// maybeSendRelayedSnapshot sends the snapshot of the follower when it is generated.
+func (d *peerMsgHandler) maybeSendRelayedSnapshot() {
+	p := d.peer
+	if p.snapSource == nil || p.snapSource.pending == nil {
+		return
+	}
+	s := p.snapSource
+	r := s.pending
+	if p.Term() != r.term || p.IsLeader() || time.Since(r.since) > s.timeout {
+		log.S().Infof("%s drop snapshot relay to %d at term %d", d.tag(), r.to.Id, r.term)
+		s.pending = nil
+		return
+	}
+	if p.Store().AppliedIndex() < r.index || p.IsApplyingSnapshot() || p.HasPendingSnapshot() {
+		return
+	}
+	snap, err := p.Store().Snapshot()
+	if err == raft.ErrSnapshotTemporarilyUnavailable && p.Store().snapStorm != nil {
+		err = p.Store().snapStorm
+	} else if err == raft.ErrSnapshotTemporarilyUnavailable {
+		// The snapshot is generated after the next ready.
+		d.hasReady = true
+		return
+	}
+	s.pending = nil
+	if err != nil {
+		log.S().Warnf("%s failed to generate relayed snapshot: %v", d.tag(), err)
+		return
+	}
+	if snap.GetMetadata().GetIndex() < r.index {
+		log.S().Warnf("%s relayed snapshot index %d is older than %d", d.tag(), snap.GetMetadata().GetIndex(), r.index)
+		return
+	}
+	err = d.ctx.trans.Send(&rspb.RaftMessage{
+		RegionId:    p.regionID,
+		FromPeer:    r.leader,
+		ToPeer:      r.to,
+		RegionEpoch: &metapb.RegionEpoch{ConfVer: p.Region().RegionEpoch.ConfVer, Version: p.Region().RegionEpoch.Version},
+		Message: &eraftpb.Message{
+			MsgType:  eraftpb.MessageType_MsgSnapshot,
+			From:     r.leader.Id,
+			To:       r.to.Id,
+			Term:     r.term,
+			Snapshot: &snap,
+		},
+	})
+	if err != nil {
+		log.S().Warnf("%s failed to send relayed snapshot: %v", d.tag(), err)
+		return
+	}
+	s.record(SnapSourceEventSent, r.to.Id, p.PeerID(), r.index)
+}
+
+// SnapshotSourceEvents returns the recent relayed snapshots of the region, the oldest first.
+func (r *Router) SnapshotSourceEvents(regionID uint64) ([]SnapshotSourceEvent, error) {
+	p := r.router.get(regionID)
+	if p == nil {
+		return nil, errPeerNotFound
+	}
+	return p.peer.peer.snapSource.snapshot(), nil
+}
@@ -0,0 +1,203 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// SnapEventType represents the type of a snapshot lifecycle event.
+type SnapEventType int
+
+// SnapEventType
+const (
+	SnapEventGenerated SnapEventType = 1
+	SnapEventSending   SnapEventType = 2
+	SnapEventSent      SnapEventType = 3
+	SnapEventReceived  SnapEventType = 4
+	SnapEventApplied   SnapEventType = 5
+	SnapEventCanceled  SnapEventType = 6
+	SnapEventFailed    SnapEventType = 7
+	// SnapEventActivated means the peer has noticed the applied snapshot and serves the reads and
+	// commands waiting for it.
+	SnapEventActivated SnapEventType = 8
+)
+
+// String returns a string representation of the snapshot event type.
+func (t SnapEventType) String() string {
+	switch t {
+	case SnapEventGenerated:
+		return "generated"
+	case SnapEventSending:
+		return "sending"
+	case SnapEventSent:
+		return "sent"
+	case SnapEventReceived:
+		return "received"
+	case SnapEventApplied:
+		return "applied"
+	case SnapEventCanceled:
+		return "canceled"
+	case SnapEventFailed:
+		return "failed"
+	case SnapEventActivated:
+		return "activated"
+	}
+	return "unknown"
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (t SnapEventType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// SnapEvent represents a snapshot lifecycle event.
+type SnapEvent struct {
+	Type SnapEventType
+	Key  SnapKey
+	// Entry is the stage the snapshot was in when the event happened.
+	Entry SnapEntry
+	// StoreID is the peer store for sending and receiving events.
+	StoreID uint64
+	// Bytes is the number of bytes processed so far, Total is the snapshot size.
+	Bytes  uint64
+	Total  uint64
+	Reason string
+	Time   time.Time
+}
+
+// SnapMetrics represents the aggregated snapshot metrics of a store.
+type SnapMetrics struct {
+	Generated     uint64
+	Sent          uint64
+	SentBytes     uint64
+	Received      uint64
+	ReceivedBytes uint64
+	Applied       uint64
+	Canceled      uint64
+	Failed        uint64
+}
+
+// SnapEventListener is called for every snapshot event, it must not block.
+type SnapEventListener func(event SnapEvent)
+
+const maxRecentSnapEvents = 256
+
+type snapEventRecorder struct {
+	mu        sync.Mutex
+	metrics   SnapMetrics
+	recent    []SnapEvent
+	listeners []SnapEventListener
+}
+
+func (r *snapEventRecorder) record(event SnapEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if event.Type == SnapEventSending {
+		log.Debug("snapshot event", zap.Stringer("type", event.Type), zap.Stringer("snap key", event.Key),
+			zap.Uint64("bytes", event.Bytes), zap.Uint64("total", event.Total))
+	} else {
+		log.Info("snapshot event", zap.Stringer("type", event.Type), zap.Stringer("snap key", event.Key),
+			zap.Uint64("store id", event.StoreID), zap.Uint64("total", event.Total), zap.String("reason", event.Reason))
+	}
+
+	r.mu.Lock()
+	switch event.Type {
+	case SnapEventGenerated:
+		r.metrics.Generated++
+	case SnapEventSent:
+		r.metrics.Sent++
+		r.metrics.SentBytes += event.Total
+	case SnapEventReceived:
+		r.metrics.Received++
+		r.metrics.ReceivedBytes += event.Total
+	case SnapEventApplied:
+		r.metrics.Applied++
+	case SnapEventCanceled:
+		r.metrics.Canceled++
+	case SnapEventFailed:
+		r.metrics.Failed++
+	}
+	if event.Type != SnapEventSending {
+		if len(r.recent) >= maxRecentSnapEvents {
+			r.recent = append(r.recent[:0], r.recent[1:]...)
+		}
+		r.recent = append(r.recent, event)
+	}
+	listeners := r.listeners
+	r.mu.Unlock()
+
+	for _, l := range listeners {
+		l(event)
+	}
+}
+
+func (r *snapEventRecorder) addListener(l SnapEventListener) {
+	r.mu.Lock()
+	// Copy on write so record can call listeners without holding the lock.
+	listeners := make([]SnapEventListener, 0, len(r.listeners)+1)
+	listeners = append(listeners, r.listeners...)
+	r.listeners = append(listeners, l)
+	r.mu.Unlock()
+}
+
+func (r *snapEventRecorder) snapshot() (SnapMetrics, []SnapEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	events := make([]SnapEvent, len(r.recent))
+	copy(events, r.recent)
+	return r.metrics, events
+}
+
+// AddSnapEventListener registers a listener for the snapshot lifecycle events.
+func (sm *SnapManager) AddSnapEventListener(l SnapEventListener) {
+	sm.events.addListener(l)
+}
+
+// SnapMetrics returns the aggregated snapshot metrics.
+func (sm *SnapManager) SnapMetrics() SnapMetrics {
+	m, _ := sm.events.snapshot()
+	return m
+}
+
+// RecentSnapEvents returns the most recent snapshot events, sending progress events are not kept.
+func (sm *SnapManager) RecentSnapEvents() []SnapEvent {
+	_, events := sm.events.snapshot()
+	return events
+}
+
+func (sm *SnapManager) recordSnapEvent(event SnapEvent) {
+	sm.events.record(event)
+}
+
+type snapStatsResponse struct {
+	Metrics SnapMetrics
+	Events  []SnapEvent
+}
+
+// ServeHTTP serves the snapshot metrics and recent events as JSON for the status server.
+func (sm *SnapManager) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	metrics, events := sm.events.snapshot()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&snapStatsResponse{Metrics: metrics, Events: events}); err != nil {
+		log.Warn("failed to encode snapshot stats", zap.Error(err))
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"time"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// snapGenGuard limits the snapshots generated for a region in a sliding window, so the flapping followers
+// can't make the leader generate snapshots endlessly.
+type snapGenGuard struct {
+	limit  int
+	window time.Duration
+	// generated are the times the snapshots in the window were requested, the oldest first.
+	generated []time.Time
+}
+
+func newSnapGenGuard(cfg *Config) *snapGenGuard {
+	if cfg.SnapGenLimit <= 0 {
+		return nil
+	}
+	return &snapGenGuard{limit: cfg.SnapGenLimit, window: cfg.SnapGenLimitWindow}
+}
+
+// check counts a snapshot generated at now, it returns ErrSnapshotStorm without counting if the limit is
+// reached.
+func (g *snapGenGuard) check(regionID uint64, now time.Time) *ErrSnapshotStorm {
+	if g == nil {
+		return nil
+	}
+	expired := 0
+	for expired < len(g.generated) && now.Sub(g.generated[expired]) >= g.window {
+		expired++
+	}
+	g.generated = g.generated[expired:]
+	if len(g.generated) >= g.limit {
+		return &ErrSnapshotStorm{
+			RegionID:   regionID,
+			Limit:      g.limit,
+			Window:     g.window,
+			RetryAfter: g.generated[0].Add(g.window).Sub(now),
+		}
+	}
+	g.generated = append(g.generated, now)
+	return nil
+}
+
+// SnapshotStorm returns the error of the last snapshot refused by Config.SnapGenLimit, nil if the next
+// snapshot is not refused yet.
+func (ps *PeerStorage) SnapshotStorm() error {
+	if ps.snapStorm == nil {
+		return nil
+	}
+	return ps.snapStorm
+}
+
+type pdSnapStormTask struct {
+	err *ErrSnapshotStorm
+	// heartbeat is the heartbeat of the region if the peer is the leader.
+	heartbeat *pdRegionHeartbeatTask
+}
+
+// reportSnapshotStorm reports the refused snapshots to PD once per storm.
+func (d *peerMsgHandler) reportSnapshotStorm() {
+	ps := d.peer.Store()
+	if ps.snapStorm == nil || ps.snapStormReported {
+		return
+	}
+	ps.snapStormReported = true
+	t := &pdSnapStormTask{err: ps.snapStorm}
+	if d.peer.IsLeader() {
+		t.heartbeat = d.peer.heartbeatTask()
+	}
+	d.ctx.pdTaskSender <- task{tp: taskTypePDSnapStorm, data: t}
+}
+
+func (r *pdTaskHandler) onSnapStorm(t *pdSnapStormTask) {
+	log.Warn("snapshot storm", zap.Uint64("region id", t.err.RegionID), zap.Error(t.err))
+	if t.heartbeat != nil {
+		// The followers waiting for the snapshots are reported as the pending peers.
+		r.heartbeats.remove(t.heartbeat.region.GetId())
+		r.onHeartbeat(t.heartbeat)
+	}
+}
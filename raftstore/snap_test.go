@@ -14,11 +14,18 @@
 package raftstore
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/ngaut/unistore/rocksdb"
+	"github.com/ngaut/unistore/util"
 	"github.com/pingcap/badger"
 	"github.com/pingcap/badger/y"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
@@ -202,6 +209,9 @@ func doTestSnapFile(t *testing.T, dbHasData bool) {
 		assert.Equal(t, 3, getKVCount(t, dbBundle))
 		// stat.KVCount is 5 because there are two extra default cf value.
 		assert.Equal(t, 5, stat.KVCount)
+		assert.Equal(t, uint64(200), getSnapMaxTS(snapData))
+	} else {
+		assert.Equal(t, uint64(0), getSnapMaxTS(snapData))
 	}
 
 	// Ensure this snapshot could be read for sending.
@@ -723,3 +733,268 @@ func TestSnapMaxTotalSize(t *testing.T) {
 	}
 }
 */
+
+func TestSnapEventRecorder(t *testing.T) {
+	mgr := NewSnapManager("", nil)
+	var received []SnapEventType
+	mgr.AddSnapEventListener(func(event SnapEvent) {
+		received = append(received, event.Type)
+	})
+
+	key := SnapKey{RegionID: 1, Term: 2, Index: 3}
+	mgr.recordSnapEvent(SnapEvent{Type: SnapEventGenerated, Key: key, Total: 100})
+	mgr.recordSnapEvent(SnapEvent{Type: SnapEventSending, Key: key, Bytes: 50, Total: 100})
+	mgr.recordSnapEvent(SnapEvent{Type: SnapEventSent, Key: key, Bytes: 100, Total: 100})
+	mgr.recordSnapEvent(SnapEvent{Type: SnapEventReceived, Key: key, Bytes: 100, Total: 100})
+	mgr.recordSnapEvent(SnapEvent{Type: SnapEventApplied, Key: key})
+	mgr.recordSnapEvent(SnapEvent{Type: SnapEventFailed, Key: key, Reason: "injected"})
+
+	assert.Equal(t, []SnapEventType{SnapEventGenerated, SnapEventSending, SnapEventSent,
+		SnapEventReceived, SnapEventApplied, SnapEventFailed}, received)
+	assert.Equal(t, SnapMetrics{Generated: 1, Sent: 1, SentBytes: 100, Received: 1, ReceivedBytes: 100,
+		Applied: 1, Failed: 1}, mgr.SnapMetrics())
+
+	// Progress events are not kept.
+	events := mgr.RecentSnapEvents()
+	require.Len(t, events, 5)
+	assert.Equal(t, "injected", events[4].Reason)
+	assert.False(t, events[0].Time.IsZero())
+
+	for i := 0; i < maxRecentSnapEvents; i++ {
+		mgr.recordSnapEvent(SnapEvent{Type: SnapEventCanceled, Key: key})
+	}
+	events = mgr.RecentSnapEvents()
+	require.Len(t, events, maxRecentSnapEvents)
+	assert.Equal(t, SnapEventCanceled, events[0].Type)
+
+	rec := httptest.NewRecorder()
+	mgr.ServeHTTP(rec, httptest.NewRequest("GET", "/snapshot/stats", nil))
+	var resp struct{ Metrics SnapMetrics }
+	require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, uint64(maxRecentSnapEvents), resp.Metrics.Canceled)
+	assert.Contains(t, rec.Body.String(), `"Type":"canceled"`)
+}
+
+func writeTestSnapCF(t *testing.T, dir string, cf string, kvs [][2][]byte) *CFFile {
+	path := dir + "/" + cf
+	file, err := os.Create(path)
+	require.Nil(t, err)
+	if plainFileUsed(cf) {
+		var buf []byte
+		for _, kv := range kvs {
+			buf = codec.EncodeCompactBytes(buf, kv[0])
+			buf = codec.EncodeCompactBytes(buf, kv[1])
+		}
+		_, err = file.Write(buf)
+		require.Nil(t, err)
+		require.Nil(t, file.Close())
+	} else if len(kvs) > 0 {
+		w := rocksdb.NewSstFileWriter(file, rocksdb.NewDefaultBlockBasedTableOptions(bytes.Compare))
+		for _, kv := range kvs {
+			require.Nil(t, w.Put(kv[0], kv[1]))
+		}
+		require.Nil(t, w.Finish())
+		require.Nil(t, w.Close())
+	} else {
+		require.Nil(t, file.Close())
+	}
+	info, err := os.Stat(path)
+	require.Nil(t, err)
+	return &CFFile{CF: cf, Path: path, Size: uint64(info.Size())}
+}
+
+func TestValidateSnapData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snap_validate")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	region := genTestRegion(1, 1, 1)
+	ts := func(v uint64) *uint64 { return &v }
+	longVal := bytes.Repeat([]byte("v"), shortValueMaxLen+1)
+	putWithDefault := encodeWriteCFValue(&writeCFValue{writeType: byte(kvrpcpb.Op_Put), startTS: 10})
+	shortPut := encodeWriteCFValue(&writeCFValue{writeType: byte(kvrpcpb.Op_Put), startTS: 10, shortValue: []byte("v")})
+	lockWithDefault := encodeLockCFValue(&lockCFValue{lockType: byte(kvrpcpb.Op_Put), primary: []byte("tb"), startTS: 30}, nil)
+
+	cfs := []*CFFile{
+		writeTestSnapCF(t, dir, CFDefault, [][2][]byte{
+			{encodeRocksDBSSTKey([]byte("tb"), ts(30)), longVal},
+			{encodeRocksDBSSTKey([]byte("tc"), ts(10)), longVal},
+		}),
+		writeTestSnapCF(t, dir, CFLock, [][2][]byte{
+			{encodeRocksDBSSTKey([]byte("tb"), nil), lockWithDefault},
+		}),
+		writeTestSnapCF(t, dir, CFWrite, [][2][]byte{
+			{encodeRocksDBSSTKey([]byte("tb"), ts(20)), shortPut},
+			{encodeRocksDBSSTKey([]byte("tc"), ts(20)), putWithDefault},
+		}),
+	}
+	require.Nil(t, validateSnapData(cfs, region))
+
+	cfs = []*CFFile{
+		// A short key from a corrupted snapshot is reported instead of panicking.
+		writeTestSnapCF(t, dir, CFDefault, [][2][]byte{
+			{[]byte("z"), longVal},
+		}),
+		writeTestSnapCF(t, dir, CFLock, [][2][]byte{
+			{encodeRocksDBSSTKey([]byte("tb"), nil), lockWithDefault},
+		}),
+		writeTestSnapCF(t, dir, CFWrite, [][2][]byte{
+			{encodeRocksDBSSTKey([]byte("tc"), ts(20)), putWithDefault},
+			{encodeRocksDBSSTKey([]byte("td"), ts(5)), shortPut},
+			{encodeRocksDBSSTKey([]byte("zz"), ts(20)), shortPut},
+		}),
+	}
+	err = validateSnapData(cfs, region)
+	validationErr, ok := err.(*SnapValidationError)
+	require.True(t, ok)
+	assert.Equal(t, uint64(1), validationErr.RegionID)
+	require.Len(t, validationErr.Issues, 5)
+	assert.Contains(t, validationErr.Issues[0], "default CF key 7a is malformed: bad key length")
+	assert.Contains(t, validationErr.Issues[1], "lock CF key 7462 start ts 30 has no default CF value")
+	assert.Contains(t, validationErr.Issues[2], "write CF key 7463 start ts 10 has no default CF value")
+	assert.Contains(t, validationErr.Issues[3], "start ts 10 is larger than commit ts 5")
+	assert.Contains(t, validationErr.Issues[4], "out of region range")
+}
+
+func TestSnapMgrCancelSending(t *testing.T) {
+	mgr := NewSnapManager("", nil)
+	ctx1, done1 := mgr.sendingContext(1)
+	ctx2, done2 := mgr.sendingContext(1)
+	ctx3, done3 := mgr.sendingContext(2)
+	done2()
+	assert.NotNil(t, ctx2.Err())
+
+	assert.Equal(t, 1, mgr.CancelSending(1))
+	assert.Equal(t, context.Canceled, ctx1.Err())
+	assert.Nil(t, ctx3.Err())
+	done1()
+	assert.Equal(t, 0, mgr.CancelSending(1))
+	done3()
+	assert.Len(t, mgr.sending, 0)
+}
+
+func TestSnapMgrRateLimit(t *testing.T) {
+	unlimited := NewSnapManager("", nil)
+	assert.Nil(t, unlimited.throttle(context.Background(), 1<<30))
+	assert.Equal(t, time.Duration(0), unlimited.Stats().Throttled)
+
+	mgr := new(SnapManagerBuilder).RateLimit(10*snapChunkLen).Build("", nil)
+	// The burst is allowed at once, the next chunk waits for 1/10 second.
+	assert.Nil(t, mgr.throttle(context.Background(), 10*snapChunkLen))
+	start := time.Now()
+	assert.Nil(t, mgr.throttle(context.Background(), snapChunkLen))
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+	assert.True(t, mgr.Stats().Throttled >= 50*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.NotNil(t, mgr.throttle(ctx, snapChunkLen))
+
+	key1, key2 := SnapKey{RegionID: 1, Term: 1, Index: 1}, SnapKey{RegionID: 2, Term: 1, Index: 1}
+	mgr.Register(key1, SnapEntryGenerating)
+	mgr.Register(key2, SnapEntryApplying)
+	stats := mgr.Stats()
+	assert.Equal(t, 1, stats.GeneratingCount)
+	assert.Equal(t, 1, stats.SendingCount)
+	assert.Equal(t, 1, stats.ApplyingCount)
+	assert.Equal(t, 1, stats.ReceivingCount)
+}
+
+type testCausalTSOracle struct {
+	observed []uint64
+}
+
+func (o *testCausalTSOracle) Observe(ts uint64) {
+	o.observed = append(o.observed, ts)
+}
+
+func TestSnapMaxTS(t *testing.T) {
+	snapData := new(rspb.RaftSnapshotData)
+	setSnapMaxTS(snapData, 0)
+	assert.Empty(t, snapData.Data)
+	setSnapMaxTS(snapData, 300)
+	data, err := snapData.Marshal()
+	require.Nil(t, err)
+	decoded := new(rspb.RaftSnapshotData)
+	require.Nil(t, decoded.Unmarshal(data))
+	assert.Equal(t, uint64(300), getSnapMaxTS(decoded))
+
+	oracle := new(testCausalTSOracle)
+	cfg := NewDefaultConfig()
+	cfg.CausalTSOracle = oracle
+	r := &Router{router: newRouter(nil, nil)}
+	d := &peerMsgHandler{ctx: &RaftContext{GlobalContext: &GlobalContext{cfg: cfg, router: r.router}}}
+	d.observeSnapMaxTS(300)
+	// A snapshot with an older max ts or without the max ts doesn't move the max ts back.
+	d.observeSnapMaxTS(200)
+	d.observeSnapMaxTS(0)
+	assert.Equal(t, uint64(300), r.MaxTS())
+	d.observeSnapMaxTS(400)
+	assert.Equal(t, uint64(400), r.MaxTS())
+	assert.Equal(t, []uint64{300, 400}, oracle.observed)
+}
+
+func TestChecksumService(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "checksum")
+	require.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	svc := NewChecksumService()
+	path := tempDir + "/file"
+	require.Nil(t, ioutil.WriteFile(path, []byte("abcd"), 0600))
+	fi, err := os.Stat(path)
+	require.Nil(t, err)
+	checksum, err := svc.Checksum(path)
+	require.Nil(t, err)
+	require.Nil(t, svc.Verify(path, checksum, false))
+
+	// The cached checksum is reused while the size and the modification time are unchanged.
+	require.Nil(t, ioutil.WriteFile(path, []byte("abce"), 0600))
+	require.Nil(t, os.Chtimes(path, fi.ModTime(), fi.ModTime()))
+	cached, err := svc.Checksum(path)
+	require.Nil(t, err)
+	assert.Equal(t, checksum, cached)
+	assert.NotNil(t, svc.Verify(path, checksum, true))
+
+	results := svc.VerifyAll()
+	require.Len(t, results, 1)
+	assert.False(t, results[0].OK())
+	require.Nil(t, os.Remove(path))
+	assert.Len(t, svc.VerifyAll(), 0)
+
+	// The files of the snapshots created by the SnapManager are verified by the cached checksums.
+	mgr := NewSnapManager(tempDir, nil)
+	cfs := []*CFFile{
+		writeTestSnapCF(t, tempDir, CFLock, [][2][]byte{{[]byte("k1"), []byte("v1")}}),
+		writeTestSnapCF(t, tempDir, CFWrite, [][2][]byte{{[]byte("k2"), []byte("v2")}}),
+	}
+	for _, cf := range cfs {
+		cf.Checksum, err = util.CalcCRC32(cf.Path)
+		require.Nil(t, err)
+	}
+	s := &Snap{CFFiles: cfs, SizeTrack: new(int64), MetaFile: &MetaFile{Path: tempDir + "/meta"}, checksums: mgr.Checksums()}
+	require.Nil(t, s.validate())
+	results = mgr.Checksums().VerifyAll()
+	require.Len(t, results, 2)
+	for _, result := range results {
+		assert.True(t, result.OK(), result.Path)
+	}
+	rec := httptest.NewRecorder()
+	mgr.VerifyChecksumHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/checksums", nil))
+	assert.Equal(t, 200, rec.Code)
+
+	// Corrupt a file without changing its size.
+	data, err := ioutil.ReadFile(cfs[1].Path)
+	require.Nil(t, err)
+	data[len(data)-1] ^= 0xff
+	require.Nil(t, ioutil.WriteFile(cfs[1].Path, data, 0600))
+	rec = httptest.NewRecorder()
+	mgr.VerifyChecksumHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/checksums", nil))
+	assert.Equal(t, 500, rec.Code)
+	var resp []FileChecksum
+	require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.Len(t, resp, 2)
+	assert.False(t, resp[1].OK())
+	assert.NotNil(t, s.validate())
+
+	s.Delete()
+	assert.Len(t, mgr.Checksums().VerifyAll(), 0)
+}
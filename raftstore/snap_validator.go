@@ -0,0 +1,187 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/ngaut/unistore/rocksdb"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/tidb/util/codec"
+)
+
+const maxSnapValidationIssues = 16
+
+// SnapValidationError is returned when the snapshot data doesn't pass the validation before apply.
+type SnapValidationError struct {
+	RegionID uint64
+	Issues   []string
+	// Omitted is the number of issues not kept in Issues.
+	Omitted int
+}
+
+func (e *SnapValidationError) Error() string {
+	msg := fmt.Sprintf("snapshot of region %d has %d invalid records: %s",
+		e.RegionID, len(e.Issues)+e.Omitted, strings.Join(e.Issues, "; "))
+	if e.Omitted > 0 {
+		msg += fmt.Sprintf("; and %d more", e.Omitted)
+	}
+	return msg
+}
+
+// snapValidator checks that all the keys in the snapshot are in the region range and the
+// write CF and lock CF records refer to existing default CF values.
+type snapValidator struct {
+	startKey    []byte
+	endKey      []byte
+	defaultKeys map[string]struct{}
+	err         SnapValidationError
+}
+
+func validateSnapData(cfs []*CFFile, region *metapb.Region) error {
+	v := &snapValidator{
+		startKey:    RawStartKey(region),
+		endKey:      RawEndKey(region),
+		defaultKeys: make(map[string]struct{}),
+		err:         SnapValidationError{RegionID: region.Id},
+	}
+	if err := v.checkDefaultCF(cfs[defaultCFIdx]); err != nil {
+		return err
+	}
+	if err := v.checkLockCF(cfs[lockCFIdx]); err != nil {
+		return err
+	}
+	if err := v.checkWriteCF(cfs[writeCFIdx]); err != nil {
+		return err
+	}
+	if len(v.err.Issues) > 0 {
+		return &v.err
+	}
+	return nil
+}
+
+func (v *snapValidator) addIssue(format string, args ...interface{}) {
+	if len(v.err.Issues) >= maxSnapValidationIssues {
+		v.err.Omitted++
+		return
+	}
+	v.err.Issues = append(v.err.Issues, fmt.Sprintf(format, args...))
+}
+
+func (v *snapValidator) checkRange(cf string, key []byte) {
+	if bytes.Compare(key, v.startKey) < 0 || bytes.Compare(key, v.endKey) >= 0 {
+		v.addIssue("%s key %x out of region range [%x, %x)", cf, key, v.startKey, v.endKey)
+	}
+}
+
+func (v *snapValidator) checkDefaultValue(cf string, key []byte, startTS uint64) {
+	if _, ok := v.defaultKeys[string(encodeRocksDBSSTKey(key, &startTS))]; !ok {
+		v.addIssue("%s key %x start ts %d has no default CF value", cf, key, startTS)
+	}
+}
+
+func (v *snapValidator) iterateSST(cf *CFFile, fn func(key, val []byte)) error {
+	if cf.Size == 0 {
+		return nil
+	}
+	file, err := os.Open(cf.Path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+	it, err := rocksdb.NewSstFileIterator(file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		fn(it.Key().UserKey, it.Value())
+	}
+	return it.Err()
+}
+
+func (v *snapValidator) checkDefaultCF(cf *CFFile) error {
+	return v.iterateSST(cf, func(sstKey, _ []byte) {
+		key, _, err := decodeRocksDBSSTKey(sstKey)
+		if err != nil {
+			v.addIssue("default CF key %x is malformed: %v", sstKey, err)
+			return
+		}
+		v.checkRange("default CF", key)
+		v.defaultKeys[string(sstKey)] = struct{}{}
+	})
+}
+
+func (v *snapValidator) checkLockCF(cf *CFFile) error {
+	if cf.Size <= 1 {
+		return nil
+	}
+	data, err := ioutil.ReadFile(cf.Path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for len(data) > 1 {
+		var encodedKey, val []byte
+		encodedKey, val, data, err = readEntryFromPlainFile(data)
+		if err != nil {
+			v.addIssue("lock CF is malformed: %v", err)
+			return nil
+		}
+		if len(encodedKey) == 0 {
+			break
+		}
+		_, key, err := codec.DecodeBytes(encodedKey, nil)
+		if err != nil {
+			v.addIssue("lock CF key %x is malformed: %v", encodedKey, err)
+			continue
+		}
+		v.checkRange("lock CF", key)
+		lv, err := decodeLockCFValue(val)
+		if err != nil {
+			v.addIssue("lock CF key %x has malformed value: %v", key, err)
+			continue
+		}
+		if lv.shortVal == nil && lv.lockType == byte(kvrpcpb.Op_Put) {
+			v.checkDefaultValue("lock CF", key, lv.startTS)
+		}
+	}
+	return nil
+}
+
+func (v *snapValidator) checkWriteCF(cf *CFFile) error {
+	return v.iterateSST(cf, func(sstKey, val []byte) {
+		key, commitTS, err := decodeRocksDBSSTKey(sstKey)
+		if err != nil {
+			v.addIssue("write CF key %x is malformed: %v", sstKey, err)
+			return
+		}
+		v.checkRange("write CF", key)
+		wv, err := parseWriteCFValue(val)
+		if err != nil {
+			v.addIssue("write CF key %x commit ts %d has malformed value: %v", key, commitTS, err)
+			return
+		}
+		if wv.startTS > commitTS {
+			v.addIssue("write CF key %x start ts %d is larger than commit ts %d", key, wv.startTS, commitTS)
+		}
+		if wv.shortValue == nil && wv.writeType == byte(kvrpcpb.Op_Put) {
+			v.checkDefaultValue("write CF", key, wv.startTS)
+		}
+	})
+}
@@ -0,0 +1,93 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/ngaut/unistore/raftstore/raftlog"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// splitHint anticipates the split of a leader region on the propose side. Sequential writes append
+// keys after all the written keys, that is near the end key of the region, so once such a region is
+// oversized it is split checked right away instead of waiting for the split check tick.
+type splitHint struct {
+	// tailKey is the largest key written since the last split.
+	tailKey []byte
+	// pending is set when a split check should be scheduled for the region.
+	pending bool
+	// checking is set until the result of the hinted split check is received.
+	checking bool
+}
+
+// observe updates the tail key and returns true if the log writes a key at or after the tail key.
+func (h *splitHint) observe(rlog raftlog.RaftLog) bool {
+	var atTail bool
+	iterateWriteKeys(rlog, func(key []byte) {
+		if bytes.Compare(key, h.tailKey) >= 0 {
+			h.tailKey = append(h.tailKey[:0], key...)
+			atTail = true
+		}
+	})
+	return atTail
+}
+
+func (h *splitHint) reset() {
+	h.tailKey = nil
+	h.pending = false
+	h.checking = false
+}
+
+// maybeHintSplit sets the split hint if the proposed log writes near the end key of an oversized region.
+func (p *Peer) maybeHintSplit(cfg *Config, rlog raftlog.RaftLog) {
+	if !cfg.EnableSplitHint {
+		return
+	}
+	if !p.splitHint.observe(rlog) || p.splitHint.pending || p.splitHint.checking {
+		return
+	}
+	size := p.SizeDiffHint
+	if p.ApproximateSize != nil {
+		size += *p.ApproximateSize
+	}
+	if size >= cfg.SplitCheck.regionThresholds(p.Region()).maxSize {
+		p.splitHint.pending = true
+	}
+}
+
+// onSplitHint schedules a split check for the hinted region ahead of the split check tick.
+func (d *peerMsgHandler) onSplitHint() {
+	d.peer.splitHint.pending = false
+	t := task{
+		tp: taskTypeSplitCheck,
+		data: &splitCheckTask{
+			region: d.region(),
+			hinted: true,
+		},
+	}
+	select {
+	case d.ctx.splitCheckTaskSender <- t:
+	default:
+		// The split check worker is busy, the split check tick retries later.
+		return
+	}
+	log.Debug("schedule hinted split check", zap.String("tag", d.tag()), zap.Uint64("size diff hint", d.peer.SizeDiffHint))
+	d.peer.splitHint.checking = true
+	d.peer.sizeCheckTime = time.Now()
+	d.peer.SizeDiffHint = 0
+	d.peer.CompactionDeclinedBytes = 0
+}
@@ -0,0 +1,178 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/tidb/util/codec"
+)
+
+// SplitRule overrides the split thresholds of the regions in the key range of the key prefix, a zero
+// threshold keeps the store default. A region only partially in the key range, like a region spanning
+// several tables, takes the lower thresholds of the rule, so it is split and the new regions match the rule.
+type SplitRule struct {
+	KeyPrefix       []byte
+	RegionMaxSize   uint64
+	RegionSplitSize uint64
+	RegionMaxKeys   uint64
+	RegionSplitKeys uint64
+}
+
+type splitThresholds struct {
+	maxSize   uint64
+	splitSize uint64
+	maxKeys   uint64
+	splitKeys uint64
+}
+
+// splitRules are changed at runtime and read by the split checker and the split hint.
+type splitRules struct {
+	mu sync.RWMutex
+	// rules are sorted by the prefix length in descending order, so the longest prefix matches first.
+	rules []SplitRule
+}
+
+func (c *splitCheckConfig) defaultThresholds() splitThresholds {
+	return splitThresholds{
+		maxSize:   c.RegionMaxSize,
+		splitSize: c.RegionSplitSize,
+		maxKeys:   c.RegionMaxKeys,
+		splitKeys: c.RegionSplitKeys,
+	}
+}
+
+// thresholds returns the split thresholds of the region of the raw key range, an empty end key means
+// the range is unbounded. The longest prefix whose key range contains the region overrides the defaults,
+// then every rule whose key range only overlaps the region lowers the thresholds.
+func (c *splitCheckConfig) thresholds(startKey, endKey []byte) splitThresholds {
+	th := c.defaultThresholds()
+	if c.rules == nil {
+		return th
+	}
+	c.rules.mu.RLock()
+	defer c.rules.mu.RUnlock()
+	contained := false
+	var overlapped []*SplitRule
+	for i := range c.rules.rules {
+		rule := &c.rules.rules[i]
+		prefixEnd := prefixNext(rule.KeyPrefix)
+		if len(endKey) > 0 && bytes.Compare(rule.KeyPrefix, endKey) >= 0 ||
+			len(prefixEnd) > 0 && bytes.Compare(startKey, prefixEnd) >= 0 {
+			continue
+		}
+		if bytes.HasPrefix(startKey, rule.KeyPrefix) &&
+			(len(prefixEnd) == 0 || len(endKey) > 0 && bytes.Compare(endKey, prefixEnd) <= 0) {
+			if !contained {
+				th = rule.apply(th)
+				contained = true
+			}
+			continue
+		}
+		overlapped = append(overlapped, rule)
+	}
+	for _, rule := range overlapped {
+		th = th.lower(rule.apply(th))
+	}
+	return th
+}
+
+// regionThresholds returns the split thresholds of the region.
+func (c *splitCheckConfig) regionThresholds(region *metapb.Region) splitThresholds {
+	var startKey, endKey []byte
+	if len(region.StartKey) > 0 {
+		_, startKey, _ = codec.DecodeBytes(region.StartKey, nil)
+	}
+	if len(region.EndKey) > 0 {
+		_, endKey, _ = codec.DecodeBytes(region.EndKey, nil)
+	}
+	return c.thresholds(startKey, endKey)
+}
+
+// prefixNext returns the first key after all the keys with the prefix, nil means there is no such key.
+func prefixNext(prefix []byte) []byte {
+	next := append([]byte(nil), prefix...)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			return next[:i+1]
+		}
+	}
+	return nil
+}
+
+func (th splitThresholds) lower(o splitThresholds) splitThresholds {
+	if o.maxSize < th.maxSize {
+		th.maxSize = o.maxSize
+	}
+	if o.splitSize < th.splitSize {
+		th.splitSize = o.splitSize
+	}
+	if o.maxKeys < th.maxKeys {
+		th.maxKeys = o.maxKeys
+	}
+	if o.splitKeys < th.splitKeys {
+		th.splitKeys = o.splitKeys
+	}
+	return th
+}
+
+func (rule *SplitRule) apply(th splitThresholds) splitThresholds {
+	if rule.RegionMaxSize != 0 {
+		th.maxSize = rule.RegionMaxSize
+	}
+	if rule.RegionSplitSize != 0 {
+		th.splitSize = rule.RegionSplitSize
+	}
+	if rule.RegionMaxKeys != 0 {
+		th.maxKeys = rule.RegionMaxKeys
+	}
+	if rule.RegionSplitKeys != 0 {
+		th.splitKeys = rule.RegionSplitKeys
+	}
+	return th
+}
+
+func (c *splitCheckConfig) setRules(rules []SplitRule) error {
+	sorted := make([]SplitRule, len(rules))
+	for i, rule := range rules {
+		th := rule.apply(c.defaultThresholds())
+		if th.maxSize < th.splitSize {
+			return invalidConfig(fmt.Sprintf("SplitRules[%d].RegionMaxSize", i), th.maxSize,
+				"must not be less than region split size %v", th.splitSize)
+		}
+		if th.maxKeys < th.splitKeys {
+			return invalidConfig(fmt.Sprintf("SplitRules[%d].RegionMaxKeys", i), th.maxKeys,
+				"must not be less than region split keys %v", th.splitKeys)
+		}
+		rule.KeyPrefix = append([]byte(nil), rule.KeyPrefix...)
+		sorted[i] = rule
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(sorted[i].KeyPrefix) > len(sorted[j].KeyPrefix)
+	})
+	c.rules.mu.Lock()
+	c.rules.rules = sorted
+	c.rules.mu.Unlock()
+	return nil
+}
+
+// SetSplitRules replaces the split rules of the store, the following split checks use the new rules.
+func (ris *RaftInnerServer) SetSplitRules(rules []SplitRule) error {
+	return ris.raftConfig.SplitCheck.setRules(rules)
+}
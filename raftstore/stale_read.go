@@ -0,0 +1,242 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"context"
+	"time"
+
+	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// The safe ts of a region is a ts that all the transactions committed at or before it are applied by the
+// peer, so a replica can serve the reads at the safe ts from its local data.
+//
+// Every Config.SafeTSUpdateInterval, the leader fetches a ts from PD and raises the max timestamp of the store
+// with it, so the async commit transactions prewritten later commit after it. A transaction committed at or
+// before the ts was prewritten before the ts is fetched, so it is in the raft log of the leader when the ts
+// arrives, the leader checks its lease then to make sure no other leader has committed entries. Once the
+// leader applies its log up to that point, the safe ts is the ts or the min start ts of the locks in the
+// region minus one if it's smaller. The leader sends it to the followers with its applied index, and a
+// follower publishes it after applying the index.
+
+// extraMsgSafeTS is the type of the extra message publishing the safe ts of the leader to a follower, the ts
+// is carried in PremergeCommit and the applied index of the leader in Message.Index.
+const extraMsgSafeTS rspb.ExtraMessageType = 101
+
+// safeTSState is the safe ts being advanced by the raft worker, the published safe ts is in the leader
+// checker of the peer.
+type safeTSState struct {
+	// fetching is set while the PD worker fetches a ts for the leader in the term.
+	fetching bool
+	term     uint64
+	// pendingTS becomes the safe ts of the leader after pendingIndex is applied.
+	pendingTS    uint64
+	pendingIndex uint64
+	// remoteTS is the safe ts of the leader, it is published by the follower after remoteIndex is applied.
+	remoteTS    uint64
+	remoteIndex uint64
+}
+
+// publishSafeTS raises the safe ts served by the peer.
+func (c *leaderChecker) publishSafeTS(ts uint64) bool {
+	for {
+		old := c.safeTS.Load()
+		if ts <= old {
+			return false
+		}
+		if c.safeTS.CAS(old, ts) {
+			return true
+		}
+	}
+}
+
+func (d *peerMsgHandler) onUpdateSafeTSTick() {
+	d.ticker.schedule(PeerTickUpdateSafeTS)
+	s := &d.peer.safeTS
+	if !d.peer.IsLeader() {
+		s.fetching, s.pendingTS = false, 0
+		return
+	}
+	if s.term != d.peer.Term() {
+		*s = safeTSState{term: d.peer.Term()}
+	}
+	if !s.fetching && s.pendingTS == 0 {
+		s.fetching = true
+		d.ctx.pdTaskSender <- task{tp: taskTypePDUpdateSafeTS, data: &pdUpdateSafeTSTask{
+			regionID: d.regionID(),
+			term:     s.term,
+			oracle:   d.ctx.cfg.CausalTSOracle,
+		}}
+	}
+	d.maybeAdvanceSafeTS()
+}
+
+// MsgSafeTS is the ts fetched by the PD worker for the leader to advance the safe ts in the term, 0 means
+// the ts is not fetched.
+type MsgSafeTS struct {
+	Term uint64
+	TS   uint64
+}
+
+func (d *peerMsgHandler) onSafeTS(msg *MsgSafeTS) {
+	s := &d.peer.safeTS
+	if msg.Term != s.term {
+		return
+	}
+	s.fetching = false
+	if msg.TS == 0 || !d.peer.IsLeader() || d.peer.Term() != s.term ||
+		d.peer.leaderLease.Inspect(nil) != LeaseStateValid {
+		return
+	}
+	s.pendingTS = msg.TS
+	s.pendingIndex = d.peer.RaftGroup.Raft.RaftLog.LastIndex()
+	d.maybeAdvanceSafeTS()
+}
+
+// maybeAdvanceSafeTS publishes the pending safe ts once its index is applied, the leader sends it to the
+// followers.
+func (d *peerMsgHandler) maybeAdvanceSafeTS() {
+	p := d.peer
+	s := &p.safeTS
+	applied := p.Store().AppliedIndex()
+	if s.remoteTS != 0 && applied >= s.remoteIndex {
+		p.leaderChecker.publishSafeTS(s.remoteTS)
+		s.remoteTS = 0
+	}
+	if s.pendingTS == 0 || applied < s.pendingIndex {
+		return
+	}
+	safeTS := s.pendingTS
+	s.pendingTS = 0
+	if !p.IsLeader() || p.Term() != s.term {
+		return
+	}
+	if resolved := resolvedTS(d.ctx.engine.kv.LockStore, d.region()); resolved < safeTS {
+		safeTS = resolved
+	}
+	p.leaderChecker.publishSafeTS(safeTS)
+	for _, peer := range d.region().Peers {
+		if peer.Id == p.PeerID() {
+			continue
+		}
+		if err := d.ctx.trans.Send(p.newSafeTSMessage(peer, safeTS, applied)); err != nil {
+			log.Debug("failed to send safe ts", zap.String("tag", d.tag()), zap.Error(err))
+		}
+	}
+}
+
+func (p *Peer) newSafeTSMessage(to *metapb.Peer, safeTS, index uint64) *rspb.RaftMessage {
+	return &rspb.RaftMessage{
+		RegionId:    p.regionID,
+		FromPeer:    p.Meta,
+		ToPeer:      to,
+		RegionEpoch: p.Region().RegionEpoch,
+		Message:     &eraftpb.Message{From: p.PeerID(), To: to.Id, Term: p.Term(), Index: index},
+		ExtraMsg:    &rspb.ExtraMessage{Type: extraMsgSafeTS, PremergeCommit: safeTS},
+	}
+}
+
+func isSafeTSMessage(msg *rspb.RaftMessage) bool {
+	return msg.GetExtraMsg().GetType() == extraMsgSafeTS
+}
+
+// onSafeTSMessage accepts the safe ts of the current leader, the one of a stale leader may miss the entries
+// committed by the new leader.
+func (d *peerMsgHandler) onSafeTSMessage(msg *rspb.RaftMessage) {
+	p := d.peer
+	if p.IsLeader() || msg.GetMessage().GetTerm() != p.Term() || msg.GetFromPeer().GetId() != p.LeaderID() {
+		return
+	}
+	s := &p.safeTS
+	if msg.ExtraMsg.PremergeCommit <= s.remoteTS {
+		return
+	}
+	s.remoteTS = msg.ExtraMsg.PremergeCommit
+	s.remoteIndex = msg.Message.Index
+	d.maybeAdvanceSafeTS()
+}
+
+type pdUpdateSafeTSTask struct {
+	regionID uint64
+	term     uint64
+	oracle   CausalTSOracle
+}
+
+func (r *pdTaskHandler) onUpdateSafeTS(t *pdUpdateSafeTSTask) {
+	msg := &MsgSafeTS{Term: t.term}
+	physical, logical, err := r.pdClient.GetTS(context.TODO())
+	if err != nil {
+		log.Warn("failed to get ts to update safe ts", zap.Uint64("region id", t.regionID), zap.Error(err))
+	} else {
+		msg.TS = uint64(physical)<<18 + uint64(logical)
+		r.router.maxTS.raise(msg.TS, t.oracle)
+	}
+	if err := r.router.send(t.regionID, NewPeerMsg(MsgTypeSafeTS, t.regionID, msg)); err != nil {
+		log.Debug("failed to send safe ts", zap.Uint64("region id", t.regionID), zap.Error(err))
+	}
+}
+
+// SafeTS returns the safe ts of the region on the store, 0 if the region has no safe ts yet.
+func (r *Router) SafeTS(regionID uint64) (uint64, error) {
+	p := r.router.get(regionID)
+	if p == nil {
+		return 0, &ErrRegionNotFound{RegionID: regionID}
+	}
+	return p.peer.peer.leaderChecker.safeTS.Load(), nil
+}
+
+// tsStaleness converts a duration to the difference of the physical part of two timestamps.
+func tsStaleness(d time.Duration) uint64 {
+	return uint64(d/time.Millisecond) << 18
+}
+
+// BoundedStaleSnapshot returns a snapshot of the region on the store, a leader or a follower, for a read
+// tolerating maxStaleness behind ts. The snapshot is taken at the safe ts of the region, or ts if the safe
+// ts is newer. If the safe ts is more than maxStaleness behind ts, ErrDataIsNotReady is returned with the
+// safe ts, the client may retry with it or read from the leader.
+func (ris *RaftInnerServer) BoundedStaleSnapshot(regionCtx *kvrpcpb.Context, ts uint64, maxStaleness time.Duration) (*MultiRegionSnapshot, error) {
+	region, err := currentRegion(ris.router, regionCtx)
+	if err != nil {
+		return nil, err
+	}
+	safeTS, err := ris.GetRaftstoreRouter().SafeTS(region.Id)
+	if err != nil {
+		return nil, err
+	}
+	// The locks of the transactions prewritten after the safe ts is advanced may be applied already.
+	if resolved := resolvedTS(ris.engines.kv.LockStore, region); resolved < safeTS {
+		safeTS = resolved
+	}
+	if staleness := tsStaleness(maxStaleness); ts > staleness && safeTS < ts-staleness {
+		return nil, &ErrDataIsNotReady{RegionID: region.Id, SafeTS: safeTS}
+	}
+	readTS := ts
+	if safeTS < readTS {
+		readTS = safeTS
+	}
+	txn := ris.engines.kv.DB.NewTransaction(false)
+	txn.SetReadTS(readTS)
+	// The region may be split or merged before the transaction is created.
+	if _, err := currentRegion(ris.router, regionCtx); err != nil {
+		txn.Discard()
+		return nil, err
+	}
+	return &MultiRegionSnapshot{ts: readTS, regions: []*metapb.Region{region}, txn: txn}, nil
+}
@@ -28,7 +28,7 @@ func newTicker(regionID uint64, cfg *Config) *ticker {
 	baseInterval := cfg.RaftBaseTickInterval
 	t := &ticker{
 		regionID:  regionID,
-		schedules: make([]tickSchedule, 6),
+		schedules: make([]tickSchedule, 8),
 	}
 	t.schedules[int(PeerTickRaft)].interval = 1
 	t.schedules[int(PeerTickRaftLogGC)].interval = int64(cfg.RaftLogGCTickInterval / baseInterval)
@@ -36,18 +36,23 @@ func newTicker(regionID uint64, cfg *Config) *ticker {
 	t.schedules[int(PeerTickPdHeartbeat)].interval = int64(cfg.PdHeartbeatTickInterval / baseInterval)
 	t.schedules[int(PeerTickCheckMerge)].interval = int64(cfg.MergeCheckTickInterval / baseInterval)
 	t.schedules[int(PeerTickPeerStaleState)].interval = int64(cfg.PeerStaleStateCheckInterval / baseInterval)
+	t.schedules[int(PeerTickCheckInvariants)].interval = int64(cfg.InvariantCheckInterval / baseInterval)
+	t.schedules[int(PeerTickUpdateSafeTS)].interval = int64(cfg.SafeTSUpdateInterval / baseInterval)
 	return t
 }
 
 func newStoreTicker(cfg *Config) *ticker {
 	baseInterval := cfg.RaftBaseTickInterval
 	t := &ticker{
-		schedules: make([]tickSchedule, 4),
+		schedules: make([]tickSchedule, 7),
 	}
 	t.schedules[int(StoreTickCompactCheck)].interval = int64(cfg.RegionCompactCheckInterval / baseInterval)
 	t.schedules[int(StoreTickPdStoreHeartbeat)].interval = int64(cfg.PdStoreHeartbeatTickInterval / baseInterval)
 	t.schedules[int(StoreTickSnapGC)].interval = int64(cfg.SnapMgrGcTickInterval / baseInterval)
 	t.schedules[int(StoreTickConsistencyCheck)].interval = int64(cfg.ConsistencyCheckInterval / baseInterval)
+	t.schedules[int(StoreTickTombstoneGC)].interval = int64(cfg.TombstoneGCTickInterval / baseInterval)
+	t.schedules[int(StoreTickCheckInvariants)].interval = int64(cfg.InvariantCheckInterval / baseInterval)
+	t.schedules[int(StoreTickIngestLimiter)].interval = int64(ingestAdjustInterval / baseInterval)
 	return t
 }
 
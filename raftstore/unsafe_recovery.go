@@ -0,0 +1,167 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
+	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// forceLeaderState is the ForceLeader state of a peer campaigning after the failed voters are dropped, the
+// callback is done once the peer becomes the leader or gives up.
+type forceLeaderState struct {
+	cb    *Callback
+	ticks int
+}
+
+// dropFailedPeers removes the peers on the failed stores from the region and the raft group of the peer
+// without a quorum. The rewritten region is persisted with a bumped conf version, so the removed peers are
+// told to destroy themselves if they come back.
+func (d *peerMsgHandler) dropFailedPeers(failedStores []uint64) error {
+	failed := make(map[uint64]struct{}, len(failedStores))
+	for _, storeID := range failedStores {
+		failed[storeID] = struct{}{}
+	}
+	if _, ok := failed[d.storeID()]; ok {
+		return errors.Errorf("the store %d of the peer is failed", d.storeID())
+	}
+	p := d.peer
+	if p.isSplitting() || p.isMerging() || p.IsApplyingSnapshot() || p.HasPendingSnapshot() {
+		return errors.New("the peer is splitting, merging or applying a snapshot")
+	}
+	if !p.ReadyToHandlePendingSnap() {
+		return errors.New("the peer is applying entries, retry later")
+	}
+	region := new(metapb.Region)
+	if err := CloneMsg(d.region(), region); err != nil {
+		return err
+	}
+	var peers, removed []*metapb.Peer
+	for _, peer := range region.Peers {
+		if _, ok := failed[peer.StoreId]; ok {
+			removed = append(removed, peer)
+		} else {
+			peers = append(peers, peer)
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	region.Peers = peers
+	region.RegionEpoch.ConfVer += uint64(len(removed))
+	kvWB := new(WriteBatch)
+	WritePeerState(kvWB, region, rspb.PeerState_Normal, nil)
+	if err := kvWB.WriteToKV(d.ctx.engine.kv); err != nil {
+		return err
+	}
+	for _, peer := range removed {
+		p.RaftGroup.ApplyConfChange(eraftpb.ConfChange{ChangeType: eraftpb.ConfChangeType_RemoveNode, NodeId: peer.Id})
+		delete(p.PeerHeartbeats, peer.Id)
+		delete(p.PeersStartPendingTime, peer.Id)
+	}
+	d.ctx.storeMetaLock.Lock()
+	d.ctx.storeMeta.setRegion(region, p)
+	d.ctx.storeMetaLock.Unlock()
+	p.refreshPeerCache(region)
+	// The applier checks the admin commands against its own copy of the region.
+	d.ctx.applyMsgs.appendMsg(d.regionID(), NewMsg(MsgTypeApplyRegistration, newRegistration(p)))
+	log.Warn("dropped the peers on the failed stores", zap.String("tag", d.tag()),
+		zap.Uint64s("failed stores", failedStores), zap.Int("removed", len(removed)),
+		zap.Uint64("conf ver", region.RegionEpoch.ConfVer))
+	if p.IsLeader() {
+		p.HeartbeatPd(d.ctx.pdTaskSender)
+	}
+	return nil
+}
+
+func (d *peerMsgHandler) onForceLeader(failedStores []uint64, campaign bool, cb *Callback) {
+	if d.peer.forceLeader != nil {
+		cb.Done(ErrResp(errors.New("force leader is in progress")))
+		return
+	}
+	if err := d.dropFailedPeers(failedStores); err != nil {
+		cb.Done(ErrResp(err))
+		return
+	}
+	if !campaign || d.peer.IsLeader() {
+		cb.Done(&raft_cmdpb.RaftCmdResponse{Header: &raft_cmdpb.RaftResponseHeader{}})
+		return
+	}
+	d.wakeUp(false)
+	d.peer.forceLeader = &forceLeaderState{cb: cb}
+	if err := d.peer.RaftGroup.Campaign(); err != nil {
+		d.peer.finishForceLeader(err)
+		return
+	}
+	d.hasReady = true
+}
+
+// finishForceLeader leaves the ForceLeader state, err nil means the peer becomes the leader.
+func (p *Peer) finishForceLeader(err error) {
+	if p.forceLeader == nil {
+		return
+	}
+	cb := p.forceLeader.cb
+	p.forceLeader = nil
+	if err != nil {
+		log.Warn("force leader failed", zap.String("tag", p.Tag), zap.Error(err))
+		cb.Done(ErrResp(err))
+		return
+	}
+	log.Warn("force leader succeeded", zap.String("tag", p.Tag), zap.Uint64("term", p.Term()))
+	cb.Done(&raft_cmdpb.RaftCmdResponse{Header: &raft_cmdpb.RaftResponseHeader{}})
+}
+
+// tickForceLeader gives up the ForceLeader state if the peer isn't elected in two election timeouts.
+func (d *peerMsgHandler) tickForceLeader() {
+	s := d.peer.forceLeader
+	if s == nil {
+		return
+	}
+	s.ticks++
+	if s.ticks > 2*d.ctx.cfg.RaftElectionTimeoutTicks {
+		d.peer.finishForceLeader(errors.New("force leader timeout"))
+	}
+}
+
+// UnsafeDropFailedPeers removes the peers on the failed stores from the region of the peer on this store, like
+// the unsafe recovery of TiKV. It must be called on every surviving peer of the region to keep their regions
+// in sync, the data written by the quorum including the failed stores may be lost.
+func (r *Router) UnsafeDropFailedPeers(regionID uint64, failedStores []uint64) error {
+	return r.forceLeader(regionID, failedStores, false)
+}
+
+// ForceLeader drops the peers on the failed stores like UnsafeDropFailedPeers, then makes the peer on this
+// store campaign with the surviving voters. It returns once the peer becomes the leader or gives up.
+func (r *Router) ForceLeader(regionID uint64, failedStores []uint64) error {
+	return r.forceLeader(regionID, failedStores, true)
+}
+
+func (r *Router) forceLeader(regionID uint64, failedStores []uint64, campaign bool) error {
+	cb := NewCallback()
+	msg := &MsgForceLeader{FailedStores: failedStores, Campaign: campaign, Callback: cb}
+	if err := r.router.send(regionID, Msg{Type: MsgTypeForceLeader, Data: msg}); err != nil {
+		return err
+	}
+	cb.wg.Wait()
+	if pbErr := cb.resp.GetHeader().GetError(); pbErr != nil {
+		return errors.New(pbErr.Message)
+	}
+	return nil
+}
@@ -111,16 +111,54 @@ type Lease struct {
 	lastUpdate time.Time
 	remote     *RemoteLease
 
-	// Todo: use monotonic_raw instead of time.Now() to fix time jump back issue.
+	// clock is the time source of the lease, it's monotonic by default.
+	clock LeaseClock
 }
 
 // NewLease creates a new Lease.
 func NewLease(maxLease time.Duration) *Lease {
+	return NewLeaseWithClock(maxLease, nil)
+}
+
+// NewLeaseWithClock creates a new Lease using the clock as the time source, nil means the default monotonic
+// clock.
+func NewLeaseWithClock(maxLease time.Duration, clock LeaseClock) *Lease {
 	return &Lease{
 		maxLease:   maxLease,
 		maxDrift:   maxLease / 3,
 		lastUpdate: time.Time{},
+		clock:      leaseClockOrDefault(clock),
+	}
+}
+
+// Now returns the current time of the lease clock.
+func (l *Lease) Now() time.Time {
+	return l.clock.Now()
+}
+
+// MaxLease returns the max lease.
+func (l *Lease) MaxLease() time.Duration {
+	return l.maxLease
+}
+
+// SetMaxLease changes the max lease, a shorter max lease shortens the current lease and the remote lease
+// right away.
+func (l *Lease) SetMaxLease(maxLease time.Duration) {
+	if maxLease < l.maxLease {
+		bound := l.clock.Now().Add(maxLease)
+		if l.boundValid != nil && l.boundValid.After(bound) {
+			l.boundValid = &bound
+			l.lastUpdate = bound
+			if l.remote != nil {
+				l.remote.Renew(bound)
+			}
+		}
+		if l.boundSuspect != nil && l.boundSuspect.After(bound) {
+			l.boundSuspect = &bound
+		}
 	}
+	l.maxLease = maxLease
+	l.maxDrift = maxLease / 3
 }
 
 // The valid leader lease should be `lease = max_lease - (commit_ts - send_ts)`
@@ -175,7 +213,7 @@ func (l *Lease) Inspect(ts *time.Time) LeaseState {
 	}
 	if l.boundValid != nil {
 		if ts == nil {
-			t := time.Now()
+			t := l.clock.Now()
 			ts = &t
 		}
 		if ts.Before(*l.boundValid) {
@@ -220,11 +258,13 @@ func (l *Lease) MaybeNewRemoteLease(term uint64) *RemoteLease {
 	remote := &RemoteLease{
 		expiredTime: &expiredTime,
 		term:        term,
+		clock:       l.clock,
 	}
 	// Clone the remote.
 	remoteClone := &RemoteLease{
 		expiredTime: &expiredTime,
 		term:        term,
+		clock:       l.clock,
 	}
 	l.remote = remote
 	return remoteClone
@@ -236,13 +276,14 @@ func (l *Lease) MaybeNewRemoteLease(term uint64) *RemoteLease {
 type RemoteLease struct {
 	expiredTime *uint64
 	term        uint64
+	clock       LeaseClock
 }
 
 // Inspect returns the lease state with the given time.
 func (r *RemoteLease) Inspect(ts *time.Time) LeaseState {
 	expiredTime := atomic.LoadUint64(r.expiredTime)
 	if ts == nil {
-		t := time.Now()
+		t := r.clock.Now()
 		ts = &t
 	}
 	if ts.Before(U64ToTime(expiredTime)) {
@@ -93,6 +93,105 @@ func TestLease(t *testing.T) {
 	assert.Equal(t, m1.Inspect(&now), LeaseStateValid)
 }
 
+func TestLeaseClock(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	lease := NewLeaseWithClock(10*time.Second, clock)
+	remote := lease.MaybeNewRemoteLease(1)
+	require.NotNil(t, remote)
+	lease.Renew(lease.Now())
+	lease.Renew(lease.Now().Add(5 * time.Second))
+	assert.Equal(t, LeaseStateValid, lease.Inspect(nil))
+	assert.Equal(t, LeaseStateValid, remote.Inspect(nil))
+
+	// The lease only expires when the clock is advanced, the system time doesn't matter.
+	clock.Advance(14 * time.Second)
+	assert.Equal(t, LeaseStateValid, lease.Inspect(nil))
+	clock.Advance(-time.Hour)
+	assert.Equal(t, time.Unix(1014, 0), clock.Now())
+	clock.Advance(time.Second)
+	assert.Equal(t, LeaseStateExpired, lease.Inspect(nil))
+	assert.Equal(t, LeaseStateExpired, remote.Inspect(nil))
+
+	// The hybrid logical clock never goes backwards even if the physical clock is skewed back.
+	hlc := NewHybridLogicalClock(clock)
+	first := hlc.Now()
+	assert.Equal(t, clock.Now(), first)
+	assert.Equal(t, first.Add(time.Nanosecond), hlc.Now())
+	hlc.Update(first.Add(time.Minute))
+	assert.Equal(t, first.Add(time.Minute+time.Nanosecond), hlc.Now())
+	clock.Advance(2 * time.Minute)
+	assert.Equal(t, clock.Now(), hlc.Now())
+	hlc.Update(first)
+	assert.True(t, hlc.Now().After(clock.Now()))
+}
+
+// wallClock is a wall clock which can jump in both directions.
+type wallClock struct {
+	now time.Time
+}
+
+func (c *wallClock) Now() time.Time {
+	return c.now
+}
+
+func TestMonotonicClock(t *testing.T) {
+	// A lease on the wall clock is extended when the clock jumps back.
+	wall := &wallClock{now: time.Unix(100000, 0)}
+	lease := NewLeaseWithClock(10*time.Second, wall)
+	lease.Renew(lease.Now())
+	wall.now = wall.now.Add(11 * time.Second)
+	assert.Equal(t, LeaseStateExpired, lease.Inspect(nil))
+	wall.now = wall.now.Add(-time.Hour)
+	assert.Equal(t, LeaseStateValid, lease.Inspect(nil))
+
+	// The monotonic clock only moves with the elapsed time, whatever the wall clock does.
+	var elapsed time.Duration
+	clock := &MonotonicClock{base: wall.now, elapsed: func() time.Duration { return elapsed }}
+	lease = NewLeaseWithClock(10*time.Second, clock)
+	remote := lease.MaybeNewRemoteLease(1)
+	lease.Renew(lease.Now())
+	wall.now = wall.now.Add(-time.Hour)
+	elapsed = 11 * time.Second
+	assert.Equal(t, LeaseStateExpired, lease.Inspect(nil))
+	assert.Equal(t, LeaseStateExpired, remote.Inspect(nil))
+	assert.Equal(t, time.Unix(100000-3600+11+11, 0), clock.Now())
+
+	system := NewMonotonicClock()
+	first := system.Now()
+	assert.False(t, system.Now().Before(first))
+	assert.Equal(t, defaultLeaseClock, leaseClockOrDefault(nil))
+}
+
+func TestSetMaxLease(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	lease := NewLeaseWithClock(9*time.Second, clock)
+	remote := lease.MaybeNewRemoteLease(1)
+	lease.Renew(lease.Now())
+	assert.Equal(t, LeaseStateValid, remote.Inspect(nil))
+
+	// A shorter max lease shortens the current lease and the remote lease.
+	clock.Advance(time.Second)
+	lease.SetMaxLease(3 * time.Second)
+	assert.Equal(t, 3*time.Second, lease.MaxLease())
+	clock.Advance(3 * time.Second)
+	assert.Equal(t, LeaseStateExpired, lease.Inspect(nil))
+	assert.Equal(t, LeaseStateExpired, remote.Inspect(nil))
+
+	// A longer max lease takes effect on the next renewal.
+	lease.SetMaxLease(6 * time.Second)
+	lease.Renew(lease.Now())
+	clock.Advance(5 * time.Second)
+	assert.Equal(t, LeaseStateValid, lease.Inspect(nil))
+	assert.Equal(t, LeaseStateValid, remote.Inspect(nil))
+	clock.Advance(time.Second)
+	assert.Equal(t, LeaseStateExpired, lease.Inspect(nil))
+
+	// The suspect bound is shortened as well.
+	lease.Suspect(lease.Now())
+	lease.SetMaxLease(time.Second)
+	assert.Equal(t, clock.Now().Add(time.Second), *lease.boundSuspect)
+}
+
 func TestTimeU64(t *testing.T) {
 	type TimeU64 struct {
 		T time.Time
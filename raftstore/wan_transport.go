@@ -0,0 +1,259 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// wanLinkQueueSize is the max number of the messages in flight on a link, more are dropped.
+	wanLinkQueueSize = 4096
+	// wanBurstDivisor makes the burst of a link the bytes it transmits in 1/wanBurstDivisor second.
+	wanBurstDivisor = 10
+)
+
+// LatencyDistribution samples the one-way latencies of a simulated link.
+type LatencyDistribution interface {
+	Sample(r *rand.Rand) time.Duration
+}
+
+// FixedLatency is a constant latency.
+type FixedLatency time.Duration
+
+// Sample implements the LatencyDistribution Sample method.
+func (l FixedLatency) Sample(_ *rand.Rand) time.Duration {
+	return time.Duration(l)
+}
+
+// UniformLatency is uniformly distributed in [Min, Max).
+type UniformLatency struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+// Sample implements the LatencyDistribution Sample method.
+func (l UniformLatency) Sample(r *rand.Rand) time.Duration {
+	if l.Max <= l.Min {
+		return l.Min
+	}
+	return l.Min + time.Duration(r.Int63n(int64(l.Max-l.Min)))
+}
+
+// NormalLatency is normally distributed, the negative samples are 0.
+type NormalLatency struct {
+	Mean   time.Duration
+	StdDev time.Duration
+}
+
+// Sample implements the LatencyDistribution Sample method.
+func (l NormalLatency) Sample(r *rand.Rand) time.Duration {
+	d := l.Mean + time.Duration(r.NormFloat64()*float64(l.StdDev))
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// WANLink describes the simulated link from a store to another.
+type WANLink struct {
+	// Bandwidth is in bytes per second, 0 means unlimited.
+	Bandwidth uint64
+	// Latency is the one-way latency of a message, nil means none.
+	Latency LatencyDistribution
+}
+
+type storePair struct {
+	from uint64
+	to   uint64
+}
+
+type wanPacket struct {
+	msg *rspb.RaftMessage
+	at  time.Time
+}
+
+type wanLink struct {
+	WANLink
+	limiter *rate.Limiter
+	queue   chan wanPacket
+	// lastDelivery keeps the messages on the link in order like a TCP stream.
+	lastDelivery time.Time
+
+	// sent and dropped are accessed atomically.
+	sent    uint64
+	dropped uint64
+}
+
+func (l *wanLink) setLink(link WANLink) {
+	l.WANLink = link
+	if link.Bandwidth == 0 {
+		l.limiter = nil
+		return
+	}
+	burst := int(link.Bandwidth / wanBurstDivisor)
+	if burst == 0 {
+		burst = 1
+	}
+	l.limiter = rate.NewLimiter(rate.Limit(link.Bandwidth), burst)
+}
+
+// transmitDelay reserves the bandwidth of the message and returns the time to wait for it.
+func (l *wanLink) transmitDelay(now time.Time, size int) time.Duration {
+	if l.limiter == nil {
+		return 0
+	}
+	var delay time.Duration
+	burst := l.limiter.Burst()
+	for size > 0 {
+		n := size
+		if n > burst {
+			n = burst
+		}
+		delay = l.limiter.ReserveN(now, n).DelayFrom(now)
+		size -= n
+	}
+	return delay
+}
+
+// WANTransport simulates the bandwidth and the latency of the links between the stores of a geo-distributed
+// cluster. The messages between a pair of stores with a link are delivered to the inner Transport in order
+// after they are transmitted at the bandwidth of the link and delayed by a sampled latency, the messages
+// without a link are sent directly.
+type WANTransport struct {
+	inner   Transport
+	closeCh chan struct{}
+	wg      sync.WaitGroup
+	dropped uint64
+
+	mu    sync.Mutex
+	rand  *rand.Rand
+	links map[storePair]*wanLink
+}
+
+// NewWANTransport creates a WANTransport sending the messages with the inner Transport.
+func NewWANTransport(inner Transport) *WANTransport {
+	return &WANTransport{
+		inner:   inner,
+		closeCh: make(chan struct{}),
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		links:   make(map[storePair]*wanLink),
+	}
+}
+
+// SetLink sets the link from a store to another, the messages in flight are not affected.
+func (t *WANTransport) SetLink(from, to uint64, link WANLink) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pair := storePair{from: from, to: to}
+	l, ok := t.links[pair]
+	if !ok {
+		l = &wanLink{queue: make(chan wanPacket, wanLinkQueueSize)}
+		t.links[pair] = l
+		t.wg.Add(1)
+		go t.deliver(l)
+	}
+	l.setLink(link)
+}
+
+// SetLinks sets the links between the two stores in both directions.
+func (t *WANTransport) SetLinks(store1, store2 uint64, link WANLink) {
+	t.SetLink(store1, store2, link)
+	t.SetLink(store2, store1, link)
+}
+
+// Dropped returns the number of the messages dropped because a link is congested.
+func (t *WANTransport) Dropped() uint64 {
+	return atomic.LoadUint64(&t.dropped)
+}
+
+// Send implements the Transport Send method.
+func (t *WANTransport) Send(msg *rspb.RaftMessage) error {
+	pair := storePair{from: msg.GetFromPeer().GetStoreId(), to: msg.GetToPeer().GetStoreId()}
+	t.mu.Lock()
+	l, ok := t.links[pair]
+	if !ok {
+		t.mu.Unlock()
+		return t.inner.Send(msg)
+	}
+	now := time.Now()
+	at := now.Add(l.transmitDelay(now, msg.Size()))
+	if l.Latency != nil {
+		at = at.Add(l.Latency.Sample(t.rand))
+	}
+	if at.Before(l.lastDelivery) {
+		at = l.lastDelivery
+	}
+	l.lastDelivery = at
+	t.mu.Unlock()
+	atomic.AddUint64(&l.sent, 1)
+	select {
+	case l.queue <- wanPacket{msg: msg, at: at}:
+	default:
+		atomic.AddUint64(&t.dropped, 1)
+		atomic.AddUint64(&l.dropped, 1)
+	}
+	return nil
+}
+
+// LinkDrops implements the LinkDropCounter LinkDrops method, the messages without a link are not counted.
+func (t *WANTransport) LinkDrops(from, to uint64) (sent, dropped uint64) {
+	t.mu.Lock()
+	l, ok := t.links[storePair{from: from, to: to}]
+	t.mu.Unlock()
+	if !ok {
+		return 0, 0
+	}
+	return atomic.LoadUint64(&l.sent), atomic.LoadUint64(&l.dropped)
+}
+
+func (t *WANTransport) deliver(l *wanLink) {
+	defer t.wg.Done()
+	timer := time.NewTimer(0)
+	<-timer.C
+	for {
+		var p wanPacket
+		select {
+		case <-t.closeCh:
+			return
+		case p = <-l.queue:
+		}
+		if d := time.Until(p.at); d > 0 {
+			timer.Reset(d)
+			select {
+			case <-t.closeCh:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+		if err := t.inner.Send(p.msg); err != nil {
+			log.Warn("failed to deliver simulated WAN message", zap.Uint64("region id", p.msg.RegionId), zap.Error(err))
+		}
+	}
+}
+
+// Close stops delivering the messages in flight.
+func (t *WANTransport) Close() {
+	close(t.closeCh)
+	t.wg.Wait()
+}
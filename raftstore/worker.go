@@ -20,11 +20,13 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/ngaut/unistore/config"
+	"github.com/ngaut/unistore/util"
 	"github.com/pingcap/badger"
 	"github.com/pingcap/badger/table/sstable"
 	"github.com/pingcap/badger/y"
@@ -58,6 +60,11 @@ const (
 	taskTypePDValidatePeer     taskType = 106
 	taskTypePDReadStats        taskType = 107
 	taskTypePDDestroyPeer      taskType = 108
+	taskTypePDDelayedHeartbeat taskType = 109
+	taskTypePDFlushHeartbeats  taskType = 110
+	taskTypePDUpdateMaxTS      taskType = 111
+	taskTypePDSnapStorm        taskType = 112
+	taskTypePDUpdateSafeTS     taskType = 113
 
 	taskTypeRegionGen   taskType = 401
 	taskTypeRegionApply taskType = 402
@@ -65,6 +72,8 @@ const (
 	///
 	/// The deletion may and may not succeed.
 	taskTypeRegionDestroy taskType = 403
+	/// Destroy all the data between [start_key, end_key) regardless of the regions.
+	taskTypeRegionDestroyRange taskType = 404
 
 	taskTypeSnapSend taskType = 601
 	taskTypeSnapRecv taskType = 602
@@ -82,6 +91,8 @@ type regionTask struct {
 	startKey []byte
 	endKey   []byte
 	redoIdx  uint64
+	// epoch is the region epoch when the snapshot is requested.
+	epoch *metapb.RegionEpoch
 }
 
 type raftLogGCTask struct {
@@ -93,6 +104,8 @@ type raftLogGCTask struct {
 
 type splitCheckTask struct {
 	region *metapb.Region
+	// hinted is set if the task is scheduled by the propose side split hint.
+	hinted bool
 }
 
 type computeHashTask struct {
@@ -122,6 +135,7 @@ type pdAskBatchSplitTask struct {
 type pdRegionHeartbeatTask struct {
 	region          *metapb.Region
 	peer            *metapb.Peer
+	term            uint64
 	downPeers       []*pdpb.PeerStats
 	pendingPeers    []*metapb.Peer
 	writtenBytes    uint64
@@ -222,23 +236,33 @@ type splitCheckHandler struct {
 	router   *router
 	config   *splitCheckConfig
 	checkers []splitChecker
+	// sizeAmplification multiplies the size of every scanned kv, see Config.RegionSizeAmplification.
+	sizeAmplification uint64
+
+	// The approximate size and keys of the region, only valid if the whole region is scanned.
+	scannedSize  uint64
+	scannedKeys  uint64
+	scanFinished bool
 }
 
-func newSplitCheckRunner(engine *badger.DB, router *router, config *splitCheckConfig) *splitCheckHandler {
+func newSplitCheckRunner(engine *badger.DB, router *router, config *splitCheckConfig, sizeAmplification uint64) *splitCheckHandler {
 	runner := &splitCheckHandler{
-		engine: engine,
-		router: router,
-		config: config,
+		engine:            engine,
+		router:            router,
+		config:            config,
+		sizeAmplification: sizeAmplification,
 	}
 	return runner
 }
 
-func (r *splitCheckHandler) newCheckers() {
+func (r *splitCheckHandler) newCheckers(startKey, endKey []byte) {
 	r.checkers = r.checkers[:0]
+	th := r.config.thresholds(startKey, endKey)
 	// the checker append order is the priority order
-	sizeChecker := newSizeSplitChecker(r.config.regionMaxSize, r.config.regionSplitSize, r.config.batchSplitLimit)
+	sizeChecker := newSizeSplitChecker(th.maxSize, th.splitSize, r.config.batchSplitLimit)
+	sizeChecker.sizeAmplification = r.sizeAmplification
 	r.checkers = append(r.checkers, sizeChecker)
-	keysChecker := newKeysSplitChecker(r.config.RegionMaxKeys, r.config.RegionSplitKeys, r.config.batchSplitLimit)
+	keysChecker := newKeysSplitChecker(th.maxKeys, th.splitKeys, r.config.batchSplitLimit)
 	r.checkers = append(r.checkers, keysChecker)
 }
 
@@ -257,8 +281,8 @@ func (r *splitCheckHandler) handle(t task) {
 		log.S().Errorf("failed to decode region key %x, err:%v", region.EndKey, err)
 		return
 	}
-	log.S().Debugf("executing split check task: [regionId: %d, startKey: %s, endKey: %s]", regionID,
-		hex.EncodeToString(startKey), hex.EncodeToString(endKey))
+	log.S().Debugf("executing split check task: [regionId: %d, startKey: %s, endKey: %s, hinted: %v]", regionID,
+		hex.EncodeToString(startKey), hex.EncodeToString(endKey), spCheckTask.hinted)
 	txn := r.engine.NewTransaction(false)
 	reader := dbreader.NewDBReader(startKey, endKey, txn)
 	defer reader.Close()
@@ -268,6 +292,9 @@ func (r *splitCheckHandler) handle(t task) {
 		keys = r.halfSplitCheck(startKey, endKey, reader)
 	case taskTypeSplitCheck:
 		keys = r.splitCheck(startKey, endKey, reader)
+		if r.scanFinished {
+			r.reportApproximateSize(regionID)
+		}
 	}
 	if len(keys) != 0 {
 		regionEpoch := region.GetRegionEpoch()
@@ -298,24 +325,40 @@ func exceedEndKey(current, endKey []byte) bool {
 
 // doCheck checks kvs using every checker
 func (r *splitCheckHandler) doCheck(startKey, endKey []byte, ite *badger.Iterator) {
-	r.newCheckers()
+	r.newCheckers(startKey, endKey)
+	r.scannedSize, r.scannedKeys, r.scanFinished = 0, 0, false
 	for ite.Seek(startKey); ite.Valid(); ite.Next() {
 		item := ite.Item()
 		key := item.Key()
 		if exceedEndKey(key, endKey) {
 			break
 		}
+		r.scannedSize += uint64(len(key)+item.ValueSize()) * r.sizeAmplification
+		r.scannedKeys++
 		for _, checker := range r.checkers {
 			if checker.onKv(key, item) {
 				return
 			}
 		}
 	}
+	r.scanFinished = true
+}
+
+// reportApproximateSize sends the size and keys of the scanned region to the peer.
+func (r *splitCheckHandler) reportApproximateSize(regionID uint64) {
+	if err := r.router.send(regionID, NewPeerMsg(MsgTypeRegionApproximateSize, regionID, r.scannedSize)); err != nil {
+		log.Warn("failed to send approximate region size", zap.Uint64("region id", regionID), zap.Error(err))
+		return
+	}
+	if err := r.router.send(regionID, NewPeerMsg(MsgTypeRegionApproximateKeys, regionID, r.scannedKeys)); err != nil {
+		log.Warn("failed to send approximate region keys", zap.Uint64("region id", regionID), zap.Error(err))
+	}
 }
 
 /// SplitCheck gets the split keys by scanning the range.
 func (r *splitCheckHandler) splitCheck(startKey, endKey []byte, reader *dbreader.DBReader) [][]byte {
 	ite := reader.GetIter()
+	r.scanFinished = false
 	splitKeys := r.tryTableSplit(startKey, endKey, ite)
 	if len(splitKeys) > 0 {
 		return splitKeys
@@ -368,18 +411,20 @@ type splitChecker interface {
 }
 
 type sizeSplitChecker struct {
-	maxSize         uint64
-	splitSize       uint64
-	currentSize     uint64
-	splitKeys       [][]byte
-	batchSplitLimit uint64
+	maxSize           uint64
+	splitSize         uint64
+	currentSize       uint64
+	splitKeys         [][]byte
+	batchSplitLimit   uint64
+	sizeAmplification uint64
 }
 
 func newSizeSplitChecker(maxSize, splitSize, batchSplitLimit uint64) *sizeSplitChecker {
 	return &sizeSplitChecker{
-		maxSize:         maxSize,
-		splitSize:       splitSize,
-		batchSplitLimit: batchSplitLimit,
+		maxSize:           maxSize,
+		splitSize:         splitSize,
+		batchSplitLimit:   batchSplitLimit,
+		sizeAmplification: 1,
 	}
 }
 
@@ -389,7 +434,7 @@ func safeCopy(b []byte) []byte {
 
 func (checker *sizeSplitChecker) onKv(key []byte, item *badger.Item) bool {
 	valueSize := uint64(item.ValueSize())
-	size := uint64(len(key)) + valueSize
+	size := (uint64(len(key)) + valueSize) * checker.sizeAmplification
 	checker.currentSize += size
 	overLimit := uint64(len(checker.splitKeys)) >= checker.batchSplitLimit
 	if checker.currentSize > checker.splitSize && !overLimit {
@@ -608,22 +653,60 @@ type snapContext struct {
 	mgr                 *SnapManager
 	cleanStalePeerDelay time.Duration
 	pendingDeleteRanges *pendingDeleteRanges
+	// strictApplyOrder verifies the visibility order of the applied snapshots.
+	strictApplyOrder bool
+	// verifyIngestChecksum verifies the checksums of the tables before ingesting them.
+	verifyIngestChecksum bool
 }
 
 // handleGen handles the task of generating snapshot of the Region. It calls `generateSnap` to do the actual work.
-func (snapCtx *snapContext) handleGen(regionID, redoIdx uint64, notifier chan<- *eraftpb.Snapshot) {
-	if err := snapCtx.generateSnap(regionID, redoIdx, notifier); err != nil {
+func (snapCtx *snapContext) handleGen(regionID, redoIdx uint64, epoch *metapb.RegionEpoch, notifier chan<- *eraftpb.Snapshot, status *JobStatus) {
+	if status != nil && !atomic.CompareAndSwapUint32(status, JobStatusPending, JobStatusRunning) {
+		// The leader stepped down before the task is handled.
+		atomic.StoreUint32(status, JobStatusCancelled)
+		snapCtx.mgr.recordSnapEvent(SnapEvent{Type: SnapEventCanceled, Key: SnapKey{RegionID: regionID},
+			Entry: SnapEntryGenerating, Reason: "generating snapshot is canceled"})
+		return
+	}
+	if err := snapCtx.generateSnap(regionID, redoIdx, epoch, notifier, status); err != nil {
 		log.Error("failed to generate snapshot!!!", zap.Uint64("region id", regionID), zap.Error(err))
 	}
 }
 
 // generateSnap generates the snapshots of the Region
-func (snapCtx *snapContext) generateSnap(regionID, redoIdx uint64, notifier chan<- *eraftpb.Snapshot) error {
+func (snapCtx *snapContext) generateSnap(regionID, redoIdx uint64, epoch *metapb.RegionEpoch, notifier chan<- *eraftpb.Snapshot, status *JobStatus) error {
 	// do we need to check leader here?
-	snap, err := doSnapshot(snapCtx.engiens, snapCtx.mgr, regionID, redoIdx)
+	snap, err := doSnapshot(snapCtx.engiens, snapCtx.mgr, regionID, redoIdx, epoch, status)
+	if err == errAbort || err == errSnapEpochChanged {
+		// The peer is destroyed or the region epoch changed, the engine snapshot is released already.
+		if status != nil {
+			atomic.StoreUint32(status, JobStatusCancelled)
+		}
+		reason := "generating snapshot is canceled"
+		if err == errSnapEpochChanged {
+			reason = "generating snapshot is canceled, " + err.Error()
+		}
+		snapCtx.mgr.recordSnapEvent(SnapEvent{Type: SnapEventCanceled, Key: SnapKey{RegionID: regionID},
+			Entry: SnapEntryGenerating, Reason: reason})
+		return nil
+	}
 	if err != nil {
+		if status != nil {
+			atomic.StoreUint32(status, JobStatusFailed)
+		}
+		snapCtx.mgr.recordSnapEvent(SnapEvent{Type: SnapEventFailed, Key: SnapKey{RegionID: regionID},
+			Entry: SnapEntryGenerating, Reason: err.Error()})
 		return err
 	}
+	if status != nil && !atomic.CompareAndSwapUint32(status, JobStatusRunning, JobStatusFinished) {
+		// The leader stepped down while generating, nobody is going to send the snapshot.
+		atomic.StoreUint32(status, JobStatusCancelled)
+		key := SnapKeyFromRegionSnap(regionID, snap)
+		snapCtx.mgr.deleteSnapshotFiles(key)
+		snapCtx.mgr.recordSnapEvent(SnapEvent{Type: SnapEventCanceled, Key: key,
+			Entry: SnapEntryGenerating, Reason: "generating snapshot is canceled"})
+		return nil
+	}
 	notifier <- snap
 	return nil
 }
@@ -676,6 +759,7 @@ func (snapCtx *snapContext) applySnap(regionID uint64, status *JobStatus, builde
 
 	t := time.Now()
 	applyOptions := newApplyOptions(snapCtx.engiens.kv, regionState.GetRegion(), status, builder, snapCtx.wb)
+	applyOptions.CollectLockKeys = snapCtx.strictApplyOrder
 	if result, err = snap.Apply(*applyOptions); err != nil {
 		return result, err
 	}
@@ -688,19 +772,26 @@ func (snapCtx *snapContext) applySnap(regionID uint64, status *JobStatus, builde
 }
 
 // handleApply tries to apply the snapshot of the specified Region. It calls `applySnap` to do the actual work.
+// The job is still running on success, it is finished by finishApply after the data is visible.
 func (snapCtx *snapContext) handleApply(regionID uint64, status *JobStatus, builder *sstable.Builder) (ApplyResult, error) {
 	atomic.CompareAndSwapUint32(status, JobStatusPending, JobStatusRunning)
 	result, err := snapCtx.applySnap(regionID, status, builder)
+	event := SnapEvent{Key: SnapKey{RegionID: regionID}, Entry: SnapEntryApplying}
 	switch err.(type) {
 	case nil:
-		atomic.SwapUint32(status, JobStatusFinished)
+		return result, nil
 	case applySnapAbortError:
 		log.Warn("applying snapshot is aborted", zap.Uint64("region id", regionID))
 		y.Assert(atomic.SwapUint32(status, JobStatusCancelled) == JobStatusCancelling)
+		event.Type = SnapEventCanceled
+		event.Reason = err.Error()
 	default:
 		log.Error("failed to apply snap!!!", zap.Error(err))
 		atomic.SwapUint32(status, JobStatusFailed)
+		event.Type = SnapEventFailed
+		event.Reason = err.Error()
 	}
+	snapCtx.mgr.recordSnapEvent(event)
 	return result, err
 }
 
@@ -759,6 +850,8 @@ func (snapCtx *snapContext) cleanUpRange(regionID uint64, startKey, endKey []byt
 type regionApplyState struct {
 	localState *rspb.RegionLocalState
 	tableCount int
+	status     *JobStatus
+	lockKeys   [][]byte
 }
 
 type regionTaskHandler struct {
@@ -774,6 +867,8 @@ type regionTaskHandler struct {
 
 	tableFiles  []*os.File
 	applyStates []regionApplyState
+	// tableChecksums are the checksums of the tableFiles if verifyIngestChecksum is set.
+	tableChecksums []uint32
 }
 
 func newRegionTaskHandler(conf *config.Config, engines *Engines, mgr *SnapManager, batchSize uint64, cleanStalePeerDelay time.Duration) *regionTaskHandler {
@@ -802,7 +897,7 @@ func (r *regionTaskHandler) resetBuilder() error {
 	}
 	compressionType := config.ParseCompression(r.conf.Engine.IngestCompression)
 	if r.builder == nil {
-		r.builder = r.ctx.engiens.kv.DB.NewExternalTableBuilder(r.builderFile, compressionType, r.ctx.mgr.limiter)
+		r.builder = r.ctx.engiens.kv.DB.NewExternalTableBuilder(r.builderFile, compressionType, r.ctx.mgr.ingestLimiter.Limiter())
 		r.builder.SetIsManaged()
 	} else {
 		r.builder.Reset(r.builderFile)
@@ -811,7 +906,7 @@ func (r *regionTaskHandler) resetBuilder() error {
 	return nil
 }
 
-func (r *regionTaskHandler) handleApplyResult(result ApplyResult) error {
+func (r *regionTaskHandler) handleApplyResult(status *JobStatus, result ApplyResult) error {
 	if result.HasPut {
 		if _, err := r.builder.Finish(); err != nil {
 			return err
@@ -822,8 +917,13 @@ func (r *regionTaskHandler) handleApplyResult(result ApplyResult) error {
 		}
 	}
 
-	state := regionApplyState{localState: result.RegionState}
+	state := regionApplyState{localState: result.RegionState, status: status, lockKeys: result.LockKeys}
 	if result.HasPut {
+		if r.ctx.verifyIngestChecksum {
+			if err := r.recordTableChecksum(r.builderFile.Name()); err != nil {
+				return err
+			}
+		}
 		state.tableCount++
 		r.tableFiles = append(r.tableFiles, r.builderFile)
 	}
@@ -832,31 +932,63 @@ func (r *regionTaskHandler) handleApplyResult(result ApplyResult) error {
 	return nil
 }
 
+// finishApply makes the data of the applied snapshots visible and finishes their jobs. The column families
+// become visible in this order: lock, write and default, then the rollbacks and op locks, then the region
+// states. The locks are written by Apply before any other data, so a read never misses the lock of a key
+// whose committed versions are visible. The jobs are finished last, the peers don't serve reads before.
 func (r *regionTaskHandler) finishApply() error {
+	states := r.applyStates
+	r.applyStates = nil
+	applied, err := r.ingestApplied(states)
+	for i, state := range states {
+		r.ctx.finishApplyJob(state, i < applied)
+	}
+	return err
+}
+
+// ingestApplied ingests the data of the applied snapshots and returns the number of the snapshots whose data
+// is visible.
+func (r *regionTaskHandler) ingestApplied(states []regionApplyState) (int, error) {
+	if r.ctx.strictApplyOrder {
+		if err := r.ctx.checkApplyOrder(states); err != nil {
+			panic(err)
+		}
+	}
 	log.S().Infof("apply snapshot ingesting %d tables", len(r.tableFiles))
 	externalFiles := make([]badger.ExternalTableSpec, len(r.tableFiles))
 	for i, file := range r.tableFiles {
 		externalFiles[i] = badger.ExternalTableSpec{Filename: file.Name()}
 	}
-	n, err := r.ctx.engiens.kv.DB.IngestExternalFiles(externalFiles)
+	var n int
+	err := r.verifyTableChecksums()
 	if err != nil {
-		log.S().Errorf("ingest sst failed (first %d files succeeded): %s", n, err)
+		log.Error("verify table checksum failed, skip ingesting", zap.Error(err))
+	} else {
+		n, err = r.ctx.engiens.kv.DB.IngestExternalFiles(externalFiles)
+		if err != nil {
+			log.S().Errorf("ingest sst failed (first %d files succeeded): %s", n, err)
+		}
 	}
 
-	wb := r.ctx.wb
+	// The write batch only has the rollback and op lock entries of the snapshots now.
+	if err = r.ingestExtraEntries(r.ctx.wb); err != nil {
+		return 0, err
+	}
+	wb := new(WriteBatch)
 	r.ctx.wb = nil
-	var cnt int
-	for _, state := range r.applyStates {
-		if cnt >= n {
+	var cnt, applied int
+	for _, state := range states {
+		if cnt+state.tableCount > n {
 			break
 		}
 		cnt += state.tableCount
 		rs := state.localState
 		regionID := rs.Region.Id
 		if err := wb.SetMsg(y.KeyWithTs(RegionStateKey(regionID), KvTS), rs); err != nil {
-			return err
+			return 0, err
 		}
 		wb.Delete(y.KeyWithTs(SnapshotRaftStateKey(regionID), KvTS))
+		applied++
 	}
 
 	if err := wb.WriteToKV(r.ctx.engiens.kv); err != nil {
@@ -866,15 +998,89 @@ func (r *regionTaskHandler) finishApply() error {
 	log.S().Infof("apply snapshot ingested %d tables", len(r.tableFiles))
 
 	for _, f := range r.tableFiles {
+		r.ctx.mgr.checksums.forget(f.Name())
 		if err := os.Remove(f.Name()); err != nil {
-			return err
+			return applied, err
 		}
 	}
 	r.tableFiles = nil
-	r.applyStates = nil
+	r.tableChecksums = nil
+	return applied, nil
+}
+
+func (r *regionTaskHandler) recordTableChecksum(path string) error {
+	checksum, err := util.CalcCRC32(path)
+	if err != nil {
+		return err
+	}
+	if err = r.ctx.mgr.checksums.record(path, checksum); err != nil {
+		return err
+	}
+	r.tableChecksums = append(r.tableChecksums, checksum)
+	return nil
+}
+
+// verifyTableChecksums reads the tables again and checks them against the checksums computed when they were
+// built, so a table corrupted on disk is never ingested.
+func (r *regionTaskHandler) verifyTableChecksums() error {
+	if !r.ctx.verifyIngestChecksum {
+		return nil
+	}
+	for i, f := range r.tableFiles {
+		if err := r.ctx.mgr.checksums.Verify(f.Name(), r.tableChecksums[i], true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ingestExtraEntries ingests the rollback and op lock entries of the applied snapshots as a single table.
+// The extra txn status keys are out of the ranges of the regions, so they can't be put in the tables of
+// the regions. The entries are written key by key if the ingestion fails.
+func (r *regionTaskHandler) ingestExtraEntries(wb *WriteBatch) error {
+	if len(wb.entries) == 0 {
+		return nil
+	}
+	entries := wb.entries
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key.Compare(entries[j].Key) < 0
+	})
+	if err := r.resetBuilder(); err != nil {
+		return err
+	}
+	file := r.builderFile
+	defer func() {
+		for _, name := range []string{file.Name(), sstable.IndexFilename(file.Name())} {
+			if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+				log.S().Error(err)
+			}
+		}
+	}()
+	err := r.buildExtraTable(entries)
+	if err == nil {
+		_, err = r.ctx.engiens.kv.DB.IngestExternalFiles([]badger.ExternalTableSpec{{Filename: file.Name()}})
+	}
+	if err != nil {
+		log.S().Warnf("ingest %d extra entries failed, write them instead: %s", len(entries), err)
+		return wb.WriteToKV(r.ctx.engiens.kv)
+	}
+	log.S().Infof("apply snapshot ingested %d extra entries", len(entries))
 	return nil
 }
 
+func (r *regionTaskHandler) buildExtraTable(entries []*badger.Entry) error {
+	for i, e := range entries {
+		if i > 0 && e.Key.Equal(entries[i-1].Key) {
+			continue
+		}
+		if err := r.builder.Add(e.Key, y.ValueStruct{Value: e.Value, UserMeta: e.UserMeta}); err != nil {
+			return err
+		}
+	}
+	_, err := r.builder.Finish()
+	return err
+}
+
 // handlePendingApplies tries to apply pending tasks if there is some.
 func (r *regionTaskHandler) handlePendingApplies() {
 	r.ctx.wb = new(WriteBatch)
@@ -898,8 +1104,9 @@ func (r *regionTaskHandler) handlePendingApplies() {
 			log.S().Error(err)
 			continue
 		}
-		if err := r.handleApplyResult(result); err != nil {
+		if err := r.handleApplyResult(task.status, result); err != nil {
 			log.S().Error(err)
+			r.ctx.finishApplyJob(regionApplyState{localState: result.RegionState, status: task.status}, false)
 		}
 	}
 	if err := r.finishApply(); err != nil {
@@ -913,7 +1120,7 @@ func (r *regionTaskHandler) handle(t task) {
 		// It is safe for now to handle generating and applying snapshot concurrently,
 		// but it may not when merge is implemented.
 		regionTask := t.data.(*regionTask)
-		r.ctx.handleGen(regionTask.regionID, regionTask.redoIdx, regionTask.notifier)
+		r.ctx.handleGen(regionTask.regionID, regionTask.redoIdx, regionTask.epoch, regionTask.notifier, regionTask.status)
 	case taskTypeRegionApply:
 		// To make sure applying snapshots in order.
 		r.pendingApplies = append(r.pendingApplies, t)
@@ -926,6 +1133,8 @@ func (r *regionTaskHandler) handle(t task) {
 			// Use delete files
 			r.ctx.cleanUpRange(regionTask.regionID, regionTask.startKey, regionTask.endKey, false)
 		}
+	case taskTypeRegionDestroyRange:
+		r.ctx.destroyRange(t.data.(*destroyRangeTask))
 	}
 }
 
@@ -1019,7 +1228,3 @@ func (r *compactTaskHandler) handle(t task) {
 type computeHashTaskHandler struct {
 	router *router
 }
-
-func (r *computeHashTaskHandler) handle(t task) {
-	// TODO: stub
-}
@@ -14,6 +14,8 @@
 package raftstore
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"sync"
@@ -26,6 +28,7 @@ import (
 	"github.com/pingcap/kvproto/pkg/eraftpb"
 	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
 	"github.com/pingcap/tidb/store/mockstore/unistore/lockstore"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/dbreader"
 	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/mvcc"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -391,3 +394,535 @@ func raftLogMustExist(t *testing.T, db *badger.DB, regionID, startIdx, endIdx ui
 		}
 	}
 }
+
+func TestSplitCheckSizeAmplification(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	require.Nil(t, engines.kv.DB.Update(func(txn *badger.Txn) error {
+		for i := 0; i < 20; i++ {
+			// Every kv is 10 bytes.
+			if err := txn.Set([]byte(fmt.Sprintf("k%02d", i)), []byte("value00")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	cfg := &splitCheckConfig{
+		batchSplitLimit: 10,
+		RegionSplitSize: 20 * KB,
+		RegionMaxSize:   30 * KB,
+		RegionSplitKeys: 1000,
+		RegionMaxKeys:   1500,
+	}
+	splitCheck := func(amplification uint64) *splitCheckHandler {
+		h := newSplitCheckRunner(engines.kv.DB, nil, cfg, amplification)
+		txn := engines.kv.DB.NewTransaction(false)
+		defer txn.Discard()
+		reader := dbreader.NewDBReader([]byte("k"), []byte("l"), txn)
+		defer reader.Close()
+		keys := h.splitCheck([]byte("k"), []byte("l"), reader)
+		if amplification == 1 {
+			assert.Len(t, keys, 0)
+		} else {
+			assert.Equal(t, [][]byte{[]byte("k02"), []byte("k05"), []byte("k08"), []byte("k11"),
+				[]byte("k14"), []byte("k17")}, keys)
+		}
+		return h
+	}
+
+	h := splitCheck(1)
+	assert.True(t, h.scanFinished)
+	assert.Equal(t, uint64(200), h.scannedSize)
+	assert.Equal(t, uint64(20), h.scannedKeys)
+
+	h = splitCheck(1000)
+	assert.True(t, h.scanFinished)
+	assert.Equal(t, uint64(200000), h.scannedSize)
+	assert.Equal(t, uint64(20), h.scannedKeys)
+
+	assert.Equal(t, uint64(5), NewDefaultConfig().amplifySize(5))
+	amplifiedCfg := NewDefaultConfig()
+	amplifiedCfg.RegionSizeAmplification = 1000
+	assert.Equal(t, uint64(5000), amplifiedCfg.amplifySize(5))
+}
+
+func TestSplitRules(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	require.Nil(t, engines.kv.DB.Update(func(txn *badger.Txn) error {
+		for i := 0; i < 20; i++ {
+			// Every kv is 10 bytes.
+			if err := txn.Set([]byte(fmt.Sprintf("k%02d", i)), []byte("value00")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	cfg := newDefaultSplitCheckConfig()
+	splitCheck := func() [][]byte {
+		h := newSplitCheckRunner(engines.kv.DB, nil, cfg, 1)
+		txn := engines.kv.DB.NewTransaction(false)
+		defer txn.Discard()
+		reader := dbreader.NewDBReader([]byte("k"), []byte("l"), txn)
+		defer reader.Close()
+		return h.splitCheck([]byte("k"), []byte("l"), reader)
+	}
+	assert.Len(t, splitCheck(), 0)
+
+	// The longest matching prefix wins and the zero thresholds keep the defaults.
+	require.Nil(t, cfg.setRules([]SplitRule{
+		{KeyPrefix: []byte("k"), RegionSplitSize: 20, RegionMaxSize: 30},
+		{KeyPrefix: []byte("k1"), RegionSplitKeys: 2, RegionMaxKeys: 3},
+		{KeyPrefix: []byte("x"), RegionSplitSize: 1, RegionMaxSize: 1},
+	}))
+	assert.Equal(t, [][]byte{[]byte("k02"), []byte("k04"), []byte("k06"), []byte("k08"), []byte("k10"),
+		[]byte("k12"), []byte("k14"), []byte("k16"), []byte("k18")}, splitCheck())
+	th := cfg.thresholds([]byte("k10"), []byte("k2"))
+	assert.Equal(t, uint64(3), th.maxKeys)
+	assert.Equal(t, cfg.RegionMaxSize, th.maxSize)
+	assert.Equal(t, cfg.defaultThresholds(), cfg.thresholds([]byte("a"), []byte("k")))
+
+	// A region spanning several rules takes the lower thresholds of the rules it overlaps.
+	th = cfg.thresholds([]byte("a"), nil)
+	assert.Equal(t, uint64(1), th.maxSize)
+	assert.Equal(t, uint64(1), th.splitSize)
+	assert.Equal(t, uint64(3), th.maxKeys)
+	th = cfg.thresholds([]byte("k2"), []byte("l"))
+	assert.Equal(t, uint64(20), th.splitSize)
+	assert.Equal(t, cfg.RegionMaxKeys, th.maxKeys)
+
+	err := cfg.setRules([]SplitRule{{KeyPrefix: []byte("k"), RegionSplitKeys: cfg.RegionMaxKeys + 1}})
+	require.IsType(t, &ErrInvalidConfig{}, err)
+	assert.Equal(t, "SplitRules[0].RegionMaxKeys", err.(*ErrInvalidConfig).Field)
+	require.Nil(t, cfg.setRules(nil))
+	assert.Len(t, splitCheck(), 0)
+}
+
+func TestUnsafeDestroyRange(t *testing.T) {
+	kvPath, err := ioutil.TempDir("", "testUnsafeDestroyRange")
+	require.Nil(t, err)
+	db := getTestDBForRegions(t, kvPath, []uint64{1})
+	require.Nil(t, db.DB.Update(func(txn *badger.Txn) error {
+		for _, k := range []byte{1, 2, 3, 4} {
+			require.Nil(t, txn.SetEntry(&badger.Entry{Key: y.KeyWithTs([]byte{'t', k}, KvTS), Value: []byte{k}}))
+		}
+		return nil
+	}))
+	db.LockStore.Put([]byte{'t', 2}, []byte{2})
+	db.LockStore.Put([]byte{'t', 4}, []byte{4})
+	engines := newEnginesWithKVDb(t, db)
+	engines.kvPath = kvPath
+	defer cleanUpTestEngineData(engines)
+
+	wg := new(sync.WaitGroup)
+	regionWorker := newWorker("snapshot-worker", wg)
+	regionWorker.start(newRegionTaskHandler(&config.DefaultConf, engines, NewSnapManager(kvPath, nil), 0, 0))
+	defer func() {
+		regionWorker.sender <- task{tp: taskTypeStop}
+		wg.Wait()
+	}()
+	ris := &RaftInnerServer{batchSystem: &raftBatchSystem{workers: &workers{regionWorker: regionWorker}}}
+	var events []DestroyRangeEvent
+	ris.AddDestroyRangeListener(func(event DestroyRangeEvent) {
+		events = append(events, event)
+	})
+
+	assert.NotNil(t, ris.UnsafeDestroyRange(context.Background(), []byte{'t', 3}, []byte{'t', 1}))
+	assert.NotNil(t, ris.UnsafeDestroyRange(context.Background(), []byte{'t', 1}, nil))
+	require.Nil(t, ris.UnsafeDestroyRange(context.Background(), []byte{'t', 2}, []byte{'t', 4}))
+	require.Len(t, events, 1)
+	assert.Equal(t, []byte{'t', 2}, events[0].StartKey)
+	assert.Equal(t, []byte{'t', 4}, events[0].EndKey)
+	assert.Nil(t, events[0].Err)
+
+	txn := db.DB.NewTransaction(false)
+	reader := dbreader.NewDBReader([]byte{'t', 1}, []byte{'t', 5}, txn)
+	keys := collectRangeKeys(reader.GetIter(), []byte{'t', 1}, []byte{'t', 5}, nil)
+	reader.Close()
+	require.Len(t, keys, 2)
+	assert.Equal(t, []byte{'t', 1}, keys[0].UserKey)
+	assert.Equal(t, []byte{'t', 4}, keys[1].UserKey)
+	assert.Nil(t, db.LockStore.Get([]byte{'t', 2}, nil))
+	assert.NotNil(t, db.LockStore.Get([]byte{'t', 4}, nil))
+
+	// The request doesn't wait for a full queue of the region worker after its deadline.
+	busy := &RaftInnerServer{batchSystem: &raftBatchSystem{workers: &workers{regionWorker: &worker{sender: make(chan task)}}}}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, busy.UnsafeDestroyRange(ctx, []byte{'t', 1}, []byte{'t', 2}))
+}
+
+func TestCancelGeneratingSnap(t *testing.T) {
+	kvPath, err := ioutil.TempDir("", "testCancelGeneratingSnap")
+	require.Nil(t, err)
+	db := getTestDBForRegions(t, kvPath, []uint64{1})
+	engines := newEnginesWithKVDb(t, db)
+	engines.kvPath = kvPath
+	defer cleanUpTestEngineData(engines)
+	snapPath, err := ioutil.TempDir("", "unistore_snap")
+	require.Nil(t, err)
+	defer os.RemoveAll(snapPath)
+	mgr := NewSnapManager(snapPath, nil)
+	snapCtx := newRegionTaskHandler(&config.DefaultConf, engines, mgr, 0, 0).ctx
+	txn := engines.kv.DB.NewTransaction(false)
+	index, _, err := getAppliedIdxTermForSnapshot(engines.raft, txn, 1)
+	txn.Discard()
+	require.Nil(t, err)
+	notifier := make(chan *eraftpb.Snapshot, 1)
+
+	// Canceled before the task is handled.
+	status := JobStatusCancelling
+	snapCtx.handleGen(1, index+1, nil, notifier, &status)
+	assert.Equal(t, JobStatusCancelled, status)
+	assert.Len(t, notifier, 0)
+
+	// Canceled while generating, the building stops and the snapshot files are deleted.
+	status = JobStatusCancelling
+	require.Nil(t, snapCtx.generateSnap(1, index+1, nil, notifier, &status))
+	assert.Equal(t, JobStatusCancelled, status)
+	assert.Len(t, notifier, 0)
+	events := mgr.RecentSnapEvents()
+	require.Len(t, events, 2)
+	assert.Equal(t, SnapEventCanceled, events[0].Type)
+	assert.Equal(t, SnapEventCanceled, events[1].Type)
+	files, err := ioutil.ReadDir(snapPath)
+	require.Nil(t, err)
+	assert.Len(t, files, 0)
+
+	status = JobStatusPending
+	snapCtx.handleGen(1, index+1, nil, notifier, &status)
+	assert.Equal(t, JobStatusFinished, status)
+	require.Len(t, notifier, 1)
+	snap, err := mgr.GetSnapshotForSending(SnapKeyFromRegionSnap(1, <-notifier))
+	require.Nil(t, err)
+	assert.True(t, snap.Exists())
+}
+
+func TestCancelStaleGeneratingSnap(t *testing.T) {
+	kvPath, err := ioutil.TempDir("", "testCancelStaleGeneratingSnap")
+	require.Nil(t, err)
+	db := getTestDBForRegions(t, kvPath, []uint64{1})
+	engines := newEnginesWithKVDb(t, db)
+	engines.kvPath = kvPath
+	defer cleanUpTestEngineData(engines)
+	snapPath, err := ioutil.TempDir("", "unistore_snap")
+	require.Nil(t, err)
+	defer os.RemoveAll(snapPath)
+	mgr := NewSnapManager(snapPath, nil)
+	snapCtx := newRegionTaskHandler(&config.DefaultConf, engines, mgr, 0, 0).ctx
+	txn := engines.kv.DB.NewTransaction(false)
+	index, _, err := getAppliedIdxTermForSnapshot(engines.raft, txn, 1)
+	txn.Discard()
+	require.Nil(t, err)
+	notifier := make(chan *eraftpb.Snapshot, 1)
+
+	// Cancelled while building, the partly written files are deleted.
+	status := JobStatusCancelling
+	_, err = doSnapshot(engines, mgr, 1, index+1, nil, &status)
+	assert.Equal(t, errAbort, err)
+	files, err := ioutil.ReadDir(snapPath)
+	require.Nil(t, err)
+	assert.Len(t, files, 0)
+
+	// The region is split after the snapshot is requested.
+	regionState, err := getRegionLocalState(engines.kv.DB, 1)
+	require.Nil(t, err)
+	epoch := *regionState.Region.RegionEpoch
+	regionState.Region.RegionEpoch.Version++
+	wb := new(WriteBatch)
+	require.Nil(t, wb.SetMsg(y.KeyWithTs(RegionStateKey(1), KvTS), regionState))
+	require.Nil(t, wb.WriteToKV(engines.kv))
+	status = JobStatusPending
+	snapCtx.handleGen(1, index+1, &epoch, notifier, &status)
+	assert.Equal(t, JobStatusCancelled, status)
+	assert.Len(t, notifier, 0)
+	events := mgr.RecentSnapEvents()
+	require.Len(t, events, 1)
+	assert.Equal(t, SnapEventCanceled, events[0].Type)
+	assert.Contains(t, events[0].Reason, errSnapEpochChanged.Error())
+
+	status = JobStatusPending
+	snapCtx.handleGen(1, index+1, regionState.Region.RegionEpoch, notifier, &status)
+	assert.Equal(t, JobStatusFinished, status)
+	assert.Len(t, notifier, 1)
+}
+
+func TestSnapApplyOrder(t *testing.T) {
+	kvPath, err := ioutil.TempDir("", "testSnapApplyOrder")
+	require.Nil(t, err)
+	db := getTestDBForRegions(t, kvPath, []uint64{1})
+	engines := newEnginesWithKVDb(t, db)
+	engines.kvPath = kvPath
+	defer cleanUpTestEngineData(engines)
+	snapPath, err := ioutil.TempDir("", "unistore_snap")
+	require.Nil(t, err)
+	defer os.RemoveAll(snapPath)
+	mgr := NewSnapManager(snapPath, nil)
+	handler := newRegionTaskHandler(&config.DefaultConf, engines, mgr, 0, 0)
+	handler.ctx.strictApplyOrder = true
+
+	txn := engines.kv.DB.NewTransaction(false)
+	index, _, err := getAppliedIdxTermForSnapshot(engines.raft, txn, 1)
+	txn.Discard()
+	require.Nil(t, err)
+	notifier := make(chan *eraftpb.Snapshot, 1)
+	handler.ctx.handleGen(1, index+1, nil, notifier, nil)
+	s := <-notifier
+	key := SnapKeyFromRegionSnap(1, s)
+	s1, err := mgr.GetSnapshotForSending(key)
+	require.Nil(t, err)
+	s2, err := mgr.GetSnapshotForReceiving(key, s.Data)
+	require.Nil(t, err)
+	require.Nil(t, copySnapshot(s2, s1))
+	regionState, err := getRegionLocalState(engines.kv.DB, 1)
+	require.Nil(t, err)
+	regionState.State = rspb.PeerState_Applying
+	wb := new(WriteBatch)
+	require.Nil(t, wb.SetMsg(y.KeyWithTs(RegionStateKey(1), KvTS), regionState))
+	require.Nil(t, wb.WriteToKV(engines.kv))
+
+	// The lock is visible after the snapshot is applied, but the job runs until the other data is ingested.
+	status := JobStatusPending
+	handler.ctx.wb = new(WriteBatch)
+	require.Nil(t, handler.resetBuilder())
+	result, err := handler.ctx.handleApply(1, &status, handler.builder)
+	require.Nil(t, err)
+	assert.Equal(t, JobStatusRunning, status)
+	assert.Equal(t, [][]byte{snapTestKey}, result.LockKeys)
+	assert.NotNil(t, db.LockStore.Get(snapTestKey, nil))
+	require.Nil(t, handler.handleApplyResult(&status, result))
+	require.Nil(t, handler.finishApply())
+	assert.Equal(t, JobStatusFinished, status)
+	regionState, err = getRegionLocalState(engines.kv.DB, 1)
+	require.Nil(t, err)
+	assert.Equal(t, rspb.PeerState_Normal, regionState.State)
+	events := mgr.RecentSnapEvents()
+	assert.Equal(t, SnapEventApplied, events[len(events)-1].Type)
+
+	// A job finished early or a missing lock is a violation.
+	state := regionApplyState{localState: regionState, status: &status}
+	assert.NotNil(t, handler.ctx.checkApplyOrder([]regionApplyState{state}))
+	running := JobStatusRunning
+	state = regionApplyState{localState: regionState, status: &running, lockKeys: [][]byte{[]byte("missing")}}
+	assert.NotNil(t, handler.ctx.checkApplyOrder([]regionApplyState{state}))
+	state.lockKeys = [][]byte{snapTestKey}
+	assert.Nil(t, handler.ctx.checkApplyOrder([]regionApplyState{state}))
+}
+
+func TestIngestLimiter(t *testing.T) {
+	unlimited := newIngestLimiter(0, 0, 0)
+	assert.Equal(t, uint64(0), unlimited.Rate())
+	assert.Nil(t, unlimited.WaitN(context.Background(), 1<<30))
+
+	const mb = 1 << 20
+	l := newIngestLimiter(100*mb, 10*mb, 10*time.Millisecond)
+	assert.Equal(t, uint64(100*mb), l.Rate())
+	assert.Nil(t, l.WaitN(context.Background(), ingestLimiterMinBurst))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.NotNil(t, l.WaitN(ctx, 2*ingestLimiterMinBurst))
+
+	// The rate is halved after every window with too many slow writes, down to the min rate.
+	now := time.Now()
+	for _, expected := range []uint64{50 * mb, 25 * mb, 12.5 * mb, 10 * mb} {
+		l.observe(now, 5*time.Millisecond)
+		l.observe(now, 20*time.Millisecond)
+		now = now.Add(ingestAdjustInterval)
+		l.observe(now, 20*time.Millisecond)
+		assert.Equal(t, expected, l.Rate())
+	}
+	// It grows back gradually once the writes are fast.
+	for i := 0; i < ingestRateSteps; i++ {
+		l.observe(now, time.Millisecond)
+		now = now.Add(ingestAdjustInterval)
+		l.observe(now, time.Millisecond)
+	}
+	assert.Equal(t, uint64(100*mb), l.Rate())
+
+	// The rate recovers on the tick without any write.
+	l.observe(now, 20*time.Millisecond)
+	now = now.Add(ingestAdjustInterval)
+	l.observe(now, 20*time.Millisecond)
+	assert.Equal(t, uint64(50*mb), l.Rate())
+	l.tick(now.Add(ingestAdjustInterval / 2))
+	assert.Equal(t, uint64(50*mb), l.Rate())
+	now = now.Add(ingestAdjustInterval)
+	l.tick(now)
+	assert.Equal(t, uint64(60*mb), l.Rate())
+	unlimited.tick(now)
+}
+
+func TestIngestExtraEntries(t *testing.T) {
+	kvPath, err := ioutil.TempDir("", "testIngestExtraEntries")
+	require.Nil(t, err)
+	db := getTestDBForRegions(t, kvPath, []uint64{1})
+	engines := newEnginesWithKVDb(t, db)
+	engines.kvPath = kvPath
+	defer cleanUpTestEngineData(engines)
+	snapPath, err := ioutil.TempDir("", "unistore_snap")
+	require.Nil(t, err)
+	defer os.RemoveAll(snapPath)
+	handler := newRegionTaskHandler(&config.DefaultConf, engines, NewSnapManager(snapPath, nil), 0, 0)
+
+	// The entries are added in the order of the write CF, they are sorted before ingesting.
+	wb := new(WriteBatch)
+	wb.Rollback(y.KeyWithTs([]byte("b"), 10))
+	wb.Rollback(y.KeyWithTs([]byte("b"), 20))
+	wb.SetOpLock(y.KeyWithTs([]byte("a"), 31), mvcc.NewDBUserMeta(30, 31))
+	wb.Rollback(y.KeyWithTs([]byte("a"), 20))
+	require.Nil(t, handler.ingestExtraEntries(wb))
+
+	files, err := ioutil.ReadDir(kvPath)
+	require.Nil(t, err)
+	for _, f := range files {
+		assert.NotContains(t, f.Name(), "ingest_convert_")
+	}
+	txn := engines.kv.DB.NewTransaction(false)
+	defer txn.Discard()
+	txn.SetReadTS(100)
+	for _, k := range []struct {
+		key     string
+		startTS uint64
+	}{{"a", 20}, {"a", 30}, {"b", 10}, {"b", 20}} {
+		item, err := txn.Get(mvcc.EncodeExtraTxnStatusKey([]byte(k.key), k.startTS))
+		require.Nil(t, err, k.key)
+		assert.Equal(t, k.startTS, mvcc.DBUserMeta(item.UserMeta()).StartTS())
+	}
+}
+
+type recordTaskHandler struct {
+	handled chan task
+	started chan struct{}
+	block   chan struct{}
+}
+
+func (h *recordTaskHandler) handle(t task) {
+	if t.tp == taskTypeRegionGen && t.data == nil {
+		close(h.started)
+		<-h.block
+	}
+	h.handled <- t
+}
+
+func TestRegionTaskQueue(t *testing.T) {
+	var events []RegionTaskStarvedEvent
+	listeners := new(regionTaskListeners)
+	listeners.add(func(event RegionTaskStarvedEvent) {
+		events = append(events, event)
+	})
+	cfg := NewDefaultConfig()
+	cfg.RegionTaskAgingInterval = time.Second
+	cfg.RegionTaskStarvationThreshold = 10 * time.Second
+	q := newRegionTaskQueue(cfg, listeners)
+	now := time.Now()
+	q.push(task{tp: taskTypeRegionGen, data: &regionTask{regionID: 1}}, now)
+	q.push(task{tp: taskTypeRegionApply, data: &regionTask{regionID: 2}}, now)
+	q.push(task{tp: taskTypeRegionApply, data: &regionTask{regionID: 3}}, now)
+	q.push(task{tp: taskTypeRegionDestroy, data: regionTask{regionID: 4}}, now)
+	var order []uint64
+	for q.len() > 0 {
+		order = append(order, regionTaskRegionID(q.pop(now)))
+	}
+	assert.Equal(t, []uint64{4, 2, 3, 1}, order)
+
+	// The generate task waiting for 3 seconds runs before the new destroy task.
+	q.push(task{tp: taskTypeRegionGen, data: &regionTask{regionID: 1}}, now)
+	now = now.Add(3 * time.Second)
+	q.push(task{tp: taskTypeRegionDestroy, data: regionTask{regionID: 4}}, now)
+	assert.Equal(t, uint64(1), regionTaskRegionID(q.pop(now)))
+
+	// A starved task is reported only once.
+	now = now.Add(11 * time.Second)
+	q.checkStarvation(now)
+	q.checkStarvation(now)
+	require.Len(t, events, 1)
+	assert.Equal(t, "destroy", events[0].Task)
+	assert.Equal(t, uint64(4), events[0].RegionID)
+	assert.Equal(t, 11*time.Second, events[0].Waited)
+	assert.Equal(t, regionTaskPriorityDestroy+11, events[0].Priority)
+
+	// The destroy task of a region runs after the earlier apply task of the region, which takes the
+	// priority of the destroy.
+	q = newRegionTaskQueue(cfg, listeners)
+	q.push(task{tp: taskTypeRegionApply, data: &regionTask{regionID: 1}}, now)
+	q.push(task{tp: taskTypeRegionApply, data: &regionTask{regionID: 2}}, now)
+	q.push(task{tp: taskTypeRegionDestroy, data: regionTask{regionID: 2}}, now)
+	var tasks []task
+	for q.len() > 0 {
+		tasks = append(tasks, q.pop(now))
+	}
+	require.Len(t, tasks, 3)
+	assert.Equal(t, taskTypeRegionApply, tasks[0].tp)
+	assert.Equal(t, uint64(2), regionTaskRegionID(tasks[0]))
+	assert.Equal(t, taskTypeRegionDestroy, tasks[1].tp)
+	assert.Equal(t, uint64(2), regionTaskRegionID(tasks[1]))
+	assert.Equal(t, uint64(1), regionTaskRegionID(tasks[2]))
+
+	// The destroy task received during a snapshot generation runs before the queued generations.
+	wg := new(sync.WaitGroup)
+	w := newWorker("test-region-worker", wg)
+	h := &recordTaskHandler{handled: make(chan task, 4), started: make(chan struct{}), block: make(chan struct{})}
+	w.startPrioritized(h, newRegionTaskQueue(cfg, listeners))
+	w.sender <- task{tp: taskTypeRegionGen}
+	<-h.started
+	w.sender <- task{tp: taskTypeRegionGen, data: &regionTask{regionID: 1}}
+	w.sender <- task{tp: taskTypeRegionDestroy, data: regionTask{regionID: 2}}
+	close(h.block)
+	assert.Nil(t, (<-h.handled).data)
+	assert.Equal(t, taskTypeRegionDestroy, (<-h.handled).tp)
+	assert.Equal(t, taskTypeRegionGen, (<-h.handled).tp)
+	w.stop()
+	wg.Wait()
+}
+
+func TestReadPool(t *testing.T) {
+	cfg := NewDefaultConfig()
+	cfg.ReadPoolSize = 2
+	cfg.ReadPoolScanConcurrency = 1
+	pool := newReadPool(cfg)
+	defer pool.stop()
+
+	// A long scan takes the only scan slot, the next scan waits for it.
+	release := make(chan struct{})
+	scanned := make(chan struct{}, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			assert.Nil(t, pool.Run(context.Background(), ReadQueueScan, func() { <-release }))
+			scanned <- struct{}{}
+		}()
+	}
+	require.Eventually(t, func() bool {
+		m := pool.Metrics(ReadQueueScan)
+		return m.Running == 1 && m.Pending == 1
+	}, time.Second, time.Millisecond)
+
+	// The point gets don't wait for the scans.
+	var got bool
+	require.Nil(t, pool.Run(context.Background(), ReadQueuePointGet, func() { got = true }))
+	assert.True(t, got)
+	m := pool.Metrics(ReadQueuePointGet)
+	assert.Equal(t, uint64(1), m.Tasks)
+	assert.Equal(t, 2, m.Concurrency)
+
+	// A read canceled before it runs is skipped.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, pool.Run(ctx, ReadQueueScan, func() { t.Error("canceled scan runs") }))
+	m = pool.Metrics(ReadQueueScan)
+	assert.Equal(t, uint64(1), m.Canceled)
+	assert.Equal(t, 1, m.Pending)
+
+	close(release)
+	<-scanned
+	<-scanned
+	m = pool.Metrics(ReadQueueScan)
+	assert.Equal(t, uint64(2), m.Tasks)
+	assert.Equal(t, 0, m.Running+m.Pending)
+	assert.Equal(t, 1, m.Concurrency)
+	assert.True(t, m.MaxWait > 0 && m.AvgWait() <= m.MaxWait)
+
+	// The reads run on the callers without a pool.
+	got = false
+	require.Nil(t, (*ReadPool)(nil).Run(context.Background(), ReadQueueScan, func() { got = true }))
+	assert.True(t, got)
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ngaut/unistore/config"
+	"github.com/ngaut/unistore/raftstore"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	coprocessorMethod        = "/tikvpb.Tikv/Coprocessor"
+	unsafeDestroyRangeMethod = "/tikvpb.Tikv/UnsafeDestroyRange"
+)
+
+// RangeDestroyer removes all the data in a range on the store without going through raft.
+type RangeDestroyer interface {
+	UnsafeDestroyRange(ctx context.Context, startKey, endKey []byte) error
+}
+
+// Services are the services of the store used by the built-in interceptors.
+type Services struct {
+	// RangeDestroyer is nil on the standalone server, which keeps using the UnsafeDestroyRange of the tikv server.
+	RangeDestroyer RangeDestroyer
+	// ReadPool runs the reads of the raft server, the reads of the standalone server run on the callers.
+	ReadPool *raftstore.ReadPool
+}
+
+// readQueues are the queues of the read pool for the unary reads, the reads in the batch commands streams
+// run on the streams.
+var readQueues = map[string]raftstore.ReadQueue{
+	"/tikvpb.Tikv/KvGet":        raftstore.ReadQueuePointGet,
+	"/tikvpb.Tikv/KvBatchGet":   raftstore.ReadQueuePointGet,
+	"/tikvpb.Tikv/RawGet":       raftstore.ReadQueuePointGet,
+	"/tikvpb.Tikv/RawBatchGet":  raftstore.ReadQueuePointGet,
+	"/tikvpb.Tikv/KvScan":       raftstore.ReadQueueScan,
+	"/tikvpb.Tikv/RawScan":      raftstore.ReadQueueScan,
+	"/tikvpb.Tikv/RawBatchScan": raftstore.ReadQueueScan,
+	coprocessorMethod:           raftstore.ReadQueueScan,
+}
+
+// Interceptors are the interceptors of the users on the gRPC server of the tikv server, like the ones
+// checking the auth, injecting latency or capturing the requests. They run before the built-in
+// interceptors in the given order.
+type Interceptors struct {
+	Unary  []grpc.UnaryServerInterceptor
+	Stream []grpc.StreamServerInterceptor
+}
+
+var (
+	registeredMu sync.Mutex
+	registered   Interceptors
+)
+
+// RegisterInterceptors adds the interceptors to the ones installed on the gRPC server of the tikv server, they
+// run after the ones registered before. It's called before the server is started, e.g. in an init function
+// of the package providing the interceptors.
+func RegisterInterceptors(i Interceptors) {
+	registeredMu.Lock()
+	defer registeredMu.Unlock()
+	registered.Unary = append(registered.Unary, i.Unary...)
+	registered.Stream = append(registered.Stream, i.Stream...)
+}
+
+// RegisteredInterceptors returns the interceptors added by RegisterInterceptors.
+func RegisteredInterceptors() Interceptors {
+	registeredMu.Lock()
+	defer registeredMu.Unlock()
+	return Interceptors{
+		Unary:  append([]grpc.UnaryServerInterceptor(nil), registered.Unary...),
+		Stream: append([]grpc.StreamServerInterceptor(nil), registered.Stream...),
+	}
+}
+
+// ServerOptions returns the interceptor options to create the gRPC server of the tikv server with.
+func (i Interceptors) ServerOptions(conf *config.Config, svcs *Services) []grpc.ServerOption {
+	tracker := newMemTracker(conf.Memory)
+	return []grpc.ServerOption{
+		grpc.UnaryInterceptor(newUnaryInterceptor(svcs, tracker, i.Unary...)),
+		grpc.StreamInterceptor(ChainStreamInterceptors(i.Stream...)),
+		// The memory tracker holds the bytes of the responses until they are sent.
+		grpc.StatsHandler(tracker),
+	}
+}
+
+// NewUnaryInterceptor returns the interceptor for the unary RPCs of the tikv server, the given interceptors
+// run before the built-in ones. The bytes of the responses are released when the interceptor returns, use
+// ServerOptions to hold them until the responses are sent.
+func NewUnaryInterceptor(conf *config.Config, svcs *Services, interceptors ...grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return newUnaryInterceptor(svcs, newMemTracker(conf.Memory), interceptors...)
+}
+
+func newUnaryInterceptor(svcs *Services, tracker *memTracker, interceptors ...grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	chain := make([]grpc.UnaryServerInterceptor, 0, len(interceptors)+4)
+	chain = append(chain, interceptors...)
+	chain = append(chain, CoprocessorInterceptor, tracker.intercept, newReadPoolInterceptor(svcs.ReadPool),
+		newDestroyRangeInterceptor(svcs.RangeDestroyer))
+	return ChainUnaryInterceptors(chain...)
+}
+
+// ChainUnaryInterceptors returns an interceptor running the interceptors in order, the first one is the
+// outermost.
+func ChainUnaryInterceptors(interceptors ...grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, next := interceptors[i], handler
+			handler = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return interceptor(ctx, req, info, next)
+			}
+		}
+		return handler(ctx, req)
+	}
+}
+
+// ChainStreamInterceptors returns an interceptor running the interceptors in order, the first one is the
+// outermost.
+func ChainStreamInterceptors(interceptors ...grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, next := interceptors[i], handler
+			handler = func(srv interface{}, ss grpc.ServerStream) error {
+				return interceptor(srv, ss, info, next)
+			}
+		}
+		return handler(srv, ss)
+	}
+}
+
+// cancelableMethods are the methods whose requests run long, they are skipped when their client is gone
+// before they are dispatched.
+var cancelableMethods = map[string]bool{
+	coprocessorMethod:           true,
+	"/tikvpb.Tikv/KvScan":       true,
+	"/tikvpb.Tikv/RawScan":      true,
+	"/tikvpb.Tikv/RawBatchScan": true,
+}
+
+// CoprocessorInterceptor skips the coprocessor and scan requests whose client has gone before they are
+// dispatched, so no engine snapshot is taken for them. A running request is not interrupted: the executors
+// of the cophandler take neither a context nor a cancel hook, so the request runs to the end and holds its
+// snapshot, its read pool slot and its tracked memory until then.
+func CoprocessorInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !cancelableMethods[info.FullMethod] {
+		return handler(ctx, req)
+	}
+	if err := ctx.Err(); err != nil {
+		log.Info("skip canceled request", zap.String("method", info.FullMethod), zap.Error(err))
+		return nil, status.FromContextError(err).Err()
+	}
+	return handler(ctx, req)
+}
+
+// newReadPoolInterceptor returns the interceptor running the reads in the read pool, so the scans don't block
+// the point gets.
+func newReadPoolInterceptor(readPool *raftstore.ReadPool) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		queue, ok := readQueues[info.FullMethod]
+		if !ok || readPool == nil {
+			return handler(ctx, req)
+		}
+		var (
+			resp interface{}
+			err  error
+		)
+		if poolErr := readPool.Run(ctx, queue, func() { resp, err = handler(ctx, req) }); poolErr != nil {
+			return nil, status.FromContextError(poolErr).Err()
+		}
+		return resp, err
+	}
+}
+
+// newDestroyRangeInterceptor returns the interceptor serving UnsafeDestroyRange with the destroyer, the
+// requests are passed to the tikv server if the destroyer is nil.
+func newDestroyRangeInterceptor(destroyer RangeDestroyer) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if info.FullMethod != unsafeDestroyRangeMethod || destroyer == nil {
+			return handler(ctx, req)
+		}
+		destroyReq := req.(*kvrpcpb.UnsafeDestroyRangeRequest)
+		resp := &kvrpcpb.UnsafeDestroyRangeResponse{}
+		if err := destroyer.UnsafeDestroyRange(ctx, destroyReq.StartKey, destroyReq.EndKey); err != nil {
+			log.Warn("failed to destroy range", zap.Error(err))
+			resp.Error = err.Error()
+		}
+		return resp, nil
+	}
+}
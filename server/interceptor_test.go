@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pingcap/kvproto/pkg/coprocessor"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCoprocessorInterceptorCanceledBeforeDispatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	info := &grpc.UnaryServerInfo{FullMethod: coprocessorMethod}
+	called := false
+	_, err := CoprocessorInterceptor(ctx, &coprocessor.Request{}, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		called = true
+		return &coprocessor.Response{}, nil
+	})
+	require.Equal(t, codes.Canceled, status.Code(err))
+	require.False(t, called)
+}
+
+func TestCoprocessorInterceptorCanceledMidRequest(t *testing.T) {
+	for _, method := range []string{coprocessorMethod, kvScanMethod} {
+		ctx, cancel := context.WithCancel(context.Background())
+		info := &grpc.UnaryServerInfo{FullMethod: method}
+		// The running request is not interrupted, it runs to the end.
+		resp, err := CoprocessorInterceptor(ctx, &coprocessor.Request{}, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			cancel()
+			return &coprocessor.Response{OtherError: "done"}, nil
+		})
+		require.Nil(t, err, method)
+		require.Equal(t, "done", resp.(*coprocessor.Response).OtherError, method)
+	}
+}
+
+func TestCoprocessorInterceptorDeadlineExceeded(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	info := &grpc.UnaryServerInfo{FullMethod: coprocessorMethod}
+	called := false
+	_, err := CoprocessorInterceptor(ctx, &coprocessor.Request{}, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		called = true
+		return &coprocessor.Response{}, nil
+	})
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	require.False(t, called)
+}
+
+func TestCoprocessorInterceptorFinished(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: coprocessorMethod}
+	resp, err := CoprocessorInterceptor(context.Background(), &coprocessor.Request{}, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return &coprocessor.Response{OtherError: "done"}, nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, "done", resp.(*coprocessor.Response).OtherError)
+}
+
+type fakeRangeDestroyer struct {
+	ranges [][2][]byte
+}
+
+func (d *fakeRangeDestroyer) UnsafeDestroyRange(ctx context.Context, startKey, endKey []byte) error {
+	d.ranges = append(d.ranges, [2][]byte{startKey, endKey})
+	return nil
+}
+
+func TestDestroyRangeInterceptor(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: unsafeDestroyRangeMethod}
+	req := &kvrpcpb.UnsafeDestroyRangeRequest{StartKey: []byte("a"), EndKey: []byte("b")}
+	passed := false
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		passed = true
+		return &kvrpcpb.UnsafeDestroyRangeResponse{}, nil
+	}
+
+	// The standalone server has no destroyer, the request is passed to the tikv server.
+	_, err := newDestroyRangeInterceptor(nil)(context.Background(), req, info, handler)
+	require.Nil(t, err)
+	require.True(t, passed)
+
+	passed = false
+	destroyer := new(fakeRangeDestroyer)
+	_, err = newDestroyRangeInterceptor(destroyer)(context.Background(), req, info, handler)
+	require.Nil(t, err)
+	require.False(t, passed)
+	require.Equal(t, [][2][]byte{{[]byte("a"), []byte("b")}}, destroyer.ranges)
+}
+
+func TestRegisterInterceptors(t *testing.T) {
+	var order []int
+	newInterceptor := func(n int) grpc.UnaryServerInterceptor {
+		return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			order = append(order, n)
+			return handler(ctx, req)
+		}
+	}
+	RegisterInterceptors(Interceptors{Unary: []grpc.UnaryServerInterceptor{newInterceptor(1)}})
+	RegisterInterceptors(Interceptors{Unary: []grpc.UnaryServerInterceptor{newInterceptor(2)}})
+	defer func() {
+		registered = Interceptors{}
+	}()
+	chain := ChainUnaryInterceptors(RegisteredInterceptors().Unary...)
+	_, err := chain(context.Background(), nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, []int{1, 2}, order)
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/ngaut/unistore/config"
+	"github.com/pingcap/kvproto/pkg/coprocessor"
+	"github.com/pingcap/kvproto/pkg/errorpb"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/stats"
+)
+
+const kvScanMethod = "/tikvpb.Tikv/KvScan"
+
+// ErrMemoryExceeded is returned when a request exceeds its memory quota, it's reported to the client as
+// ServerIsBusy so the request is retried later.
+type ErrMemoryExceeded struct {
+	Consumed int64
+	Quota    int64
+	// Store is true if the store level quota is exceeded.
+	Store bool
+}
+
+func (e *ErrMemoryExceeded) Error() string {
+	if e.Store {
+		return fmt.Sprintf("store memory quota exceeded, consumed %d, quota %d", e.Consumed, e.Quota)
+	}
+	return fmt.Sprintf("request memory quota exceeded, consumed %d, quota %d", e.Consumed, e.Quota)
+}
+
+// memTracker limits the memory used by the coprocessor and scan requests.
+// The bytes of the request are consumed before it runs and released when it returns. The cophandler builds
+// the response without a hook to check the quotas, so the bytes of the response are consumed after it's
+// built: a response exceeding the quotas is dropped and ServerIsBusy is returned instead. Installed as the
+// stats handler of the gRPC server, the tracker holds the bytes of the response until it's sent, otherwise
+// they are released when the request returns. A request is rejected if its bytes exceed the request quota
+// or the bytes consumed by all the requests exceed the store quota.
+type memTracker struct {
+	requestQuota int64
+	storeQuota   int64
+	consumed     int64
+}
+
+func newMemTracker(conf config.Memory) *memTracker {
+	return &memTracker{
+		requestQuota: conf.RequestQuota,
+		storeQuota:   conf.StoreQuota,
+	}
+}
+
+func (t *memTracker) consume(n int64) *ErrMemoryExceeded {
+	consumed := atomic.AddInt64(&t.consumed, n)
+	if t.storeQuota > 0 && consumed > t.storeQuota {
+		atomic.AddInt64(&t.consumed, -n)
+		return &ErrMemoryExceeded{Consumed: consumed, Quota: t.storeQuota, Store: true}
+	}
+	return nil
+}
+
+func (t *memTracker) release(n int64) {
+	atomic.AddInt64(&t.consumed, -n)
+}
+
+// track consumes n more bytes of a request which has consumed the given bytes.
+func (t *memTracker) track(consumed, n int64) *ErrMemoryExceeded {
+	if t.requestQuota > 0 && consumed+n > t.requestQuota {
+		return &ErrMemoryExceeded{Consumed: consumed + n, Quota: t.requestQuota}
+	}
+	return t.consume(n)
+}
+
+func (t *memTracker) intercept(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if info.FullMethod != coprocessorMethod && info.FullMethod != kvScanMethod ||
+		t.requestQuota == 0 && t.storeQuota == 0 {
+		return handler(ctx, req)
+	}
+	reqSize := messageSize(req)
+	if err := t.track(0, reqSize); err != nil {
+		log.Warn("reject request", zap.String("method", info.FullMethod), zap.Error(err))
+		return memExceededResponse(info.FullMethod, err), nil
+	}
+	defer t.release(reqSize)
+	resp, err := handler(ctx, req)
+	if err != nil {
+		return resp, err
+	}
+	respSize := messageSize(resp)
+	if err := t.track(reqSize, respSize); err != nil {
+		log.Warn("drop response", zap.String("method", info.FullMethod), zap.Error(err))
+		return memExceededResponse(info.FullMethod, err), nil
+	}
+	if charge, ok := ctx.Value(memChargeKey{}).(*memCharge); ok {
+		atomic.AddInt64(&charge.bytes, respSize)
+	} else {
+		t.release(respSize)
+	}
+	return resp, nil
+}
+
+// memCharge is the bytes of the response of an RPC held until the RPC ends.
+type memCharge struct {
+	bytes int64
+}
+
+type memChargeKey struct{}
+
+// TagRPC implements stats.Handler, it tags the tracked RPCs with the charges of their responses.
+func (t *memTracker) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	if info.FullMethodName != coprocessorMethod && info.FullMethodName != kvScanMethod {
+		return ctx
+	}
+	return context.WithValue(ctx, memChargeKey{}, new(memCharge))
+}
+
+// HandleRPC implements stats.Handler, it releases the bytes of the response after the RPC ends, the
+// response has been sent then.
+func (t *memTracker) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	if _, ok := s.(*stats.End); !ok {
+		return
+	}
+	if charge, ok := ctx.Value(memChargeKey{}).(*memCharge); ok {
+		t.release(atomic.SwapInt64(&charge.bytes, 0))
+	}
+}
+
+// TagConn implements stats.Handler.
+func (t *memTracker) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+// HandleConn implements stats.Handler.
+func (t *memTracker) HandleConn(context.Context, stats.ConnStats) {}
+
+func messageSize(msg interface{}) int64 {
+	if sizer, ok := msg.(interface{ Size() int }); ok {
+		return int64(sizer.Size())
+	}
+	return 0
+}
+
+func memExceededResponse(method string, err *ErrMemoryExceeded) interface{} {
+	regionErr := &errorpb.Error{
+		Message:      err.Error(),
+		ServerIsBusy: &errorpb.ServerIsBusy{Reason: err.Error()},
+	}
+	if method == kvScanMethod {
+		return &kvrpcpb.ScanResponse{RegionError: regionErr}
+	}
+	return &coprocessor.Response{RegionError: regionErr}
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ngaut/unistore/config"
+	"github.com/pingcap/kvproto/pkg/coprocessor"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/stats"
+)
+
+func TestMemTrackerRequestQuota(t *testing.T) {
+	tracker := newMemTracker(config.Memory{RequestQuota: 1024})
+	info := &grpc.UnaryServerInfo{FullMethod: coprocessorMethod}
+	resp, err := tracker.intercept(context.Background(), &coprocessor.Request{}, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return &coprocessor.Response{Data: make([]byte, 2048)}, nil
+	})
+	require.Nil(t, err)
+	regionErr := resp.(*coprocessor.Response).RegionError
+	require.NotNil(t, regionErr)
+	require.NotNil(t, regionErr.ServerIsBusy)
+	require.Equal(t, int64(0), tracker.consumed)
+
+	resp, err = tracker.intercept(context.Background(), &coprocessor.Request{}, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return &coprocessor.Response{Data: make([]byte, 512)}, nil
+	})
+	require.Nil(t, err)
+	require.Nil(t, resp.(*coprocessor.Response).RegionError)
+	require.Len(t, resp.(*coprocessor.Response).Data, 512)
+
+	// The bytes of the request count too.
+	scanInfo := &grpc.UnaryServerInfo{FullMethod: kvScanMethod}
+	resp, err = tracker.intercept(context.Background(), &kvrpcpb.ScanRequest{StartKey: make([]byte, 2048)}, scanInfo, func(ctx context.Context, req interface{}) (interface{}, error) {
+		t.Fatal("the request exceeding the quota runs")
+		return nil, nil
+	})
+	require.Nil(t, err)
+	require.NotNil(t, resp.(*kvrpcpb.ScanResponse).RegionError.GetServerIsBusy())
+}
+
+func TestMemTrackerStoreQuota(t *testing.T) {
+	req := &coprocessor.Request{Data: make([]byte, 600)}
+	tracker := newMemTracker(config.Memory{StoreQuota: 1000})
+	info := &grpc.UnaryServerInfo{FullMethod: coprocessorMethod}
+	running, finish := make(chan struct{}), make(chan struct{})
+	done := make(chan interface{}, 1)
+	go func() {
+		resp, _ := tracker.intercept(context.Background(), req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			close(running)
+			<-finish
+			return &coprocessor.Response{}, nil
+		})
+		done <- resp
+	}()
+	<-running
+	require.Equal(t, int64(req.Size()), tracker.consumed)
+
+	// The running request holds the store quota.
+	resp, err := tracker.intercept(context.Background(), req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		t.Fatal("the request exceeding the quota runs")
+		return nil, nil
+	})
+	require.Nil(t, err)
+	regionErr := resp.(*coprocessor.Response).RegionError
+	require.NotNil(t, regionErr.GetServerIsBusy())
+	err = &ErrMemoryExceeded{Consumed: int64(2 * req.Size()), Quota: 1000, Store: true}
+	require.Equal(t, err.Error(), regionErr.Message)
+
+	close(finish)
+	require.Nil(t, (<-done).(*coprocessor.Response).RegionError)
+	require.Equal(t, int64(0), tracker.consumed)
+}
+
+func TestMemTrackerHoldResponse(t *testing.T) {
+	tracker := newMemTracker(config.Memory{StoreQuota: 1000})
+	info := &grpc.UnaryServerInfo{FullMethod: coprocessorMethod}
+	ctx := tracker.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: coprocessorMethod})
+	resp, err := tracker.intercept(ctx, &coprocessor.Request{}, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return &coprocessor.Response{Data: make([]byte, 600)}, nil
+	})
+	require.Nil(t, err)
+	respSize := int64(resp.(*coprocessor.Response).Size())
+	require.Equal(t, respSize, tracker.consumed)
+
+	// The response not sent yet holds the store quota.
+	resp, err = tracker.intercept(context.Background(), &coprocessor.Request{Data: make([]byte, 600)}, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		t.Fatal("the request exceeding the quota runs")
+		return nil, nil
+	})
+	require.Nil(t, err)
+	require.NotNil(t, resp.(*coprocessor.Response).RegionError.GetServerIsBusy())
+
+	tracker.HandleRPC(ctx, &stats.OutPayload{})
+	require.Equal(t, respSize, tracker.consumed)
+	tracker.HandleRPC(ctx, &stats.End{})
+	require.Equal(t, int64(0), tracker.consumed)
+	tracker.HandleRPC(ctx, &stats.End{})
+	require.Equal(t, int64(0), tracker.consumed)
+}
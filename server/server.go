@@ -3,8 +3,10 @@ package server
 import (
 	"context"
 	"encoding/binary"
+	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 
 	"github.com/ngaut/unistore/config"
 	"github.com/ngaut/unistore/raftstore"
@@ -24,6 +26,25 @@ const (
 
 // New returns a new tikv.Server.
 func New(conf *config.Config, pdClient pd.Client) (*tikv.Server, error) {
+	s, err := NewStore(conf, pdClient)
+	if err != nil {
+		return nil, err
+	}
+	return s.Server, nil
+}
+
+// Store is a tikv.Server with the services of the store, which are used by the interceptors of its gRPC
+// server.
+type Store struct {
+	Server   *tikv.Server
+	Services *Services
+	// Status serves the status API of the store, it's mounted on the status server. Every store has its own,
+	// so the stores in a process don't conflict.
+	Status *http.ServeMux
+}
+
+// NewStore returns a new tikv.Server with the services of the store.
+func NewStore(conf *config.Config, pdClient pd.Client) (*Store, error) {
 	physical, logical, err := pdClient.GetTS(context.Background())
 	if err != nil {
 		return nil, err
@@ -45,7 +66,11 @@ func New(conf *config.Config, pdClient pd.Client) (*tikv.Server, error) {
 	}
 
 	rm := tikv.NewStandAloneRegionManager(bundle, getRegionOptions(conf), pdClient)
-	return setupStandAlongInnerServer(bundle, safePoint, rm, pdClient, conf)
+	svr, err := setupStandAlongInnerServer(bundle, safePoint, rm, pdClient, conf)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{Server: svr, Services: &Services{}, Status: http.NewServeMux()}, nil
 }
 
 func getRegionOptions(conf *config.Config) tikv.RegionOptions {
@@ -56,7 +81,7 @@ func getRegionOptions(conf *config.Config) tikv.RegionOptions {
 	}
 }
 
-func setupRaftServer(bundle *mvcc.DBBundle, safePoint *tikv.SafePoint, pdClient pd.Client, conf *config.Config) (*tikv.Server, error) {
+func setupRaftServer(bundle *mvcc.DBBundle, safePoint *tikv.SafePoint, pdClient pd.Client, conf *config.Config) (*Store, error) {
 	dbPath := conf.Engine.DBPath
 	kvPath := filepath.Join(dbPath, "kv")
 	raftPath := filepath.Join(dbPath, "raft")
@@ -99,9 +124,39 @@ func setupRaftServer(bundle *mvcc.DBBundle, safePoint *tikv.SafePoint, pdClient
 	innerServer.Setup(pdClient)
 	router := innerServer.GetRaftstoreRouter()
 	storeMeta := innerServer.GetStoreMeta()
-	store := tikv.NewMVCCStore(&conf.Config, bundle, dbPath, safePoint, raftstore.NewDBWriter(conf, router), pdClient)
+	store := tikv.NewMVCCStore(&conf.Config, bundle, dbPath, safePoint, raftstore.NewDBWriter(conf, router),
+		router.MaxTSPDClient(pdClient))
 	rm := raftstore.NewRaftRegionManager(storeMeta, router, store.DeadlockDetectSvr)
 	innerServer.SetPeerEventObserver(rm)
+	readPool := innerServer.ReadPool()
+	status := http.NewServeMux()
+	// Expose the wait time of the reads in the queues of the read pool.
+	status.Handle("/read_pool/metrics", readPool)
+	// Expose snapshot metrics and lifecycle events on the status server.
+	status.Handle("/snapshot/stats", innerServer.GetSnapManager())
+	// Expose the sampled hot keys of the leader regions for hotspot diagnosis.
+	status.Handle("/regions/hotkeys", router)
+	// Expose the replication progress of the followers to find the straggling stores.
+	status.Handle("/regions/replication_lag", router.ReplicationLagHandler())
+	// Count the proposals and the reads dropped by raft by reason.
+	status.Handle("/regions/dropped_proposals", router.DroppedProposalsHandler())
+	// Count the invariant checks and the violations of the store.
+	status.Handle("/regions/invariants", router.InvariantStatsHandler())
+	// Inject faults into the admin proposals to reproduce the operator retry bugs.
+	status.Handle("/debug/admin_faults", router.AdminFaultHandler())
+	// Dump the message backlogs of the store to diagnose a stuck store.
+	status.Handle("/debug/backlog", router.BacklogHandler())
+	// Map the keys to the regions owning them at a time by the splits and the merges of the store.
+	status.Handle("/debug/region_history", router.RegionHistoryHandler())
+	// Verify the checksums of the snapshot files and the tables to ingest after transfers.
+	status.Handle("/debug/checksums", innerServer.GetSnapManager().VerifyChecksumHandler())
+	// Show or change the max leader lease of the peers at runtime.
+	status.Handle("/config/leader_lease", innerServer.LeaderLeaseHandler())
+	// Expose the replica state of a region, and compare it with the replicas on the other stores.
+	status.Handle("/regions/replica_state", router.ReplicaStateHandler())
+	status.Handle("/regions/consistency", router.RegionConsistencyHandler(raftstore.NewHTTPReplicaFetcher(pdClient)))
+	// Expose the LSM levels, the pending compactions and the file counts of the engines.
+	status.Handle("/engine/stats", innerServer.EngineStatsHandler())
 
 	if err := innerServer.Start(pdClient); err != nil {
 		return nil, err
@@ -109,7 +164,11 @@ func setupRaftServer(bundle *mvcc.DBBundle, safePoint *tikv.SafePoint, pdClient
 
 	store.StartDeadlockDetection(true)
 
-	return tikv.NewServer(rm, store, innerServer), nil
+	return &Store{
+		Server:   tikv.NewServer(rm, store, innerServer),
+		Services: &Services{RangeDestroyer: innerServer, ReadPool: readPool},
+		Status:   status,
+	}, nil
 }
 
 func setupStandAlongInnerServer(bundle *mvcc.DBBundle, safePoint *tikv.SafePoint, rm tikv.RegionManager, pdClient pd.Client, conf *config.Config) (*tikv.Server, error) {
@@ -129,17 +188,117 @@ func setupStandAlongInnerServer(bundle *mvcc.DBBundle, safePoint *tikv.SafePoint
 
 func setupRaftStoreConf(raftConf *raftstore.Config, conf *config.Config) {
 	raftConf.Addr = conf.Server.StoreAddr
+	raftConf.StatusAddr = conf.Server.StatusAddr
 
 	// raftstore block
 	raftConf.PdHeartbeatTickInterval = config.ParseDuration(conf.RaftStore.PdHeartbeatTickInterval)
+	if conf.RaftStore.RaftLogGCTickInterval != "" {
+		raftConf.RaftLogGCTickInterval = config.ParseDuration(conf.RaftStore.RaftLogGCTickInterval)
+	}
+	if conf.RaftStore.RaftLogGCThreshold > 0 {
+		raftConf.RaftLogGcThreshold = uint64(conf.RaftStore.RaftLogGCThreshold)
+	}
+	if conf.RaftStore.RaftLogGCCountLimit > 0 {
+		raftConf.RaftLogGcCountLimit = uint64(conf.RaftStore.RaftLogGCCountLimit)
+	}
+	if conf.RaftStore.RaftLogGCSizeLimit > 0 {
+		raftConf.RaftLogGcSizeLimit = uint64(conf.RaftStore.RaftLogGCSizeLimit)
+	}
+	if conf.RaftStore.PdStoreHeartbeatTickInterval != "" {
+		raftConf.PdStoreHeartbeatTickInterval = config.ParseDuration(conf.RaftStore.PdStoreHeartbeatTickInterval)
+	}
 	raftConf.RaftStoreMaxLeaderLease = config.ParseDuration(conf.RaftStore.RaftStoreMaxLeaderLease)
 	raftConf.RaftBaseTickInterval = config.ParseDuration(conf.RaftStore.RaftBaseTickInterval)
 	raftConf.RaftHeartbeatTicks = conf.RaftStore.RaftHeartbeatTicks
 	raftConf.RaftElectionTimeoutTicks = conf.RaftStore.RaftElectionTimeoutTicks
+	raftConf.RaftMinElectionTimeoutTicks = conf.RaftStore.RaftMinElectionTimeoutTicks
+	raftConf.RaftMaxElectionTimeoutTicks = conf.RaftStore.RaftMaxElectionTimeoutTicks
+	raftConf.ElectionPriority = conf.RaftStore.ElectionPriority
+	raftConf.RaftElectionGraceTicks = conf.RaftStore.RaftElectionGraceTicks
+	keys := make([]string, 0, len(conf.RaftStore.Labels))
+	for key := range conf.RaftStore.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		raftConf.Labels = append(raftConf.Labels, raftstore.StoreLabel{LabelKey: key, LabelValue: conf.RaftStore.Labels[key]})
+	}
+	raftConf.LocationLabels = conf.RaftStore.LocationLabels
+	raftConf.IsolationLevel = conf.RaftStore.IsolationLevel
+	raftConf.HibernateRegions = conf.RaftStore.HibernateRegions
+	if conf.RaftStore.HibernateIdleTicks > 0 {
+		raftConf.HibernateIdleTicks = conf.RaftStore.HibernateIdleTicks
+	}
+	if conf.RaftStore.PeerDebugLogRate > 0 {
+		raftConf.PeerDebugLogRate = conf.RaftStore.PeerDebugLogRate
+	} else if conf.RaftStore.PeerDebugLogRate < 0 {
+		raftConf.PeerDebugLogRate = 0
+	}
+	if conf.RaftStore.PeerDebugLogBurst > 0 {
+		raftConf.PeerDebugLogBurst = conf.RaftStore.PeerDebugLogBurst
+	}
+	raftConf.VerifyIngestChecksum = conf.RaftStore.VerifyIngestChecksum
+	if conf.RaftStore.SnapWaitersCapacity > 0 {
+		raftConf.SnapWaitersCapacity = conf.RaftStore.SnapWaitersCapacity
+	}
+	if conf.RaftStore.SnapWaitTimeout != "" {
+		raftConf.SnapWaitTimeout = config.ParseDuration(conf.RaftStore.SnapWaitTimeout)
+	}
+	raftConf.SnapGenLimit = conf.RaftStore.SnapGenLimit
+	raftConf.SnapRateLimit = conf.RaftStore.SnapRateLimit
+	raftConf.FailFastDroppedProposals = conf.RaftStore.FailFastDroppedProposals
+	raftConf.AsyncRaftLogWriters = conf.RaftStore.AsyncRaftLogWriters
+	if conf.RaftStore.RaftEntryCacheCapacity > 0 {
+		raftConf.RaftEntryCacheCapacity = uint64(conf.RaftStore.RaftEntryCacheCapacity)
+	} else if conf.RaftStore.RaftEntryCacheCapacity < 0 {
+		raftConf.RaftEntryCacheCapacity = 0
+	}
+	if conf.RaftStore.SnapGenLimitWindow != "" {
+		raftConf.SnapGenLimitWindow = config.ParseDuration(conf.RaftStore.SnapGenLimitWindow)
+	}
+	if conf.RaftStore.ReadPoolSize > 0 {
+		raftConf.ReadPoolSize = conf.RaftStore.ReadPoolSize
+	} else if conf.RaftStore.ReadPoolSize < 0 {
+		raftConf.ReadPoolSize = 0
+	}
+	raftConf.ReadPoolPointGetConcurrency = conf.RaftStore.ReadPoolPointGetConcurrency
+	if conf.RaftStore.ReadPoolScanConcurrency > 0 {
+		raftConf.ReadPoolScanConcurrency = conf.RaftStore.ReadPoolScanConcurrency
+	}
+	if conf.RaftStore.SafeTSUpdateInterval != "" {
+		raftConf.SafeTSUpdateInterval = config.ParseDuration(conf.RaftStore.SafeTSUpdateInterval)
+	}
+	raftConf.RaftAdaptiveFlowControl = conf.RaftStore.RaftAdaptiveFlowControl
+	if conf.RaftStore.RaftFlowTargetLatency != "" {
+		raftConf.RaftFlowTargetLatency = config.ParseDuration(conf.RaftStore.RaftFlowTargetLatency)
+	}
+	if conf.RaftStore.InvariantCheckInterval != "" {
+		raftConf.InvariantCheckInterval = config.ParseDuration(conf.RaftStore.InvariantCheckInterval)
+	}
+	raftConf.InvariantViolationMode = conf.RaftStore.InvariantViolationMode
+	if conf.RaftStore.LoadSplitQPSThreshold > 0 {
+		raftConf.LoadSplitQPSThreshold = uint64(conf.RaftStore.LoadSplitQPSThreshold)
+	} else if conf.RaftStore.LoadSplitQPSThreshold < 0 {
+		raftConf.LoadSplitQPSThreshold = 0
+	}
+	raftConf.PeerInitWorkers = conf.RaftStore.PeerInitWorkers
+	if conf.RaftStore.ApplyProfileSampleRate != 0 {
+		raftConf.ApplyProfileSampleRate = conf.RaftStore.ApplyProfileSampleRate
+	}
+	if conf.RaftStore.LoadSplitWindow != "" {
+		raftConf.LoadSplitWindow = config.ParseDuration(conf.RaftStore.LoadSplitWindow)
+	}
 
 	// coprocessor block
 	raftConf.SplitCheck.RegionMaxKeys = uint64(conf.Coprocessor.RegionMaxKeys)
 	raftConf.SplitCheck.RegionSplitKeys = uint64(conf.Coprocessor.RegionSplitKeys)
+	if conf.RaftStore.RegionSplitSize > 0 {
+		raftConf.SplitCheck.RegionSplitSize = uint64(conf.RaftStore.RegionSplitSize)
+		raftConf.SplitCheck.RegionMaxSize = raftConf.SplitCheck.RegionSplitSize / 2 * 3
+	}
+	if conf.RaftStore.RegionMaxSize > 0 {
+		raftConf.SplitCheck.RegionMaxSize = uint64(conf.RaftStore.RegionMaxSize)
+	}
 }
 
 func createDB(subPath string, safePoint *tikv.SafePoint, conf *tidbconfig.Engine) (*badger.DB, error) {